@@ -27,6 +27,8 @@ const (
 	CommandOkay    uint32 = 0x59414b4f
 	CommandClose   uint32 = 0x45534c43
 	CommandWrite   uint32 = 0x45545257
+	CommandAuth    uint32 = 0x48545541
+	CommandStls    uint32 = 0x534c5453
 )
 
 var ErrMessageTooShort = errors.New("adb message shorter than the header size")
@@ -39,7 +41,9 @@ func validateCommand(command uint32) error {
 		CommandOpen,
 		CommandOkay,
 		CommandClose,
-		CommandWrite:
+		CommandWrite,
+		CommandAuth,
+		CommandStls:
 		return nil
 	}
 	return fmt.Errorf("invalid command, not supported: %x", command)
@@ -0,0 +1,313 @@
+package adbtest
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ShellResult is what a scripted shell command prints and exits with.
+type ShellResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// TcpHandler serves one "tcp:<port>" stream opened on a Device, standing in
+// for whatever listens on that port on the device. conn is closed once it
+// returns.
+type TcpHandler func(conn net.Conn)
+
+// Device is a scripted fake device, served by a Server once added to it
+// (see Server.AddDevice). It services:
+//   - "shell:", "exec:" and "shell,v2,...:" commands: the ones scripted with
+//     HandleShell, plus built-in "getprop <name>" (see SetProperty) and
+//     "echo"; several commands may be chained with ";".
+//   - "sync:": STAT, LIST, SEND, RECV and QUIT against an in-memory file
+//     system (see SetFile and File).
+//   - "tcp:<port>": the handler registered with HandleTcp.
+//
+// The exported fields describe the device in the device list and must not
+// change once it's added to a Server.
+type Device struct {
+	Serial     string
+	Product    string
+	Model      string
+	DeviceName string
+	Features   []string
+
+	mutex      sync.Mutex
+	properties map[string]string
+	commands   map[string]ShellResult
+	files      map[string][]byte
+	tcp        map[string]TcpHandler
+}
+
+// fileMode is the mode every file of a Device's file system has: a regular
+// file, rw-r--r--.
+const fileMode = 0o100644
+
+// NewDevice returns a device named serial that looks like a current
+// emulator image, with an empty file system and no scripted commands.
+func NewDevice(serial string) *Device {
+	return &Device{
+		Serial:     serial,
+		Product:    "sdk_gphone64_arm64",
+		Model:      "sdk_gphone64_arm64",
+		DeviceName: "emu64a",
+		Features:   []string{"shell_v2", "cmd", "stat_v2", "ls_v2", "fixed_push_mkdir", "abb", "abb_exec", "sendrecv_v2"},
+		properties: map[string]string{
+			"ro.product.manufacturer":  "Google",
+			"ro.build.version.release": "14",
+			"ro.product.cpu.abi":       "arm64-v8a",
+		},
+		commands: make(map[string]ShellResult),
+		files:    make(map[string][]byte),
+		tcp:      make(map[string]TcpHandler),
+	}
+}
+
+// SetProperty sets what "getprop name" prints.
+func (d *Device) SetProperty(name string, value string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.properties[name] = value
+}
+
+// HandleShell scripts what command, matched exactly, prints and exits with.
+func (d *Device) HandleShell(command string, result ShellResult) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.commands[command] = result
+}
+
+// HandleTcp has "tcp:<port>" streams served by handler.
+func (d *Device) HandleTcp(port string, handler TcpHandler) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.tcp[port] = handler
+}
+
+// SetFile stores content at path in the device's file system.
+func (d *Device) SetFile(path string, content []byte) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.files[path] = append([]byte{}, content...)
+}
+
+// File returns the content stored at path, e.g. by an "adb push".
+func (d *Device) File(path string) ([]byte, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	content, ok := d.files[path]
+	return append([]byte{}, content...), ok
+}
+
+// open returns what serves service's stream, or why the device can't.
+func (d *Device) open(service string) (func(conn net.Conn), error) {
+	switch {
+	case service == "sync:":
+		return d.serveSync, nil
+	case strings.HasPrefix(service, "tcp:"):
+		port := strings.TrimPrefix(service, "tcp:")
+		d.mutex.Lock()
+		handler, ok := d.tcp[port]
+		d.mutex.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("connection refused on tcp:%s", port)
+		}
+		return func(conn net.Conn) { handler(conn) }, nil
+	case strings.HasPrefix(service, "shell:"), strings.HasPrefix(service, "exec:"):
+		_, command, _ := strings.Cut(service, ":")
+		if command == "" {
+			return nil, errors.New("interactive shells aren't scripted")
+		}
+		return func(conn net.Conn) {
+			result := d.run(command)
+			_, _ = io.WriteString(conn, result.Stdout+result.Stderr)
+		}, nil
+	case strings.HasPrefix(service, "shell,"):
+		options, command, _ := strings.Cut(strings.TrimPrefix(service, "shell,"), ":")
+		if !strings.Contains(","+options+",", ",v2,") {
+			return nil, fmt.Errorf("unsupported shell options %q", options)
+		}
+		if command == "" {
+			return nil, errors.New("interactive shells aren't scripted")
+		}
+		return func(conn net.Conn) {
+			result := d.run(command)
+			if result.Stdout != "" {
+				_ = adb.WriteShellV2Packet(conn, adb.ShellV2Stdout, []byte(result.Stdout))
+			}
+			if result.Stderr != "" {
+				_ = adb.WriteShellV2Packet(conn, adb.ShellV2Stderr, []byte(result.Stderr))
+			}
+			_ = adb.WriteShellV2Packet(conn, adb.ShellV2Exit, []byte{byte(result.ExitCode)})
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown service %q", service)
+}
+
+// run runs command, a ";"-separated chain of commands, returning their
+// combined output and the last one's exit code.
+func (d *Device) run(command string) ShellResult {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if result, ok := d.commands[command]; ok {
+		return result
+	}
+	var combined ShellResult
+	for _, single := range strings.Split(command, ";") {
+		result := d.runSingle(strings.TrimSpace(single))
+		combined.Stdout += result.Stdout
+		combined.Stderr += result.Stderr
+		combined.ExitCode = result.ExitCode
+	}
+	return combined
+}
+
+func (d *Device) runSingle(command string) ShellResult {
+	if result, ok := d.commands[command]; ok {
+		return result
+	}
+	name, argument, _ := strings.Cut(command, " ")
+	switch name {
+	case "getprop":
+		return ShellResult{Stdout: d.properties[argument] + "\n"}
+	case "echo":
+		return ShellResult{Stdout: argument + "\n"}
+	}
+	return ShellResult{Stderr: fmt.Sprintf("/system/bin/sh: %s: inaccessible or not found\n", name), ExitCode: 127}
+}
+
+// serveSync answers sync requests on conn until QUIT or an error.
+func (d *Device) serveSync(conn net.Conn) {
+	for {
+		id, argument, err := adb.ReadSyncHeader(conn)
+		if err != nil {
+			return
+		}
+		if id == adb.SyncQuit {
+			return
+		}
+		if argument > adb.SyncMaxPathLength {
+			_ = adb.WriteSyncRequest(conn, adb.SyncFail, []byte("path too long"))
+			return
+		}
+		path := make([]byte, argument)
+		if _, err := io.ReadFull(conn, path); err != nil {
+			return
+		}
+		switch id {
+		case adb.SyncStat:
+			err = d.syncStat(conn, string(path))
+		case adb.SyncList:
+			err = d.syncList(conn, string(path))
+		case adb.SyncRecv:
+			err = d.syncRecv(conn, string(path))
+		case adb.SyncSend:
+			err = d.syncSend(conn, string(path))
+		default:
+			_ = adb.WriteSyncRequest(conn, adb.SyncFail, []byte(fmt.Sprintf("unsupported sync request %q", id)))
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (d *Device) syncStat(conn net.Conn, path string) error {
+	content, ok := d.File(path)
+	response := make([]byte, 16)
+	copy(response, adb.SyncStat)
+	if ok {
+		binary.LittleEndian.PutUint32(response[4:8], fileMode)
+		binary.LittleEndian.PutUint32(response[8:12], uint32(len(content)))
+	}
+	_, err := conn.Write(response)
+	return err
+}
+
+func (d *Device) syncList(conn net.Conn, path string) error {
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	d.mutex.Lock()
+	var names []string
+	sizes := make(map[string]int)
+	for filePath, content := range d.files {
+		name, ok := strings.CutPrefix(filePath, prefix)
+		if ok && name != "" && !strings.Contains(name, "/") {
+			names = append(names, name)
+			sizes[name] = len(content)
+		}
+	}
+	d.mutex.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		entry := make([]byte, 20+len(name))
+		copy(entry, adb.SyncDent)
+		binary.LittleEndian.PutUint32(entry[4:8], fileMode)
+		binary.LittleEndian.PutUint32(entry[8:12], uint32(sizes[name]))
+		binary.LittleEndian.PutUint32(entry[16:20], uint32(len(name)))
+		copy(entry[20:], name)
+		if _, err := conn.Write(entry); err != nil {
+			return err
+		}
+	}
+	done := make([]byte, 20)
+	copy(done, adb.SyncDone)
+	_, err := conn.Write(done)
+	return err
+}
+
+func (d *Device) syncRecv(conn net.Conn, path string) error {
+	content, ok := d.File(path)
+	if !ok {
+		return adb.WriteSyncRequest(conn, adb.SyncFail, []byte(fmt.Sprintf("remote object '%s' does not exist", path)))
+	}
+	for len(content) > 0 {
+		chunk := content[:min(len(content), adb.SyncMaxDataLength)]
+		if err := adb.WriteSyncRequest(conn, adb.SyncData, chunk); err != nil {
+			return err
+		}
+		content = content[len(chunk):]
+	}
+	return adb.WriteSyncHeader(conn, adb.SyncDone, 0)
+}
+
+// syncSend receives a pushed file. request is SEND's "<path>,<mode>".
+func (d *Device) syncSend(conn net.Conn, request string) error {
+	path := request
+	if comma := strings.LastIndex(request, ","); comma >= 0 {
+		path = request[:comma]
+	}
+	var content []byte
+	for {
+		id, argument, err := adb.ReadSyncHeader(conn)
+		if err != nil {
+			return err
+		}
+		switch id {
+		case adb.SyncData:
+			if argument > adb.SyncMaxDataLength {
+				return adb.WriteSyncRequest(conn, adb.SyncFail, []byte("data chunk too large"))
+			}
+			chunk := make([]byte, argument)
+			if _, err := io.ReadFull(conn, chunk); err != nil {
+				return err
+			}
+			content = append(content, chunk...)
+		case adb.SyncDone:
+			d.SetFile(path, content)
+			return adb.WriteSyncHeader(conn, adb.SyncOkay, 0)
+		default:
+			return adb.WriteSyncRequest(conn, adb.SyncFail, []byte(fmt.Sprintf("unexpected %q during SEND", id)))
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package adbtest
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// hostTimeout bounds every helper below, so a stuck relay fails the test
+// instead of hanging it.
+const hostTimeout = 10 * time.Second
+
+// Shell runs command on serial over shell_v2, the way "adb shell" does, and
+// returns what it printed and exited with.
+func Shell(smartSocket adb.IAdbSmartSocket, serial string, command string) (ShellResult, error) {
+	conn, err := smartSocket.OpenStream(serial, "shell,v2,raw:"+command)
+	if err != nil {
+		return ShellResult{}, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(hostTimeout))
+	var stdout, stderr bytes.Buffer
+	for {
+		packet, err := adb.ReadShellV2Packet(conn)
+		if err != nil {
+			return ShellResult{}, fmt.Errorf("shell %q ended without an exit code: %w", command, err)
+		}
+		switch packet.Id {
+		case adb.ShellV2Stdout:
+			stdout.Write(packet.Data)
+		case adb.ShellV2Stderr:
+			stderr.Write(packet.Data)
+		case adb.ShellV2Exit:
+			if len(packet.Data) != 1 {
+				return ShellResult{}, fmt.Errorf("shell %q sent a malformed exit packet", command)
+			}
+			return ShellResult{Stdout: stdout.String(), Stderr: stderr.String(), ExitCode: int(packet.Data[0])}, nil
+		}
+	}
+}
+
+// Push writes content to path on serial over the sync protocol, the way
+// "adb push" does.
+func Push(smartSocket adb.IAdbSmartSocket, serial string, path string, content []byte) error {
+	conn, err := smartSocket.OpenStream(serial, "sync:")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(hostTimeout))
+	if err := adb.WriteSyncRequest(conn, adb.SyncSend, []byte(fmt.Sprintf("%s,%d", path, fileMode))); err != nil {
+		return err
+	}
+	for remaining := content; len(remaining) > 0; {
+		chunk := remaining[:min(len(remaining), adb.SyncMaxDataLength)]
+		if err := adb.WriteSyncRequest(conn, adb.SyncData, chunk); err != nil {
+			return err
+		}
+		remaining = remaining[len(chunk):]
+	}
+	if err := adb.WriteSyncHeader(conn, adb.SyncDone, uint32(time.Now().Unix())); err != nil {
+		return err
+	}
+	id, argument, err := adb.ReadSyncHeader(conn)
+	if err != nil {
+		return err
+	}
+	if id != adb.SyncOkay {
+		return syncFailure(conn, id, argument)
+	}
+	return adb.WriteSyncHeader(conn, adb.SyncQuit, 0)
+}
+
+// Pull reads path from serial over the sync protocol, the way "adb pull"
+// does.
+func Pull(smartSocket adb.IAdbSmartSocket, serial string, path string) ([]byte, error) {
+	conn, err := smartSocket.OpenStream(serial, "sync:")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(hostTimeout))
+	if err := adb.WriteSyncRequest(conn, adb.SyncRecv, []byte(path)); err != nil {
+		return nil, err
+	}
+	var content bytes.Buffer
+	for {
+		id, argument, err := adb.ReadSyncHeader(conn)
+		if err != nil {
+			return nil, err
+		}
+		switch id {
+		case adb.SyncData:
+			if argument > adb.SyncMaxDataLength {
+				return nil, fmt.Errorf("DATA chunk of %d bytes is too large", argument)
+			}
+			if _, err := io.CopyN(&content, conn, int64(argument)); err != nil {
+				return nil, err
+			}
+		case adb.SyncDone:
+			return content.Bytes(), adb.WriteSyncHeader(conn, adb.SyncQuit, 0)
+		default:
+			return nil, syncFailure(conn, id, argument)
+		}
+	}
+}
+
+// syncFailure turns an unexpected sync response into an error, reading a
+// FAIL's message.
+func syncFailure(conn io.Reader, id string, argument uint32) error {
+	if id != adb.SyncFail || argument > adb.SyncMaxPathLength {
+		return fmt.Errorf("unexpected sync response %q", id)
+	}
+	message := make([]byte, argument)
+	if _, err := io.ReadFull(conn, message); err != nil {
+		return err
+	}
+	return errors.New(string(message))
+}
@@ -0,0 +1,481 @@
+// Package adbtest provides a fake adb server, and scripted fake devices for
+// it to serve, for hermetic tests of everything that talks to an adb
+// server: the server speaks the smartsocket host protocol the real one
+// does, and can "adb connect" to an ADB wire protocol endpoint (such as an
+// adb.AdbProxy) the way the real one does, so a test can drive real ADB
+// traffic end to end without an emulator. Not for production use.
+package adbtest
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hostVersion is what "host:version" reports, adb's own server version.
+const hostVersion = 41
+
+// hostKeyComment is the user@host a fake server's key is labelled with.
+const hostKeyComment = "adbtest@localhost"
+
+// sharedHostKey is every fake server's adb key unless told otherwise, the
+// way every adb server of a user shares ~/.android/adbkey; generating one
+// per server would slow tests down.
+var sharedHostKey = sync.OnceValue(func() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(fmt.Sprintf("adbtest: failed to generate an adb key: %s", err))
+	}
+	return key
+})
+
+// Server is a fake adb server listening on a local TCP port. It serves
+// devices added with AddDevice, and devices it's told to "adb connect" to,
+// whose serial is then the address it connected to.
+type Server struct {
+	listener net.Listener
+
+	mutex   sync.Mutex
+	devices []*serverDevice
+	// changed is closed, and replaced, whenever the device list changes.
+	changed         chan struct{}
+	nextTransportId int
+	// connections are every host connection still open, closed when the
+	// test ends so no goroutine outlives it.
+	connections map[net.Conn]struct{}
+	// key is what the server authenticates to devices it connects to with.
+	key *rsa.PrivateKey
+}
+
+// serverDevice is one entry of a Server's device list.
+type serverDevice struct {
+	serial      string
+	state       string
+	product     string
+	model       string
+	device      string
+	transportId int
+	features    []string
+	// open returns what serves a stream for service, or why the device
+	// can't.
+	open func(service string) (func(conn net.Conn), error)
+	// connected is set for a device the server "adb connect"ed to, and
+	// wire once its handshake completed.
+	connected bool
+	wire      *wireTransport
+}
+
+// NewServer starts a fake adb server on 127.0.0.1, shut down when t ends.
+func NewServer(t *testing.T) *Server {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("adbtest: failed to start the fake adb server: %s", err)
+	}
+	s := &Server{
+		listener:    listener,
+		changed:     make(chan struct{}),
+		connections: make(map[net.Conn]struct{}),
+		key:         sharedHostKey(),
+	}
+	go s.accept()
+	t.Cleanup(s.close)
+	return s
+}
+
+// Address returns the server's address, for adb.NewAdbSmartSocket.
+func (s *Server) Address() string {
+	return s.listener.Addr().String()
+}
+
+// SetKey has the server authenticate with key, a 2048-bit RSA key, to
+// devices it connects to from now on.
+func (s *Server) SetKey(key *rsa.PrivateKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.key = key
+}
+
+// PublicKey returns the public half of the server's adb key, the way its
+// adbkey.pub holds it.
+func (s *Server) PublicKey() *adb.PublicKey {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key, err := adb.NewPublicKey(&s.key.PublicKey, hostKeyComment)
+	if err != nil {
+		panic(fmt.Sprintf("adbtest: unusable adb key: %s", err))
+	}
+	return key
+}
+
+// AddDevice plugs device in, online.
+func (s *Server) AddDevice(device *Device) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nextTransportId++
+	s.devices = append(s.devices, &serverDevice{
+		serial:      device.Serial,
+		state:       adb.TypeDevice,
+		product:     device.Product,
+		model:       device.Model,
+		device:      device.DeviceName,
+		transportId: s.nextTransportId,
+		features:    device.Features,
+		open:        device.open,
+	})
+	s.notifyLocked()
+}
+
+// SetState changes serial's state, e.g. to "offline" or "unauthorized".
+// Streams can only be opened on a device in the "device" state.
+func (s *Server) SetState(serial string, state string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if device := s.findLocked(serial); device != nil {
+		device.state = state
+		s.notifyLocked()
+	}
+}
+
+// RemoveDevice unplugs serial.
+func (s *Server) RemoveDevice(serial string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, device := range s.devices {
+		if device.serial == serial {
+			s.devices = append(s.devices[:i], s.devices[i+1:]...)
+			if device.wire != nil {
+				go device.wire.close()
+			}
+			s.notifyLocked()
+			return
+		}
+	}
+}
+
+// Devices returns the device list, as "adb devices -l" reports it.
+func (s *Server) Devices() []adb.Device {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	devices := make([]adb.Device, len(s.devices))
+	for i, device := range s.devices {
+		devices[i] = adb.Device{
+			Id:          device.serial,
+			Type:        device.state,
+			Product:     device.product,
+			Model:       device.model,
+			Device:      device.device,
+			TransportId: strconv.Itoa(device.transportId),
+		}
+	}
+	return devices
+}
+
+// TLSCertificate returns the certificate of the device the server "adb
+// connect"ed to as serial, or nil unless that connection was upgraded to
+// TLS.
+func (s *Server) TLSCertificate(serial string) *x509.Certificate {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	device := s.findLocked(serial)
+	if device == nil || device.wire == nil {
+		return nil
+	}
+	return device.wire.tlsCertificate
+}
+
+// WaitForState waits up to timeout for serial to be listed in state.
+func (s *Server) WaitForState(serial string, state string, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		s.mutex.Lock()
+		device := s.findLocked(serial)
+		current := ""
+		if device != nil {
+			current = device.state
+		}
+		changed := s.changed
+		s.mutex.Unlock()
+		if current == state {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return fmt.Errorf("adbtest: %s is %q, not %q, after %s", serial, current, state, timeout)
+		}
+	}
+}
+
+func (s *Server) findLocked(serial string) *serverDevice {
+	for _, device := range s.devices {
+		if device.serial == serial {
+			return device
+		}
+	}
+	return nil
+}
+
+func (s *Server) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) close() {
+	_ = s.listener.Close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for conn := range s.connections {
+		_ = conn.Close()
+	}
+	for _, device := range s.devices {
+		if device.wire != nil {
+			go device.wire.close()
+		}
+	}
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.connections[conn] = struct{}{}
+		s.mutex.Unlock()
+		go func() {
+			defer func() {
+				s.mutex.Lock()
+				delete(s.connections, conn)
+				s.mutex.Unlock()
+				_ = conn.Close()
+			}()
+			s.serve(conn)
+		}()
+	}
+}
+
+// serve answers one host connection's request.
+func (s *Server) serve(conn net.Conn) {
+	request, err := readRequest(conn)
+	if err != nil {
+		return
+	}
+	switch {
+	case request == "host:version":
+		writeOkay(conn, fmt.Sprintf("%04x", hostVersion))
+	case request == "host:devices", request == "host:devices-l":
+		writeOkay(conn, s.deviceList(request == "host:devices-l"))
+	case request == "host:track-devices", request == "host:track-devices-l":
+		s.trackDevices(conn, request == "host:track-devices-l")
+	case strings.HasPrefix(request, "host-serial:") && strings.HasSuffix(request, ":features"):
+		serial := strings.TrimSuffix(strings.TrimPrefix(request, "host-serial:"), ":features")
+		s.mutex.Lock()
+		device := s.findLocked(serial)
+		var features string
+		if device != nil {
+			features = strings.Join(device.features, ",")
+		}
+		s.mutex.Unlock()
+		if device == nil {
+			writeFail(conn, fmt.Sprintf("device '%s' not found", serial))
+			return
+		}
+		writeOkay(conn, features)
+	case strings.HasPrefix(request, "host:transport:"):
+		s.transport(conn, strings.TrimPrefix(request, "host:transport:"))
+	case strings.HasPrefix(request, "host:connect:"):
+		s.connect(conn, strings.TrimPrefix(request, "host:connect:"))
+	case strings.HasPrefix(request, "host:disconnect:"):
+		address := strings.TrimPrefix(request, "host:disconnect:")
+		s.mutex.Lock()
+		device := s.findLocked(address)
+		s.mutex.Unlock()
+		if device == nil || !device.connected {
+			writeFail(conn, fmt.Sprintf("no such device '%s'", address))
+			return
+		}
+		s.RemoveDevice(address)
+		writeOkay(conn, "disconnected "+address)
+	default:
+		writeFail(conn, fmt.Sprintf("unknown host service %q", request))
+	}
+}
+
+func (s *Server) deviceList(long bool) string {
+	var body strings.Builder
+	for _, device := range s.Devices() {
+		if !long {
+			fmt.Fprintf(&body, "%s\t%s\n", device.Id, device.Type)
+			continue
+		}
+		fmt.Fprintf(&body, "%-22s %s", device.Id, device.Type)
+		for _, detail := range [][2]string{{"product", device.Product}, {"model", device.Model}, {"device", device.Device}} {
+			if detail[1] != "" {
+				fmt.Fprintf(&body, " %s:%s", detail[0], detail[1])
+			}
+		}
+		fmt.Fprintf(&body, " transport_id:%s\n", device.TransportId)
+	}
+	return body.String()
+}
+
+// trackDevices reports the device list now and on every change, until the
+// host disconnects.
+func (s *Server) trackDevices(conn net.Conn, long bool) {
+	if _, err := io.WriteString(conn, "OKAY"); err != nil {
+		return
+	}
+	gone := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+	for {
+		s.mutex.Lock()
+		changed := s.changed
+		s.mutex.Unlock()
+		body := s.deviceList(long)
+		if _, err := fmt.Fprintf(conn, "%04x%s", len(body), body); err != nil {
+			return
+		}
+		select {
+		case <-changed:
+		case <-gone:
+			return
+		}
+	}
+}
+
+// transport selects serial for the request that follows, then serves it.
+func (s *Server) transport(conn net.Conn, serial string) {
+	s.mutex.Lock()
+	device := s.findLocked(serial)
+	var state string
+	var open func(service string) (func(conn net.Conn), error)
+	if device != nil {
+		state, open = device.state, device.open
+	}
+	s.mutex.Unlock()
+	if device == nil {
+		writeFail(conn, fmt.Sprintf("device '%s' not found", serial))
+		return
+	}
+	if state != adb.TypeDevice {
+		writeFail(conn, fmt.Sprintf("device %s", state))
+		return
+	}
+	if _, err := io.WriteString(conn, "OKAY"); err != nil {
+		return
+	}
+	service, err := readRequest(conn)
+	if err != nil {
+		return
+	}
+	serveStream, err := open(service)
+	if err != nil {
+		writeFail(conn, err.Error())
+		return
+	}
+	if _, err := io.WriteString(conn, "OKAY"); err != nil {
+		return
+	}
+	serveStream(conn)
+}
+
+// connect "adb connect"s address: it's listed as offline until it answers
+// the CNXN handshake (or as unauthorized while it decides whether to accept
+// the server's key), then as a device whose streams are relayed over the
+// ADB wire protocol.
+func (s *Server) connect(conn net.Conn, address string) {
+	s.mutex.Lock()
+	existing := s.findLocked(address)
+	s.mutex.Unlock()
+	if existing != nil {
+		writeOkay(conn, "already connected to "+address)
+		return
+	}
+	deviceConn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		writeFail(conn, fmt.Sprintf("failed to connect to %s: %s", address, err))
+		return
+	}
+	s.mutex.Lock()
+	s.nextTransportId++
+	device := &serverDevice{serial: address, state: adb.TypeDisconnected, transportId: s.nextTransportId, connected: true}
+	s.devices = append(s.devices, device)
+	s.notifyLocked()
+	key := s.key
+	s.mutex.Unlock()
+	writeOkay(conn, "connected to "+address)
+
+	go func() {
+		wire, banner, err := dialWire(deviceConn, key, func() {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			if s.findLocked(address) == device {
+				device.state = adb.TypeUnauthorized
+				s.notifyLocked()
+			}
+		})
+		if err != nil {
+			_ = deviceConn.Close()
+			s.RemoveDevice(address)
+			return
+		}
+		properties, features := parseBanner(banner)
+		s.mutex.Lock()
+		if s.findLocked(address) != device {
+			s.mutex.Unlock()
+			wire.close()
+			return
+		}
+		device.state = adb.TypeDevice
+		device.product = properties["ro.product.name"]
+		device.model = properties["ro.product.model"]
+		device.device = properties["ro.product.device"]
+		device.features = features
+		device.wire = wire
+		device.open = wire.open
+		s.notifyLocked()
+		s.mutex.Unlock()
+
+		<-wire.closed
+		s.RemoveDevice(address)
+	}()
+}
+
+// readRequest reads one length-prefixed smartsocket request.
+func readRequest(conn net.Conn) (string, error) {
+	lengthBuffer := make([]byte, 4)
+	if _, err := io.ReadFull(conn, lengthBuffer); err != nil {
+		return "", err
+	}
+	length, err := strconv.ParseUint(string(lengthBuffer), 16, 16)
+	if err != nil {
+		return "", err
+	}
+	request := make([]byte, length)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	return string(request), nil
+}
+
+func writeOkay(conn net.Conn, body string) {
+	_, _ = fmt.Fprintf(conn, "OKAY%04x%s", len(body), body)
+}
+
+func writeFail(conn net.Conn, message string) {
+	_, _ = fmt.Fprintf(conn, "FAIL%04x%s", len(message), message)
+}
@@ -0,0 +1,302 @@
+package adbtest
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSmartSocket(server *Server) adb.IAdbSmartSocket {
+	return adb.NewAdbSmartSocket(server.Address(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestServerListsDevicesAndFeatures(t *testing.T) {
+	server := NewServer(t)
+	device := NewDevice("emulator-5554")
+	device.Model = "Pixel_7"
+	server.AddDevice(device)
+	smartSocket := newTestSmartSocket(server)
+
+	devices, err := smartSocket.DeviceList()
+	if err != nil {
+		t.Fatalf("DeviceList failed: %s", err)
+	}
+	if len(devices) != 1 || devices[0].Id != "emulator-5554" || devices[0].Type != adb.TypeDevice || devices[0].Model != "Pixel_7" {
+		t.Fatalf("unexpected device list: %+v", devices)
+	}
+	features, err := smartSocket.Features("emulator-5554")
+	if err != nil {
+		t.Fatalf("Features failed: %s", err)
+	}
+	if strings.Join(features, ",") != strings.Join(device.Features, ",") {
+		t.Fatalf("expected features %q, got %q", device.Features, features)
+	}
+	info, err := adb.QueryDeviceInfo(smartSocket, devices[0])
+	if err != nil {
+		t.Fatalf("QueryDeviceInfo failed: %s", err)
+	}
+	if info.Manufacturer != "Google" || info.AndroidVersion != "14" || info.Abi != "arm64-v8a" {
+		t.Fatalf("unexpected device info: %+v", info)
+	}
+}
+
+func TestServerServesScriptedDevice(t *testing.T) {
+	server := NewServer(t)
+	device := NewDevice("emulator-5554")
+	device.HandleShell("false", ShellResult{Stderr: "nope\n", ExitCode: 1})
+	device.HandleTcp("8080", func(conn net.Conn) { _, _ = io.Copy(conn, conn) })
+	server.AddDevice(device)
+	smartSocket := newTestSmartSocket(server)
+
+	result, err := Shell(smartSocket, "emulator-5554", "echo hello")
+	if err != nil {
+		t.Fatalf("Shell failed: %s", err)
+	}
+	if result != (ShellResult{Stdout: "hello\n"}) {
+		t.Fatalf("unexpected echo result: %+v", result)
+	}
+	if result, err = Shell(smartSocket, "emulator-5554", "false"); err != nil || result.ExitCode != 1 || result.Stderr != "nope\n" {
+		t.Fatalf("unexpected scripted result: %+v (%v)", result, err)
+	}
+
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	if err := Push(smartSocket, "emulator-5554", "/sdcard/data.bin", content); err != nil {
+		t.Fatalf("Push failed: %s", err)
+	}
+	if stored, ok := device.File("/sdcard/data.bin"); !ok || !bytes.Equal(stored, content) {
+		t.Fatalf("expected the pushed file to be stored")
+	}
+	pulled, err := Pull(smartSocket, "emulator-5554", "/sdcard/data.bin")
+	if err != nil {
+		t.Fatalf("Pull failed: %s", err)
+	}
+	if !bytes.Equal(pulled, content) {
+		t.Fatalf("expected to pull back the %d pushed bytes, got %d", len(content), len(pulled))
+	}
+	if _, err := Pull(smartSocket, "emulator-5554", "/sdcard/missing"); err == nil {
+		t.Fatalf("expected pulling a missing file to fail")
+	}
+
+	conn, err := smartSocket.OpenStream("emulator-5554", "tcp:8080")
+	if err != nil {
+		t.Fatalf("OpenStream(tcp:8080) failed: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("expected the tcp handler to echo, got %q (%v)", reply, err)
+	}
+	if _, err := smartSocket.OpenStream("emulator-5554", "tcp:9999"); err == nil {
+		t.Fatalf("expected a stream to an unhandled port to fail")
+	}
+}
+
+func TestServerRefusesStreamsOnOfflineDevice(t *testing.T) {
+	server := NewServer(t)
+	server.AddDevice(NewDevice("emulator-5554"))
+	server.SetState("emulator-5554", adb.TypeDisconnected)
+	if _, err := Shell(newTestSmartSocket(server), "emulator-5554", "echo hi"); err == nil || !strings.Contains(err.Error(), "offline") {
+		t.Fatalf("expected an offline error, got %v", err)
+	}
+}
+
+func TestServerTracksDevices(t *testing.T) {
+	server := NewServer(t)
+	server.AddDevice(NewDevice("emulator-5554"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates, err := newTestSmartSocket(server).TrackDevices(ctx)
+	if err != nil {
+		t.Fatalf("TrackDevices failed: %s", err)
+	}
+	expectUpdate := func(want string) {
+		t.Helper()
+		select {
+		case devices := <-updates:
+			if len(devices) != 1 || devices[0].Type != want {
+				t.Fatalf("expected emulator-5554 to be %s, got %+v", want, devices)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for a device list update")
+		}
+	}
+	expectUpdate(adb.TypeDevice)
+	server.SetState("emulator-5554", adb.TypeDisconnected)
+	expectUpdate(adb.TypeDisconnected)
+}
+
+// TestServerConnectsToAdbProxy has the server "adb connect" to a real
+// AdbProxy and relay a stream over it, with this test answering for the
+// device behind the proxy.
+func TestServerConnectsToAdbProxy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve a port: %s", err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	_ = listener.Close()
+	proxy := adb.NewAdbProxy("tcp", "127.0.0.1:"+port, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	proxy.SetDeviceInfo(adb.DeviceInfo{Product: "panther", Model: "Pixel_7", Device: "panther"})
+	server := NewServer(t)
+	keys, _ := adb.LoadAuthorizedKeys("")
+	keys.Allow(server.PublicKey())
+	proxy.SetAuthorization(keys, nil)
+	if err := proxy.Start("ROOM1"); err != nil {
+		t.Fatalf("proxy Start failed: %s", err)
+	}
+	defer proxy.Stop()
+
+	smartSocket := newTestSmartSocket(server)
+	serial := "127.0.0.1:" + port
+	if err := smartSocket.Connect(serial); err != nil {
+		t.Fatalf("Connect failed: %s", err)
+	}
+	var deviceSide net.Conn
+	select {
+	case deviceSide = <-proxy.Connections():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for the server's handshake")
+	}
+	defer deviceSide.Close()
+	if err := server.WaitForState(serial, adb.TypeDevice, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if devices := server.Devices(); devices[0].Model != "Pixel_7" {
+		t.Fatalf("expected the banner's model to be listed, got %+v", devices[0])
+	}
+
+	// Answer the OPEN, send a reply and close, as a device would.
+	go func() {
+		message := adb.CreateMessage()
+		if err := message.Read(deviceSide); err != nil || message.Command() != adb.CommandOpen {
+			t.Errorf("expected an OPEN, got %v", err)
+			return
+		}
+		hostId := message.Arg1()
+		for _, reply := range []struct {
+			command uint32
+			data    []byte
+		}{{adb.CommandOkay, nil}, {adb.CommandWrite, []byte("hi")}, {adb.CommandClose, nil}} {
+			_ = message.Set(reply.command, 7, hostId, reply.data)
+			_ = message.Write(deviceSide)
+		}
+	}()
+	conn, err := smartSocket.OpenStream(serial, "tcp:1234")
+	if err != nil {
+		t.Fatalf("OpenStream failed: %s", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	output, err := io.ReadAll(conn)
+	if err != nil || string(output) != "hi" {
+		t.Fatalf("expected to read %q until the device closed the stream, got %q (%v)", "hi", output, err)
+	}
+
+	if err := smartSocket.Disconnect(serial); err != nil {
+		t.Fatalf("Disconnect failed: %s", err)
+	}
+	if len(server.Devices()) != 0 {
+		t.Fatalf("expected the device to be gone after disconnecting")
+	}
+}
+
+// TestServerIsUnauthorizedUntilItsKeyIsApproved has the server "adb
+// connect" to an AdbProxy that doesn't know its key, and checks that it's
+// listed as unauthorized until the proxy approves the key it offers.
+func TestServerIsUnauthorizedUntilItsKeyIsApproved(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve a port: %s", err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	_ = listener.Close()
+	proxy := adb.NewAdbProxy("tcp", "127.0.0.1:"+port, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	keys, _ := adb.LoadAuthorizedKeys("")
+	offered := make(chan *adb.PublicKey, 1)
+	approve := make(chan bool)
+	proxy.SetAuthorization(keys, func(ctx context.Context, key *adb.PublicKey) (bool, bool) {
+		offered <- key
+		return <-approve, false
+	})
+	if err := proxy.Start("ROOM1"); err != nil {
+		t.Fatalf("proxy Start failed: %s", err)
+	}
+	defer proxy.Stop()
+
+	server := NewServer(t)
+	serial := "127.0.0.1:" + port
+	if err := newTestSmartSocket(server).Connect(serial); err != nil {
+		t.Fatalf("Connect failed: %s", err)
+	}
+	if err := server.WaitForState(serial, adb.TypeUnauthorized, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if key := <-offered; key.String() != server.PublicKey().String() {
+		t.Fatalf("expected the server to offer its own key, got %q", key)
+	}
+	approve <- true
+	if err := server.WaitForState(serial, adb.TypeDevice, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case conn := <-proxy.Connections():
+		_ = conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for the handshaked connection")
+	}
+}
+
+// TestServerConnectsToAdbProxyOverTLS has the server "adb connect" to an
+// AdbProxy that upgrades connections with STLS.
+func TestServerConnectsToAdbProxyOverTLS(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve a port: %s", err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	_ = listener.Close()
+	_, owner, _ := ed25519.GenerateKey(rand.Reader)
+	cert, err := adb.LoadOrCreateProxyCertificate(filepath.Join(t.TempDir(), "adb_proxy.pem"), owner)
+	if err != nil {
+		t.Fatalf("LoadOrCreateProxyCertificate failed: %s", err)
+	}
+	proxy := adb.NewAdbProxy("tcp", "127.0.0.1:"+port, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	server := NewServer(t)
+	keys, _ := adb.LoadAuthorizedKeys("")
+	keys.Allow(server.PublicKey())
+	proxy.SetAuthorization(keys, nil)
+	proxy.SetTLSCertificate(&cert)
+	if err := proxy.Start("ROOM1"); err != nil {
+		t.Fatalf("proxy Start failed: %s", err)
+	}
+	defer proxy.Stop()
+
+	serial := "127.0.0.1:" + port
+	if err := newTestSmartSocket(server).Connect(serial); err != nil {
+		t.Fatalf("Connect failed: %s", err)
+	}
+	if err := server.WaitForState(serial, adb.TypeDevice, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if presented := server.TLSCertificate(serial); presented == nil || !presented.Equal(cert.Leaf) {
+		t.Fatalf("expected the connection to be upgraded to TLS with the proxy's certificate")
+	}
+	select {
+	case conn := <-proxy.Connections():
+		_ = conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for the handshaked connection")
+	}
+}
@@ -0,0 +1,375 @@
+package adbtest
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wireVersion is the ADB protocol version a real adb server offers in its
+// CNXN (A_VERSION).
+const wireVersion = 0x01000001
+
+// hostBanner is what the fake server presents itself as in its CNXN.
+const hostBanner = "host::features=shell_v2,cmd,stat_v2,ls_v2,fixed_push_mkdir,abb,abb_exec,sendrecv_v2\x00"
+
+// wireOpenTimeout bounds how long opening a stream waits for the device's
+// OKAY or CLSE.
+const wireOpenTimeout = 10 * time.Second
+
+// wireTransport is the adb server's end of an ADB wire protocol connection
+// to a device it was told to "adb connect" to, e.g. a guest's AdbProxy: it
+// turns every service request for that device into an OPEN, and relays the
+// stream's bytes as WRTE messages, the way a real adb server does.
+type wireTransport struct {
+	conn net.Conn
+	// tlsCertificate is the device's certificate if it upgraded the
+	// connection with STLS.
+	tlsCertificate *x509.Certificate
+	// maxData is the largest WRTE payload the device accepts.
+	maxData int
+
+	writeMutex sync.Mutex
+	message    *adb.AdbMessage
+
+	mutex   sync.Mutex
+	nextId  uint32
+	streams map[uint32]*wireStream
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// wireStream is one stream open over a wireTransport. Ids follow the ADB
+// convention: localId is ours, remoteId the device's.
+type wireStream struct {
+	localId  uint32
+	remoteId uint32
+	// opened receives whether the device accepted the OPEN.
+	opened chan bool
+	// sendPermit holds a token while we may send the next WRTE.
+	sendPermit chan struct{}
+	// incoming queues the device's WRTE payloads, then nil for its CLSE,
+	// until they're written to host. Flow control keeps at most one WRTE
+	// outstanding.
+	incoming chan []byte
+	// host is the connection of whoever asked the adb server for the
+	// stream, guarded by the transport's mutex.
+	host net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+// dialWire performs the CNXN handshake on conn, returning the transport
+// and the device's banner once the device answered it. The device may hold
+// its answer back (e.g. a proxy whose device is offline) for as long as it
+// likes. If the device asks to authenticate, the token is signed with key,
+// and if the device doesn't accept that, key's public half is offered and
+// unauthorized called while the device decides, the way a real adb server
+// does. If the device asks for STLS instead, the connection is upgraded to
+// TLS with a client certificate for key.
+func dialWire(conn net.Conn, key *rsa.PrivateKey, unauthorized func()) (*wireTransport, string, error) {
+	message := adb.CreateMessage()
+	if err := message.Set(adb.CommandConnect, wireVersion, adb.MaxPayloadLength, []byte(hostBanner)); err != nil {
+		return nil, "", err
+	}
+	if err := message.Write(conn); err != nil {
+		return nil, "", err
+	}
+	signed := false
+	var tlsCertificate *x509.Certificate
+	for {
+		if err := message.Read(conn); err != nil {
+			return nil, "", err
+		}
+		if message.Command() == adb.CommandStls && tlsCertificate == nil {
+			tlsConn, err := upgradeWire(conn, message, key)
+			if err != nil {
+				return nil, "", err
+			}
+			conn = tlsConn
+			tlsCertificate = tlsConn.ConnectionState().PeerCertificates[0]
+			continue
+		}
+		if message.Command() != adb.CommandAuth || message.Arg1() != adb.AuthToken {
+			break
+		}
+		if err := answerAuth(conn, message, key, signed); err != nil {
+			return nil, "", err
+		}
+		if signed {
+			unauthorized()
+		}
+		signed = true
+	}
+	if message.Command() != adb.CommandConnect {
+		return nil, "", fmt.Errorf("expected CNXN, got %s", message.CommandString())
+	}
+	maxData := min(int(message.Arg2()), adb.MaxPayloadLength)
+	banner := strings.TrimRight(message.DataString(), "\x00")
+	transport := &wireTransport{
+		conn:           conn,
+		tlsCertificate: tlsCertificate,
+		maxData:        maxData,
+		message:        adb.CreateMessage(),
+		streams:        make(map[uint32]*wireStream),
+		closed:         make(chan struct{}),
+	}
+	go transport.read()
+	return transport, banner, nil
+}
+
+// upgradeWire answers the device's STLS in message and performs the TLS
+// handshake as the client, presenting key's certificate. Like adb, it
+// doesn't check the device's certificate.
+func upgradeWire(conn net.Conn, message *adb.AdbMessage, key *rsa.PrivateKey) (*tls.Conn, error) {
+	if err := message.Set(adb.CommandStls, adb.StlsVersion, 0, nil); err != nil {
+		return nil, err
+	}
+	if err := message.Write(conn); err != nil {
+		return nil, err
+	}
+	cert, err := adb.NewHostCertificate(key)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		MinVersion:         tls.VersionTLS13,
+		InsecureSkipVerify: true,
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// answerAuth answers the AUTH token in message: with a signature the
+// first time, and with the public key once the signature was turned down.
+func answerAuth(conn net.Conn, message *adb.AdbMessage, key *rsa.PrivateKey, signed bool) error {
+	if signed {
+		publicKey, err := adb.NewPublicKey(&key.PublicKey, hostKeyComment)
+		if err != nil {
+			return err
+		}
+		if err := message.Set(adb.CommandAuth, adb.AuthRSAPublicKey, 0, []byte(publicKey.String()+"\x00")); err != nil {
+			return err
+		}
+		return message.Write(conn)
+	}
+	signature, err := adb.SignAuthToken(key, message.Data())
+	if err != nil {
+		return err
+	}
+	if err := message.Set(adb.CommandAuth, adb.AuthSignature, 0, signature); err != nil {
+		return err
+	}
+	return message.Write(conn)
+}
+
+// parseBanner returns the properties and features of a CNXN device banner,
+// "device::ro.product.name=...;ro.product.model=...;features=a,b".
+func parseBanner(banner string) (properties map[string]string, features []string) {
+	properties = make(map[string]string)
+	_, fields, _ := strings.Cut(banner, "::")
+	for _, field := range strings.Split(fields, ";") {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		if key == "features" {
+			features = strings.Split(value, ",")
+			continue
+		}
+		properties[key] = value
+	}
+	return properties, features
+}
+
+func (w *wireTransport) send(command uint32, arg1 uint32, arg2 uint32, data []byte) error {
+	w.writeMutex.Lock()
+	defer w.writeMutex.Unlock()
+	if err := w.message.Set(command, arg1, arg2, data); err != nil {
+		return err
+	}
+	return w.message.Write(w.conn)
+}
+
+// read handles everything the device sends until the connection is lost.
+func (w *wireTransport) read() {
+	defer w.close()
+	message := adb.CreateMessage()
+	for {
+		if err := message.Read(w.conn); err != nil {
+			return
+		}
+		w.mutex.Lock()
+		stream := w.streams[message.Arg2()]
+		w.mutex.Unlock()
+		if stream == nil {
+			continue
+		}
+		switch message.Command() {
+		case adb.CommandOkay:
+			if stream.remoteId == 0 {
+				stream.remoteId = message.Arg1()
+				stream.opened <- true
+				continue
+			}
+			select {
+			case stream.sendPermit <- struct{}{}:
+			default:
+			}
+		case adb.CommandWrite:
+			select {
+			case stream.incoming <- append([]byte{}, message.Data()...):
+			default:
+				w.closeStream(stream, true)
+			}
+		case adb.CommandClose:
+			if stream.remoteId == 0 {
+				stream.opened <- false
+				w.forget(stream)
+				continue
+			}
+			select {
+			case stream.incoming <- nil:
+			default:
+				w.closeStream(stream, false)
+			}
+		}
+	}
+}
+
+// open asks the device for service, returning what relays the stream for
+// the host connection once it's been told OKAY.
+func (w *wireTransport) open(service string) (func(host net.Conn), error) {
+	w.mutex.Lock()
+	w.nextId++
+	stream := &wireStream{
+		localId:    w.nextId,
+		opened:     make(chan bool, 1),
+		sendPermit: make(chan struct{}, 1),
+		incoming:   make(chan []byte, 2),
+		done:       make(chan struct{}),
+	}
+	stream.sendPermit <- struct{}{}
+	w.streams[stream.localId] = stream
+	w.mutex.Unlock()
+
+	if err := w.send(adb.CommandOpen, stream.localId, 0, []byte(service+"\x00")); err != nil {
+		w.forget(stream)
+		return nil, err
+	}
+	select {
+	case accepted := <-stream.opened:
+		if !accepted {
+			return nil, fmt.Errorf("the device refused %q", service)
+		}
+	case <-w.closed:
+		return nil, errors.New("device disconnected")
+	case <-time.After(wireOpenTimeout):
+		w.forget(stream)
+		return nil, fmt.Errorf("timed out opening %q", service)
+	}
+	return func(host net.Conn) { w.relay(stream, host) }, nil
+}
+
+// relay pumps the stream's bytes between host and the device until either
+// side closes it.
+func (w *wireTransport) relay(stream *wireStream, host net.Conn) {
+	w.mutex.Lock()
+	stream.host = host
+	w.mutex.Unlock()
+	go w.relayIncoming(stream, host)
+	buffer := make([]byte, w.maxData)
+	for {
+		n, err := host.Read(buffer)
+		if n > 0 {
+			select {
+			case <-stream.sendPermit:
+			case <-stream.done:
+				return
+			}
+			if sendErr := w.send(adb.CommandWrite, stream.localId, stream.remoteId, buffer[:n]); sendErr != nil {
+				w.closeStream(stream, false)
+				return
+			}
+		}
+		if err != nil {
+			w.closeStream(stream, true)
+			return
+		}
+	}
+}
+
+// relayIncoming writes the device's data to host, acknowledging each WRTE
+// once it's written.
+func (w *wireTransport) relayIncoming(stream *wireStream, host net.Conn) {
+	for {
+		select {
+		case data := <-stream.incoming:
+			if data == nil {
+				w.closeStream(stream, false)
+				return
+			}
+			if _, err := host.Write(data); err != nil {
+				w.closeStream(stream, true)
+				return
+			}
+			if err := w.send(adb.CommandOkay, stream.localId, stream.remoteId, nil); err != nil {
+				w.closeStream(stream, false)
+				return
+			}
+		case <-stream.done:
+			return
+		}
+	}
+}
+
+// closeStream closes stream's host connection, telling the device with a
+// CLSE if notify is set.
+func (w *wireTransport) closeStream(stream *wireStream, notify bool) {
+	stream.once.Do(func() {
+		close(stream.done)
+		w.forget(stream)
+		if notify {
+			_ = w.send(adb.CommandClose, stream.localId, stream.remoteId, nil)
+		}
+		w.mutex.Lock()
+		host := stream.host
+		w.mutex.Unlock()
+		if host != nil {
+			_ = host.Close()
+		}
+	})
+}
+
+func (w *wireTransport) forget(stream *wireStream) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	delete(w.streams, stream.localId)
+}
+
+// close disconnects the device, closing every stream.
+func (w *wireTransport) close() {
+	w.once.Do(func() {
+		close(w.closed)
+		_ = w.conn.Close()
+		w.mutex.Lock()
+		streams := make([]*wireStream, 0, len(w.streams))
+		for _, stream := range w.streams {
+			streams = append(streams, stream)
+		}
+		w.mutex.Unlock()
+		for _, stream := range streams {
+			w.closeStream(stream, false)
+		}
+	})
+}
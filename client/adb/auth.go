@@ -0,0 +1,286 @@
+package adb
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// AUTH message types, its arg1.
+const (
+	// AuthToken carries a random token the device wants signed.
+	AuthToken uint32 = 1
+	// AuthSignature carries the host's signature of the last token.
+	AuthSignature uint32 = 2
+	// AuthRSAPublicKey carries a public key the host wants the device to
+	// accept, once none of its signatures did.
+	AuthRSAPublicKey uint32 = 3
+)
+
+// AuthTokenLength is the size of an AUTH token; adb signs it as if it were
+// a SHA-1 digest.
+const AuthTokenLength = 20
+
+// publicKeyBits is the only key size adb uses or accepts.
+const publicKeyBits = 2048
+
+const publicKeyWords = publicKeyBits / 32
+
+// publicKeyBlobLength is the size of adb's binary RSA public key: the
+// modulus size in words, n0inv, the modulus, R^2 mod n, and the exponent.
+const publicKeyBlobLength = 4 + 4 + publicKeyBits/8 + publicKeyBits/8 + 4
+
+// PublicKey is an adb RSA public key, as found in adbkey.pub and in a
+// device's adb_keys.
+type PublicKey struct {
+	Key *rsa.PublicKey
+	// Comment is what follows the key on its line, conventionally the
+	// user@host it belongs to.
+	Comment string
+	blob    []byte
+}
+
+// NewPublicKey wraps a 2048-bit RSA key, the only size adb supports.
+func NewPublicKey(key *rsa.PublicKey, comment string) (*PublicKey, error) {
+	if key.N.BitLen() != publicKeyBits {
+		return nil, fmt.Errorf("adb keys are %d-bit RSA keys, got %d bits", publicKeyBits, key.N.BitLen())
+	}
+	blob := make([]byte, publicKeyBlobLength)
+	binary.LittleEndian.PutUint32(blob[0:], publicKeyWords)
+	// n0inv is -1/n mod 2^32.
+	r32 := new(big.Int).Lsh(big.NewInt(1), 32)
+	n0inv := new(big.Int).ModInverse(new(big.Int).Mod(key.N, r32), r32)
+	n0inv.Sub(r32, n0inv)
+	binary.LittleEndian.PutUint32(blob[4:], uint32(n0inv.Uint64()))
+	putLittleEndian(blob[8:8+publicKeyBits/8], key.N)
+	rr := new(big.Int).Exp(big.NewInt(2), big.NewInt(2*publicKeyBits), key.N)
+	putLittleEndian(blob[8+publicKeyBits/8:8+2*publicKeyBits/8], rr)
+	binary.LittleEndian.PutUint32(blob[8+2*publicKeyBits/8:], uint32(key.E))
+	return &PublicKey{Key: key, Comment: comment, blob: blob}, nil
+}
+
+// ParsePublicKey parses one line of adbkey.pub or adb_keys: the base64 key,
+// optionally followed by a space and a comment.
+func ParsePublicKey(line string) (*PublicKey, error) {
+	encoded, comment, _ := strings.Cut(strings.TrimRight(strings.TrimSpace(line), "\x00"), " ")
+	blob, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid adb key encoding: %w", err)
+	}
+	if len(blob) != publicKeyBlobLength || binary.LittleEndian.Uint32(blob) != publicKeyWords {
+		return nil, errors.New("not a 2048-bit adb RSA key")
+	}
+	modulus := littleEndianInt(blob[8 : 8+publicKeyBits/8])
+	exponent := binary.LittleEndian.Uint32(blob[8+2*publicKeyBits/8:])
+	if modulus.BitLen() != publicKeyBits || exponent < 3 || exponent > 1<<31-1 {
+		return nil, errors.New("invalid adb RSA key")
+	}
+	key := &rsa.PublicKey{N: modulus, E: int(exponent)}
+	return &PublicKey{Key: key, Comment: strings.TrimSpace(comment), blob: blob}, nil
+}
+
+// LoadPublicKeyFile reads an adbkey.pub file.
+func LoadPublicKeyFile(path string) (*PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePublicKey(string(data))
+}
+
+// String returns the key in adbkey.pub format.
+func (k *PublicKey) String() string {
+	encoded := base64.StdEncoding.EncodeToString(k.blob)
+	if k.Comment == "" {
+		return encoded
+	}
+	return encoded + " " + k.Comment
+}
+
+// Fingerprint returns the key's fingerprint the way a device's "Allow USB
+// debugging?" dialog shows it: the MD5 of the binary key, as colon-separated
+// hex.
+func (k *PublicKey) Fingerprint() string {
+	sum := md5.Sum(k.blob)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// Verify reports whether signature is this key's signature of token.
+func (k *PublicKey) Verify(token []byte, signature []byte) bool {
+	return len(token) == AuthTokenLength && rsa.VerifyPKCS1v15(k.Key, crypto.SHA1, token, signature) == nil
+}
+
+// SignAuthToken signs an AUTH token with key, the way an adb server answers
+// a device's AuthToken.
+func SignAuthToken(key *rsa.PrivateKey, token []byte) ([]byte, error) {
+	if len(token) != AuthTokenLength {
+		return nil, fmt.Errorf("AUTH tokens are %d bytes, got %d", AuthTokenLength, len(token))
+	}
+	return rsa.SignPKCS1v15(nil, key, crypto.SHA1, token)
+}
+
+// NewAuthToken returns a fresh random AUTH token.
+func NewAuthToken() ([]byte, error) {
+	token := make([]byte, AuthTokenLength)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func putLittleEndian(destination []byte, value *big.Int) {
+	bigEndian := value.FillBytes(make([]byte, len(destination)))
+	for i, b := range bigEndian {
+		destination[len(destination)-1-i] = b
+	}
+}
+
+func littleEndianInt(littleEndian []byte) *big.Int {
+	bigEndian := make([]byte, len(littleEndian))
+	for i, b := range littleEndian {
+		bigEndian[len(littleEndian)-1-i] = b
+	}
+	return new(big.Int).SetBytes(bigEndian)
+}
+
+// DefaultUserKeyPath returns where the local adb server keeps its public
+// key, the way adb finds it: in $ANDROID_USER_HOME, or .android under
+// $ANDROID_SDK_HOME or the home directory.
+func DefaultUserKeyPath() (string, error) {
+	if dir := os.Getenv("ANDROID_USER_HOME"); dir != "" {
+		return filepath.Join(dir, "adbkey.pub"), nil
+	}
+	if dir := os.Getenv("ANDROID_SDK_HOME"); dir != "" {
+		return filepath.Join(dir, ".android", "adbkey.pub"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".android", "adbkey.pub"), nil
+}
+
+// AuthorizedKeys are the adb keys allowed to connect to an AdbProxy, the
+// way a device's adb_keys are: keys remembered in an adb_keys-style file
+// (one adbkey.pub line per key), plus any allowed for this run only. It is
+// safe for concurrent use.
+type AuthorizedKeys struct {
+	path string
+
+	mutex sync.Mutex
+	keys  []*PublicKey
+}
+
+// LoadAuthorizedKeys reads the keys remembered at path, which needn't exist
+// yet. An empty path keeps nothing on disk.
+func LoadAuthorizedKeys(path string) (*AuthorizedKeys, error) {
+	authorized := &AuthorizedKeys{path: path}
+	if path == "" {
+		return authorized, nil
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return authorized, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, err := ParsePublicKey(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		authorized.keys = append(authorized.keys, key)
+	}
+	return authorized, scanner.Err()
+}
+
+// Allow authorizes key for as long as this AuthorizedKeys lives.
+func (a *AuthorizedKeys) Allow(key *PublicKey) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if !a.containsLocked(key) {
+		a.keys = append(a.keys, key)
+	}
+}
+
+// Remember authorizes key and adds it to the file, so it stays authorized
+// on later runs.
+func (a *AuthorizedKeys) Remember(key *PublicKey) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.containsLocked(key) {
+		return nil
+	}
+	a.keys = append(a.keys, key)
+	if a.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(a.path), 0o700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(file, key.String()); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Contains reports whether key is authorized.
+func (a *AuthorizedKeys) Contains(key *PublicKey) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.containsLocked(key)
+}
+
+// Keys returns every authorized key.
+func (a *AuthorizedKeys) Keys() []*PublicKey {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return append([]*PublicKey{}, a.keys...)
+}
+
+// Verify returns the authorized key signature is a signature of token by,
+// or nil if there's none.
+func (a *AuthorizedKeys) Verify(token []byte, signature []byte) *PublicKey {
+	for _, key := range a.Keys() {
+		if key.Verify(token, signature) {
+			return key
+		}
+	}
+	return nil
+}
+
+func (a *AuthorizedKeys) containsLocked(key *PublicKey) bool {
+	for _, known := range a.keys {
+		if known.Key.Equal(key.Key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package adb
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestPublicKeyRoundTripsThroughAdbkeyFormat(t *testing.T) {
+	key := testHostPublicKey(t)
+	line := key.String()
+	if !strings.HasSuffix(line, " test@localhost") {
+		t.Fatalf("expected the comment after the key, got %q", line)
+	}
+	// adb sends its key NUL-terminated, with a trailing newline in the file.
+	parsed, err := ParsePublicKey(line + "\n\x00")
+	if err != nil {
+		t.Fatalf("ParsePublicKey failed: %s", err)
+	}
+	if !parsed.Key.Equal(key.Key) || parsed.Comment != "test@localhost" || parsed.String() != line {
+		t.Fatalf("expected the key to round-trip, got %q", parsed.String())
+	}
+	if !regexp.MustCompile(`^([0-9A-F]{2}:){15}[0-9A-F]{2}$`).MatchString(parsed.Fingerprint()) {
+		t.Fatalf("unexpected fingerprint format: %q", parsed.Fingerprint())
+	}
+}
+
+func TestParsePublicKeyRejectsGarbage(t *testing.T) {
+	for _, line := range []string{"", "not base64!", "QUJD user@host"} {
+		if _, err := ParsePublicKey(line); err == nil {
+			t.Fatalf("expected %q to be rejected", line)
+		}
+	}
+}
+
+func TestSignedAuthTokenVerifies(t *testing.T) {
+	token, err := NewAuthToken()
+	if err != nil {
+		t.Fatalf("NewAuthToken failed: %s", err)
+	}
+	signature, err := SignAuthToken(testHostKey(), token)
+	if err != nil {
+		t.Fatalf("SignAuthToken failed: %s", err)
+	}
+	key := testHostPublicKey(t)
+	if !key.Verify(token, signature) {
+		t.Fatalf("expected the signature to verify")
+	}
+	otherToken, _ := NewAuthToken()
+	if key.Verify(otherToken, signature) {
+		t.Fatalf("did not expect the signature to verify for another token")
+	}
+}
+
+func TestAuthorizedKeysRememberOnlyWhatTheyAreToldTo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "adb_keys")
+	key := testHostPublicKey(t)
+	if err := os.WriteFile(path, []byte("# allowed adb keys\n\n"), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %s", path, err)
+	}
+	keys, err := LoadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatalf("LoadAuthorizedKeys failed: %s", err)
+	}
+	keys.Allow(key)
+	if reloaded, _ := LoadAuthorizedKeys(path); len(reloaded.Keys()) != 0 {
+		t.Fatalf("did not expect an allowed key to be written to the file")
+	}
+	if err := keys.Remember(key); err != nil {
+		t.Fatalf("Remember failed: %s", err)
+	}
+	if len(keys.Keys()) != 1 {
+		t.Fatalf("expected remembering an allowed key not to duplicate it, got %d keys", len(keys.Keys()))
+	}
+
+	keys, err = LoadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatalf("LoadAuthorizedKeys failed: %s", err)
+	}
+	if err := keys.Remember(key); err != nil {
+		t.Fatalf("Remember failed: %s", err)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Count(string(data), key.String()) != 1 {
+		t.Fatalf("expected the key to be written exactly once, got %q", data)
+	}
+	token, _ := NewAuthToken()
+	signature, _ := SignAuthToken(testHostKey(), token)
+	if verified := keys.Verify(token, signature); verified == nil || verified.Comment != "test@localhost" {
+		t.Fatalf("expected the remembered key to verify its signature")
+	}
+}
+
+func TestLoadAuthorizedKeysReportsBadLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "adb_keys")
+	if err := os.WriteFile(path, []byte(testHostPublicKey(t).String()+"\ngarbage\n"), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %s", path, err)
+	}
+	if _, err := LoadAuthorizedKeys(path); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Fatalf("expected an error pointing at line 2, got %v", err)
+	}
+}
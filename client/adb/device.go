@@ -5,9 +5,19 @@ const (
 	TypeHost         string = "host"
 	TypeUnknown      string = "unknown"
 	TypeDisconnected string = "offline"
+	// TypeUnauthorized is a device that hasn't accepted the adb server's
+	// key (yet).
+	TypeUnauthorized string = "unauthorized"
 )
 
+// Device is one entry of the adb server's device list: Id is its serial,
+// Type its state ("device" when usable), and the rest the details
+// "adb devices -l" reports, empty when the adb server doesn't know them.
 type Device struct {
-	Id   string
-	Type string
+	Id          string
+	Type        string
+	Product     string
+	Model       string
+	Device      string
+	TransportId string
 }
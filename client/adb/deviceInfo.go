@@ -0,0 +1,85 @@
+package adb
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// deviceInfoProperties are the system properties QueryDeviceInfo reads, in
+// the order of its getprop output lines.
+var deviceInfoProperties = []string{"ro.product.manufacturer", "ro.build.version.release", "ro.product.cpu.abi"}
+
+// deviceInfoTimeout bounds how long QueryDeviceInfo waits on getprop, so a
+// wedged device can't hold up sharing it.
+const deviceInfoTimeout = 5 * time.Second
+
+// maxGetpropOutputSize bounds the getprop output QueryDeviceInfo reads.
+const maxGetpropOutputSize = 64 * 1024
+
+// DeviceInfo is what a guest is told about a shared device, to present it
+// as the real phone rather than a generic one (see AdbProxy.SetDeviceInfo).
+// Product, Model and Device come from the adb server's device list, the
+// rest from the device's own properties; any may be empty.
+type DeviceInfo struct {
+	Product        string
+	Model          string
+	Device         string
+	Manufacturer   string
+	AndroidVersion string
+	Abi            string
+}
+
+// Describe renders info for people, e.g. "Google Pixel_7 (Android 14,
+// arm64-v8a)", or "" if nothing is known.
+func (info DeviceInfo) Describe() string {
+	name := strings.TrimSpace(info.Manufacturer + " " + info.Model)
+	var details []string
+	if info.AndroidVersion != "" {
+		details = append(details, "Android "+info.AndroidVersion)
+	}
+	if info.Abi != "" {
+		details = append(details, info.Abi)
+	}
+	if len(details) == 0 {
+		return name
+	}
+	return strings.TrimSpace(fmt.Sprintf("%s (%s)", name, strings.Join(details, ", ")))
+}
+
+// QueryDeviceInfo returns device's details: those the device list already
+// carries, plus the manufacturer, Android version and ABI read with
+// getprop. If getprop fails, the error is returned along with the details
+// known without it.
+func QueryDeviceInfo(smartSocket IAdbSmartSocket, device Device) (DeviceInfo, error) {
+	info := DeviceInfo{
+		Product: device.Product,
+		Model:   device.Model,
+		Device:  device.Device,
+	}
+	commands := make([]string, len(deviceInfoProperties))
+	for i, property := range deviceInfoProperties {
+		commands[i] = "getprop " + property
+	}
+	conn, err := smartSocket.OpenStream(device.Id, "shell:"+strings.Join(commands, ";"))
+	if err != nil {
+		return info, fmt.Errorf("getprop on %s: %w", device.Id, err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(deviceInfoTimeout))
+	output, err := io.ReadAll(io.LimitReader(conn, maxGetpropOutputSize))
+	if err != nil {
+		return info, fmt.Errorf("getprop on %s: %w", device.Id, err)
+	}
+	// The legacy shell: service may translate newlines to \r\n.
+	lines := strings.Split(strings.ReplaceAll(string(output), "\r\n", "\n"), "\n")
+	values := make([]string, len(deviceInfoProperties))
+	for i := range values {
+		if i < len(lines) {
+			values[i] = strings.TrimSpace(lines[i])
+		}
+	}
+	info.Manufacturer, info.AndroidVersion, info.Abi = values[0], values[1], values[2]
+	return info, nil
+}
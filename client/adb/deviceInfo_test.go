@@ -0,0 +1,49 @@
+package adb
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestQueryDeviceInfoReadsGetprop(t *testing.T) {
+	address := fakeAdbTransportServer(t, func(service string, conn net.Conn) {
+		want := "shell:getprop ro.product.manufacturer;getprop ro.build.version.release;getprop ro.product.cpu.abi"
+		if service != want {
+			t.Errorf("expected service %q, got %q", want, service)
+		}
+		_, _ = conn.Write([]byte("OKAY"))
+		_, _ = conn.Write([]byte("Google\r\n14\r\narm64-v8a\r\n"))
+	})
+
+	socket := newTestSmartSocket(address)
+	info, err := QueryDeviceInfo(socket, Device{Id: "emulator-5554", Type: TypeDevice, Product: "panther", Model: "Pixel_7", Device: "panther"})
+	if err != nil {
+		t.Fatalf("QueryDeviceInfo failed: %s", err)
+	}
+	want := DeviceInfo{Product: "panther", Model: "Pixel_7", Device: "panther", Manufacturer: "Google", AndroidVersion: "14", Abi: "arm64-v8a"}
+	if info != want {
+		t.Fatalf("expected %+v, got %+v", want, info)
+	}
+	if described := info.Describe(); described != "Google Pixel_7 (Android 14, arm64-v8a)" {
+		t.Fatalf("unexpected description %q", described)
+	}
+}
+
+func TestQueryDeviceInfoKeepsListDetailsWhenGetpropFails(t *testing.T) {
+	address := fakeAdbTransportServer(t, func(service string, conn net.Conn) {
+		body := "device offline"
+		_, _ = conn.Write([]byte("FAIL"))
+		_, _ = conn.Write([]byte(fmt.Sprintf("%04x", len(body))))
+		_, _ = conn.Write([]byte(body))
+	})
+
+	socket := newTestSmartSocket(address)
+	info, err := QueryDeviceInfo(socket, Device{Id: "emulator-5554", Model: "Pixel_7"})
+	if err == nil {
+		t.Fatalf("expected getprop's failure to be reported")
+	}
+	if info.Model != "Pixel_7" || info.Manufacturer != "" {
+		t.Fatalf("expected only the device list's details, got %+v", info)
+	}
+}
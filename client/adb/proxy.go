@@ -1,36 +1,66 @@
 package adb
 
 import (
+	"adb-remote.maci.team/client/internal/unixsocket"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"strings"
+	"sync"
+	"time"
 )
 
 // DefaultProxyPort is the local TCP port a guest's AdbProxy listens on by
 // default, for the local ADB server to "adb connect" to.
 const DefaultProxyPort = "5038"
 
-// deviceFeatures is advertised in our CNXN response's device banner. Most
-// importantly this must include shell_v2: without it, a real adb client
-// silently falls back to the legacy v1 "shell:" service, which relays
-// stdout/stderr fine but has no way to carry the remote command's exit
-// code back at all (adb always reports 0 regardless of what actually ran).
-// The rest mirror what a real, current adb-server/adbd pair commonly
+// DefaultProxyBind is the address a guest's AdbProxy listens on by default:
+// loopback only, so the shared device isn't exposed to the network unless
+// asked for.
+const DefaultProxyBind = "127.0.0.1"
+
+// defaultFeatures is advertised in our CNXN response's device banner until
+// the proxy learns the shared device's real feature set (see SetFeatures).
+// Most importantly this must include shell_v2: without it, a real adb
+// client silently falls back to the legacy v1 "shell:" service, which
+// relays stdout/stderr fine but has no way to carry the remote command's
+// exit code back at all (adb always reports 0 regardless of what actually
+// ran). The rest mirror what a real, current adb-server/adbd pair commonly
 // support; if the underlying shared device doesn't actually support one,
 // that specific stream's OpenStream just fails, same as with any other
 // unsupported service request.
-const deviceFeatures = "shell_v2,cmd,stat_v2,ls_v2,fixed_push_mkdir,apex,abb,fixed_push_symlink_timestamp,abb_exec,remount_shell,track_app,sendrecv_v2"
+const defaultFeatures = "shell_v2,cmd,stat_v2,ls_v2,fixed_push_mkdir,apex,abb,fixed_push_symlink_timestamp,abb_exec,remount_shell,track_app,sendrecv_v2"
+
+// unrelayableFeatures change the ADB wire protocol itself rather than which
+// services a stream may request. The relay terminates the guest's ADB
+// connection at this proxy and opens the owner's streams through the owner's
+// adb server, so it can't honour them even when the shared device does.
+var unrelayableFeatures = map[string]bool{
+	"delayed_ack": true,
+}
 
 // IAdbProxy listens locally for a real ADB server to "adb connect" to,
-// performs the ADB CNXN handshake on its behalf (pretending to be a single
-// device named after the room), and hands the now-handshaked connection off
-// through Connections for a relay to pump ADB protocol messages over the
-// transporter.
+// authenticates it the way a device does (see SetAuthorization), over TLS
+// if told to (see SetTLSCertificate), performs the ADB CNXN handshake on
+// its behalf (pretending to be the shared device, or a generic one named
+// after the room until told what the device is), and hands the
+// now-handshaked connection off through Connections for a relay to pump ADB
+// protocol messages over the transporter.
 type IAdbProxy interface {
 	// Start begins listening for local ADB connections, presenting itself
 	// as a device named after roomId once a CNXN handshake completes.
 	Start(roomId string) error
+	// Addr returns the address the proxy listens on, e.g. to learn the
+	// port picked for port 0, or nil until Start succeeded.
+	Addr() net.Addr
+	// SetAllowedSources has the proxy turn away TCP connections from
+	// outside networks right after accepting them. A nil networks allows
+	// every source; unix socket connections are always allowed.
+	SetAllowedSources(networks []*net.IPNet)
 	// Stop closes the listener and any pending accept loop. Already
 	// handshaked connections handed out through Connections are left open;
 	// the caller owns their lifecycle from that point on.
@@ -38,24 +68,344 @@ type IAdbProxy interface {
 	// Connections yields one net.Conn per successfully handshaked local
 	// ADB connection.
 	Connections() <-chan net.Conn
+	// SetOnline tells the proxy whether the device it stands for is
+	// currently usable (it starts out online). While offline, local
+	// connections are accepted but their CNXN handshake isn't answered
+	// until the device is back, so the local adb server lists it as
+	// "offline" rather than failing every stream.
+	SetOnline(online bool)
+	// SetDeviceInfo has later handshakes present the shared device's real
+	// product, model and device names, so the local adb server (and IDEs
+	// on top of it) show the actual phone.
+	SetDeviceInfo(info DeviceInfo)
+	// SetFeatures has later handshakes advertise the shared device's real
+	// adb features (minus any the relay can't carry) instead of a
+	// guessed default set, so the local adb client only uses services the
+	// device actually has.
+	SetFeatures(features []string)
+	// SetAuthorization has later handshakes authenticate the local adb
+	// server the way a device does: only one that signs the proxy's AUTH
+	// token with one of keys connects, or one whose public key approve
+	// accepts (after which keys holds it). A nil approve rejects unknown
+	// keys. Until it's called, every connection is refused.
+	SetAuthorization(keys *AuthorizedKeys, approve KeyApproveFunc)
+	// SetTLSCertificate has later handshakes upgrade the connection to
+	// TLS with STLS, the way a wireless debugging device does, presenting
+	// cert (see LoadOrCreateProxyCertificate) and authenticating the local
+	// adb server by its client certificate instead of AUTH. A nil cert
+	// goes back to plain connections. Local adb servers older than
+	// platform-tools 30 don't know STLS and can't connect while it's set.
+	SetTLSCertificate(cert *tls.Certificate)
 }
 
+// KeyApproveFunc decides whether an adb server offering key, none of whose
+// keys are authorized, may connect, the way a device's "Allow USB
+// debugging?" dialog does. remember reports whether the key should stay
+// authorized on later runs ("Always allow from this computer").
+type KeyApproveFunc func(ctx context.Context, key *PublicKey) (approved bool, remember bool)
+
+// maxAuthSignatures bounds how many signatures a local adb server may try
+// before it must offer its public key: one per key it holds.
+const maxAuthSignatures = 16
+
+// defaultHandshakeTimeout bounds a local connection's CNXN handshake, AUTH
+// or STLS included, so that one stalling halfway doesn't hold its
+// goroutine and connection forever. It doesn't count the time spent asking
+// the operator to approve a key or waiting for the device to come online.
+const defaultHandshakeTimeout = 10 * time.Second
+
 type AdbProxy struct {
-	port       string
+	// network and address are what Start listens on, as net.Listen takes
+	// them.
+	network    string
+	address    string
 	listener   net.Listener
 	cancelFunc context.CancelFunc
 
 	connections chan net.Conn
 
+	// mutex guards listener, onlineSignal, deviceInfo, features, keys,
+	// approve, tlsCertificate and allowedSources.
+	mutex sync.Mutex
+	// onlineSignal is closed while the device is online; SetOnline(false)
+	// swaps in an open one for handshakes to wait on.
+	onlineSignal   chan struct{}
+	deviceInfo     DeviceInfo
+	features       string
+	keys           *AuthorizedKeys
+	approve        KeyApproveFunc
+	tlsCertificate *tls.Certificate
+	allowedSources []*net.IPNet
+	// handshakeTimeout is defaultHandshakeTimeout but in tests.
+	handshakeTimeout time.Duration
+
 	//Dependencies
 	logger *slog.Logger
 }
 
-func NewAdbProxy(port string, logger *slog.Logger) IAdbProxy {
+// NewAdbProxy returns a proxy that listens on address of network, as
+// net.Listen takes them: "tcp" and a host:port (port 0 picks a free one),
+// or "unix" and a socket path.
+func NewAdbProxy(network string, address string, logger *slog.Logger) IAdbProxy {
+	onlineSignal := make(chan struct{})
+	close(onlineSignal)
 	return &AdbProxy{
-		port:        port,
-		connections: make(chan net.Conn),
-		logger:      logger,
+		network:      network,
+		address:      address,
+		connections:  make(chan net.Conn),
+		onlineSignal: onlineSignal,
+		features:     defaultFeatures,
+		logger:       logger,
+
+		handshakeTimeout: defaultHandshakeTimeout,
+	}
+}
+
+func (p *AdbProxy) SetOnline(online bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	select {
+	case <-p.onlineSignal:
+		if !online {
+			p.onlineSignal = make(chan struct{})
+		}
+	default:
+		if online {
+			close(p.onlineSignal)
+		}
+	}
+}
+
+func (p *AdbProxy) SetDeviceInfo(info DeviceInfo) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.deviceInfo = info
+}
+
+func (p *AdbProxy) SetFeatures(features []string) {
+	relayable := make([]string, 0, len(features))
+	for _, feature := range features {
+		if feature != "" && !unrelayableFeatures[feature] {
+			relayable = append(relayable, feature)
+		}
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.features = strings.Join(relayable, ",")
+}
+
+func (p *AdbProxy) SetAuthorization(keys *AuthorizedKeys, approve KeyApproveFunc) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.keys = keys
+	p.approve = approve
+}
+
+func (p *AdbProxy) SetAllowedSources(networks []*net.IPNet) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.allowedSources = networks
+}
+
+// allowed reports whether a connection from remote may go on.
+func (p *AdbProxy) allowed(remote net.Addr) bool {
+	p.mutex.Lock()
+	networks := p.allowedSources
+	p.mutex.Unlock()
+	address, ok := remote.(*net.TCPAddr)
+	if len(networks) == 0 || !ok {
+		return true
+	}
+	for _, network := range networks {
+		if network.Contains(address.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *AdbProxy) SetTLSCertificate(cert *tls.Certificate) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.tlsCertificate = cert
+}
+
+// authorization returns the keys and approval to authenticate with, or
+// false if every connection must be refused.
+func (p *AdbProxy) authorization() (*AuthorizedKeys, KeyApproveFunc, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.keys == nil {
+		p.logger.Error("Refusing a local ADB connection: no adb keys are authorized")
+		return nil, nil, false
+	}
+	return p.keys, p.approve, true
+}
+
+// approveKey asks approve about key, which keys doesn't hold, adding it to
+// them if it's approved. The handshake timeout of conn, the connection
+// offering it, is suspended meanwhile: the operator may take a while.
+func (p *AdbProxy) approveKey(ctx context.Context, conn net.Conn, keys *AuthorizedKeys, approve KeyApproveFunc, key *PublicKey) bool {
+	logger := p.logger
+	if approve == nil {
+		logger.Info(fmt.Sprintf("Refusing a local ADB connection with unknown key %s (%s)", key.Fingerprint(), key.Comment))
+		return false
+	}
+	_ = conn.SetDeadline(time.Time{})
+	approved, remember := approve(ctx, key)
+	_ = conn.SetDeadline(time.Now().Add(p.handshakeTimeout))
+	if !approved {
+		logger.Info(fmt.Sprintf("Rejected adb key %s (%s)", key.Fingerprint(), key.Comment))
+		return false
+	}
+	if !remember {
+		keys.Allow(key)
+	} else if err := keys.Remember(key); err != nil {
+		logger.Error(fmt.Sprintf("Failed to remember adb key %s: %s", key.Fingerprint(), err))
+	}
+	logger.Info(fmt.Sprintf("Approved adb key %s (%s)", key.Fingerprint(), key.Comment))
+	return true
+}
+
+// upgrade runs the device side of an STLS upgrade over conn, whose CNXN
+// was just read into message, returning the TLS connection once the local
+// adb server's client certificate is for an authorized or approved key.
+func (p *AdbProxy) upgrade(ctx context.Context, conn net.Conn, message *AdbMessage, cert tls.Certificate) (net.Conn, error) {
+	keys, approve, ok := p.authorization()
+	if !ok {
+		return nil, errors.New("no adb keys are authorized")
+	}
+	if err := message.Set(CommandStls, StlsVersion, 0, nil); err != nil {
+		return nil, err
+	}
+	if err := message.Write(conn); err != nil {
+		return nil, fmt.Errorf("failed to send STLS: %w", err)
+	}
+	if err := message.Read(conn); err != nil {
+		return nil, fmt.Errorf("invalid ADB message read during the STLS handshake: %w", err)
+	}
+	if message.Command() != CommandStls {
+		return nil, fmt.Errorf("expected STLS, got %s; the local adb server may be too old for TLS", message.CommandString())
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+		ClientAuth:   tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			key, err := peerPublicKey(rawCerts)
+			if err != nil {
+				return err
+			}
+			if keys.Contains(key) {
+				p.logger.Info(fmt.Sprintf("Local ADB instance authenticated over TLS with key %s", key.Fingerprint()))
+				return nil
+			}
+			if !p.approveKey(ctx, conn, keys, approve, key) {
+				return fmt.Errorf("adb key %s isn't authorized", key.Fingerprint())
+			}
+			return nil
+		},
+	}
+	tlsConn := tls.Server(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// authenticate runs the device side of ADB authentication over conn, whose
+// CNXN was just read into message: it sends AUTH tokens until the host
+// signs one with an authorized key, or offers a public key that is then
+// approved. It returns false if the host must be turned away.
+func (p *AdbProxy) authenticate(ctx context.Context, conn net.Conn, message *AdbMessage) bool {
+	logger := p.logger
+	keys, approve, ok := p.authorization()
+	if !ok {
+		return false
+	}
+	for signatures := 0; ; {
+		token, err := NewAuthToken()
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to create an AUTH token: %s", err))
+			return false
+		}
+		if err := message.Set(CommandAuth, AuthToken, 0, token); err != nil {
+			logger.Error(fmt.Sprintf("Failed to build the AUTH token: %s", err))
+			return false
+		}
+		if err := message.Write(conn); err != nil {
+			logger.Error(fmt.Sprintf("Error during the AUTH token sending: %s", err))
+			return false
+		}
+		if err := message.Read(conn); err != nil {
+			logger.Error(fmt.Sprintf("Invalid ADB message read during authentication: %s", err))
+			return false
+		}
+		if message.Command() != CommandAuth {
+			logger.Info(fmt.Sprintf("Unexpected command from the local ADB instance, expected AUTH: %x", message.Command()))
+			return false
+		}
+		switch message.Arg1() {
+		case AuthSignature:
+			if key := keys.Verify(token, message.Data()); key != nil {
+				logger.Info(fmt.Sprintf("Local ADB instance authenticated with key %s (%s)", key.Fingerprint(), key.Comment))
+				return true
+			}
+			signatures++
+			if signatures >= maxAuthSignatures {
+				logger.Info("Refusing a local ADB connection: too many invalid AUTH signatures")
+				return false
+			}
+		case AuthRSAPublicKey:
+			key, err := ParsePublicKey(message.DataString())
+			if err != nil {
+				logger.Info(fmt.Sprintf("Refusing a local ADB connection offering an invalid key: %s", err))
+				return false
+			}
+			return p.approveKey(ctx, conn, keys, approve, key)
+		default:
+			logger.Info(fmt.Sprintf("Unexpected AUTH type from the local ADB instance: %d", message.Arg1()))
+			return false
+		}
+	}
+}
+
+// banner returns the CNXN device banner, with the shared device's names
+// and features where known, and generic ones derived from roomId
+// otherwise.
+func (p *AdbProxy) banner(roomId string) string {
+	p.mutex.Lock()
+	info := p.deviceInfo
+	features := p.features
+	p.mutex.Unlock()
+	generic := fmt.Sprintf("wrapper-remote-%s", roomId)
+	product, model, device := "adb-remote", generic, generic
+	if info.Product != "" {
+		product = info.Product
+	}
+	if info.Model != "" {
+		model = info.Model
+	}
+	if info.Device != "" {
+		device = info.Device
+	}
+	return fmt.Sprintf(
+		"device::ro.product.name=%s;ro.product.model=%s;ro.product.device=%s;features=%s",
+		product, model, device, features,
+	)
+}
+
+// waitOnline blocks until the device is online, or returns false if ctx is
+// done first.
+func (p *AdbProxy) waitOnline(ctx context.Context) bool {
+	p.mutex.Lock()
+	onlineSignal := p.onlineSignal
+	p.mutex.Unlock()
+	select {
+	case <-onlineSignal:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
 
@@ -65,11 +415,19 @@ func (p *AdbProxy) Connections() <-chan net.Conn {
 
 func (p *AdbProxy) Start(roomId string) error {
 	logger := p.logger
-	listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%s", p.port))
+	var listener net.Listener
+	var err error
+	if p.network == "unix" {
+		listener, err = unixsocket.Listen(p.address)
+	} else {
+		listener, err = net.Listen(p.network, p.address)
+	}
 	if err != nil {
 		return err
 	}
+	p.mutex.Lock()
 	p.listener = listener
+	p.mutex.Unlock()
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	p.cancelFunc = cancelFunc
 
@@ -84,6 +442,11 @@ func (p *AdbProxy) Start(roomId string) error {
 				logger.Error(fmt.Sprintf("Error during the connection accept: %s", err))
 				continue
 			}
+			if !p.allowed(conn.RemoteAddr()) {
+				logger.Info(fmt.Sprintf("Refusing a local connection from %s: not an allowed source", conn.RemoteAddr()))
+				_ = conn.Close()
+				continue
+			}
 			logger.Info("Accepted a new local connection, starting the CNXN handshake")
 			go p.handleConnection(ctx, conn, roomId)
 		}
@@ -93,6 +456,7 @@ func (p *AdbProxy) Start(roomId string) error {
 
 func (p *AdbProxy) handleConnection(ctx context.Context, conn net.Conn, roomId string) {
 	logger := p.logger
+	_ = conn.SetDeadline(time.Now().Add(p.handshakeTimeout))
 	message := CreateMessage()
 	if err := message.Read(conn); err != nil {
 		logger.Error(fmt.Sprintf("Invalid ADB message read from the network: %s", err))
@@ -107,16 +471,33 @@ func (p *AdbProxy) handleConnection(ctx context.Context, conn net.Conn, roomId s
 	protocolVersion := message.Arg1()
 	peerMaxMessageSize := message.Arg2()
 	logger.Info(fmt.Sprintf("Protocol version: %d, peer max message size: %d", protocolVersion, peerMaxMessageSize))
+	p.mutex.Lock()
+	cert := p.tlsCertificate
+	p.mutex.Unlock()
+	if cert != nil {
+		upgraded, err := p.upgrade(ctx, conn, message, *cert)
+		if err != nil {
+			logger.Info(fmt.Sprintf("Refusing a local ADB connection: %s", err))
+			_ = conn.Close()
+			return
+		}
+		conn = upgraded
+	} else if !p.authenticate(ctx, conn, message) {
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if !p.waitOnline(ctx) {
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Now().Add(p.handshakeTimeout))
 	// Each side of a CNXN handshake independently advertises its own
 	// MAXDATA; there is no requirement that they match. We always
 	// advertise our own capacity here regardless of what the peer offered
 	// (real adb clients commonly offer up to 1MiB, far more than our
 	// fixed-size buffers hold).
-	banner := fmt.Sprintf(
-		"device::ro.product.name=adb-remote;ro.product.model=wrapper-remote-%s;ro.product.device=wrapper-remote-%s;features=%s",
-		roomId, roomId, deviceFeatures,
-	)
-	if err := message.Set(CommandConnect, protocolVersion, MaxPayloadLength, []byte(banner)); err != nil {
+	if err := message.Set(CommandConnect, protocolVersion, MaxPayloadLength, []byte(p.banner(roomId))); err != nil {
 		logger.Error(fmt.Sprintf("Failed to build the CNXN response: %s", err))
 		_ = conn.Close()
 		return
@@ -126,6 +507,7 @@ func (p *AdbProxy) handleConnection(ctx context.Context, conn net.Conn, roomId s
 		_ = conn.Close()
 		return
 	}
+	_ = conn.SetDeadline(time.Time{})
 
 	select {
 	case p.connections <- conn:
@@ -138,8 +520,50 @@ func (p *AdbProxy) Stop() {
 	if p.cancelFunc != nil {
 		p.cancelFunc()
 	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 	if p.listener != nil {
 		_ = p.listener.Close()
 		p.listener = nil
 	}
 }
+
+func (p *AdbProxy) Addr() net.Addr {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.listener == nil {
+		return nil
+	}
+	return p.listener.Addr()
+}
+
+// ParseSourceNetworks parses a comma-separated list of networks in CIDR
+// notation, or single IP addresses, for SetAllowedSources. An empty list
+// gives nil, allowing every source.
+func ParseSourceNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid source address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source network %q: %w", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
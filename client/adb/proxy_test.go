@@ -1,10 +1,19 @@
 package adb
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -13,9 +22,43 @@ func newTestLogger() *slog.Logger {
 	return slog.New(slog.NewTextHandler(io.Discard, nil))
 }
 
+// testHostKey is the adb key the tests' local "adb servers" authenticate
+// with; generated once, since RSA key generation is slow.
+var testHostKey = sync.OnceValue(func() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+})
+
+func testHostPublicKey(t *testing.T) *PublicKey {
+	t.Helper()
+	key, err := NewPublicKey(&testHostKey().PublicKey, "test@localhost")
+	if err != nil {
+		t.Fatalf("NewPublicKey failed: %s", err)
+	}
+	return key
+}
+
+// testAuthorizedKeys authorizes testHostKey.
+func testAuthorizedKeys(t *testing.T) *AuthorizedKeys {
+	t.Helper()
+	keys, _ := LoadAuthorizedKeys("")
+	keys.Allow(testHostPublicKey(t))
+	return keys
+}
+
+// startTestProxy starts a proxy that lets testHostKey connect.
 func startTestProxy(t *testing.T, port string, roomId string) *AdbProxy {
 	t.Helper()
-	proxy := NewAdbProxy(port, newTestLogger()).(*AdbProxy)
+	return startTestProxyWithKeys(t, port, roomId, testAuthorizedKeys(t), nil)
+}
+
+func startTestProxyWithKeys(t *testing.T, port string, roomId string, keys *AuthorizedKeys, approve KeyApproveFunc) *AdbProxy {
+	t.Helper()
+	proxy := NewAdbProxy("tcp", "127.0.0.1:"+port, newTestLogger()).(*AdbProxy)
+	proxy.SetAuthorization(keys, approve)
 	if err := proxy.Start(roomId); err != nil {
 		t.Fatalf("Start failed: %s", err)
 	}
@@ -34,27 +77,68 @@ func freeLocalPort(t *testing.T) string {
 	return port
 }
 
-func TestProxyCompletesHandshakeAndYieldsConnection(t *testing.T) {
-	port := freeLocalPort(t)
-	proxy := startTestProxy(t, port, "ROOM42")
+// hostHandshake performs a local adb server's side of the CNXN handshake,
+// answering AUTH tokens the way adb does with its one key: a signature by
+// key first, then the public key. It returns the proxy's CNXN.
+func hostHandshake(conn net.Conn, key *rsa.PrivateKey) (*AdbMessage, error) {
+	message := CreateMessage()
+	if err := message.Set(CommandConnect, 1, MaxPayloadLength, []byte("host::")); err != nil {
+		return nil, err
+	}
+	if err := message.Write(conn); err != nil {
+		return nil, err
+	}
+	for signed := false; ; signed = true {
+		if err := message.Read(conn); err != nil {
+			return nil, err
+		}
+		if message.Command() != CommandAuth {
+			return message, nil
+		}
+		if message.Arg1() != AuthToken || len(message.Data()) != AuthTokenLength {
+			return nil, fmt.Errorf("expected a %d-byte AUTH token, got type %d with %d bytes", AuthTokenLength, message.Arg1(), len(message.Data()))
+		}
+		if signed {
+			publicKey, err := NewPublicKey(&key.PublicKey, "test@localhost")
+			if err != nil {
+				return nil, err
+			}
+			if err := message.Set(CommandAuth, AuthRSAPublicKey, 0, []byte(publicKey.String()+"\x00")); err != nil {
+				return nil, err
+			}
+		} else {
+			signature, err := SignAuthToken(key, message.Data())
+			if err != nil {
+				return nil, err
+			}
+			if err := message.Set(CommandAuth, AuthSignature, 0, signature); err != nil {
+				return nil, err
+			}
+		}
+		if err := message.Write(conn); err != nil {
+			return nil, err
+		}
+	}
+}
 
+func dialTestProxy(t *testing.T, port string) net.Conn {
+	t.Helper()
 	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
 	if err != nil {
 		t.Fatalf("failed to dial the proxy: %s", err)
 	}
-	defer conn.Close()
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
 
-	request := CreateMessage()
-	if err := request.Set(CommandConnect, 1, MaxPayloadLength, []byte("host::")); err != nil {
-		t.Fatalf("Set failed: %s", err)
-	}
-	if err := request.Write(conn); err != nil {
-		t.Fatalf("failed to write the CNXN request: %s", err)
-	}
+func TestProxyCompletesHandshakeAndYieldsConnection(t *testing.T) {
+	port := freeLocalPort(t)
+	proxy := startTestProxy(t, port, "ROOM42")
 
-	response := CreateMessage()
-	if err := response.Read(conn); err != nil {
-		t.Fatalf("failed to read the CNXN response: %s", err)
+	response, err := hostHandshake(dialTestProxy(t, port), testHostKey())
+	if err != nil {
+		t.Fatalf("the CNXN handshake failed: %s", err)
 	}
 	if response.Command() != CommandConnect {
 		t.Fatalf("expected a CNXN response, got %x", response.Command())
@@ -108,9 +192,43 @@ func TestProxyClosesConnectionOnUnexpectedCommand(t *testing.T) {
 	}
 }
 
+// TestProxyTimesOutStalledHandshakes checks that a local connection that
+// stops answering halfway through its handshake is closed rather than held
+// open forever.
+func TestProxyTimesOutStalledHandshakes(t *testing.T) {
+	port := freeLocalPort(t)
+	proxy := NewAdbProxy("tcp", "127.0.0.1:"+port, newTestLogger()).(*AdbProxy)
+	proxy.handshakeTimeout = 100 * time.Millisecond
+	proxy.SetAuthorization(testAuthorizedKeys(t), nil)
+	if err := proxy.Start("ROOM1"); err != nil {
+		t.Fatalf("Start failed: %s", err)
+	}
+	t.Cleanup(proxy.Stop)
+
+	// One that never sends its CNXN, and one that never answers AUTH.
+	silent := dialTestProxy(t, port)
+	stalled := dialTestProxy(t, port)
+	request := CreateMessage()
+	if err := request.Set(CommandConnect, 1, MaxPayloadLength, []byte("host::")); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	if err := request.Write(stalled); err != nil {
+		t.Fatalf("failed to write the CNXN: %s", err)
+	}
+	if err := request.Read(stalled); err != nil || request.Command() != CommandAuth {
+		t.Fatalf("expected an AUTH token, got %x (%v)", request.Command(), err)
+	}
+
+	for name, conn := range map[string]net.Conn{"silent": silent, "stalled": stalled} {
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected the proxy to close the %s connection, got err=%v", name, err)
+		}
+	}
+}
+
 func TestProxyStopClosesListener(t *testing.T) {
 	port := freeLocalPort(t)
-	proxy := NewAdbProxy(port, newTestLogger()).(*AdbProxy)
+	proxy := NewAdbProxy("tcp", "127.0.0.1:"+port, newTestLogger()).(*AdbProxy)
 	if err := proxy.Start("ROOM1"); err != nil {
 		t.Fatalf("Start failed: %s", err)
 	}
@@ -120,3 +238,317 @@ func TestProxyStopClosesListener(t *testing.T) {
 		t.Fatalf("expected dialing a stopped proxy to fail")
 	}
 }
+
+func TestProxyWithholdsHandshakeWhileOffline(t *testing.T) {
+	port := freeLocalPort(t)
+	proxy := startTestProxy(t, port, "ROOM1")
+	proxy.SetOnline(false)
+
+	conn := dialTestProxy(t, port)
+	responded := make(chan error, 1)
+	go func() {
+		_, err := hostHandshake(conn, testHostKey())
+		responded <- err
+	}()
+	select {
+	case err := <-responded:
+		t.Fatalf("did not expect a CNXN response while offline, got err=%v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	proxy.SetOnline(true)
+	select {
+	case err := <-responded:
+		if err != nil {
+			t.Fatalf("failed to read the CNXN response: %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for the CNXN response once back online")
+	}
+	select {
+	case <-proxy.Connections():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for the handshaked connection")
+	}
+}
+
+func TestProxyBannerPresentsDeviceInfo(t *testing.T) {
+	proxy := NewAdbProxy("tcp", "127.0.0.1:0", newTestLogger()).(*AdbProxy)
+	if banner := proxy.banner("ROOM1"); !strings.Contains(banner, "ro.product.model=wrapper-remote-ROOM1;") {
+		t.Fatalf("expected a generic banner before any device info, got %q", banner)
+	}
+
+	proxy.SetDeviceInfo(DeviceInfo{Product: "panther", Model: "Pixel_7", Device: "panther", Manufacturer: "Google"})
+	banner := proxy.banner("ROOM1")
+	if !strings.HasPrefix(banner, "device::ro.product.name=panther;ro.product.model=Pixel_7;ro.product.device=panther;") {
+		t.Fatalf("expected the banner to present the real device, got %q", banner)
+	}
+	if !strings.Contains(banner, "features=") {
+		t.Fatalf("expected the banner to keep advertising features, got %q", banner)
+	}
+}
+
+func TestProxyBannerAdvertisesRelayableDeviceFeatures(t *testing.T) {
+	proxy := NewAdbProxy("tcp", "127.0.0.1:0", newTestLogger()).(*AdbProxy)
+	if banner := proxy.banner("ROOM1"); !strings.HasSuffix(banner, ";features="+defaultFeatures) {
+		t.Fatalf("expected the default features before the device's are known, got %q", banner)
+	}
+
+	proxy.SetFeatures([]string{"shell_v2", "delayed_ack", "cmd"})
+	if banner := proxy.banner("ROOM1"); !strings.HasSuffix(banner, ";features=shell_v2,cmd") {
+		t.Fatalf("expected exactly the device's relayable features, got %q", banner)
+	}
+}
+
+func TestProxyRefusesUnauthorizedKeys(t *testing.T) {
+	port := freeLocalPort(t)
+	keys, _ := LoadAuthorizedKeys("")
+	proxy := startTestProxyWithKeys(t, port, "ROOM1", keys, nil)
+
+	if _, err := hostHandshake(dialTestProxy(t, port), testHostKey()); err == nil {
+		t.Fatalf("expected the handshake of an unknown key to fail")
+	}
+	select {
+	case <-proxy.Connections():
+		t.Fatalf("did not expect an unauthorized connection to be handed out")
+	default:
+	}
+}
+
+func TestProxyRefusesConnectionsWithoutAuthorization(t *testing.T) {
+	port := freeLocalPort(t)
+	proxy := NewAdbProxy("tcp", "127.0.0.1:"+port, newTestLogger()).(*AdbProxy)
+	if err := proxy.Start("ROOM1"); err != nil {
+		t.Fatalf("Start failed: %s", err)
+	}
+	defer proxy.Stop()
+
+	if _, err := hostHandshake(dialTestProxy(t, port), testHostKey()); err == nil {
+		t.Fatalf("expected a proxy without authorized keys to refuse the handshake")
+	}
+}
+
+func TestProxyApprovesAndRemembersNewKeys(t *testing.T) {
+	port := freeLocalPort(t)
+	path := filepath.Join(t.TempDir(), "adb_keys")
+	keys, err := LoadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatalf("LoadAuthorizedKeys failed: %s", err)
+	}
+	var asked []string
+	proxy := startTestProxyWithKeys(t, port, "ROOM1", keys, func(ctx context.Context, key *PublicKey) (bool, bool) {
+		asked = append(asked, key.Fingerprint())
+		return true, true
+	})
+
+	if _, err := hostHandshake(dialTestProxy(t, port), testHostKey()); err != nil {
+		t.Fatalf("expected an approved key's handshake to succeed, got %s", err)
+	}
+	<-proxy.Connections()
+	if len(asked) != 1 || asked[0] != testHostPublicKey(t).Fingerprint() {
+		t.Fatalf("expected to be asked about the host's key once, got %v", asked)
+	}
+	reloaded, err := LoadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatalf("LoadAuthorizedKeys failed: %s", err)
+	}
+	if remembered := reloaded.Keys(); len(remembered) != 1 || !remembered[0].Key.Equal(&testHostKey().PublicKey) {
+		t.Fatalf("expected the approved key to be remembered, got %d keys", len(remembered))
+	}
+}
+
+// startTestTLSProxy starts a proxy that lets testHostKey connect over TLS,
+// returning the certificate it presents.
+func startTestTLSProxy(t *testing.T, port string, keys *AuthorizedKeys) (*AdbProxy, tls.Certificate) {
+	t.Helper()
+	_, owner, _ := ed25519.GenerateKey(rand.Reader)
+	cert, err := LoadOrCreateProxyCertificate(filepath.Join(t.TempDir(), "adb_proxy.pem"), owner)
+	if err != nil {
+		t.Fatalf("LoadOrCreateProxyCertificate failed: %s", err)
+	}
+	proxy := NewAdbProxy("tcp", "127.0.0.1:"+port, newTestLogger()).(*AdbProxy)
+	proxy.SetAuthorization(keys, nil)
+	proxy.SetTLSCertificate(&cert)
+	if err := proxy.Start("ROOM1"); err != nil {
+		t.Fatalf("Start failed: %s", err)
+	}
+	t.Cleanup(proxy.Stop)
+	return proxy, cert
+}
+
+// hostTLSHandshake performs a local adb server's side of a CNXN handshake
+// the device upgrades with STLS, presenting key's certificate. It returns
+// the TLS connection and the proxy's CNXN, read over it.
+func hostTLSHandshake(conn net.Conn, key *rsa.PrivateKey) (*tls.Conn, *AdbMessage, error) {
+	message := CreateMessage()
+	if err := message.Set(CommandConnect, 1, MaxPayloadLength, []byte("host::")); err != nil {
+		return nil, nil, err
+	}
+	if err := message.Write(conn); err != nil {
+		return nil, nil, err
+	}
+	if err := message.Read(conn); err != nil {
+		return nil, nil, err
+	}
+	if message.Command() != CommandStls || message.Arg1() != StlsVersion {
+		return nil, nil, fmt.Errorf("expected STLS, got %s(%x)", message.CommandString(), message.Arg1())
+	}
+	if err := message.Write(conn); err != nil {
+		return nil, nil, err
+	}
+	cert, err := NewHostCertificate(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS13, InsecureSkipVerify: true})
+	if err := message.Read(tlsConn); err != nil {
+		return nil, nil, err
+	}
+	return tlsConn, message, nil
+}
+
+func TestProxyUpgradesConnectionsToTLS(t *testing.T) {
+	port := freeLocalPort(t)
+	proxy, cert := startTestTLSProxy(t, port, testAuthorizedKeys(t))
+
+	tlsConn, response, err := hostTLSHandshake(dialTestProxy(t, port), testHostKey())
+	if err != nil {
+		t.Fatalf("the STLS handshake failed: %s", err)
+	}
+	if response.Command() != CommandConnect || !strings.Contains(response.DataString(), "ROOM1") {
+		t.Fatalf("expected the CNXN over TLS, got %s %q", response.CommandString(), response.DataString())
+	}
+	if peer := tlsConn.ConnectionState().PeerCertificates; len(peer) == 0 || !peer[0].Equal(cert.Leaf) {
+		t.Fatalf("expected the proxy to present its certificate")
+	}
+
+	var handshaked net.Conn
+	select {
+	case handshaked = <-proxy.Connections():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for the handshaked connection")
+	}
+	defer handshaked.Close()
+	message := CreateMessage()
+	if err := message.Set(CommandOkay, 7, 1, nil); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	go func() { _ = message.Write(handshaked) }()
+	received := CreateMessage()
+	if err := received.Read(tlsConn); err != nil || received.Command() != CommandOkay || received.Arg1() != 7 {
+		t.Fatalf("expected the handed out connection to carry messages over TLS, got %v", err)
+	}
+}
+
+func TestProxyRefusesTLSClientsWithUnknownKeys(t *testing.T) {
+	port := freeLocalPort(t)
+	keys, _ := LoadAuthorizedKeys("")
+	proxy, _ := startTestTLSProxy(t, port, keys)
+
+	if _, _, err := hostTLSHandshake(dialTestProxy(t, port), testHostKey()); err == nil {
+		t.Fatalf("expected the TLS handshake of an unknown key to fail")
+	}
+	select {
+	case <-proxy.Connections():
+		t.Fatalf("did not expect an unauthorized connection to be handed out")
+	default:
+	}
+}
+
+func TestProxyPicksAFreePortForPortZero(t *testing.T) {
+	proxy := NewAdbProxy("tcp", "127.0.0.1:0", newTestLogger())
+	proxy.SetAuthorization(testAuthorizedKeys(t), nil)
+	if proxy.Addr() != nil {
+		t.Fatalf("did not expect an address before Start")
+	}
+	if err := proxy.Start("ROOM1"); err != nil {
+		t.Fatalf("Start failed: %s", err)
+	}
+	defer proxy.Stop()
+	_, port, _ := net.SplitHostPort(proxy.Addr().String())
+	if port == "0" {
+		t.Fatalf("expected a free port to be picked, got %s", proxy.Addr())
+	}
+	if _, err := hostHandshake(dialTestProxy(t, port), testHostKey()); err != nil {
+		t.Fatalf("the handshake on the picked port failed: %s", err)
+	}
+}
+
+func TestProxyListensOnAUnixSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "adbproxy")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed: %s", err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	path := filepath.Join(dir, "proxy.sock")
+	// A socket left behind by a proxy that didn't shut down cleanly.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to create a stale socket: %s", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	proxy := NewAdbProxy("unix", path, newTestLogger())
+	proxy.SetAuthorization(testAuthorizedKeys(t), nil)
+	if err := proxy.Start("ROOM1"); err != nil {
+		t.Fatalf("Start failed: %s", err)
+	}
+	defer proxy.Stop()
+	if proxy.Addr().String() != path {
+		t.Fatalf("expected the proxy to listen on %s, got %s", path, proxy.Addr())
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected the socket to be private to its user, got %v (%v)", info, err)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to dial the socket: %s", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := hostHandshake(conn, testHostKey()); err != nil {
+		t.Fatalf("the handshake over the socket failed: %s", err)
+	}
+}
+
+func TestProxyTurnsAwaySourcesOutsideTheAllowedNetworks(t *testing.T) {
+	port := freeLocalPort(t)
+	proxy := startTestProxy(t, port, "ROOM1")
+	elsewhere, _ := ParseSourceNetworks("10.0.0.0/8")
+	proxy.SetAllowedSources(elsewhere)
+
+	conn := dialTestProxy(t, port)
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the proxy to close a connection from outside the allowed networks, got %v", err)
+	}
+
+	loopback, _ := ParseSourceNetworks("10.0.0.0/8, 127.0.0.1")
+	proxy.SetAllowedSources(loopback)
+	if _, err := hostHandshake(dialTestProxy(t, port), testHostKey()); err != nil {
+		t.Fatalf("expected an allowed source to connect, got %s", err)
+	}
+}
+
+func TestParseSourceNetworks(t *testing.T) {
+	networks, err := ParseSourceNetworks("192.168.1.0/24,10.0.0.7, ::1")
+	if err != nil {
+		t.Fatalf("ParseSourceNetworks failed: %s", err)
+	}
+	var formatted []string
+	for _, network := range networks {
+		formatted = append(formatted, network.String())
+	}
+	if got := strings.Join(formatted, " "); got != "192.168.1.0/24 10.0.0.7/32 ::1/128" {
+		t.Fatalf("unexpected networks: %s", got)
+	}
+	if networks, err := ParseSourceNetworks(""); err != nil || networks != nil {
+		t.Fatalf("expected an empty list to allow everything, got %v (%v)", networks, err)
+	}
+	if _, err := ParseSourceNetworks("10.0.0.0/33"); err == nil {
+		t.Fatalf("expected an invalid network to be rejected")
+	}
+	if _, err := ParseSourceNetworks("example.com"); err == nil {
+		t.Fatalf("expected a host name to be rejected")
+	}
+}
@@ -0,0 +1,69 @@
+package adb
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// The environment variables the real adb CLI reads to find its server.
+// ADB_SERVER_SOCKET takes a full socket spec ("tcp:host:port",
+// "localfilesystem:/path/to/socket") and wins over the
+// ANDROID_ADB_SERVER_ADDRESS host/ANDROID_ADB_SERVER_PORT port pair.
+const (
+	EnvServerSocket  = "ADB_SERVER_SOCKET"
+	EnvServerAddress = "ANDROID_ADB_SERVER_ADDRESS"
+	EnvServerPort    = "ANDROID_ADB_SERVER_PORT"
+)
+
+const defaultServerHost = "127.0.0.1"
+const defaultServerPort = "5037"
+
+// ResolveServerAddress picks the adb server address to use: explicit (e.g.
+// a command line flag) if set, else the adb environment variables, else
+// configured (e.g. from the config file), else DefaultAddress. Any of them
+// may be "host:port", "tcp:host:port", "tcp:port" or
+// "localfilesystem:<unix socket path>".
+func ResolveServerAddress(explicit string, configured string) string {
+	if explicit != "" {
+		return explicit
+	}
+	if socket := os.Getenv(EnvServerSocket); socket != "" {
+		return socket
+	}
+	host, port := os.Getenv(EnvServerAddress), os.Getenv(EnvServerPort)
+	if host != "" || port != "" {
+		if host == "" {
+			host = defaultServerHost
+		}
+		if port == "" {
+			port = defaultServerPort
+		}
+		return net.JoinHostPort(host, port)
+	}
+	if configured != "" {
+		return configured
+	}
+	return DefaultAddress
+}
+
+// parseServerAddress splits an adb server address (see
+// ResolveServerAddress) into the network and address net.Dial takes.
+func parseServerAddress(address string) (network string, dialAddress string, err error) {
+	if path, ok := strings.CutPrefix(address, "localfilesystem:"); ok {
+		if path == "" {
+			return "", "", fmt.Errorf("invalid adb server address %q: missing socket path", address)
+		}
+		return "unix", path, nil
+	}
+	hostPort := strings.TrimPrefix(address, "tcp:")
+	if !strings.Contains(hostPort, ":") {
+		// "tcp:5037", like adb's own -L option accepts.
+		hostPort = net.JoinHostPort(defaultServerHost, hostPort)
+	}
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		return "", "", fmt.Errorf("invalid adb server address %q: %w", address, err)
+	}
+	return "tcp", hostPort, nil
+}
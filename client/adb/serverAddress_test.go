@@ -0,0 +1,95 @@
+package adb
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveServerAddressPrecedence(t *testing.T) {
+	t.Setenv(EnvServerSocket, "")
+	t.Setenv(EnvServerAddress, "")
+	t.Setenv(EnvServerPort, "")
+	if address := ResolveServerAddress("", ""); address != DefaultAddress {
+		t.Fatalf("expected %q without any configuration, got %q", DefaultAddress, address)
+	}
+	if address := ResolveServerAddress("", "10.0.0.2:5037"); address != "10.0.0.2:5037" {
+		t.Fatalf("expected the configured address, got %q", address)
+	}
+
+	t.Setenv(EnvServerPort, "5040")
+	if address := ResolveServerAddress("", "10.0.0.2:5037"); address != "127.0.0.1:5040" {
+		t.Fatalf("expected the environment to win over the configured address, got %q", address)
+	}
+	t.Setenv(EnvServerAddress, "adb-host")
+	if address := ResolveServerAddress("", ""); address != "adb-host:5040" {
+		t.Fatalf("expected %q, got %q", "adb-host:5040", address)
+	}
+	t.Setenv(EnvServerSocket, "localfilesystem:/run/adb.sock")
+	if address := ResolveServerAddress("", ""); address != "localfilesystem:/run/adb.sock" {
+		t.Fatalf("expected %s to win over the host/port pair, got %q", EnvServerSocket, address)
+	}
+	if address := ResolveServerAddress("tcp:lab:5037", ""); address != "tcp:lab:5037" {
+		t.Fatalf("expected the explicit address to win, got %q", address)
+	}
+}
+
+func TestParseServerAddress(t *testing.T) {
+	for _, test := range []struct {
+		address     string
+		network     string
+		dialAddress string
+	}{
+		{"127.0.0.1:5037", "tcp", "127.0.0.1:5037"},
+		{"tcp:adb-host:5037", "tcp", "adb-host:5037"},
+		{"tcp:5040", "tcp", "127.0.0.1:5040"},
+		{"tcp:[::1]:5037", "tcp", "[::1]:5037"},
+		{"localfilesystem:/run/adb.sock", "unix", "/run/adb.sock"},
+	} {
+		network, dialAddress, err := parseServerAddress(test.address)
+		if err != nil {
+			t.Fatalf("parseServerAddress(%q) failed: %s", test.address, err)
+		}
+		if network != test.network || dialAddress != test.dialAddress {
+			t.Fatalf("parseServerAddress(%q) = %s %s, expected %s %s", test.address, network, dialAddress, test.network, test.dialAddress)
+		}
+	}
+	for _, address := range []string{"localfilesystem:", "tcp:host:port:extra"} {
+		if _, _, err := parseServerAddress(address); err == nil {
+			t.Fatalf("expected parseServerAddress(%q) to fail", address)
+		}
+	}
+}
+
+func TestSmartSocketDialsUnixSocketServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "adb.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %s", path, err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if command, ok := readSmartSocketCommand(t, conn); !ok || command != "host:devices-l" {
+			t.Errorf("expected command %q, got %q", "host:devices-l", command)
+			return
+		}
+		writeSmartSocketResponse(conn, "emulator-5554          device\n")
+	}()
+
+	socket := newTestSmartSocket("localfilesystem:" + path)
+	devices, err := socket.DeviceList()
+	if err != nil {
+		t.Fatalf("DeviceList failed: %s", err)
+	}
+	if len(devices) != 1 || devices[0].Id != "emulator-5554" {
+		t.Fatalf("unexpected devices: %+v", devices)
+	}
+	if host, err := socket.ReachableHost(); err != nil || host != "127.0.0.1" {
+		t.Fatalf("expected a unix socket server to reach us on 127.0.0.1, got %q (%v)", host, err)
+	}
+}
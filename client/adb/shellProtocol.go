@@ -0,0 +1,89 @@
+package adb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Packet ids of the shell_v2 protocol ("shell,v2,..." services). Every
+// packet on such a stream, in both directions, is framed as a 1-byte id, a
+// 4-byte little-endian data length, then the data itself.
+const (
+	ShellV2Stdin      byte = 0
+	ShellV2Stdout     byte = 1
+	ShellV2Stderr     byte = 2
+	ShellV2Exit       byte = 3
+	ShellV2CloseStdin byte = 4
+	ShellV2WindowSize byte = 5
+)
+
+// ShellV2HeaderSize is the size of a shell_v2 packet header (id + length).
+const ShellV2HeaderSize = 5
+
+// maxShellV2PacketSize bounds a single received shell_v2 packet. Real adbd
+// never sends more than its own (much smaller) buffer size at once; this
+// only guards against a corrupted length allocating unbounded memory.
+const maxShellV2PacketSize = 1024 * 1024
+
+// ShellV2Packet is a single decoded shell_v2 packet.
+type ShellV2Packet struct {
+	Id   byte
+	Data []byte
+}
+
+// WriteShellV2Packet frames data as a single shell_v2 packet of type id.
+func WriteShellV2Packet(writer io.Writer, id byte, data []byte) error {
+	packet := make([]byte, ShellV2HeaderSize+len(data))
+	packet[0] = id
+	binary.LittleEndian.PutUint32(packet[1:ShellV2HeaderSize], uint32(len(data)))
+	copy(packet[ShellV2HeaderSize:], data)
+	_, err := writer.Write(packet)
+	return err
+}
+
+// ReadShellV2Packet reads the next complete shell_v2 packet from reader.
+func ReadShellV2Packet(reader io.Reader) (*ShellV2Packet, error) {
+	header := make([]byte, ShellV2HeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(header[1:])
+	if length > maxShellV2PacketSize {
+		return nil, fmt.Errorf("shell_v2 packet length %d exceeds the maximum allowed size (%d)", length, maxShellV2PacketSize)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+	return &ShellV2Packet{Id: header[0], Data: data}, nil
+}
+
+// ShellV2PacketParser incrementally decodes shell_v2 packets from
+// arbitrarily split chunks of one direction of a stream (e.g. successive
+// WRTE payloads), for observers that see the bytes as they are relayed
+// rather than reading them from a connection.
+type ShellV2PacketParser struct {
+	buffer []byte
+}
+
+// Feed consumes the next chunk of the stream, returning every packet it
+// completed. The returned packets' Data don't alias data.
+func (p *ShellV2PacketParser) Feed(data []byte) ([]ShellV2Packet, error) {
+	p.buffer = append(p.buffer, data...)
+	var packets []ShellV2Packet
+	for len(p.buffer) >= ShellV2HeaderSize {
+		length := binary.LittleEndian.Uint32(p.buffer[1:ShellV2HeaderSize])
+		if length > maxShellV2PacketSize {
+			return packets, fmt.Errorf("shell_v2 packet length %d exceeds the maximum allowed size (%d)", length, maxShellV2PacketSize)
+		}
+		if uint32(len(p.buffer)-ShellV2HeaderSize) < length {
+			break
+		}
+		packet := ShellV2Packet{Id: p.buffer[0], Data: make([]byte, length)}
+		copy(packet.Data, p.buffer[ShellV2HeaderSize:ShellV2HeaderSize+int(length)])
+		packets = append(packets, packet)
+		p.buffer = p.buffer[ShellV2HeaderSize+int(length):]
+	}
+	return packets, nil
+}
@@ -0,0 +1,71 @@
+package adb
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestShellV2PacketRoundTrip(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := WriteShellV2Packet(&buffer, ShellV2Stderr, []byte("oops")); err != nil {
+		t.Fatalf("WriteShellV2Packet failed: %s", err)
+	}
+	if err := WriteShellV2Packet(&buffer, ShellV2Exit, []byte{3}); err != nil {
+		t.Fatalf("WriteShellV2Packet failed: %s", err)
+	}
+	if !bytes.Equal(buffer.Bytes()[:ShellV2HeaderSize], []byte{ShellV2Stderr, 4, 0, 0, 0}) {
+		t.Fatalf("unexpected header encoding: %x", buffer.Bytes()[:ShellV2HeaderSize])
+	}
+
+	packet, err := ReadShellV2Packet(&buffer)
+	if err != nil {
+		t.Fatalf("ReadShellV2Packet failed: %s", err)
+	}
+	if packet.Id != ShellV2Stderr || string(packet.Data) != "oops" {
+		t.Fatalf("unexpected first packet: %+v", packet)
+	}
+	packet, err = ReadShellV2Packet(&buffer)
+	if err != nil {
+		t.Fatalf("ReadShellV2Packet failed: %s", err)
+	}
+	if packet.Id != ShellV2Exit || !bytes.Equal(packet.Data, []byte{3}) {
+		t.Fatalf("unexpected second packet: %+v", packet)
+	}
+}
+
+func TestReadShellV2PacketRejectsOversizedLength(t *testing.T) {
+	header := []byte{ShellV2Stdout, 0xff, 0xff, 0xff, 0x7f}
+	if _, err := ReadShellV2Packet(bytes.NewReader(header)); err == nil {
+		t.Fatalf("expected an error for an oversized packet length")
+	}
+}
+
+func TestShellV2PacketParserHandlesSplitPackets(t *testing.T) {
+	var stream bytes.Buffer
+	_ = WriteShellV2Packet(&stream, ShellV2Stdout, []byte("hello"))
+	_ = WriteShellV2Packet(&stream, ShellV2Stderr, nil)
+	_ = WriteShellV2Packet(&stream, ShellV2Exit, []byte{3})
+	data := stream.Bytes()
+
+	parser := ShellV2PacketParser{}
+	var packets []ShellV2Packet
+	for i := range data {
+		parsed, err := parser.Feed(data[i : i+1])
+		if err != nil {
+			t.Fatalf("Feed failed: %s", err)
+		}
+		packets = append(packets, parsed...)
+	}
+	if len(packets) != 3 {
+		t.Fatalf("expected 3 packets, got %d", len(packets))
+	}
+	if packets[0].Id != ShellV2Stdout || string(packets[0].Data) != "hello" {
+		t.Fatalf("unexpected first packet: %+v", packets[0])
+	}
+	if packets[1].Id != ShellV2Stderr || len(packets[1].Data) != 0 {
+		t.Fatalf("unexpected second packet: %+v", packets[1])
+	}
+	if packets[2].Id != ShellV2Exit || packets[2].Data[0] != 3 {
+		t.Fatalf("unexpected third packet: %+v", packets[2])
+	}
+}
@@ -1,15 +1,19 @@
 package adb
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"strconv"
+	"strings"
 )
 
-const DefaultAddress = "127.0.0.1:5037"
+// DefaultAddress is where a local adb server listens unless told otherwise
+// (see ResolveServerAddress).
+const DefaultAddress = defaultServerHost + ":" + defaultServerPort
 const responseOkay = "OKAY"
 const smartSocketMessageFormat = "%04X%s"
 
@@ -22,6 +26,14 @@ type IAdbSmartSocket interface {
 	Connect(targetSerial string) error
 	Disconnect(targetSerial string) error
 	DeviceList() ([]Device, error)
+	// TrackDevices asks the adb server to report the device list now and
+	// again every time it changes (host:track-devices-l). Each update is the
+	// full list, not a diff. The channel is closed once ctx is cancelled or
+	// the adb server connection is lost.
+	TrackDevices(ctx context.Context) (<-chan []Device, error)
+	// Features returns the adb features targetSerial and the adb server
+	// both support (host-serial:<serial>:features), e.g. "shell_v2".
+	Features(targetSerial string) ([]string, error)
 	// Transport returns a connection already inside "transport mode" for
 	// targetSerial. Real adb-server does not expose a raw ADB
 	// wire-protocol (CNXN/OPEN/WRTE/...) pass-through here: the connection
@@ -34,51 +46,131 @@ type IAdbSmartSocket interface {
 	// positioned right after the OKAY/FAIL status, ready for the raw byte
 	// stream that service produces/consumes.
 	OpenStream(targetSerial string, service string) (net.Conn, error)
+	// ReachableHost returns the host the adb server can reach this machine
+	// on, for "adb connect"ing it to a local listener: 127.0.0.1 when the
+	// server runs here, else this machine's address on the route to it.
+	ReachableHost() (string, error)
 }
 
 type AdbSmartSocket struct {
+	// Address is the adb server's address, in any form
+	// ResolveServerAddress accepts.
 	Address string
 
 	//Dependencies
 	logger *slog.Logger
 }
 
-func NewAdbSmartSocket(logger *slog.Logger) IAdbSmartSocket {
+func NewAdbSmartSocket(address string, logger *slog.Logger) IAdbSmartSocket {
 	return &AdbSmartSocket{
-		Address: DefaultAddress,
+		Address: address,
 		logger:  logger,
 	}
 }
 
 func (ss *AdbSmartSocket) DeviceList() ([]Device, error) {
-	body, err := ss.executeCommand("host:devices")
+	body, err := ss.executeCommand("host:devices-l")
 	if err != nil {
 		return nil, err
 	}
+	return parseLongDeviceList(string(body)), nil
+}
+
+func (ss *AdbSmartSocket) Features(targetSerial string) ([]string, error) {
+	body, err := ss.executeCommand(fmt.Sprintf("host-serial:%s:features", targetSerial))
+	if err != nil {
+		return nil, err
+	}
+	var features []string
+	for _, feature := range strings.Split(strings.TrimSpace(string(body)), ",") {
+		if feature != "" {
+			features = append(features, feature)
+		}
+	}
+	return features, nil
+}
+
+func (ss *AdbSmartSocket) TrackDevices(ctx context.Context) (<-chan []Device, error) {
+	logger := ss.logger
+	logger.Info("Track devices")
+	conn, err := ss.dial()
+	if err != nil {
+		return nil, err
+	}
+	if err := ss.sendCommand(conn, "host:track-devices-l"); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if err := ss.checkResult(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	updates := make(chan []Device)
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+	go func() {
+		defer close(updates)
+		defer conn.Close()
+		for {
+			body, err := ss.readResponse(conn)
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Error(fmt.Sprintf("Device tracking stopped: %s", err))
+				}
+				return
+			}
+			select {
+			case updates <- parseLongDeviceList(string(body)):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return updates, nil
+}
+
+// parseLongDeviceList parses the "adb devices -l" format: one device per
+// line, its serial, then its state, then key:value details (product:,
+// model:, transport_id:, ...). The state itself may contain spaces, e.g.
+// "no permissions (...)", so it runs up to the first key:value token.
+func parseLongDeviceList(body string) []Device {
 	deviceList := make([]Device, 0)
-	var lastIndex = 0
-	for lastIndex < len(body) {
-		deviceIdLastIndex := lastIndex
-		for deviceIdLastIndex < len(body) && body[deviceIdLastIndex] != 0x09 {
-			deviceIdLastIndex++
+	for _, line := range strings.Split(body, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		stateEnd := 1
+		for stateEnd < len(fields) && !strings.Contains(fields[stateEnd], ":") {
+			stateEnd++
 		}
-		deviceTypeLastIndex := deviceIdLastIndex + 1
-		for deviceTypeLastIndex < len(body) && body[deviceTypeLastIndex] != 0x0a {
-			deviceTypeLastIndex++
+		device := Device{
+			Id:   fields[0],
+			Type: strings.Join(fields[1:stateEnd], " "),
 		}
-		deviceId := string(body[lastIndex:deviceIdLastIndex])
-		deviceType := string(body[deviceIdLastIndex+1 : deviceTypeLastIndex])
-		deviceList = append(deviceList, Device{
-			Id:   deviceId,
-			Type: deviceType,
-		})
-		lastIndex = deviceTypeLastIndex + 1
+		for _, field := range fields[stateEnd:] {
+			key, value, _ := strings.Cut(field, ":")
+			switch key {
+			case "product":
+				device.Product = value
+			case "model":
+				device.Model = value
+			case "device":
+				device.Device = value
+			case "transport_id":
+				device.TransportId = value
+			}
+		}
+		deviceList = append(deviceList, device)
 	}
-	return deviceList, nil
+	return deviceList
 }
 
 func (ss *AdbSmartSocket) Transport(targetSerial string) (net.Conn, error) {
-	conn, err := net.Dial("tcp", ss.Address)
+	conn, err := ss.dial()
 	if err != nil {
 		return nil, err
 	}
@@ -90,7 +182,7 @@ func (ss *AdbSmartSocket) Transport(targetSerial string) (net.Conn, error) {
 }
 
 func (ss *AdbSmartSocket) OpenStream(targetSerial string, service string) (net.Conn, error) {
-	conn, err := net.Dial("tcp", ss.Address)
+	conn, err := ss.dial()
 	if err != nil {
 		return nil, err
 	}
@@ -135,6 +227,36 @@ func (ss *AdbSmartSocket) Disconnect(targetSerial string) error {
 	return err
 }
 
+func (ss *AdbSmartSocket) ReachableHost() (string, error) {
+	network, address, err := parseServerAddress(ss.Address)
+	if err != nil {
+		return "", err
+	}
+	if network == "unix" {
+		return defaultServerHost, nil
+	}
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.TCPAddr)
+	if local.IP.IsLoopback() {
+		return defaultServerHost, nil
+	}
+	return local.IP.String(), nil
+}
+
+// dial connects to the adb server, over TCP or a unix socket depending on
+// Address.
+func (ss *AdbSmartSocket) dial() (net.Conn, error) {
+	network, address, err := parseServerAddress(ss.Address)
+	if err != nil {
+		return nil, err
+	}
+	return net.Dial(network, address)
+}
+
 func (ss *AdbSmartSocket) sendCommand(conn net.Conn, command string) error {
 	_, err := conn.Write([]byte(fmt.Sprintf(smartSocketMessageFormat, len(command), command)))
 	return err
@@ -143,7 +265,7 @@ func (ss *AdbSmartSocket) sendCommand(conn net.Conn, command string) error {
 func (ss *AdbSmartSocket) executeCommand(command string) ([]byte, error) {
 	logger := ss.logger
 	logger.Info(fmt.Sprintf("Execute command: %s", command))
-	conn, err := net.Dial("tcp", ss.Address)
+	conn, err := ss.dial()
 	if err != nil {
 		return nil, err
 	}
@@ -1,6 +1,7 @@
 package adb
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
@@ -118,17 +119,16 @@ func fakeAdbTransportServer(t *testing.T, handle func(service string, conn net.C
 
 func newTestSmartSocket(address string) *AdbSmartSocket {
 	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
-	socket := NewAdbSmartSocket(logger).(*AdbSmartSocket)
-	socket.Address = address
-	return socket
+	return NewAdbSmartSocket(address, logger).(*AdbSmartSocket)
 }
 
 func TestDeviceList(t *testing.T) {
 	address := fakeAdbServer(t, func(command string, conn net.Conn) {
-		if command != "host:devices" {
-			t.Errorf("expected command %q, got %q", "host:devices", command)
+		if command != "host:devices-l" {
+			t.Errorf("expected command %q, got %q", "host:devices-l", command)
 		}
-		writeSmartSocketResponse(conn, "emulator-5554\tdevice\n192.168.1.5:5555\toffline\n")
+		writeSmartSocketResponse(conn, "emulator-5554          device product:sdk_gphone64 model:sdk_gphone64_arm64 device:emu64a transport_id:1\n"+
+			"192.168.1.5:5555       offline transport_id:2\n")
 	})
 
 	socket := newTestSmartSocket(address)
@@ -139,14 +139,90 @@ func TestDeviceList(t *testing.T) {
 	if len(devices) != 2 {
 		t.Fatalf("expected 2 devices, got %d", len(devices))
 	}
-	if devices[0].Id != "emulator-5554" || devices[0].Type != TypeDevice {
-		t.Fatalf("unexpected first device: %+v", devices[0])
+	want := Device{Id: "emulator-5554", Type: TypeDevice, Product: "sdk_gphone64", Model: "sdk_gphone64_arm64", Device: "emu64a", TransportId: "1"}
+	if devices[0] != want {
+		t.Fatalf("expected %+v, got %+v", want, devices[0])
 	}
-	if devices[1].Id != "192.168.1.5:5555" || devices[1].Type != TypeDisconnected {
+	if devices[1].Id != "192.168.1.5:5555" || devices[1].Type != TypeDisconnected || devices[1].Model != "" {
 		t.Fatalf("unexpected second device: %+v", devices[1])
 	}
 }
 
+func TestFeaturesSplitsTheFeatureList(t *testing.T) {
+	address := fakeAdbServer(t, func(command string, conn net.Conn) {
+		if command != "host-serial:emulator-5554:features" {
+			t.Errorf("expected command %q, got %q", "host-serial:emulator-5554:features", command)
+		}
+		writeSmartSocketResponse(conn, "shell_v2,cmd,stat_v2")
+	})
+
+	socket := newTestSmartSocket(address)
+	features, err := socket.Features("emulator-5554")
+	if err != nil {
+		t.Fatalf("Features failed: %s", err)
+	}
+	if strings.Join(features, ",") != "shell_v2,cmd,stat_v2" {
+		t.Fatalf("unexpected features: %q", features)
+	}
+}
+
+func TestTrackDevicesReportsEveryUpdate(t *testing.T) {
+	release := make(chan struct{})
+	address := fakeAdbServer(t, func(command string, conn net.Conn) {
+		if command != "host:track-devices-l" {
+			t.Errorf("expected command %q, got %q", "host:track-devices-l", command)
+		}
+		_, _ = conn.Write([]byte("OKAY"))
+		for _, body := range []string{
+			"emulator-5554          device product:sdk_gphone64 model:Pixel_7 device:emu64 transport_id:1\n",
+			"emulator-5554          offline transport_id:1\n0123456789ABCDEF       no permissions (missing udev rules?) usb:1-1 transport_id:2\n",
+			"",
+		} {
+			_, _ = conn.Write([]byte(fmt.Sprintf("%04x%s", len(body), body)))
+		}
+		<-release
+	})
+
+	socket := newTestSmartSocket(address)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates, err := socket.TrackDevices(ctx)
+	if err != nil {
+		t.Fatalf("TrackDevices failed: %s", err)
+	}
+	expected := [][]Device{
+		{{Id: "emulator-5554", Type: TypeDevice, Product: "sdk_gphone64", Model: "Pixel_7", Device: "emu64", TransportId: "1"}},
+		{{Id: "emulator-5554", Type: TypeDisconnected, TransportId: "1"}, {Id: "0123456789ABCDEF", Type: "no permissions (missing udev rules?)", TransportId: "2"}},
+		{},
+	}
+	for i, want := range expected {
+		select {
+		case got := <-updates:
+			if len(got) != len(want) {
+				t.Fatalf("update %d: expected %v, got %v", i, want, got)
+			}
+			for j := range want {
+				if got[j] != want[j] {
+					t.Fatalf("update %d: expected %v, got %v", i, want, got)
+				}
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for update %d", i)
+		}
+	}
+
+	cancel()
+	close(release)
+	select {
+	case _, ok := <-updates:
+		if ok {
+			t.Fatalf("expected the updates channel to be closed after cancellation")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the updates channel wasn't closed after cancellation")
+	}
+}
+
 func TestConnectSuccess(t *testing.T) {
 	address := fakeAdbServer(t, func(command string, conn net.Conn) {
 		if command != "host:connect:192.168.1.5:5555" {
@@ -0,0 +1,170 @@
+package adb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Request and response ids of the file sync protocol ("sync:" service).
+// Every sync message starts with a 4-byte ASCII id followed by a 4-byte
+// little-endian argument, whose meaning (usually a payload length) depends
+// on the id.
+const (
+	SyncStat = "STAT"
+	SyncList = "LIST"
+	SyncSend = "SEND"
+	SyncRecv = "RECV"
+	// The v2 variants (stat_v2, ls_v2, sendrecv_v2 features) of the
+	// requests above.
+	SyncStatV2  = "STA2"
+	SyncLstatV2 = "LST2"
+	SyncListV2  = "LIS2"
+	SyncSendV2  = "SND2"
+	SyncRecvV2  = "RCV2"
+	SyncDent    = "DENT"
+	SyncData    = "DATA"
+	SyncDone    = "DONE"
+	SyncOkay    = "OKAY"
+	SyncFail    = "FAIL"
+	SyncQuit    = "QUIT"
+)
+
+// SyncHeaderSize is the size of a sync message header (id + argument).
+const SyncHeaderSize = 8
+
+// SyncMaxDataLength is the largest DATA chunk real adb sends or accepts.
+const SyncMaxDataLength = 64 * 1024
+
+// SyncMaxPathLength bounds the path of a single sync request (adb itself
+// rejects anything over 1024 bytes).
+const SyncMaxPathLength = 4096
+
+// Sizes of the setup message sendrecv_v2 sends right after a SND2/RCV2
+// path request: {id, mode, flags} and {id, flags} respectively.
+const (
+	syncSendV2SetupSize = 12
+	syncRecvV2SetupSize = 8
+)
+
+// WriteSyncRequest writes a sync message with id and a payload whose
+// length is sent as the header's argument (e.g. a STAT/LIST/RECV path, or
+// a DATA chunk).
+func WriteSyncRequest(writer io.Writer, id string, payload []byte) error {
+	message := make([]byte, SyncHeaderSize+len(payload))
+	copy(message[0:4], id)
+	binary.LittleEndian.PutUint32(message[4:SyncHeaderSize], uint32(len(payload)))
+	copy(message[SyncHeaderSize:], payload)
+	_, err := writer.Write(message)
+	return err
+}
+
+// WriteSyncHeader writes a payload-less sync message whose argument is not
+// a length (e.g. DONE, which carries a modification time).
+func WriteSyncHeader(writer io.Writer, id string, argument uint32) error {
+	message := make([]byte, SyncHeaderSize)
+	copy(message[0:4], id)
+	binary.LittleEndian.PutUint32(message[4:SyncHeaderSize], argument)
+	_, err := writer.Write(message)
+	return err
+}
+
+// ReadSyncHeader reads a sync message header, returning its id and
+// argument.
+func ReadSyncHeader(reader io.Reader) (string, uint32, error) {
+	header := make([]byte, SyncHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", 0, err
+	}
+	return string(header[0:4]), binary.LittleEndian.Uint32(header[4:SyncHeaderSize]), nil
+}
+
+// SyncRequest is one request a host sent on a sync stream, as decoded by
+// SyncRequestParser. Path is set for requests that carry one (STAT, LIST,
+// SEND, RECV and their v2 variants), Length for DATA.
+type SyncRequest struct {
+	Id     string
+	Path   string
+	Length uint32
+}
+
+// SyncRequestParser incrementally decodes the host-to-device side of a sync
+// stream, i.e. the requests a guest sends, from arbitrarily split chunks
+// (e.g. successive WRTE payloads). It never buffers DATA contents, only
+// headers and paths.
+type SyncRequestParser struct {
+	buffer []byte
+	// skip counts DATA payload bytes still to be skipped.
+	skip uint32
+	// pending is a v2 request whose setup message (setupSize bytes) hasn't
+	// fully arrived yet.
+	pending   *SyncRequest
+	setupSize int
+}
+
+// Feed consumes the next chunk of the stream, returning every request it
+// completed.
+func (p *SyncRequestParser) Feed(data []byte) ([]SyncRequest, error) {
+	var requests []SyncRequest
+	for len(data) > 0 && p.skip > 0 {
+		n := min(uint32(len(data)), p.skip)
+		p.skip -= n
+		data = data[n:]
+	}
+	p.buffer = append(p.buffer, data...)
+
+	for {
+		if p.skip > 0 {
+			n := min(uint32(len(p.buffer)), p.skip)
+			p.skip -= n
+			p.buffer = p.buffer[n:]
+			if p.skip > 0 {
+				return requests, nil
+			}
+		}
+		if p.pending != nil {
+			if len(p.buffer) < p.setupSize {
+				return requests, nil
+			}
+			p.buffer = p.buffer[p.setupSize:]
+			requests = append(requests, *p.pending)
+			p.pending = nil
+		}
+		if len(p.buffer) < SyncHeaderSize {
+			return requests, nil
+		}
+		id := string(p.buffer[0:4])
+		argument := binary.LittleEndian.Uint32(p.buffer[4:SyncHeaderSize])
+		switch id {
+		case SyncStat, SyncStatV2, SyncLstatV2, SyncList, SyncListV2, SyncRecv, SyncSend, SyncRecvV2, SyncSendV2:
+			if argument > SyncMaxPathLength {
+				return requests, fmt.Errorf("sync %s path length %d exceeds the maximum allowed (%d)", id, argument, SyncMaxPathLength)
+			}
+			if uint32(len(p.buffer)) < SyncHeaderSize+argument {
+				return requests, nil
+			}
+			request := SyncRequest{Id: id, Path: string(p.buffer[SyncHeaderSize : SyncHeaderSize+argument])}
+			p.buffer = p.buffer[SyncHeaderSize+argument:]
+			switch id {
+			case SyncSendV2:
+				p.pending, p.setupSize = &request, syncSendV2SetupSize
+			case SyncRecvV2:
+				p.pending, p.setupSize = &request, syncRecvV2SetupSize
+			default:
+				requests = append(requests, request)
+			}
+		case SyncData:
+			if argument > SyncMaxDataLength {
+				return requests, fmt.Errorf("sync DATA length %d exceeds the maximum allowed (%d)", argument, SyncMaxDataLength)
+			}
+			p.buffer = p.buffer[SyncHeaderSize:]
+			p.skip = argument
+			requests = append(requests, SyncRequest{Id: id, Length: argument})
+		case SyncDone, SyncQuit:
+			p.buffer = p.buffer[SyncHeaderSize:]
+			requests = append(requests, SyncRequest{Id: id})
+		default:
+			return requests, fmt.Errorf("unknown sync request id %q", id)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package adb
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSyncRequestEncoding(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := WriteSyncRequest(&buffer, SyncRecv, []byte("/sdcard/a.txt")); err != nil {
+		t.Fatalf("WriteSyncRequest failed: %s", err)
+	}
+	expected := append([]byte("RECV\x0d\x00\x00\x00"), "/sdcard/a.txt"...)
+	if !bytes.Equal(buffer.Bytes(), expected) {
+		t.Fatalf("unexpected encoding: %q", buffer.Bytes())
+	}
+
+	id, length, err := ReadSyncHeader(&buffer)
+	if err != nil {
+		t.Fatalf("ReadSyncHeader failed: %s", err)
+	}
+	if id != SyncRecv || length != 13 {
+		t.Fatalf("unexpected header: %s %d", id, length)
+	}
+}
+
+func TestSyncHeaderCarriesArgument(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := WriteSyncHeader(&buffer, SyncDone, 1700000000); err != nil {
+		t.Fatalf("WriteSyncHeader failed: %s", err)
+	}
+	id, argument, err := ReadSyncHeader(&buffer)
+	if err != nil {
+		t.Fatalf("ReadSyncHeader failed: %s", err)
+	}
+	if id != SyncDone || argument != 1700000000 {
+		t.Fatalf("unexpected header: %s %d", id, argument)
+	}
+}
+
+// encodeSyncSession builds the host side of a sync session: a v1 STAT, a
+// v2 RECV (path + setup message) and a v1 SEND with two DATA chunks.
+func encodeSyncSession() []byte {
+	var buffer bytes.Buffer
+	_ = WriteSyncRequest(&buffer, SyncStat, []byte("/sdcard/a"))
+	_ = WriteSyncRequest(&buffer, SyncRecvV2, []byte("/sdcard/b"))
+	_ = WriteSyncHeader(&buffer, SyncRecvV2, 0)
+	_ = WriteSyncRequest(&buffer, SyncSend, []byte("/sdcard/c,33188"))
+	_ = WriteSyncRequest(&buffer, SyncData, bytes.Repeat([]byte("x"), 100))
+	_ = WriteSyncRequest(&buffer, SyncData, []byte("DONEQUIT"))
+	_ = WriteSyncHeader(&buffer, SyncDone, 1700000000)
+	_ = WriteSyncRequest(&buffer, SyncQuit, nil)
+	return buffer.Bytes()
+}
+
+func TestSyncRequestParserHandlesArbitraryChunking(t *testing.T) {
+	session := encodeSyncSession()
+	expected := []SyncRequest{
+		{Id: SyncStat, Path: "/sdcard/a"},
+		{Id: SyncRecvV2, Path: "/sdcard/b"},
+		{Id: SyncSend, Path: "/sdcard/c,33188"},
+		{Id: SyncData, Length: 100},
+		{Id: SyncData, Length: 8},
+		{Id: SyncDone},
+		{Id: SyncQuit},
+	}
+
+	for _, chunkSize := range []int{1, 3, 7, len(session)} {
+		parser := SyncRequestParser{}
+		var requests []SyncRequest
+		for offset := 0; offset < len(session); offset += chunkSize {
+			parsed, err := parser.Feed(session[offset:min(offset+chunkSize, len(session))])
+			if err != nil {
+				t.Fatalf("chunk size %d: Feed failed: %s", chunkSize, err)
+			}
+			requests = append(requests, parsed...)
+		}
+		if len(requests) != len(expected) {
+			t.Fatalf("chunk size %d: expected %d requests, got %d: %+v", chunkSize, len(expected), len(requests), requests)
+		}
+		for i := range expected {
+			if requests[i] != expected[i] {
+				t.Fatalf("chunk size %d: request %d: expected %+v, got %+v", chunkSize, i, expected[i], requests[i])
+			}
+		}
+	}
+}
+
+func TestSyncRequestParserRejectsUnknownIds(t *testing.T) {
+	parser := SyncRequestParser{}
+	if _, err := parser.Feed([]byte("NOPE\x00\x00\x00\x00")); err == nil {
+		t.Fatalf("expected an error for an unknown request id")
+	}
+}
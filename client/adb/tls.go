@@ -0,0 +1,129 @@
+package adb
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StlsVersion is the version of the STLS handshake, its arg1.
+const StlsVersion uint32 = 0x01000000
+
+const proxyCertificateValidity = 10 * 365 * 24 * time.Hour
+
+// LoadOrCreateProxyCertificate loads the certificate an AdbProxy presents
+// to local adb servers that upgrade to TLS (see SetTLSCertificate) from
+// path, a PEM file holding it and its key. The certificate is issued by
+// owner, the client identity's key, so it can be traced back to who runs
+// the proxy; if path doesn't exist yet, has expired, or wasn't issued by
+// owner (e.g. the identity changed), a new one is generated and written
+// there with owner-only permissions.
+func LoadOrCreateProxyCertificate(path string, owner ed25519.PrivateKey) (tls.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		cert, err := tls.X509KeyPair(data, data)
+		if err == nil && issuedBy(cert.Leaf, owner) && time.Now().Before(cert.Leaf.NotAfter) {
+			return cert, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return tls.Certificate{}, err
+	}
+
+	data, err = generateProxyCertificate(owner)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(data, data)
+}
+
+func issuedBy(cert *x509.Certificate, owner ed25519.PrivateKey) bool {
+	publicKey, ok := owner.Public().(ed25519.PublicKey)
+	return ok && cert.SignatureAlgorithm == x509.PureEd25519 && ed25519.Verify(publicKey, cert.RawTBSCertificate, cert.Signature)
+}
+
+// generateProxyCertificate returns a new PEM certificate and key for an
+// AdbProxy, issued by owner.
+func generateProxyCertificate(owner ed25519.PrivateKey) ([]byte, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: "adb-remote proxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(proxyCertificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	issuer := &x509.Certificate{Subject: pkix.Name{CommonName: "adb-remote identity"}}
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, issuer, &privateKey.PublicKey, owner)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	return append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})...), nil
+}
+
+// NewHostCertificate returns the TLS client certificate an adb server
+// presents when it upgrades a connection with STLS: a self-signed one for
+// its adb key, which is what the device checks against its authorized
+// keys.
+func NewHostCertificate(key *rsa.PrivateKey) (tls.Certificate, error) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Adb", Organization: []string{"Android"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(proxyCertificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{derBytes}, PrivateKey: key}, nil
+}
+
+// peerPublicKey returns the adb key a local adb server's TLS client
+// certificate is for.
+func peerPublicKey(rawCerts [][]byte) (*PublicKey, error) {
+	if len(rawCerts) == 0 {
+		return nil, errors.New("no client certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("the client certificate isn't for an RSA key, but %T", cert.PublicKey)
+	}
+	return NewPublicKey(key, "")
+}
@@ -0,0 +1,55 @@
+package adb
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreateProxyCertificatePersistsUntilTheIdentityChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "adb_proxy.pem")
+	_, owner, _ := ed25519.GenerateKey(rand.Reader)
+
+	first, err := LoadOrCreateProxyCertificate(path, owner)
+	if err != nil {
+		t.Fatalf("LoadOrCreateProxyCertificate failed: %s", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected the certificate to be written with mode 0600, got %v (%v)", info, err)
+	}
+	if !issuedBy(first.Leaf, owner) {
+		t.Fatalf("expected the certificate to be issued by the identity key")
+	}
+	second, err := LoadOrCreateProxyCertificate(path, owner)
+	if err != nil {
+		t.Fatalf("second LoadOrCreateProxyCertificate failed: %s", err)
+	}
+	if !second.Leaf.Equal(first.Leaf) {
+		t.Fatalf("expected the same certificate to be loaded back")
+	}
+
+	_, otherOwner, _ := ed25519.GenerateKey(rand.Reader)
+	third, err := LoadOrCreateProxyCertificate(path, otherOwner)
+	if err != nil {
+		t.Fatalf("LoadOrCreateProxyCertificate failed: %s", err)
+	}
+	if third.Leaf.Equal(first.Leaf) || !issuedBy(third.Leaf, otherOwner) {
+		t.Fatalf("expected a new certificate for a different identity")
+	}
+}
+
+func TestHostCertificateCarriesTheAdbKey(t *testing.T) {
+	cert, err := NewHostCertificate(testHostKey())
+	if err != nil {
+		t.Fatalf("NewHostCertificate failed: %s", err)
+	}
+	key, err := peerPublicKey(cert.Certificate)
+	if err != nil {
+		t.Fatalf("peerPublicKey failed: %s", err)
+	}
+	if key.Fingerprint() != testHostPublicKey(t).Fingerprint() {
+		t.Fatalf("expected the certificate's key to be the adb key")
+	}
+}
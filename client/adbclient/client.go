@@ -0,0 +1,226 @@
+// Package adbclient speaks the ADB stream protocol (OPEN/WRTE/OKAY/CLSE)
+// directly over a relay.TransportClient, i.e. straight to a room owner's
+// OwnerMultiplexer, without a real adb server or AdbProxy on the guest side
+// at all. It lets Go code (tests, CI jobs) drive a shared device without
+// platform-tools installed:
+//
+//	clientId, err := controller.Handshake(transport)
+//	devices, err := controller.JoinRoom(transport, guestIdentity, roomId, nil)
+//	c := adbclient.New(transport, logger)
+//	go c.Run(ctx)
+//	result, err := c.Shell(ctx, "getprop ro.product.model")
+//
+// The higher-level helpers (Shell, Stat, List, Push, Pull, Install,
+// Forward) are all built on Open, which returns a Stream for any service
+// string the owner's adb-server understands.
+package adbclient
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/relay"
+	"adb-remote.maci.team/client/transportLayer"
+	"adb-remote.maci.team/shared/protocol"
+	"adb-remote.maci.team/shared/utils"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrClientClosed is returned by Open (and by any operation on a Stream)
+// once the Client has stopped, e.g. because the transporter connection was
+// lost.
+var ErrClientClosed = errors.New("the adb client is closed")
+
+// ErrOpenRejected is returned by Open when the owner answers an OPEN with a
+// CLSE, i.e. the requested service couldn't be opened on the device.
+var ErrOpenRejected = errors.New("the remote side rejected the stream")
+
+// adbMessagePool recycles outgoing message buffers, same as the one in
+// relay/owner.go.
+var adbMessagePool = utils.NewObjectPool(adb.CreateMessage)
+
+// Client multiplexes any number of concurrent ADB streams over a single
+// transport. Like relay.OwnerMultiplexer, its Dispatch only consumes
+// CommandAdbTransport messages, so a caller that also needs to handle other
+// message types can own the read loop itself; Run is the convenience
+// wrapper for callers that don't.
+type Client struct {
+	transport relay.TransportClient
+	// device is the index of the room device every stream is opened on.
+	device int
+	logger *slog.Logger
+
+	nextId uint32 // atomic; monotonically increasing, never reused
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	closed  bool
+}
+
+// New returns a Client for the room's first (usually only) device.
+func New(transport relay.TransportClient, logger *slog.Logger) *Client {
+	return NewForDevice(transport, 0, logger)
+}
+
+// NewForDevice returns a Client for the room's device'th device, an index
+// into the device list controller.JoinRoom returns. Clients for different
+// devices of the same room need their own transport each (see
+// relay.DeviceRouter), as Run and Dispatch expect only their device's
+// messages.
+func NewForDevice(transport relay.TransportClient, device int, logger *slog.Logger) *Client {
+	return &Client{
+		transport: transport,
+		device:    device,
+		logger:    logger,
+		streams:   make(map[uint32]*Stream),
+	}
+}
+
+// Run reads transport.Messages() until ctx is cancelled or the transport
+// is lost, dispatching every CommandAdbTransport message, then closes every
+// stream that is still open.
+func (c *Client) Run(ctx context.Context) error {
+	defer c.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case container, ok := <-c.transport.Messages():
+			if !ok {
+				return relay.ErrTransportClosed
+			}
+			message, err := container.Data()
+			if err != nil {
+				_ = container.Dispose()
+				return err
+			}
+			if message.Command() != protocol.CommandAdbTransport {
+				c.logger.Info(fmt.Sprintf("Ignoring unexpected message, command: %x", message.Command()))
+				_ = container.Dispose()
+				continue
+			}
+			c.Dispatch(container)
+		}
+	}
+}
+
+// Dispatch decodes container as an embedded ADB message and routes it to
+// the stream it belongs to. The caller must only pass containers whose
+// Command() is CommandAdbTransport; Dispatch always disposes of container
+// before returning.
+func (c *Client) Dispatch(container *transportLayer.MessageContainer) {
+	defer func() { _ = container.Dispose() }()
+
+	message, err := container.Data()
+	if err != nil {
+		c.logger.Error(fmt.Sprintf("Unusable pooled message container: %s", err))
+		return
+	}
+	payload, err := message.GetPayloadAdbTransport()
+	if err != nil {
+		c.logger.Error(fmt.Sprintf("Invalid ADB transport payload received from the owner: %s", err))
+		return
+	}
+	adbMessage, err := adb.DecodeMessage(payload.Message)
+	if err != nil {
+		c.logger.Error(fmt.Sprintf("Invalid ADB message received from the owner: %s", err))
+		return
+	}
+
+	stream := c.lookup(adbMessage.Arg2())
+	if stream == nil {
+		c.logger.Info(fmt.Sprintf("Received %s for an unknown or already-closed stream: %d", adbMessage.CommandString(), adbMessage.Arg2()))
+		// e.g. an OPEN we gave up on (ctx cancelled) that the owner
+		// accepted afterward: tell it to tear its side down rather than
+		// leaving it open for the rest of the session.
+		if command := adbMessage.Command(); command == adb.CommandOkay || command == adb.CommandWrite {
+			if err := c.send(adb.CommandClose, 0, adbMessage.Arg1(), nil); err != nil {
+				c.logger.Error(fmt.Sprintf("Failed to close the orphaned remote stream %d: %s", adbMessage.Arg1(), err))
+			}
+		}
+		return
+	}
+	switch adbMessage.Command() {
+	case adb.CommandOkay:
+		stream.handleOkay(adbMessage.Arg1())
+	case adb.CommandWrite:
+		stream.handleWrite(adbMessage.Data())
+	case adb.CommandClose:
+		stream.handleClose()
+	default:
+		c.logger.Info(fmt.Sprintf("Ignoring unexpected ADB command: %x", adbMessage.Command()))
+	}
+}
+
+// Close closes every currently open stream; Open fails with
+// ErrClientClosed afterward.
+func (c *Client) Close() {
+	c.mu.Lock()
+	c.closed = true
+	streams := make([]*Stream, 0, len(c.streams))
+	for _, stream := range c.streams {
+		streams = append(streams, stream)
+	}
+	c.mu.Unlock()
+
+	for _, stream := range streams {
+		stream.terminate(ErrClientClosed)
+	}
+}
+
+// Open requests service (e.g. "shell,v2,raw:id", "sync:", "tcp:8080") on
+// the shared device and waits until the owner accepts or rejects it.
+func (c *Client) Open(ctx context.Context, service string) (*Stream, error) {
+	stream := newStream(c, atomic.AddUint32(&c.nextId, 1))
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClientClosed
+	}
+	c.streams[stream.localId] = stream
+	c.mu.Unlock()
+
+	if err := c.send(adb.CommandOpen, stream.localId, 0, append([]byte(service), 0)); err != nil {
+		c.unregister(stream)
+		return nil, err
+	}
+
+	select {
+	case <-stream.opened:
+		return stream, nil
+	case <-stream.done:
+		return nil, fmt.Errorf("failed to open %q: %w", service, stream.err)
+	case <-ctx.Done():
+		_ = stream.Close()
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) lookup(localId uint32) *Stream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.streams[localId]
+}
+
+func (c *Client) unregister(stream *Stream) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.streams, stream.localId)
+}
+
+func (c *Client) send(command uint32, arg1 uint32, arg2 uint32, data []byte) error {
+	container := adbMessagePool.Obtain()
+	defer container.Dispose()
+	message, err := container.Data()
+	if err != nil {
+		return err
+	}
+	if err := message.Set(command, arg1, arg2, data); err != nil {
+		return err
+	}
+	return c.transport.SendAdbMessage(c.device, message)
+}
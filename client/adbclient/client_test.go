@@ -0,0 +1,383 @@
+package adbclient
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/relay"
+	"adb-remote.maci.team/client/transportLayer"
+	"adb-remote.maci.team/shared/protocol"
+	"adb-remote.maci.team/shared/utils"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// linkedTransport is one end of an in-memory room link: every ADB message
+// sent on it arrives, wrapped as a CommandAdbTransport TransporterMessage,
+// on its peer's Messages() — standing in for a transporter between an
+// adbclient.Client and a real relay.OwnerMultiplexer.
+type linkedTransport struct {
+	pool     *utils.ObjectPool[protocol.TransporterMessage]
+	messages chan *transportLayer.MessageContainer
+	peer     *linkedTransport
+}
+
+func newLinkedTransports() (*linkedTransport, *linkedTransport) {
+	factory := func() *protocol.TransporterMessage { return protocol.CreateTransporterMessage() }
+	a := &linkedTransport{pool: utils.NewObjectPool(factory), messages: make(chan *transportLayer.MessageContainer, 64)}
+	b := &linkedTransport{pool: utils.NewObjectPool(factory), messages: make(chan *transportLayer.MessageContainer, 64)}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (l *linkedTransport) SendAdbMessage(device int, message *adb.AdbMessage) error {
+	container := l.peer.pool.Obtain()
+	wrapper, err := container.Data()
+	if err != nil {
+		return err
+	}
+	wrapper.SetDirectCommand(protocol.CommandAdbTransport)
+	if err := wrapper.SetPayloadAdbTransport(&protocol.TransporterMessagePayloadAdbTransport{Device: device, Message: message.Bytes()}); err != nil {
+		return err
+	}
+	l.peer.messages <- container
+	return nil
+}
+
+func (l *linkedTransport) Messages() <-chan *transportLayer.MessageContainer {
+	return l.messages
+}
+
+// fakeDevice answers the owner multiplexer's OpenStream calls with an
+// in-memory device: scripted shell_v2 commands, an in-memory filesystem
+// behind "sync:", and an echo server behind any "tcp:" service.
+type fakeDevice struct {
+	adb.IAdbSmartSocket
+
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func newFakeDevice() *fakeDevice {
+	return &fakeDevice{files: make(map[string][]byte)}
+}
+
+func (d *fakeDevice) OpenStream(targetSerial string, service string) (net.Conn, error) {
+	deviceSide, ownerSide := net.Pipe()
+	switch {
+	case strings.HasPrefix(service, "shell,v2,raw:"):
+		go d.serveShell(deviceSide, strings.TrimPrefix(service, "shell,v2,raw:"))
+	case service == "sync:":
+		go d.serveSync(deviceSide)
+	case strings.HasPrefix(service, "tcp:"):
+		go func() {
+			defer deviceSide.Close()
+			_, _ = io.Copy(deviceSide, deviceSide)
+		}()
+	default:
+		_ = deviceSide.Close()
+		_ = ownerSide.Close()
+		return nil, errors.New("closed: unsupported service " + service)
+	}
+	return ownerSide, nil
+}
+
+func (d *fakeDevice) serveShell(conn net.Conn, command string) {
+	defer conn.Close()
+	switch command {
+	case "cat":
+		// Echo stdin back on stdout until stdin is closed.
+		for {
+			packet, err := adb.ReadShellV2Packet(conn)
+			if err != nil {
+				return
+			}
+			if packet.Id == adb.ShellV2CloseStdin {
+				_ = adb.WriteShellV2Packet(conn, adb.ShellV2Exit, []byte{0})
+				return
+			}
+			_ = adb.WriteShellV2Packet(conn, adb.ShellV2Stdout, packet.Data)
+		}
+	default:
+		_ = adb.WriteShellV2Packet(conn, adb.ShellV2Stdout, []byte("out:"+command))
+		_ = adb.WriteShellV2Packet(conn, adb.ShellV2Stderr, []byte("err:"+command))
+		_ = adb.WriteShellV2Packet(conn, adb.ShellV2Exit, []byte{7})
+	}
+}
+
+func (d *fakeDevice) serveSync(conn net.Conn) {
+	defer conn.Close()
+	for {
+		id, length, err := adb.ReadSyncHeader(conn)
+		if err != nil {
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return
+		}
+		switch id {
+		case adb.SyncStat:
+			d.mu.Lock()
+			content, ok := d.files[string(payload)]
+			d.mu.Unlock()
+			response := make([]byte, 16)
+			copy(response, adb.SyncStat)
+			if ok {
+				binary.LittleEndian.PutUint32(response[4:8], 0o100644)
+				binary.LittleEndian.PutUint32(response[8:12], uint32(len(content)))
+				binary.LittleEndian.PutUint32(response[12:16], 1700000000)
+			}
+			_, _ = conn.Write(response)
+		case adb.SyncList:
+			d.mu.Lock()
+			for name, content := range d.files {
+				dent := make([]byte, 20)
+				copy(dent, adb.SyncDent)
+				binary.LittleEndian.PutUint32(dent[4:8], 0o100644)
+				binary.LittleEndian.PutUint32(dent[8:12], uint32(len(content)))
+				binary.LittleEndian.PutUint32(dent[16:20], uint32(len(name)))
+				_, _ = conn.Write(append(dent, name...))
+			}
+			d.mu.Unlock()
+			done := make([]byte, 20)
+			copy(done, adb.SyncDone)
+			_, _ = conn.Write(done)
+		case adb.SyncSend:
+			path := string(payload[:bytes.LastIndexByte(payload, ',')])
+			var content bytes.Buffer
+			for {
+				id, length, err := adb.ReadSyncHeader(conn)
+				if err != nil {
+					return
+				}
+				if id == adb.SyncDone {
+					break
+				}
+				if _, err := io.CopyN(&content, conn, int64(length)); err != nil {
+					return
+				}
+			}
+			d.mu.Lock()
+			d.files[path] = content.Bytes()
+			d.mu.Unlock()
+			_ = adb.WriteSyncHeader(conn, adb.SyncOkay, 0)
+		case adb.SyncRecv:
+			d.mu.Lock()
+			content, ok := d.files[string(payload)]
+			d.mu.Unlock()
+			if !ok {
+				_ = adb.WriteSyncRequest(conn, adb.SyncFail, []byte("No such file or directory"))
+				continue
+			}
+			for len(content) > 0 {
+				n := min(len(content), adb.SyncMaxDataLength)
+				_ = adb.WriteSyncRequest(conn, adb.SyncData, content[:n])
+				content = content[n:]
+			}
+			_ = adb.WriteSyncHeader(conn, adb.SyncDone, 0)
+		case adb.SyncQuit:
+			return
+		}
+	}
+}
+
+// startClient wires a Client to a real OwnerMultiplexer servicing device,
+// through an in-memory link.
+func startClient(t *testing.T, device *fakeDevice) *Client {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	guestSide, ownerSide := newLinkedTransports()
+	go func() { _ = relay.RunOwner(ctx, device, []string{"emulator-5554"}, ownerSide, newTestLogger()) }()
+
+	client := New(guestSide, newTestLogger())
+	go func() { _ = client.Run(ctx) }()
+	return client
+}
+
+func testContext(t *testing.T) context.Context {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestShellDemultiplexesOutputAndExitCode(t *testing.T) {
+	client := startClient(t, newFakeDevice())
+
+	result, err := client.Shell(testContext(t), "id")
+	if err != nil {
+		t.Fatalf("Shell failed: %s", err)
+	}
+	if string(result.Stdout) != "out:id" || string(result.Stderr) != "err:id" {
+		t.Fatalf("unexpected output: stdout=%q stderr=%q", result.Stdout, result.Stderr)
+	}
+	if result.ExitCode != 7 {
+		t.Fatalf("expected exit code 7, got %d", result.ExitCode)
+	}
+}
+
+func TestShellStreamForwardsStdin(t *testing.T) {
+	client := startClient(t, newFakeDevice())
+
+	var stdout bytes.Buffer
+	exitCode, err := client.ShellStream(testContext(t), "cat", strings.NewReader("hello over stdin"), &stdout, io.Discard)
+	if err != nil {
+		t.Fatalf("ShellStream failed: %s", err)
+	}
+	if exitCode != 0 || stdout.String() != "hello over stdin" {
+		t.Fatalf("unexpected result: exit=%d stdout=%q", exitCode, stdout.String())
+	}
+}
+
+func TestOpenRejectedByTheOwner(t *testing.T) {
+	client := startClient(t, newFakeDevice())
+
+	_, err := client.Open(testContext(t), "reboot:")
+	if !errors.Is(err, ErrOpenRejected) {
+		t.Fatalf("expected ErrOpenRejected, got %v", err)
+	}
+}
+
+// TestPushPullRoundTrip pushes a file spanning several WRTEs and sync DATA
+// chunks, so it also exercises per-stream flow control in both directions.
+func TestPushPullRoundTrip(t *testing.T) {
+	client := startClient(t, newFakeDevice())
+	ctx := testContext(t)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 20000) // 320KB
+	modTime := time.Unix(1700000000, 0)
+	if err := client.Push(ctx, bytes.NewReader(content), "/sdcard/big.bin", 0o644, modTime); err != nil {
+		t.Fatalf("Push failed: %s", err)
+	}
+
+	info, err := client.Stat(ctx, "/sdcard/big.bin")
+	if err != nil {
+		t.Fatalf("Stat failed: %s", err)
+	}
+	if info.Size != uint32(len(content)) || info.IsDir() {
+		t.Fatalf("unexpected stat result: %+v", info)
+	}
+
+	var pulled bytes.Buffer
+	if err := client.Pull(ctx, "/sdcard/big.bin", &pulled); err != nil {
+		t.Fatalf("Pull failed: %s", err)
+	}
+	if !bytes.Equal(pulled.Bytes(), content) {
+		t.Fatalf("pulled content differs from what was pushed (%d vs %d bytes)", pulled.Len(), len(content))
+	}
+
+	entries, err := client.List(ctx, "/sdcard")
+	if err != nil {
+		t.Fatalf("List failed: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Name != "/sdcard/big.bin" {
+		t.Fatalf("unexpected list result: %+v", entries)
+	}
+}
+
+func TestStatAndPullMissingFile(t *testing.T) {
+	client := startClient(t, newFakeDevice())
+	ctx := testContext(t)
+
+	if _, err := client.Stat(ctx, "/nope"); !errors.Is(err, ErrRemoteNotFound) {
+		t.Fatalf("expected ErrRemoteNotFound, got %v", err)
+	}
+	err := client.Pull(ctx, "/nope", io.Discard)
+	var failErr *syncFailError
+	if !errors.As(err, &failErr) || failErr.message != "No such file or directory" {
+		t.Fatalf("expected the device's FAIL message, got %v", err)
+	}
+}
+
+func TestForwardRelaysLocalConnections(t *testing.T) {
+	client := startClient(t, newFakeDevice())
+	ctx := testContext(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	go func() { _ = client.Forward(ctx, listener, "tcp:8080") }()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buffer := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buffer); err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if string(buffer) != "ping" {
+		t.Fatalf("expected the echo, got %q", buffer)
+	}
+}
+
+// TestForwardClosesConnectionsWhenCancelled checks that cancelling ctx
+// closes the forwarded connections too, and that Forward waits for them.
+func TestForwardClosesConnectionsWhenCancelled(t *testing.T) {
+	client := startClient(t, newFakeDevice())
+	ctx, cancel := context.WithCancel(testContext(t))
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- client.Forward(ctx, listener, "tcp:8080") }()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Forward did not return after ctx was cancelled")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the forwarded connection to be closed, got err=%v", err)
+	}
+}
+
+func TestOpenFailsOnceTheClientIsClosed(t *testing.T) {
+	guestSide, _ := newLinkedTransports()
+	client := New(guestSide, newTestLogger())
+	client.Close()
+
+	if _, err := client.Open(testContext(t), "shell,v2,raw:id"); !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("expected ErrClientClosed, got %v", err)
+	}
+}
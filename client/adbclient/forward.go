@@ -0,0 +1,74 @@
+package adbclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Forward accepts connections on listener and relays each one to a fresh
+// stream opened for remote on the device (e.g. "tcp:8080",
+// "localabstract:chrome_devtools_remote"), the equivalent of "adb forward"
+// without a local adb server. It blocks until ctx is cancelled or listener
+// fails, then closes listener and every forwarded connection, and waits
+// for them to be done before returning.
+func (c *Client) Forward(ctx context.Context, listener net.Listener, remote string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var connections sync.WaitGroup
+	defer connections.Wait()
+	defer cancel()
+	defer listener.Close()
+	context.AfterFunc(ctx, func() { _ = listener.Close() })
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		connections.Add(1)
+		go func() {
+			defer connections.Done()
+			c.forwardConnection(ctx, conn, remote)
+		}()
+	}
+}
+
+// forwardConnection relays conn to a stream opened for remote until either
+// side closes or ctx is cancelled, then closes both and waits for the
+// copies to stop.
+func (c *Client) forwardConnection(ctx context.Context, conn net.Conn, remote string) {
+	defer conn.Close()
+
+	stream, err := c.Open(ctx, remote)
+	if err != nil {
+		c.logger.Error(fmt.Sprintf("Failed to open %s for a forwarded connection: %s", remote, err))
+		return
+	}
+	defer stream.Close()
+
+	// Closing both ends unblocks whichever copy is still running.
+	closeBoth := func() {
+		_ = conn.Close()
+		_ = stream.Close()
+	}
+	stop := context.AfterFunc(ctx, closeBoth)
+	defer stop()
+	var copies sync.WaitGroup
+	copies.Add(2)
+	go func() {
+		defer copies.Done()
+		defer closeBoth()
+		_, _ = io.Copy(stream, conn)
+	}()
+	go func() {
+		defer copies.Done()
+		defer closeBoth()
+		_, _ = io.Copy(conn, stream)
+	}()
+	copies.Wait()
+}
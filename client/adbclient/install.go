@@ -0,0 +1,60 @@
+package adbclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// installStagingDirectory is where Install pushes the APK before handing it
+// to the package manager, the same place "adb install" stages it on
+// devices without streamed install support.
+const installStagingDirectory = "/data/local/tmp"
+
+// Install installs the local APK at apkPath on the device, passing extra
+// "pm install" options (e.g. "-r", "-g") through as-is. It stages the APK
+// with Push, installs it with "pm install", then removes the staged copy
+// whether or not the install succeeded.
+func (c *Client) Install(ctx context.Context, apkPath string, options ...string) error {
+	file, err := os.Open(apkPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	remotePath := path.Join(installStagingDirectory, "adb-remote-"+filepath.Base(apkPath))
+	if err := c.Push(ctx, file, remotePath, 0o644, info.ModTime()); err != nil {
+		return fmt.Errorf("failed to push %s: %w", apkPath, err)
+	}
+	defer func() {
+		// Best effort: a leftover staging file is harmless.
+		_, _ = c.Shell(context.WithoutCancel(ctx), "rm -f "+shellQuote(remotePath))
+	}()
+
+	arguments := make([]string, 0, len(options)+1)
+	for _, option := range options {
+		arguments = append(arguments, shellQuote(option))
+	}
+	arguments = append(arguments, shellQuote(remotePath))
+	result, err := c.Shell(ctx, "pm install "+strings.Join(arguments, " "))
+	if err != nil {
+		return err
+	}
+	output := strings.TrimSpace(string(result.Stdout) + string(result.Stderr))
+	if result.ExitCode != 0 || !strings.Contains(output, "Success") {
+		return fmt.Errorf("install failed (exit code %d): %s", result.ExitCode, output)
+	}
+	return nil
+}
+
+// shellQuote single-quotes value for the device's /system/bin/sh.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,97 @@
+package adbclient
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNoExitCode is returned by Shell when the stream ended without the
+// device reporting the command's exit code.
+var ErrNoExitCode = errors.New("the shell stream ended without an exit code")
+
+// ShellResult is the outcome of a completed Shell command.
+type ShellResult struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
+}
+
+// Shell runs command on the device through the shell_v2 protocol and waits
+// for it to finish, returning its demultiplexed stdout, stderr and exit
+// code. A non-zero exit code is not an error; check ShellResult.ExitCode.
+func (c *Client) Shell(ctx context.Context, command string) (*ShellResult, error) {
+	var stdout, stderr bytes.Buffer
+	exitCode, err := c.ShellStream(ctx, command, nil, &stdout, &stderr)
+	if err != nil {
+		return nil, err
+	}
+	return &ShellResult{Stdout: stdout.Bytes(), Stderr: stderr.Bytes(), ExitCode: exitCode}, nil
+}
+
+// ShellStream runs command like Shell, but copies its output to stdout and
+// stderr as it arrives instead of buffering it, and feeds it stdin (if
+// non-nil) until stdin reaches EOF, at which point the remote stdin is
+// closed.
+func (c *Client) ShellStream(ctx context.Context, command string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	stream, err := c.Open(ctx, "shell,v2,raw:"+command)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+	defer closeOnCancel(ctx, stream)()
+
+	if stdin != nil {
+		go pumpShellStdin(stream, stdin)
+	}
+
+	for {
+		packet, err := adb.ReadShellV2Packet(stream)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			if errors.Is(err, io.EOF) {
+				return 0, ErrNoExitCode
+			}
+			return 0, err
+		}
+		switch packet.Id {
+		case adb.ShellV2Stdout:
+			if _, err := stdout.Write(packet.Data); err != nil {
+				return 0, err
+			}
+		case adb.ShellV2Stderr:
+			if _, err := stderr.Write(packet.Data); err != nil {
+				return 0, err
+			}
+		case adb.ShellV2Exit:
+			if len(packet.Data) < 1 {
+				return 0, fmt.Errorf("malformed shell_v2 exit packet")
+			}
+			return int(packet.Data[0]), nil
+		}
+	}
+}
+
+// pumpShellStdin forwards stdin as shell_v2 stdin packets, then closes the
+// remote stdin once it reaches EOF. Errors just stop the pump: the stream
+// itself reports anything that matters to the reading side.
+func pumpShellStdin(stream *Stream, stdin io.Reader) {
+	buffer := make([]byte, adb.MaxPayloadLength-adb.ShellV2HeaderSize)
+	for {
+		n, err := stdin.Read(buffer)
+		if n > 0 {
+			if writeErr := adb.WriteShellV2Packet(stream, adb.ShellV2Stdin, buffer[:n]); writeErr != nil {
+				return
+			}
+		}
+		if err != nil {
+			_ = adb.WriteShellV2Packet(stream, adb.ShellV2CloseStdin, nil)
+			return
+		}
+	}
+}
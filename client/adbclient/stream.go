@@ -0,0 +1,198 @@
+package adbclient
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// incomingQueueSize bounds how many received-but-unread WRTE payloads a
+// stream buffers. The owner only ever sends one WRTE per OKAY (plus the
+// first, which needs none), and we only send an OKAY once the reader has
+// taken the previous chunk, so anything beyond that is a protocol
+// violation rather than something to buffer.
+const incomingQueueSize = 4
+
+// Stream is one open ADB stream to the shared device: an io.ReadWriteCloser
+// over the service's raw byte stream. Read acknowledges each WRTE only once
+// the caller has taken it, so a slow reader applies backpressure all the
+// way to the device instead of buffering unboundedly.
+type Stream struct {
+	client  *Client
+	localId uint32
+	// remoteId is written once, before opened is closed, and only read
+	// after that.
+	remoteId uint32
+
+	opened     chan struct{}
+	sendPermit chan struct{}
+	incoming   chan []byte
+	pending    []byte
+	readMutex  sync.Mutex
+	writeMutex sync.Mutex
+
+	done     chan struct{}
+	doneOnce sync.Once
+	err      error
+}
+
+func newStream(client *Client, localId uint32) *Stream {
+	return &Stream{
+		client:     client,
+		localId:    localId,
+		opened:     make(chan struct{}),
+		sendPermit: make(chan struct{}, 1),
+		incoming:   make(chan []byte, incomingQueueSize),
+		done:       make(chan struct{}),
+	}
+}
+
+func (s *Stream) isOpened() bool {
+	select {
+	case <-s.opened:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Stream) handleOkay(remoteId uint32) {
+	if !s.isOpened() {
+		s.remoteId = remoteId
+		s.sendPermit <- struct{}{}
+		close(s.opened)
+		return
+	}
+	select {
+	case s.sendPermit <- struct{}{}:
+	default:
+		// A token is already available; tolerate a redundant OKAY rather
+		// than blocking the dispatch loop.
+	}
+}
+
+func (s *Stream) handleWrite(data []byte) {
+	// data aliases the pooled transporter message, which is recycled as
+	// soon as Dispatch returns.
+	chunk := append([]byte{}, data...)
+	select {
+	case s.incoming <- chunk:
+	default:
+		s.client.logger.Error(fmt.Sprintf("Stream %d received more unacknowledged data than allowed, closing it", s.localId))
+		_ = s.Close()
+	}
+}
+
+func (s *Stream) handleClose() {
+	if !s.isOpened() {
+		s.terminate(ErrOpenRejected)
+		return
+	}
+	s.terminate(io.EOF)
+}
+
+// terminate idempotently marks the stream done with err as the reason,
+// returning whether this call was the one that did so.
+func (s *Stream) terminate(err error) bool {
+	terminated := false
+	s.doneOnce.Do(func() {
+		s.err = err
+		close(s.done)
+		s.client.unregister(s)
+		terminated = true
+	})
+	return terminated
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	s.readMutex.Lock()
+	defer s.readMutex.Unlock()
+
+	if len(s.pending) == 0 {
+		select {
+		case chunk := <-s.incoming:
+			s.takeChunk(chunk)
+		case <-s.done:
+			// Data that arrived before the CLSE is still readable.
+			select {
+			case chunk := <-s.incoming:
+				s.pending = chunk
+			default:
+				return 0, s.err
+			}
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// takeChunk makes chunk the pending read data and acknowledges it, letting
+// the owner send the next one.
+func (s *Stream) takeChunk(chunk []byte) {
+	s.pending = chunk
+	if err := s.client.send(adb.CommandOkay, s.localId, s.remoteId, nil); err != nil {
+		s.client.logger.Error(fmt.Sprintf("Failed to acknowledge a WRTE for stream %d: %s", s.localId, err))
+		s.terminate(err)
+	}
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	written := 0
+	for written < len(p) {
+		select {
+		case <-s.sendPermit:
+		case <-s.done:
+			return written, s.writeError()
+		}
+		end := min(written+adb.MaxPayloadLength, len(p))
+		if err := s.client.send(adb.CommandWrite, s.localId, s.remoteId, p[written:end]); err != nil {
+			s.terminate(err)
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+func (s *Stream) writeError() error {
+	if errors.Is(s.err, io.EOF) {
+		return io.ErrClosedPipe
+	}
+	return s.err
+}
+
+// Close closes the stream, notifying the owner unless it already closed
+// its side.
+func (s *Stream) Close() error {
+	if !s.terminate(io.ErrClosedPipe) {
+		return nil
+	}
+	remoteId := uint32(0)
+	if s.isOpened() {
+		remoteId = s.remoteId
+	}
+	return s.client.send(adb.CommandClose, s.localId, remoteId, nil)
+}
+
+// closeOnCancel closes stream as soon as ctx is cancelled, unblocking any
+// Read/Write in progress. The returned func stops watching; call it once
+// the operation is over.
+func closeOnCancel(ctx context.Context, stream *Stream) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = stream.Close()
+		case <-stop:
+		case <-stream.done:
+		}
+	}()
+	return func() { close(stop) }
+}
@@ -0,0 +1,234 @@
+package adbclient
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrRemoteNotFound is returned by Stat when the remote path doesn't exist.
+var ErrRemoteNotFound = errors.New("remote path not found")
+
+// maxSyncNameLength bounds a DENT name or FAIL message we're willing to
+// read, guarding against a corrupted length.
+const maxSyncNameLength = 64 * 1024
+
+// FileInfo is the result of a sync STAT, or one entry of a sync LIST.
+type FileInfo struct {
+	Name    string
+	Mode    os.FileMode
+	Size    uint32
+	ModTime time.Time
+}
+
+// IsDir reports whether the entry is a directory, decoded from the raw
+// st_mode bits the device reports.
+func (f *FileInfo) IsDir() bool {
+	return f.Mode&os.ModeDir != 0
+}
+
+// syncFailError carries the message of a sync FAIL response.
+type syncFailError struct {
+	message string
+}
+
+func (e *syncFailError) Error() string {
+	return fmt.Sprintf("sync failed: %s", e.message)
+}
+
+// unixModeDirectory is the S_IFDIR bit of a raw st_mode.
+const unixModeDirectory = 0o040000
+
+func fileModeFromUnix(mode uint32) os.FileMode {
+	fileMode := os.FileMode(mode & 0o777)
+	if mode&0o170000 == unixModeDirectory {
+		fileMode |= os.ModeDir
+	}
+	return fileMode
+}
+
+// withSync opens a "sync:" stream, runs fn against it, then ends the sync
+// session with QUIT.
+func (c *Client) withSync(ctx context.Context, fn func(stream *Stream) error) error {
+	stream, err := c.Open(ctx, "sync:")
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	defer closeOnCancel(ctx, stream)()
+
+	err = fn(stream)
+	if err == nil {
+		err = adb.WriteSyncRequest(stream, adb.SyncQuit, nil)
+	}
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Stat returns information about remotePath, or ErrRemoteNotFound if it
+// doesn't exist.
+func (c *Client) Stat(ctx context.Context, remotePath string) (*FileInfo, error) {
+	var info *FileInfo
+	err := c.withSync(ctx, func(stream *Stream) error {
+		if err := adb.WriteSyncRequest(stream, adb.SyncStat, []byte(remotePath)); err != nil {
+			return err
+		}
+		id, mode, err := adb.ReadSyncHeader(stream)
+		if err != nil {
+			return err
+		}
+		if id != adb.SyncStat {
+			return fmt.Errorf("unexpected sync response to STAT: %q", id)
+		}
+		rest := make([]byte, 8)
+		if _, err := io.ReadFull(stream, rest); err != nil {
+			return err
+		}
+		if mode == 0 {
+			return fmt.Errorf("%s: %w", remotePath, ErrRemoteNotFound)
+		}
+		info = &FileInfo{
+			Name:    remotePath,
+			Mode:    fileModeFromUnix(mode),
+			Size:    binary.LittleEndian.Uint32(rest[0:4]),
+			ModTime: time.Unix(int64(binary.LittleEndian.Uint32(rest[4:8])), 0),
+		}
+		return nil
+	})
+	return info, err
+}
+
+// List returns the entries of the remote directory remotePath (including
+// "." and "..", as the device reports them).
+func (c *Client) List(ctx context.Context, remotePath string) ([]FileInfo, error) {
+	entries := make([]FileInfo, 0)
+	err := c.withSync(ctx, func(stream *Stream) error {
+		if err := adb.WriteSyncRequest(stream, adb.SyncList, []byte(remotePath)); err != nil {
+			return err
+		}
+		for {
+			id, mode, err := adb.ReadSyncHeader(stream)
+			if err != nil {
+				return err
+			}
+			rest := make([]byte, 12)
+			if _, err := io.ReadFull(stream, rest); err != nil {
+				return err
+			}
+			switch id {
+			case adb.SyncDone:
+				return nil
+			case adb.SyncDent:
+			default:
+				return fmt.Errorf("unexpected sync response to LIST: %q", id)
+			}
+			nameLength := binary.LittleEndian.Uint32(rest[8:12])
+			if nameLength > maxSyncNameLength {
+				return fmt.Errorf("sync entry name length %d exceeds the maximum allowed (%d)", nameLength, maxSyncNameLength)
+			}
+			name := make([]byte, nameLength)
+			if _, err := io.ReadFull(stream, name); err != nil {
+				return err
+			}
+			entries = append(entries, FileInfo{
+				Name:    string(name),
+				Mode:    fileModeFromUnix(mode),
+				Size:    binary.LittleEndian.Uint32(rest[0:4]),
+				ModTime: time.Unix(int64(binary.LittleEndian.Uint32(rest[4:8])), 0),
+			})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Pull copies the remote file remotePath into writer.
+func (c *Client) Pull(ctx context.Context, remotePath string, writer io.Writer) error {
+	return c.withSync(ctx, func(stream *Stream) error {
+		if err := adb.WriteSyncRequest(stream, adb.SyncRecv, []byte(remotePath)); err != nil {
+			return err
+		}
+		for {
+			id, length, err := adb.ReadSyncHeader(stream)
+			if err != nil {
+				return err
+			}
+			switch id {
+			case adb.SyncData:
+				if length > adb.SyncMaxDataLength {
+					return fmt.Errorf("sync DATA length %d exceeds the maximum allowed (%d)", length, adb.SyncMaxDataLength)
+				}
+				if _, err := io.CopyN(writer, stream, int64(length)); err != nil {
+					return err
+				}
+			case adb.SyncDone:
+				return nil
+			case adb.SyncFail:
+				return readSyncFail(stream, length)
+			default:
+				return fmt.Errorf("unexpected sync response to RECV: %q", id)
+			}
+		}
+	})
+}
+
+// Push copies everything read from reader to the remote file remotePath,
+// created with permission bits mode and modification time modTime.
+func (c *Client) Push(ctx context.Context, reader io.Reader, remotePath string, mode os.FileMode, modTime time.Time) error {
+	return c.withSync(ctx, func(stream *Stream) error {
+		request := fmt.Sprintf("%s,%d", remotePath, uint32(mode.Perm())|0o100000)
+		if err := adb.WriteSyncRequest(stream, adb.SyncSend, []byte(request)); err != nil {
+			return err
+		}
+		buffer := make([]byte, adb.SyncMaxDataLength)
+		for {
+			n, readErr := reader.Read(buffer)
+			if n > 0 {
+				if err := adb.WriteSyncRequest(stream, adb.SyncData, buffer[:n]); err != nil {
+					return err
+				}
+			}
+			if errors.Is(readErr, io.EOF) {
+				break
+			}
+			if readErr != nil {
+				return readErr
+			}
+		}
+		if err := adb.WriteSyncHeader(stream, adb.SyncDone, uint32(modTime.Unix())); err != nil {
+			return err
+		}
+		id, length, err := adb.ReadSyncHeader(stream)
+		if err != nil {
+			return err
+		}
+		switch id {
+		case adb.SyncOkay:
+			return nil
+		case adb.SyncFail:
+			return readSyncFail(stream, length)
+		default:
+			return fmt.Errorf("unexpected sync response to SEND: %q", id)
+		}
+	})
+}
+
+func readSyncFail(reader io.Reader, length uint32) error {
+	if length > maxSyncNameLength {
+		return fmt.Errorf("sync FAIL message length %d exceeds the maximum allowed (%d)", length, maxSyncNameLength)
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(reader, message); err != nil {
+		return err
+	}
+	return &syncFailError{message: string(message)}
+}
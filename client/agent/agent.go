@@ -0,0 +1,320 @@
+// Package agent runs the `agent` command: an unattended owner for device
+// labs that shares every device plugged into the adb server in a room of
+// its own, each on its own transporter connection, decides join requests
+// by a Policy, restarts rooms that fail, and reports what it's doing as a
+// Status (see Handler for the status page).
+package agent
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/audit"
+	"adb-remote.maci.team/client/controller"
+	"adb-remote.maci.team/client/identity"
+	"adb-remote.maci.team/client/relay"
+	"adb-remote.maci.team/client/transportLayer"
+	"adb-remote.maci.team/shared/protocol"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DeviceGoneGrace is how long a device may be missing from the adb
+// server's device list before its room is closed, so a guest rebooting it
+// doesn't lose the room.
+const DeviceGoneGrace = time.Minute
+
+// RestartPolicy is how the agent backs off restarting a room that failed,
+// and re-tracking devices when the adb server goes away.
+var RestartPolicy = controller.ReconnectPolicy{InitialDelay: time.Second, MaxDelay: time.Minute}
+
+// roomIdUnsafe matches what a serial may contain that a room id can't,
+// e.g. the ':' of "192.168.1.20:5555".
+var roomIdUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// Settings is what the agent shares, and how.
+type Settings struct {
+	// Devices, if set, limits the agent to these serials.
+	Devices []string
+	// RoomIdPrefix, if set, shares each device at the reserved room id
+	// RoomIdPrefix followed by its serial.
+	RoomIdPrefix string
+	Policy       *Policy
+	// ServiceFilter, if non-nil, applies to every room's guest.
+	ServiceFilter relay.ServiceFilter
+	// Publish, if non-nil, lists every room in a team's room directory,
+	// labelled with its device's model and serial.
+	Publish *controller.PublishOptions
+	// AuditLogPath, if set, is where every room's audit log is appended.
+	AuditLogPath string
+	RejoinWindow time.Duration
+	// Lease, if positive, is how long every accepted guest may stay.
+	Lease time.Duration
+}
+
+// Agent shares the adb server's devices. Create one with New.
+type Agent struct {
+	logger        *slog.Logger
+	smartSocket   adb.IAdbSmartSocket
+	ownerIdentity *identity.Identity
+	// newClient returns a started transporter connection for a room.
+	newClient func() (*transportLayer.Client, error)
+	settings  Settings
+	now       func() time.Time
+	// auditLog is the log at settings.AuditLogPath while Run runs, every
+	// room writing to it through a Logger of its own (see
+	// audit.Logger.ForRoom); nil without one.
+	auditLog *audit.Logger
+
+	mutex sync.Mutex
+	rooms map[string]*room
+}
+
+// room is the agent's room for one device.
+type room struct {
+	serial string
+	cancel context.CancelFunc
+	// removal closes the room once the device has been gone for
+	// DeviceGoneGrace; nil while the device is listed.
+	removal *time.Timer
+	// status is guarded by the agent's mutex.
+	status DeviceStatus
+}
+
+// New returns an Agent sharing smartSocket's devices as ownerIdentity,
+// connecting to the transporter with newClient.
+func New(logger *slog.Logger, smartSocket adb.IAdbSmartSocket, ownerIdentity *identity.Identity, newClient func() (*transportLayer.Client, error), settings Settings) *Agent {
+	return &Agent{
+		logger:        logger,
+		smartSocket:   smartSocket,
+		ownerIdentity: ownerIdentity,
+		newClient:     newClient,
+		settings:      settings,
+		now:           time.Now,
+		rooms:         make(map[string]*room),
+	}
+}
+
+// Run shares devices until ctx is cancelled, closing every room then. It
+// follows the adb server's device list, opening a room for every device
+// that comes online and closing it once the device is gone, and tracks
+// the devices again, with backoff, whenever the adb server stops
+// reporting them.
+func (a *Agent) Run(ctx context.Context) error {
+	if a.settings.AuditLogPath != "" {
+		auditLog, err := audit.Open(a.settings.AuditLogPath)
+		if err != nil {
+			return err
+		}
+		defer auditLog.Close()
+		a.auditLog = auditLog
+	}
+	var wg sync.WaitGroup
+	defer func() {
+		a.stopAll()
+		wg.Wait()
+	}()
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(RestartPolicy.Delay(attempt))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil
+			}
+		}
+		updates, err := a.smartSocket.TrackDevices(ctx)
+		if err != nil {
+			a.logger.Error(fmt.Sprintf("Can't track the adb server's devices: %s", err))
+			continue
+		}
+		attempt = 0
+		for devices := range updates {
+			a.update(ctx, &wg, devices)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		a.logger.Error("The adb server stopped reporting devices; tracking them again")
+		// Every device is as good as gone until the adb server is back.
+		a.update(ctx, &wg, nil)
+	}
+}
+
+// update opens rooms for the online devices of deviceList that have none,
+// and schedules the rooms of the devices missing from it for closing.
+func (a *Agent) update(ctx context.Context, wg *sync.WaitGroup, deviceList []adb.Device) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	listed := make(map[string]bool, len(deviceList))
+	for _, device := range deviceList {
+		if len(a.settings.Devices) > 0 && !slices.Contains(a.settings.Devices, device.Id) {
+			continue
+		}
+		listed[device.Id] = true
+		if r, ok := a.rooms[device.Id]; ok {
+			if r.removal != nil {
+				r.removal.Stop()
+				r.removal = nil
+			}
+			continue
+		}
+		if device.Type != adb.TypeDevice {
+			continue
+		}
+		roomCtx, cancel := context.WithCancel(ctx)
+		r := &room{
+			serial: device.Id,
+			cancel: cancel,
+			status: DeviceStatus{Serial: device.Id, Model: device.Model, State: RoomStarting, Since: a.now()},
+		}
+		a.rooms[device.Id] = r
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.runRoom(roomCtx, r)
+		}()
+	}
+	for serial, r := range a.rooms {
+		if listed[serial] || r.removal != nil {
+			continue
+		}
+		a.logger.Info(fmt.Sprintf("Device %s is gone; closing its room in %s unless it comes back", serial, DeviceGoneGrace))
+		r.removal = time.AfterFunc(DeviceGoneGrace, func() { a.remove(r) })
+	}
+}
+
+// remove closes r, unless it was replaced already.
+func (a *Agent) remove(r *room) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.rooms[r.serial] != r {
+		return
+	}
+	delete(a.rooms, r.serial)
+	r.cancel()
+}
+
+func (a *Agent) stopAll() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for serial, r := range a.rooms {
+		if r.removal != nil {
+			r.removal.Stop()
+		}
+		r.cancel()
+		delete(a.rooms, serial)
+	}
+}
+
+// runRoom shares r's device until ctx is cancelled, restarting the room
+// with backoff whenever it fails. The backoff starts over once a room was
+// created.
+func (a *Agent) runRoom(ctx context.Context, r *room) {
+	for attempt := 1; ; attempt++ {
+		created, err := a.serveRoom(ctx, r)
+		if ctx.Err() != nil {
+			return
+		}
+		if created {
+			attempt = 1
+		}
+		delay := RestartPolicy.Delay(attempt)
+		a.logger.Error(fmt.Sprintf("The room for %s failed, restarting it in %s: %s", r.serial, delay, err))
+		a.setStatus(r, func(status *DeviceStatus) {
+			status.State = RoomRestarting
+			status.Since = a.now()
+			status.RoomId = ""
+			status.GuestClientId = ""
+			status.GuestFingerprint = ""
+			status.Restarts++
+			status.LastError = err.Error()
+		})
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		a.setStatus(r, func(status *DeviceStatus) {
+			status.State = RoomStarting
+			status.Since = a.now()
+		})
+	}
+}
+
+// serveRoom shares r's device in a room on a connection of its own until
+// ctx is cancelled or the room fails, reporting whether it was created.
+func (a *Agent) serveRoom(ctx context.Context, r *room) (bool, error) {
+	client, err := a.newClient()
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+	// The handshake and room creation don't watch ctx; closing the
+	// connection makes them stop waiting.
+	stopClosing := context.AfterFunc(ctx, client.Close)
+	defer stopClosing()
+	if _, err := controller.Handshake(client); err != nil {
+		return false, err
+	}
+
+	options := controller.OwnerOptions{ServiceFilter: a.settings.ServiceFilter, RejoinWindow: a.settings.RejoinWindow}
+	if a.settings.RoomIdPrefix != "" {
+		options.RoomId = a.settings.RoomIdPrefix + roomIdUnsafe.ReplaceAllString(r.serial, "-")
+	}
+	if a.settings.Publish != nil {
+		publish := *a.settings.Publish
+		publish.Label = r.serial
+		if model := a.statusOf(r).Model; model != "" {
+			publish.Label = model + " " + r.serial
+		}
+		if len(publish.Label) > protocol.MaxListingTextLength {
+			publish.Label = publish.Label[:protocol.MaxListingTextLength]
+		}
+		options.Publish = &publish
+	}
+	if a.auditLog != nil {
+		// One logger per room: a logger attributes records to the one room
+		// and guest it was last told about.
+		options.Observers = append(options.Observers, a.auditLog.ForRoom())
+	}
+	if a.settings.Lease > 0 {
+		options.Leases = controller.NewLeases(func(string, []byte) time.Duration { return a.settings.Lease })
+	}
+
+	promptAccept := func(guestClientId string, guestPublicKey []byte) (bool, error) {
+		return a.settings.Policy.Allows(identity.Fingerprint(guestPublicKey), a.now()), nil
+	}
+	created := false
+	onEvent := func(e controller.OwnerEvent) {
+		if e.Kind == controller.OwnerRoomCreated {
+			created = true
+			a.logger.Info(fmt.Sprintf("Sharing %s in room %s", r.serial, e.RoomId))
+		}
+		a.setStatus(r, func(status *DeviceStatus) { status.apply(e, a.now()) })
+	}
+	err = controller.JoinAsRoomOwner(ctx, client, a.smartSocket, []string{r.serial}, a.ownerIdentity, promptAccept, onEvent, options)
+	if err == nil {
+		err = errors.New("the room closed")
+	}
+	return created, err
+}
+
+func (a *Agent) setStatus(r *room, update func(status *DeviceStatus)) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	update(&r.status)
+}
+
+func (a *Agent) statusOf(r *room) DeviceStatus {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return r.status
+}
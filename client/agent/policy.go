@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"adb-remote.maci.team/client/config"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Policy decides the agent's join requests, with nobody there to ask: a
+// guest may join if its identity fingerprint is trusted, at a time one of
+// the accept windows allows, if there are any.
+type Policy struct {
+	fingerprints []string
+	windows      []window
+}
+
+// window is a parsed config.AcceptWindow, in minutes since midnight.
+type window struct {
+	// days is indexed by time.Weekday; all false means every day.
+	days     [7]bool
+	from, to int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// NewPolicy returns the Policy of the agent's configuration, failing on an
+// invalid fingerprint or accept window.
+func NewPolicy(agentConfig config.AgentConfiguration) (*Policy, error) {
+	policy := &Policy{}
+	for _, fingerprint := range agentConfig.TrustedFingerprints {
+		if !strings.HasPrefix(fingerprint, "SHA256:") {
+			return nil, fmt.Errorf("invalid trusted fingerprint %q: expected SHA256:<base64>", fingerprint)
+		}
+		policy.fingerprints = append(policy.fingerprints, fingerprint)
+	}
+	for _, acceptWindow := range agentConfig.AcceptWindows {
+		parsed, err := parseWindow(acceptWindow)
+		if err != nil {
+			return nil, err
+		}
+		policy.windows = append(policy.windows, parsed)
+	}
+	return policy, nil
+}
+
+func parseWindow(acceptWindow config.AcceptWindow) (window, error) {
+	var parsed window
+	for _, day := range acceptWindow.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return window{}, fmt.Errorf("invalid accept window day %q: expected mon to sun", day)
+		}
+		parsed.days[weekday] = true
+	}
+	var err error
+	if parsed.from, err = parseClock(acceptWindow.From); err != nil {
+		return window{}, err
+	}
+	if parsed.to, err = parseClock(acceptWindow.To); err != nil {
+		return window{}, err
+	}
+	if parsed.from == parsed.to {
+		return window{}, fmt.Errorf("accept window %s to %s is empty", acceptWindow.From, acceptWindow.To)
+	}
+	return parsed, nil
+}
+
+// parseClock returns the minutes since midnight of a "15:04" time.
+func parseClock(value string) (int, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid accept window time %q: expected HH:MM", value)
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+// Allows reports whether the guest whose identity has guestFingerprint
+// may join at now.
+func (p *Policy) Allows(guestFingerprint string, now time.Time) bool {
+	if !slices.Contains(p.fingerprints, guestFingerprint) {
+		return false
+	}
+	if len(p.windows) == 0 {
+		return true
+	}
+	for _, w := range p.windows {
+		if w.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustsAnybody reports whether any guest may ever join.
+func (p *Policy) TrustsAnybody() bool {
+	return len(p.fingerprints) > 0
+}
+
+func (w window) contains(now time.Time) bool {
+	minute := now.Hour()*60 + now.Minute()
+	if w.from < w.to {
+		return w.on(now.Weekday()) && minute >= w.from && minute < w.to
+	}
+	// Past midnight: the evening part is on one of days, the morning part
+	// on the day after.
+	if minute >= w.from {
+		return w.on(now.Weekday())
+	}
+	return minute < w.to && w.on((now.Weekday()+6)%7)
+}
+
+func (w window) on(day time.Weekday) bool {
+	return w.days == [7]bool{} || w.days[day]
+}
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"adb-remote.maci.team/client/config"
+	"testing"
+	"time"
+)
+
+// monday is a Monday.
+var monday = time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+
+func at(day time.Time, hour int, minute int) time.Time {
+	return day.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute)
+}
+
+func TestPolicyOnlyAllowsTrustedFingerprints(t *testing.T) {
+	policy, err := NewPolicy(config.AgentConfiguration{TrustedFingerprints: []string{"SHA256:trusted"}})
+	if err != nil {
+		t.Fatalf("NewPolicy failed: %s", err)
+	}
+	if !policy.Allows("SHA256:trusted", monday) {
+		t.Fatalf("expected the trusted fingerprint to be allowed")
+	}
+	if policy.Allows("SHA256:other", monday) {
+		t.Fatalf("expected another fingerprint to be declined")
+	}
+}
+
+func TestPolicyAcceptWindows(t *testing.T) {
+	policy, err := NewPolicy(config.AgentConfiguration{
+		TrustedFingerprints: []string{"SHA256:trusted"},
+		AcceptWindows: []config.AcceptWindow{
+			{Days: []string{"mon", "tue"}, From: "09:00", To: "18:00"},
+			{Days: []string{"fri"}, From: "22:00", To: "02:00"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewPolicy failed: %s", err)
+	}
+	friday := monday.AddDate(0, 0, 4)
+	for _, test := range []struct {
+		now     time.Time
+		allowed bool
+	}{
+		{at(monday, 9, 0), true},
+		{at(monday, 17, 59), true},
+		{at(monday, 18, 0), false},
+		{at(monday, 8, 59), false},
+		{at(monday.AddDate(0, 0, 2), 12, 0), false}, // Wednesday
+		{at(friday, 23, 0), true},
+		{at(friday.AddDate(0, 0, 1), 1, 30), true}, // Saturday morning
+		{at(friday.AddDate(0, 0, 1), 23, 0), false},
+		{at(friday, 1, 30), false}, // Friday morning is Thursday night's
+	} {
+		if allowed := policy.Allows("SHA256:trusted", test.now); allowed != test.allowed {
+			t.Fatalf("expected %s allowed=%v, got %v", test.now.Format("Mon 15:04"), test.allowed, allowed)
+		}
+	}
+}
+
+func TestNewPolicyRejectsInvalidConfiguration(t *testing.T) {
+	for _, agentConfig := range []config.AgentConfiguration{
+		{TrustedFingerprints: []string{"trusted"}},
+		{AcceptWindows: []config.AcceptWindow{{Days: []string{"someday"}, From: "09:00", To: "18:00"}}},
+		{AcceptWindows: []config.AcceptWindow{{From: "9am", To: "18:00"}}},
+		{AcceptWindows: []config.AcceptWindow{{From: "09:00", To: "09:00"}}},
+	} {
+		if _, err := NewPolicy(agentConfig); err == nil {
+			t.Fatalf("expected %+v to be rejected", agentConfig)
+		}
+	}
+}
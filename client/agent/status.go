@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/controller"
+	"adb-remote.maci.team/client/identity"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Room states, as DeviceStatus.State.
+const (
+	// RoomStarting is a room being created.
+	RoomStarting = "starting"
+	// RoomShared is a room guests can join.
+	RoomShared = "shared"
+	// RoomRestarting is a room that failed, waiting to be created again.
+	RoomRestarting = "restarting"
+)
+
+// DeviceStatus is what the agent is doing with one device.
+type DeviceStatus struct {
+	Serial string `json:"serial"`
+	Model  string `json:"model,omitempty"`
+	// State is one of the room states; DeviceState the device's adb state
+	// while it isn't usable.
+	State       string `json:"state"`
+	DeviceState string `json:"deviceState,omitempty"`
+	RoomId      string `json:"roomId,omitempty"`
+	// Team is the team whose room directory lists the room.
+	Team             string `json:"team,omitempty"`
+	GuestClientId    string `json:"guestClientId,omitempty"`
+	GuestFingerprint string `json:"guestFingerprint,omitempty"`
+	// LeaseExpiresAt is when the guest's session lease runs out, and
+	// LeaseEnded set once it did.
+	LeaseExpiresAt *time.Time `json:"leaseExpiresAt,omitempty"`
+	LeaseEnded     bool       `json:"leaseEnded,omitempty"`
+	// Queue holds the client ids of the guests waiting to join.
+	Queue     []string `json:"queue,omitempty"`
+	Restarts  int      `json:"restarts"`
+	LastError string   `json:"lastError,omitempty"`
+	// Since is when State last changed.
+	Since time.Time `json:"since"`
+}
+
+// Status is what the agent is doing.
+type Status struct {
+	// Fingerprint is the agent's identity fingerprint, for guests to
+	// check the rooms' owner against.
+	Fingerprint string         `json:"fingerprint"`
+	Devices     []DeviceStatus `json:"devices"`
+}
+
+// apply updates the status with what e reports.
+func (s *DeviceStatus) apply(e controller.OwnerEvent, now time.Time) {
+	switch e.Kind {
+	case controller.OwnerRoomCreated:
+		s.State = RoomShared
+		s.RoomId = e.RoomId
+		s.Since = now
+	case controller.OwnerJoinDecided:
+		if e.Accepted {
+			s.GuestClientId = e.GuestClientId
+			s.GuestFingerprint = identity.Fingerprint(e.GuestPublicKey)
+		}
+	case controller.OwnerGuestLeft:
+		s.GuestClientId = ""
+		s.GuestFingerprint = ""
+		s.LeaseExpiresAt = nil
+		s.LeaseEnded = false
+	case controller.OwnerJoinQueueChanged:
+		s.Queue = e.Queue
+	case controller.OwnerLeaseChanged:
+		expiresAt := now.Add(e.Lease)
+		s.LeaseExpiresAt = &expiresAt
+	case controller.OwnerLeaseEnded:
+		s.LeaseExpiresAt = nil
+		s.LeaseEnded = true
+	case controller.OwnerDeviceOffline:
+		s.DeviceState = e.DeviceState
+	case controller.OwnerDeviceOnline:
+		s.DeviceState = ""
+	case controller.OwnerRoomPublished:
+		s.Team = e.Team
+	case controller.OwnerPublishFailed:
+		s.LastError = e.Err.Error()
+	}
+}
+
+// Status returns what the agent is doing, by device serial.
+func (a *Agent) Status() Status {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	devices := make([]DeviceStatus, 0, len(a.rooms))
+	for _, r := range a.rooms {
+		status := r.status
+		if r.removal != nil {
+			status.DeviceState = adb.TypeDisconnected
+		}
+		devices = append(devices, status)
+	}
+	slices.SortFunc(devices, func(a, b DeviceStatus) int { return strings.Compare(a.Serial, b.Serial) })
+	return Status{Fingerprint: a.ownerIdentity.Fingerprint(), Devices: devices}
+}
+
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta http-equiv="refresh" content="5"><title>adb-remote agent</title></head>
+<body>
+<h1>adb-remote agent</h1>
+<p>Owner fingerprint: <code>{{.Fingerprint}}</code></p>
+<table border="1" cellpadding="4">
+<tr><th>Device</th><th>Model</th><th>Room</th><th>State</th><th>Guest</th><th>Restarts</th><th>Last error</th></tr>
+{{range .Devices}}<tr>
+<td>{{.Serial}}{{if .DeviceState}} ({{.DeviceState}}){{end}}</td>
+<td>{{.Model}}</td>
+<td>{{.RoomId}}{{if .Team}} (team {{.Team}}){{end}}</td>
+<td>{{.State}} since {{.Since.Format "2006-01-02 15:04:05"}}</td>
+<td>{{if .GuestClientId}}{{.GuestClientId}} <code>{{.GuestFingerprint}}</code>{{if .LeaseEnded}} (lease ended){{else if .LeaseExpiresAt}} (lease until {{.LeaseExpiresAt.Format "15:04:05"}}){{end}}{{end}}{{with .Queue}} ({{len .}} waiting){{end}}</td>
+<td>{{.Restarts}}</td>
+<td>{{.LastError}}</td>
+</tr>{{else}}<tr><td colspan="7">No devices.</td></tr>{{end}}
+</table>
+</body>
+</html>
+`))
+
+// Handler serves the status page: Status as HTML at /, and as JSON at
+// /status.json.
+func (a *Agent) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = statusPage.Execute(w, a.Status())
+	})
+	mux.HandleFunc("GET /status.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(a.Status())
+	})
+	return mux
+}
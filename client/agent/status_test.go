@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"adb-remote.maci.team/client/controller"
+	"adb-remote.maci.team/client/identity"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeviceStatusFollowsOwnerEvents(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	status := DeviceStatus{Serial: "emulator-5554", State: RoomStarting}
+	guestKey := []byte("0123456789abcdef0123456789abcdef")
+
+	status.apply(controller.OwnerEvent{Kind: controller.OwnerRoomCreated, RoomId: "ROOM1"}, now)
+	status.apply(controller.OwnerEvent{Kind: controller.OwnerJoinDecided, GuestClientId: "GUEST1", GuestPublicKey: guestKey, Accepted: true}, now)
+	if status.State != RoomShared || status.RoomId != "ROOM1" || status.GuestClientId != "GUEST1" || status.GuestFingerprint != identity.Fingerprint(guestKey) {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	status.apply(controller.OwnerEvent{Kind: controller.OwnerLeaseChanged, GuestClientId: "GUEST1", Lease: time.Hour}, now)
+	if status.LeaseExpiresAt == nil || !status.LeaseExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("expected the lease to run out in an hour, got %+v", status)
+	}
+	status.apply(controller.OwnerEvent{Kind: controller.OwnerLeaseEnded, GuestClientId: "GUEST1"}, now)
+	if status.LeaseExpiresAt != nil || !status.LeaseEnded {
+		t.Fatalf("expected the lease to have ended, got %+v", status)
+	}
+	status.apply(controller.OwnerEvent{Kind: controller.OwnerJoinQueueChanged, Queue: []string{"GUEST2"}}, now)
+	if len(status.Queue) != 1 || status.Queue[0] != "GUEST2" {
+		t.Fatalf("expected GUEST2 to be waiting, got %+v", status)
+	}
+	status.apply(controller.OwnerEvent{Kind: controller.OwnerGuestLeft}, now)
+	if status.GuestClientId != "" || status.LeaseEnded {
+		t.Fatalf("expected the guest to be gone, got %+v", status)
+	}
+}
+
+func TestHandlerServesTheStatus(t *testing.T) {
+	ownerIdentity, err := identity.Load(filepath.Join(t.TempDir(), "identity"))
+	if err != nil {
+		t.Fatalf("failed to create a test identity: %s", err)
+	}
+	a := New(newTestLogger(), nil, ownerIdentity, nil, Settings{})
+	a.rooms["emulator-5554"] = &room{serial: "emulator-5554", status: DeviceStatus{Serial: "emulator-5554", State: RoomShared, RoomId: "<ROOM1>"}}
+
+	recorder := httptest.NewRecorder()
+	a.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/status.json", nil))
+	var status Status
+	if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+		t.Fatalf("invalid status JSON %q: %s", recorder.Body.String(), err)
+	}
+	if status.Fingerprint != ownerIdentity.Fingerprint() || len(status.Devices) != 1 || status.Devices[0].RoomId != "<ROOM1>" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	recorder = httptest.NewRecorder()
+	a.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if page := recorder.Body.String(); !strings.Contains(page, "&lt;ROOM1&gt;") || !strings.Contains(page, "emulator-5554") {
+		t.Fatalf("expected the page to list the room, escaped, got %q", page)
+	}
+}
+
+func newTestLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
@@ -0,0 +1,313 @@
+// Package audit records what guests do on a shared device: every service
+// they open (shell commands, installs, ...), every file they push or pull
+// over sync:, and how each stream ended, as JSON lines the owner can query
+// later with `adb-remote audit`.
+//
+// A Logger is a relay.StreamObserver; the owner controller attaches it to
+// the room's OwnerMultiplexer and tells it who the current guest is as
+// guests are accepted and leave.
+package audit
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/relay"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record event kinds.
+const (
+	EventRoomCreated   = "roomCreated"
+	EventGuestJoined   = "guestJoined"
+	EventGuestLeft     = "guestLeft"
+	EventStreamOpened  = "open"
+	EventStreamDenied  = "denied"
+	EventSyncOperation = "sync"
+	EventStreamClosed  = "close"
+)
+
+// Service kinds, a coarse classification of Record.Service.
+const (
+	KindShell   = "shell"
+	KindSync    = "sync"
+	KindInstall = "install"
+	KindOther   = "other"
+)
+
+// Record is one line of the audit log. Fields that don't apply to an event
+// are omitted.
+type Record struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	RoomId string    `json:"roomId,omitempty"`
+	// Devices lists the serials a room shares, on its roomCreated record.
+	Devices []string `json:"devices,omitempty"`
+	// Device is the serial of the device a stream was opened on.
+	Device           string `json:"device,omitempty"`
+	GuestClientId    string `json:"guestClientId,omitempty"`
+	GuestFingerprint string `json:"guestFingerprint,omitempty"`
+	StreamId         uint32 `json:"streamId,omitempty"`
+	Service          string `json:"service,omitempty"`
+	Kind             string `json:"kind,omitempty"`
+	// Command is the shell command of a shell/exec/abb service.
+	Command string `json:"command,omitempty"`
+	// SyncOperation ("stat", "list", "pull" or "push") and Path describe
+	// one request on a sync: stream.
+	SyncOperation  string    `json:"syncOperation,omitempty"`
+	Path           string    `json:"path,omitempty"`
+	OpenedAt       time.Time `json:"openedAt,omitzero"`
+	BytesFromGuest uint64    `json:"bytesFromGuest,omitempty"`
+	BytesToGuest   uint64    `json:"bytesToGuest,omitempty"`
+	Reason         string    `json:"reason,omitempty"`
+}
+
+// Logger writes Records as JSON lines. It is safe for concurrent use. A
+// Logger serves one room at a time; ForRoom returns one for another room
+// appending to the same log.
+type Logger struct {
+	output *output
+	closer io.Closer
+	now    func() time.Time
+
+	mu               sync.Mutex
+	roomId           string
+	guestClientId    string
+	guestFingerprint string
+	streams          map[uint32]*streamState
+}
+
+// output is where Loggers write their Records, one at a time so that
+// those of different rooms don't interleave.
+type output struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+// streamState is what the Logger remembers about an open stream.
+type streamState struct {
+	device   string
+	service  string
+	openedAt time.Time
+	// syncParser is non-nil for sync: streams.
+	syncParser *adb.SyncRequestParser
+}
+
+// Open returns a Logger appending to the file at path, creating it (owner
+// read/write only: it names every file and command guests touched) if
+// needed.
+func Open(path string) (*Logger, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the audit log %s: %w", path, err)
+	}
+	logger := NewLogger(file)
+	logger.closer = file
+	return logger, nil
+}
+
+// NewLogger returns a Logger writing to writer.
+func NewLogger(writer io.Writer) *Logger {
+	return &Logger{
+		output:  &output{encoder: json.NewEncoder(writer)},
+		now:     time.Now,
+		streams: make(map[uint32]*streamState),
+	}
+}
+
+// ForRoom returns a Logger for another room, writing to the same log as l,
+// so that rooms served at the same time can share one file. Only l closes
+// it.
+func (l *Logger) ForRoom() *Logger {
+	return &Logger{
+		output:  l.output,
+		now:     l.now,
+		streams: make(map[uint32]*streamState),
+	}
+}
+
+// Close closes the underlying file, if the Logger was created with Open.
+func (l *Logger) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// RoomCreated attributes every following record to the given room, and
+// records which devices it shares.
+func (l *Logger) RoomCreated(roomId string, devices []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.roomId = roomId
+	l.write(Record{Event: EventRoomCreated, Devices: devices})
+}
+
+// GuestJoined attributes every following record to the given guest.
+func (l *Logger) GuestJoined(clientId string, fingerprint string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.guestClientId = clientId
+	l.guestFingerprint = fingerprint
+	l.write(Record{Event: EventGuestJoined})
+}
+
+// GuestLeft records the current guest leaving.
+func (l *Logger) GuestLeft() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.write(Record{Event: EventGuestLeft})
+	l.guestClientId = ""
+	l.guestFingerprint = ""
+}
+
+// StreamOpened implements relay.StreamObserver.
+func (l *Logger) StreamOpened(id uint32, device string, service string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	openedAt := l.now()
+	state := &streamState{device: device, service: service, openedAt: openedAt}
+	if service == "sync:" {
+		state.syncParser = &adb.SyncRequestParser{}
+	}
+	l.streams[id] = state
+	kind, command := classify(service)
+	l.write(Record{Time: openedAt, Event: EventStreamOpened, Device: device, StreamId: id, Service: service, Kind: kind, Command: command})
+}
+
+// StreamRejected implements relay.StreamObserver.
+func (l *Logger) StreamRejected(device string, service string, reason error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kind, command := classify(service)
+	l.write(Record{Event: EventStreamDenied, Device: device, Service: service, Kind: kind, Command: command, Reason: reason.Error()})
+}
+
+// GuestData implements relay.StreamObserver: sync: streams are decoded so
+// every stat, list, pull and push is recorded with its path.
+func (l *Logger) GuestData(id uint32, data []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	state := l.streams[id]
+	if state == nil || state.syncParser == nil {
+		return
+	}
+	requests, err := state.syncParser.Feed(data)
+	for _, request := range requests {
+		operation := syncOperation(request.Id)
+		if operation == "" {
+			continue
+		}
+		path := request.Path
+		if request.Id == adb.SyncSend {
+			// A v1 SEND's path carries the file mode: "<path>,<mode>".
+			if comma := strings.LastIndexByte(path, ','); comma >= 0 {
+				path = path[:comma]
+			}
+		}
+		l.write(Record{Event: EventSyncOperation, Device: state.device, StreamId: id, Service: state.service, Kind: KindSync, SyncOperation: operation, Path: path})
+	}
+	if err != nil {
+		// Stop decoding: the rest of the stream can't be framed reliably.
+		state.syncParser = nil
+		l.write(Record{Event: EventSyncOperation, Device: state.device, StreamId: id, Service: state.service, Kind: KindSync, Reason: fmt.Sprintf("undecodable sync request: %s", err)})
+	}
+}
+
+// DeviceData implements relay.StreamObserver; device output isn't audited,
+// only its volume (see StreamClosed).
+func (l *Logger) DeviceData(id uint32, data []byte) {}
+
+// StreamClosed implements relay.StreamObserver.
+func (l *Logger) StreamClosed(id uint32, summary relay.StreamSummary) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	record := Record{
+		Event:          EventStreamClosed,
+		Device:         summary.Device,
+		StreamId:       id,
+		Service:        summary.Service,
+		BytesFromGuest: summary.BytesFromGuest,
+		BytesToGuest:   summary.BytesToGuest,
+		Reason:         summary.Reason,
+	}
+	record.Kind, record.Command = classify(summary.Service)
+	if state := l.streams[id]; state != nil {
+		record.OpenedAt = state.openedAt
+		delete(l.streams, id)
+	}
+	l.write(record)
+}
+
+// write stamps record with the time (unless already set), room and
+// current guest and appends it. l.mu must be held. Write failures are
+// dropped: an unwritable audit log must not take the shared session down
+// with it.
+func (l *Logger) write(record Record) {
+	if record.Time.IsZero() {
+		record.Time = l.now()
+	}
+	record.RoomId = l.roomId
+	record.GuestClientId = l.guestClientId
+	record.GuestFingerprint = l.guestFingerprint
+	l.output.mu.Lock()
+	defer l.output.mu.Unlock()
+	_ = l.output.encoder.Encode(record)
+}
+
+// syncOperation names the sync requests worth recording; DATA/DONE/QUIT
+// are framing and return "".
+func syncOperation(id string) string {
+	switch id {
+	case adb.SyncStat, adb.SyncStatV2, adb.SyncLstatV2:
+		return "stat"
+	case adb.SyncList, adb.SyncListV2:
+		return "list"
+	case adb.SyncRecv, adb.SyncRecvV2:
+		return "pull"
+	case adb.SyncSend, adb.SyncSendV2:
+		return "push"
+	}
+	return ""
+}
+
+// classify returns service's Kind and, for command-running services, the
+// command itself. Installs are recognised whichever way adb performs them:
+// the abb "package install" binder calls, "cmd package install" or the
+// legacy "pm install" after a push.
+func classify(service string) (string, string) {
+	name, argument, found := strings.Cut(service, ":")
+	if !found {
+		return KindOther, ""
+	}
+	switch {
+	case name == "sync":
+		return KindSync, ""
+	case name == "abb" || name == "abb_exec":
+		command := strings.ReplaceAll(argument, "\x00", " ")
+		if strings.HasPrefix(command, "package install") {
+			return KindInstall, command
+		}
+		return KindShell, command
+	case name == "exec" || name == "shell" || strings.HasPrefix(name, "shell,"):
+		if isInstallCommand(argument) {
+			return KindInstall, argument
+		}
+		return KindShell, argument
+	}
+	return KindOther, ""
+}
+
+func isInstallCommand(command string) bool {
+	fields := strings.Fields(command)
+	for i := 0; i+1 < len(fields); i++ {
+		if (fields[i] == "pm" || fields[i] == "package") && strings.HasPrefix(fields[i+1], "install") {
+			return true
+		}
+	}
+	return false
+}
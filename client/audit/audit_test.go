@@ -0,0 +1,147 @@
+package audit
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/relay"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestLogger returns a Logger writing to a buffer, with a clock that
+// advances one second per record.
+func newTestLogger() (*Logger, *bytes.Buffer) {
+	buffer := &bytes.Buffer{}
+	logger := NewLogger(buffer)
+	current := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	logger.now = func() time.Time {
+		current = current.Add(time.Second)
+		return current
+	}
+	return logger, buffer
+}
+
+func decodeRecords(t *testing.T, buffer *bytes.Buffer) []Record {
+	t.Helper()
+	var records []Record
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		record := Record{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid audit line %q: %s", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestLoggerRecordsAGuestSession(t *testing.T) {
+	logger, buffer := newTestLogger()
+	logger.RoomCreated("ROOM01", []string{"emulator-5554", "R58M123"})
+	logger.GuestJoined("GUEST1", "SHA256:abc")
+	logger.StreamOpened(1, "emulator-5554", "shell,v2,raw:ls /sdcard")
+	logger.StreamClosed(1, relay.StreamSummary{Device: "emulator-5554", Service: "shell,v2,raw:ls /sdcard", BytesFromGuest: 5, BytesToGuest: 120, Reason: relay.CloseReasonDevice})
+	logger.StreamRejected("R58M123", "reboot:", errors.New("denied"))
+	logger.GuestLeft()
+
+	records := decodeRecords(t, buffer)
+	events := make([]string, len(records))
+	for i, record := range records {
+		events[i] = record.Event
+	}
+	expected := []string{EventRoomCreated, EventGuestJoined, EventStreamOpened, EventStreamClosed, EventStreamDenied, EventGuestLeft}
+	if strings.Join(events, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected events %v, got %v", expected, events)
+	}
+
+	if devices := records[0].Devices; len(devices) != 2 || devices[1] != "R58M123" {
+		t.Fatalf("expected the room creation to list the shared devices, got %+v", records[0])
+	}
+	opened := records[2]
+	if opened.RoomId != "ROOM01" || opened.Device != "emulator-5554" || opened.GuestClientId != "GUEST1" || opened.GuestFingerprint != "SHA256:abc" {
+		t.Fatalf("expected the open to be attributed to the room, device and guest, got %+v", opened)
+	}
+	if opened.Kind != KindShell || opened.Command != "ls /sdcard" {
+		t.Fatalf("expected a shell command %q, got %+v", "ls /sdcard", opened)
+	}
+
+	closed := records[3]
+	if closed.Device != "emulator-5554" || closed.BytesFromGuest != 5 || closed.BytesToGuest != 120 || closed.Reason != relay.CloseReasonDevice {
+		t.Fatalf("unexpected close record: %+v", closed)
+	}
+	if closed.Time.Sub(closed.OpenedAt) != time.Second {
+		t.Fatalf("expected the close to carry the open time, got %s -> %s", closed.OpenedAt, closed.Time)
+	}
+	if records[4].Reason != "denied" || records[4].Service != "reboot:" || records[4].Device != "R58M123" {
+		t.Fatalf("unexpected denial record: %+v", records[4])
+	}
+	if records[5].GuestClientId != "GUEST1" {
+		t.Fatalf("expected the leave to still name the guest, got %+v", records[5])
+	}
+}
+
+func TestForRoomSharesTheLogBetweenRooms(t *testing.T) {
+	logger, buffer := newTestLogger()
+	other := logger.ForRoom()
+	logger.RoomCreated("ROOM01", []string{"emulator-5554"})
+	other.RoomCreated("ROOM02", []string{"R58M123"})
+	logger.GuestJoined("GUEST1", "SHA256:abc")
+	// Stream ids are per room, so the same one in another room is another
+	// stream.
+	logger.StreamOpened(1, "emulator-5554", "shell:ls")
+	other.StreamOpened(1, "R58M123", "sync:")
+	other.StreamClosed(1, relay.StreamSummary{Device: "R58M123", Service: "sync:"})
+
+	records := decodeRecords(t, buffer)
+	if len(records) != 6 {
+		t.Fatalf("expected both rooms' records in the one log, got %+v", records)
+	}
+	if records[3].RoomId != "ROOM01" || records[3].GuestClientId != "GUEST1" {
+		t.Fatalf("expected the first room's stream to be attributed to it and its guest, got %+v", records[3])
+	}
+	if records[4].RoomId != "ROOM02" || records[4].GuestClientId != "" || records[5].OpenedAt.IsZero() {
+		t.Fatalf("expected the other room's streams to be attributed to it alone, got %+v", records[4:])
+	}
+}
+
+func TestLoggerRecordsSyncPathsSplitAcrossWrites(t *testing.T) {
+	logger, buffer := newTestLogger()
+	logger.StreamOpened(7, "emulator-5554", "sync:")
+
+	var session bytes.Buffer
+	_ = adb.WriteSyncRequest(&session, adb.SyncSend, []byte("/sdcard/app.apk,33188"))
+	_ = adb.WriteSyncRequest(&session, adb.SyncData, []byte("payload"))
+	_ = adb.WriteSyncHeader(&session, adb.SyncDone, 0)
+	_ = adb.WriteSyncRequest(&session, adb.SyncRecv, []byte("/sdcard/log.txt"))
+	data := session.Bytes()
+	logger.GuestData(7, data[:11])
+	logger.GuestData(7, data[11:])
+
+	records := decodeRecords(t, buffer)
+	if len(records) != 3 {
+		t.Fatalf("expected open + push + pull records, got %+v", records)
+	}
+	if records[1].SyncOperation != "push" || records[1].Path != "/sdcard/app.apk" {
+		t.Fatalf("unexpected push record: %+v", records[1])
+	}
+	if records[2].SyncOperation != "pull" || records[2].Path != "/sdcard/log.txt" {
+		t.Fatalf("unexpected pull record: %+v", records[2])
+	}
+}
+
+func TestClassifyRecognisesInstalls(t *testing.T) {
+	for _, service := range []string{
+		"abb_exec:package\x00install-create\x00-S\x00100",
+		"exec:cmd package install -S 100",
+		"shell:pm install /data/local/tmp/app.apk",
+	} {
+		if kind, _ := classify(service); kind != KindInstall {
+			t.Fatalf("expected %q to be classified as an install, got %s", service, kind)
+		}
+	}
+	if kind, _ := classify("tcp:8080"); kind != KindOther {
+		t.Fatalf("expected tcp:8080 to be classified as other, got %s", kind)
+	}
+}
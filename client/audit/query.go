@@ -0,0 +1,136 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Query selects Records from an audit log; zero-valued fields match
+// everything.
+type Query struct {
+	Since time.Time
+	Until time.Time
+	// Guest matches a guest client id exactly, or a fingerprint by prefix
+	// (with or without the "SHA256:" scheme).
+	Guest string
+	// Events restricts the result to the given event kinds.
+	Events []string
+	// Kind matches Record.Kind exactly.
+	Kind string
+	// Service matches Record.Service by prefix.
+	Service string
+	// Contains matches a substring of the record's command or sync path.
+	Contains string
+}
+
+// Matches reports whether record satisfies every criterion of q.
+func (q *Query) Matches(record *Record) bool {
+	if !q.Since.IsZero() && record.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && record.Time.After(q.Until) {
+		return false
+	}
+	if q.Guest != "" && record.GuestClientId != q.Guest &&
+		!strings.HasPrefix(strings.TrimPrefix(record.GuestFingerprint, "SHA256:"), strings.TrimPrefix(q.Guest, "SHA256:")) {
+		return false
+	}
+	if len(q.Events) > 0 && !contains(q.Events, record.Event) {
+		return false
+	}
+	if q.Kind != "" && record.Kind != q.Kind {
+		return false
+	}
+	if q.Service != "" && !strings.HasPrefix(record.Service, q.Service) {
+		return false
+	}
+	if q.Contains != "" && !strings.Contains(record.Command, q.Contains) && !strings.Contains(record.Path, q.Contains) {
+		return false
+	}
+	return true
+}
+
+// Read calls visit, in order, for every Record of the audit log in reader
+// that matches query. A malformed line (e.g. one truncated by a crash) is
+// reported with its line number rather than silently skipped.
+func Read(reader io.Reader, query Query, visit func(Record) error) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		record := Record{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("invalid audit record on line %d: %w", line, err)
+		}
+		if !query.Matches(&record) {
+			continue
+		}
+		if err := visit(record); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// ReadFile is Read over the audit log at path.
+func ReadFile(path string, query Query, visit func(Record) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return Read(file, query, visit)
+}
+
+// Format renders record as a single human-readable line.
+func Format(record Record) string {
+	var builder strings.Builder
+	builder.WriteString(record.Time.Local().Format("2006-01-02 15:04:05"))
+	builder.WriteString(" ")
+	builder.WriteString(fmt.Sprintf("%-11s", record.Event))
+	if record.GuestClientId != "" {
+		builder.WriteString(" guest=" + record.GuestClientId)
+	}
+	if record.StreamId != 0 {
+		builder.WriteString(fmt.Sprintf(" stream=%d", record.StreamId))
+	}
+	switch {
+	case record.SyncOperation != "":
+		builder.WriteString(fmt.Sprintf(" %s %s", record.SyncOperation, record.Path))
+	case record.Command != "":
+		builder.WriteString(fmt.Sprintf(" %s %q", record.Kind, record.Command))
+	case record.Service != "":
+		builder.WriteString(fmt.Sprintf(" %q", record.Service))
+	}
+	if record.Event == EventStreamClosed {
+		builder.WriteString(fmt.Sprintf(" in=%dB out=%dB", record.BytesFromGuest, record.BytesToGuest))
+		if !record.OpenedAt.IsZero() {
+			builder.WriteString(fmt.Sprintf(" duration=%s", record.Time.Sub(record.OpenedAt).Round(time.Millisecond)))
+		}
+	}
+	if record.Event == EventGuestJoined && record.GuestFingerprint != "" {
+		builder.WriteString(" fingerprint=" + record.GuestFingerprint)
+	}
+	if record.Reason != "" {
+		builder.WriteString(" (" + record.Reason + ")")
+	}
+	return builder.String()
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package audit
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testLog = `{"time":"2026-01-02T03:00:00Z","event":"guestJoined","guestClientId":"GUEST1","guestFingerprint":"SHA256:abcdef"}
+{"time":"2026-01-02T03:01:00Z","event":"open","guestClientId":"GUEST1","guestFingerprint":"SHA256:abcdef","streamId":1,"service":"shell:ls","kind":"shell","command":"ls"}
+
+{"time":"2026-01-02T04:00:00Z","event":"sync","guestClientId":"GUEST2","guestFingerprint":"SHA256:zzz","streamId":2,"service":"sync:","kind":"sync","syncOperation":"pull","path":"/sdcard/a.txt"}
+`
+
+func readAll(t *testing.T, log string, query Query) []Record {
+	t.Helper()
+	var records []Record
+	err := Read(strings.NewReader(log), query, func(record Record) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	return records
+}
+
+func TestReadFiltersByGuestIdOrFingerprint(t *testing.T) {
+	if records := readAll(t, testLog, Query{Guest: "GUEST1"}); len(records) != 2 {
+		t.Fatalf("expected 2 records for GUEST1, got %d", len(records))
+	}
+	if records := readAll(t, testLog, Query{Guest: "abc"}); len(records) != 2 {
+		t.Fatalf("expected 2 records for fingerprint prefix abc, got %d", len(records))
+	}
+	if records := readAll(t, testLog, Query{Guest: "SHA256:zz"}); len(records) != 1 {
+		t.Fatalf("expected 1 record for fingerprint SHA256:zz, got %d", len(records))
+	}
+}
+
+func TestReadFiltersByTimeEventAndContent(t *testing.T) {
+	since := time.Date(2026, 1, 2, 3, 30, 0, 0, time.UTC)
+	if records := readAll(t, testLog, Query{Since: since}); len(records) != 1 || records[0].Path != "/sdcard/a.txt" {
+		t.Fatalf("expected only the pull after %s, got %+v", since, records)
+	}
+	if records := readAll(t, testLog, Query{Events: []string{EventStreamOpened, EventSyncOperation}}); len(records) != 2 {
+		t.Fatalf("expected 2 open/sync records, got %d", len(records))
+	}
+	if records := readAll(t, testLog, Query{Contains: "a.txt"}); len(records) != 1 {
+		t.Fatalf("expected 1 record mentioning a.txt, got %d", len(records))
+	}
+}
+
+func TestReadReportsMalformedLines(t *testing.T) {
+	err := Read(strings.NewReader(testLog+"{truncated"), Query{}, func(Record) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "line 5") {
+		t.Fatalf("expected an error naming line 5, got %v", err)
+	}
+}
+
+func TestFormatSummarisesAClose(t *testing.T) {
+	opened := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+	line := Format(Record{Time: opened.Add(1500 * time.Millisecond), Event: EventStreamClosed, StreamId: 3, Service: "shell:ls", Kind: KindShell, Command: "ls", OpenedAt: opened, BytesFromGuest: 10, BytesToGuest: 20, Reason: "closed by device"})
+	for _, expected := range []string{"close", "stream=3", `shell "ls"`, "in=10B out=20B", "duration=1.5s", "(closed by device)"} {
+		if !strings.Contains(line, expected) {
+			t.Fatalf("expected %q in %q", expected, line)
+		}
+	}
+}
+
+func TestReadFiltersByKind(t *testing.T) {
+	if records := readAll(t, testLog, Query{Kind: KindSync}); len(records) != 1 || records[0].SyncOperation != "pull" {
+		t.Fatalf("expected only the sync record, got %+v", records)
+	}
+}
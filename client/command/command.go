@@ -1,16 +1,48 @@
 package command
 
 import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/headless"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 )
 
 var InvalidCommandArgumentType = errors.New("invalid command argument type")
 
+// ExitError is returned by a handler for the process to exit with Code
+// rather than 1.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// runHeadless runs a headless session until it ends or ctx is cancelled,
+// or SIGINT or SIGTERM stops it, returning an ExitError with the
+// headless.ExitCode of how it failed.
+func runHeadless(ctx context.Context, run func(ctx context.Context) error) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := run(ctx); err != nil {
+		return &ExitError{Code: headless.ExitCode(err), Err: err}
+	}
+	return nil
+}
+
 // VerbosityDebug is the -verbosity flag value that enables debug logging
 // and packet capture (see ParseCommand).
 const VerbosityDebug = "debug"
@@ -22,6 +54,28 @@ func RegisterVerbosityFlag(flagSet *flag.FlagSet) *string {
 	return flagSet.String("verbosity", "default", `Logging verbosity: "default" or "debug" (debug also writes a packet capture .pcap file next to the log)`)
 }
 
+// RegisterControlSocketFlag adds the -controlSocket flag shared by share
+// and connect.
+func RegisterControlSocketFlag(flagSet *flag.FlagSet) *string {
+	return flagSet.String("controlSocket", "", "Unix socket to serve a JSON-RPC control API for the running session on, for other processes (IDE plugins, test harnesses) to follow and steer it")
+}
+
+// RegisterAdbServerFlag adds the -adbServer flag shared by the commands that
+// talk to an adb server.
+func RegisterAdbServerFlag(flagSet *flag.FlagSet) *string {
+	return flagSet.String("adbServer", "", `adb server address: "host:port", "tcp:host:port" or "localfilesystem:<unix socket path>" (overrides ADB_SERVER_SOCKET, ANDROID_ADB_SERVER_ADDRESS/PORT and the config file's adbServer)`)
+}
+
+// SmartSocketFor returns a smart socket for the -adbServer flag's value, or
+// smartSocket (resolved from the environment and config file) if the flag
+// isn't set.
+func SmartSocketFor(adbServer string, smartSocket adb.IAdbSmartSocket, logger *slog.Logger) adb.IAdbSmartSocket {
+	if adbServer == "" {
+		return smartSocket
+	}
+	return adb.NewAdbSmartSocket(adb.ResolveServerAddress(adbServer, ""), logger)
+}
+
 func printGlobalHelp(commands []*Command[BaseCommand]) {
 	fmt.Println("Program usage [command] [...args]")
 	fmt.Println("Commands: ")
@@ -42,7 +96,8 @@ func findCommand(commands []*Command[BaseCommand], name string) *Command[BaseCom
 }
 
 // ParseCommand parses os.Args against the given commands, connects the
-// shared transport client, and runs the matched command's handler.
+// shared transport client (unless the command is Offline), and runs the
+// matched command's handler.
 func ParseCommand(commands []*Command[BaseCommand]) error {
 	args := os.Args
 	if len(args) < 2 {
@@ -69,10 +124,15 @@ func ParseCommand(commands []*Command[BaseCommand]) error {
 		return nil
 	}
 
-	if parameter.Verbosity() == VerbosityDebug {
-		if targetCommand.LogLevel != nil {
-			targetCommand.LogLevel.Set(slog.LevelDebug)
-		}
+	debug := parameter.Verbosity() == VerbosityDebug
+	if debug && targetCommand.LogLevel != nil {
+		targetCommand.LogLevel.Set(slog.LevelDebug)
+	}
+	if targetCommand.Offline {
+		return targetCommand.Handler(parameter)
+	}
+
+	if debug {
 		if err := targetCommand.Client.EnableDebugCapture(targetCommand.PcapPath); err != nil {
 			return fmt.Errorf("failed to enable debug packet capture: %w", err)
 		}
@@ -0,0 +1,172 @@
+package command
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/agent"
+	"adb-remote.maci.team/client/config"
+	"adb-remote.maci.team/client/controller"
+	"adb-remote.maci.team/client/identity"
+	"adb-remote.maci.team/client/policy"
+	"adb-remote.maci.team/client/relay"
+	"adb-remote.maci.team/client/transportLayer"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// DefaultStatusAddress is where the agent serves its status page, unless
+// overridden with -statusAddress or the config file's agent statusAddress.
+const DefaultStatusAddress = "127.0.0.1:8765"
+
+// StatusPageDisabled is the -statusAddress value that turns the agent's
+// status page off.
+const StatusPageDisabled = "none"
+
+// CreateAgentCommand creates the agent command, which shares every device
+// plugged into the adb server unattended, as the config file's agent
+// section says (see client/agent). It opens a transporter connection per
+// room, so it's Offline as far as ParseCommand is concerned.
+func CreateAgentCommand(
+	logger *slog.Logger,
+	smartSocket adb.IAdbSmartSocket,
+	ownerIdentity *identity.Identity,
+	config *config.ClientConfiguration,
+	logLevel *slog.LevelVar,
+	defaultAuditLogPath string,
+) *Command[BaseCommand] {
+	return &Command[BaseCommand]{
+		Name:    "agent",
+		Offline: true,
+		Handler: func(args BaseCommand) error {
+			typedArgs, ok := args.(*commandAgentArgs)
+			if !ok {
+				return InvalidCommandArgumentType
+			}
+			agentConfig := config.Agent
+			acceptPolicy, err := agent.NewPolicy(agentConfig)
+			if err != nil {
+				return err
+			}
+			if agentConfig.LeaseMinutes < 0 {
+				return errors.New("the agent's leaseMinutes can't be negative")
+			}
+			if !acceptPolicy.TrustsAnybody() {
+				fmt.Println("No trusted fingerprints are configured: every join request will be declined.")
+			}
+			settings := agent.Settings{
+				Devices:      agentConfig.Devices,
+				RoomIdPrefix: agentConfig.RoomIdPrefix,
+				Policy:       acceptPolicy,
+				AuditLogPath: resolveAuditLogPath("", config, defaultAuditLogPath),
+				RejoinWindow: DefaultRejoinWindow,
+				Lease:        time.Duration(agentConfig.LeaseMinutes) * time.Minute,
+			}
+			var filters []relay.ServiceFilter
+			if agentConfig.ReadOnly {
+				filters = append(filters, policy.ReadOnly{})
+			}
+			if config.ServicePolicyPath != "" {
+				servicePolicy, err := policy.Load(config.ServicePolicyPath)
+				if err != nil {
+					return err
+				}
+				filters = append(filters, servicePolicy)
+			}
+			if len(filters) > 0 {
+				settings.ServiceFilter = policy.Chain(filters...)
+			}
+			if agentConfig.Publish {
+				team, teamToken, err := resolveTeam("", "", config)
+				if err != nil {
+					return err
+				}
+				settings.Publish = &controller.PublishOptions{Team: team, TeamToken: teamToken}
+			}
+			newClient := func() (*transportLayer.Client, error) {
+				client, err := transportLayer.CreateClient(logger, config)
+				if err != nil {
+					return nil, err
+				}
+				if err := client.Start(); err != nil {
+					return nil, fmt.Errorf("failed to connect to the transporter at %s: %w", config.TransporterAddress, err)
+				}
+				return client, nil
+			}
+			labAgent := agent.New(logger, SmartSocketFor(*typedArgs.AdbServer, smartSocket, logger), ownerIdentity, newClient, settings)
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			statusAddress := *typedArgs.StatusAddress
+			if statusAddress == "" {
+				statusAddress = agentConfig.StatusAddress
+			}
+			if statusAddress == "" {
+				statusAddress = DefaultStatusAddress
+			}
+			if statusAddress != StatusPageDisabled {
+				listener, err := net.Listen("tcp", statusAddress)
+				if err != nil {
+					return fmt.Errorf("failed to serve the status page: %w", err)
+				}
+				server := &http.Server{Handler: labAgent.Handler()}
+				go func() {
+					if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+						logger.Error(fmt.Sprintf("The status page stopped: %s", err))
+					}
+				}()
+				defer server.Close()
+				fmt.Printf("Status page: http://%s/\n", listener.Addr())
+			}
+			fmt.Printf("Sharing devices as %s; stop with Ctrl+C.\n", ownerIdentity.Fingerprint())
+			return labAgent.Run(ctx)
+		},
+		ParameterFactory: func() (BaseCommand, error) {
+			flagSet := flag.NewFlagSet("agent", flag.ExitOnError)
+			statusAddress := flagSet.String("statusAddress", "", `Address to serve the status page on, `+DefaultStatusAddress+` by default; "none" turns it off (overrides the config file's agent statusAddress)`)
+			adbServer := RegisterAdbServerFlag(flagSet)
+			verbosity := RegisterVerbosityFlag(flagSet)
+			getHelp := flagSet.Bool("help", false, "Print this help")
+			return &commandAgentArgs{
+				FlagSet:       flagSet,
+				GetHelp:       getHelp,
+				StatusAddress: statusAddress,
+				AdbServer:     adbServer,
+				VerbosityFlag: verbosity,
+			}, nil
+		},
+
+		//Dependencies
+		Logger:      logger,
+		Config:      config,
+		SmartSocket: smartSocket,
+		LogLevel:    logLevel,
+	}
+}
+
+type commandAgentArgs struct {
+	FlagSet       *flag.FlagSet
+	GetHelp       *bool
+	StatusAddress *string
+	AdbServer     *string
+	VerbosityFlag *string
+}
+
+func (c *commandAgentArgs) GetFlagSet() *flag.FlagSet {
+	return c.FlagSet
+}
+
+func (c *commandAgentArgs) IsHelp() bool {
+	return *c.GetHelp
+}
+
+func (c *commandAgentArgs) Verbosity() string {
+	return *c.VerbosityFlag
+}
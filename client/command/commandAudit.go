@@ -0,0 +1,157 @@
+package command
+
+import (
+	"adb-remote.maci.team/client/audit"
+	"adb-remote.maci.team/client/config"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// AuditLogDisabled is the -auditLog (or config "auditLog") value that turns
+// share's audit logging off.
+const AuditLogDisabled = "none"
+
+// resolveAuditLogPath picks the audit log path: the -auditLog flag, else
+// the config file's auditLog, else defaultPath. It returns "" if audit
+// logging is disabled.
+func resolveAuditLogPath(flagValue string, config *config.ClientConfiguration, defaultPath string) string {
+	path := flagValue
+	if path == "" {
+		path = config.AuditLogPath
+	}
+	if path == "" {
+		path = defaultPath
+	}
+	if path == AuditLogDisabled {
+		return ""
+	}
+	return path
+}
+
+func CreateAuditCommand(
+	logger *slog.Logger,
+	config *config.ClientConfiguration,
+	logLevel *slog.LevelVar,
+	defaultAuditLogPath string,
+) *Command[BaseCommand] {
+	return &Command[BaseCommand]{
+		Name:    "audit",
+		Offline: true,
+		Handler: func(args BaseCommand) error {
+			typedArgs, ok := args.(*commandAuditArgs)
+			if !ok {
+				return InvalidCommandArgumentType
+			}
+			path := resolveAuditLogPath(*typedArgs.AuditLogPath, config, defaultAuditLogPath)
+			if path == "" {
+				return fmt.Errorf("audit logging is disabled; pass -auditLog to read a specific file")
+			}
+			query, err := typedArgs.query(time.Now())
+			if err != nil {
+				return err
+			}
+			encoder := json.NewEncoder(os.Stdout)
+			return audit.ReadFile(path, query, func(record audit.Record) error {
+				if *typedArgs.Json {
+					return encoder.Encode(record)
+				}
+				_, err := fmt.Println(audit.Format(record))
+				return err
+			})
+		},
+		ParameterFactory: func() (BaseCommand, error) {
+			flagSet := flag.NewFlagSet("audit", flag.ExitOnError)
+			auditLogPath := flagSet.String("auditLog", "", "The audit log to read (defaults to the config file's auditLog, else the one next to the client logs)")
+			since := flagSet.String("since", "", `Only show records from this long ago (e.g. "2h") or since this RFC 3339 time`)
+			until := flagSet.String("until", "", `Only show records up to this long ago (e.g. "30m") or up to this RFC 3339 time`)
+			guest := flagSet.String("guest", "", "Only show records of this guest client id, or guest fingerprint (prefix)")
+			events := flagSet.String("event", "", `Comma-separated event kinds to show: roomCreated, guestJoined, guestLeft, open, denied, sync, close`)
+			kind := flagSet.String("kind", "", "Only show records of this service kind: shell, sync, install or other")
+			service := flagSet.String("service", "", `Only show records whose service starts with this (e.g. "shell", "sync:")`)
+			contains := flagSet.String("grep", "", "Only show records whose command or sync path contains this")
+			asJson := flagSet.Bool("json", false, "Print matching records as JSON lines instead of a summary line each")
+			verbosity := RegisterVerbosityFlag(flagSet)
+			getHelp := flagSet.Bool("help", false, "Print this help")
+			return &commandAuditArgs{
+				FlagSet:       flagSet,
+				GetHelp:       getHelp,
+				AuditLogPath:  auditLogPath,
+				Since:         since,
+				Until:         until,
+				Guest:         guest,
+				Events:        events,
+				Kind:          kind,
+				Service:       service,
+				Contains:      contains,
+				Json:          asJson,
+				VerbosityFlag: verbosity,
+			}, nil
+		},
+
+		//Dependencies
+		Logger:   logger,
+		Config:   config,
+		LogLevel: logLevel,
+	}
+}
+
+type commandAuditArgs struct {
+	FlagSet       *flag.FlagSet
+	GetHelp       *bool
+	AuditLogPath  *string
+	Since         *string
+	Until         *string
+	Guest         *string
+	Events        *string
+	Kind          *string
+	Service       *string
+	Contains      *string
+	Json          *bool
+	VerbosityFlag *string
+}
+
+// query builds the audit.Query the flags describe, resolving relative
+// times against now.
+func (c *commandAuditArgs) query(now time.Time) (audit.Query, error) {
+	query := audit.Query{Guest: *c.Guest, Kind: *c.Kind, Service: *c.Service, Contains: *c.Contains}
+	var err error
+	if query.Since, err = parseAuditTime(*c.Since, now); err != nil {
+		return query, fmt.Errorf("invalid -since: %w", err)
+	}
+	if query.Until, err = parseAuditTime(*c.Until, now); err != nil {
+		return query, fmt.Errorf("invalid -until: %w", err)
+	}
+	if *c.Events != "" {
+		query.Events = strings.Split(*c.Events, ",")
+	}
+	return query, nil
+}
+
+// parseAuditTime accepts either a duration before now or an RFC 3339
+// timestamp; "" is the zero time (no bound).
+func parseAuditTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(-duration), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func (c *commandAuditArgs) GetFlagSet() *flag.FlagSet {
+	return c.FlagSet
+}
+
+func (c *commandAuditArgs) IsHelp() bool {
+	return *c.GetHelp
+}
+
+func (c *commandAuditArgs) Verbosity() string {
+	return *c.VerbosityFlag
+}
@@ -3,12 +3,19 @@ package command
 import (
 	"adb-remote.maci.team/client/adb"
 	"adb-remote.maci.team/client/config"
+	"adb-remote.maci.team/client/control"
+	"adb-remote.maci.team/client/controller"
+	"adb-remote.maci.team/client/headless"
 	"adb-remote.maci.team/client/identity"
 	"adb-remote.maci.team/client/transportLayer"
 	"adb-remote.maci.team/client/tui"
 	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"log/slog"
+	"os"
+	"path/filepath"
 )
 
 func CreateConnectCommand(
@@ -27,21 +34,14 @@ func CreateConnectCommand(
 			if !ok {
 				return InvalidCommandArgumentType
 			}
-			return tui.RunConnect(context.Background(), client, smartSocket, guestIdentity, *typedArgs.TargetRoomId, *typedArgs.LocalPort)
+			return runConnect(typedArgs, *typedArgs.TargetRoomId, nil, logger, client, smartSocket, guestIdentity, config)
 		},
 		ParameterFactory: func() (BaseCommand, error) {
 			flagSet := flag.NewFlagSet("connect", flag.ExitOnError)
 			targetRoomId := flagSet.String("targetRoomId", "", "The target room ID")
-			localPort := flagSet.String("port", adb.DefaultProxyPort, "The local port to expose the remote device on, for \"adb connect\" to use")
-			verbosity := RegisterVerbosityFlag(flagSet)
-			getHelp := flagSet.Bool("help", false, "Print this help")
-			return &commandConnectArgs{
-				FlagSet:       flagSet,
-				GetHelp:       getHelp,
-				TargetRoomId:  targetRoomId,
-				LocalPort:     localPort,
-				VerbosityFlag: verbosity,
-			}, nil
+			args := registerConnectFlags(flagSet, config)
+			args.TargetRoomId = targetRoomId
+			return args, nil
 		},
 
 		//Dependencies
@@ -54,11 +54,144 @@ func CreateConnectCommand(
 	}
 }
 
+// runConnect joins roomId with the flags in typedArgs, in the TUI or, with
+// -headless, printing events; it's shared by connect and list. With
+// ownerPublicKey set, it leaves a room that doesn't belong to that
+// identity.
+func runConnect(typedArgs *commandConnectArgs, roomId string, ownerPublicKey []byte, logger *slog.Logger, client *transportLayer.Client, smartSocket adb.IAdbSmartSocket, guestIdentity *identity.Identity, config *config.ClientConfiguration) error {
+	adbKeys, err := loadAdbKeys(*typedArgs.AdbKeysPath, config, logger)
+	if err != nil {
+		return err
+	}
+	bind := *typedArgs.Bind
+	if bind == "" {
+		bind = config.ProxyBind
+	}
+	allowFrom := *typedArgs.AllowFrom
+	if allowFrom == "" {
+		allowFrom = config.ProxyAllowFrom
+	}
+	allowedSources, err := adb.ParseSourceNetworks(allowFrom)
+	if err != nil {
+		return err
+	}
+	options := controller.GuestOptions{AdbKeys: adbKeys, Bind: bind, AllowedSources: allowedSources, OwnerPublicKey: ownerPublicKey}
+	if *typedArgs.Reconnect {
+		options.Reconnect = &controller.DefaultReconnectPolicy
+	}
+	if *typedArgs.AdbTLS {
+		cert, err := loadProxyCertificate(guestIdentity)
+		if err != nil {
+			return err
+		}
+		options.AdbTLSCertificate = &cert
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var session *control.GuestSession
+	if *typedArgs.ControlSocket != "" {
+		session = control.NewGuestSession(roomId, cancel)
+		server, err := control.ServeGuest(*typedArgs.ControlSocket, session)
+		if err != nil {
+			return err
+		}
+		defer server.Close()
+	}
+	smartSocket = SmartSocketFor(*typedArgs.AdbServer, smartSocket, logger)
+	if *typedArgs.Headless {
+		return runHeadless(ctx, func(ctx context.Context) error {
+			return headless.RunConnect(ctx, client, smartSocket, guestIdentity, roomId, *typedArgs.LocalPort, options, session, os.Stdout)
+		})
+	}
+	return tui.RunConnect(ctx, client, smartSocket, guestIdentity, roomId, *typedArgs.LocalPort, options, session)
+}
+
+// registerConnectFlags adds the flags of connect that say how to serve the
+// room's devices, shared by connect and list; TargetRoomId is left to the
+// caller.
+func registerConnectFlags(flagSet *flag.FlagSet, config *config.ClientConfiguration) *commandConnectArgs {
+	localPort := flagSet.String("port", adb.DefaultProxyPort, "The local port to expose the remote device on, for \"adb connect\" to use (0 picks a free one)")
+	bind := flagSet.String("bind", "", "The host the local proxies listen on, "+adb.DefaultProxyBind+" by default; 0.0.0.0 exposes the device to the network, and unix:<path> listens on a unix socket instead (overrides the config file's bind)")
+	allowFrom := flagSet.String("allowFrom", "", "Comma-separated networks (CIDR) or addresses the local proxies accept connections from, any by default (overrides the config file's allowFrom)")
+	adbKeysPath := flagSet.String("adbKeys", "", "File of adb keys (adbkey.pub lines) allowed to connect to the local proxies besides your own adb key; keys you always allow are added to it (overrides the config file's adbKeys)")
+	adbTls := flagSet.Bool("adbTls", config.AdbTLS, "Upgrade local adb connections to the proxies to TLS (STLS, needs platform-tools 30 or newer), with a certificate issued by your identity key (overrides the config file's adbTls)")
+	reconnect := flagSet.Bool("reconnect", true, "When the transporter connection drops, keep the local proxies up and redial, with exponential backoff, until back in the room; false ends the session instead")
+	headlessMode := flagSet.Bool("headless", false, "Run without the TUI, printing events as JSON lines on stdout; local adb servers with unknown keys are refused rather than asked about")
+	controlSocket := RegisterControlSocketFlag(flagSet)
+	adbServer := RegisterAdbServerFlag(flagSet)
+	verbosity := RegisterVerbosityFlag(flagSet)
+	getHelp := flagSet.Bool("help", false, "Print this help")
+	return &commandConnectArgs{
+		FlagSet:       flagSet,
+		GetHelp:       getHelp,
+		LocalPort:     localPort,
+		Bind:          bind,
+		AllowFrom:     allowFrom,
+		AdbKeysPath:   adbKeysPath,
+		AdbTLS:        adbTls,
+		Reconnect:     reconnect,
+		Headless:      headlessMode,
+		ControlSocket: controlSocket,
+		AdbServer:     adbServer,
+		VerbosityFlag: verbosity,
+	}
+}
+
+// loadAdbKeys loads the adb keys allowed to connect to the guest's proxies:
+// those in the -adbKeys flag's file, else the config file's adbKeys, else
+// adb_keys next to the identity key, plus this user's own adb server's key.
+func loadAdbKeys(flagValue string, config *config.ClientConfiguration, logger *slog.Logger) (*adb.AuthorizedKeys, error) {
+	path := flagValue
+	if path == "" {
+		path = config.AdbKeysPath
+	}
+	if path == "" {
+		identityPath, err := identity.DefaultPath()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(filepath.Dir(identityPath), "adb_keys")
+	}
+	adbKeys, err := adb.LoadAuthorizedKeys(path)
+	if err != nil {
+		return nil, err
+	}
+	userKeyPath, err := adb.DefaultUserKeyPath()
+	if err == nil {
+		var userKey *adb.PublicKey
+		if userKey, err = adb.LoadPublicKeyFile(userKeyPath); err == nil {
+			adbKeys.Allow(userKey)
+		}
+	}
+	if err != nil {
+		logger.Info(fmt.Sprintf("Not allowing the local adb key automatically: %s", err))
+	}
+	return adbKeys, nil
+}
+
+// loadProxyCertificate loads the proxies' TLS certificate, kept in
+// adb_proxy.pem next to the identity key and issued by it.
+func loadProxyCertificate(guestIdentity *identity.Identity) (tls.Certificate, error) {
+	identityPath, err := identity.DefaultPath()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return adb.LoadOrCreateProxyCertificate(filepath.Join(filepath.Dir(identityPath), "adb_proxy.pem"), guestIdentity.PrivateKey)
+}
+
 type commandConnectArgs struct {
 	FlagSet       *flag.FlagSet
 	GetHelp       *bool
 	TargetRoomId  *string
 	LocalPort     *string
+	Bind          *string
+	AllowFrom     *string
+	AdbKeysPath   *string
+	AdbTLS        *bool
+	Reconnect     *bool
+	Headless      *bool
+	ControlSocket *string
+	AdbServer     *string
 	VerbosityFlag *string
 }
 
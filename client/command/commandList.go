@@ -0,0 +1,106 @@
+package command
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/config"
+	"adb-remote.maci.team/client/headless"
+	"adb-remote.maci.team/client/identity"
+	"adb-remote.maci.team/client/transportLayer"
+	"adb-remote.maci.team/client/tui"
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"os"
+)
+
+// CreateListCommand creates the list command: show the rooms of a team's
+// room directory and connect to the one picked, as connect would (its
+// flags are connect's, less -targetRoomId). With -headless it only prints
+// the rooms.
+func CreateListCommand(
+	logger *slog.Logger,
+	client *transportLayer.Client,
+	smartSocket adb.IAdbSmartSocket,
+	guestIdentity *identity.Identity,
+	config *config.ClientConfiguration,
+	logLevel *slog.LevelVar,
+	pcapPath string,
+) *Command[BaseCommand] {
+	return &Command[BaseCommand]{
+		Name: "list",
+		Handler: func(args BaseCommand) error {
+			typedArgs, ok := args.(*commandListArgs)
+			if !ok {
+				return InvalidCommandArgumentType
+			}
+			team, teamToken, err := resolveTeam(*typedArgs.Team, *typedArgs.TeamToken, config)
+			if err != nil {
+				return err
+			}
+			if *typedArgs.Headless {
+				return runHeadless(context.Background(), func(ctx context.Context) error {
+					return headless.RunList(client, team, teamToken, os.Stdout)
+				})
+			}
+			room, err := tui.RunList(context.Background(), client, team, teamToken)
+			if err != nil || room == nil {
+				return err
+			}
+			// The transporter takes a single handshake per connection, and
+			// connect starts with one.
+			if err := client.Reconnect(); err != nil {
+				return err
+			}
+			// Only join the room if it's really the owner's the directory
+			// listed it under, whose fingerprint the picker showed.
+			return runConnect(typedArgs.commandConnectArgs, room.RoomId, room.OwnerPublicKey, logger, client, smartSocket, guestIdentity, config)
+		},
+		ParameterFactory: func() (BaseCommand, error) {
+			flagSet := flag.NewFlagSet("list", flag.ExitOnError)
+			team, teamToken := registerTeamFlags(flagSet)
+			return &commandListArgs{
+				commandConnectArgs: registerConnectFlags(flagSet, config),
+				Team:               team,
+				TeamToken:          teamToken,
+			}, nil
+		},
+
+		//Dependencies
+		Logger:      logger,
+		Client:      client,
+		Config:      config,
+		SmartSocket: smartSocket,
+		LogLevel:    logLevel,
+		PcapPath:    pcapPath,
+	}
+}
+
+// registerTeamFlags adds the -team and -teamToken flags shared by share
+// and list.
+func registerTeamFlags(flagSet *flag.FlagSet) (*string, *string) {
+	team := flagSet.String("team", "", "The team whose room directory to use (overrides the config file's team)")
+	teamToken := flagSet.String("teamToken", "", "The team's token, as given by the transporter's operator (overrides the config file's teamToken)")
+	return team, teamToken
+}
+
+// resolveTeam returns the team and team token to use: the flags', else the
+// config file's.
+func resolveTeam(team string, teamToken string, config *config.ClientConfiguration) (string, string, error) {
+	if team == "" {
+		team = config.Team
+	}
+	if teamToken == "" {
+		teamToken = config.TeamToken
+	}
+	if team == "" {
+		return "", "", errors.New("no team: set -team or the config file's team")
+	}
+	return team, teamToken, nil
+}
+
+type commandListArgs struct {
+	*commandConnectArgs
+	Team      *string
+	TeamToken *string
+}
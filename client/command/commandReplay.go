@@ -0,0 +1,89 @@
+package command
+
+import (
+	"adb-remote.maci.team/client/config"
+	"adb-remote.maci.team/client/recording"
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"time"
+)
+
+func CreateReplayCommand(
+	logger *slog.Logger,
+	config *config.ClientConfiguration,
+	logLevel *slog.LevelVar,
+) *Command[BaseCommand] {
+	return &Command[BaseCommand]{
+		Name:    "replay",
+		Offline: true,
+		Handler: func(args BaseCommand) error {
+			typedArgs, ok := args.(*commandReplayArgs)
+			if !ok {
+				return InvalidCommandArgumentType
+			}
+			path := typedArgs.FlagSet.Arg(0)
+			if path == "" {
+				return errors.New("usage: replay [-speed N] [-maxIdle D] <recording.cast>")
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			err = recording.Replay(ctx, file, os.Stdout, recording.ReplayOptions{
+				Speed:   *typedArgs.Speed,
+				MaxIdle: *typedArgs.MaxIdle,
+			})
+			if errors.Is(err, context.Canceled) {
+				return nil
+			}
+			return err
+		},
+		ParameterFactory: func() (BaseCommand, error) {
+			flagSet := flag.NewFlagSet("replay", flag.ExitOnError)
+			speed := flagSet.Float64("speed", 1, "Playback speed multiplier")
+			maxIdle := flagSet.Duration("maxIdle", 2*time.Second, "Longest pause to reproduce between two outputs; 0 keeps every original pause")
+			verbosity := RegisterVerbosityFlag(flagSet)
+			getHelp := flagSet.Bool("help", false, "Print this help")
+			return &commandReplayArgs{
+				FlagSet:       flagSet,
+				GetHelp:       getHelp,
+				Speed:         speed,
+				MaxIdle:       maxIdle,
+				VerbosityFlag: verbosity,
+			}, nil
+		},
+
+		//Dependencies
+		Logger:   logger,
+		Config:   config,
+		LogLevel: logLevel,
+	}
+}
+
+type commandReplayArgs struct {
+	FlagSet       *flag.FlagSet
+	GetHelp       *bool
+	Speed         *float64
+	MaxIdle       *time.Duration
+	VerbosityFlag *string
+}
+
+func (c *commandReplayArgs) GetFlagSet() *flag.FlagSet {
+	return c.FlagSet
+}
+
+func (c *commandReplayArgs) IsHelp() bool {
+	return *c.GetHelp
+}
+
+func (c *commandReplayArgs) Verbosity() string {
+	return *c.VerbosityFlag
+}
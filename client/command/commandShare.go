@@ -2,13 +2,23 @@ package command
 
 import (
 	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/audit"
 	"adb-remote.maci.team/client/config"
+	"adb-remote.maci.team/client/control"
+	"adb-remote.maci.team/client/controller"
+	"adb-remote.maci.team/client/headless"
 	"adb-remote.maci.team/client/identity"
+	"adb-remote.maci.team/client/policy"
+	"adb-remote.maci.team/client/recording"
+	"adb-remote.maci.team/client/relay"
 	"adb-remote.maci.team/client/transportLayer"
 	"adb-remote.maci.team/client/tui"
 	"context"
+	"errors"
 	"flag"
 	"log/slog"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -16,6 +26,11 @@ import (
 // it's automatically closed, unless overridden with -sessionTimeout.
 const DefaultSessionTimeoutMinutes = 120
 
+// DefaultRejoinWindow is how long a guest whose connection dropped may
+// re-join without being asked about again, unless overridden with
+// -rejoinWindow.
+const DefaultRejoinWindow = 2 * time.Minute
+
 func CreateShareCommand(
 	logger *slog.Logger,
 	client *transportLayer.Client,
@@ -24,6 +39,7 @@ func CreateShareCommand(
 	config *config.ClientConfiguration,
 	logLevel *slog.LevelVar,
 	pcapPath string,
+	defaultAuditLogPath string,
 ) *Command[BaseCommand] {
 	return &Command[BaseCommand]{
 		Name: "share",
@@ -32,16 +48,120 @@ func CreateShareCommand(
 			if !ok {
 				return InvalidCommandArgumentType
 			}
+			fingerprints, err := headless.ParseFingerprints(*typedArgs.AllowFingerprints)
+			if err != nil {
+				return err
+			}
+			if !*typedArgs.Headless && (len(fingerprints) > 0 || *typedArgs.AcceptFromStdin) {
+				return errors.New("-allowFingerprint and -acceptFromStdin only apply with -headless")
+			}
 			// A zero or negative timeout (including the documented -1
 			// sentinel) disables the timer entirely.
 			sessionTimeout := time.Duration(*typedArgs.SessionTimeoutMinutes) * time.Minute
-			return tui.RunShare(context.Background(), client, smartSocket, ownerIdentity, *typedArgs.TargetDevice, *typedArgs.AutoAccept, sessionTimeout)
+			lease := *typedArgs.Lease
+			if lease < 0 {
+				return errors.New("-lease can't be negative")
+			}
+			options := controller.OwnerOptions{RejoinWindow: *typedArgs.RejoinWindow, RoomId: *typedArgs.RoomId}
+			if options.RoomId == "" {
+				options.RoomId = config.RoomId
+			}
+			if *typedArgs.Publish {
+				team, teamToken, err := resolveTeam(*typedArgs.Team, *typedArgs.TeamToken, config)
+				if err != nil {
+					return err
+				}
+				options.Publish = &controller.PublishOptions{Team: team, TeamToken: teamToken, Label: *typedArgs.Label, Tags: splitDeviceList(*typedArgs.Tags)}
+			} else if *typedArgs.Label != "" || *typedArgs.Tags != "" {
+				return errors.New("-label and -tags only apply with -publish")
+			}
+			var filters []relay.ServiceFilter
+			if *typedArgs.ReadOnly {
+				filters = append(filters, policy.ReadOnly{})
+			}
+			policyPath := *typedArgs.ServicePolicyPath
+			if policyPath == "" {
+				policyPath = config.ServicePolicyPath
+			}
+			if policyPath != "" {
+				servicePolicy, err := policy.Load(policyPath)
+				if err != nil {
+					return err
+				}
+				filters = append(filters, servicePolicy)
+			}
+			if len(filters) > 0 {
+				options.ServiceFilter = policy.Chain(filters...)
+			}
+			if auditLogPath := resolveAuditLogPath(*typedArgs.AuditLogPath, config, defaultAuditLogPath); auditLogPath != "" {
+				auditLogger, err := audit.Open(auditLogPath)
+				if err != nil {
+					return err
+				}
+				defer auditLogger.Close()
+				options.Observers = append(options.Observers, auditLogger)
+			}
+			recordingDir := *typedArgs.ShellRecordingDir
+			if recordingDir == "" {
+				recordingDir = config.ShellRecordingDir
+			}
+			if recordingDir != "" {
+				recorder, err := recording.NewRecorder(recordingDir, logger)
+				if err != nil {
+					return err
+				}
+				defer recorder.Close()
+				options.Observers = append(options.Observers, recorder)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var session *control.OwnerSession
+			if *typedArgs.ControlSocket != "" {
+				session = control.NewOwnerSession(cancel)
+				server, err := control.ServeOwner(*typedArgs.ControlSocket, session)
+				if err != nil {
+					return err
+				}
+				defer server.Close()
+				options.Observers = append(options.Observers, session)
+			}
+			smartSocket := SmartSocketFor(*typedArgs.AdbServer, smartSocket, logger)
+			devices := splitDeviceList(*typedArgs.TargetDevice)
+			if *typedArgs.Headless {
+				acceptPolicy := headless.AcceptPolicy{AcceptAll: *typedArgs.AutoAccept, Fingerprints: fingerprints}
+				if *typedArgs.AcceptFromStdin {
+					acceptPolicy.Decisions = headless.ReadDecisions(os.Stdin, logger)
+				}
+				if lease > 0 {
+					options.Leases = controller.NewLeases(func(string, []byte) time.Duration { return lease })
+				}
+				return runHeadless(ctx, func(ctx context.Context) error {
+					return headless.RunShare(ctx, client, smartSocket, ownerIdentity, devices, acceptPolicy, sessionTimeout, options, session, os.Stdout)
+				})
+			}
+			return tui.RunShare(ctx, client, smartSocket, ownerIdentity, devices, *typedArgs.AutoAccept, sessionTimeout, lease, options, session)
 		},
 		ParameterFactory: func() (BaseCommand, error) {
 			flagSet := flag.NewFlagSet("share", flag.ExitOnError)
-			targetDevice := flagSet.String("targetDevice", "", "The device ID to share; skips the device picker if set")
+			targetDevice := flagSet.String("targetDevice", "", "Comma-separated IDs of the devices to share; skips the device picker if set")
 			autoAccept := flagSet.Bool("yes", false, "Automatically accept every room join request instead of prompting")
 			sessionTimeoutMinutes := flagSet.Int("sessionTimeout", DefaultSessionTimeoutMinutes, "Minutes before the room is automatically closed; -1 disables the timeout")
+			servicePolicyPath := flagSet.String("servicePolicy", "", "Path to a JSON service allow/deny policy applied to every stream a guest opens (overrides the config file's servicePolicy)")
+			auditLogPath := flagSet.String("auditLog", "", `File to append the session audit log to (overrides the config file's auditLog; "none" disables it)`)
+			shellRecordingDir := flagSet.String("recordShells", "", "Directory to record every guest shell_v2 shell into, as asciicast v2 files (overrides the config file's shellRecordingDir)")
+			readOnly := flagSet.Bool("readOnly", false, "Only let guests observe the device: logcat, screencap, dumpsys <service>, getprop and file pulls; no pushes, installs, interactive shells or reboots")
+			headlessMode := flagSet.Bool("headless", false, "Run without the TUI, printing events as JSON lines on stdout; needs -targetDevice, and declines join requests unless -yes, -allowFingerprint or -acceptFromStdin accepts them")
+			allowFingerprints := flagSet.String("allowFingerprint", "", "Comma-separated identity fingerprints (SHA256:...) of guests to accept without asking, with -headless")
+			acceptFromStdin := flagSet.Bool("acceptFromStdin", false, `Decide the other join requests from JSON lines on stdin, {"guestClientId":"...","accept":true}, with -headless`)
+			roomId := flagSet.String("roomId", "", "Share at this room id, reserved on the transporter for your identity the first time, instead of a random one, so guests can keep using it across restarts (overrides the config file's roomId)")
+			publish := flagSet.Bool("publish", false, "List the room in your team's room directory on the transporter, for team members to find with the list command; joining still needs your accept")
+			team, teamToken := registerTeamFlags(flagSet)
+			label := flagSet.String("label", "", "What to describe the room as in the room directory, with -publish")
+			tags := flagSet.String("tags", "", "Comma-separated tags to list the room with in the room directory, with -publish")
+			lease := flagSet.Duration("lease", 0, "How long each accepted guest may stay before its session ends; 0 for no time limit. The TUI lets you pick another for each guest, and extend or revoke it")
+			rejoinWindow := flagSet.Duration("rejoinWindow", DefaultRejoinWindow, "How long an accepted guest that lost its connection may re-join with the same identity without being asked again; 0 always asks")
+			controlSocket := RegisterControlSocketFlag(flagSet)
+			adbServer := RegisterAdbServerFlag(flagSet)
 			verbosity := RegisterVerbosityFlag(flagSet)
 			getHelp := flagSet.Bool("help", false, "Print this help")
 			return &commandShareArgs{
@@ -50,6 +170,23 @@ func CreateShareCommand(
 				TargetDevice:          targetDevice,
 				AutoAccept:            autoAccept,
 				SessionTimeoutMinutes: sessionTimeoutMinutes,
+				ServicePolicyPath:     servicePolicyPath,
+				ReadOnly:              readOnly,
+				AuditLogPath:          auditLogPath,
+				ShellRecordingDir:     shellRecordingDir,
+				Headless:              headlessMode,
+				AllowFingerprints:     allowFingerprints,
+				AcceptFromStdin:       acceptFromStdin,
+				RoomId:                roomId,
+				Publish:               publish,
+				Team:                  team,
+				TeamToken:             teamToken,
+				Label:                 label,
+				Tags:                  tags,
+				Lease:                 lease,
+				RejoinWindow:          rejoinWindow,
+				ControlSocket:         controlSocket,
+				AdbServer:             adbServer,
 				VerbosityFlag:         verbosity,
 			}, nil
 		},
@@ -64,12 +201,45 @@ func CreateShareCommand(
 	}
 }
 
+// splitDeviceList splits a comma-separated list of device ids (or tags),
+// dropping blanks and duplicates.
+func splitDeviceList(value string) []string {
+	var devices []string
+	seen := make(map[string]bool)
+	for _, device := range strings.Split(value, ",") {
+		device = strings.TrimSpace(device)
+		if device == "" || seen[device] {
+			continue
+		}
+		seen[device] = true
+		devices = append(devices, device)
+	}
+	return devices
+}
+
 type commandShareArgs struct {
 	FlagSet               *flag.FlagSet
 	GetHelp               *bool
 	TargetDevice          *string
 	AutoAccept            *bool
 	SessionTimeoutMinutes *int
+	ServicePolicyPath     *string
+	ReadOnly              *bool
+	AuditLogPath          *string
+	ShellRecordingDir     *string
+	Headless              *bool
+	AllowFingerprints     *string
+	AcceptFromStdin       *bool
+	RoomId                *string
+	Publish               *bool
+	Team                  *string
+	TeamToken             *string
+	Label                 *string
+	Tags                  *string
+	Lease                 *time.Duration
+	RejoinWindow          *time.Duration
+	ControlSocket         *string
+	AdbServer             *string
 	VerbosityFlag         *string
 }
 
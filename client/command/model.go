@@ -15,6 +15,10 @@ type Command[T BaseCommand] struct {
 	Name             string
 	Handler          CommandHandler[T]
 	ParameterFactory FlagSetFactory[T]
+	// Offline commands (e.g. audit) only work on local files, or (agent)
+	// open transporter connections of their own: ParseCommand neither
+	// connects them to the transporter nor enables packet capture.
+	Offline bool
 
 	//Dependencies
 	Logger      *slog.Logger
@@ -9,6 +9,77 @@ const DefaultConfigPath = "./config.json"
 
 type ClientConfiguration struct {
 	TransporterAddress string `json:"transporterAddress"`
+	// ServicePolicyPath optionally points `share` at a service allow/deny
+	// policy file (see client/policy); the -servicePolicy flag overrides it.
+	ServicePolicyPath string `json:"servicePolicy,omitempty"`
+	// AuditLogPath overrides where `share` appends its audit log (see
+	// client/audit) and where `audit` reads it from; "none" disables audit
+	// logging. The -auditLog flag overrides it in turn.
+	AuditLogPath string `json:"auditLog,omitempty"`
+	// ShellRecordingDir, if set, makes `share` record every guest shell
+	// into this directory (see client/recording); the -recordShells flag
+	// overrides it.
+	ShellRecordingDir string `json:"shellRecordingDir,omitempty"`
+	// AdbServerAddress is the adb server both commands talk to, in any
+	// form adb.ResolveServerAddress accepts; the adb environment variables
+	// and the -adbServer flag override it.
+	AdbServerAddress string `json:"adbServer,omitempty"`
+	// AdbKeysPath is the file of adb keys `connect` lets connect to its
+	// proxies, besides the user's own; the -adbKeys flag overrides it.
+	AdbKeysPath string `json:"adbKeys,omitempty"`
+	// AdbTLS makes `connect` upgrade local adb connections to its proxies
+	// to TLS; the -adbTls flag overrides it.
+	AdbTLS bool `json:"adbTls,omitempty"`
+	// ProxyBind is the host, or "unix:<path>", `connect` has its proxies
+	// listen on; the -bind flag overrides it.
+	ProxyBind string `json:"bind,omitempty"`
+	// ProxyAllowFrom is the comma-separated networks `connect`'s proxies
+	// accept connections from; the -allowFrom flag overrides it.
+	ProxyAllowFrom string `json:"allowFrom,omitempty"`
+	// RoomId is the reserved room id `share` shares at instead of a random
+	// one; the -roomId flag overrides it.
+	RoomId string `json:"roomId,omitempty"`
+	// Team and TeamToken are the team whose room directory `share
+	// -publish` lists the room in and `list` shows, and the token proving
+	// membership of it; the -team and -teamToken flags override them.
+	Team      string `json:"team,omitempty"`
+	TeamToken string `json:"teamToken,omitempty"`
+	// Agent configures the `agent` command (see client/agent).
+	Agent AgentConfiguration `json:"agent,omitempty"`
+}
+
+// AgentConfiguration configures the `agent` command, which shares every
+// device plugged into the adb server in a room of its own, unattended.
+type AgentConfiguration struct {
+	// Devices, if set, limits the agent to the devices with these serials.
+	Devices []string `json:"devices,omitempty"`
+	// RoomIdPrefix, if set, shares each device at the reserved room id
+	// RoomIdPrefix followed by its serial, instead of a random one.
+	RoomIdPrefix string `json:"roomIdPrefix,omitempty"`
+	// TrustedFingerprints are the identity fingerprints of the guests
+	// allowed to join; everybody else is declined.
+	TrustedFingerprints []string `json:"trustedFingerprints,omitempty"`
+	// AcceptWindows, if set, limit joining to these times of the week.
+	AcceptWindows []AcceptWindow `json:"acceptWindows,omitempty"`
+	// StatusAddress is where the status page is served; the -statusAddress
+	// flag overrides it, and "none" turns it off.
+	StatusAddress string `json:"statusAddress,omitempty"`
+	// Publish lists every room in the directory of Team.
+	Publish bool `json:"publish,omitempty"`
+	// ReadOnly only lets guests observe the devices, as share -readOnly.
+	ReadOnly bool `json:"readOnly,omitempty"`
+	// LeaseMinutes, if positive, is how long every accepted guest may stay
+	// before its session ends, as share -lease.
+	LeaseMinutes int `json:"leaseMinutes,omitempty"`
+}
+
+// AcceptWindow is a daily time range, "15:04" to "15:04" in local time, on
+// Days ("mon" to "sun"; every day if empty). A range ending before it
+// starts runs past midnight into the next day.
+type AcceptWindow struct {
+	Days []string `json:"days,omitempty"`
+	From string   `json:"from"`
+	To   string   `json:"to"`
 }
 
 func CreateConfig() (*ClientConfiguration, error) {
@@ -26,6 +26,50 @@ func TestLoadConfigParsesTransporterAddress(t *testing.T) {
 	}
 }
 
+func TestLoadConfigParsesServicePolicyPath(t *testing.T) {
+	path := writeConfigFile(t, `{"transporterAddress": "127.0.0.1:9000", "servicePolicy": "policy.json"}`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	if config.ServicePolicyPath != "policy.json" {
+		t.Fatalf("expected servicePolicy %q, got %q", "policy.json", config.ServicePolicyPath)
+	}
+}
+
+func TestLoadConfigParsesAuditLogPath(t *testing.T) {
+	path := writeConfigFile(t, `{"transporterAddress": "127.0.0.1:9000", "auditLog": "/var/log/adb-remote-audit.jsonl"}`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	if config.AuditLogPath != "/var/log/adb-remote-audit.jsonl" {
+		t.Fatalf("expected auditLog %q, got %q", "/var/log/adb-remote-audit.jsonl", config.AuditLogPath)
+	}
+}
+
+func TestLoadConfigParsesShellRecordingDir(t *testing.T) {
+	path := writeConfigFile(t, `{"transporterAddress": "127.0.0.1:9000", "shellRecordingDir": "recordings"}`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	if config.ShellRecordingDir != "recordings" {
+		t.Fatalf("expected shellRecordingDir %q, got %q", "recordings", config.ShellRecordingDir)
+	}
+}
+
+func TestLoadConfigParsesAdbServerAddress(t *testing.T) {
+	path := writeConfigFile(t, `{"transporterAddress": "127.0.0.1:9000", "adbServer": "localfilesystem:/run/adb.sock"}`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	if config.AdbServerAddress != "localfilesystem:/run/adb.sock" {
+		t.Fatalf("expected adbServer %q, got %q", "localfilesystem:/run/adb.sock", config.AdbServerAddress)
+	}
+}
+
 func TestLoadConfigMissingFile(t *testing.T) {
 	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil {
 		t.Fatalf("expected an error for a missing config file")
@@ -38,3 +82,48 @@ func TestLoadConfigInvalidJson(t *testing.T) {
 		t.Fatalf("expected an error for invalid JSON")
 	}
 }
+
+func TestLoadConfigParsesAdbKeysPath(t *testing.T) {
+	path := writeConfigFile(t, `{"transporterAddress": "127.0.0.1:9000", "adbKeys": "adb_keys"}`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	if config.AdbKeysPath != "adb_keys" {
+		t.Fatalf("expected adbKeys %q, got %q", "adb_keys", config.AdbKeysPath)
+	}
+}
+
+func TestLoadConfigParsesAdbTLS(t *testing.T) {
+	path := writeConfigFile(t, `{"transporterAddress": "127.0.0.1:9000", "adbTls": true}`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	if !config.AdbTLS {
+		t.Fatalf("expected adbTls to be set")
+	}
+}
+
+func TestLoadConfigParsesProxyListenOptions(t *testing.T) {
+	path := writeConfigFile(t, `{"transporterAddress": "127.0.0.1:9000", "bind": "0.0.0.0", "allowFrom": "10.0.0.0/8"}`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	if config.ProxyBind != "0.0.0.0" || config.ProxyAllowFrom != "10.0.0.0/8" {
+		t.Fatalf("expected bind and allowFrom to be parsed, got %q and %q", config.ProxyBind, config.ProxyAllowFrom)
+	}
+}
+
+func TestLoadConfigParsesAgent(t *testing.T) {
+	path := writeConfigFile(t, `{"transporterAddress": "127.0.0.1:9000", "agent": {"roomIdPrefix": "lab-", "leaseMinutes": 30, "trustedFingerprints": ["SHA256:abc"], "acceptWindows": [{"days": ["mon"], "from": "09:00", "to": "18:00"}]}}`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	agent := config.Agent
+	if agent.RoomIdPrefix != "lab-" || len(agent.TrustedFingerprints) != 1 || len(agent.AcceptWindows) != 1 || agent.AcceptWindows[0].From != "09:00" || agent.LeaseMinutes != 30 {
+		t.Fatalf("unexpected agent configuration %+v", agent)
+	}
+}
@@ -0,0 +1,153 @@
+// Package control exposes a running share or connect session on a local
+// unix socket, for another process (an IDE plugin, a test harness) to
+// follow and steer it. The socket speaks JSON-RPC 1.0 (net/rpc/jsonrpc):
+// every method is "Session.<Method>" and takes a single object parameter,
+// e.g. {"method":"Session.State","params":[{}],"id":1}.
+//
+// Both sessions answer State, which returns a snapshot of the session
+// (waiting for it to change past a version first, if asked to), and End,
+// which ends it. An OwnerSession also answers Streams, Accept, Decline and
+// Kick.
+package control
+
+import (
+	"adb-remote.maci.team/client/internal/unixsocket"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"sync"
+	"time"
+)
+
+// maxStateWait bounds how long a State call waits for a change.
+const maxStateWait = time.Minute
+
+// StateArgs are State's parameters. With WaitMillis set, State waits up to
+// that long for the session to change past version After before answering,
+// so callers can follow it without polling.
+type StateArgs struct {
+	After      uint64 `json:"after"`
+	WaitMillis int    `json:"waitMillis"`
+}
+
+// Empty is the parameter and result of methods that have none.
+type Empty struct{}
+
+// Server serves one session's control API on a unix socket.
+type Server struct {
+	listener  net.Listener
+	rpcServer *rpc.Server
+
+	mu          sync.Mutex
+	connections map[net.Conn]struct{}
+	closed      bool
+}
+
+// ServeOwner serves session's control API on the unix socket at path until
+// the Server is closed.
+func ServeOwner(path string, session *OwnerSession) (*Server, error) {
+	return serve(path, &ownerService{session: session})
+}
+
+// ServeGuest serves session's control API on the unix socket at path until
+// the Server is closed.
+func ServeGuest(path string, session *GuestSession) (*Server, error) {
+	return serve(path, &guestService{session: session})
+}
+
+func serve(path string, service any) (*Server, error) {
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.RegisterName("Session", service); err != nil {
+		return nil, err
+	}
+	listener, err := unixsocket.Listen(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{listener: listener, rpcServer: rpcServer, connections: make(map[net.Conn]struct{})}
+	go s.acceptLoop()
+	return s, nil
+}
+
+// Addr returns where the Server listens.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops listening, removing the socket, and closes every open
+// connection.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.connections {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+	return s.listener.Close()
+}
+
+func (s *Server) acceptLoop() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		s.connections[conn] = struct{}{}
+		s.mu.Unlock()
+		go func() {
+			s.rpcServer.ServeCodec(jsonrpc.NewServerCodec(conn))
+			s.mu.Lock()
+			delete(s.connections, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// changes versions a session's state, for State callers to wait for the
+// next change. Its methods are called with the session's mutex held.
+type changes struct {
+	version uint64
+	changed chan struct{}
+}
+
+func newChanges() changes {
+	return changes{changed: make(chan struct{})}
+}
+
+// bump records a change.
+func (c *changes) bump() {
+	c.version++
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// waitForChange waits up to args.WaitMillis for c's version to pass
+// args.After, locking mu to read it.
+func waitForChange(mu *sync.Mutex, c *changes, args *StateArgs) {
+	wait := min(time.Duration(args.WaitMillis)*time.Millisecond, maxStateWait)
+	if wait <= 0 {
+		return
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		mu.Lock()
+		if c.version > args.After {
+			mu.Unlock()
+			return
+		}
+		changed := c.changed
+		mu.Unlock()
+		select {
+		case <-changed:
+		case <-timer.C:
+			return
+		}
+	}
+}
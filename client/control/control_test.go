@@ -0,0 +1,127 @@
+package control
+
+import (
+	"adb-remote.maci.team/client/relay"
+	"context"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func dialControl(t *testing.T, server *Server) *rpc.Client {
+	t.Helper()
+	client, err := jsonrpc.Dial("unix", server.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial the control socket: %s", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+func startOwnerControl(t *testing.T) (*OwnerSession, *rpc.Client, <-chan struct{}) {
+	t.Helper()
+	ended := make(chan struct{})
+	session := NewOwnerSession(func() { close(ended) })
+	server, err := ServeOwner(filepath.Join(t.TempDir(), "control.sock"), session)
+	if err != nil {
+		t.Fatalf("ServeOwner failed: %s", err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+	return session, dialControl(t, server), ended
+}
+
+func TestOwnerControlAcceptsPendingJoinRequests(t *testing.T) {
+	session, client, _ := startOwnerControl(t)
+	session.RoomCreated("ROOM1", []string{"emulator-5554"})
+
+	decided := make(chan bool, 1)
+	go func() {
+		// The prompt never answers, so only the control client can.
+		accepted, _ := session.Decide(context.Background(), "GUEST1", []byte("0123456789abcdef0123456789abcdef"), func(ctx context.Context) (bool, error) {
+			<-ctx.Done()
+			return false, ctx.Err()
+		})
+		decided <- accepted
+	}()
+
+	var state OwnerState
+	for len(state.PendingJoins) == 0 {
+		if err := client.Call("Session.State", &StateArgs{After: state.Version, WaitMillis: 5000}, &state); err != nil {
+			t.Fatalf("State failed: %s", err)
+		}
+	}
+	if state.RoomId != "ROOM1" || len(state.Devices) != 1 || state.PendingJoins[0].GuestClientId != "GUEST1" || !strings.HasPrefix(state.PendingJoins[0].GuestFingerprint, "SHA256:") {
+		t.Fatalf("unexpected state %+v", state)
+	}
+	if err := client.Call("Session.Accept", &JoinArgs{GuestClientId: "NOBODY"}, &Empty{}); err == nil {
+		t.Fatalf("expected accepting a request nobody made to fail")
+	}
+	if err := client.Call("Session.Accept", &JoinArgs{GuestClientId: "GUEST1"}, &Empty{}); err != nil {
+		t.Fatalf("Accept failed: %s", err)
+	}
+	select {
+	case accepted := <-decided:
+		if !accepted {
+			t.Fatalf("expected the request to be accepted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the decision")
+	}
+}
+
+func TestOwnerControlListsOpenStreams(t *testing.T) {
+	session, client, _ := startOwnerControl(t)
+	session.StreamOpened(1, "emulator-5554", "shell:ls")
+	session.StreamOpened(2, "emulator-5554", "sync:")
+	session.GuestData(1, []byte("abc"))
+	session.DeviceData(1, []byte("hello"))
+	session.StreamClosed(2, relay.StreamSummary{})
+
+	var reply StreamsReply
+	if err := client.Call("Session.Streams", &Empty{}, &reply); err != nil {
+		t.Fatalf("Streams failed: %s", err)
+	}
+	if len(reply.Streams) != 1 {
+		t.Fatalf("expected only the open stream, got %+v", reply.Streams)
+	}
+	stream := reply.Streams[0]
+	if stream.Id != 1 || stream.Service != "shell:ls" || stream.BytesFromGuest != 3 || stream.BytesToGuest != 5 {
+		t.Fatalf("unexpected stream %+v", stream)
+	}
+}
+
+func TestOwnerControlEndsTheSession(t *testing.T) {
+	_, client, ended := startOwnerControl(t)
+	if err := client.Call("Session.Kick", &KickArgs{}, &Empty{}); err == nil {
+		t.Fatalf("expected Kick to fail")
+	}
+	if err := client.Call("Session.End", &Empty{}, &Empty{}); err != nil {
+		t.Fatalf("End failed: %s", err)
+	}
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected End to end the session")
+	}
+}
+
+func TestServerCloseRemovesTheSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	server, err := ServeGuest(path, NewGuestSession("ROOM1", func() {}))
+	if err != nil {
+		t.Fatalf("ServeGuest failed: %s", err)
+	}
+	client := dialControl(t, server)
+	if err := server.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+	if err := client.Call("Session.State", &StateArgs{}, &GuestState{}); err == nil {
+		t.Fatalf("expected open connections to be closed")
+	}
+	if _, err := jsonrpc.Dial("unix", path); err == nil {
+		t.Fatalf("expected the socket to be gone")
+	}
+}
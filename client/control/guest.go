@@ -0,0 +1,181 @@
+package control
+
+import (
+	"adb-remote.maci.team/client/controller"
+	"adb-remote.maci.team/client/identity"
+	"context"
+	"sync"
+	"time"
+)
+
+// GuestState is a snapshot of a joined room, from the guest's side.
+type GuestState struct {
+	// Version increases with every change (see StateArgs).
+	Version uint64 `json:"version"`
+	RoomId  string `json:"roomId"`
+	// QueuePosition is where the join request is in the room's join queue
+	// while another guest is in the room (1 being next).
+	QueuePosition int `json:"queuePosition,omitempty"`
+	// Joined is set once the owner accepted the join request, and Declined
+	// if it declined it.
+	Joined           bool   `json:"joined"`
+	Declined         bool   `json:"declined"`
+	OwnerClientId    string `json:"ownerClientId,omitempty"`
+	OwnerFingerprint string `json:"ownerFingerprint,omitempty"`
+	// Devices are the room's devices, in the owner's order.
+	Devices []GuestDevice `json:"devices"`
+	// Reconnecting is set while getting back into the room after the
+	// transporter connection was lost, and Reconnects counts the times it
+	// did. TransportLost is set once that's given up on, or right away
+	// without reconnecting.
+	Reconnecting  bool `json:"reconnecting"`
+	Reconnects    int  `json:"reconnects"`
+	TransportLost bool `json:"transportLost"`
+	// LeaseExpiresAt is when the session lease the owner granted runs out,
+	// if it has a time limit; LeaseEnded is set once it ran out or was
+	// revoked, ending the session.
+	LeaseExpiresAt *time.Time `json:"leaseExpiresAt,omitempty"`
+	LeaseEnded     bool       `json:"leaseEnded,omitempty"`
+	// Kicked is set once the owner removed the guest from the room, with
+	// the KickReason it gave, ending the session.
+	Kicked     bool   `json:"kicked,omitempty"`
+	KickReason string `json:"kickReason,omitempty"`
+}
+
+// GuestDevice is one of a joined room's devices and its local proxy.
+type GuestDevice struct {
+	Serial string `json:"serial"`
+	// State is the device's adb state on the owner's side ("device" when
+	// usable).
+	State       string `json:"state"`
+	Description string `json:"description,omitempty"`
+	// LocalAddress is where its proxy listens (host:port, or
+	// "unix:<path>"), once it does, and LocalPort the port (empty for a
+	// unix socket).
+	LocalAddress string `json:"localAddress,omitempty"`
+	LocalPort    string `json:"localPort,omitempty"`
+	// AdbConnected is set once the local adb server was connected to the
+	// proxy automatically.
+	AdbConnected bool `json:"adbConnected"`
+	// LocalConnections counts the local adb connections being relayed.
+	LocalConnections int `json:"localConnections"`
+}
+
+// GuestSession follows a joined room for its control API, from every
+// GuestEvent it is told about. It is safe for concurrent use, and
+// GuestEvent may be called on a nil GuestSession, which follows nothing.
+type GuestSession struct {
+	end context.CancelFunc
+
+	mu      sync.Mutex
+	changes changes
+	state   GuestState
+}
+
+// NewGuestSession returns a GuestSession for roomId whose End method calls
+// end, which should stop the whole connect session.
+func NewGuestSession(roomId string, end context.CancelFunc) *GuestSession {
+	return &GuestSession{end: end, changes: newChanges(), state: GuestState{RoomId: roomId, Devices: []GuestDevice{}}}
+}
+
+// GuestEvent records what e reports.
+func (s *GuestSession) GuestEvent(e controller.GuestEvent) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch e.Kind {
+	case controller.GuestQueued:
+		s.state.QueuePosition = e.QueuePosition
+	case controller.GuestJoinDecided:
+		s.state.QueuePosition = 0
+		s.state.Joined = e.Accepted
+		s.state.Declined = !e.Accepted
+		s.state.OwnerClientId = e.OwnerClientId
+		if len(e.OwnerPublicKey) > 0 {
+			s.state.OwnerFingerprint = identity.Fingerprint(e.OwnerPublicKey)
+		}
+		s.state.Devices = make([]GuestDevice, len(e.Devices))
+		for i, serial := range e.Devices {
+			s.state.Devices[i] = GuestDevice{Serial: serial, State: "device"}
+		}
+	case controller.GuestReconnecting:
+		s.state.Reconnecting = true
+	case controller.GuestReconnected:
+		s.state.Reconnecting = false
+		s.state.Reconnects++
+	case controller.GuestTransportLost:
+		s.state.Reconnecting = false
+		s.state.TransportLost = true
+	case controller.GuestLeaseChanged:
+		expiresAt := e.LeaseExpiresAt.UTC()
+		s.state.LeaseExpiresAt = &expiresAt
+	case controller.GuestLeaseEnded:
+		s.state.LeaseExpiresAt = nil
+		s.state.LeaseEnded = true
+	case controller.GuestKicked:
+		s.state.Joined = false
+		s.state.Kicked, s.state.KickReason = true, e.Reason
+	case controller.GuestLeaseExpiring:
+		return
+	default:
+		device := s.device(e.Device)
+		if device == nil {
+			return
+		}
+		switch e.Kind {
+		case controller.GuestProxyReady:
+			device.LocalAddress, device.LocalPort = e.LocalAddress, e.LocalPort
+		case controller.GuestAdbConnected:
+			device.AdbConnected = true
+		case controller.GuestLocalAdbConnected:
+			device.LocalConnections++
+		case controller.GuestRelayStopped:
+			device.LocalConnections = max(device.LocalConnections-1, 0)
+		case controller.GuestDeviceOffline:
+			device.State = e.DeviceState
+		case controller.GuestDeviceOnline:
+			device.State = "device"
+		case controller.GuestDeviceInfo:
+			device.Description = e.DeviceInfo.Describe()
+		default:
+			return
+		}
+	}
+	s.changes.bump()
+}
+
+func (s *GuestSession) device(serial string) *GuestDevice {
+	for i := range s.state.Devices {
+		if s.state.Devices[i].Serial == serial {
+			return &s.state.Devices[i]
+		}
+	}
+	return nil
+}
+
+func (s *GuestSession) snapshot() GuestState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state
+	state.Version = s.changes.version
+	state.Devices = append([]GuestDevice{}, s.state.Devices...)
+	return state
+}
+
+// guestService is a GuestSession's RPC receiver.
+type guestService struct {
+	session *GuestSession
+}
+
+func (g *guestService) State(args *StateArgs, reply *GuestState) error {
+	waitForChange(&g.session.mu, &g.session.changes, args)
+	*reply = g.session.snapshot()
+	return nil
+}
+
+func (g *guestService) End(_ *Empty, _ *Empty) error {
+	g.session.end()
+	return nil
+}
@@ -0,0 +1,57 @@
+package control
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/controller"
+	"testing"
+)
+
+func TestGuestStateFollowsGuestEvents(t *testing.T) {
+	session := NewGuestSession("ROOM1", func() {})
+	session.GuestEvent(controller.GuestEvent{Kind: controller.GuestQueued, QueuePosition: 2})
+	if state := session.snapshot(); state.QueuePosition != 2 || state.Joined {
+		t.Fatalf("expected the session to wait in line, got %+v", state)
+	}
+	for _, event := range []controller.GuestEvent{
+		{Kind: controller.GuestJoinDecided, Accepted: true, OwnerClientId: "OWNER1", OwnerPublicKey: []byte("0123456789abcdef0123456789abcdef"), Devices: []string{"emulator-5554"}},
+		{Kind: controller.GuestDeviceInfo, Device: "emulator-5554", DeviceInfo: adb.DeviceInfo{Manufacturer: "Google", Model: "Pixel_7"}},
+		{Kind: controller.GuestProxyReady, Device: "emulator-5554", LocalPort: "5038", LocalAddress: "127.0.0.1:5038"},
+		{Kind: controller.GuestAdbConnected, Device: "emulator-5554"},
+		{Kind: controller.GuestLocalAdbConnected, Device: "emulator-5554"},
+		{Kind: controller.GuestLocalAdbConnected, Device: "emulator-5554"},
+		{Kind: controller.GuestRelayStopped, Device: "emulator-5554"},
+		{Kind: controller.GuestDeviceOffline, Device: "emulator-5554", DeviceState: "offline"},
+	} {
+		session.GuestEvent(event)
+	}
+	state := session.snapshot()
+	if !state.Joined || state.QueuePosition != 0 || state.OwnerClientId != "OWNER1" || state.OwnerFingerprint == "" || len(state.Devices) != 1 {
+		t.Fatalf("unexpected state %+v", state)
+	}
+	device := state.Devices[0]
+	if device.LocalAddress != "127.0.0.1:5038" || !device.AdbConnected || device.LocalConnections != 1 || device.State != "offline" || device.Description == "" {
+		t.Fatalf("unexpected device %+v", device)
+	}
+	if state.Version != 9 {
+		t.Fatalf("expected every event to bump the version, got %d", state.Version)
+	}
+
+	session.GuestEvent(controller.GuestEvent{Kind: controller.GuestReconnecting, Attempt: 1})
+	if state := session.snapshot(); !state.Reconnecting || state.TransportLost {
+		t.Fatalf("expected the session to be reconnecting, got %+v", state)
+	}
+	session.GuestEvent(controller.GuestEvent{Kind: controller.GuestReconnected, ClientId: "CLIENT2"})
+	if state := session.snapshot(); state.Reconnecting || state.Reconnects != 1 || !state.Joined {
+		t.Fatalf("expected the session to be back in the room, got %+v", state)
+	}
+
+	session.GuestEvent(controller.GuestEvent{Kind: controller.GuestTransportLost})
+	if !session.snapshot().TransportLost {
+		t.Fatalf("expected the transport loss to be recorded")
+	}
+
+	session.GuestEvent(controller.GuestEvent{Kind: controller.GuestKicked, Reason: "Session over"})
+	if state := session.snapshot(); state.Joined || !state.Kicked || state.KickReason != "Session over" {
+		t.Fatalf("expected the kick to be recorded, got %+v", state)
+	}
+}
@@ -0,0 +1,424 @@
+package control
+
+import (
+	"adb-remote.maci.team/client/controller"
+	"adb-remote.maci.team/client/identity"
+	"adb-remote.maci.team/client/relay"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// OwnerState is a snapshot of a shared room.
+type OwnerState struct {
+	// Version increases with every change (see StateArgs).
+	Version uint64 `json:"version"`
+	RoomId  string `json:"roomId,omitempty"`
+	// Devices are the shared devices, in the order guests see them.
+	Devices []DeviceState `json:"devices"`
+	// Guest is the room's current guest, if any.
+	Guest *GuestInfo `json:"guest,omitempty"`
+	// PendingJoins are the join requests waiting for a decision, oldest
+	// first.
+	PendingJoins []JoinRequest `json:"pendingJoins"`
+	// Queue holds the client ids of the guests waiting, in order, to join
+	// while another one is in the room; their join requests come once it's
+	// their turn.
+	Queue []string `json:"queue"`
+}
+
+// DeviceState is a shared device and its adb state ("device" when usable).
+type DeviceState struct {
+	Serial string `json:"serial"`
+	State  string `json:"state"`
+}
+
+// GuestInfo identifies a room's guest.
+type GuestInfo struct {
+	ClientId    string    `json:"clientId"`
+	Fingerprint string    `json:"fingerprint"`
+	JoinedAt    time.Time `json:"joinedAt"`
+	// LeaseExpiresAt is when the guest's session lease runs out, if it has
+	// a time limit; LeaseEnded is set once it ran out or was revoked.
+	LeaseExpiresAt *time.Time `json:"leaseExpiresAt,omitempty"`
+	LeaseEnded     bool       `json:"leaseEnded,omitempty"`
+}
+
+// JoinRequest is a join request waiting for a decision.
+type JoinRequest struct {
+	GuestClientId    string    `json:"guestClientId"`
+	GuestFingerprint string    `json:"guestFingerprint"`
+	RequestedAt      time.Time `json:"requestedAt"`
+}
+
+// Stream is an ADB stream the guest has open on a shared device.
+type Stream struct {
+	Id             uint32    `json:"id"`
+	Device         string    `json:"device"`
+	Service        string    `json:"service"`
+	OpenedAt       time.Time `json:"openedAt"`
+	BytesFromGuest uint64    `json:"bytesFromGuest"`
+	BytesToGuest   uint64    `json:"bytesToGuest"`
+}
+
+// StreamsReply is Streams' result.
+type StreamsReply struct {
+	Streams []Stream `json:"streams"`
+}
+
+// JoinArgs name the guest whose join request Accept or Decline decides.
+type JoinArgs struct {
+	GuestClientId string `json:"guestClientId"`
+}
+
+// ExtendLeaseArgs say how much ExtendLease adds to the guest's lease.
+type ExtendLeaseArgs struct {
+	Minutes int `json:"minutes"`
+}
+
+// errNoLeases is what ExtendLease and RevokeLease answer for a session
+// that doesn't grant leases.
+var errNoLeases = errors.New("this session doesn't grant session leases")
+
+// KickArgs give the Reason Kick tells the guest it was removed for.
+type KickArgs struct {
+	Reason string `json:"reason"`
+}
+
+// errNoKicker is what Kick answers for a session that can't remove its
+// guest.
+var errNoKicker = errors.New("this session can't remove its guest; End the session instead")
+
+// OwnerSession follows a shared room for its control API: it is the
+// room's controller.SessionObserver (see OwnerOptions.Observers), is told
+// about every OwnerEvent, and decides join requests alongside the room's
+// own prompt (see Decide). It is safe for concurrent use. OwnerEvent and
+// Decide may be called on a nil OwnerSession, which follows nothing and
+// leaves every decision to the prompt.
+type OwnerSession struct {
+	end context.CancelFunc
+	now func() time.Time
+
+	mu      sync.Mutex
+	changes changes
+	roomId  string
+	devices []DeviceState
+	guest   *GuestInfo
+	pending []*pendingJoin
+	queue   []string
+	streams map[uint32]*Stream
+	// leases, if set, is what ExtendLease and RevokeLease change.
+	leases *controller.Leases
+	// kicker, if set, is what Kick removes the guest with.
+	kicker *controller.Kicker
+}
+
+// pendingJoin is a JoinRequest and where its decision goes.
+type pendingJoin struct {
+	request JoinRequest
+	respond chan bool
+}
+
+// NewOwnerSession returns an OwnerSession whose End method calls end, which
+// should stop the whole share session.
+func NewOwnerSession(end context.CancelFunc) *OwnerSession {
+	return &OwnerSession{
+		end:     end,
+		now:     time.Now,
+		changes: newChanges(),
+		streams: make(map[uint32]*Stream),
+	}
+}
+
+// SetLeases has the control API extend and revoke the guests' leases
+// with leases. It must be called before the room is shared, and may be
+// called on a nil OwnerSession.
+func (s *OwnerSession) SetLeases(leases *controller.Leases) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leases = leases
+}
+
+// SetKicker has the control API remove the guest with kicker. It must be
+// called before the room is shared, and may be called on a nil
+// OwnerSession.
+func (s *OwnerSession) SetKicker(kicker *controller.Kicker) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kicker = kicker
+}
+
+// OwnerEvent records the device state, guest lease and join queue changes
+// e reports.
+func (s *OwnerSession) OwnerEvent(e controller.OwnerEvent) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch e.Kind {
+	case controller.OwnerDeviceOffline, controller.OwnerDeviceOnline:
+		for i := range s.devices {
+			if s.devices[i].Serial == e.Device {
+				s.devices[i].State = e.DeviceState
+			}
+		}
+	case controller.OwnerLeaseChanged, controller.OwnerLeaseEnded:
+		if s.guest == nil || s.guest.ClientId != e.GuestClientId {
+			return
+		}
+		if e.Kind == controller.OwnerLeaseEnded {
+			s.guest.LeaseExpiresAt, s.guest.LeaseEnded = nil, true
+		} else {
+			expiresAt := s.now().UTC().Add(e.Lease)
+			s.guest.LeaseExpiresAt = &expiresAt
+		}
+	case controller.OwnerJoinQueueChanged:
+		s.queue = e.Queue
+	default:
+		return
+	}
+	s.changes.bump()
+}
+
+// Decide decides the join request from guestClientId: whichever of ask, if
+// non-nil, and a control client's Accept or Decline answers first. ask's
+// context is cancelled once a control client has answered.
+func (s *OwnerSession) Decide(ctx context.Context, guestClientId string, guestPublicKey []byte, ask func(ctx context.Context) (bool, error)) (bool, error) {
+	if s == nil {
+		return ask(ctx)
+	}
+	join := &pendingJoin{
+		request: JoinRequest{GuestClientId: guestClientId, GuestFingerprint: identity.Fingerprint(guestPublicKey), RequestedAt: s.now().UTC()},
+		respond: make(chan bool, 1),
+	}
+	s.mu.Lock()
+	s.pending = append(s.pending, join)
+	s.changes.bump()
+	s.mu.Unlock()
+	defer s.removePending(join)
+
+	askCtx, cancelAsk := context.WithCancel(ctx)
+	defer cancelAsk()
+	type answer struct {
+		accepted bool
+		err      error
+	}
+	asked := make(chan answer, 1)
+	if ask != nil {
+		go func() {
+			accepted, err := ask(askCtx)
+			asked <- answer{accepted, err}
+		}()
+	}
+	select {
+	case accepted := <-join.respond:
+		return accepted, nil
+	case answer := <-asked:
+		return answer.accepted, answer.err
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+func (s *OwnerSession) removePending(join *pendingJoin) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, pending := range s.pending {
+		if pending == join {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			s.changes.bump()
+			return
+		}
+	}
+}
+
+// answer decides the oldest pending join request from guestClientId.
+func (s *OwnerSession) answer(guestClientId string, accepted bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, pending := range s.pending {
+		if pending.request.GuestClientId == guestClientId {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			s.changes.bump()
+			pending.respond <- accepted
+			return nil
+		}
+	}
+	return fmt.Errorf("no pending join request from %s", guestClientId)
+}
+
+func (s *OwnerSession) state() OwnerState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := OwnerState{
+		Version:      s.changes.version,
+		RoomId:       s.roomId,
+		Devices:      append([]DeviceState{}, s.devices...),
+		PendingJoins: []JoinRequest{},
+		Queue:        append([]string{}, s.queue...),
+	}
+	if s.guest != nil {
+		guest := *s.guest
+		state.Guest = &guest
+	}
+	for _, pending := range s.pending {
+		state.PendingJoins = append(state.PendingJoins, pending.request)
+	}
+	return state
+}
+
+func (s *OwnerSession) currentLeases() *controller.Leases {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leases
+}
+
+func (s *OwnerSession) currentKicker() *controller.Kicker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kicker
+}
+
+func (s *OwnerSession) openStreams() []Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	streams := make([]Stream, 0, len(s.streams))
+	for _, stream := range s.streams {
+		streams = append(streams, *stream)
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].Id < streams[j].Id })
+	return streams
+}
+
+// RoomCreated implements controller.SessionObserver.
+func (s *OwnerSession) RoomCreated(roomId string, devices []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roomId = roomId
+	s.devices = make([]DeviceState, len(devices))
+	for i, serial := range devices {
+		s.devices[i] = DeviceState{Serial: serial, State: "device"}
+	}
+	s.changes.bump()
+}
+
+// GuestJoined implements controller.SessionObserver.
+func (s *OwnerSession) GuestJoined(clientId string, fingerprint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.guest = &GuestInfo{ClientId: clientId, Fingerprint: fingerprint, JoinedAt: s.now().UTC()}
+	s.changes.bump()
+}
+
+// GuestLeft implements controller.SessionObserver. A room only ever has
+// one guest, so if none was accepted yet, the one that left is the one
+// still waiting for a decision, which is declined.
+func (s *OwnerSession) GuestLeft() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.guest = nil
+	for _, pending := range s.pending {
+		pending.respond <- false
+	}
+	s.pending = nil
+	s.changes.bump()
+}
+
+// StreamOpened implements relay.StreamObserver.
+func (s *OwnerSession) StreamOpened(id uint32, device string, service string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams[id] = &Stream{Id: id, Device: device, Service: service, OpenedAt: s.now().UTC()}
+}
+
+// StreamRejected implements relay.StreamObserver.
+func (s *OwnerSession) StreamRejected(string, string, error) {}
+
+// GuestData implements relay.StreamObserver.
+func (s *OwnerSession) GuestData(id uint32, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stream, ok := s.streams[id]; ok {
+		stream.BytesFromGuest += uint64(len(data))
+	}
+}
+
+// DeviceData implements relay.StreamObserver.
+func (s *OwnerSession) DeviceData(id uint32, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stream, ok := s.streams[id]; ok {
+		stream.BytesToGuest += uint64(len(data))
+	}
+}
+
+// StreamClosed implements relay.StreamObserver.
+func (s *OwnerSession) StreamClosed(id uint32, _ relay.StreamSummary) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+}
+
+// ownerService is an OwnerSession's RPC receiver; net/rpc wants every
+// exported method of it to be one.
+type ownerService struct {
+	session *OwnerSession
+}
+
+func (o *ownerService) State(args *StateArgs, reply *OwnerState) error {
+	waitForChange(&o.session.mu, &o.session.changes, args)
+	*reply = o.session.state()
+	return nil
+}
+
+func (o *ownerService) Streams(_ *Empty, reply *StreamsReply) error {
+	reply.Streams = o.session.openStreams()
+	return nil
+}
+
+func (o *ownerService) Accept(args *JoinArgs, _ *Empty) error {
+	return o.session.answer(args.GuestClientId, true)
+}
+
+func (o *ownerService) Decline(args *JoinArgs, _ *Empty) error {
+	return o.session.answer(args.GuestClientId, false)
+}
+
+func (o *ownerService) ExtendLease(args *ExtendLeaseArgs, _ *Empty) error {
+	leases := o.session.currentLeases()
+	if leases == nil {
+		return errNoLeases
+	}
+	return leases.Extend(time.Duration(args.Minutes) * time.Minute)
+}
+
+func (o *ownerService) RevokeLease(_ *Empty, _ *Empty) error {
+	leases := o.session.currentLeases()
+	if leases == nil {
+		return errNoLeases
+	}
+	return leases.Revoke()
+}
+
+func (o *ownerService) Kick(args *KickArgs, _ *Empty) error {
+	kicker := o.session.currentKicker()
+	if kicker == nil {
+		return errNoKicker
+	}
+	return kicker.Kick(args.Reason)
+}
+
+func (o *ownerService) End(_ *Empty, _ *Empty) error {
+	o.session.end()
+	return nil
+}
@@ -0,0 +1,113 @@
+package control
+
+import (
+	"adb-remote.maci.team/client/controller"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDecideTakesThePromptsAnswer(t *testing.T) {
+	session := NewOwnerSession(func() {})
+	accepted, err := session.Decide(context.Background(), "GUEST1", nil, func(context.Context) (bool, error) { return true, nil })
+	if err != nil || !accepted {
+		t.Fatalf("expected the prompt's answer, got %v (%v)", accepted, err)
+	}
+	if state := session.state(); len(state.PendingJoins) != 0 {
+		t.Fatalf("expected no pending request once decided, got %+v", state.PendingJoins)
+	}
+}
+
+func TestDecideWithoutSessionAsksThePrompt(t *testing.T) {
+	var session *OwnerSession
+	accepted, err := session.Decide(context.Background(), "GUEST1", nil, func(context.Context) (bool, error) { return true, nil })
+	if err != nil || !accepted {
+		t.Fatalf("expected the prompt's answer, got %v (%v)", accepted, err)
+	}
+	session.OwnerEvent(controller.OwnerEvent{Kind: controller.OwnerDeviceOffline})
+}
+
+func TestGuestLeavingDeclinesItsPendingRequest(t *testing.T) {
+	session := NewOwnerSession(func() {})
+	decided := make(chan bool, 1)
+	go func() {
+		accepted, _ := session.Decide(context.Background(), "GUEST1", nil, nil)
+		decided <- accepted
+	}()
+	for len(session.state().PendingJoins) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	session.GuestLeft()
+	select {
+	case accepted := <-decided:
+		if accepted {
+			t.Fatalf("did not expect a guest that left to be accepted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the decision")
+	}
+}
+
+func TestOwnerStateFollowsDeviceStates(t *testing.T) {
+	session := NewOwnerSession(func() {})
+	session.RoomCreated("ROOM1", []string{"emulator-5554", "R58M123"})
+	session.OwnerEvent(controller.OwnerEvent{Kind: controller.OwnerDeviceOffline, Device: "R58M123", DeviceState: "unauthorized"})
+	session.GuestJoined("GUEST1", "SHA256:abc")
+	state := session.state()
+	if state.Devices[0].State != "device" || state.Devices[1].State != "unauthorized" {
+		t.Fatalf("unexpected device states %+v", state.Devices)
+	}
+	if state.Guest == nil || state.Guest.ClientId != "GUEST1" {
+		t.Fatalf("expected GUEST1 to be the guest, got %+v", state.Guest)
+	}
+	session.GuestLeft()
+	if session.state().Guest != nil {
+		t.Fatalf("expected no guest once it left")
+	}
+}
+
+func TestOwnerStateFollowsTheGuestsLease(t *testing.T) {
+	session := NewOwnerSession(func() {})
+	session.RoomCreated("ROOM1", []string{"emulator-5554"})
+	session.GuestJoined("GUEST1", "SHA256:abc")
+	session.OwnerEvent(controller.OwnerEvent{Kind: controller.OwnerLeaseChanged, GuestClientId: "GUEST1", Lease: time.Hour})
+	guest := session.state().Guest
+	if guest == nil || guest.LeaseExpiresAt == nil || guest.LeaseExpiresAt.Before(time.Now().Add(59*time.Minute)) {
+		t.Fatalf("expected GUEST1's lease to run out in an hour, got %+v", guest)
+	}
+	session.OwnerEvent(controller.OwnerEvent{Kind: controller.OwnerLeaseEnded, GuestClientId: "GUEST1"})
+	if guest := session.state().Guest; guest.LeaseExpiresAt != nil || !guest.LeaseEnded {
+		t.Fatalf("expected GUEST1's lease to have ended, got %+v", guest)
+	}
+}
+
+func TestOwnerStateListsTheJoinQueue(t *testing.T) {
+	session := NewOwnerSession(func() {})
+	if queue := session.state().Queue; queue == nil || len(queue) != 0 {
+		t.Fatalf("expected an empty join queue, got %v", queue)
+	}
+	session.OwnerEvent(controller.OwnerEvent{Kind: controller.OwnerJoinQueueChanged, Queue: []string{"GUEST2", "GUEST3"}})
+	if queue := session.state().Queue; len(queue) != 2 || queue[0] != "GUEST2" {
+		t.Fatalf("expected GUEST2 and GUEST3 waiting, got %v", queue)
+	}
+}
+
+func TestExtendLeaseNeedsLeases(t *testing.T) {
+	service := &ownerService{session: NewOwnerSession(func() {})}
+	if err := service.ExtendLease(&ExtendLeaseArgs{Minutes: 15}, &Empty{}); err != errNoLeases {
+		t.Fatalf("expected errNoLeases, got %v", err)
+	}
+}
+
+func TestKickNeedsAGuest(t *testing.T) {
+	session := NewOwnerSession(func() {})
+	service := &ownerService{session: session}
+	if err := service.Kick(&KickArgs{Reason: "bye"}, &Empty{}); err != errNoKicker {
+		t.Fatalf("expected errNoKicker, got %v", err)
+	}
+	session.SetKicker(controller.NewKicker())
+	if err := service.Kick(&KickArgs{Reason: "bye"}, &Empty{}); !errors.Is(err, controller.ErrNoGuest) {
+		t.Fatalf("expected controller.ErrNoGuest, got %v", err)
+	}
+}
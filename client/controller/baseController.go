@@ -37,5 +37,6 @@ func Handshake(client *transportLayer.Client) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	client.SetClientId(payload.ClientId)
 	return payload.ClientId, nil
 }
@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"adb-remote.maci.team/client/identity"
+	"adb-remote.maci.team/client/transportLayer"
+	"adb-remote.maci.team/shared/protocol"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chatMaxSkew is how far a chat message's send time may be off the
+// receiver's clock for it to be shown.
+const chatMaxSkew = 5 * time.Minute
+
+// ErrNoChatPeer is returned by Chat.Send when nobody is in the room to chat
+// with.
+var ErrNoChatPeer = errors.New("nobody is in the room to chat with")
+
+// ErrEmptyChatMessage is returned by Chat.Send for a message with nothing
+// but blanks in it.
+var ErrEmptyChatMessage = errors.New("the chat message is empty")
+
+// chatStamp is when, and as which of its sender's messages, a chat message
+// was sent; a sender's stamps only ever go up.
+type chatStamp struct {
+	sentAt   int
+	sequence int
+}
+
+func (s chatStamp) after(other chatStamp) bool {
+	return s.sentAt > other.sentAt || s.sentAt == other.sentAt && s.sequence > other.sequence
+}
+
+// Chat lets a room's owner and its accepted guest send each other text
+// messages within the session. Every message is signed with its sender's
+// identity key, for the room and the recipient's identity, so the
+// transporter relaying them can't make one up, alter it, or hand it to
+// someone else; a message that doesn't verify, that isn't newer than the
+// last one from the same sender, or whose send time is more than a few
+// minutes off is dropped. Messages received are reported as
+// OwnerChatMessage or GuestChatMessage events. Create one with NewChat and
+// pass it in OwnerOptions.Chat or GuestOptions.Chat; it serves one room at
+// a time.
+type Chat struct {
+	mutex sync.Mutex
+	// client, self, roomId and emit are set by attach.
+	client *transportLayer.Client
+	self   *identity.Identity
+	roomId string
+	emit   func(peerClientId string, text string, sentAt time.Time)
+	// peerClientId and peerPublicKey are who's at the other end, while
+	// somebody is.
+	peerClientId  string
+	peerPublicKey ed25519.PublicKey
+	// sent is the stamp of the last message sent, and received that of the
+	// last message accepted from every identity, by public key.
+	sent     chatStamp
+	received map[string]chatStamp
+}
+
+// NewChat returns a Chat for a room to be shared or joined.
+func NewChat() *Chat {
+	return &Chat{received: map[string]chatStamp{}}
+}
+
+// attach has c chat in roomId, over client, as self, passing every message
+// received to emit.
+func (c *Chat) attach(client *transportLayer.Client, self *identity.Identity, roomId string, emit func(peerClientId string, text string, sentAt time.Time)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.client, c.self, c.roomId, c.emit = client, self, roomId, emit
+}
+
+// joined records that peerClientId, whose identity public key is
+// peerPublicKey, is at the other end of the room now.
+func (c *Chat) joined(peerClientId string, peerPublicKey []byte) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.peerClientId, c.peerPublicKey = peerClientId, peerPublicKey
+}
+
+// left records that nobody is at the other end of the room anymore.
+func (c *Chat) left() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.peerClientId, c.peerPublicKey = "", nil
+}
+
+// Send signs text and sends it to the other participant in the room.
+func (c *Chat) Send(text string) error {
+	if strings.TrimSpace(text) == "" {
+		return ErrEmptyChatMessage
+	}
+	if len(text) > protocol.MaxChatMessageLength {
+		return fmt.Errorf("the chat message is longer than %d bytes", protocol.MaxChatMessageLength)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.peerPublicKey == nil {
+		return ErrNoChatPeer
+	}
+	stamp := chatStamp{sentAt: int(time.Now().Unix()), sequence: c.sent.sequence + 1}
+	if stamp.sentAt < c.sent.sentAt {
+		// The clock went back; keep the stamps going up regardless.
+		stamp.sentAt = c.sent.sentAt
+	}
+	signed := protocol.ChatMessage(c.roomId, c.peerPublicKey, stamp.sentAt, stamp.sequence, text)
+	if err := c.client.SendChatMessage(&protocol.TransporterMessagePayloadChatMessage{
+		Text:      text,
+		SentAt:    stamp.sentAt,
+		Sequence:  stamp.sequence,
+		Signature: ed25519.Sign(c.self.PrivateKey, signed),
+	}); err != nil {
+		return fmt.Errorf("failed to send the chat message: %w", err)
+	}
+	c.sent = stamp
+	return nil
+}
+
+// receive checks a chat message the transporter relayed, and reports it if
+// it's genuinely from the other participant and new.
+func (c *Chat) receive(message *protocol.TransporterMessagePayloadChatMessage) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	logger := c.client.Logger
+	if c.peerPublicKey == nil {
+		logger.Info("Dropping a chat message: nobody is in the room to chat with")
+		return
+	}
+	signed := protocol.ChatMessage(c.roomId, c.self.PublicKey, message.SentAt, message.Sequence, message.Text)
+	if !ed25519.Verify(c.peerPublicKey, signed, message.Signature) {
+		logger.Warn(fmt.Sprintf("Dropping a chat message that %s didn't sign", c.peerClientId))
+		return
+	}
+	stamp := chatStamp{sentAt: message.SentAt, sequence: message.Sequence}
+	if !stamp.after(c.received[string(c.peerPublicKey)]) {
+		logger.Warn(fmt.Sprintf("Dropping a replayed chat message from %s", c.peerClientId))
+		return
+	}
+	sentAt := time.Unix(int64(message.SentAt), 0)
+	if skew := time.Since(sentAt); skew > chatMaxSkew || skew < -chatMaxSkew {
+		logger.Warn(fmt.Sprintf("Dropping a chat message from %s sent at %s, too far off the local clock", c.peerClientId, sentAt))
+		return
+	}
+	c.received[string(c.peerPublicKey)] = stamp
+	c.emit(c.peerClientId, message.Text, sentAt)
+}
@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"adb-remote.maci.team/client/identity"
+	"adb-remote.maci.team/shared/protocol"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// sendChatMessage has the transporter relay text to the client, signed by
+// from for the room and recipient.
+func sendChatMessage(t *testing.T, server net.Conn, from *identity.Identity, roomId string, recipient []byte, sentAt int, sequence int, text string) {
+	t.Helper()
+	message := protocol.CreateTransporterMessage()
+	message.SetDirectCommand(protocol.CommandChatMessage)
+	if err := message.SetPayloadChatMessage(&protocol.TransporterMessagePayloadChatMessage{
+		Text:      text,
+		SentAt:    sentAt,
+		Sequence:  sequence,
+		Signature: ed25519.Sign(from.PrivateKey, protocol.ChatMessage(roomId, recipient, sentAt, sequence, text)),
+	}); err != nil {
+		t.Fatalf("SetPayloadChatMessage failed: %s", err)
+	}
+	if err := message.Write(server); err != nil {
+		t.Fatalf("failed to write the chat message: %s", err)
+	}
+}
+
+// TestChatWithTheGuest checks that the owner's messages are signed for the
+// accepted guest, and that only the guest's own, new messages are shown:
+// not forged, replayed or reflected ones.
+func TestChatWithTheGuest(t *testing.T) {
+	client, server := newConnectedClient(t)
+	events := make(chan OwnerEvent, 10)
+	onEvent := func(e OwnerEvent) { events <- e }
+	ownerIdentity, guestIdentity := testIdentity(t), testIdentity(t)
+
+	chat := NewChat()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- JoinAsRoomOwner(ctx, client, newFakeSmartSocket(), []string{"emulator-5554"}, ownerIdentity, func(string, []byte) (bool, error) {
+			return true, nil
+		}, onEvent, OwnerOptions{Chat: chat})
+	}()
+
+	respondToCreateRoom(t, server, "ROOM9")
+	expectOwnerEvent(t, events) // OwnerRoomCreated
+	if err := chat.Send("anybody there?"); !errors.Is(err, ErrNoChatPeer) {
+		t.Fatalf("expected chatting in an empty room to fail with ErrNoChatPeer, got %v", err)
+	}
+
+	sendJoinRoomRequestFrom(t, server, "ROOM9", "GUEST1", guestIdentity)
+	expectJoinResponse(t, server)
+	expectDeviceInfo(t, server)
+	expectOwnerEvent(t, events) // OwnerJoinRequested
+	expectOwnerEvent(t, events) // OwnerJoinDecided
+
+	go func() {
+		if err := chat.Send("Welcome!"); err != nil {
+			t.Errorf("Send failed: %s", err)
+		}
+	}()
+	message := readMessage(t, server)
+	if message.Command() != protocol.CommandChatMessage {
+		t.Fatalf("expected a chat message, got %x", message.Command())
+	}
+	sent, err := message.GetPayloadChatMessage()
+	if err != nil {
+		t.Fatalf("GetPayloadChatMessage failed: %s", err)
+	}
+	if sent.Text != "Welcome!" || !ed25519.Verify(ownerIdentity.PublicKey, protocol.ChatMessage("ROOM9", guestIdentity.PublicKey, sent.SentAt, sent.Sequence, sent.Text), sent.Signature) {
+		t.Fatalf("expected a message signed for the guest, got %+v", sent)
+	}
+
+	now := int(time.Now().Unix())
+	sendChatMessage(t, server, guestIdentity, "ROOM9", ownerIdentity.PublicKey, now, 1, "Thanks")
+	if event := expectOwnerEvent(t, events); event.Kind != OwnerChatMessage || event.GuestClientId != "GUEST1" || event.Text != "Thanks" {
+		t.Fatalf("expected OwnerChatMessage from GUEST1, got %+v", event)
+	}
+	// None of these may show up: the next event has to be the last message.
+	sendChatMessage(t, server, guestIdentity, "ROOM9", ownerIdentity.PublicKey, now, 1, "Thanks")
+	sendChatMessage(t, server, testIdentity(t), "ROOM9", ownerIdentity.PublicKey, now, 2, "forged")
+	sendChatMessage(t, server, ownerIdentity, "ROOM9", guestIdentity.PublicKey, sent.SentAt, sent.Sequence, sent.Text)
+	sendChatMessage(t, server, guestIdentity, "ROOM9", ownerIdentity.PublicKey, now-3600, 3, "stale")
+	sendChatMessage(t, server, guestIdentity, "ROOM9", ownerIdentity.PublicKey, now, 4, "Bye")
+	if event := expectOwnerEvent(t, events); event.Kind != OwnerChatMessage || event.Text != "Bye" {
+		t.Fatalf("expected only the new message to be shown, got %+v", event)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("JoinAsRoomOwner did not stop after context cancellation")
+	}
+}
@@ -0,0 +1,153 @@
+package controller
+
+import (
+	"adb-remote.maci.team/client/identity"
+	"adb-remote.maci.team/client/relay"
+	"adb-remote.maci.team/client/transportLayer"
+	"adb-remote.maci.team/shared/protocol"
+	"crypto/ed25519"
+	"fmt"
+)
+
+// PublishOptions lists a room in a team's room directory on the
+// transporter (see OwnerOptions.Publish), for the team's members to find
+// it with ListRooms instead of being told its id out of band. Joining it
+// still takes the owner's accept decision.
+type PublishOptions struct {
+	Team      string
+	TeamToken string
+	// Label describes the room, e.g. where its devices are; Tags are
+	// free-form keywords. Both are optional.
+	Label string
+	Tags  []string
+}
+
+// RoomListing is a room of a team's room directory.
+type RoomListing struct {
+	RoomId         string
+	Label          string
+	OwnerPublicKey []byte
+	// Models are the models of the devices the room shares (their serials,
+	// when unknown).
+	Models   []string
+	Tags     []string
+	Occupied bool
+}
+
+// ErrTeamAccessDenied is returned when the transporter doesn't know Team,
+// or the team token presented was wrong.
+type ErrTeamAccessDenied struct {
+	Team    string
+	Message string
+}
+
+func (e *ErrTeamAccessDenied) Error() string {
+	return fmt.Sprintf("team %s: access denied -- %s", e.Team, e.Message)
+}
+
+// ListRooms returns the rooms listed in team's room directory, presenting
+// teamToken; an *ErrTeamAccessDenied if the transporter refused it.
+func ListRooms(client *transportLayer.Client, team string, teamToken string) ([]RoomListing, error) {
+	if err := client.SendListRooms(team, teamToken); err != nil {
+		return nil, err
+	}
+
+	container, ok := <-client.Messages()
+	if !ok {
+		return nil, relay.ErrTransportClosed
+	}
+	defer container.Dispose()
+	message, err := container.Data()
+	if err != nil {
+		return nil, err
+	}
+	if message.IsError() {
+		return nil, directoryError(message, team)
+	}
+	if err := protocol.ExpectCommand(message, protocol.CommandListRooms|protocol.CommandResponseMask); err != nil {
+		return nil, err
+	}
+	payload, err := message.GetPayloadRoomList()
+	if err != nil {
+		return nil, err
+	}
+	rooms := make([]RoomListing, 0, len(payload.Rooms))
+	for _, room := range payload.Rooms {
+		rooms = append(rooms, RoomListing{
+			RoomId:         room.RoomId,
+			Label:          room.Label,
+			OwnerPublicKey: room.PublicKey,
+			Models:         room.Models,
+			Tags:           room.Tags,
+			Occupied:       room.Occupied != 0,
+		})
+	}
+	return rooms, nil
+}
+
+// directoryError returns the error a room directory request failed with.
+func directoryError(message *protocol.TransporterMessage, team string) error {
+	payload, err := message.GetErrorPayload()
+	if err != nil {
+		return err
+	}
+	if payload.ErrorCode == protocol.ErrorTeamAccessDenied {
+		return &ErrTeamAccessDenied{Team: team, Message: payload.ErrorMessage}
+	}
+	return fmt.Errorf("room directory error: %x -- %s", payload.ErrorCode, payload.ErrorMessage)
+}
+
+// publishRoom asks the transporter to list the room roomId in
+// options.Team's room directory, with the models of the shared devices,
+// under the owner's identity. The answer comes in on the owner's dispatch
+// loop (see handlePublishRoomResponse), since a guest's join request may
+// come first.
+func publishRoom(client *transportLayer.Client, ownerIdentity *identity.Identity, roomId string, shared *sharedDevices, options *PublishOptions) error {
+	var models []string
+	for i, info := range shared.info() {
+		if len(models) == protocol.MaxListingModels {
+			break
+		}
+		model := info.Model
+		if model == "" {
+			model = shared.serials[i]
+		}
+		if len(model) > protocol.MaxListingTextLength {
+			model = model[:protocol.MaxListingTextLength]
+		}
+		models = append(models, model)
+	}
+	return client.SendPublishRoom(options.Team, options.TeamToken, protocol.TransporterMessagePayloadPublishRoom{
+		Label:     options.Label,
+		PublicKey: ownerIdentity.PublicKey,
+		Models:    models,
+		Tags:      options.Tags,
+		Signature: ed25519.Sign(ownerIdentity.PrivateKey, protocol.RoomListingMessage(roomId, client.ClientId())),
+	})
+}
+
+// handlePublishRoomResponse reports the transporter's answer to
+// publishRoom as an OwnerRoomPublished or OwnerPublishFailed event,
+// disposing of container. It returns false, leaving container alone, for
+// any other message.
+func handlePublishRoomResponse(client *transportLayer.Client, container *transportLayer.MessageContainer, team string, onEvent OwnerEventFunc) bool {
+	message, err := container.Data()
+	if err != nil {
+		return false
+	}
+	switch message.Command() {
+	case protocol.CommandPublishRoom | protocol.CommandResponseMask:
+		defer container.Dispose()
+		client.Logger.Info(fmt.Sprintf("The room is listed in team %s's room directory", team))
+		emitOwner(onEvent, OwnerEvent{Kind: OwnerRoomPublished, Team: team})
+		return true
+	case protocol.CommandPublishRoom | protocol.CommandErrorResponseMask:
+		defer container.Dispose()
+		err := directoryError(message, team)
+		client.Logger.Error(fmt.Sprintf("Can't list the room in team %s's room directory: %s", team, err))
+		emitOwner(onEvent, OwnerEvent{Kind: OwnerPublishFailed, Team: team, Err: err})
+		return true
+	default:
+		return false
+	}
+}
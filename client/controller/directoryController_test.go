@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"adb-remote.maci.team/shared/protocol"
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func respondToPublishRoom(t *testing.T, server net.Conn) *protocol.TransporterMessagePayloadPublishRoom {
+	t.Helper()
+	request := readMessage(t, server)
+	if request.Command() != protocol.CommandPublishRoom {
+		t.Fatalf("expected a publish room request, got %x", request.Command())
+	}
+	payload, err := request.GetPayloadPublishRoom()
+	if err != nil {
+		t.Fatalf("GetPayloadPublishRoom failed: %s", err)
+	}
+	response := protocol.CreateTransporterMessage()
+	response.SetResponseCommand(protocol.CommandPublishRoom)
+	if err := response.SetRawPayload(nil); err != nil {
+		t.Fatalf("SetRawPayload failed: %s", err)
+	}
+	if err := response.Write(server); err != nil {
+		t.Fatalf("failed to write the response: %s", err)
+	}
+	return payload
+}
+
+func TestListRoomsReturnsTheTeamsRooms(t *testing.T) {
+	client, server := newConnectedClient(t)
+
+	done := make(chan []RoomListing, 1)
+	go func() {
+		rooms, err := ListRooms(client, "mobile", "secret")
+		if err != nil {
+			t.Errorf("ListRooms failed: %s", err)
+		}
+		done <- rooms
+	}()
+
+	request := readMessage(t, server)
+	payload, err := request.GetPayloadListRooms()
+	if err != nil {
+		t.Fatalf("GetPayloadListRooms failed: %s", err)
+	}
+	if payload.Team != "mobile" || payload.TeamToken != "secret" {
+		t.Fatalf("unexpected list rooms request: %+v", payload)
+	}
+	response := protocol.CreateTransporterMessage()
+	response.SetResponseCommand(protocol.CommandListRooms)
+	if err := response.SetPayloadRoomList(&protocol.TransporterMessagePayloadRoomList{Rooms: []protocol.TransporterRoomListing{
+		{RoomId: "lab-pixel", Label: "Pixel lab", Models: []string{"Pixel 7"}, Tags: []string{"arm64"}, Occupied: 1},
+		{RoomId: "ROOM42"},
+	}}); err != nil {
+		t.Fatalf("SetPayloadRoomList failed: %s", err)
+	}
+	if err := response.Write(server); err != nil {
+		t.Fatalf("failed to write the response: %s", err)
+	}
+
+	rooms := <-done
+	if len(rooms) != 2 || rooms[0].RoomId != "lab-pixel" || rooms[0].Label != "Pixel lab" || !rooms[0].Occupied || rooms[1].Occupied {
+		t.Fatalf("unexpected rooms %+v", rooms)
+	}
+}
+
+func TestListRoomsReportsAccessDenied(t *testing.T) {
+	client, server := newConnectedClient(t)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ListRooms(client, "mobile", "guess")
+		done <- err
+	}()
+
+	readMessage(t, server)
+	response := protocol.CreateTransporterMessage()
+	response.SetErrorResponseCommand(protocol.CommandListRooms)
+	if err := response.SetErrorPayload(&protocol.TransporterMessagePayloadError{ErrorCode: protocol.ErrorTeamAccessDenied, ErrorMessage: "wrong token"}); err != nil {
+		t.Fatalf("SetErrorPayload failed: %s", err)
+	}
+	if err := response.Write(server); err != nil {
+		t.Fatalf("failed to write the response: %s", err)
+	}
+
+	var denied *ErrTeamAccessDenied
+	if err := <-done; !errors.As(err, &denied) || denied.Team != "mobile" {
+		t.Fatalf("expected an ErrTeamAccessDenied for team mobile, got %v", err)
+	}
+}
+
+func TestJoinAsRoomOwnerPublishesTheRoom(t *testing.T) {
+	client, server := newConnectedClient(t)
+	ownerIdentity := testIdentity(t)
+	events := make(chan OwnerEvent, 10)
+	onEvent := func(e OwnerEvent) { events <- e }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- JoinAsRoomOwner(ctx, client, newFakeSmartSocket(), []string{"emulator-5554"}, ownerIdentity, func(string, []byte) (bool, error) {
+			return false, nil
+		}, onEvent, OwnerOptions{Publish: &PublishOptions{Team: "mobile", TeamToken: "secret", Label: "Pixel lab", Tags: []string{"arm64"}}})
+	}()
+
+	respondToCreateRoom(t, server, "ROOM7")
+	expectOwnerEvent(t, events) // OwnerRoomCreated
+	published := respondToPublishRoom(t, server)
+	if published.Team != "mobile" || published.TeamToken != "secret" || published.Label != "Pixel lab" || string(published.PublicKey) != string(ownerIdentity.PublicKey) {
+		t.Fatalf("unexpected publish room request: %+v", published)
+	}
+	// The device's details are unknown to the fake, so it's listed by
+	// serial.
+	if len(published.Models) != 1 || published.Models[0] != "emulator-5554" {
+		t.Fatalf("expected the device to be listed by serial, got %v", published.Models)
+	}
+	if e := expectOwnerEvent(t, events); e.Kind != OwnerRoomPublished || e.Team != "mobile" {
+		t.Fatalf("expected OwnerRoomPublished for team mobile, got %+v", e)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
@@ -1,5 +1,10 @@
 package controller
 
+import (
+	"adb-remote.maci.team/client/adb"
+	"time"
+)
+
 // OwnerEventKind identifies what happened during JoinAsRoomOwner.
 type OwnerEventKind int
 
@@ -10,15 +15,56 @@ const (
 	// promptAccept has decided anything.
 	OwnerJoinRequested
 	// OwnerJoinDecided reports the accept/decline decision for a
-	// previously reported OwnerJoinRequested.
+	// previously reported OwnerJoinRequested, or, with Rejoined set, that
+	// the guest that just left re-joined without promptAccept being asked
+	// (see OwnerOptions.RejoinWindow), with no OwnerJoinRequested before.
 	OwnerJoinDecided
 	// OwnerJoinFailed reports that handling a join request itself failed
-	// (bad payload, promptAccept error, or the response couldn't be sent).
+	// (bad payload, a signature that doesn't verify, promptAccept error, or
+	// the response couldn't be sent).
 	OwnerJoinFailed
 	// OwnerGuestLeft reports that the previously-connected guest
 	// disconnected from the room. The owner's own transporter connection is
 	// unaffected; a new guest can still join.
 	OwnerGuestLeft
+	// OwnerServiceDenied reports that the guest tried to open a service
+	// the owner's OwnerOptions.ServiceFilter rejects (Service is what it
+	// asked for, Err the reason). The guest just sees that stream fail.
+	OwnerServiceDenied
+	// OwnerDeviceOffline reports that the shared Device stopped being
+	// usable (unplugged, or DeviceState is an adb state other than
+	// "device"); its guest streams fail until it comes back.
+	OwnerDeviceOffline
+	// OwnerDeviceOnline reports that a previously offline shared Device is
+	// usable again.
+	OwnerDeviceOnline
+	// OwnerRoomPublished reports that the room is listed in Team's room
+	// directory (see OwnerOptions.Publish).
+	OwnerRoomPublished
+	// OwnerPublishFailed reports that the transporter refused to list the
+	// room in Team's room directory (Err is the reason). The room is
+	// shared all the same, just not listed.
+	OwnerPublishFailed
+	// OwnerLeaseChanged reports that GuestClientId was granted a session
+	// lease, or that it was extended; Lease is what it has left (see
+	// OwnerOptions.Leases).
+	OwnerLeaseChanged
+	// OwnerLeaseEnded reports that GuestClientId's session lease ran out
+	// or, if Revoked, was revoked: its streams were closed, and it can't
+	// open new ones.
+	OwnerLeaseEnded
+	// OwnerJoinQueueChanged reports the client ids of the guests waiting,
+	// in order, in Queue, whenever that changes: guests asking to join
+	// while another one is in the room wait in line on the transporter,
+	// and the first one's join request comes once the room is free.
+	OwnerJoinQueueChanged
+	// OwnerGuestKicked reports that GuestClientId was removed from the
+	// room with Reason (see OwnerOptions.Kicker); an OwnerGuestLeft
+	// follows once the transporter took it out.
+	OwnerGuestKicked
+	// OwnerChatMessage reports a chat message, Text, that the guest
+	// GuestClientId sent at SentAt (see OwnerOptions.Chat).
+	OwnerChatMessage
 )
 
 // OwnerEvent is emitted by JoinAsRoomOwner to report state changes as they
@@ -29,6 +75,17 @@ type OwnerEvent struct {
 	GuestClientId  string
 	GuestPublicKey []byte
 	Accepted       bool
+	Rejoined       bool
+	Service        string
+	Device         string
+	DeviceState    string
+	Team           string
+	Lease          time.Duration
+	Revoked        bool
+	Queue          []string
+	Reason         string
+	Text           string
+	SentAt         time.Time
 	Err            error
 }
 
@@ -50,18 +107,20 @@ const (
 	// GuestJoinDecided reports whether the room owner accepted the join
 	// request. When Accepted, OwnerClientId and OwnerPublicKey identify the
 	// owner (see client/identity) so the guest can display a fingerprint of
-	// it.
+	// it, and Devices lists the serials of the devices the room shares.
 	GuestJoinDecided GuestEventKind = iota
-	// GuestProxyReady reports that the local AdbProxy is listening, with
-	// the port a real "adb connect" should target.
+	// GuestProxyReady reports that the local AdbProxy for Device is
+	// listening, with the port a real "adb connect" should target (the
+	// one picked, for port 0). It is emitted once per shared device.
 	GuestProxyReady
 	// GuestLocalAdbConnected reports that a local adb server connected to
-	// the proxy and completed its handshake.
+	// the proxy and completed its handshake. Several may be connected to
+	// the same proxy at once.
 	GuestLocalAdbConnected
-	// GuestRelayStopped reports that relaying for the current local
-	// connection stopped (Err is the reason; nil only on graceful
-	// shutdown). JoinAsGuest goes back to waiting for a new local
-	// connection afterward, unless ctx was cancelled.
+	// GuestRelayStopped reports that relaying for one of Device's local
+	// connections stopped (Err is the reason). There is one per
+	// GuestLocalAdbConnected; the proxy keeps accepting new local
+	// connections afterward, unless ctx was cancelled.
 	GuestRelayStopped
 	// GuestAdbConnected reports that JoinAsGuest ran "adb connect" against
 	// the local proxy automatically (Err is nil).
@@ -71,19 +130,80 @@ const (
 	GuestAdbConnectFailed
 	// GuestTransportLost reports that the connection to the transporter
 	// (and so to the room owner) was lost, either because the owner
-	// disconnected or the transporter itself went away. JoinAsGuest returns
-	// shortly after emitting this.
+	// disconnected or the transporter itself went away, for good: with
+	// GuestOptions.Reconnect, only once re-joining the room failed.
+	// JoinAsGuest returns shortly after emitting this.
 	GuestTransportLost
+	// GuestDeviceOffline reports that the owner's Device stopped being
+	// usable (DeviceState is its adb state on the owner's side). Its proxy
+	// presents it to the local adb server as offline until a matching
+	// GuestDeviceOnline.
+	GuestDeviceOffline
+	// GuestDeviceOnline reports that a previously offline Device is usable
+	// again.
+	GuestDeviceOnline
+	// GuestDeviceInfo reports what the owner says Device is (DeviceInfo),
+	// which its proxy presents to the local adb server from then on.
+	GuestDeviceInfo
+	// GuestReconnecting reports that the transporter connection was lost
+	// and, per GuestOptions.Reconnect, JoinAsGuest is about to make its
+	// Attempt'th try at redialing and re-joining the room (Err is why the
+	// previous one failed, if there was one). The proxies keep listening,
+	// presenting every device as offline meanwhile.
+	GuestReconnecting
+	// GuestReconnected reports that the room was re-joined over a new
+	// transporter connection, on which this client is ClientId.
+	GuestReconnected
+	// GuestLeaseChanged reports that the owner granted the session a
+	// lease, or extended it: Lease is what it has left, until
+	// LeaseExpiresAt.
+	GuestLeaseChanged
+	// GuestLeaseExpiring reports that the session lease runs out within
+	// LeaseWarning, at LeaseExpiresAt, unless the owner extends it.
+	GuestLeaseExpiring
+	// GuestLeaseEnded reports that the owner ended the session because its
+	// lease ran out or was revoked (Err is an *ErrLeaseEnded saying
+	// which). JoinAsGuest returns shortly after emitting this.
+	GuestLeaseEnded
+	// GuestQueued reports that another guest is in the room, and that the
+	// join request waits in the room's join queue, QueuePosition in line
+	// (1 being next). It is emitted again whenever that changes, until the
+	// owner gets to decide it (GuestJoinDecided).
+	GuestQueued
+	// GuestKicked reports that the owner removed the guest from the room,
+	// with Reason (Err is an *ErrKicked carrying it). JoinAsGuest returns
+	// shortly after emitting this.
+	GuestKicked
+	// GuestChatMessage reports a chat message, Text, that the owner
+	// OwnerClientId sent at SentAt (see GuestOptions.Chat).
+	GuestChatMessage
 )
 
 // GuestEvent is emitted by JoinAsGuest to report state changes as they
-// happen; the caller (e.g. a TUI) owns all presentation.
+// happen; the caller (e.g. a TUI) owns all presentation. Events about one
+// of the room's devices carry its serial in Device, and where its proxy
+// listens in LocalAddress (host:port, or "unix:<path>") and LocalPort
+// (empty for a unix socket). Until the proxy listens on a port 0 picked
+// for it, LocalPort is "0".
 type GuestEvent struct {
 	Kind           GuestEventKind
 	Accepted       bool
 	OwnerClientId  string
 	OwnerPublicKey []byte
+	Devices        []string
+	Device         string
+	DeviceState    string
+	DeviceInfo     adb.DeviceInfo
 	LocalPort      string
+	LocalAddress   string
+	ClientId       string
+	Attempt        int
+	QueuePosition  int
+	Lease          time.Duration
+	LeaseExpiresAt time.Time
+	Reason         string
+	Text           string
+	SentAt         time.Time
 	Err            error
 }
 
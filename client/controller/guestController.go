@@ -6,11 +6,93 @@ import (
 	"adb-remote.maci.team/client/relay"
 	"adb-remote.maci.team/client/transportLayer"
 	"adb-remote.maci.team/shared/protocol"
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// deviceInfoWait bounds how long JoinAsGuest waits for the owner to say
+// what its devices are before presenting them generically.
+const deviceInfoWait = 3 * time.Second
+
+// GuestOptions carries JoinAsGuest's optional behavior; with the zero value
+// no local adb server may connect to the proxies.
+type GuestOptions struct {
+	// AdbKeys are the adb keys of the local adb servers allowed to connect
+	// to the proxies, e.g. the guest's own (see adb.DefaultUserKeyPath).
+	AdbKeys *adb.AuthorizedKeys
+	// ApproveAdbKey, if non-nil, decides about a local adb server whose
+	// key AdbKeys doesn't hold; approved keys are added to AdbKeys.
+	ApproveAdbKey adb.KeyApproveFunc
+	// AdbTLSCertificate, if non-nil, has the proxies upgrade local adb
+	// connections to TLS with STLS, presenting it (see
+	// adb.LoadOrCreateProxyCertificate).
+	AdbTLSCertificate *tls.Certificate
+	// Bind is the host the proxies listen on, adb.DefaultProxyBind if
+	// empty; "0.0.0.0" exposes them to the network. "unix:<path>" has
+	// them listen on a unix socket instead, suffixed with "-1", "-2"...
+	// when the room shares several devices, and skips the automatic "adb
+	// connect", which adb can't do over one.
+	Bind string
+	// AllowedSources, if non-empty, are the only networks the proxies
+	// accept TCP connections from (see adb.ParseSourceNetworks).
+	AllowedSources []*net.IPNet
+	// Reconnect, if non-nil, has JoinAsGuest redial the transporter and
+	// re-join the room when the connection is lost, instead of returning,
+	// keeping the proxies and the local adb server's registration of them
+	// meanwhile.
+	Reconnect *ReconnectPolicy
+	// Chat, if non-nil, lets the caller chat with the room owner once
+	// accepted; messages from it are reported as GuestChatMessage events.
+	Chat *Chat
+	// OwnerPublicKey, if non-nil, is the identity the room must belong to,
+	// e.g. the one a room directory lists it under; JoinAsGuest returns an
+	// *ErrUnexpectedOwner, before relaying anything, if its owner presents
+	// another one.
+	OwnerPublicKey []byte
+}
+
+// proxyListenAddress returns the network and address the proxy for the
+// i'th of count devices listens on.
+func proxyListenAddress(bind string, firstPort int, i int, count int) (string, string) {
+	if path, ok := strings.CutPrefix(bind, "unix:"); ok {
+		if count > 1 {
+			path = fmt.Sprintf("%s-%d", path, i+1)
+		}
+		return "unix", path
+	}
+	if bind == "" {
+		bind = adb.DefaultProxyBind
+	}
+	port := 0
+	if firstPort != 0 {
+		port = firstPort + i
+	}
+	return "tcp", net.JoinHostPort(bind, strconv.Itoa(port))
+}
+
+// proxyEndpoint returns the port (empty for a unix socket) and address a
+// proxy listens on, or the ones it's configured with until it does.
+func proxyEndpoint(proxy adb.IAdbProxy, network string, address string) (string, string) {
+	if addr := proxy.Addr(); addr != nil {
+		network, address = addr.Network(), addr.String()
+	}
+	if network == "unix" {
+		return "", "unix:" + address
+	}
+	_, port, _ := net.SplitHostPort(address)
+	return port, address
+}
+
 type ErrJoinRoomDenied struct {
 	RoomId string
 }
@@ -19,38 +101,258 @@ func (e *ErrJoinRoomDenied) Error() string {
 	return fmt.Sprintf("join room request denied: %s", e.RoomId)
 }
 
-// JoinAsGuest joins roomId as a guest, then starts a local AdbProxy on
-// localPort and relays ADB protocol traffic between it and the room owner
-// until ctx is cancelled or the proxy fails to start. Once the proxy is
-// listening, it runs "adb connect" against it automatically (via
+// ErrUnexpectedOwner is returned by JoinAsGuest when RoomId's owner isn't
+// the identity GuestOptions.OwnerPublicKey expects, but Fingerprint.
+type ErrUnexpectedOwner struct {
+	RoomId      string
+	Fingerprint string
+}
+
+func (e *ErrUnexpectedOwner) Error() string {
+	return fmt.Sprintf("room %s belongs to %s, not to the identity expected", e.RoomId, e.Fingerprint)
+}
+
+// ErrRoomNotFound is returned when the transporter has no room with RoomId,
+// e.g. because its owner already closed it.
+type ErrRoomNotFound struct {
+	RoomId  string
+	Message string
+}
+
+func (e *ErrRoomNotFound) Error() string {
+	return fmt.Sprintf("join room error: %x -- %s", protocol.ErrorRoomNotFound, e.Message)
+}
+
+// JoinAsGuest joins roomId as a guest, waiting in the room's join queue
+// while another guest is in it, then starts a local AdbProxy per device the
+// room shares, on consecutive ports starting at localPort (free ones if
+// it's 0) of options.Bind (once the owner said what the devices are, so
+// they're presented as such), and relays ADB protocol traffic between each
+// and the room owner until ctx is cancelled or a proxy fails to start. Once
+// a proxy is listening, it runs "adb connect" against it automatically (via
 // smartSocket, the same smartsocket protocol the real adb CLI uses — no
 // external process involved) so the local adb server picks up the shared
 // device without the operator having to run it by hand, and "adb
 // disconnect" symmetrically as JoinAsGuest returns for any reason, so a
 // stale entry doesn't linger in `adb devices` after this process exits.
-// State changes are reported through onEvent; all presentation is the
-// caller's responsibility.
-func JoinAsGuest(ctx context.Context, client *transportLayer.Client, smartSocket adb.IAdbSmartSocket, guestIdentity *identity.Identity, roomId string, localPort string, onEvent GuestEventFunc) error {
-	if err := roomJoinStep(client, guestIdentity, roomId, onEvent); err != nil {
+// Only local adb servers that authenticate with one of options.AdbKeys, or
+// whose key options.ApproveAdbKey approves, can connect to the proxies,
+// over TLS if options.AdbTLSCertificate is set. A lost transporter
+// connection ends it too, unless options.Reconnect is set, in which case it
+// only does once re-joining the room failed; the owner ending the session
+// lease ends it as well, with an *ErrLeaseEnded, as does it removing the
+// guest from the room, with an *ErrKicked. State changes are reported
+// through onEvent; all presentation is the caller's responsibility.
+func JoinAsGuest(ctx context.Context, client *transportLayer.Client, smartSocket adb.IAdbSmartSocket, guestIdentity *identity.Identity, roomId string, localPort string, onEvent GuestEventFunc, options GuestOptions) error {
+	var ownerClientId string
+	var ownerPublicKey []byte
+	devices, features, err := roomJoinStep(client, guestIdentity, roomId, func(e GuestEvent) {
+		ownerClientId, ownerPublicKey = e.OwnerClientId, e.OwnerPublicKey
+		emitGuest(onEvent, e)
+	})
+	if err != nil {
 		return err
 	}
+	if options.OwnerPublicKey != nil && !bytes.Equal(ownerPublicKey, options.OwnerPublicKey) {
+		return &ErrUnexpectedOwner{RoomId: roomId, Fingerprint: identity.Fingerprint(ownerPublicKey)}
+	}
+	if len(devices) == 0 {
+		return fmt.Errorf("room %s doesn't share any device", roomId)
+	}
+	firstPort, err := strconv.Atoi(localPort)
+	if err != nil {
+		return fmt.Errorf("invalid local port %q: %w", localPort, err)
+	}
 
 	logger := client.Logger
-	proxy := adb.NewAdbProxy(localPort, logger)
-	if err := proxy.Start(roomId); err != nil {
-		return err
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The proxies exist before routing starts, for the owner's device
+	// details and states to land on, but only listen once those details
+	// arrived (or took too long), so the local adb server's first handshake
+	// already presents the real devices.
+	adbKeys := options.AdbKeys
+	if adbKeys == nil {
+		adbKeys, _ = adb.LoadAuthorizedKeys("")
+	}
+	proxies := make([]adb.IAdbProxy, len(devices))
+	endpoints := make([]func() (string, string), len(devices))
+	for i := range devices {
+		network, address := proxyListenAddress(options.Bind, firstPort, i, len(devices))
+		proxies[i] = adb.NewAdbProxy(network, address, logger)
+		proxies[i].SetAuthorization(adbKeys, options.ApproveAdbKey)
+		proxies[i].SetTLSCertificate(options.AdbTLSCertificate)
+		proxies[i].SetAllowedSources(options.AllowedSources)
+		endpoints[i] = func() (string, string) { return proxyEndpoint(proxies[i], network, address) }
+		if i < len(features) && features[i] != "" {
+			proxies[i].SetFeatures(strings.Split(features[i], ","))
+		}
+	}
+	infoReceived := make([]chan struct{}, len(devices))
+	for i := range infoReceived {
+		infoReceived[i] = make(chan struct{})
+	}
+	onDeviceInfo := func(device int, info adb.DeviceInfo) {
+		proxies[device].SetDeviceInfo(info)
+		select {
+		case <-infoReceived[device]:
+		default:
+			close(infoReceived[device])
+		}
+		port, address := endpoints[device]()
+		emitGuest(onEvent, GuestEvent{Kind: GuestDeviceInfo, Device: devices[device], DeviceInfo: info, LocalPort: port, LocalAddress: address})
+	}
+	// offline[i] tells device i's serveDevice to drop its current relay,
+	// so the local adb server reconnects and finds the device offline.
+	offline := make([]chan struct{}, len(devices))
+	for i := range offline {
+		offline[i] = make(chan struct{}, 1)
+	}
+	onDeviceState := func(device int, state string) {
+		port, address := endpoints[device]()
+		if state != adb.TypeDevice {
+			proxies[device].SetOnline(false)
+			select {
+			case offline[device] <- struct{}{}:
+			default:
+			}
+			emitGuest(onEvent, GuestEvent{Kind: GuestDeviceOffline, Device: devices[device], DeviceState: state, LocalPort: port, LocalAddress: address})
+			return
+		}
+		// A relay started from now on is for the device as it's back, so
+		// an offline signal nobody picked up yet no longer applies.
+		select {
+		case <-offline[device]:
+		default:
+		}
+		proxies[device].SetOnline(true)
+		emitGuest(onEvent, GuestEvent{Kind: GuestDeviceOnline, Device: devices[device], DeviceState: state, LocalPort: port, LocalAddress: address})
+	}
+
+	// The owner ending the session lease ends JoinAsGuest, like ctx would.
+	lease := &guestLease{onEvent: onEvent}
+	defer lease.stop()
+	onLease := func(state int, remaining time.Duration) {
+		if lease.update(state, remaining) {
+			cancel()
+		}
+	}
+
+	// The owner removing the guest from the room ends JoinAsGuest too.
+	// kicked is only set on the router's goroutine, and only read once it
+	// stopped.
+	var kicked error
+	onKick := func(reason string) {
+		kicked = &ErrKicked{Reason: reason}
+		emitGuest(onEvent, GuestEvent{Kind: GuestKicked, Reason: reason, Err: kicked})
+		cancel()
+	}
+
+	// The owner's identity is known from the join room response; a
+	// reconnection only gets back into the same owner's room.
+	if options.Chat != nil {
+		options.Chat.attach(client, guestIdentity, roomId, func(ownerClientId string, text string, sentAt time.Time) {
+			emitGuest(onEvent, GuestEvent{Kind: GuestChatMessage, OwnerClientId: ownerClientId, Text: text, SentAt: sentAt})
+		})
+		options.Chat.joined(ownerClientId, ownerPublicKey)
+		defer options.Chat.left()
+	}
+
+	// startRouting relays between the proxies and the current transporter
+	// connection until it's lost or ctx is cancelled, closing the returned
+	// channel then. The returned stop function, safe to call more than
+	// once, waits for every relay to wind down and returns why routing
+	// stopped. The proxies outlive it, for a reconnection's routing to
+	// pick up.
+	startRouting := func() (<-chan struct{}, func() error) {
+		routeCtx, cancelRoute := context.WithCancel(ctx)
+		router := relay.NewDeviceRouter(client, len(devices), logger)
+		router.SetDeviceInfoHandler(onDeviceInfo)
+		router.SetDeviceStateHandler(onDeviceState)
+		router.SetSessionLeaseHandler(onLease)
+		router.SetKickHandler(onKick)
+		router.SetChatHandler(options.Chat.receive)
+		var relays sync.WaitGroup
+		for i, device := range devices {
+			relays.Add(1)
+			go func() {
+				defer relays.Done()
+				serveDevice(routeCtx, router.Device(i), proxies[i], offline[i], i, device, endpoints[i], logger, onEvent)
+			}()
+		}
+		var routerErr error
+		routerDone := make(chan struct{})
+		go func() {
+			routerErr = router.Run(routeCtx)
+			cancelRoute()
+			close(routerDone)
+		}()
+		return routerDone, func() error {
+			cancelRoute()
+			<-routerDone
+			relays.Wait()
+			return routerErr
+		}
+	}
+	routerDone, stopRouting := startRouting()
+	// The deferred call covers returning early below; stopRouting changes
+	// with every reconnection.
+	defer func() { _ = stopRouting() }()
+	// lost reports whether there's no point in going on setting up: ctx is
+	// cancelled, or the connection is lost and won't be reconnected.
+	lost := func() bool {
+		select {
+		case <-routerDone:
+			return options.Reconnect == nil || ctx.Err() != nil
+		default:
+			return false
+		}
 	}
-	defer proxy.Stop()
 
-	emitGuest(onEvent, GuestEvent{Kind: GuestProxyReady, LocalPort: localPort})
+	deadline := time.After(deviceInfoWait)
+waitForInfo:
+	for i, received := range infoReceived {
+		select {
+		case <-received:
+		case <-deadline:
+			logger.Info(fmt.Sprintf("No details received for %s, presenting it generically", devices[i]))
+			break waitForInfo
+		case <-routerDone:
+			break waitForInfo
+		}
+	}
+
+	for i, device := range devices {
+		if lost() {
+			break
+		}
+		// With several devices, each proxy needs a distinct name or the
+		// local adb server would show them all as the same device.
+		name := roomId
+		if len(devices) > 1 {
+			name = fmt.Sprintf("%s-%d", roomId, i+1)
+		}
+		proxy := proxies[i]
+		if err := proxy.Start(name); err != nil {
+			_, address := endpoints[i]()
+			return fmt.Errorf("failed to start the proxy for %s on %s: %w", device, address, err)
+		}
+		defer proxy.Stop()
+		port, address := endpoints[i]()
+		emitGuest(onEvent, GuestEvent{Kind: GuestProxyReady, Device: device, LocalPort: port, LocalAddress: address})
 
-	proxyAddress := fmt.Sprintf("127.0.0.1:%s", localPort)
-	if err := smartSocket.Connect(proxyAddress); err != nil {
-		logger.Error(fmt.Sprintf("Automatic \"adb connect %s\" failed: %s", proxyAddress, err))
-		emitGuest(onEvent, GuestEvent{Kind: GuestAdbConnectFailed, Err: err})
-	} else {
+		if port == "" {
+			continue
+		}
+		proxyAddress := connectAddress(smartSocket, address, logger)
+		if err := smartSocket.Connect(proxyAddress); err != nil {
+			logger.Error(fmt.Sprintf("Automatic \"adb connect %s\" failed: %s", proxyAddress, err))
+			emitGuest(onEvent, GuestEvent{Kind: GuestAdbConnectFailed, Device: device, LocalPort: port, LocalAddress: address, Err: err})
+			continue
+		}
 		logger.Info(fmt.Sprintf("Automatic \"adb connect %s\" succeeded", proxyAddress))
-		emitGuest(onEvent, GuestEvent{Kind: GuestAdbConnected})
+		emitGuest(onEvent, GuestEvent{Kind: GuestAdbConnected, Device: device, LocalPort: port, LocalAddress: address})
 		defer func() {
 			if err := smartSocket.Disconnect(proxyAddress); err != nil {
 				logger.Error(fmt.Sprintf("Automatic \"adb disconnect %s\" failed: %s", proxyAddress, err))
@@ -60,77 +362,192 @@ func JoinAsGuest(ctx context.Context, client *transportLayer.Client, smartSocket
 		}()
 	}
 
+	for {
+		<-routerDone
+		routerErr := stopRouting()
+		if err := lease.stop(); err != nil {
+			return err
+		}
+		if kicked != nil {
+			return kicked
+		}
+		if !errors.Is(routerErr, relay.ErrTransportClosed) || ctx.Err() != nil {
+			return routerErr
+		}
+		logger.Info("Transporter connection lost")
+		if options.Reconnect == nil {
+			emitGuest(onEvent, GuestEvent{Kind: GuestTransportLost})
+			return routerErr
+		}
+		// The local adb server keeps the devices registered, but sees
+		// them offline until the room is re-joined.
+		for _, proxy := range proxies {
+			proxy.SetOnline(false)
+		}
+		if err := rejoinRoom(ctx, client, guestIdentity, roomId, ownerPublicKey, len(devices), *options.Reconnect, onEvent); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			emitGuest(onEvent, GuestEvent{Kind: GuestTransportLost, Err: err})
+			return fmt.Errorf("%w; re-joining room %s failed: %w", routerErr, roomId, err)
+		}
+		for _, proxy := range proxies {
+			proxy.SetOnline(true)
+		}
+		routerDone, stopRouting = startRouting()
+	}
+}
+
+// connectAddress returns the address the adb server should "adb connect"
+// to reach a proxy listening on address. A proxy listening on every
+// interface can be reached by an adb server on another machine too, just
+// not on that machine's loopback.
+func connectAddress(smartSocket adb.IAdbSmartSocket, address string, logger *slog.Logger) string {
+	host, port, _ := net.SplitHostPort(address)
+	if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+		return address
+	}
+	reachableHost, err := smartSocket.ReachableHost()
+	if err != nil {
+		logger.Error(fmt.Sprintf("Can't tell how the adb server reaches this machine, assuming it runs here: %s", err))
+		reachableHost = "127.0.0.1"
+	}
+	return net.JoinHostPort(reachableHost, port)
+}
+
+// serveDevice relays every local ADB connection proxy hands over for the
+// room's device'th device, all of them at once over the one room link (see
+// relay.GuestMultiplexer), until ctx is cancelled or the transport is lost.
+// A signal on offline drops the connections open at the time.
+func serveDevice(ctx context.Context, transport relay.TransportClient, proxy adb.IAdbProxy, offline <-chan struct{}, device int, serial string, endpoint func() (string, string), logger *slog.Logger, onEvent GuestEventFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	multiplexer := relay.NewGuestMultiplexer(transport, device, logger)
+	var multiplexerErr error
+	multiplexerDone := make(chan struct{})
+	go func() {
+		multiplexerErr = multiplexer.Run(ctx)
+		cancel()
+		close(multiplexerDone)
+	}()
+
+	var connections sync.WaitGroup
+	defer func() {
+		cancel()
+		<-multiplexerDone
+		connections.Wait()
+	}()
 	for {
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
-		case container, ok := <-client.Messages():
-			// While idle (no active relay), nothing should legitimately
-			// arrive here — the guest is always the one opening ADB
-			// streams. This case exists to notice the channel closing,
-			// meaning the connection to the transporter (and so to the
-			// room owner) is gone; anything else received is logged and
-			// discarded.
-			if !ok {
-				logger.Info("Transporter connection lost while idle")
-				emitGuest(onEvent, GuestEvent{Kind: GuestTransportLost})
-				return relay.ErrTransportClosed
-			}
-			logger.Info("Ignoring unexpected message while idle")
-			_ = container.Dispose()
+			return
+		case <-offline:
+			logger.Info(fmt.Sprintf("%s went offline, dropping its local ADB connections", serial))
+			multiplexer.CloseConnections()
 		case conn := <-proxy.Connections():
-			logger.Info("Local ADB server connected, starting the relay")
-			emitGuest(onEvent, GuestEvent{Kind: GuestLocalAdbConnected})
-			err := relay.Run(ctx, conn, client, logger)
-			logger.Info(fmt.Sprintf("Relay stopped: %s", err))
-			emitGuest(onEvent, GuestEvent{Kind: GuestRelayStopped, Err: err})
-			if errors.Is(err, relay.ErrTransportClosed) {
-				emitGuest(onEvent, GuestEvent{Kind: GuestTransportLost})
-				return err
-			}
+			logger.Info(fmt.Sprintf("Local ADB server connected for %s, starting the relay", serial))
+			port, address := endpoint()
+			emitGuest(onEvent, GuestEvent{Kind: GuestLocalAdbConnected, Device: serial, LocalPort: port, LocalAddress: address})
+			connections.Add(1)
+			go func() {
+				defer connections.Done()
+				err := multiplexer.Serve(ctx, conn)
+				// A connection cut short by the transport going away
+				// reports that, rather than its closed socket.
+				select {
+				case <-multiplexerDone:
+					if errors.Is(multiplexerErr, relay.ErrTransportClosed) {
+						err = multiplexerErr
+					}
+				default:
+				}
+				logger.Info(fmt.Sprintf("Relay for %s stopped: %s", serial, err))
+				emitGuest(onEvent, GuestEvent{Kind: GuestRelayStopped, Device: serial, LocalPort: port, LocalAddress: address, Err: err})
+			}()
 		}
 	}
 }
 
-func roomJoinStep(client *transportLayer.Client, guestIdentity *identity.Identity, roomId string, onEvent GuestEventFunc) error {
+// JoinRoom asks to join roomId as a guest and waits for the owner's
+// decision, without starting an AdbProxy: for callers that talk to the
+// shared devices directly over client instead (see client/adbclient).
+// Returns the serials of the devices the room shares, or an
+// *ErrJoinRoomDenied if the owner declined (*ErrRoomNotFound if there's no
+// such room).
+func JoinRoom(client *transportLayer.Client, guestIdentity *identity.Identity, roomId string, onEvent GuestEventFunc) ([]string, error) {
+	devices, _, err := roomJoinStep(client, guestIdentity, roomId, onEvent)
+	return devices, err
+}
+
+// roomJoinStep returns the serials of the devices the room shares, and each
+// one's comma-separated adb features (empty when the owner doesn't know
+// them).
+func roomJoinStep(client *transportLayer.Client, guestIdentity *identity.Identity, roomId string, onEvent GuestEventFunc) ([]string, []string, error) {
 	logger := client.Logger
 	logger.Info(fmt.Sprintf("Joining room %s", roomId))
-	if err := client.SendJoinRoom(roomId, guestIdentity.PublicKey); err != nil {
+	signature := ed25519.Sign(guestIdentity.PrivateKey, protocol.RoomJoinMessage(roomId, client.ClientId()))
+	if err := client.SendJoinRoom(roomId, guestIdentity.PublicKey, signature); err != nil {
 		logger.Error(fmt.Sprintf("Failed to join room: %s, error: %s", roomId, err))
-		return err
-	}
-	container, ok := <-client.Messages()
-	if !ok {
-		return relay.ErrTransportClosed
+		return nil, nil, err
 	}
-	defer container.Dispose()
-	message, err := container.Data()
+	container, message, err := awaitJoinRoomResponse(client, onEvent)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	defer container.Dispose()
 	if message.IsError() {
 		payload, err := message.GetErrorPayload()
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 		logger.Error(fmt.Sprintf("Join room error: %x -- %s", payload.ErrorCode, payload.ErrorMessage))
-		return fmt.Errorf("join room error: %x -- %s", payload.ErrorCode, payload.ErrorMessage)
+		if payload.ErrorCode == protocol.ErrorRoomNotFound {
+			return nil, nil, &ErrRoomNotFound{RoomId: roomId, Message: payload.ErrorMessage}
+		}
+		return nil, nil, fmt.Errorf("join room error: %x -- %s", payload.ErrorCode, payload.ErrorMessage)
 	}
 	if err := protocol.ExpectCommand(message, protocol.CommandJoinRoom|protocol.CommandResponseMask); err != nil {
 		logger.Error(fmt.Sprintf("Unexpected message (expected: JoinRoomResponse): %x", message.Command()))
-		return err
+		return nil, nil, err
 	}
 	payload, err := message.GetPayloadConnectRoomResponse()
 	if err != nil {
 		logger.Error(fmt.Sprintf("Invalid join room response payload: %s", err))
-		return err
+		return nil, nil, err
 	}
 	accepted := payload.Accepted != 0
-	emitGuest(onEvent, GuestEvent{Kind: GuestJoinDecided, Accepted: accepted, OwnerClientId: payload.ClientId, OwnerPublicKey: payload.PublicKey})
+	emitGuest(onEvent, GuestEvent{Kind: GuestJoinDecided, Accepted: accepted, OwnerClientId: payload.ClientId, OwnerPublicKey: payload.PublicKey, Devices: payload.Devices})
 	if !accepted {
 		logger.Error(fmt.Sprintf("Join room declined, roomId: %s", roomId))
-		return &ErrJoinRoomDenied{RoomId: roomId}
+		return nil, nil, &ErrJoinRoomDenied{RoomId: roomId}
+	}
+	logger.Info(fmt.Sprintf("Joined room: %s, devices: %s", roomId, strings.Join(payload.Devices, ", ")))
+	return payload.Devices, payload.Features, nil
+}
+
+// awaitJoinRoomResponse returns the answer to a join room request,
+// reporting the guest's place in the room's join queue while another guest
+// is in the room. The caller disposes of the container.
+func awaitJoinRoomResponse(client *transportLayer.Client, onEvent GuestEventFunc) (*transportLayer.MessageContainer, *protocol.TransporterMessage, error) {
+	for {
+		container, ok := <-client.Messages()
+		if !ok {
+			return nil, nil, relay.ErrTransportClosed
+		}
+		message, err := container.Data()
+		if err != nil {
+			_ = container.Dispose()
+			return nil, nil, err
+		}
+		if message.Command() != protocol.CommandQueuePosition {
+			return container, message, nil
+		}
+		payload, err := message.GetPayloadQueuePosition()
+		_ = container.Dispose()
+		if err != nil {
+			return nil, nil, err
+		}
+		client.Logger.Info(fmt.Sprintf("Waiting to join the room, number %d in line", payload.Position))
+		emitGuest(onEvent, GuestEvent{Kind: GuestQueued, QueuePosition: payload.Position})
 	}
-	logger.Info(fmt.Sprintf("Joined room: %s", roomId))
-	return nil
 }
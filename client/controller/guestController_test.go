@@ -8,8 +8,12 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -26,6 +30,11 @@ func testIdentity(t *testing.T) *identity.Identity {
 }
 
 func respondToJoinRoom(t *testing.T, server net.Conn, accepted int) {
+	t.Helper()
+	respondToJoinRoomWithDevices(t, server, accepted, []string{"emulator-5554"})
+}
+
+func respondToJoinRoomWithDevices(t *testing.T, server net.Conn, accepted int, devices []string) {
 	t.Helper()
 	request := readMessage(t, server)
 	if request.Command() != protocol.CommandJoinRoom {
@@ -34,26 +43,55 @@ func respondToJoinRoom(t *testing.T, server net.Conn, accepted int) {
 
 	response := protocol.CreateTransporterMessage()
 	response.SetResponseCommand(protocol.CommandJoinRoom)
-	if err := response.SetPayloadConnectRoomResult(&protocol.TransporterMessagePayloadConnectRoomResult{Accepted: accepted}); err != nil {
+	features := make([]string, len(devices))
+	for i := range features {
+		features[i] = "shell_v2,cmd"
+	}
+	if err := response.SetPayloadConnectRoomResult(&protocol.TransporterMessagePayloadConnectRoomResult{Accepted: accepted, Devices: devices, Features: features}); err != nil {
 		t.Fatalf("SetPayloadConnectRoomResult failed: %s", err)
 	}
 	if err := response.Write(server); err != nil {
 		t.Fatalf("failed to write the response: %s", err)
 	}
+	if accepted == 0 {
+		return
+	}
+	// Like a real owner, follow up with every device's details.
+	for i, device := range devices {
+		info := protocol.CreateTransporterMessage()
+		info.SetDirectCommand(protocol.CommandDeviceInfo)
+		if err := info.SetPayloadDeviceInfo(&protocol.TransporterMessagePayloadDeviceInfo{Device: i, Model: "Model_" + device}); err != nil {
+			t.Fatalf("SetPayloadDeviceInfo failed: %s", err)
+		}
+		if err := info.Write(server); err != nil {
+			t.Fatalf("failed to write the device info: %s", err)
+		}
+	}
 }
 
 func TestRoomJoinStepAccepted(t *testing.T) {
 	client, server := newConnectedClient(t)
 	guestIdentity := testIdentity(t)
 
+	var devices, features []string
 	done := make(chan error, 1)
-	go func() { done <- roomJoinStep(client, guestIdentity, "ROOM1", nil) }()
+	go func() {
+		var err error
+		devices, features, err = roomJoinStep(client, guestIdentity, "ROOM1", nil)
+		done <- err
+	}()
 
-	respondToJoinRoom(t, server, 1)
+	respondToJoinRoomWithDevices(t, server, 1, []string{"emulator-5554", "R58M123"})
 
 	if err := <-done; err != nil {
 		t.Fatalf("roomJoinStep failed: %s", err)
 	}
+	if len(devices) != 2 || devices[0] != "emulator-5554" || devices[1] != "R58M123" {
+		t.Fatalf("expected the room's devices, got %v", devices)
+	}
+	if len(features) != 2 || features[0] != "shell_v2,cmd" {
+		t.Fatalf("expected each device's features, got %q", features)
+	}
 }
 
 func TestRoomJoinStepDenied(t *testing.T) {
@@ -61,7 +99,10 @@ func TestRoomJoinStepDenied(t *testing.T) {
 	guestIdentity := testIdentity(t)
 
 	done := make(chan error, 1)
-	go func() { done <- roomJoinStep(client, guestIdentity, "ROOM1", nil) }()
+	go func() {
+		_, _, err := roomJoinStep(client, guestIdentity, "ROOM1", nil)
+		done <- err
+	}()
 
 	respondToJoinRoom(t, server, 0)
 
@@ -75,6 +116,48 @@ func TestRoomJoinStepDenied(t *testing.T) {
 	}
 }
 
+func sendQueuePosition(t *testing.T, server net.Conn, position int) {
+	t.Helper()
+	message := protocol.CreateTransporterMessage()
+	message.SetDirectCommand(protocol.CommandQueuePosition)
+	if err := message.SetPayloadQueuePosition(&protocol.TransporterMessagePayloadQueuePosition{Position: position}); err != nil {
+		t.Fatalf("SetPayloadQueuePosition failed: %s", err)
+	}
+	if err := message.Write(server); err != nil {
+		t.Fatalf("failed to write the queue position: %s", err)
+	}
+}
+
+// TestRoomJoinStepWaitsInTheJoinQueue checks that the guest reports its
+// place in a busy room's join queue while it waits for the owner's
+// decision.
+func TestRoomJoinStepWaitsInTheJoinQueue(t *testing.T) {
+	client, server := newConnectedClient(t)
+	events := make(chan GuestEvent, 10)
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := roomJoinStep(client, testIdentity(t), "ROOM1", func(e GuestEvent) { events <- e })
+		done <- err
+	}()
+
+	sendQueuePosition(t, server, 2)
+	sendQueuePosition(t, server, 1)
+	respondToJoinRoom(t, server, 1)
+
+	if err := <-done; err != nil {
+		t.Fatalf("roomJoinStep failed: %s", err)
+	}
+	for _, position := range []int{2, 1} {
+		if event := <-events; event.Kind != GuestQueued || event.QueuePosition != position {
+			t.Fatalf("expected GuestQueued at position %d, got %+v", position, event)
+		}
+	}
+	if event := <-events; event.Kind != GuestJoinDecided || !event.Accepted {
+		t.Fatalf("expected an accepted GuestJoinDecided, got %+v", event)
+	}
+}
+
 // TestRoomJoinStepSendsPublicKey verifies the guest's identity public key
 // actually goes out on the wire with the join request, since that's what
 // lets the room owner display and verify its fingerprint before accepting.
@@ -83,7 +166,10 @@ func TestRoomJoinStepSendsPublicKey(t *testing.T) {
 	guestIdentity := testIdentity(t)
 
 	done := make(chan error, 1)
-	go func() { done <- roomJoinStep(client, guestIdentity, "ROOM1", nil) }()
+	go func() {
+		_, _, err := roomJoinStep(client, guestIdentity, "ROOM1", nil)
+		done <- err
+	}()
 
 	request := readMessage(t, server)
 	if request.Command() != protocol.CommandJoinRoom {
@@ -122,7 +208,10 @@ func TestRoomJoinStepReportsTransporterError(t *testing.T) {
 	guestIdentity := testIdentity(t)
 
 	done := make(chan error, 1)
-	go func() { done <- roomJoinStep(client, guestIdentity, "ROOM1", nil) }()
+	go func() {
+		_, _, err := roomJoinStep(client, guestIdentity, "ROOM1", nil)
+		done <- err
+	}()
 
 	request := readMessage(t, server)
 	if request.Command() != protocol.CommandJoinRoom {
@@ -151,6 +240,10 @@ func TestRoomJoinStepReportsTransporterError(t *testing.T) {
 	if !strings.Contains(err.Error(), "room not found") {
 		t.Fatalf("expected the error to surface the server's message, got: %s", err)
 	}
+	var notFound *ErrRoomNotFound
+	if !errors.As(err, &notFound) || notFound.RoomId != "ROOM1" {
+		t.Fatalf("expected an ErrRoomNotFound for ROOM1, got %v", err)
+	}
 }
 
 func freeLocalPort(t *testing.T) string {
@@ -164,6 +257,29 @@ func freeLocalPort(t *testing.T) string {
 	return port
 }
 
+// freeConsecutiveLocalPorts returns the first of count consecutive ports
+// that are currently free.
+func freeConsecutiveLocalPorts(t *testing.T, count int) int {
+	t.Helper()
+	for attempt := 0; attempt < 20; attempt++ {
+		first, _ := strconv.Atoi(freeLocalPort(t))
+		free := true
+		for i := 1; i < count && free; i++ {
+			listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", first+i))
+			if err != nil {
+				free = false
+				continue
+			}
+			_ = listener.Close()
+		}
+		if free {
+			return first
+		}
+	}
+	t.Fatalf("failed to find %d consecutive free ports", count)
+	return 0
+}
+
 // fakeGuestSmartSocket records Connect/Disconnect calls so tests can assert
 // JoinAsGuest drives the automatic "adb connect"/"adb disconnect" lifecycle
 // correctly.
@@ -175,6 +291,15 @@ type fakeGuestSmartSocket struct {
 	disconnectCalls []string
 	connectErr      error
 	disconnectErr   error
+	// reachableHost is what ReachableHost reports; 127.0.0.1 if unset.
+	reachableHost string
+}
+
+func (f *fakeGuestSmartSocket) ReachableHost() (string, error) {
+	if f.reachableHost == "" {
+		return "127.0.0.1", nil
+	}
+	return f.reachableHost, nil
 }
 
 func (f *fakeGuestSmartSocket) Connect(targetSerial string) error {
@@ -216,7 +341,8 @@ func TestJoinAsGuestRelaysAdbTraffic(t *testing.T) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	done := make(chan error, 1)
-	go func() { done <- JoinAsGuest(ctx, client, smartSocket, guestIdentity, "ROOM1", port, onEvent) }()
+	options := testGuestOptions(t)
+	go func() { done <- JoinAsGuest(ctx, client, smartSocket, guestIdentity, "ROOM1", port, onEvent, options) }()
 
 	respondToJoinRoom(t, server, 1)
 
@@ -237,17 +363,9 @@ func TestJoinAsGuestRelaysAdbTraffic(t *testing.T) {
 	}
 	defer localConn.Close()
 
-	cnxnRequest := adb.CreateMessage()
-	if err := cnxnRequest.Set(adb.CommandConnect, 1, adb.MaxPayloadLength, []byte("host::")); err != nil {
-		t.Fatalf("Set failed: %s", err)
-	}
-	if err := cnxnRequest.Write(localConn); err != nil {
-		t.Fatalf("failed to write the CNXN request: %s", err)
-	}
-	cnxnResponse := adb.CreateMessage()
 	_ = localConn.SetReadDeadline(time.Now().Add(2 * time.Second))
-	if err := cnxnResponse.Read(localConn); err != nil {
-		t.Fatalf("failed to read the CNXN response: %s", err)
+	if _, err := adbHandshake(localConn); err != nil {
+		t.Fatalf("the CNXN handshake failed: %s", err)
 	}
 
 	// Local -> remote: the local side writes an OPEN, the transporter must
@@ -264,7 +382,11 @@ func TestJoinAsGuestRelaysAdbTraffic(t *testing.T) {
 	if forwarded.Command() != protocol.CommandAdbTransport {
 		t.Fatalf("expected command %x, got %x", protocol.CommandAdbTransport, forwarded.Command())
 	}
-	decoded, err := adb.DecodeMessage(forwarded.Payload())
+	payload, err := forwarded.GetPayloadAdbTransport()
+	if err != nil {
+		t.Fatalf("GetPayloadAdbTransport failed: %s", err)
+	}
+	decoded, err := adb.DecodeMessage(payload.Message)
 	if err != nil {
 		t.Fatalf("DecodeMessage failed: %s", err)
 	}
@@ -272,16 +394,17 @@ func TestJoinAsGuestRelaysAdbTraffic(t *testing.T) {
 		t.Fatalf("unexpected forwarded message: %+v", decoded)
 	}
 
-	// Remote -> local: the transporter sends an OKAY, the local ADB server
-	// must receive it verbatim.
+	// Remote -> local: the owner accepts the OPEN under the id it was
+	// forwarded with, and the local ADB server must receive the OKAY for
+	// its own stream id.
 	okayMessage := adb.CreateMessage()
-	if err := okayMessage.Set(adb.CommandOkay, 7, 0, nil); err != nil {
+	if err := okayMessage.Set(adb.CommandOkay, 9, decoded.Arg1(), nil); err != nil {
 		t.Fatalf("Set failed: %s", err)
 	}
 	wrapper := protocol.CreateTransporterMessage()
 	wrapper.SetDirectCommand(protocol.CommandAdbTransport)
-	if err := wrapper.SetRawPayload(okayMessage.Bytes()); err != nil {
-		t.Fatalf("SetRawPayload failed: %s", err)
+	if err := wrapper.SetPayloadAdbTransport(&protocol.TransporterMessagePayloadAdbTransport{Message: okayMessage.Bytes()}); err != nil {
+		t.Fatalf("SetPayloadAdbTransport failed: %s", err)
 	}
 	if err := wrapper.Write(server); err != nil {
 		t.Fatalf("failed to write the wrapped OKAY: %s", err)
@@ -292,8 +415,8 @@ func TestJoinAsGuestRelaysAdbTraffic(t *testing.T) {
 	if err := received.Read(localConn); err != nil {
 		t.Fatalf("failed to read the relayed OKAY: %s", err)
 	}
-	if received.Command() != adb.CommandOkay {
-		t.Fatalf("expected command %x, got %x", adb.CommandOkay, received.Command())
+	if received.Command() != adb.CommandOkay || received.Arg1() != 9 || received.Arg2() != 7 {
+		t.Fatalf("expected OKAY(9, 7), got %s(%d, %d)", received.CommandString(), received.Arg1(), received.Arg2())
 	}
 
 	eventsMu.Lock()
@@ -302,7 +425,7 @@ func TestJoinAsGuestRelaysAdbTraffic(t *testing.T) {
 		gotKinds[i] = e.Kind
 	}
 	eventsMu.Unlock()
-	wantKinds := []GuestEventKind{GuestJoinDecided, GuestProxyReady, GuestAdbConnected, GuestLocalAdbConnected}
+	wantKinds := []GuestEventKind{GuestJoinDecided, GuestDeviceInfo, GuestProxyReady, GuestAdbConnected, GuestLocalAdbConnected}
 	if len(gotKinds) < len(wantKinds) {
 		t.Fatalf("expected at least %v, got %v", wantKinds, gotKinds)
 	}
@@ -360,7 +483,8 @@ func TestJoinAsGuestStopsWhenTransporterDisconnectsWhileIdle(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	done := make(chan error, 1)
-	go func() { done <- JoinAsGuest(ctx, client, smartSocket, guestIdentity, "ROOM1", port, onEvent) }()
+	options := testGuestOptions(t)
+	go func() { done <- JoinAsGuest(ctx, client, smartSocket, guestIdentity, "ROOM1", port, onEvent, options) }()
 
 	respondToJoinRoom(t, server, 1)
 
@@ -390,6 +514,36 @@ func TestJoinAsGuestStopsWhenTransporterDisconnectsWhileIdle(t *testing.T) {
 	}
 }
 
+// TestJoinAsGuestRefusesAnUnexpectedOwner verifies that a room picked
+// from a directory isn't joined when someone else turns out to own it.
+func TestJoinAsGuestRefusesAnUnexpectedOwner(t *testing.T) {
+	client, server := newConnectedClient(t)
+	smartSocket := &fakeGuestSmartSocket{}
+	options := testGuestOptions(t)
+	options.OwnerPublicKey = testIdentity(t).PublicKey
+
+	done := make(chan error, 1)
+	go func() {
+		done <- JoinAsGuest(context.Background(), client, smartSocket, testIdentity(t), "ROOM1", freeLocalPort(t), nil, options)
+	}()
+
+	// The owner answering presents no key, let alone the one listed.
+	respondToJoinRoom(t, server, 1)
+
+	select {
+	case err := <-done:
+		var unexpectedOwner *ErrUnexpectedOwner
+		if !errors.As(err, &unexpectedOwner) || unexpectedOwner.RoomId != "ROOM1" {
+			t.Fatalf("expected an *ErrUnexpectedOwner for ROOM1, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("JoinAsGuest did not refuse the room")
+	}
+	if connect, _ := smartSocket.calls(); len(connect) != 0 {
+		t.Fatalf("expected no adb connect, got %v", connect)
+	}
+}
+
 // TestJoinAsGuestReportsAutomaticAdbConnectFailure verifies that a failure
 // running the automatic "adb connect" is reported as an event (so the
 // operator can fall back to running it manually) rather than aborting
@@ -408,7 +562,8 @@ func TestJoinAsGuestReportsAutomaticAdbConnectFailure(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	done := make(chan error, 1)
-	go func() { done <- JoinAsGuest(ctx, client, smartSocket, guestIdentity, "ROOM1", port, onEvent) }()
+	options := testGuestOptions(t)
+	go func() { done <- JoinAsGuest(ctx, client, smartSocket, guestIdentity, "ROOM1", port, onEvent, options) }()
 
 	respondToJoinRoom(t, server, 1)
 
@@ -426,3 +581,421 @@ func TestJoinAsGuestReportsAutomaticAdbConnectFailure(t *testing.T) {
 		}
 	}
 }
+
+// TestJoinAsGuestConnectsRemoteAdbServerToReachableHost verifies an adb
+// server on another machine is told to connect to this machine's address,
+// not to its own loopback, when the proxies listen on every interface.
+func TestJoinAsGuestConnectsRemoteAdbServerToReachableHost(t *testing.T) {
+	client, server := newConnectedClient(t)
+	port := freeLocalPort(t)
+	smartSocket := &fakeGuestSmartSocket{reachableHost: "192.0.2.10"}
+	guestIdentity := testIdentity(t)
+
+	events := make(chan GuestEvent, 10)
+	onEvent := func(e GuestEvent) { events <- e }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	options := testGuestOptions(t)
+	options.Bind = "0.0.0.0"
+	go func() { done <- JoinAsGuest(ctx, client, smartSocket, guestIdentity, "ROOM1", port, onEvent, options) }()
+
+	respondToJoinRoom(t, server, 1)
+
+	for {
+		select {
+		case e := <-events:
+			if e.Kind != GuestAdbConnected {
+				continue
+			}
+			connectCalls, _ := smartSocket.calls()
+			wantAddress := "192.0.2.10:" + port
+			if len(connectCalls) != 1 || connectCalls[0] != wantAddress {
+				t.Fatalf("expected exactly one Connect(%q) call, got %v", wantAddress, connectCalls)
+			}
+			return
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for GuestAdbConnected")
+		}
+	}
+}
+
+// TestJoinAsGuestStartsOneProxyPerDevice verifies a room sharing several
+// devices gets one proxy per device on consecutive ports, and that each
+// proxy's traffic is tagged with, and only receives, its own device's
+// messages.
+func TestJoinAsGuestStartsOneProxyPerDevice(t *testing.T) {
+	client, server := newConnectedClient(t)
+	firstPort := freeConsecutiveLocalPorts(t, 2)
+	smartSocket := &fakeGuestSmartSocket{}
+	guestIdentity := testIdentity(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	options := testGuestOptions(t)
+	go func() {
+		done <- JoinAsGuest(ctx, client, smartSocket, guestIdentity, "ROOM1", strconv.Itoa(firstPort), nil, options)
+	}()
+
+	respondToJoinRoomWithDevices(t, server, 1, []string{"emulator-5554", "R58M123"})
+
+	// Dial the second device's proxy: its OPEN must reach the owner tagged
+	// as device 1.
+	var localConn net.Conn
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", firstPort+1))
+		if err == nil {
+			localConn = conn
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if localConn == nil {
+		t.Fatalf("failed to dial the second device's proxy")
+	}
+	defer localConn.Close()
+
+	_ = localConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	cnxnResponse, err := adbHandshake(localConn)
+	if err != nil {
+		t.Fatalf("the CNXN handshake failed: %s", err)
+	}
+	// The owner's details arrived before the proxy started listening, so
+	// even the first handshake presents the real device.
+	if banner := cnxnResponse.DataString(); !strings.Contains(banner, "ro.product.model=Model_R58M123;") {
+		t.Fatalf("expected the banner to present R58M123's model, got %q", banner)
+	}
+
+	openMessage := adb.CreateMessage()
+	if err := openMessage.Set(adb.CommandOpen, 7, 0, []byte("shell:")); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	if err := openMessage.Write(localConn); err != nil {
+		t.Fatalf("failed to write the OPEN message: %s", err)
+	}
+	forwarded := readMessage(t, server)
+	payload, err := forwarded.GetPayloadAdbTransport()
+	if err != nil {
+		t.Fatalf("GetPayloadAdbTransport failed: %s", err)
+	}
+	if payload.Device != 1 {
+		t.Fatalf("expected the OPEN to be tagged as device 1, got %d", payload.Device)
+	}
+	forwardedOpen, err := adb.DecodeMessage(payload.Message)
+	if err != nil {
+		t.Fatalf("DecodeMessage failed: %s", err)
+	}
+
+	// A message for device 0 must not reach device 1's connection, while
+	// the one for device 1 that follows it must.
+	for device, arg1 := range []uint32{100, 200} {
+		okayMessage := adb.CreateMessage()
+		if err := okayMessage.Set(adb.CommandOkay, arg1, forwardedOpen.Arg1(), nil); err != nil {
+			t.Fatalf("Set failed: %s", err)
+		}
+		wrapper := protocol.CreateTransporterMessage()
+		wrapper.SetDirectCommand(protocol.CommandAdbTransport)
+		if err := wrapper.SetPayloadAdbTransport(&protocol.TransporterMessagePayloadAdbTransport{Device: device, Message: okayMessage.Bytes()}); err != nil {
+			t.Fatalf("SetPayloadAdbTransport failed: %s", err)
+		}
+		if err := wrapper.Write(server); err != nil {
+			t.Fatalf("failed to write the wrapped OKAY: %s", err)
+		}
+	}
+	received := adb.CreateMessage()
+	_ = localConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := received.Read(localConn); err != nil {
+		t.Fatalf("failed to read the relayed OKAY: %s", err)
+	}
+	if received.Arg1() != 200 {
+		t.Fatalf("expected device 1's OKAY (arg1 200), got arg1 %d", received.Arg1())
+	}
+
+	connectCalls, _ := smartSocket.calls()
+	wantCalls := []string{fmt.Sprintf("127.0.0.1:%d", firstPort), fmt.Sprintf("127.0.0.1:%d", firstPort+1)}
+	if len(connectCalls) != 2 || connectCalls[0] != wantCalls[0] || connectCalls[1] != wantCalls[1] {
+		t.Fatalf("expected Connect calls %v, got %v", wantCalls, connectCalls)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("JoinAsGuest did not stop after context cancellation")
+	}
+	if _, disconnectCalls := smartSocket.calls(); len(disconnectCalls) != 2 {
+		t.Fatalf("expected both proxies to be disconnected, got %v", disconnectCalls)
+	}
+}
+
+func expectGuestEventKind(t *testing.T, events <-chan GuestEvent, kind GuestEventKind) GuestEvent {
+	t.Helper()
+	for {
+		select {
+		case e := <-events:
+			if e.Kind == kind {
+				return e
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for guest event kind %d", kind)
+			return GuestEvent{}
+		}
+	}
+}
+
+func sendDeviceState(t *testing.T, server net.Conn, device int, state string) {
+	t.Helper()
+	message := protocol.CreateTransporterMessage()
+	message.SetDirectCommand(protocol.CommandDeviceState)
+	if err := message.SetPayloadDeviceState(&protocol.TransporterMessagePayloadDeviceState{Device: device, State: state}); err != nil {
+		t.Fatalf("SetPayloadDeviceState failed: %s", err)
+	}
+	if err := message.Write(server); err != nil {
+		t.Fatalf("failed to write the device state: %s", err)
+	}
+}
+
+// TestJoinAsGuestPresentsOfflineDevice verifies that the owner reporting
+// its device offline drops the local adb server's connection and holds a
+// new one's handshake until the device is reported back online.
+func TestJoinAsGuestPresentsOfflineDevice(t *testing.T) {
+	client, server := newConnectedClient(t)
+	port := freeLocalPort(t)
+	smartSocket := &fakeGuestSmartSocket{}
+
+	events := make(chan GuestEvent, 20)
+	onEvent := func(e GuestEvent) { events <- e }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	options := testGuestOptions(t)
+	go func() { _ = JoinAsGuest(ctx, client, smartSocket, testIdentity(t), "ROOM1", port, onEvent, options) }()
+
+	respondToJoinRoom(t, server, 1)
+	expectGuestEventKind(t, events, GuestProxyReady)
+
+	handshake := func() (net.Conn, <-chan error) {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+		if err != nil {
+			t.Fatalf("failed to dial the proxy: %s", err)
+		}
+		responded := make(chan error, 1)
+		go func() {
+			_, err := adbHandshake(conn)
+			responded <- err
+		}()
+		return conn, responded
+	}
+
+	firstConn, responded := handshake()
+	defer firstConn.Close()
+	if err := <-responded; err != nil {
+		t.Fatalf("failed to read the CNXN response: %s", err)
+	}
+	expectGuestEventKind(t, events, GuestLocalAdbConnected)
+
+	sendDeviceState(t, server, 0, "offline")
+	event := expectGuestEventKind(t, events, GuestDeviceOffline)
+	if event.Device != "emulator-5554" || event.DeviceState != "offline" {
+		t.Fatalf("unexpected GuestDeviceOffline event: %+v", event)
+	}
+	_ = firstConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := firstConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the local connection to be dropped, got err=%v", err)
+	}
+
+	secondConn, responded := handshake()
+	defer secondConn.Close()
+	select {
+	case err := <-responded:
+		t.Fatalf("did not expect a CNXN response while the device is offline, got err=%v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	sendDeviceState(t, server, 0, "device")
+	expectGuestEventKind(t, events, GuestDeviceOnline)
+	select {
+	case err := <-responded:
+		if err != nil {
+			t.Fatalf("failed to read the CNXN response: %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for the CNXN response once the device is back")
+	}
+}
+
+// TestJoinAsGuestAuthenticatesLocalAdbServers checks that a local adb server
+// whose key isn't authorized only connects once ApproveAdbKey approves it,
+// and that the approved key is authorized from then on.
+func TestJoinAsGuestAuthenticatesLocalAdbServers(t *testing.T) {
+	client, server := newConnectedClient(t)
+	port := freeLocalPort(t)
+	events := make(chan GuestEvent, 20)
+	adbKeys, err := adb.LoadAuthorizedKeys("")
+	if err != nil {
+		t.Fatalf("LoadAuthorizedKeys failed: %s", err)
+	}
+	approvals := make(chan *adb.PublicKey, 2)
+	decisions := make(chan bool, 1)
+	options := GuestOptions{
+		AdbKeys: adbKeys,
+		ApproveAdbKey: func(ctx context.Context, key *adb.PublicKey) (bool, bool) {
+			approvals <- key
+			return <-decisions, false
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = JoinAsGuest(ctx, client, &fakeGuestSmartSocket{}, testIdentity(t), "ROOM1", port, func(e GuestEvent) { events <- e }, options)
+	}()
+	respondToJoinRoom(t, server, 1)
+	expectGuestEventKind(t, events, GuestProxyReady)
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+		if err != nil {
+			t.Fatalf("failed to dial the proxy: %s", err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+
+	decisions <- false
+	if _, err := adbHandshake(dial()); err == nil {
+		t.Fatalf("expected a rejected key's handshake to fail")
+	}
+	if key := <-approvals; key.Comment != "test@localhost" || !key.Key.Equal(&testAdbKey().PublicKey) {
+		t.Fatalf("expected to be asked about the local adb server's key, got %+v", key)
+	}
+
+	decisions <- true
+	if _, err := adbHandshake(dial()); err != nil {
+		t.Fatalf("expected an approved key's handshake to succeed, got %s", err)
+	}
+	<-approvals
+	expectGuestEventKind(t, events, GuestLocalAdbConnected)
+	if len(adbKeys.Keys()) != 1 {
+		t.Fatalf("expected the approved key to be authorized, got %d keys", len(adbKeys.Keys()))
+	}
+
+	// Now that it's authorized, its signature alone is enough.
+	if _, err := adbHandshake(dial()); err != nil {
+		t.Fatalf("expected the authorized key's handshake to succeed, got %s", err)
+	}
+	select {
+	case <-approvals:
+		t.Fatalf("did not expect to be asked about an authorized key again")
+	default:
+	}
+}
+
+// TestJoinAsGuestPicksFreePortsForPortZero verifies local port 0 has each
+// proxy listen on a free port of its own, which is reported and connected
+// to.
+func TestJoinAsGuestPicksFreePortsForPortZero(t *testing.T) {
+	client, server := newConnectedClient(t)
+	smartSocket := &fakeGuestSmartSocket{reachableHost: "192.0.2.10"}
+
+	events := make(chan GuestEvent, 20)
+	onEvent := func(e GuestEvent) { events <- e }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	options := testGuestOptions(t)
+	go func() { _ = JoinAsGuest(ctx, client, smartSocket, testIdentity(t), "ROOM1", "0", onEvent, options) }()
+	respondToJoinRoomWithDevices(t, server, 1, []string{"emulator-5554", "R58M123"})
+
+	ports := make(map[string]string)
+	for len(ports) < 2 {
+		select {
+		case e := <-events:
+			if e.Kind != GuestProxyReady {
+				continue
+			}
+			if e.LocalPort == "0" || e.LocalAddress != "127.0.0.1:"+e.LocalPort {
+				t.Fatalf("expected a picked loopback port, got %q at %q", e.LocalPort, e.LocalAddress)
+			}
+			ports[e.Device] = e.LocalPort
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for both proxies")
+		}
+	}
+	if ports["emulator-5554"] == ports["R58M123"] {
+		t.Fatalf("expected each proxy to get its own port, both got %s", ports["R58M123"])
+	}
+	// A loopback proxy is connected to on loopback, wherever the adb
+	// server runs.
+	for {
+		if connectCalls, _ := smartSocket.calls(); len(connectCalls) == 2 {
+			if connectCalls[0] != "127.0.0.1:"+ports["emulator-5554"] || connectCalls[1] != "127.0.0.1:"+ports["R58M123"] {
+				t.Fatalf("expected the picked ports to be connected to, got %v", connectCalls)
+			}
+			break
+		}
+		select {
+		case <-events:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for the automatic adb connects")
+		}
+	}
+}
+
+// TestJoinAsGuestListensOnUnixSockets verifies a unix: bind has each proxy
+// listen on its own socket, without an automatic "adb connect".
+func TestJoinAsGuestListensOnUnixSockets(t *testing.T) {
+	client, server := newConnectedClient(t)
+	smartSocket := &fakeGuestSmartSocket{}
+	dir, err := os.MkdirTemp("", "guest")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed: %s", err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	events := make(chan GuestEvent, 20)
+	onEvent := func(e GuestEvent) { events <- e }
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	options := testGuestOptions(t)
+	options.Bind = "unix:" + filepath.Join(dir, "proxy.sock")
+	go func() {
+		done <- JoinAsGuest(ctx, client, smartSocket, testIdentity(t), "ROOM1", adb.DefaultProxyPort, onEvent, options)
+	}()
+	respondToJoinRoomWithDevices(t, server, 1, []string{"emulator-5554", "R58M123"})
+
+	for ready := 0; ready < 2; {
+		select {
+		case e := <-events:
+			if e.Kind != GuestProxyReady {
+				continue
+			}
+			ready++
+			if e.LocalPort != "" || !strings.HasPrefix(e.LocalAddress, "unix:"+filepath.Join(dir, "proxy.sock-")) {
+				t.Fatalf("expected a numbered unix socket, got port %q at %q", e.LocalPort, e.LocalAddress)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for both proxies")
+		}
+	}
+	conn, err := net.Dial("unix", filepath.Join(dir, "proxy.sock-2"))
+	if err != nil {
+		t.Fatalf("failed to dial the second device's socket: %s", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if response, err := adbHandshake(conn); err != nil || !strings.Contains(response.DataString(), "Model_R58M123") {
+		t.Fatalf("expected the second device's handshake over its socket, got %v", err)
+	}
+
+	cancel()
+	<-done
+	if connectCalls, _ := smartSocket.calls(); len(connectCalls) != 0 {
+		t.Fatalf("did not expect an automatic adb connect to a unix socket, got %v", connectCalls)
+	}
+}
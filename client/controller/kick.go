@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"adb-remote.maci.team/client/transportLayer"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrNoGuest is returned by Kicker.Kick when no accepted guest is in the
+// room.
+var ErrNoGuest = errors.New("no guest is in the room")
+
+// ErrKicked is returned by JoinAsGuest when the room owner removed the
+// guest from the room, with the Reason it gave, if any.
+type ErrKicked struct {
+	Reason string
+}
+
+func (e *ErrKicked) Error() string {
+	if e.Reason == "" {
+		return "the room owner removed you from the room"
+	}
+	return fmt.Sprintf("the room owner removed you from the room: %s", e.Reason)
+}
+
+// Kicker lets the owner remove the guest JoinAsRoomOwner accepted from the
+// room without closing it: the guest is told why, its streams are closed,
+// and the next guest in line gets its turn. Create one with NewKicker and
+// pass it in OwnerOptions.Kicker; it serves one room at a time.
+type Kicker struct {
+	mutex sync.Mutex
+	// client, onEvent and forget are set by attach.
+	client  *transportLayer.Client
+	onEvent OwnerEventFunc
+	forget  func()
+	// guestClientId is the current guest's, while one is in the room.
+	guestClientId string
+}
+
+// NewKicker returns a Kicker for a room to be shared.
+func NewKicker() *Kicker {
+	return &Kicker{}
+}
+
+// attach has k remove the guest of the room serviced over client, calling
+// forget to close its streams and forget about it once it did.
+func (k *Kicker) attach(client *transportLayer.Client, onEvent OwnerEventFunc, forget func()) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.client, k.onEvent, k.forget = client, onEvent, forget
+}
+
+// joined records that guestClientId was accepted into the room.
+func (k *Kicker) joined(guestClientId string) {
+	if k == nil {
+		return
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.guestClientId = guestClientId
+}
+
+// guestLeft records that the room's guest left.
+func (k *Kicker) guestLeft() {
+	if k == nil {
+		return
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.guestClientId = ""
+}
+
+// Kick removes the current guest from the room, telling it reason (which
+// may be empty). It has to be accepted again to come back, even within
+// OwnerOptions.RejoinWindow.
+func (k *Kicker) Kick(reason string) error {
+	k.mutex.Lock()
+	guestClientId := k.guestClientId
+	if guestClientId == "" {
+		k.mutex.Unlock()
+		return ErrNoGuest
+	}
+	if err := k.client.SendKickGuest(reason); err != nil {
+		k.mutex.Unlock()
+		return fmt.Errorf("failed to remove %s from the room: %w", guestClientId, err)
+	}
+	k.guestClientId = ""
+	forget, onEvent := k.forget, k.onEvent
+	k.mutex.Unlock()
+	forget()
+	emitOwner(onEvent, OwnerEvent{Kind: OwnerGuestKicked, GuestClientId: guestClientId, Reason: reason})
+	return nil
+}
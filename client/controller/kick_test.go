@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"adb-remote.maci.team/shared/protocol"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestKickerRemovesTheGuest checks that kicking the accepted guest tells
+// the transporter why, and that the guest isn't let back in without being
+// asked about again, even within the re-join window.
+func TestKickerRemovesTheGuest(t *testing.T) {
+	client, server := newConnectedClient(t)
+	events := make(chan OwnerEvent, 10)
+	onEvent := func(e OwnerEvent) { events <- e }
+	guestIdentity := testIdentity(t)
+
+	kicker := NewKicker()
+	prompts := make(chan string, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- JoinAsRoomOwner(ctx, client, newFakeSmartSocket(), []string{"emulator-5554"}, testIdentity(t), func(clientId string, publicKey []byte) (bool, error) {
+			prompts <- clientId
+			return len(prompts) == 1, nil
+		}, onEvent, OwnerOptions{Kicker: kicker, RejoinWindow: time.Minute})
+	}()
+
+	respondToCreateRoom(t, server, "ROOM9")
+	expectOwnerEvent(t, events) // OwnerRoomCreated
+	if err := kicker.Kick("nobody here"); !errors.Is(err, ErrNoGuest) {
+		t.Fatalf("expected kicking an empty room to fail with ErrNoGuest, got %v", err)
+	}
+
+	sendJoinRoomRequestFrom(t, server, "ROOM9", "GUEST1", guestIdentity)
+	expectJoinResponse(t, server)
+	expectDeviceInfo(t, server)
+	expectOwnerEvent(t, events) // OwnerJoinRequested
+	expectOwnerEvent(t, events) // OwnerJoinDecided
+
+	go func() {
+		if err := kicker.Kick("Session over"); err != nil {
+			t.Errorf("Kick failed: %s", err)
+		}
+	}()
+	message := readMessage(t, server)
+	if message.Command() != protocol.CommandKickGuest {
+		t.Fatalf("expected a kick message, got %x", message.Command())
+	}
+	if payload, err := message.GetPayloadKickGuest(); err != nil || payload.Reason != "Session over" {
+		t.Fatalf("expected the reason to be sent, got %+v (%v)", payload, err)
+	}
+	if event := expectOwnerEvent(t, events); event.Kind != OwnerGuestKicked || event.GuestClientId != "GUEST1" || event.Reason != "Session over" {
+		t.Fatalf("expected OwnerGuestKicked for GUEST1, got %+v", event)
+	}
+
+	guestLeft := protocol.CreateTransporterMessage()
+	guestLeft.SetDirectCommand(protocol.CommandGuestLeft)
+	if err := guestLeft.Write(server); err != nil {
+		t.Fatalf("failed to write the guest-left notification: %s", err)
+	}
+	expectOwnerEvent(t, events) // OwnerGuestLeft
+	sendJoinRoomRequestFrom(t, server, "ROOM9", "GUEST1-AGAIN", guestIdentity)
+	if accepted := expectJoinResponse(t, server); accepted != 0 {
+		t.Fatalf("expected the guest to be asked about again and declined, got Accepted=%d", accepted)
+	}
+	if err := kicker.Kick(""); !errors.Is(err, ErrNoGuest) {
+		t.Fatalf("expected kicking a declined guest to fail with ErrNoGuest, got %v", err)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("JoinAsRoomOwner did not stop after context cancellation")
+	}
+}
+
+// TestJoinAsGuestEndsWhenKicked checks that the guest reports being
+// removed from the room, and stops with an *ErrKicked carrying the reason.
+func TestJoinAsGuestEndsWhenKicked(t *testing.T) {
+	client, server := newConnectedClient(t)
+	events := make(chan GuestEvent, 20)
+	onEvent := func(e GuestEvent) { events <- e }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- JoinAsGuest(ctx, client, &fakeGuestSmartSocket{}, testIdentity(t), "ROOM1", freeLocalPort(t), onEvent, testGuestOptions(t))
+	}()
+
+	respondToJoinRoom(t, server, 1)
+	message := protocol.CreateTransporterMessage()
+	message.SetDirectCommand(protocol.CommandKickGuest)
+	if err := message.SetPayloadKickGuest(&protocol.TransporterMessagePayloadKickGuest{Reason: "Session over"}); err != nil {
+		t.Fatalf("SetPayloadKickGuest failed: %s", err)
+	}
+	if err := message.Write(server); err != nil {
+		t.Fatalf("failed to write the kick: %s", err)
+	}
+	if event := expectGuestEventKind(t, events, GuestKicked); event.Reason != "Session over" {
+		t.Fatalf("expected the kick reason, got %+v", event)
+	}
+
+	select {
+	case err := <-done:
+		var kicked *ErrKicked
+		if !errors.As(err, &kicked) || kicked.Reason != "Session over" {
+			t.Fatalf("expected an *ErrKicked with the reason, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("JoinAsGuest did not stop after being kicked")
+	}
+}
@@ -0,0 +1,293 @@
+package controller
+
+import (
+	"adb-remote.maci.team/client/transportLayer"
+	"adb-remote.maci.team/shared/protocol"
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LeaseWarning is how long before its session lease runs out a guest is
+// warned about it (see GuestLeaseExpiring).
+const LeaseWarning = time.Minute
+
+// ErrNoLease is returned by Leases.Extend and Leases.Revoke when there's no
+// lease to change: no guest is in the room, it was let in without a time
+// limit, or its lease already ended.
+var ErrNoLease = errors.New("the guest holds no session lease")
+
+// ErrLeaseEnded is returned by JoinAsGuest when the owner ended the session
+// because its lease ran out or, if Revoked, because the owner revoked it.
+type ErrLeaseEnded struct {
+	Revoked bool
+}
+
+func (e *ErrLeaseEnded) Error() string {
+	if e.Revoked {
+		return "the room owner revoked the session"
+	}
+	return "the session lease expired"
+}
+
+// LeaseFunc returns how long the guest guestClientId, whose identity is
+// guestPublicKey, may stay once accepted, or 0 to let it stay for as long
+// as it likes.
+type LeaseFunc func(guestClientId string, guestPublicKey []byte) time.Duration
+
+// Leases grants the guests JoinAsRoomOwner accepts session leases, and
+// ends a guest's session once its lease runs out: its new streams are
+// refused, and it's removed from the room the way Kicker.Kick does, for
+// the next guest in line to get its turn. The owner can extend or revoke the current guest's
+// lease while it's in the room. Create one with NewLeases and pass it in
+// OwnerOptions.Leases; it serves one room at a time.
+type Leases struct {
+	grant LeaseFunc
+	now   func() time.Time
+
+	mutex sync.Mutex
+	// client, onEvent and evict are set by attach.
+	client  *transportLayer.Client
+	onEvent OwnerEventFunc
+	evict   func(reason string)
+	// guestClientId and publicKey are the current guest's, while one is in
+	// the room; expiresAt is when its lease runs out (zero without a time
+	// limit) and timer what ends it then.
+	guestClientId string
+	publicKey     []byte
+	expiresAt     time.Time
+	timer         *time.Timer
+	// ended reports that the current guest's lease ended; it stays in the
+	// room, but can't open anything any more.
+	ended bool
+	// generation tells a timer for a lease since replaced from the
+	// current one's.
+	generation int
+	// left is the public key of the last guest to leave, leftRemaining
+	// what was left of its lease (zero without a time limit), and
+	// leftEnded whether it had ended, for a re-join to carry on with.
+	left          []byte
+	leftRemaining time.Duration
+	leftEnded     bool
+}
+
+// NewLeases returns Leases granting every accepted guest the lease grant
+// returns for it.
+func NewLeases(grant LeaseFunc) *Leases {
+	return &Leases{grant: grant, now: time.Now}
+}
+
+// attach has l report to the room serviced over client, removing its
+// guest from it with evict, telling it reason, when a lease ends.
+func (l *Leases) attach(client *transportLayer.Client, onEvent OwnerEventFunc, evict func(reason string)) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.client, l.onEvent, l.evict = client, onEvent, evict
+}
+
+// start grants the guest just accepted a lease and tells it about it. A
+// guest re-joining after its connection dropped carries on with the lease
+// it had rather than getting a new one.
+func (l *Leases) start(guestClientId string, publicKey []byte, rejoined bool) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	resume := rejoined && l.left != nil && bytes.Equal(l.left, publicKey)
+	remaining := l.leftRemaining
+	l.mutex.Unlock()
+	if !resume {
+		remaining = l.grant(guestClientId, publicKey)
+	}
+
+	l.mutex.Lock()
+	l.stopTimer()
+	l.guestClientId, l.publicKey, l.ended = guestClientId, publicKey, false
+	l.expiresAt = time.Time{}
+	l.left = nil
+	if remaining <= 0 {
+		l.mutex.Unlock()
+		return
+	}
+	l.expiresAt = l.now().Add(remaining)
+	l.schedule(remaining)
+	changed := l.announce()
+	l.mutex.Unlock()
+	emitOwner(l.onEvent, changed)
+}
+
+// guestLeft records that the room's guest left, remembering its lease for
+// a re-join.
+func (l *Leases) guestLeft() {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.guestClientId == "" {
+		return
+	}
+	l.stopTimer()
+	l.left, l.leftEnded, l.leftRemaining = l.publicKey, l.ended, 0
+	if !l.expiresAt.IsZero() {
+		l.leftRemaining = max(l.expiresAt.Sub(l.now()), time.Second)
+	}
+	l.guestClientId, l.publicKey, l.expiresAt, l.ended = "", nil, time.Time{}, false
+}
+
+// endedFor reports whether request is the guest that just left after its
+// lease ended, which mustn't re-join without being asked about again.
+func (l *Leases) endedFor(request *joinRequest) bool {
+	if l == nil {
+		return false
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.leftEnded && bytes.Equal(l.left, request.publicKey)
+}
+
+// Extend adds by to the current guest's lease.
+func (l *Leases) Extend(by time.Duration) error {
+	if by <= 0 {
+		return fmt.Errorf("can't extend a lease by %s", by)
+	}
+	l.mutex.Lock()
+	if l.guestClientId == "" || l.ended || l.expiresAt.IsZero() {
+		l.mutex.Unlock()
+		return ErrNoLease
+	}
+	l.stopTimer()
+	l.expiresAt = l.expiresAt.Add(by)
+	l.schedule(l.expiresAt.Sub(l.now()))
+	changed := l.announce()
+	l.mutex.Unlock()
+	emitOwner(l.onEvent, changed)
+	return nil
+}
+
+// Revoke ends the current guest's lease, and so its session, now.
+func (l *Leases) Revoke() error {
+	l.mutex.Lock()
+	if l.guestClientId == "" || l.ended || l.expiresAt.IsZero() {
+		l.mutex.Unlock()
+		return ErrNoLease
+	}
+	ended := l.end(protocol.LeaseRevoked)
+	l.mutex.Unlock()
+	ended()
+	return nil
+}
+
+// CheckOpen makes Leases a relay.ServiceFilter refusing every stream once
+// the current guest's lease ended.
+func (l *Leases) CheckOpen(string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.ended {
+		return errors.New("the guest's session lease ended")
+	}
+	return nil
+}
+
+// schedule has the current lease end in remaining. Called with the mutex
+// held.
+func (l *Leases) schedule(remaining time.Duration) {
+	l.generation++
+	generation := l.generation
+	l.timer = time.AfterFunc(remaining, func() {
+		l.mutex.Lock()
+		if l.generation != generation || l.ended {
+			l.mutex.Unlock()
+			return
+		}
+		ended := l.end(protocol.LeaseExpired)
+		l.mutex.Unlock()
+		ended()
+	})
+}
+
+// stopTimer cancels the current lease's timer. Called with the mutex
+// held.
+func (l *Leases) stopTimer() {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	l.generation++
+}
+
+// announce tells the guest what the current lease has left, returning the
+// event telling onEvent, for the caller to emit once it released the
+// mutex. Called with the mutex held.
+func (l *Leases) announce() OwnerEvent {
+	remaining := l.expiresAt.Sub(l.now())
+	if err := l.client.SendSessionLease(protocol.LeaseActive, remaining); err != nil {
+		l.client.Logger.Error(fmt.Sprintf("Failed to tell %s about its session lease: %s", l.guestClientId, err))
+	}
+	return OwnerEvent{Kind: OwnerLeaseChanged, GuestClientId: l.guestClientId, Lease: remaining}
+}
+
+// end ends the current guest's lease in state, telling it, and returns
+// what's left to do once the mutex is released: reporting it to onEvent
+// and evicting the guest, which takes the mutex again (see guestLeft).
+// Called with the mutex held.
+func (l *Leases) end(state int) func() {
+	l.stopTimer()
+	l.ended = true
+	if err := l.client.SendSessionLease(state, 0); err != nil {
+		l.client.Logger.Error(fmt.Sprintf("Failed to tell %s its session lease ended: %s", l.guestClientId, err))
+	}
+	revoked := state == protocol.LeaseRevoked
+	onEvent, evict := l.onEvent, l.evict
+	event := OwnerEvent{Kind: OwnerLeaseEnded, GuestClientId: l.guestClientId, Revoked: revoked}
+	return func() {
+		emitOwner(onEvent, event)
+		evict((&ErrLeaseEnded{Revoked: revoked}).Error())
+	}
+}
+
+// guestLease follows the session lease the owner granted a guest, warning
+// LeaseWarning before it runs out, and remembers why it ended once it did.
+type guestLease struct {
+	onEvent GuestEventFunc
+
+	mutex  sync.Mutex
+	warner *time.Timer
+	err    error
+}
+
+// update handles the owner's news about the lease, reporting whether it
+// ended.
+func (g *guestLease) update(state int, remaining time.Duration) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.warner != nil {
+		g.warner.Stop()
+		g.warner = nil
+	}
+	if state != protocol.LeaseActive {
+		g.err = &ErrLeaseEnded{Revoked: state == protocol.LeaseRevoked}
+		emitGuest(g.onEvent, GuestEvent{Kind: GuestLeaseEnded, Err: g.err})
+		return true
+	}
+	expiresAt := time.Now().Add(remaining)
+	emitGuest(g.onEvent, GuestEvent{Kind: GuestLeaseChanged, Lease: remaining, LeaseExpiresAt: expiresAt})
+	g.warner = time.AfterFunc(max(remaining-LeaseWarning, 0), func() {
+		emitGuest(g.onEvent, GuestEvent{Kind: GuestLeaseExpiring, Lease: time.Until(expiresAt), LeaseExpiresAt: expiresAt})
+	})
+	return false
+}
+
+// stop stops warning, returning the *ErrLeaseEnded that ended the lease,
+// if it did.
+func (g *guestLease) stop() error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.warner != nil {
+		g.warner.Stop()
+		g.warner = nil
+	}
+	return g.err
+}
@@ -0,0 +1,220 @@
+package controller
+
+import (
+	"adb-remote.maci.team/shared/protocol"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func expectSessionLease(t *testing.T, server net.Conn) *protocol.TransporterMessagePayloadSessionLease {
+	t.Helper()
+	message := readMessage(t, server)
+	if message.Command() != protocol.CommandSessionLease {
+		t.Fatalf("expected a session lease message, got %x", message.Command())
+	}
+	payload, err := message.GetPayloadSessionLease()
+	if err != nil {
+		t.Fatalf("GetPayloadSessionLease failed: %s", err)
+	}
+	return payload
+}
+
+func sendSessionLease(t *testing.T, server net.Conn, state int, remainingSeconds int) {
+	t.Helper()
+	message := protocol.CreateTransporterMessage()
+	message.SetDirectCommand(protocol.CommandSessionLease)
+	if err := message.SetPayloadSessionLease(&protocol.TransporterMessagePayloadSessionLease{State: state, RemainingSeconds: remainingSeconds}); err != nil {
+		t.Fatalf("SetPayloadSessionLease failed: %s", err)
+	}
+	if err := message.Write(server); err != nil {
+		t.Fatalf("failed to write the session lease: %s", err)
+	}
+}
+
+// TestJoinAsRoomOwnerEndsExpiredLeases checks that a guest's lease is
+// announced once it's accepted, that it running out is announced too and
+// removes the guest from the room, and that the guest isn't let back in
+// without being asked about again.
+func TestJoinAsRoomOwnerEndsExpiredLeases(t *testing.T) {
+	client, server := newConnectedClient(t)
+	events := make(chan OwnerEvent, 10)
+	onEvent := func(e OwnerEvent) { events <- e }
+	guestIdentity := testIdentity(t)
+
+	var promptsMu sync.Mutex
+	prompts := 0
+	leases := NewLeases(func(guestClientId string, guestPublicKey []byte) time.Duration {
+		return 200 * time.Millisecond
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- JoinAsRoomOwner(ctx, client, newFakeSmartSocket(), []string{"emulator-5554"}, testIdentity(t), func(clientId string, publicKey []byte) (bool, error) {
+			promptsMu.Lock()
+			defer promptsMu.Unlock()
+			prompts++
+			return prompts == 1, nil
+		}, onEvent, OwnerOptions{Leases: leases, RejoinWindow: time.Minute})
+	}()
+
+	respondToCreateRoom(t, server, "ROOM9")
+	expectOwnerEvent(t, events) // OwnerRoomCreated
+
+	sendJoinRoomRequestFrom(t, server, "ROOM9", "GUEST1", guestIdentity)
+	expectJoinResponse(t, server)
+	expectDeviceInfo(t, server)
+	if lease := expectSessionLease(t, server); lease.State != protocol.LeaseActive || lease.RemainingSeconds != 1 {
+		t.Fatalf("expected an active lease with 1s left, got %+v", lease)
+	}
+	expectOwnerEvent(t, events) // OwnerJoinRequested
+	expectOwnerEvent(t, events) // OwnerJoinDecided
+	if event := expectOwnerEvent(t, events); event.Kind != OwnerLeaseChanged || event.GuestClientId != "GUEST1" || event.Lease <= 0 {
+		t.Fatalf("expected OwnerLeaseChanged for GUEST1, got %+v", event)
+	}
+
+	if lease := expectSessionLease(t, server); lease.State != protocol.LeaseExpired {
+		t.Fatalf("expected the lease to expire, got %+v", lease)
+	}
+	if event := expectOwnerEvent(t, events); event.Kind != OwnerLeaseEnded || event.Revoked {
+		t.Fatalf("expected OwnerLeaseEnded, got %+v", event)
+	}
+	message := readMessage(t, server)
+	if message.Command() != protocol.CommandKickGuest {
+		t.Fatalf("expected the guest to be removed from the room, got %x", message.Command())
+	}
+	if payload, err := message.GetPayloadKickGuest(); err != nil || payload.Reason != "the session lease expired" {
+		t.Fatalf("expected the lease to be given as the reason, got %+v (%v)", payload, err)
+	}
+	if event := expectOwnerEvent(t, events); event.Kind != OwnerGuestKicked || event.GuestClientId != "GUEST1" {
+		t.Fatalf("expected OwnerGuestKicked for GUEST1, got %+v", event)
+	}
+	if err := leases.Extend(time.Minute); !errors.Is(err, ErrNoLease) {
+		t.Fatalf("expected extending an expired lease to fail with ErrNoLease, got %v", err)
+	}
+
+	guestLeft := protocol.CreateTransporterMessage()
+	guestLeft.SetDirectCommand(protocol.CommandGuestLeft)
+	if err := guestLeft.Write(server); err != nil {
+		t.Fatalf("failed to write the guest-left notification: %s", err)
+	}
+	expectOwnerEvent(t, events) // OwnerGuestLeft
+	// Somebody presenting the guest's public key without its signature is
+	// neither let in nor asked about.
+	sendJoinRoomPayload(t, server, &protocol.TransporterMessagePayloadConnectRoom{RoomId: "ROOM9", ClientId: "IMPOSTOR", PublicKey: guestIdentity.PublicKey})
+	if accepted := expectJoinResponse(t, server); accepted != 0 {
+		t.Fatalf("expected an unsigned join request to be declined, got Accepted=%d", accepted)
+	}
+	if event := expectOwnerEvent(t, events); event.Kind != OwnerJoinFailed || !errors.Is(event.Err, ErrInvalidJoinSignature) {
+		t.Fatalf("expected OwnerJoinFailed with ErrInvalidJoinSignature, got %+v", event)
+	}
+	sendJoinRoomRequestFrom(t, server, "ROOM9", "GUEST1-AGAIN", guestIdentity)
+	if accepted := expectJoinResponse(t, server); accepted != 0 {
+		t.Fatalf("expected the guest to be asked about again and declined, got Accepted=%d", accepted)
+	}
+	promptsMu.Lock()
+	if prompts != 2 {
+		t.Fatalf("expected promptAccept to be asked about the guest twice only, got %d", prompts)
+	}
+	promptsMu.Unlock()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("JoinAsRoomOwner did not stop after context cancellation")
+	}
+}
+
+// TestLeasesExtendAndRevoke checks that extending a lease announces what
+// it has left, and that revoking it ends it, refusing new streams and
+// evicting the guest.
+func TestLeasesExtendAndRevoke(t *testing.T) {
+	client, server := newConnectedClient(t)
+	events := make(chan OwnerEvent, 10)
+	evicted := make(chan string, 1)
+	leases := NewLeases(func(guestClientId string, guestPublicKey []byte) time.Duration {
+		return time.Hour
+	})
+	leases.attach(client, func(e OwnerEvent) { events <- e }, func(reason string) { evicted <- reason })
+
+	go leases.start("GUEST1", []byte("guest key"), false)
+	if lease := expectSessionLease(t, server); lease.RemainingSeconds != 3600 {
+		t.Fatalf("expected an hour-long lease, got %+v", lease)
+	}
+	expectOwnerEvent(t, events) // OwnerLeaseChanged
+
+	go func() {
+		if err := leases.Extend(30 * time.Minute); err != nil {
+			t.Errorf("Extend failed: %s", err)
+		}
+	}()
+	if lease := expectSessionLease(t, server); lease.State != protocol.LeaseActive || lease.RemainingSeconds != 5400 {
+		t.Fatalf("expected the lease to be extended to 90 minutes, got %+v", lease)
+	}
+	if event := expectOwnerEvent(t, events); event.Kind != OwnerLeaseChanged || event.GuestClientId != "GUEST1" || event.Lease <= time.Hour {
+		t.Fatalf("expected GUEST1's lease to have more than an hour left, got %+v", event)
+	}
+
+	go func() {
+		if err := leases.Revoke(); err != nil {
+			t.Errorf("Revoke failed: %s", err)
+		}
+	}()
+	if lease := expectSessionLease(t, server); lease.State != protocol.LeaseRevoked {
+		t.Fatalf("expected the lease to be revoked, got %+v", lease)
+	}
+	if event := expectOwnerEvent(t, events); event.Kind != OwnerLeaseEnded || !event.Revoked {
+		t.Fatalf("expected a revoked OwnerLeaseEnded, got %+v", event)
+	}
+	select {
+	case reason := <-evicted:
+		if reason != "the room owner revoked the session" {
+			t.Fatalf("expected the revocation to be given as the reason, got %q", reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the guest to be evicted")
+	}
+	if err := leases.CheckOpen("shell:"); err == nil {
+		t.Fatalf("expected new streams to be refused once the lease ended")
+	}
+	if err := leases.Revoke(); !errors.Is(err, ErrNoLease) {
+		t.Fatalf("expected revoking twice to fail with ErrNoLease, got %v", err)
+	}
+}
+
+// TestJoinAsGuestEndsWhenTheLeaseIsRevoked checks that the guest reports
+// its lease, and stops with an *ErrLeaseEnded once the owner revokes it.
+func TestJoinAsGuestEndsWhenTheLeaseIsRevoked(t *testing.T) {
+	client, server := newConnectedClient(t)
+	events := make(chan GuestEvent, 20)
+	onEvent := func(e GuestEvent) { events <- e }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- JoinAsGuest(ctx, client, &fakeGuestSmartSocket{}, testIdentity(t), "ROOM1", freeLocalPort(t), onEvent, testGuestOptions(t))
+	}()
+
+	respondToJoinRoom(t, server, 1)
+	sendSessionLease(t, server, protocol.LeaseActive, 120)
+	if event := expectGuestEventKind(t, events, GuestLeaseChanged); event.Lease != 2*time.Minute {
+		t.Fatalf("expected 2 minutes left, got %+v", event)
+	}
+	sendSessionLease(t, server, protocol.LeaseRevoked, 0)
+
+	select {
+	case err := <-done:
+		var leaseEnded *ErrLeaseEnded
+		if !errors.As(err, &leaseEnded) || !leaseEnded.Revoked {
+			t.Fatalf("expected a revoked *ErrLeaseEnded, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("JoinAsGuest did not stop after the lease was revoked")
+	}
+}
@@ -3,11 +3,16 @@ package controller
 import (
 	"adb-remote.maci.team/client/adb"
 	"adb-remote.maci.team/client/identity"
+	"adb-remote.maci.team/client/policy"
 	"adb-remote.maci.team/client/relay"
 	"adb-remote.maci.team/client/transportLayer"
 	"adb-remote.maci.team/shared/protocol"
 	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
+	"log/slog"
+	"time"
 )
 
 // AcceptPromptFunc decides whether a room join request from guestClientId
@@ -16,25 +21,201 @@ import (
 // operator can verify it out of band before accepting.
 type AcceptPromptFunc func(guestClientId string, guestPublicKey []byte) (accepted bool, err error)
 
-// JoinAsRoomOwner creates a room sharing deviceId, then services the room
-// for its whole lifetime: every ADB stream a guest opens is relayed via a
-// relay.OwnerMultiplexer, and every join request is handed to promptAccept
-// off the dispatch loop (promptAccept commonly blocks on user input; it
-// must not stall ADB traffic for a guest that is already connected). State
-// changes are reported through onEvent; all presentation is the caller's
+// OwnerOptions carries JoinAsRoomOwner's optional behavior; the zero value
+// shares the device with no restrictions.
+type OwnerOptions struct {
+	// ServiceFilter, if non-nil, is consulted for every stream the guest
+	// opens (see client/policy); rejected opens are reported as
+	// OwnerServiceDenied events.
+	ServiceFilter relay.ServiceFilter
+	// Observers are told about every stream guests open and about guests
+	// joining and leaving (see client/audit, client/recording).
+	Observers []SessionObserver
+	// RejoinWindow, if positive, lets an accepted guest that left the room
+	// join it again within RejoinWindow without promptAccept being asked,
+	// provided it presents the same identity: a guest whose transporter
+	// connection dropped reconnects this way (see GuestOptions.Reconnect).
+	RejoinWindow time.Duration
+	// RoomId, if set, is the room id to share at instead of a random one,
+	// reserved on the transporter for ownerIdentity the first time it's
+	// asked for, so that it stays the same across restarts. Asking for one
+	// another identity reserved fails.
+	RoomId string
+	// Publish, if non-nil, lists the room in a team's room directory once
+	// it's created; whether that worked is reported as an
+	// OwnerRoomPublished or OwnerPublishFailed event.
+	Publish *PublishOptions
+	// Leases, if non-nil, grants every accepted guest a session lease and
+	// ends its session once it runs out, removing the guest from the room;
+	// the caller can extend or revoke it meanwhile. How it goes is
+	// reported as OwnerLeaseChanged and OwnerLeaseEnded events, followed
+	// by an OwnerGuestKicked one once the guest is removed.
+	Leases *Leases
+	// Kicker, if non-nil, lets the caller remove the accepted guest from
+	// the room, which is reported as an OwnerGuestKicked event.
+	Kicker *Kicker
+	// Chat, if non-nil, lets the caller chat with the accepted guest;
+	// messages from it are reported as OwnerChatMessage events.
+	Chat *Chat
+}
+
+// SessionObserver follows a shared room's guest sessions: the lifecycle of
+// every stream (as a relay.StreamObserver), plus which room and devices are
+// shared and which guest is connected.
+type SessionObserver interface {
+	relay.StreamObserver
+	RoomCreated(roomId string, devices []string)
+	GuestJoined(clientId string, fingerprint string)
+	GuestLeft()
+}
+
+// sessionObservers fans every SessionObserver call out to each element, in
+// order.
+type sessionObservers []SessionObserver
+
+func (o sessionObservers) RoomCreated(roomId string, devices []string) {
+	for _, observer := range o {
+		observer.RoomCreated(roomId, devices)
+	}
+}
+
+func (o sessionObservers) GuestJoined(clientId string, fingerprint string) {
+	for _, observer := range o {
+		observer.GuestJoined(clientId, fingerprint)
+	}
+}
+
+func (o sessionObservers) GuestLeft() {
+	for _, observer := range o {
+		observer.GuestLeft()
+	}
+}
+
+func (o sessionObservers) StreamOpened(id uint32, device string, service string) {
+	for _, observer := range o {
+		observer.StreamOpened(id, device, service)
+	}
+}
+
+func (o sessionObservers) StreamRejected(device string, service string, reason error) {
+	for _, observer := range o {
+		observer.StreamRejected(device, service, reason)
+	}
+}
+
+func (o sessionObservers) GuestData(id uint32, data []byte) {
+	for _, observer := range o {
+		observer.GuestData(id, data)
+	}
+}
+
+func (o sessionObservers) DeviceData(id uint32, data []byte) {
+	for _, observer := range o {
+		observer.DeviceData(id, data)
+	}
+}
+
+func (o sessionObservers) StreamClosed(id uint32, summary relay.StreamSummary) {
+	for _, observer := range o {
+		observer.StreamClosed(id, summary)
+	}
+}
+
+// JoinAsRoomOwner creates a room sharing devices (serials, in the order
+// guests will see them), then services the room for its whole lifetime:
+// every ADB stream a guest opens is relayed via a relay.OwnerMultiplexer,
+// and every join request is handed to promptAccept off the dispatch loop
+// (promptAccept commonly blocks on user input; it must not stall ADB
+// traffic for a guest that is already connected). State changes are
+// reported through onEvent; all presentation is the caller's
 // responsibility. Returns when ctx is cancelled or the transporter
 // connection is lost.
-func JoinAsRoomOwner(ctx context.Context, client *transportLayer.Client, smartSocket adb.IAdbSmartSocket, deviceId string, ownerIdentity *identity.Identity, promptAccept AcceptPromptFunc, onEvent OwnerEventFunc) error {
+func JoinAsRoomOwner(ctx context.Context, client *transportLayer.Client, smartSocket adb.IAdbSmartSocket, devices []string, ownerIdentity *identity.Identity, promptAccept AcceptPromptFunc, onEvent OwnerEventFunc, options OwnerOptions) error {
 	logger := client.Logger
 
-	roomId, err := createRoom(client)
+	shared := newSharedDevices(devices)
+	loadDeviceInfo(smartSocket, shared, logger)
+
+	roomId, err := createRoom(client, ownerIdentity, options.RoomId)
 	if err != nil {
 		return err
 	}
 	emitOwner(onEvent, OwnerEvent{Kind: OwnerRoomCreated, RoomId: roomId})
+	// observer is nil rather than an empty fan-out when there are none, so
+	// the multiplexer skips the calls altogether.
+	var observer SessionObserver
+	if len(options.Observers) > 0 {
+		observer = sessionObservers(options.Observers)
+		observer.RoomCreated(roomId, devices)
+	}
+	if options.Publish != nil {
+		if err := publishRoom(client, ownerIdentity, roomId, shared, options.Publish); err != nil {
+			return err
+		}
+	}
 
-	multiplexer := relay.NewOwnerMultiplexer(smartSocket, deviceId, client, logger)
+	if updates, err := smartSocket.TrackDevices(ctx); err != nil {
+		logger.Error(fmt.Sprintf("Can't track the shared devices' state, guests won't be told when they go offline: %s", err))
+	} else {
+		go trackDeviceStates(client, smartSocket, shared, updates, onEvent)
+	}
+
+	multiplexer := relay.NewOwnerMultiplexer(smartSocket, devices, client, logger)
 	defer multiplexer.Close()
+	room := &ownerRoom{
+		roomId:        roomId,
+		client:        client,
+		multiplexer:   multiplexer,
+		shared:        shared,
+		ownerIdentity: ownerIdentity,
+		promptAccept:  promptAccept,
+		onEvent:       onEvent,
+		observer:      observer,
+		rejoins:       newTrustedRejoins(options.RejoinWindow),
+		leases:        options.Leases,
+		kicker:        options.Kicker,
+		chat:          options.Chat,
+	}
+	filter := options.ServiceFilter
+	// A lease ending removes the guest from the room the way a kick does,
+	// which takes a Kicker even if the caller has no use for one.
+	if room.kicker == nil && room.leases != nil {
+		room.kicker = NewKicker()
+	}
+	if room.leases != nil {
+		room.leases.attach(client, onEvent, func(reason string) {
+			if err := room.kicker.Kick(reason); err != nil && !errors.Is(err, ErrNoGuest) {
+				logger.Error(fmt.Sprintf("Failed to remove the guest whose lease ended: %s", err))
+			}
+		})
+		defer room.leases.guestLeft()
+		filter = policy.Chain(room.leases, options.ServiceFilter)
+	}
+	if room.kicker != nil {
+		room.kicker.attach(client, onEvent, func() {
+			// Only one guest is ever active at a time, so every open stream
+			// is the kicked guest's.
+			multiplexer.Close()
+			room.rejoins.forget()
+			room.leases.guestLeft()
+			room.chat.left()
+		})
+		defer room.kicker.guestLeft()
+	}
+	if room.chat != nil {
+		room.chat.attach(client, ownerIdentity, roomId, func(guestClientId string, text string, sentAt time.Time) {
+			emitOwner(onEvent, OwnerEvent{Kind: OwnerChatMessage, GuestClientId: guestClientId, Text: text, SentAt: sentAt})
+		})
+		defer room.chat.left()
+	}
+	if filter != nil {
+		multiplexer.SetServiceFilter(filter, func(service string, reason error) {
+			emitOwner(onEvent, OwnerEvent{Kind: OwnerServiceDenied, Service: service, Err: reason})
+		})
+	}
+	if observer != nil {
+		multiplexer.SetStreamObserver(observer)
+	}
 
 	for {
 		select {
@@ -44,14 +225,36 @@ func JoinAsRoomOwner(ctx context.Context, client *transportLayer.Client, smartSo
 			if !ok {
 				return relay.ErrTransportClosed
 			}
-			dispatchOwnerMessage(client, multiplexer, ownerIdentity, promptAccept, onEvent, container)
+			if options.Publish != nil && handlePublishRoomResponse(client, container, options.Publish.Team, onEvent) {
+				continue
+			}
+			dispatchOwnerMessage(room, container)
 		}
 	}
 }
 
+// ownerRoom is the state JoinAsRoomOwner serves a room with, shared by
+// the handlers of the messages it gets. leases, kicker and chat are nil
+// when the room goes without them.
+type ownerRoom struct {
+	roomId        string
+	client        *transportLayer.Client
+	multiplexer   *relay.OwnerMultiplexer
+	shared        *sharedDevices
+	ownerIdentity *identity.Identity
+	promptAccept  AcceptPromptFunc
+	onEvent       OwnerEventFunc
+	observer      SessionObserver
+	rejoins       *trustedRejoins
+	leases        *Leases
+	kicker        *Kicker
+	chat          *Chat
+}
+
 // dispatchOwnerMessage routes a single incoming message either to the ADB
 // stream multiplexer or to the room join-request flow.
-func dispatchOwnerMessage(client *transportLayer.Client, multiplexer *relay.OwnerMultiplexer, ownerIdentity *identity.Identity, promptAccept AcceptPromptFunc, onEvent OwnerEventFunc, container *transportLayer.MessageContainer) {
+func dispatchOwnerMessage(room *ownerRoom, container *transportLayer.MessageContainer) {
+	client := room.client
 	logger := client.Logger
 
 	message, err := container.Data()
@@ -63,7 +266,7 @@ func dispatchOwnerMessage(client *transportLayer.Client, multiplexer *relay.Owne
 
 	switch message.Command() {
 	case protocol.CommandAdbTransport:
-		multiplexer.Dispatch(container) // disposes container itself
+		room.multiplexer.Dispatch(container) // disposes container itself
 	case protocol.CommandJoinRoom:
 		defer container.Dispose()
 		payload, err := message.GetPayloadConnectRoom()
@@ -74,27 +277,105 @@ func dispatchOwnerMessage(client *transportLayer.Client, multiplexer *relay.Owne
 			}
 			return
 		}
-		emitOwner(onEvent, OwnerEvent{Kind: OwnerJoinRequested, GuestClientId: payload.ClientId, GuestPublicKey: payload.PublicKey})
+		// Nothing about the guest's identity is to be trusted, let alone
+		// compared against an accept policy, before its signature is.
+		request, err := verifyJoinRequest(room.roomId, payload)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Declining the join request from %s: %s", payload.ClientId, err))
+			emitOwner(room.onEvent, OwnerEvent{Kind: OwnerJoinFailed, GuestClientId: payload.ClientId, Err: err})
+			if err := client.SendJoinRoomResponse(0, room.ownerIdentity.PublicKey, nil, nil); err != nil {
+				logger.Error(fmt.Sprintf("Failed to decline the join request from %s: %s", payload.ClientId, err))
+			}
+			return
+		}
+		// A guest whose lease ended is asked about again like anybody else.
+		if !room.leases.endedFor(request) && room.rejoins.trusted(request) {
+			logger.Info(fmt.Sprintf("%s is the guest that just left, letting it back in without asking", request.clientId))
+			go handleJoinRequest(room, request.clientId, request.publicKey, true)
+			return
+		}
+		emitOwner(room.onEvent, OwnerEvent{Kind: OwnerJoinRequested, GuestClientId: request.clientId, GuestPublicKey: request.publicKey})
 		// promptAccept commonly blocks on user input; run it off the
 		// dispatch loop so an already-connected guest's ADB traffic keeps
 		// flowing while the operator decides.
-		go handleJoinRequest(client, ownerIdentity, promptAccept, onEvent, payload.ClientId, payload.PublicKey)
+		go handleJoinRequest(room, request.clientId, request.publicKey, false)
 	case protocol.CommandGuestLeft:
 		defer container.Dispose()
 		logger.Info("The guest left the room")
 		// Only one guest is ever active at a time, so every currently open
 		// stream necessarily belonged to it.
-		multiplexer.Close()
-		emitOwner(onEvent, OwnerEvent{Kind: OwnerGuestLeft})
+		room.multiplexer.Close()
+		room.rejoins.guestLeft()
+		room.leases.guestLeft()
+		room.kicker.guestLeft()
+		room.chat.left()
+		if room.observer != nil {
+			room.observer.GuestLeft()
+		}
+		emitOwner(room.onEvent, OwnerEvent{Kind: OwnerGuestLeft})
+	case protocol.CommandJoinQueue:
+		defer container.Dispose()
+		payload, err := message.GetPayloadJoinQueue()
+		if err != nil {
+			logger.Error(fmt.Sprintf("Invalid join queue payload: %s", err))
+			return
+		}
+		emitOwner(room.onEvent, OwnerEvent{Kind: OwnerJoinQueueChanged, Queue: payload.GuestClientIds})
+	case protocol.CommandChatMessage:
+		defer container.Dispose()
+		payload, err := message.GetPayloadChatMessage()
+		if err != nil {
+			logger.Error(fmt.Sprintf("Invalid chat message payload: %s", err))
+			return
+		}
+		room.chat.receive(payload)
 	default:
 		defer container.Dispose()
 		logger.Info(fmt.Sprintf("Ignoring unexpected message, command: %x", message.Command()))
 	}
 }
 
-func handleJoinRequest(client *transportLayer.Client, ownerIdentity *identity.Identity, promptAccept AcceptPromptFunc, onEvent OwnerEventFunc, guestClientId string, guestPublicKey []byte) {
+// ErrInvalidJoinSignature is reported, as an OwnerJoinFailed event, for a
+// join request that isn't signed by the identity it presents; it's
+// declined without promptAccept being asked.
+var ErrInvalidJoinSignature = errors.New("the join request isn't signed by the identity it presents")
+
+// joinRequest is a join request whose signature verified: publicKey is
+// the identity of the guest that asked to join as clientId.
+type joinRequest struct {
+	clientId  string
+	publicKey ed25519.PublicKey
+}
+
+// verifyJoinRequest checks that payload, a request to join roomId, is
+// signed by the identity it presents, for the client id it comes from
+// (see protocol.RoomJoinMessage).
+func verifyJoinRequest(roomId string, payload *protocol.TransporterMessagePayloadConnectRoom) (*joinRequest, error) {
+	if len(payload.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(payload.PublicKey, protocol.RoomJoinMessage(roomId, payload.ClientId), payload.Signature) {
+		return nil, ErrInvalidJoinSignature
+	}
+	return &joinRequest{clientId: payload.ClientId, publicKey: ed25519.PublicKey(payload.PublicKey)}, nil
+}
+
+// acceptRejoin is the AcceptPromptFunc of trusted re-joins.
+func acceptRejoin(string, []byte) (bool, error) {
+	return true, nil
+}
+
+// handleJoinRequest decides guestClientId's join request with the room's
+// promptAccept and answers it, granting an accepted guest its lease (if
+// the room has leases); rejoined tells it's a trusted re-join (see
+// OwnerOptions.RejoinWindow), accepted without asking, for
+// OwnerJoinDecided to say so and for the guest to carry on with the lease
+// it had.
+func handleJoinRequest(room *ownerRoom, guestClientId string, guestPublicKey []byte, rejoined bool) {
+	client, shared, onEvent := room.client, room.shared, room.onEvent
 	logger := client.Logger
 
+	promptAccept := room.promptAccept
+	if rejoined {
+		promptAccept = acceptRejoin
+	}
 	accepted, err := promptAccept(guestClientId, guestPublicKey)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error while deciding whether to accept the join request from %s: %s", guestClientId, err))
@@ -109,16 +390,113 @@ func handleJoinRequest(client *transportLayer.Client, ownerIdentity *identity.Id
 	if accepted {
 		isAccepted = 1
 	}
-	if err := client.SendJoinRoomResponse(isAccepted, ownerIdentity.PublicKey); err != nil {
+	if err := client.SendJoinRoomResponse(isAccepted, room.ownerIdentity.PublicKey, shared.serials, shared.featureLists()); err != nil {
 		logger.Error(fmt.Sprintf("Failed to send the join room response for %s: %s", guestClientId, err))
 		emitOwner(onEvent, OwnerEvent{Kind: OwnerJoinFailed, GuestClientId: guestClientId, Err: err})
 		return
 	}
-	emitOwner(onEvent, OwnerEvent{Kind: OwnerJoinDecided, GuestClientId: guestClientId, GuestPublicKey: guestPublicKey, Accepted: accepted})
+	if accepted {
+		room.rejoins.accepted(guestPublicKey)
+		room.kicker.joined(guestClientId)
+		room.chat.joined(guestClientId, guestPublicKey)
+	}
+	if accepted && room.observer != nil {
+		room.observer.GuestJoined(guestClientId, identity.Fingerprint(guestPublicKey))
+	}
+	emitOwner(onEvent, OwnerEvent{Kind: OwnerJoinDecided, GuestClientId: guestClientId, GuestPublicKey: guestPublicKey, Accepted: accepted, Rejoined: rejoined})
+	if accepted {
+		// Tell the guest what the devices are, for its proxies to present
+		// them as such, and, since it assumes every device is online, about
+		// those that went offline before it joined.
+		for index, info := range shared.info() {
+			if err := client.SendDeviceInfo(index, info); err != nil {
+				logger.Error(fmt.Sprintf("Failed to send %s's details to the new guest: %s", shared.serials[index], err))
+			}
+		}
+		for _, change := range shared.unavailable() {
+			if err := client.SendDeviceState(change.index, change.state); err != nil {
+				logger.Error(fmt.Sprintf("Failed to send %s's state to the new guest: %s", change.serial, err))
+			}
+		}
+		room.leases.start(guestClientId, guestPublicKey, rejoined)
+	}
+}
+
+// loadDeviceInfo looks up what every shared device is and which adb
+// features it supports. A device that can't be looked up is just presented
+// generically to guests.
+func loadDeviceInfo(smartSocket adb.IAdbSmartSocket, shared *sharedDevices, logger *slog.Logger) {
+	deviceList, err := smartSocket.DeviceList()
+	if err != nil {
+		logger.Error(fmt.Sprintf("Can't list devices to look up the shared devices' details: %s", err))
+		return
+	}
+	for index, serial := range shared.serials {
+		for _, device := range deviceList {
+			if device.Id == serial {
+				shared.setInfo(index, queryDeviceInfo(smartSocket, device, logger))
+				shared.setFeatures(index, queryFeatures(smartSocket, device, logger))
+				break
+			}
+		}
+	}
+}
+
+func queryDeviceInfo(smartSocket adb.IAdbSmartSocket, device adb.Device, logger *slog.Logger) adb.DeviceInfo {
+	info, err := adb.QueryDeviceInfo(smartSocket, device)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Can't read %s's properties: %s", device.Id, err))
+	}
+	return info
 }
 
-func createRoom(client *transportLayer.Client) (string, error) {
-	if err := client.SendCreateRoom(); err != nil {
+func queryFeatures(smartSocket adb.IAdbSmartSocket, device adb.Device, logger *slog.Logger) []string {
+	features, err := smartSocket.Features(device.Id)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Can't read %s's adb features: %s", device.Id, err))
+	}
+	return features
+}
+
+// trackDeviceStates follows the adb server's device list updates until
+// updates is closed, reporting every shared device going offline or coming
+// back through onEvent and to the room's guest, if any. A device coming
+// back is looked up again, since it may have been replugged as a different
+// build.
+func trackDeviceStates(client *transportLayer.Client, smartSocket adb.IAdbSmartSocket, shared *sharedDevices, updates <-chan []adb.Device, onEvent OwnerEventFunc) {
+	logger := client.Logger
+	for deviceList := range updates {
+		for _, change := range shared.update(deviceList) {
+			logger.Info(fmt.Sprintf("Shared device %s is now %s", change.serial, change.state))
+			kind := OwnerDeviceOffline
+			if change.online() {
+				kind = OwnerDeviceOnline
+			}
+			emitOwner(onEvent, OwnerEvent{Kind: kind, Device: change.serial, DeviceState: change.state})
+			if change.online() {
+				info := queryDeviceInfo(smartSocket, change.entry, logger)
+				shared.setInfo(change.index, info)
+				shared.setFeatures(change.index, queryFeatures(smartSocket, change.entry, logger))
+				if err := client.SendDeviceInfo(change.index, info); err != nil {
+					logger.Error(fmt.Sprintf("Failed to tell the guest about %s's details: %s", change.serial, err))
+				}
+			}
+			if err := client.SendDeviceState(change.index, change.state); err != nil {
+				logger.Error(fmt.Sprintf("Failed to tell the guest about %s's state: %s", change.serial, err))
+			}
+		}
+	}
+}
+
+// createRoom asks the transporter for a room: roomId, signed for by
+// ownerIdentity, or a random one if roomId is empty.
+func createRoom(client *transportLayer.Client, ownerIdentity *identity.Identity, roomId string) (string, error) {
+	var publicKey, signature []byte
+	if roomId != "" {
+		publicKey = ownerIdentity.PublicKey
+		signature = ed25519.Sign(ownerIdentity.PrivateKey, protocol.RoomReservationMessage(roomId, client.ClientId()))
+	}
+	if err := client.SendCreateRoom(roomId, publicKey, signature); err != nil {
 		return "", err
 	}
 
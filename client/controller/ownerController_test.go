@@ -2,13 +2,16 @@ package controller
 
 import (
 	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/identity"
 	"adb-remote.maci.team/shared/protocol"
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"slices"
 	"sync"
 	"testing"
 	"time"
@@ -32,14 +35,26 @@ func respondToCreateRoom(t *testing.T, server net.Conn, roomId string) {
 
 func sendJoinRoomRequest(t *testing.T, server net.Conn, roomId string, guestClientId string) {
 	t.Helper()
-	sendJoinRoomRequestWithKey(t, server, roomId, guestClientId, nil)
+	sendJoinRoomRequestFrom(t, server, roomId, guestClientId, testIdentity(t))
 }
 
-func sendJoinRoomRequestWithKey(t *testing.T, server net.Conn, roomId string, guestClientId string, publicKey []byte) {
+// sendJoinRoomRequestFrom sends guestIdentity's request to join roomId as
+// guestClientId, signed the way a guest signs it.
+func sendJoinRoomRequestFrom(t *testing.T, server net.Conn, roomId string, guestClientId string, guestIdentity *identity.Identity) {
+	t.Helper()
+	sendJoinRoomPayload(t, server, &protocol.TransporterMessagePayloadConnectRoom{
+		RoomId:    roomId,
+		ClientId:  guestClientId,
+		PublicKey: guestIdentity.PublicKey,
+		Signature: ed25519.Sign(guestIdentity.PrivateKey, protocol.RoomJoinMessage(roomId, guestClientId)),
+	})
+}
+
+func sendJoinRoomPayload(t *testing.T, server net.Conn, payload *protocol.TransporterMessagePayloadConnectRoom) {
 	t.Helper()
 	request := protocol.CreateTransporterMessage()
 	request.SetDirectCommand(protocol.CommandJoinRoom)
-	if err := request.SetPayloadConnectRoom(&protocol.TransporterMessagePayloadConnectRoom{RoomId: roomId, ClientId: guestClientId, PublicKey: publicKey}); err != nil {
+	if err := request.SetPayloadConnectRoom(payload); err != nil {
 		t.Fatalf("SetPayloadConnectRoom failed: %s", err)
 	}
 	if err := request.Write(server); err != nil {
@@ -54,6 +69,12 @@ func expectJoinResponse(t *testing.T, server net.Conn) int {
 }
 
 func expectJoinResponseWithKey(t *testing.T, server net.Conn) (accepted int, ownerClientId string, ownerPublicKey []byte) {
+	t.Helper()
+	payload := expectJoinResponsePayload(t, server)
+	return payload.Accepted, payload.ClientId, payload.PublicKey
+}
+
+func expectJoinResponsePayload(t *testing.T, server net.Conn) *protocol.TransporterMessagePayloadConnectRoomResult {
 	t.Helper()
 	response := readMessage(t, server)
 	if response.Command() != protocol.CommandJoinRoom|protocol.CommandResponseMask {
@@ -63,15 +84,15 @@ func expectJoinResponseWithKey(t *testing.T, server net.Conn) (accepted int, own
 	if err != nil {
 		t.Fatalf("GetPayloadConnectRoomResponse failed: %s", err)
 	}
-	return payload.Accepted, payload.ClientId, payload.PublicKey
+	return payload
 }
 
 func sendAdbTransport(t *testing.T, server net.Conn, adbMessage *adb.AdbMessage) {
 	t.Helper()
 	wrapper := protocol.CreateTransporterMessage()
 	wrapper.SetDirectCommand(protocol.CommandAdbTransport)
-	if err := wrapper.SetRawPayload(adbMessage.Bytes()); err != nil {
-		t.Fatalf("SetRawPayload failed: %s", err)
+	if err := wrapper.SetPayloadAdbTransport(&protocol.TransporterMessagePayloadAdbTransport{Message: adbMessage.Bytes()}); err != nil {
+		t.Fatalf("SetPayloadAdbTransport failed: %s", err)
 	}
 	if err := wrapper.Write(server); err != nil {
 		t.Fatalf("failed to write the wrapped ADB message: %s", err)
@@ -87,7 +108,11 @@ func expectAdbTransport(t *testing.T, server net.Conn) *adb.AdbMessage {
 	if forwarded.Command() != protocol.CommandAdbTransport {
 		t.Fatalf("expected command %x, got %x", protocol.CommandAdbTransport, forwarded.Command())
 	}
-	decoded, err := adb.DecodeMessage(forwarded.Payload())
+	payload, err := forwarded.GetPayloadAdbTransport()
+	if err != nil {
+		t.Fatalf("GetPayloadAdbTransport failed: %s", err)
+	}
+	decoded, err := adb.DecodeMessage(payload.Message)
 	if err != nil {
 		t.Fatalf("DecodeMessage failed: %s", err)
 	}
@@ -102,7 +127,7 @@ func TestCreateRoomSuccess(t *testing.T) {
 		err    error
 	}, 1)
 	go func() {
-		roomId, err := createRoom(client)
+		roomId, err := createRoom(client, testIdentity(t), "")
 		done <- struct {
 			roomId string
 			err    error
@@ -120,6 +145,41 @@ func TestCreateRoomSuccess(t *testing.T) {
 	}
 }
 
+func TestCreateRoomSignsReservedRoomId(t *testing.T) {
+	client, server := newConnectedClient(t)
+	client.SetClientId("ABCD1234")
+	ownerIdentity := testIdentity(t)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := createRoom(client, ownerIdentity, "lab-pixel")
+		done <- err
+	}()
+
+	request := readMessage(t, server)
+	payload, err := request.GetPayloadCreateRoom()
+	if err != nil {
+		t.Fatalf("GetPayloadCreateRoom failed: %s", err)
+	}
+	if payload.RoomId != "lab-pixel" || !bytes.Equal(payload.PublicKey, ownerIdentity.PublicKey) {
+		t.Fatalf("unexpected create room request: %+v", payload)
+	}
+	if !ed25519.Verify(ownerIdentity.PublicKey, protocol.RoomReservationMessage("lab-pixel", "ABCD1234"), payload.Signature) {
+		t.Fatalf("expected the request to be signed for this connection's client id")
+	}
+	response := protocol.CreateTransporterMessage()
+	response.SetErrorResponseCommand(protocol.CommandCreateRoom)
+	if err := response.SetErrorPayload(&protocol.TransporterMessagePayloadError{ErrorCode: protocol.ErrorRoomReserved, ErrorMessage: "reserved"}); err != nil {
+		t.Fatalf("SetErrorPayload failed: %s", err)
+	}
+	if err := response.Write(server); err != nil {
+		t.Fatalf("failed to write the response: %s", err)
+	}
+	if err := <-done; err == nil {
+		t.Fatalf("expected createRoom to fail when the room id is reserved")
+	}
+}
+
 func TestHandleJoinRequestAccepted(t *testing.T) {
 	client, server := newConnectedClient(t)
 	ownerIdentity := testIdentity(t)
@@ -127,20 +187,35 @@ func TestHandleJoinRequestAccepted(t *testing.T) {
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
-		handleJoinRequest(client, ownerIdentity, func(clientId string, publicKey []byte) (bool, error) {
-			if clientId != "GUEST1" {
-				t.Errorf("expected guest client id %q, got %q", "GUEST1", clientId)
-			}
-			return true, nil
-		}, nil, "GUEST1", nil)
+		shared := newSharedDevices([]string{"emulator-5554", "R58M123"})
+		shared.setFeatures(0, []string{"shell_v2", "cmd"})
+		room := &ownerRoom{
+			client:        client,
+			shared:        shared,
+			ownerIdentity: ownerIdentity,
+			promptAccept: func(clientId string, publicKey []byte) (bool, error) {
+				if clientId != "GUEST1" {
+					t.Errorf("expected guest client id %q, got %q", "GUEST1", clientId)
+				}
+				return true, nil
+			},
+			rejoins: newTrustedRejoins(0),
+		}
+		handleJoinRequest(room, "GUEST1", nil, false)
 	}()
 
-	accepted, _, ownerPublicKey := expectJoinResponseWithKey(t, server)
-	if accepted != 1 {
-		t.Fatalf("expected Accepted=1, got %d", accepted)
+	payload := expectJoinResponsePayload(t, server)
+	if payload.Accepted != 1 {
+		t.Fatalf("expected Accepted=1, got %d", payload.Accepted)
+	}
+	if !bytes.Equal(payload.PublicKey, ownerIdentity.PublicKey) {
+		t.Fatalf("expected the response to carry the owner's public key %x, got %x", []byte(ownerIdentity.PublicKey), payload.PublicKey)
 	}
-	if !bytes.Equal(ownerPublicKey, ownerIdentity.PublicKey) {
-		t.Fatalf("expected the response to carry the owner's public key %x, got %x", []byte(ownerIdentity.PublicKey), ownerPublicKey)
+	if len(payload.Devices) != 2 || payload.Devices[0] != "emulator-5554" || payload.Devices[1] != "R58M123" {
+		t.Fatalf("expected the response to list the shared devices, got %v", payload.Devices)
+	}
+	if len(payload.Features) != 2 || payload.Features[0] != "shell_v2,cmd" || payload.Features[1] != "" {
+		t.Fatalf("expected the response to carry each device's features, got %q", payload.Features)
 	}
 	<-done
 }
@@ -152,7 +227,14 @@ func TestHandleJoinRequestDeclined(t *testing.T) {
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
-		handleJoinRequest(client, ownerIdentity, func(clientId string, publicKey []byte) (bool, error) { return false, nil }, nil, "GUEST1", nil)
+		room := &ownerRoom{
+			client:        client,
+			shared:        newSharedDevices([]string{"emulator-5554"}),
+			ownerIdentity: ownerIdentity,
+			promptAccept:  func(clientId string, publicKey []byte) (bool, error) { return false, nil },
+			rejoins:       newTrustedRejoins(0),
+		}
+		handleJoinRequest(room, "GUEST1", nil, false)
 	}()
 
 	if accepted := expectJoinResponse(t, server); accepted != 0 {
@@ -161,6 +243,60 @@ func TestHandleJoinRequestDeclined(t *testing.T) {
 	<-done
 }
 
+// TestJoinAsRoomOwnerDeclinesUnsignedJoinRequests checks that a join
+// request presenting a trusted guest's public key isn't accepted, nor
+// asked about, unless it's signed by that guest for the client id it comes
+// from: the key alone is public, so anybody can present it.
+func TestJoinAsRoomOwnerDeclinesUnsignedJoinRequests(t *testing.T) {
+	client, server := newConnectedClient(t)
+	events := make(chan OwnerEvent, 10)
+	trustedIdentity, otherIdentity := testIdentity(t), testIdentity(t)
+
+	var promptsMu sync.Mutex
+	var prompts []string
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		// Accepting by fingerprint, the way an accept policy does.
+		_ = JoinAsRoomOwner(ctx, client, newFakeSmartSocket(), []string{"emulator-5554"}, testIdentity(t), func(clientId string, publicKey []byte) (bool, error) {
+			promptsMu.Lock()
+			defer promptsMu.Unlock()
+			prompts = append(prompts, clientId)
+			return identity.Fingerprint(publicKey) == identity.Fingerprint(trustedIdentity.PublicKey), nil
+		}, func(e OwnerEvent) { events <- e }, OwnerOptions{})
+	}()
+
+	respondToCreateRoom(t, server, "ROOM7")
+	expectOwnerEvent(t, events) // OwnerRoomCreated
+
+	for name, signature := range map[string][]byte{
+		"no signature":                 nil,
+		"signed by another identity":   ed25519.Sign(otherIdentity.PrivateKey, protocol.RoomJoinMessage("ROOM7", "IMPOSTOR")),
+		"signed for another client id": ed25519.Sign(trustedIdentity.PrivateKey, protocol.RoomJoinMessage("ROOM7", "GUEST1")),
+		"signed for another room":      ed25519.Sign(trustedIdentity.PrivateKey, protocol.RoomJoinMessage("ROOM8", "IMPOSTOR")),
+		"signature of the wrong size":  []byte("signature"),
+	} {
+		sendJoinRoomPayload(t, server, &protocol.TransporterMessagePayloadConnectRoom{RoomId: "ROOM7", ClientId: "IMPOSTOR", PublicKey: trustedIdentity.PublicKey, Signature: signature})
+		if accepted := expectJoinResponse(t, server); accepted != 0 {
+			t.Fatalf("%s: expected the join request to be declined, got Accepted=%d", name, accepted)
+		}
+		if event := expectOwnerEvent(t, events); event.Kind != OwnerJoinFailed || !errors.Is(event.Err, ErrInvalidJoinSignature) {
+			t.Fatalf("%s: expected OwnerJoinFailed with ErrInvalidJoinSignature, got %+v", name, event)
+		}
+	}
+
+	sendJoinRoomRequestFrom(t, server, "ROOM7", "GUEST1", trustedIdentity)
+	if accepted := expectJoinResponse(t, server); accepted != 1 {
+		t.Fatalf("expected the trusted guest's signed join request to be accepted, got Accepted=%d", accepted)
+	}
+
+	promptsMu.Lock()
+	defer promptsMu.Unlock()
+	if len(prompts) != 1 || prompts[0] != "GUEST1" {
+		t.Fatalf("expected promptAccept to be asked about GUEST1 only, got %v", prompts)
+	}
+}
+
 // fakeSmartSocket hands out a preconfigured net.Conn per requested service,
 // standing in for connections to the local device.
 type fakeSmartSocket struct {
@@ -168,6 +304,12 @@ type fakeSmartSocket struct {
 
 	mu        sync.Mutex
 	byService map[string]net.Conn
+	// tracked, if set, feeds TrackDevices; otherwise tracking fails.
+	tracked chan []adb.Device
+	// deviceList is what DeviceList reports.
+	deviceList []adb.Device
+	// features is what Features reports, by serial.
+	features map[string][]string
 }
 
 func newFakeSmartSocket() *fakeSmartSocket {
@@ -191,6 +333,51 @@ func (f *fakeSmartSocket) OpenStream(targetSerial string, service string) (net.C
 	return conn, nil
 }
 
+func (f *fakeSmartSocket) DeviceList() ([]adb.Device, error) {
+	return f.deviceList, nil
+}
+
+func (f *fakeSmartSocket) Features(targetSerial string) ([]string, error) {
+	features, ok := f.features[targetSerial]
+	if !ok {
+		return nil, fmt.Errorf("no fake features configured for %s", targetSerial)
+	}
+	return features, nil
+}
+
+func (f *fakeSmartSocket) TrackDevices(ctx context.Context) (<-chan []adb.Device, error) {
+	if f.tracked == nil {
+		return nil, errors.New("device tracking not supported by this fake")
+	}
+	return f.tracked, nil
+}
+
+func expectDeviceState(t *testing.T, server net.Conn) *protocol.TransporterMessagePayloadDeviceState {
+	t.Helper()
+	message := readMessage(t, server)
+	if message.Command() != protocol.CommandDeviceState {
+		t.Fatalf("expected a device state message, got %x", message.Command())
+	}
+	payload, err := message.GetPayloadDeviceState()
+	if err != nil {
+		t.Fatalf("GetPayloadDeviceState failed: %s", err)
+	}
+	return payload
+}
+
+func expectDeviceInfo(t *testing.T, server net.Conn) *protocol.TransporterMessagePayloadDeviceInfo {
+	t.Helper()
+	message := readMessage(t, server)
+	if message.Command() != protocol.CommandDeviceInfo {
+		t.Fatalf("expected a device info message, got %x", message.Command())
+	}
+	payload, err := message.GetPayloadDeviceInfo()
+	if err != nil {
+		t.Fatalf("GetPayloadDeviceInfo failed: %s", err)
+	}
+	return payload
+}
+
 func expectOwnerEvent(t *testing.T, events <-chan OwnerEvent) OwnerEvent {
 	t.Helper()
 	select {
@@ -219,9 +406,9 @@ func TestJoinAsRoomOwnerRelaysAdbTraffic(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	done := make(chan error, 1)
 	go func() {
-		done <- JoinAsRoomOwner(ctx, client, smartSocket, "emulator-5554", ownerIdentity, func(clientId string, publicKey []byte) (bool, error) {
+		done <- JoinAsRoomOwner(ctx, client, smartSocket, []string{"emulator-5554"}, ownerIdentity, func(clientId string, publicKey []byte) (bool, error) {
 			return true, nil
-		}, onEvent)
+		}, onEvent, OwnerOptions{})
 	}()
 
 	// The room id and the guest's join request/decision must have been
@@ -233,8 +420,8 @@ func TestJoinAsRoomOwnerRelaysAdbTraffic(t *testing.T) {
 		t.Fatalf("expected OwnerRoomCreated with room id ROOM7, got %+v", roomCreated)
 	}
 
-	guestPublicKey := []byte{0xaa, 0xbb, 0xcc}
-	sendJoinRoomRequestWithKey(t, server, "ROOM7", "GUEST1", guestPublicKey)
+	guestIdentity := testIdentity(t)
+	sendJoinRoomRequestFrom(t, server, "ROOM7", "GUEST1", guestIdentity)
 	accepted, _, responsePublicKey := expectJoinResponseWithKey(t, server)
 	if accepted != 1 {
 		t.Fatalf("expected the join request to be accepted, got Accepted=%d", accepted)
@@ -242,20 +429,21 @@ func TestJoinAsRoomOwnerRelaysAdbTraffic(t *testing.T) {
 	if !bytes.Equal(responsePublicKey, ownerIdentity.PublicKey) {
 		t.Fatalf("expected the join response to carry the owner's public key %x, got %x", []byte(ownerIdentity.PublicKey), responsePublicKey)
 	}
+	expectDeviceInfo(t, server)
 
 	joinRequested := expectOwnerEvent(t, events)
 	if joinRequested.Kind != OwnerJoinRequested || joinRequested.GuestClientId != "GUEST1" {
 		t.Fatalf("expected a join request event from GUEST1, got %+v", joinRequested)
 	}
-	if !bytes.Equal(joinRequested.GuestPublicKey, guestPublicKey) {
-		t.Fatalf("expected the join request event to carry the guest's public key %x, got %x", guestPublicKey, joinRequested.GuestPublicKey)
+	if !bytes.Equal(joinRequested.GuestPublicKey, guestIdentity.PublicKey) {
+		t.Fatalf("expected the join request event to carry the guest's public key %x, got %x", []byte(guestIdentity.PublicKey), joinRequested.GuestPublicKey)
 	}
 	joinDecided := expectOwnerEvent(t, events)
 	if joinDecided.Kind != OwnerJoinDecided || joinDecided.GuestClientId != "GUEST1" || !joinDecided.Accepted {
 		t.Fatalf("expected GUEST1 to be reported as accepted, got %+v", joinDecided)
 	}
-	if !bytes.Equal(joinDecided.GuestPublicKey, guestPublicKey) {
-		t.Fatalf("expected the join decided event to carry the guest's public key %x, got %x", guestPublicKey, joinDecided.GuestPublicKey)
+	if !bytes.Equal(joinDecided.GuestPublicKey, guestIdentity.PublicKey) {
+		t.Fatalf("expected the join decided event to carry the guest's public key %x, got %x", []byte(guestIdentity.PublicKey), joinDecided.GuestPublicKey)
 	}
 
 	// Guest opens a stream.
@@ -373,9 +561,9 @@ func TestJoinAsRoomOwnerHandlesGuestLeft(t *testing.T) {
 	defer cancel()
 	done := make(chan error, 1)
 	go func() {
-		done <- JoinAsRoomOwner(ctx, client, smartSocket, "emulator-5554", ownerIdentity, func(clientId string, publicKey []byte) (bool, error) {
+		done <- JoinAsRoomOwner(ctx, client, smartSocket, []string{"emulator-5554"}, ownerIdentity, func(clientId string, publicKey []byte) (bool, error) {
 			return true, nil
-		}, onEvent)
+		}, onEvent, OwnerOptions{})
 	}()
 
 	respondToCreateRoom(t, server, "ROOM7")
@@ -383,6 +571,7 @@ func TestJoinAsRoomOwnerHandlesGuestLeft(t *testing.T) {
 
 	sendJoinRoomRequest(t, server, "ROOM7", "GUEST1")
 	expectJoinResponse(t, server)
+	expectDeviceInfo(t, server)
 	expectOwnerEvent(t, events) // OwnerJoinRequested
 	expectOwnerEvent(t, events) // OwnerJoinDecided
 
@@ -428,6 +617,166 @@ func TestJoinAsRoomOwnerHandlesGuestLeft(t *testing.T) {
 	}
 }
 
+// TestJoinAsRoomOwnerReportsTheJoinQueue checks that the guests waiting to
+// join a busy room are reported.
+func TestJoinAsRoomOwnerReportsTheJoinQueue(t *testing.T) {
+	client, server := newConnectedClient(t)
+	events := make(chan OwnerEvent, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = JoinAsRoomOwner(ctx, client, newFakeSmartSocket(), []string{"emulator-5554"}, testIdentity(t), func(clientId string, publicKey []byte) (bool, error) {
+			return true, nil
+		}, func(e OwnerEvent) { events <- e }, OwnerOptions{})
+	}()
+
+	respondToCreateRoom(t, server, "ROOM7")
+	expectOwnerEvent(t, events) // OwnerRoomCreated
+
+	queue := protocol.CreateTransporterMessage()
+	queue.SetDirectCommand(protocol.CommandJoinQueue)
+	if err := queue.SetPayloadJoinQueue(&protocol.TransporterMessagePayloadJoinQueue{GuestClientIds: []string{"GUEST2", "GUEST3"}}); err != nil {
+		t.Fatalf("SetPayloadJoinQueue failed: %s", err)
+	}
+	if err := queue.Write(server); err != nil {
+		t.Fatalf("failed to write the join queue: %s", err)
+	}
+	if event := expectOwnerEvent(t, events); event.Kind != OwnerJoinQueueChanged || !slices.Equal(event.Queue, []string{"GUEST2", "GUEST3"}) {
+		t.Fatalf("expected OwnerJoinQueueChanged with GUEST2 and GUEST3, got %+v", event)
+	}
+}
+
+// TestJoinAsRoomOwnerLetsTheGuestThatLeftRejoin checks that with a
+// RejoinWindow, the accepted guest that left is let back in without
+// promptAccept being asked, while anyone else still is.
+func TestJoinAsRoomOwnerLetsTheGuestThatLeftRejoin(t *testing.T) {
+	client, server := newConnectedClient(t)
+	events := make(chan OwnerEvent, 10)
+	onEvent := func(e OwnerEvent) { events <- e }
+	ownerIdentity := testIdentity(t)
+	guestIdentity, otherIdentity := testIdentity(t), testIdentity(t)
+
+	var promptsMu sync.Mutex
+	var prompts []string
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- JoinAsRoomOwner(ctx, client, newFakeSmartSocket(), []string{"emulator-5554"}, ownerIdentity, func(clientId string, publicKey []byte) (bool, error) {
+			promptsMu.Lock()
+			defer promptsMu.Unlock()
+			prompts = append(prompts, clientId)
+			return clientId == "GUEST1", nil
+		}, onEvent, OwnerOptions{RejoinWindow: time.Minute})
+	}()
+
+	respondToCreateRoom(t, server, "ROOM7")
+	expectOwnerEvent(t, events) // OwnerRoomCreated
+
+	sendJoinRoomRequestFrom(t, server, "ROOM7", "GUEST1", guestIdentity)
+	if accepted := expectJoinResponse(t, server); accepted != 1 {
+		t.Fatalf("expected the guest to be accepted, got Accepted=%d", accepted)
+	}
+	expectDeviceInfo(t, server)
+	expectOwnerEvent(t, events) // OwnerJoinRequested
+	expectOwnerEvent(t, events) // OwnerJoinDecided
+
+	guestLeft := protocol.CreateTransporterMessage()
+	guestLeft.SetDirectCommand(protocol.CommandGuestLeft)
+	if err := guestLeft.Write(server); err != nil {
+		t.Fatalf("failed to write the guest-left notification: %s", err)
+	}
+	expectOwnerEvent(t, events) // OwnerGuestLeft
+
+	sendJoinRoomRequestFrom(t, server, "ROOM7", "GUEST1-AGAIN", guestIdentity)
+	if accepted := expectJoinResponse(t, server); accepted != 1 {
+		t.Fatalf("expected the guest to be let back in, got Accepted=%d", accepted)
+	}
+	expectDeviceInfo(t, server)
+	event := expectOwnerEvent(t, events)
+	if event.Kind != OwnerJoinDecided || !event.Accepted || !event.Rejoined || event.GuestClientId != "GUEST1-AGAIN" {
+		t.Fatalf("expected an accepted re-join, got %+v", event)
+	}
+
+	if err := guestLeft.Write(server); err != nil {
+		t.Fatalf("failed to write the guest-left notification: %s", err)
+	}
+	expectOwnerEvent(t, events) // OwnerGuestLeft
+	sendJoinRoomRequestFrom(t, server, "ROOM7", "GUEST2", otherIdentity)
+	if accepted := expectJoinResponse(t, server); accepted != 0 {
+		t.Fatalf("expected another guest to be asked about and declined, got Accepted=%d", accepted)
+	}
+
+	promptsMu.Lock()
+	defer promptsMu.Unlock()
+	if len(prompts) != 2 || prompts[0] != "GUEST1" || prompts[1] != "GUEST2" {
+		t.Fatalf("expected promptAccept to be asked about GUEST1 and GUEST2 only, got %v", prompts)
+	}
+}
+
+// TestJoinAsRoomOwnerReportsDeviceStateChanges checks that a shared device
+// disappearing from, then coming back to, the adb server's device list is
+// reported as events and to the guest, and that a guest joining while a
+// device is offline is told so right after being accepted.
+func TestJoinAsRoomOwnerReportsDeviceStateChanges(t *testing.T) {
+	client, server := newConnectedClient(t)
+	smartSocket := newFakeSmartSocket()
+	smartSocket.tracked = make(chan []adb.Device)
+	smartSocket.deviceList = []adb.Device{
+		{Id: "emulator-5554", Type: adb.TypeDevice, Model: "Pixel_7"},
+		{Id: "R58M123", Type: adb.TypeDevice, Model: "SM_G991B"},
+	}
+
+	events := make(chan OwnerEvent, 10)
+	onEvent := func(e OwnerEvent) { events <- e }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = JoinAsRoomOwner(ctx, client, smartSocket, []string{"emulator-5554", "R58M123"}, testIdentity(t), func(clientId string, publicKey []byte) (bool, error) {
+			return true, nil
+		}, onEvent, OwnerOptions{})
+	}()
+
+	respondToCreateRoom(t, server, "ROOM7")
+	expectOwnerEvent(t, events) // OwnerRoomCreated
+
+	smartSocket.tracked <- []adb.Device{{Id: "emulator-5554", Type: adb.TypeDevice}}
+	event := expectOwnerEvent(t, events)
+	if event.Kind != OwnerDeviceOffline || event.Device != "R58M123" || event.DeviceState != adb.TypeDisconnected {
+		t.Fatalf("expected R58M123 to go offline, got %+v", event)
+	}
+	if state := expectDeviceState(t, server); state.Device != 1 || state.State != adb.TypeDisconnected {
+		t.Fatalf("unexpected device state: %+v", state)
+	}
+
+	sendJoinRoomRequest(t, server, "ROOM7", "GUEST1")
+	expectJoinResponse(t, server)
+	if info := expectDeviceInfo(t, server); info.Device != 0 || info.Model != "Pixel_7" {
+		t.Fatalf("expected emulator-5554's details, got %+v", info)
+	}
+	expectDeviceInfo(t, server)
+	if state := expectDeviceState(t, server); state.Device != 1 || state.State != adb.TypeDisconnected {
+		t.Fatalf("expected the new guest to be told R58M123 is offline, got %+v", state)
+	}
+	expectOwnerEvent(t, events) // OwnerJoinRequested
+	expectOwnerEvent(t, events) // OwnerJoinDecided
+
+	smartSocket.tracked <- []adb.Device{{Id: "emulator-5554", Type: adb.TypeDevice}, {Id: "R58M123", Type: adb.TypeDevice, Model: "SM_G991U"}}
+	event = expectOwnerEvent(t, events)
+	if event.Kind != OwnerDeviceOnline || event.Device != "R58M123" {
+		t.Fatalf("expected R58M123 to come back online, got %+v", event)
+	}
+	// It's looked up again before being reported online.
+	if info := expectDeviceInfo(t, server); info.Device != 1 || info.Model != "SM_G991U" {
+		t.Fatalf("expected R58M123's fresh details, got %+v", info)
+	}
+	if state := expectDeviceState(t, server); state.Device != 1 || state.State != adb.TypeDevice {
+		t.Fatalf("unexpected device state: %+v", state)
+	}
+}
+
 // TestJoinRequestDoesNotBlockActiveStreamTraffic is a regression test for
 // the bug this multiplexer fixes: prompting for a second guest's join
 // request (which can block indefinitely on TTY input) must not stall ADB
@@ -453,7 +802,7 @@ func TestJoinRequestDoesNotBlockActiveStreamTraffic(t *testing.T) {
 	defer cancel()
 	done := make(chan error, 1)
 	go func() {
-		done <- JoinAsRoomOwner(ctx, client, smartSocket, "emulator-5554", ownerIdentity, promptAccept, nil)
+		done <- JoinAsRoomOwner(ctx, client, smartSocket, []string{"emulator-5554"}, ownerIdentity, promptAccept, nil, OwnerOptions{})
 	}()
 
 	respondToCreateRoom(t, server, "ROOM7")
@@ -463,6 +812,7 @@ func TestJoinRequestDoesNotBlockActiveStreamTraffic(t *testing.T) {
 	if accepted := expectJoinResponse(t, server); accepted != 1 {
 		t.Fatalf("expected GUEST1 to be accepted, got Accepted=%d", accepted)
 	}
+	expectDeviceInfo(t, server)
 
 	// GUEST1 opens a stream.
 	openMessage := adb.CreateMessage()
@@ -510,3 +860,56 @@ func TestJoinRequestDoesNotBlockActiveStreamTraffic(t *testing.T) {
 		t.Fatalf("JoinAsRoomOwner did not stop after context cancellation")
 	}
 }
+
+// rejectAllFilter is a relay.ServiceFilter denying every service.
+type rejectAllFilter struct{}
+
+func (rejectAllFilter) CheckOpen(service string) error {
+	return errors.New("nothing is allowed")
+}
+
+// TestJoinAsRoomOwnerReportsDeniedServices verifies that OwnerOptions'
+// ServiceFilter is applied to guest OPENs, answered with a CLSE, and
+// surfaced as an OwnerServiceDenied event.
+func TestJoinAsRoomOwnerReportsDeniedServices(t *testing.T) {
+	client, server := newConnectedClient(t)
+	smartSocket := newFakeSmartSocket()
+	events := make(chan OwnerEvent, 10)
+	onEvent := func(e OwnerEvent) { events <- e }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- JoinAsRoomOwner(ctx, client, smartSocket, []string{"emulator-5554"}, testIdentity(t), func(clientId string, publicKey []byte) (bool, error) {
+			return true, nil
+		}, onEvent, OwnerOptions{ServiceFilter: rejectAllFilter{}})
+	}()
+
+	respondToCreateRoom(t, server, "ROOM8")
+	if event := expectOwnerEvent(t, events); event.Kind != OwnerRoomCreated {
+		t.Fatalf("expected OwnerRoomCreated, got %+v", event)
+	}
+
+	openMessage := adb.CreateMessage()
+	if err := openMessage.Set(adb.CommandOpen, 3, 0, []byte("root:\x00")); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	sendAdbTransport(t, server, openMessage)
+
+	closeMessage := expectAdbTransport(t, server)
+	if closeMessage.Command() != adb.CommandClose || closeMessage.Arg2() != 3 {
+		t.Fatalf("expected a CLSE for guest id 3, got %s for %d", closeMessage.CommandString(), closeMessage.Arg2())
+	}
+	denied := expectOwnerEvent(t, events)
+	if denied.Kind != OwnerServiceDenied || denied.Service != "root:" || denied.Err == nil {
+		t.Fatalf("expected OwnerServiceDenied for root:, got %+v", denied)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("JoinAsRoomOwner did not stop after context cancellation")
+	}
+}
@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"adb-remote.maci.team/client/identity"
+	"adb-remote.maci.team/client/transportLayer"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ReconnectPolicy is how JoinAsGuest tries to get back into its room once
+// the transporter connection is lost (see GuestOptions.Reconnect), and how
+// client/agent backs off restarting a failed room.
+type ReconnectPolicy struct {
+	// InitialDelay is how long to wait before the first attempt; it
+	// doubles with every failed one, up to MaxDelay.
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	// MaxAttempts bounds the attempts per lost connection; with 0, they go
+	// on until ctx is cancelled or the room is gone.
+	MaxAttempts int
+}
+
+// DefaultReconnectPolicy retries from a second apart to half a minute
+// apart, for as long as the room exists.
+var DefaultReconnectPolicy = ReconnectPolicy{InitialDelay: time.Second, MaxDelay: 30 * time.Second}
+
+// Delay returns how long to wait before the attempt'th attempt, counting
+// from 1.
+func (p ReconnectPolicy) Delay(attempt int) time.Duration {
+	delay := p.InitialDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// errRoomChanged is why a re-join is given up on when the room answering
+// isn't the one that was left.
+var errRoomChanged = errors.New("the room changed")
+
+// rejoinRoom redials client and re-joins roomId, retrying as policy says,
+// until it did, ctx is cancelled, or the room is gone: closed
+// (*ErrRoomNotFound), the owner declined (*ErrJoinRoomDenied), or it's no
+// longer ownerPublicKey's room of deviceCount devices. Reports every
+// attempt as a GuestReconnecting event, and success as GuestReconnected.
+func rejoinRoom(ctx context.Context, client *transportLayer.Client, guestIdentity *identity.Identity, roomId string, ownerPublicKey []byte, deviceCount int, policy ReconnectPolicy, onEvent GuestEventFunc) error {
+	logger := client.Logger
+	// Nothing below watches ctx while waiting for the transporter or the
+	// owner to answer; closing the connection makes them stop waiting.
+	stopClosing := context.AfterFunc(ctx, client.Close)
+	defer stopClosing()
+
+	var lastErr error
+	for attempt := 1; policy.MaxAttempts <= 0 || attempt <= policy.MaxAttempts; attempt++ {
+		emitGuest(onEvent, GuestEvent{Kind: GuestReconnecting, Attempt: attempt, Err: lastErr})
+		timer := time.NewTimer(policy.Delay(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+
+		clientId, err := rejoinRoomOnce(client, guestIdentity, roomId, ownerPublicKey, deviceCount)
+		if err == nil {
+			logger.Info(fmt.Sprintf("Re-joined room %s as %s", roomId, clientId))
+			emitGuest(onEvent, GuestEvent{Kind: GuestReconnected, ClientId: clientId})
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var notFound *ErrRoomNotFound
+		var denied *ErrJoinRoomDenied
+		if errors.As(err, &notFound) || errors.As(err, &denied) || errors.Is(err, errRoomChanged) {
+			return err
+		}
+		logger.Info(fmt.Sprintf("Re-joining room %s failed (attempt %d): %s", roomId, attempt, err))
+		lastErr = err
+	}
+	return lastErr
+}
+
+// rejoinRoomOnce redials client, handshakes and joins roomId again,
+// checking it's still the room that was left. Returns the new client id.
+func rejoinRoomOnce(client *transportLayer.Client, guestIdentity *identity.Identity, roomId string, ownerPublicKey []byte, deviceCount int) (string, error) {
+	if err := client.Reconnect(); err != nil {
+		return "", err
+	}
+	clientId, err := Handshake(client)
+	if err != nil {
+		return "", err
+	}
+	// The join decision isn't reported again: as far as the caller is
+	// concerned, it's still the same room.
+	var decided GuestEvent
+	devices, _, err := roomJoinStep(client, guestIdentity, roomId, func(e GuestEvent) {
+		if e.Kind == GuestJoinDecided {
+			decided = e
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(decided.OwnerPublicKey, ownerPublicKey) {
+		return "", fmt.Errorf("%w: it's now owned by %s", errRoomChanged, identity.Fingerprint(decided.OwnerPublicKey))
+	}
+	if len(devices) != deviceCount {
+		return "", fmt.Errorf("%w: it now shares %d devices instead of %d", errRoomChanged, len(devices), deviceCount)
+	}
+	return clientId, nil
+}
@@ -0,0 +1,190 @@
+package controller
+
+import (
+	"adb-remote.maci.team/client/config"
+	"adb-remote.maci.team/client/internal/testtls"
+	"adb-remote.maci.team/client/relay"
+	"adb-remote.maci.team/client/transportLayer"
+	"adb-remote.maci.team/shared/protocol"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReconnectPolicyDelayDoublesUpToTheMax(t *testing.T) {
+	policy := ReconnectPolicy{InitialDelay: time.Second, MaxDelay: 5 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, delay := range expected {
+		if actual := policy.Delay(i + 1); actual != delay {
+			t.Fatalf("expected attempt %d to wait %s, got %s", i+1, delay, actual)
+		}
+	}
+}
+
+// fastReconnect retries right away, for tests.
+var fastReconnect = ReconnectPolicy{InitialDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+// newReconnectingClient is newConnectedClient against a fake transporter
+// that accepts every connection, for a client that redials. The returned
+// function waits for the next one.
+func newReconnectingClient(t *testing.T) (*transportLayer.Client, func() net.Conn) {
+	t.Helper()
+	listener := testtls.Listen(t)
+	connections := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := testtls.Accept(listener)
+			if err != nil {
+				return
+			}
+			connections <- conn
+		}
+	}()
+	client, err := transportLayer.CreateClient(newTestLogger(), &config.ClientConfiguration{TransporterAddress: listener.Addr().String()})
+	if err != nil {
+		t.Fatalf("CreateClient failed: %s", err)
+	}
+	if err := client.Start(); err != nil {
+		t.Fatalf("Start failed: %s", err)
+	}
+	t.Cleanup(client.Close)
+	return client, func() net.Conn {
+		t.Helper()
+		select {
+		case conn := <-connections:
+			t.Cleanup(func() { _ = conn.Close() })
+			return conn
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for the client to connect")
+			return nil
+		}
+	}
+}
+
+// respondToHandshake answers the CommandConnect the client sends first on a
+// new connection, assigning it clientId.
+func respondToHandshake(t *testing.T, server net.Conn, clientId string) {
+	t.Helper()
+	request := readMessage(t, server)
+	if request.Command() != protocol.CommandConnect {
+		t.Fatalf("expected a connect request, got %x", request.Command())
+	}
+	response := protocol.CreateTransporterMessage()
+	response.SetResponseCommand(protocol.CommandConnect)
+	if err := response.SetPayloadConnectResponse(&protocol.TransporterMessagePayloadConnectResponse{ClientId: clientId}); err != nil {
+		t.Fatalf("SetPayloadConnectResponse failed: %s", err)
+	}
+	if err := response.Write(server); err != nil {
+		t.Fatalf("failed to write the response: %s", err)
+	}
+}
+
+// TestJoinAsGuestRejoinsAfterTheConnectionDrops checks that with Reconnect,
+// losing the transporter connection has the guest redial and re-join the
+// room, its proxy staying up and registered with the local adb server all
+// along.
+func TestJoinAsGuestRejoinsAfterTheConnectionDrops(t *testing.T) {
+	client, accept := newReconnectingClient(t)
+	port := freeLocalPort(t)
+	smartSocket := &fakeGuestSmartSocket{}
+	guestIdentity := testIdentity(t)
+	events := make(chan GuestEvent, 100)
+	onEvent := func(e GuestEvent) { events <- e }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	options := testGuestOptions(t)
+	options.Reconnect = &fastReconnect
+	go func() { done <- JoinAsGuest(ctx, client, smartSocket, guestIdentity, "ROOM1", port, onEvent, options) }()
+
+	first := accept()
+	respondToJoinRoom(t, first, 1)
+	expectGuestEventKind(t, events, GuestAdbConnected)
+
+	_ = first.Close()
+	if e := expectGuestEventKind(t, events, GuestReconnecting); e.Attempt != 1 {
+		t.Fatalf("expected the first reconnection attempt, got %+v", e)
+	}
+	second := accept()
+	respondToHandshake(t, second, "CLIENT2")
+	respondToJoinRoom(t, second, 1)
+	if e := expectGuestEventKind(t, events, GuestReconnected); e.ClientId != "CLIENT2" {
+		t.Fatalf("expected to be reconnected as CLIENT2, got %+v", e)
+	}
+
+	localConn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatalf("failed to dial the local proxy: %s", err)
+	}
+	defer localConn.Close()
+	_ = localConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := adbHandshake(localConn); err != nil {
+		t.Fatalf("the CNXN handshake failed after reconnecting: %s", err)
+	}
+
+	connects, disconnects := smartSocket.calls()
+	if len(connects) != 1 || len(disconnects) != 0 {
+		t.Fatalf("expected the proxy to stay registered with adb across the reconnection, got connect=%v disconnect=%v", connects, disconnects)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("JoinAsGuest did not stop after context cancellation")
+	}
+}
+
+// TestJoinAsGuestGivesUpReconnectingOnceTheRoomIsGone checks that a room
+// closed meanwhile, as when its owner left, ends the session rather than
+// being retried.
+func TestJoinAsGuestGivesUpReconnectingOnceTheRoomIsGone(t *testing.T) {
+	client, accept := newReconnectingClient(t)
+	port := freeLocalPort(t)
+	guestIdentity := testIdentity(t)
+	events := make(chan GuestEvent, 100)
+	onEvent := func(e GuestEvent) { events <- e }
+
+	done := make(chan error, 1)
+	options := testGuestOptions(t)
+	options.Reconnect = &fastReconnect
+	go func() {
+		done <- JoinAsGuest(context.Background(), client, &fakeGuestSmartSocket{}, guestIdentity, "ROOM1", port, onEvent, options)
+	}()
+
+	first := accept()
+	respondToJoinRoom(t, first, 1)
+	expectGuestEventKind(t, events, GuestProxyReady)
+	_ = first.Close()
+
+	second := accept()
+	respondToHandshake(t, second, "CLIENT2")
+	readMessage(t, second) // the join request
+	response := protocol.CreateTransporterMessage()
+	response.SetErrorResponseCommand(protocol.CommandJoinRoom)
+	if err := response.SetErrorPayload(&protocol.TransporterMessagePayloadError{ErrorCode: protocol.ErrorRoomNotFound, ErrorMessage: "room not found"}); err != nil {
+		t.Fatalf("SetErrorPayload failed: %s", err)
+	}
+	if err := response.Write(second); err != nil {
+		t.Fatalf("failed to write the response: %s", err)
+	}
+
+	if e := expectGuestEventKind(t, events, GuestTransportLost); e.Err == nil {
+		t.Fatalf("expected GuestTransportLost to carry why re-joining failed")
+	}
+	select {
+	case err := <-done:
+		var notFound *ErrRoomNotFound
+		if !errors.Is(err, relay.ErrTransportClosed) || !errors.As(err, &notFound) {
+			t.Fatalf("expected a lost transport whose room is gone, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("JoinAsGuest did not stop once the room was gone")
+	}
+}
@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// trustedRejoins remembers which guest identity a room last accepted, so
+// that once that guest leaves, e.g. because its transporter connection
+// dropped, it can join again within window without being asked about a
+// second time. A zero window trusts no re-join.
+type trustedRejoins struct {
+	window time.Duration
+	now    func() time.Time
+
+	mutex sync.Mutex
+	// current is the accepted guest's public key, while it's in the room.
+	current []byte
+	// left is the public key of the accepted guest that left at leftAt.
+	left   []byte
+	leftAt time.Time
+}
+
+func newTrustedRejoins(window time.Duration) *trustedRejoins {
+	return &trustedRejoins{window: window, now: time.Now}
+}
+
+// accepted records that the guest with publicKey was let in.
+func (r *trustedRejoins) accepted(publicKey []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.current = publicKey
+}
+
+// guestLeft records that the room's guest left.
+func (r *trustedRejoins) guestLeft() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.current != nil {
+		r.left, r.leftAt = r.current, r.now()
+	}
+	r.current = nil
+}
+
+// forget forgets the accepted guest, for it not to be trusted once it
+// left: it was removed from the room.
+func (r *trustedRejoins) forget() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.current = nil
+}
+
+// trusted reports whether request is the accepted guest that left coming
+// back within window. It only does once per departure. Taking a verified
+// request, rather than the public key a join request presents, keeps
+// anybody who learnt the guest's public key from passing for it.
+func (r *trustedRejoins) trusted(request *joinRequest) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.window <= 0 || r.left == nil || !bytes.Equal(r.left, request.publicKey) || r.now().Sub(r.leftAt) > r.window {
+		return false
+	}
+	r.left = nil
+	return true
+}
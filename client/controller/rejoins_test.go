@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"adb-remote.maci.team/client/identity"
+	"adb-remote.maci.team/shared/protocol"
+	"crypto/ed25519"
+	"testing"
+	"time"
+)
+
+// signedJoinRequest is guestIdentity's request to join roomId as
+// guestClientId, verified the way the owner verifies it.
+func signedJoinRequest(t *testing.T, guestIdentity *identity.Identity, roomId string, guestClientId string) *joinRequest {
+	t.Helper()
+	request, err := verifyJoinRequest(roomId, &protocol.TransporterMessagePayloadConnectRoom{
+		RoomId:    roomId,
+		ClientId:  guestClientId,
+		PublicKey: guestIdentity.PublicKey,
+		Signature: ed25519.Sign(guestIdentity.PrivateKey, protocol.RoomJoinMessage(roomId, guestClientId)),
+	})
+	if err != nil {
+		t.Fatalf("verifyJoinRequest failed: %s", err)
+	}
+	return request
+}
+
+func TestTrustedRejoinsTrustsTheGuestThatLeftOnceWithinTheWindow(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	rejoins := newTrustedRejoins(time.Minute)
+	rejoins.now = func() time.Time { return now }
+	guestIdentity := testIdentity(t)
+	guest, other := signedJoinRequest(t, guestIdentity, "ROOM7", "GUEST1"), signedJoinRequest(t, testIdentity(t), "ROOM7", "GUEST2")
+
+	if rejoins.trusted(guest) {
+		t.Fatalf("expected a guest that never joined not to be trusted")
+	}
+	rejoins.accepted(guestIdentity.PublicKey)
+	if rejoins.trusted(guest) {
+		t.Fatalf("expected a guest still in the room not to be trusted to join again")
+	}
+
+	rejoins.guestLeft()
+	now = now.Add(30 * time.Second)
+	if rejoins.trusted(other) {
+		t.Fatalf("expected another identity not to be trusted")
+	}
+	if !rejoins.trusted(signedJoinRequest(t, guestIdentity, "ROOM7", "GUEST1-AGAIN")) {
+		t.Fatalf("expected the guest that just left to be trusted")
+	}
+	if rejoins.trusted(guest) {
+		t.Fatalf("expected a departure to be trusted for only one re-join")
+	}
+}
+
+// TestTrustedRejoinsNeedTheGuestsSignature checks that presenting the
+// public key of the guest that just left, without its signature for the
+// client id it rejoins as, doesn't get a request trusted: such a request
+// never verifies, so there's nothing to ask trusted about, and the guest's
+// own departure stays trusted for when it does come back.
+func TestTrustedRejoinsNeedTheGuestsSignature(t *testing.T) {
+	rejoins := newTrustedRejoins(time.Minute)
+	guestIdentity := testIdentity(t)
+	rejoins.accepted(guestIdentity.PublicKey)
+	rejoins.guestLeft()
+
+	for name, signature := range map[string][]byte{
+		"no signature":                     nil,
+		"signed by another identity":       ed25519.Sign(testIdentity(t).PrivateKey, protocol.RoomJoinMessage("ROOM7", "IMPOSTOR")),
+		"the guest's earlier join, reused": ed25519.Sign(guestIdentity.PrivateKey, protocol.RoomJoinMessage("ROOM7", "GUEST1")),
+	} {
+		request, err := verifyJoinRequest("ROOM7", &protocol.TransporterMessagePayloadConnectRoom{RoomId: "ROOM7", ClientId: "IMPOSTOR", PublicKey: guestIdentity.PublicKey, Signature: signature})
+		if err == nil {
+			t.Fatalf("%s: expected the join request not to verify, got %+v", name, request)
+		}
+	}
+	if !rejoins.trusted(signedJoinRequest(t, guestIdentity, "ROOM7", "GUEST1-AGAIN")) {
+		t.Fatalf("expected the guest that just left to still be trusted")
+	}
+}
+
+func TestTrustedRejoinsExpire(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	rejoins := newTrustedRejoins(time.Minute)
+	rejoins.now = func() time.Time { return now }
+	guestIdentity := testIdentity(t)
+
+	rejoins.accepted(guestIdentity.PublicKey)
+	rejoins.guestLeft()
+	now = now.Add(2 * time.Minute)
+	if rejoins.trusted(signedJoinRequest(t, guestIdentity, "ROOM7", "GUEST1-AGAIN")) {
+		t.Fatalf("expected a re-join after the window not to be trusted")
+	}
+}
+
+func TestTrustedRejoinsNeedAWindow(t *testing.T) {
+	rejoins := newTrustedRejoins(0)
+	guestIdentity := testIdentity(t)
+
+	rejoins.accepted(guestIdentity.PublicKey)
+	rejoins.guestLeft()
+	if rejoins.trusted(signedJoinRequest(t, guestIdentity, "ROOM7", "GUEST1-AGAIN")) {
+		t.Fatalf("expected no re-join to be trusted without a window")
+	}
+}
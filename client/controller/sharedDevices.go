@@ -0,0 +1,115 @@
+package controller
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"strings"
+	"sync"
+)
+
+// deviceStateChange is one of a room's devices entering a new adb state.
+// entry is the device's adb server device list entry, if it's listed.
+type deviceStateChange struct {
+	index  int
+	serial string
+	state  string
+	entry  adb.Device
+}
+
+func (c deviceStateChange) online() bool {
+	return c.state == adb.TypeDevice
+}
+
+// sharedDevices follows a room's shared devices: what they are (see
+// adb.DeviceInfo), which adb features they support, and their adb state as the adb server reports device
+// list updates (see adb.IAdbSmartSocket.TrackDevices). Every device starts
+// out assumed online: it was usable when picked.
+type sharedDevices struct {
+	mutex   sync.Mutex
+	serials []string
+	states  []string
+	infos   []adb.DeviceInfo
+	// features holds each device's comma-separated adb features, as sent
+	// in the join room result; empty when unknown.
+	features []string
+}
+
+func newSharedDevices(serials []string) *sharedDevices {
+	states := make([]string, len(serials))
+	for i := range states {
+		states[i] = adb.TypeDevice
+	}
+	return &sharedDevices{
+		serials:  serials,
+		states:   states,
+		infos:    make([]adb.DeviceInfo, len(serials)),
+		features: make([]string, len(serials)),
+	}
+}
+
+// update records deviceList as the adb server's current device list and
+// returns the shared devices whose state changed, in room order. A shared
+// device missing from the list (unplugged) counts as offline.
+func (d *sharedDevices) update(deviceList []adb.Device) []deviceStateChange {
+	current := make(map[string]adb.Device, len(deviceList))
+	for _, device := range deviceList {
+		current[device.Id] = device
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var changes []deviceStateChange
+	for i, serial := range d.serials {
+		entry, ok := current[serial]
+		state := entry.Type
+		if !ok {
+			state = adb.TypeDisconnected
+		}
+		if state == d.states[i] {
+			continue
+		}
+		d.states[i] = state
+		changes = append(changes, deviceStateChange{index: i, serial: serial, state: state, entry: entry})
+	}
+	return changes
+}
+
+// unavailable returns the shared devices that aren't currently online, in
+// room order, for bringing a newly joined guest up to date.
+func (d *sharedDevices) unavailable() []deviceStateChange {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var changes []deviceStateChange
+	for i, state := range d.states {
+		if state != adb.TypeDevice {
+			changes = append(changes, deviceStateChange{index: i, serial: d.serials[i], state: state})
+		}
+	}
+	return changes
+}
+
+func (d *sharedDevices) setInfo(index int, info adb.DeviceInfo) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.infos[index] = info
+}
+
+// info returns every shared device's details, in room order.
+func (d *sharedDevices) info() []adb.DeviceInfo {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]adb.DeviceInfo{}, d.infos...)
+}
+
+func (d *sharedDevices) setFeatures(index int, features []string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.features[index] = strings.Join(features, ",")
+}
+
+// featureLists returns every shared device's comma-separated adb features,
+// in room order.
+func (d *sharedDevices) featureLists() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]string{}, d.features...)
+}
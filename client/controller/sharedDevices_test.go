@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"testing"
+)
+
+func TestSharedDevicesReportsOnlyStateChanges(t *testing.T) {
+	shared := newSharedDevices([]string{"emulator-5554", "R58M123"})
+
+	if changes := shared.update([]adb.Device{{Id: "emulator-5554", Type: adb.TypeDevice}, {Id: "R58M123", Type: adb.TypeDevice}}); len(changes) != 0 {
+		t.Fatalf("expected no change while both devices stay online, got %+v", changes)
+	}
+
+	changes := shared.update([]adb.Device{{Id: "emulator-5554", Type: adb.TypeDevice}, {Id: "other", Type: adb.TypeDevice}})
+	if len(changes) != 1 || changes[0].index != 1 || changes[0].state != adb.TypeDisconnected || changes[0].online() {
+		t.Fatalf("expected the unplugged device to go offline, got %+v", changes)
+	}
+	if unavailable := shared.unavailable(); len(unavailable) != 1 || unavailable[0].serial != "R58M123" {
+		t.Fatalf("expected R58M123 to be unavailable, got %+v", unavailable)
+	}
+
+	changes = shared.update([]adb.Device{{Id: "R58M123", Type: "unauthorized"}, {Id: "emulator-5554", Type: adb.TypeDevice}})
+	if len(changes) != 1 || changes[0].state != "unauthorized" {
+		t.Fatalf("expected R58M123 to become unauthorized, got %+v", changes)
+	}
+
+	changes = shared.update([]adb.Device{{Id: "R58M123", Type: adb.TypeDevice, Model: "SM_G991B"}, {Id: "emulator-5554", Type: adb.TypeDevice}})
+	if len(changes) != 1 || !changes[0].online() || changes[0].entry.Model != "SM_G991B" {
+		t.Fatalf("expected R58M123 to come back online, got %+v", changes)
+	}
+	if unavailable := shared.unavailable(); len(unavailable) != 0 {
+		t.Fatalf("expected every device to be available, got %+v", unavailable)
+	}
+}
+
+func TestSharedDevicesInfoIsACopy(t *testing.T) {
+	shared := newSharedDevices([]string{"emulator-5554"})
+	shared.setInfo(0, adb.DeviceInfo{Model: "Pixel_7"})
+	infos := shared.info()
+	infos[0].Model = "changed"
+	if got := shared.info()[0].Model; got != "Pixel_7" {
+		t.Fatalf("expected the stored info to be unaffected, got %q", got)
+	}
+}
@@ -1,13 +1,17 @@
 package controller
 
 import (
+	"adb-remote.maci.team/client/adb"
 	"adb-remote.maci.team/client/config"
 	"adb-remote.maci.team/client/internal/testtls"
 	"adb-remote.maci.team/client/transportLayer"
 	"adb-remote.maci.team/shared/protocol"
+	"crypto/rand"
+	"crypto/rsa"
 	"io"
 	"log/slog"
 	"net"
+	"sync"
 	"testing"
 	"time"
 )
@@ -65,3 +69,70 @@ func readMessage(t *testing.T, conn net.Conn) *protocol.TransporterMessage {
 	}
 	return message
 }
+
+// testAdbKey is the adb key the tests' local "adb servers" authenticate
+// with; generated once, since RSA key generation is slow.
+var testAdbKey = sync.OnceValue(func() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+})
+
+// testGuestOptions allows testAdbKey to connect to the guest's proxies.
+func testGuestOptions(t *testing.T) GuestOptions {
+	t.Helper()
+	publicKey, err := adb.NewPublicKey(&testAdbKey().PublicKey, "test@localhost")
+	if err != nil {
+		t.Fatalf("NewPublicKey failed: %s", err)
+	}
+	adbKeys, err := adb.LoadAuthorizedKeys("")
+	if err != nil {
+		t.Fatalf("LoadAuthorizedKeys failed: %s", err)
+	}
+	adbKeys.Allow(publicKey)
+	return GuestOptions{AdbKeys: adbKeys}
+}
+
+// adbHandshake performs a local adb server's side of the CNXN handshake
+// with a proxy, authenticating with testAdbKey the way adb does (signing
+// the first AUTH token, then offering the public key), and returns the
+// proxy's CNXN.
+func adbHandshake(conn net.Conn) (*adb.AdbMessage, error) {
+	message := adb.CreateMessage()
+	if err := message.Set(adb.CommandConnect, 1, adb.MaxPayloadLength, []byte("host::")); err != nil {
+		return nil, err
+	}
+	if err := message.Write(conn); err != nil {
+		return nil, err
+	}
+	for signed := false; ; signed = true {
+		if err := message.Read(conn); err != nil {
+			return nil, err
+		}
+		if message.Command() != adb.CommandAuth {
+			return message, nil
+		}
+		if signed {
+			publicKey, err := adb.NewPublicKey(&testAdbKey().PublicKey, "test@localhost")
+			if err != nil {
+				return nil, err
+			}
+			if err := message.Set(adb.CommandAuth, adb.AuthRSAPublicKey, 0, []byte(publicKey.String()+"\x00")); err != nil {
+				return nil, err
+			}
+		} else {
+			signature, err := adb.SignAuthToken(testAdbKey(), message.Data())
+			if err != nil {
+				return nil, err
+			}
+			if err := message.Set(adb.CommandAuth, adb.AuthSignature, 0, signature); err != nil {
+				return nil, err
+			}
+		}
+		if err := message.Write(conn); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -31,9 +31,11 @@ func CreateContainer() *container.Container {
 // to stdout out-of-band would corrupt that rendering, so logs go to a file
 // instead, in a "logs" directory next to the executable. pcapFilePath sits
 // next to it, written only when -verbosity=debug enables packet capture
-// (see transportLayer.Client.EnableDebugCapture).
+// (see transportLayer.Client.EnableDebugCapture), and so does
+// auditFilePath, share's default audit log (see client/audit).
 var logFilePath = filepath.Join(logsDir(), "adb-remote-client.log")
 var pcapFilePath = filepath.Join(logsDir(), "adb-remote-client.pcap")
+var auditFilePath = filepath.Join(logsDir(), "adb-remote-audit.jsonl")
 
 // logsDir resolves to a "logs" directory next to the running executable,
 // creating it if needed. Falls back to the OS temp dir if the executable's
@@ -97,9 +99,12 @@ func registerClient(container *container.Container) {
 	}
 }
 
+// registerSmartSocket provides the smart socket for the adb server named by
+// the environment or the config file. A command's -adbServer flag is only
+// parsed later, so commands swap in their own (see command.SmartSocketFor).
 func registerSmartSocket(container *container.Container) {
-	err := container.Singleton(func(logger *slog.Logger) adb.IAdbSmartSocket {
-		return adb.NewAdbSmartSocket(logger)
+	err := container.Singleton(func(config *config.ClientConfiguration, logger *slog.Logger) adb.IAdbSmartSocket {
+		return adb.NewAdbSmartSocket(adb.ResolveServerAddress("", config.AdbServerAddress), logger)
 	})
 	if err != nil {
 		panic(err)
@@ -131,8 +136,12 @@ func registerCommands(container *container.Container) {
 		logLevel *slog.LevelVar,
 	) []*command.Command[command.BaseCommand] {
 		return []*command.Command[command.BaseCommand]{
-			command.CreateShareCommand(logger, client, smartSocket, clientIdentity, config, logLevel, pcapFilePath),
+			command.CreateShareCommand(logger, client, smartSocket, clientIdentity, config, logLevel, pcapFilePath, auditFilePath),
 			command.CreateConnectCommand(logger, client, smartSocket, clientIdentity, config, logLevel, pcapFilePath),
+			command.CreateListCommand(logger, client, smartSocket, clientIdentity, config, logLevel, pcapFilePath),
+			command.CreateAgentCommand(logger, smartSocket, clientIdentity, config, logLevel, auditFilePath),
+			command.CreateAuditCommand(logger, config, logLevel, auditFilePath),
+			command.CreateReplayCommand(logger, config, logLevel),
 		}
 	})
 	if err != nil {
@@ -0,0 +1,75 @@
+package e2e
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/adb/adbtest"
+	"adb-remote.maci.team/client/agent"
+	"adb-remote.maci.team/client/config"
+	"adb-remote.maci.team/client/controller"
+	"adb-remote.maci.team/client/transportLayer"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestAgentSharesEveryDevice runs the agent over two devices and joins
+// one's room with a trusted identity and with an untrusted one.
+func TestAgentSharesEveryDevice(t *testing.T) {
+	transporterAddress := startTransporter(t)
+
+	ownerServer := adbtest.NewServer(t)
+	ownerServer.AddDevice(adbtest.NewDevice("emulator-5554"))
+	ownerServer.AddDevice(adbtest.NewDevice("192.168.1.20:5555"))
+
+	trusted := testIdentity(t)
+	policy, err := agent.NewPolicy(config.AgentConfiguration{TrustedFingerprints: []string{trusted.Fingerprint()}})
+	if err != nil {
+		t.Fatalf("NewPolicy failed: %s", err)
+	}
+	newClient := func() (*transportLayer.Client, error) {
+		client, err := transportLayer.CreateClient(newTestLogger(), &config.ClientConfiguration{TransporterAddress: transporterAddress})
+		if err != nil {
+			return nil, err
+		}
+		return client, client.Start()
+	}
+	labAgent := agent.New(newTestLogger(), adb.NewAdbSmartSocket(ownerServer.Address(), newTestLogger()), testIdentity(t), newClient, agent.Settings{RoomIdPrefix: "lab-", Policy: policy})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- labAgent.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run failed: %s", err)
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := labAgent.Status()
+		if len(status.Devices) == 2 && status.Devices[0].State == agent.RoomShared && status.Devices[1].State == agent.RoomShared {
+			if status.Devices[0].RoomId != "lab-192.168.1.20-5555" || status.Devices[1].RoomId != "lab-emulator-5554" {
+				t.Fatalf("expected each device shared at its reserved room id, got %+v", status.Devices)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for both rooms, got %+v", status.Devices)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	var denied *controller.ErrJoinRoomDenied
+	if _, err := controller.JoinRoom(connectClient(t, transporterAddress), testIdentity(t), "lab-emulator-5554", nil); !errors.As(err, &denied) {
+		t.Fatalf("expected an untrusted guest to be declined, got %v", err)
+	}
+	devices, err := controller.JoinRoom(connectClient(t, transporterAddress), trusted, "lab-emulator-5554", nil)
+	if err != nil {
+		t.Fatalf("expected the trusted guest to join, got %s", err)
+	}
+	if len(devices) != 1 || devices[0] != "emulator-5554" {
+		t.Fatalf("expected the room to share emulator-5554, got %v", devices)
+	}
+}
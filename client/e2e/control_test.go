@@ -0,0 +1,95 @@
+package e2e
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/adb/adbtest"
+	"adb-remote.maci.team/client/control"
+	"adb-remote.maci.team/client/controller"
+	"adb-remote.maci.team/client/headless"
+	"context"
+	"io"
+	"net"
+	"net/rpc/jsonrpc"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestControlSocketDrivesHeadlessShare accepts a guest and follows its
+// streams over a headless owner's control socket, then ends the session
+// from there.
+func TestControlSocketDrivesHeadlessShare(t *testing.T) {
+	transporterAddress := startTransporter(t)
+	ownerServer := adbtest.NewServer(t)
+	device := adbtest.NewDevice("emulator-5554")
+	device.HandleTcp("8080", func(conn net.Conn) { _, _ = io.Copy(conn, conn) })
+	ownerServer.AddDevice(device)
+	guestServer := adbtest.NewServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ownerCtx, endOwner := context.WithCancel(ctx)
+	session := control.NewOwnerSession(endOwner)
+	server, err := control.ServeOwner(filepath.Join(t.TempDir(), "control.sock"), session)
+	if err != nil {
+		t.Fatalf("ServeOwner failed: %s", err)
+	}
+	defer server.Close()
+	controlClient, err := jsonrpc.Dial("unix", server.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial the control socket: %s", err)
+	}
+	defer controlClient.Close()
+
+	ownerClient := startClient(t, transporterAddress)
+	ownerOutput, ownerEvents := headlessEvents(t)
+	ownerDone := make(chan error, 1)
+	go func() {
+		// The policy accepts nobody by itself, so the control client decides.
+		options := controller.OwnerOptions{Observers: []controller.SessionObserver{session}}
+		ownerDone <- headless.RunShare(ownerCtx, ownerClient, adb.NewAdbSmartSocket(ownerServer.Address(), newTestLogger()), testIdentity(t), []string{"emulator-5554"}, headless.AcceptPolicy{}, 0, options, session, ownerOutput)
+	}()
+	roomId := waitForEvent(t, ownerEvents, headless.EventRoomCreated).RoomId
+
+	serial, _ := startJoiningRoom(t, ctx, transporterAddress, guestServer, roomId)
+	var state control.OwnerState
+	for len(state.PendingJoins) == 0 {
+		if err := controlClient.Call("Session.State", &control.StateArgs{After: state.Version, WaitMillis: 5000}, &state); err != nil {
+			t.Fatalf("State failed: %s", err)
+		}
+	}
+	if err := controlClient.Call("Session.Accept", &control.JoinArgs{GuestClientId: state.PendingJoins[0].GuestClientId}, &control.Empty{}); err != nil {
+		t.Fatalf("Accept failed: %s", err)
+	}
+	if err := guestServer.WaitForState(serial, adb.TypeDevice, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	host := adb.NewAdbSmartSocket(guestServer.Address(), newTestLogger())
+	conn, err := host.OpenStream(serial, "tcp:8080")
+	if err != nil {
+		t.Fatalf("OpenStream failed: %s", err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var reply control.StreamsReply
+		if err := controlClient.Call("Session.Streams", &control.Empty{}, &reply); err != nil {
+			t.Fatalf("Streams failed: %s", err)
+		}
+		if len(reply.Streams) == 1 && reply.Streams[0].Service == "tcp:8080" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the guest's shell stream to be listed, got %+v", reply.Streams)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := controlClient.Call("Session.End", &control.Empty{}, &control.Empty{}); err != nil {
+		t.Fatalf("End failed: %s", err)
+	}
+	if err := waitForResult(t, ownerDone); err != nil {
+		t.Fatalf("expected ending the session over the control socket to be a clean exit, got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package e2e
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/adb/adbtest"
+	"adb-remote.maci.team/client/controller"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestPublishedRoomIsListedToTheTeam publishes a room to the "mobile"
+// team's room directory and lists it, with the team's token and without.
+func TestPublishedRoomIsListedToTheTeam(t *testing.T) {
+	transporterAddress := startTransporter(t)
+
+	ownerServer := adbtest.NewServer(t)
+	device := adbtest.NewDevice("emulator-5554")
+	device.Model = "Pixel_7"
+	ownerServer.AddDevice(device)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ownerClient := connectClient(t, transporterAddress)
+	ownerEvents := make(chan controller.OwnerEvent, 32)
+	ownerDone := make(chan error, 1)
+	go func() {
+		declineAll := func(string, []byte) (bool, error) { return false, nil }
+		options := controller.OwnerOptions{Publish: &controller.PublishOptions{Team: "mobile", TeamToken: "secret", Label: "Pixel lab", Tags: []string{"arm64"}}}
+		ownerDone <- controller.JoinAsRoomOwner(ctx, ownerClient, adb.NewAdbSmartSocket(ownerServer.Address(), newTestLogger()), []string{"emulator-5554"}, testIdentity(t), declineAll, func(event controller.OwnerEvent) { ownerEvents <- event }, options)
+	}()
+	var roomId string
+	for published := false; !published; {
+		select {
+		case event := <-ownerEvents:
+			switch event.Kind {
+			case controller.OwnerRoomCreated:
+				roomId = event.RoomId
+			case controller.OwnerRoomPublished:
+				published = true
+			case controller.OwnerPublishFailed:
+				t.Fatalf("publishing the room failed: %s", event.Err)
+			}
+		case err := <-ownerDone:
+			t.Fatalf("JoinAsRoomOwner returned early: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the room to be published")
+		}
+	}
+
+	rooms, err := controller.ListRooms(connectClient(t, transporterAddress), "mobile", "secret")
+	if err != nil {
+		t.Fatalf("ListRooms failed: %s", err)
+	}
+	if len(rooms) != 1 || rooms[0].RoomId != roomId || rooms[0].Label != "Pixel lab" || rooms[0].Occupied {
+		t.Fatalf("expected the published room, got %+v", rooms)
+	}
+	if len(rooms[0].Models) != 1 || rooms[0].Models[0] != "Pixel_7" {
+		t.Fatalf("expected the room to list the Pixel_7, got %v", rooms[0].Models)
+	}
+
+	var denied *controller.ErrTeamAccessDenied
+	if _, err := controller.ListRooms(connectClient(t, transporterAddress), "mobile", "guess"); !errors.As(err, &denied) {
+		t.Fatalf("expected ErrTeamAccessDenied for a wrong token, got %v", err)
+	}
+}
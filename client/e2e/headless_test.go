@@ -0,0 +1,208 @@
+package e2e
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/adb/adbtest"
+	"adb-remote.maci.team/client/controller"
+	"adb-remote.maci.team/client/headless"
+	"adb-remote.maci.team/client/identity"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// headlessEvents decodes the JSON lines a headless session prints to the
+// returned writer.
+func headlessEvents(t *testing.T) (io.Writer, <-chan headless.Event) {
+	t.Helper()
+	reader, writer := io.Pipe()
+	t.Cleanup(func() { _ = writer.Close() })
+	events := make(chan headless.Event, 64)
+	go func() {
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			var event headless.Event
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				event = headless.Event{Event: "invalid", Error: scanner.Text()}
+			}
+			events <- event
+		}
+	}()
+	return writer, events
+}
+
+func waitForEvent(t *testing.T, events <-chan headless.Event, name string) headless.Event {
+	t.Helper()
+	for {
+		select {
+		case event := <-events:
+			if event.Event == "invalid" {
+				t.Fatalf("expected a JSON line, got %q", event.Error)
+			}
+			if event.Event == name {
+				return event
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for a %s event", name)
+		}
+	}
+}
+
+func waitForResult(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatalf("the headless session didn't end")
+		return nil
+	}
+}
+
+// TestHeadlessShareAndConnect shares a device and joins its room without
+// either TUI, deciding join requests over the owner's decision stream, and
+// checks each way a session ends maps to its exit code.
+func TestHeadlessShareAndConnect(t *testing.T) {
+	transporterAddress := startTransporter(t)
+	ownerServer := adbtest.NewServer(t)
+	ownerServer.AddDevice(adbtest.NewDevice("emulator-5554"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	decisionReader, decisionWriter := io.Pipe()
+	defer decisionWriter.Close()
+	policy := headless.AcceptPolicy{Decisions: headless.ReadDecisions(decisionReader, newTestLogger())}
+	ownerClient := startClient(t, transporterAddress)
+	ownerOutput, ownerEvents := headlessEvents(t)
+	ownerDone := make(chan error, 1)
+	go func() {
+		ownerDone <- headless.RunShare(ctx, ownerClient, adb.NewAdbSmartSocket(ownerServer.Address(), newTestLogger()), testIdentity(t), []string{"emulator-5554"}, policy, 0, controller.OwnerOptions{}, nil, ownerOutput)
+	}()
+	if event := waitForEvent(t, ownerEvents, headless.EventConnected); event.ClientId == "" || event.Fingerprint == "" {
+		t.Fatalf("expected the owner to report its client id and fingerprint, got %+v", event)
+	}
+	roomId := waitForEvent(t, ownerEvents, headless.EventRoomCreated).RoomId
+
+	connect := func(guestServer *adbtest.Server, roomId string) (<-chan headless.Event, <-chan error, context.CancelFunc) {
+		guestCtx, cancelGuest := context.WithCancel(ctx)
+		guestClient := startClient(t, transporterAddress)
+		guestOutput, guestEvents := headlessEvents(t)
+		_, port, _ := net.SplitHostPort(freeLocalAddress(t))
+		adbKeys, err := adb.LoadAuthorizedKeys("")
+		if err != nil {
+			t.Fatalf("LoadAuthorizedKeys failed: %s", err)
+		}
+		adbKeys.Allow(guestServer.PublicKey())
+		guestDone := make(chan error, 1)
+		go func() {
+			guestDone <- headless.RunConnect(guestCtx, guestClient, adb.NewAdbSmartSocket(guestServer.Address(), newTestLogger()), testIdentity(t), roomId, port, controller.GuestOptions{AdbKeys: adbKeys}, nil, guestOutput)
+		}()
+		return guestEvents, guestDone, cancelGuest
+	}
+	decide := func(accept bool) {
+		request := waitForEvent(t, ownerEvents, headless.EventJoinRequested)
+		if request.GuestFingerprint == "" {
+			t.Fatalf("expected the join request to carry the guest's fingerprint, got %+v", request)
+		}
+		if _, err := fmt.Fprintf(decisionWriter, "{\"guestClientId\":%q,\"accept\":%t}\n", request.GuestClientId, accept); err != nil {
+			t.Fatalf("failed to write the decision: %s", err)
+		}
+		if decided := waitForEvent(t, ownerEvents, headless.EventJoinDecided); decided.Accepted == nil || *decided.Accepted != accept {
+			t.Fatalf("expected the owner to report the decision, got %+v", decided)
+		}
+	}
+
+	// A room that doesn't exist.
+	_, guestDone, cancelGuest := connect(adbtest.NewServer(t), "NOSUCHROOM")
+	if code := headless.ExitCode(waitForResult(t, guestDone)); code != headless.ExitRoomNotFound {
+		t.Fatalf("expected exit code %d for an unknown room, got %d", headless.ExitRoomNotFound, code)
+	}
+	cancelGuest()
+
+	// A declined guest.
+	guestEvents, guestDone, cancelGuest := connect(adbtest.NewServer(t), roomId)
+	decide(false)
+	if decided := waitForEvent(t, guestEvents, headless.EventJoinDecided); decided.Accepted == nil || *decided.Accepted {
+		t.Fatalf("expected the guest to report being declined, got %+v", decided)
+	}
+	if code := headless.ExitCode(waitForResult(t, guestDone)); code != headless.ExitDenied {
+		t.Fatalf("expected exit code %d for a declined guest, got %d", headless.ExitDenied, code)
+	}
+	cancelGuest()
+
+	// An accepted guest gets the device, and stopping it on purpose is a
+	// clean exit.
+	guestServer := adbtest.NewServer(t)
+	guestEvents, guestDone, cancelGuest = connect(guestServer, roomId)
+	decide(true)
+	ready := waitForEvent(t, guestEvents, headless.EventProxyReady)
+	if ready.Device != "emulator-5554" || ready.LocalAddress == "" {
+		t.Fatalf("expected the proxy's address, got %+v", ready)
+	}
+	waitForEvent(t, guestEvents, headless.EventAdbConnected)
+	if err := guestServer.WaitForState(ready.LocalAddress, adb.TypeDevice, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	cancelGuest()
+	if err := waitForResult(t, guestDone); err != nil {
+		t.Fatalf("expected a cancelled session to end cleanly, got %v", err)
+	}
+
+	// The owner losing the transporter.
+	ownerClient.Close()
+	waitForEvent(t, ownerEvents, headless.EventTransportLost)
+	if code := headless.ExitCode(waitForResult(t, ownerDone)); code != headless.ExitTransportLost {
+		t.Fatalf("expected exit code %d once the transporter is gone, got %d", headless.ExitTransportLost, code)
+	}
+}
+
+// TestHeadlessAllowFingerprintNeedsTheGuestsSignature checks that a guest
+// presenting an allowed fingerprint's public key, without the private key
+// to sign its join request with, is declined rather than let in by the
+// allowlist, while the guest that holds it is.
+func TestHeadlessAllowFingerprintNeedsTheGuestsSignature(t *testing.T) {
+	transporterAddress := startTransporter(t)
+	ownerServer := adbtest.NewServer(t)
+	ownerServer.AddDevice(adbtest.NewDevice("emulator-5554"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	trustedIdentity := testIdentity(t)
+	policy := headless.AcceptPolicy{Fingerprints: []string{identity.Fingerprint(trustedIdentity.PublicKey)}}
+	ownerOutput, ownerEvents := headlessEvents(t)
+	go func() {
+		_ = headless.RunShare(ctx, startClient(t, transporterAddress), adb.NewAdbSmartSocket(ownerServer.Address(), newTestLogger()), testIdentity(t), []string{"emulator-5554"}, policy, 0, controller.OwnerOptions{}, nil, ownerOutput)
+	}()
+	roomId := waitForEvent(t, ownerEvents, headless.EventRoomCreated).RoomId
+
+	connect := func(guestIdentity *identity.Identity) <-chan error {
+		guestOutput, _ := headlessEvents(t)
+		_, port, _ := net.SplitHostPort(freeLocalAddress(t))
+		guestDone := make(chan error, 1)
+		go func() {
+			guestDone <- headless.RunConnect(ctx, startClient(t, transporterAddress), adb.NewAdbSmartSocket(adbtest.NewServer(t).Address(), newTestLogger()), guestIdentity, roomId, port, controller.GuestOptions{}, nil, guestOutput)
+		}()
+		return guestDone
+	}
+
+	// An impostor knows the trusted guest's public key, which is no secret,
+	// but has to sign with a key of its own.
+	impostor := &identity.Identity{PublicKey: trustedIdentity.PublicKey, PrivateKey: testIdentity(t).PrivateKey}
+	guestDone := connect(impostor)
+	waitForEvent(t, ownerEvents, headless.EventJoinFailed)
+	if code := headless.ExitCode(waitForResult(t, guestDone)); code != headless.ExitDenied {
+		t.Fatalf("expected exit code %d for the impostor, got %d", headless.ExitDenied, code)
+	}
+
+	connect(trustedIdentity)
+	if decided := waitForEvent(t, ownerEvents, headless.EventJoinDecided); decided.Accepted == nil || !*decided.Accepted {
+		t.Fatalf("expected the trusted guest to be accepted, got %+v", decided)
+	}
+}
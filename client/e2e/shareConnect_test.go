@@ -0,0 +1,320 @@
+// Package e2e runs a transporter, a room owner and a guest in-process, each
+// owner and guest with its own fake adb server (see client/adb/adbtest),
+// and drives real ADB traffic through all of them.
+package e2e
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/adb/adbtest"
+	"adb-remote.maci.team/client/config"
+	"adb-remote.maci.team/client/controller"
+	"adb-remote.maci.team/client/identity"
+	"adb-remote.maci.team/client/transportLayer"
+	transporterConfig "adb-remote.maci.team/transporter/config"
+	"adb-remote.maci.team/transporter/directory"
+	"adb-remote.maci.team/transporter/manager/connectionManager"
+	"adb-remote.maci.team/transporter/manager/roomManager"
+	"adb-remote.maci.team/transporter/reservation"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func freeLocalAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve a local port: %s", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// startTransporter runs a transporter until the test ends, returning its
+// address.
+func startTransporter(t *testing.T) string {
+	t.Helper()
+	address := freeLocalAddress(t)
+	dir := t.TempDir()
+	cm := connectionManager.CreateConnectionManager(&transporterConfig.TransporterConfiguration{
+		Address:     address,
+		TLSCertFile: filepath.Join(dir, "cert.pem"),
+		TLSKeyFile:  filepath.Join(dir, "key.pem"),
+	}, newTestLogger())
+	reservations, err := reservation.Load(filepath.Join(dir, "reservations.json"), newTestLogger())
+	if err != nil {
+		t.Fatalf("failed to load the room reservations: %s", err)
+	}
+	// Don't let dir go while the reservations are written to it.
+	t.Cleanup(reservations.Flush)
+	// The test team's token is "secret".
+	teams, err := directory.NewTeams([]transporterConfig.TeamConfiguration{{Name: "mobile", TokenSha256: "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"}})
+	if err != nil {
+		t.Fatalf("NewTeams failed: %s", err)
+	}
+	rm := roomManager.CreateRoomManager(cm, reservations, teams, newTestLogger())
+	go func() { _ = cm.StartServer() }()
+	t.Cleanup(func() {
+		rm.Stop()
+		cm.Stop()
+	})
+	for i := 0; i < 100; i++ {
+		if conn, err := net.DialTimeout("tcp", address, 50*time.Millisecond); err == nil {
+			_ = conn.Close()
+			return address
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("the transporter didn't start listening on %s", address)
+	return ""
+}
+
+// connectClient connects a client to the transporter and completes its
+// handshake.
+func connectClient(t *testing.T, transporterAddress string) *transportLayer.Client {
+	t.Helper()
+	client := startClient(t, transporterAddress)
+	if _, err := controller.Handshake(client); err != nil {
+		t.Fatalf("Handshake failed: %s", err)
+	}
+	return client
+}
+
+// startClient connects a client to the transporter, leaving the handshake
+// to the caller.
+func startClient(t *testing.T, transporterAddress string) *transportLayer.Client {
+	t.Helper()
+	client, err := transportLayer.CreateClient(newTestLogger(), &config.ClientConfiguration{TransporterAddress: transporterAddress})
+	if err != nil {
+		t.Fatalf("CreateClient failed: %s", err)
+	}
+	if err := client.Start(); err != nil {
+		t.Fatalf("failed to connect to the transporter: %s", err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+func testIdentity(t *testing.T) *identity.Identity {
+	t.Helper()
+	testIdentity, err := identity.Load(filepath.Join(t.TempDir(), "identity"))
+	if err != nil {
+		t.Fatalf("failed to create a test identity: %s", err)
+	}
+	return testIdentity
+}
+
+// shareDevices has an owner share serials of ownerServer until ctx is
+// cancelled, returning the room id and where JoinAsRoomOwner's result
+// lands.
+func shareDevices(t *testing.T, ctx context.Context, transporterAddress string, ownerServer *adbtest.Server, serials ...string) (string, <-chan error) {
+	t.Helper()
+	ownerClient := connectClient(t, transporterAddress)
+	ownerEvents := make(chan controller.OwnerEvent, 32)
+	ownerDone := make(chan error, 1)
+	go func() {
+		acceptAll := func(string, []byte) (bool, error) { return true, nil }
+		ownerDone <- controller.JoinAsRoomOwner(ctx, ownerClient, adb.NewAdbSmartSocket(ownerServer.Address(), newTestLogger()), serials, testIdentity(t), acceptAll, func(event controller.OwnerEvent) { ownerEvents <- event }, controller.OwnerOptions{})
+	}()
+	for {
+		select {
+		case event := <-ownerEvents:
+			if event.Kind == controller.OwnerRoomCreated {
+				return event.RoomId, ownerDone
+			}
+		case err := <-ownerDone:
+			t.Fatalf("JoinAsRoomOwner returned early: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the room to be created")
+		}
+	}
+}
+
+// joinRoom joins roomId until ctx is cancelled, allowing guestServer's adb
+// key and waiting for it to list the shared device, and returns its serial
+// there and where JoinAsGuest's result lands.
+func joinRoom(t *testing.T, ctx context.Context, transporterAddress string, guestServer *adbtest.Server, roomId string) (string, <-chan error) {
+	t.Helper()
+	serial, guestDone := startJoiningRoom(t, ctx, transporterAddress, guestServer, roomId)
+	if err := guestServer.WaitForState(serial, adb.TypeDevice, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	return serial, guestDone
+}
+
+// startJoiningRoom is joinRoom without the waiting, for the owner to decide
+// the request meanwhile.
+func startJoiningRoom(t *testing.T, ctx context.Context, transporterAddress string, guestServer *adbtest.Server, roomId string) (string, <-chan error) {
+	t.Helper()
+	guestClient := connectClient(t, transporterAddress)
+	_, port, _ := net.SplitHostPort(freeLocalAddress(t))
+	guestDone := make(chan error, 1)
+	adbKeys, err := adb.LoadAuthorizedKeys("")
+	if err != nil {
+		t.Fatalf("LoadAuthorizedKeys failed: %s", err)
+	}
+	adbKeys.Allow(guestServer.PublicKey())
+	go func() {
+		guestDone <- controller.JoinAsGuest(ctx, guestClient, adb.NewAdbSmartSocket(guestServer.Address(), newTestLogger()), testIdentity(t), roomId, port, nil, controller.GuestOptions{AdbKeys: adbKeys})
+	}()
+	return "127.0.0.1:" + port, guestDone
+}
+
+// TestShareAndConnect shares a scripted device, joins its room, and uses
+// the device from the guest's adb server over shell_v2, sync and tcp
+// streams.
+func TestShareAndConnect(t *testing.T) {
+	transporterAddress := startTransporter(t)
+
+	ownerServer := adbtest.NewServer(t)
+	device := adbtest.NewDevice("emulator-5554")
+	device.Product, device.Model, device.DeviceName = "panther", "Pixel_7", "panther"
+	device.HandleShell("exit 3", adbtest.ShellResult{ExitCode: 3})
+	device.HandleTcp("8080", func(conn net.Conn) { _, _ = io.Copy(conn, conn) })
+	ownerServer.AddDevice(device)
+	guestServer := adbtest.NewServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roomId, ownerDone := shareDevices(t, ctx, transporterAddress, ownerServer, "emulator-5554")
+	serial, guestDone := joinRoom(t, ctx, transporterAddress, guestServer, roomId)
+
+	// The guest's adb server sees the real device.
+	if devices := guestServer.Devices(); len(devices) != 1 || devices[0].Model != "Pixel_7" || devices[0].Product != "panther" {
+		t.Fatalf("expected the guest's adb server to list the shared Pixel_7, got %+v", devices)
+	}
+	host := adb.NewAdbSmartSocket(guestServer.Address(), newTestLogger())
+	features, err := host.Features(serial)
+	if err != nil {
+		t.Fatalf("Features failed: %s", err)
+	}
+	if strings.Join(features, ",") != strings.Join(device.Features, ",") {
+		t.Fatalf("expected the proxy to advertise the device's features %q, got %q", device.Features, features)
+	}
+
+	result, err := adbtest.Shell(host, serial, "echo hello")
+	if err != nil {
+		t.Fatalf("Shell failed: %s", err)
+	}
+	if result.Stdout != "hello\n" || result.ExitCode != 0 {
+		t.Fatalf("unexpected echo result: %+v", result)
+	}
+	if result, err := adbtest.Shell(host, serial, "exit 3"); err != nil || result.ExitCode != 3 {
+		t.Fatalf("expected the exit code to be relayed, got %+v (%v)", result, err)
+	}
+
+	content := bytes.Repeat([]byte("adb-remote "), 20000)
+	if err := adbtest.Push(host, serial, "/sdcard/pushed.bin", content); err != nil {
+		t.Fatalf("Push failed: %s", err)
+	}
+	if stored, ok := device.File("/sdcard/pushed.bin"); !ok || !bytes.Equal(stored, content) {
+		t.Fatalf("expected the pushed file to reach the owner's device")
+	}
+	pulled, err := adbtest.Pull(host, serial, "/sdcard/pushed.bin")
+	if err != nil {
+		t.Fatalf("Pull failed: %s", err)
+	}
+	if !bytes.Equal(pulled, content) {
+		t.Fatalf("expected to pull back the %d pushed bytes, got %d", len(content), len(pulled))
+	}
+
+	conn, err := host.OpenStream(serial, "tcp:8080")
+	if err != nil {
+		t.Fatalf("OpenStream(tcp:8080) failed: %s", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("expected the device's tcp:8080 to echo, got %q (%v)", reply, err)
+	}
+	_ = conn.Close()
+
+	cancel()
+	for _, done := range []<-chan error{guestDone, ownerDone} {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the session didn't stop after cancellation")
+		}
+	}
+	if devices := guestServer.Devices(); len(devices) != 0 {
+		t.Fatalf("expected the guest to disconnect its adb server on the way out, got %+v", devices)
+	}
+}
+
+// TestTwoLocalAdbServersShareOneDevice connects a second local adb server
+// to the guest's proxy and has both use the shared device at the same
+// time, over the one room link.
+func TestTwoLocalAdbServersShareOneDevice(t *testing.T) {
+	transporterAddress := startTransporter(t)
+	ownerServer := adbtest.NewServer(t)
+	ownerServer.AddDevice(adbtest.NewDevice("emulator-5554"))
+	guestServer := adbtest.NewServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	roomId, _ := shareDevices(t, ctx, transporterAddress, ownerServer, "emulator-5554")
+	serial, _ := joinRoom(t, ctx, transporterAddress, guestServer, roomId)
+
+	secondServer := adbtest.NewServer(t)
+	if err := adb.NewAdbSmartSocket(secondServer.Address(), newTestLogger()).Connect(serial); err != nil {
+		t.Fatalf("Connect failed: %s", err)
+	}
+	if err := secondServer.WaitForState(serial, adb.TypeDevice, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second server is let in because it shares the first one's adb
+	// key, as every adb server of one user does. Both number their streams
+	// from 1, so their streams only stay apart if the guest remaps them.
+	const rounds = 20
+	errs := make(chan error, 2)
+	for i, server := range []*adbtest.Server{guestServer, secondServer} {
+		go func() {
+			host := adb.NewAdbSmartSocket(server.Address(), newTestLogger())
+			content := bytes.Repeat([]byte{byte('a' + i)}, 50000)
+			path := fmt.Sprintf("/sdcard/server%d.bin", i)
+			for round := 0; round < rounds; round++ {
+				want := fmt.Sprintf("server%d round%d", i, round)
+				result, err := adbtest.Shell(host, serial, "echo "+want)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if result.Stdout != want+"\n" {
+					errs <- fmt.Errorf("expected %q, got %q", want+"\n", result.Stdout)
+					return
+				}
+			}
+			if err := adbtest.Push(host, serial, path, content); err != nil {
+				errs <- err
+				return
+			}
+			pulled, err := adbtest.Pull(host, serial, path)
+			if err == nil && !bytes.Equal(pulled, content) {
+				err = fmt.Errorf("pulled back %d bytes that aren't what server %d pushed", len(pulled), i)
+			}
+			errs <- err
+		}()
+	}
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package headless
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/control"
+	"adb-remote.maci.team/client/controller"
+	"adb-remote.maci.team/client/identity"
+	"adb-remote.maci.team/client/transportLayer"
+	"context"
+	"io"
+	"sync/atomic"
+)
+
+// RunConnect joins roomId and serves its devices until ctx is cancelled
+// or the session ends, printing what happens to output. options is passed
+// through to controller.JoinAsGuest; without an ApproveAdbKey, local adb
+// servers with unknown keys are refused (and EventAdbKeyRefused printed)
+// rather than asked about. session, if non-nil, is told about the room
+// (see client/control). It returns nil when the session was stopped on
+// purpose; see ExitCode for the rest.
+func RunConnect(ctx context.Context, client *transportLayer.Client, smartSocket adb.IAdbSmartSocket, guestIdentity *identity.Identity, roomId string, localPort string, options controller.GuestOptions, session *control.GuestSession, output io.Writer) error {
+	printer := NewPrinter(output)
+
+	clientId, err := controller.Handshake(client)
+	if err != nil {
+		return transportError(printer, err)
+	}
+	printer.Print(Event{Event: EventConnected, ClientId: clientId, Fingerprint: guestIdentity.Fingerprint(), RoomId: roomId})
+
+	if options.ApproveAdbKey == nil {
+		options.ApproveAdbKey = func(ctx context.Context, key *adb.PublicKey) (bool, bool) {
+			printer.Print(Event{Event: EventAdbKeyRefused, AdbKeyFingerprint: key.Fingerprint(), AdbKeyComment: key.Comment})
+			return false, false
+		}
+	}
+	var transportLost atomic.Bool
+	onEvent := func(e controller.GuestEvent) {
+		session.GuestEvent(e)
+		event, ok := guestEvent(e)
+		if !ok {
+			return
+		}
+		event.RoomId = roomId
+		if event.Event == EventTransportLost {
+			transportLost.Store(true)
+		}
+		printer.Print(event)
+	}
+
+	err = controller.JoinAsGuest(ctx, client, smartSocket, guestIdentity, roomId, localPort, onEvent, options)
+	if ctx.Err() != nil {
+		return nil
+	}
+	if transportLost.Load() {
+		// Already printed from its GuestTransportLost.
+		return err
+	}
+	return transportError(printer, err)
+}
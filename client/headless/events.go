@@ -0,0 +1,272 @@
+// Package headless runs `share` and `connect` without a TUI, for CI jobs,
+// systemd units and scripts: it drives the controllers directly, prints what
+// happens as JSON lines (see Event), takes join decisions from an
+// AcceptPolicy rather than a prompt, and tells how a session ended through
+// ExitCode.
+package headless
+
+import (
+	"adb-remote.maci.team/client/controller"
+	"adb-remote.maci.team/client/identity"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// Event names.
+const (
+	// EventConnected is printed once the transporter handshake is done,
+	// with this client's ClientId and identity Fingerprint.
+	EventConnected     = "connected"
+	EventRoomCreated   = "roomCreated"
+	EventJoinRequested = "joinRequested"
+	EventJoinDecided   = "joinDecided"
+	EventJoinFailed    = "joinFailed"
+	EventGuestLeft     = "guestLeft"
+	EventServiceDenied = "serviceDenied"
+	EventDeviceOffline = "deviceOffline"
+	EventDeviceOnline  = "deviceOnline"
+	// EventRoomPublished and EventPublishFailed tell whether the room got
+	// listed in Team's room directory.
+	EventRoomPublished = "roomPublished"
+	EventPublishFailed = "publishFailed"
+	// EventRooms is printed by `list`, with the Rooms of Team's room
+	// directory (none if Rooms is missing).
+	EventRooms      = "rooms"
+	EventDeviceInfo = "deviceInfo"
+	EventProxyReady = "proxyReady"
+	// EventLocalAdbConnected and EventRelayStopped bracket one local adb
+	// server's connection to a proxy.
+	EventLocalAdbConnected = "localAdbConnected"
+	EventRelayStopped      = "relayStopped"
+	EventAdbConnected      = "adbConnected"
+	EventAdbConnectFailed  = "adbConnectFailed"
+	// EventAdbKeyRefused is printed when a local adb server with an
+	// unknown key is turned away from a proxy; there's nobody to ask.
+	EventAdbKeyRefused  = "adbKeyRefused"
+	EventSessionTimeout = "sessionTimeout"
+	EventTransportLost  = "transportLost"
+	// EventReconnecting is printed before every Attempt at getting back
+	// into the room after the transporter connection was lost, and
+	// EventReconnected, with the new ClientId, once it did.
+	EventReconnecting = "reconnecting"
+	EventReconnected  = "reconnected"
+	// EventLeaseChanged is printed whenever the guest's session lease is
+	// granted or extended, with the LeaseSeconds it has left, and
+	// EventLeaseExpiring, to the guest, a minute before it runs out.
+	// EventLeaseEnded tells it ran out, or was Revoked.
+	EventLeaseChanged  = "leaseChanged"
+	EventLeaseExpiring = "leaseExpiring"
+	EventLeaseEnded    = "leaseEnded"
+	// EventJoinQueue is printed by `share` whenever the guests waiting to
+	// join while another one is in the room change, with their client ids
+	// in Queue (none if Queue is missing), and EventQueued by `connect`
+	// while it waits among them, QueuePosition in line.
+	EventJoinQueue = "joinQueue"
+	EventQueued    = "queued"
+	// EventGuestKicked is printed by `share` when it removed its guest from
+	// the room, and EventKicked by `connect` when the owner removed it,
+	// both with the Reason the owner gave.
+	EventGuestKicked = "guestKicked"
+	EventKicked      = "kicked"
+)
+
+// Event is one line of output. Fields that don't apply to an event are
+// omitted.
+type Event struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	// ClientId and Fingerprint identify this client, on EventConnected.
+	ClientId    string `json:"clientId,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	RoomId      string `json:"roomId,omitempty"`
+	Team        string `json:"team,omitempty"`
+	// Devices lists the serials a room shares.
+	Devices          []string `json:"devices,omitempty"`
+	GuestClientId    string   `json:"guestClientId,omitempty"`
+	GuestFingerprint string   `json:"guestFingerprint,omitempty"`
+	OwnerClientId    string   `json:"ownerClientId,omitempty"`
+	OwnerFingerprint string   `json:"ownerFingerprint,omitempty"`
+	Accepted         *bool    `json:"accepted,omitempty"`
+	// Rejoined is set on an EventJoinDecided for the guest that left
+	// being let back in without asking.
+	Rejoined      bool     `json:"rejoined,omitempty"`
+	Queue         []string `json:"queue,omitempty"`
+	QueuePosition int      `json:"queuePosition,omitempty"`
+	Attempt       int      `json:"attempt,omitempty"`
+	Service       string   `json:"service,omitempty"`
+	Device        string   `json:"device,omitempty"`
+	// State is a device's adb state, on EventDeviceOffline.
+	State string `json:"state,omitempty"`
+	// Description is what the owner says a device is, on EventDeviceInfo.
+	Description  string `json:"description,omitempty"`
+	LocalPort    string `json:"localPort,omitempty"`
+	LocalAddress string `json:"localAddress,omitempty"`
+	// AdbKeyFingerprint and AdbKeyComment identify a refused adb key.
+	AdbKeyFingerprint string `json:"adbKeyFingerprint,omitempty"`
+	AdbKeyComment     string `json:"adbKeyComment,omitempty"`
+	Rooms             []Room `json:"rooms,omitempty"`
+	// LeaseSeconds is what a session lease has left, and Revoked is set on
+	// an EventLeaseEnded for a lease the owner revoked.
+	LeaseSeconds int    `json:"leaseSeconds,omitempty"`
+	Revoked      bool   `json:"revoked,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Printer writes Events as JSON lines. It is safe for concurrent use.
+type Printer struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+	now     func() time.Time
+}
+
+// NewPrinter returns a Printer writing to writer.
+func NewPrinter(writer io.Writer) *Printer {
+	return &Printer{encoder: json.NewEncoder(writer), now: time.Now}
+}
+
+// Print writes event, stamping it with the current time. Write errors are
+// ignored: a closed stdout mustn't stop the session.
+func (p *Printer) Print(event Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	event.Time = p.now().UTC()
+	_ = p.encoder.Encode(event)
+}
+
+// ownerEvent translates a controller.OwnerEvent, or returns false for
+// events that aren't printed.
+func ownerEvent(e controller.OwnerEvent) (Event, bool) {
+	event := Event{
+		RoomId:        e.RoomId,
+		GuestClientId: e.GuestClientId,
+		Service:       e.Service,
+		Device:        e.Device,
+		State:         e.DeviceState,
+		Team:          e.Team,
+		Error:         errorString(e.Err),
+	}
+	if len(e.GuestPublicKey) > 0 {
+		event.GuestFingerprint = identity.Fingerprint(e.GuestPublicKey)
+	}
+	switch e.Kind {
+	case controller.OwnerRoomCreated:
+		event.Event = EventRoomCreated
+	case controller.OwnerJoinRequested:
+		event.Event = EventJoinRequested
+	case controller.OwnerJoinDecided:
+		event.Event = EventJoinDecided
+		event.Accepted = &e.Accepted
+		event.Rejoined = e.Rejoined
+	case controller.OwnerJoinFailed:
+		event.Event = EventJoinFailed
+	case controller.OwnerGuestLeft:
+		event.Event = EventGuestLeft
+	case controller.OwnerServiceDenied:
+		event.Event = EventServiceDenied
+	case controller.OwnerDeviceOffline:
+		event.Event = EventDeviceOffline
+	case controller.OwnerDeviceOnline:
+		event.Event = EventDeviceOnline
+	case controller.OwnerRoomPublished:
+		event.Event = EventRoomPublished
+	case controller.OwnerPublishFailed:
+		event.Event = EventPublishFailed
+	case controller.OwnerJoinQueueChanged:
+		event.Event = EventJoinQueue
+		event.Queue = e.Queue
+	case controller.OwnerLeaseChanged:
+		event.Event = EventLeaseChanged
+		event.LeaseSeconds = leaseSeconds(e.Lease)
+	case controller.OwnerLeaseEnded:
+		event.Event = EventLeaseEnded
+		event.Revoked = e.Revoked
+	case controller.OwnerGuestKicked:
+		event.Event = EventGuestKicked
+		event.Reason = e.Reason
+	default:
+		return Event{}, false
+	}
+	return event, true
+}
+
+// guestEvent translates a controller.GuestEvent, or returns false for
+// events that aren't printed.
+func guestEvent(e controller.GuestEvent) (Event, bool) {
+	event := Event{
+		Device:       e.Device,
+		State:        e.DeviceState,
+		LocalPort:    e.LocalPort,
+		LocalAddress: e.LocalAddress,
+		Error:        errorString(e.Err),
+	}
+	switch e.Kind {
+	case controller.GuestJoinDecided:
+		event.Event = EventJoinDecided
+		event.Accepted = &e.Accepted
+		event.OwnerClientId = e.OwnerClientId
+		event.Devices = e.Devices
+		if len(e.OwnerPublicKey) > 0 {
+			event.OwnerFingerprint = identity.Fingerprint(e.OwnerPublicKey)
+		}
+	case controller.GuestProxyReady:
+		event.Event = EventProxyReady
+	case controller.GuestLocalAdbConnected:
+		event.Event = EventLocalAdbConnected
+	case controller.GuestRelayStopped:
+		event.Event = EventRelayStopped
+	case controller.GuestAdbConnected:
+		event.Event = EventAdbConnected
+	case controller.GuestAdbConnectFailed:
+		event.Event = EventAdbConnectFailed
+	case controller.GuestTransportLost:
+		event.Event = EventTransportLost
+	case controller.GuestDeviceOffline:
+		event.Event = EventDeviceOffline
+	case controller.GuestDeviceOnline:
+		event.Event = EventDeviceOnline
+	case controller.GuestDeviceInfo:
+		event.Event = EventDeviceInfo
+		event.Description = e.DeviceInfo.Describe()
+	case controller.GuestReconnecting:
+		event.Event = EventReconnecting
+		event.Attempt = e.Attempt
+	case controller.GuestReconnected:
+		event.Event = EventReconnected
+		event.ClientId = e.ClientId
+	case controller.GuestQueued:
+		event.Event = EventQueued
+		event.QueuePosition = e.QueuePosition
+	case controller.GuestLeaseChanged:
+		event.Event = EventLeaseChanged
+		event.LeaseSeconds = leaseSeconds(e.Lease)
+	case controller.GuestLeaseExpiring:
+		event.Event = EventLeaseExpiring
+		event.LeaseSeconds = leaseSeconds(e.Lease)
+	case controller.GuestLeaseEnded:
+		event.Event = EventLeaseEnded
+		var leaseEnded *controller.ErrLeaseEnded
+		event.Revoked = errors.As(e.Err, &leaseEnded) && leaseEnded.Revoked
+	case controller.GuestKicked:
+		event.Event = EventKicked
+		event.Reason = e.Reason
+	default:
+		return Event{}, false
+	}
+	return event, true
+}
+
+// leaseSeconds rounds what a lease has left up to whole seconds.
+func leaseSeconds(remaining time.Duration) int {
+	return int((remaining + time.Second - 1) / time.Second)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
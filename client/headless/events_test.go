@@ -0,0 +1,95 @@
+package headless
+
+import (
+	"adb-remote.maci.team/client/controller"
+	"adb-remote.maci.team/client/identity"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrinterWritesOneJSONObjectPerLine(t *testing.T) {
+	var output bytes.Buffer
+	printer := NewPrinter(&output)
+	printer.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+	declined := false
+	printer.Print(Event{Event: EventJoinDecided, GuestClientId: "GUEST1", Accepted: &declined})
+	printer.Print(Event{Event: EventTransportLost})
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", output.String())
+	}
+	if lines[0] != `{"time":"2024-01-02T03:04:05Z","event":"joinDecided","guestClientId":"GUEST1","accepted":false}` {
+		t.Fatalf("unexpected line %s", lines[0])
+	}
+	if lines[1] != `{"time":"2024-01-02T03:04:05Z","event":"transportLost"}` {
+		t.Fatalf("unexpected line %s", lines[1])
+	}
+}
+
+func TestOwnerEventsCarryTheGuestFingerprint(t *testing.T) {
+	publicKey := []byte("0123456789abcdef0123456789abcdef")
+	event, ok := ownerEvent(controller.OwnerEvent{Kind: controller.OwnerJoinRequested, GuestClientId: "GUEST1", GuestPublicKey: publicKey})
+	if !ok || event.Event != EventJoinRequested || event.GuestFingerprint != identity.Fingerprint(publicKey) {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	data, _ := json.Marshal(event)
+	if strings.Contains(string(data), "accepted") {
+		t.Fatalf("did not expect a join request to say whether it was accepted: %s", data)
+	}
+}
+
+func TestGuestEventsDescribeProxies(t *testing.T) {
+	event, ok := guestEvent(controller.GuestEvent{Kind: controller.GuestProxyReady, Device: "emulator-5554", LocalPort: "6000", LocalAddress: "127.0.0.1:6000"})
+	if !ok || event.Event != EventProxyReady || event.LocalAddress != "127.0.0.1:6000" || event.Device != "emulator-5554" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+}
+
+func TestGuestEventsReportReconnections(t *testing.T) {
+	event, ok := guestEvent(controller.GuestEvent{Kind: controller.GuestReconnecting, Attempt: 2, Err: errors.New("connection refused")})
+	if !ok || event.Event != EventReconnecting || event.Attempt != 2 || event.Error != "connection refused" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	event, ok = guestEvent(controller.GuestEvent{Kind: controller.GuestReconnected, ClientId: "CLIENT2"})
+	if !ok || event.Event != EventReconnected || event.ClientId != "CLIENT2" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+}
+
+func TestJoinQueueEvents(t *testing.T) {
+	event, ok := ownerEvent(controller.OwnerEvent{Kind: controller.OwnerJoinQueueChanged, Queue: []string{"GUEST2"}})
+	if !ok || event.Event != EventJoinQueue || len(event.Queue) != 1 || event.Queue[0] != "GUEST2" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	event, ok = guestEvent(controller.GuestEvent{Kind: controller.GuestQueued, QueuePosition: 3})
+	if !ok || event.Event != EventQueued || event.QueuePosition != 3 {
+		t.Fatalf("unexpected event %+v", event)
+	}
+}
+
+func TestLeaseEventsCarryWhatIsLeft(t *testing.T) {
+	event, ok := ownerEvent(controller.OwnerEvent{Kind: controller.OwnerLeaseChanged, GuestClientId: "GUEST1", Lease: 90*time.Second - time.Millisecond})
+	if !ok || event.Event != EventLeaseChanged || event.LeaseSeconds != 90 || event.GuestClientId != "GUEST1" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	event, ok = guestEvent(controller.GuestEvent{Kind: controller.GuestLeaseEnded, Err: &controller.ErrLeaseEnded{Revoked: true}})
+	if !ok || event.Event != EventLeaseEnded || !event.Revoked {
+		t.Fatalf("unexpected event %+v", event)
+	}
+}
+
+func TestKickEventsCarryTheReason(t *testing.T) {
+	event, ok := ownerEvent(controller.OwnerEvent{Kind: controller.OwnerGuestKicked, GuestClientId: "GUEST1", Reason: "Session over"})
+	if !ok || event.Event != EventGuestKicked || event.GuestClientId != "GUEST1" || event.Reason != "Session over" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	event, ok = guestEvent(controller.GuestEvent{Kind: controller.GuestKicked, Reason: "Session over", Err: &controller.ErrKicked{Reason: "Session over"}})
+	if !ok || event.Event != EventKicked || event.Reason != "Session over" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+}
@@ -0,0 +1,48 @@
+package headless
+
+import (
+	"adb-remote.maci.team/client/controller"
+	"adb-remote.maci.team/client/relay"
+	"errors"
+)
+
+// Exit codes of a headless session, so scripts can tell why it ended
+// without parsing the output. 2 is left to the flag package's usage errors.
+const (
+	ExitOK            = 0
+	ExitError         = 1
+	ExitDenied        = 3
+	ExitRoomNotFound  = 4
+	ExitTransportLost = 5
+	ExitLeaseEnded    = 6
+	ExitKicked        = 7
+)
+
+// ExitCode returns the exit code for what RunShare, RunConnect or RunList
+// returned.
+func ExitCode(err error) int {
+	var denied *controller.ErrJoinRoomDenied
+	var notFound *controller.ErrRoomNotFound
+	var teamDenied *controller.ErrTeamAccessDenied
+	var leaseEnded *controller.ErrLeaseEnded
+	var kicked *controller.ErrKicked
+	switch {
+	case err == nil:
+		return ExitOK
+	// Checked first: a guest that lost its connection and then found its
+	// room gone or was turned away re-joining it still lost its session
+	// to the transport.
+	case errors.Is(err, relay.ErrTransportClosed):
+		return ExitTransportLost
+	case errors.As(err, &denied), errors.As(err, &teamDenied):
+		return ExitDenied
+	case errors.As(err, &notFound):
+		return ExitRoomNotFound
+	case errors.As(err, &leaseEnded):
+		return ExitLeaseEnded
+	case errors.As(err, &kicked):
+		return ExitKicked
+	default:
+		return ExitError
+	}
+}
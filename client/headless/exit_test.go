@@ -0,0 +1,30 @@
+package headless
+
+import (
+	"adb-remote.maci.team/client/controller"
+	"adb-remote.maci.team/client/relay"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestExitCodeTellsWhySessionsEnded(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		code int
+	}{
+		{nil, ExitOK},
+		{&controller.ErrJoinRoomDenied{RoomId: "ROOM1"}, ExitDenied},
+		{&controller.ErrTeamAccessDenied{Team: "mobile"}, ExitDenied},
+		{fmt.Errorf("joining: %w", &controller.ErrRoomNotFound{RoomId: "ROOM1"}), ExitRoomNotFound},
+		{relay.ErrTransportClosed, ExitTransportLost},
+		{fmt.Errorf("%w; re-joining room ROOM1 failed: %w", relay.ErrTransportClosed, &controller.ErrRoomNotFound{RoomId: "ROOM1"}), ExitTransportLost},
+		{&controller.ErrLeaseEnded{Revoked: true}, ExitLeaseEnded},
+		{&controller.ErrKicked{Reason: "Session over"}, ExitKicked},
+		{errors.New("anything else"), ExitError},
+	} {
+		if code := ExitCode(test.err); code != test.code {
+			t.Fatalf("expected exit code %d for %v, got %d", test.code, test.err, code)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package headless
+
+import (
+	"adb-remote.maci.team/client/controller"
+	"adb-remote.maci.team/client/identity"
+	"adb-remote.maci.team/client/transportLayer"
+	"io"
+)
+
+// Room is a room of a team's room directory, on EventRooms.
+type Room struct {
+	RoomId           string   `json:"roomId"`
+	Label            string   `json:"label,omitempty"`
+	OwnerFingerprint string   `json:"ownerFingerprint,omitempty"`
+	Models           []string `json:"models,omitempty"`
+	Tags             []string `json:"tags,omitempty"`
+	Occupied         bool     `json:"occupied,omitempty"`
+}
+
+// RunList prints the rooms listed in team's room directory, presenting
+// teamToken, as a single EventRooms. See ExitCode for what it returns.
+func RunList(client *transportLayer.Client, team string, teamToken string, output io.Writer) error {
+	printer := NewPrinter(output)
+
+	if _, err := controller.Handshake(client); err != nil {
+		return transportError(printer, err)
+	}
+	listings, err := controller.ListRooms(client, team, teamToken)
+	if err != nil {
+		return transportError(printer, err)
+	}
+	rooms := make([]Room, 0, len(listings))
+	for _, listing := range listings {
+		room := Room{
+			RoomId:   listing.RoomId,
+			Label:    listing.Label,
+			Models:   listing.Models,
+			Tags:     listing.Tags,
+			Occupied: listing.Occupied,
+		}
+		if len(listing.OwnerPublicKey) > 0 {
+			room.OwnerFingerprint = identity.Fingerprint(listing.OwnerPublicKey)
+		}
+		rooms = append(rooms, room)
+	}
+	printer.Print(Event{Event: EventRooms, Team: team, Rooms: rooms})
+	return nil
+}
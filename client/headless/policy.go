@@ -0,0 +1,155 @@
+package headless
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// AcceptPolicy decides room join requests without anyone at a terminal. A
+// request is accepted if AcceptAll is set or the guest's identity
+// fingerprint is one of Fingerprints; otherwise Decisions is asked, if set,
+// and the request is declined if not. It's only asked about requests whose
+// signature verified (see controller.ErrInvalidJoinSignature), so the
+// fingerprint is the guest's own.
+type AcceptPolicy struct {
+	AcceptAll    bool
+	Fingerprints []string
+	Decisions    *Decisions
+}
+
+// Decide returns whether the guest guestClientId, whose identity has
+// guestFingerprint, may join.
+func (p AcceptPolicy) Decide(ctx context.Context, guestClientId string, guestFingerprint string) (bool, error) {
+	if p.allows(guestFingerprint) {
+		return true, nil
+	}
+	if p.Decisions == nil {
+		return false, nil
+	}
+	return p.Decisions.wait(ctx, guestClientId)
+}
+
+// allows reports whether the guest with guestFingerprint is accepted
+// without asking.
+func (p AcceptPolicy) allows(guestFingerprint string) bool {
+	if p.AcceptAll {
+		return true
+	}
+	for _, fingerprint := range p.Fingerprints {
+		if fingerprint == guestFingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseFingerprints splits a comma-separated list of identity fingerprints
+// ("SHA256:..."), dropping blanks.
+func ParseFingerprints(list string) ([]string, error) {
+	var fingerprints []string
+	for _, fingerprint := range strings.Split(list, ",") {
+		fingerprint = strings.TrimSpace(fingerprint)
+		if fingerprint == "" {
+			continue
+		}
+		if !strings.HasPrefix(fingerprint, "SHA256:") {
+			return nil, fmt.Errorf("invalid fingerprint %q: expected SHA256:<base64>", fingerprint)
+		}
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	return fingerprints, nil
+}
+
+// Decision is one line of the decision protocol: whether the guest that
+// asked to join as GuestClientId (see EventJoinRequested) may.
+type Decision struct {
+	GuestClientId string `json:"guestClientId"`
+	Accept        bool   `json:"accept"`
+}
+
+// Decisions are join decisions read from a stream, typically stdin, as
+// JSON lines of Decision. A decision may come before the request is asked
+// about; once the stream ends, every undecided request is declined.
+type Decisions struct {
+	mu      sync.Mutex
+	waiting map[string]chan bool
+	decided map[string]bool
+	closed  bool
+}
+
+// ReadDecisions starts reading decisions from reader until it ends. Lines
+// that aren't a Decision are logged and skipped.
+func ReadDecisions(reader io.Reader, logger *slog.Logger) *Decisions {
+	d := &Decisions{waiting: make(map[string]chan bool), decided: make(map[string]bool)}
+	go func() {
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			var decision Decision
+			if err := json.Unmarshal([]byte(line), &decision); err != nil || decision.GuestClientId == "" {
+				logger.Error(fmt.Sprintf("Ignoring invalid join decision %q", line))
+				continue
+			}
+			d.decide(decision)
+		}
+		d.close()
+	}()
+	return d
+}
+
+func (d *Decisions) decide(decision Decision) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if respond, ok := d.waiting[decision.GuestClientId]; ok {
+		delete(d.waiting, decision.GuestClientId)
+		respond <- decision.Accept
+		return
+	}
+	d.decided[decision.GuestClientId] = decision.Accept
+}
+
+func (d *Decisions) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	for guestClientId, respond := range d.waiting {
+		delete(d.waiting, guestClientId)
+		respond <- false
+	}
+}
+
+// wait returns the decision about guestClientId, once there is one.
+func (d *Decisions) wait(ctx context.Context, guestClientId string) (bool, error) {
+	d.mu.Lock()
+	if accept, ok := d.decided[guestClientId]; ok {
+		delete(d.decided, guestClientId)
+		d.mu.Unlock()
+		return accept, nil
+	}
+	if d.closed {
+		d.mu.Unlock()
+		return false, nil
+	}
+	respond := make(chan bool, 1)
+	d.waiting[guestClientId] = respond
+	d.mu.Unlock()
+
+	select {
+	case accept := <-respond:
+		return accept, nil
+	case <-ctx.Done():
+		d.mu.Lock()
+		delete(d.waiting, guestClientId)
+		d.mu.Unlock()
+		return false, ctx.Err()
+	}
+}
@@ -0,0 +1,86 @@
+package headless
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func TestAcceptPolicyAcceptsAllowedFingerprintsOnly(t *testing.T) {
+	policy := AcceptPolicy{Fingerprints: []string{"SHA256:allowed"}}
+	if accepted, err := policy.Decide(context.Background(), "GUEST1", "SHA256:allowed"); err != nil || !accepted {
+		t.Fatalf("expected an allowed fingerprint to be accepted, got %v (%v)", accepted, err)
+	}
+	if accepted, err := policy.Decide(context.Background(), "GUEST2", "SHA256:other"); err != nil || accepted {
+		t.Fatalf("expected any other fingerprint to be declined, got %v (%v)", accepted, err)
+	}
+	policy.AcceptAll = true
+	if accepted, _ := policy.Decide(context.Background(), "GUEST2", "SHA256:other"); !accepted {
+		t.Fatalf("expected AcceptAll to accept everyone")
+	}
+}
+
+func TestDecisionsAnswerWaitingAndLaterRequests(t *testing.T) {
+	reader, writer := io.Pipe()
+	policy := AcceptPolicy{Decisions: ReadDecisions(reader, newTestLogger())}
+
+	decided := make(chan bool, 1)
+	go func() {
+		accepted, _ := policy.Decide(context.Background(), "GUEST1", "SHA256:unknown")
+		decided <- accepted
+	}()
+	// Garbage is skipped, and decisions for other guests don't answer this one.
+	if _, err := io.WriteString(writer, "accept GUEST1\n{\"guestClientId\":\"GUEST2\",\"accept\":true}\n"); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	select {
+	case accepted := <-decided:
+		t.Fatalf("did not expect a decision yet, got %v", accepted)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := io.WriteString(writer, "{\"guestClientId\":\"GUEST1\",\"accept\":true}\n"); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	select {
+	case accepted := <-decided:
+		if !accepted {
+			t.Fatalf("expected GUEST1 to be accepted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the decision")
+	}
+
+	// GUEST2's decision came before it was asked about.
+	if accepted, err := policy.Decide(context.Background(), "GUEST2", "SHA256:unknown"); err != nil || !accepted {
+		t.Fatalf("expected the earlier decision about GUEST2 to be used, got %v (%v)", accepted, err)
+	}
+
+	_ = writer.Close()
+	if accepted, err := policy.Decide(context.Background(), "GUEST3", "SHA256:unknown"); err != nil || accepted {
+		t.Fatalf("expected requests to be declined once stdin ends, got %v (%v)", accepted, err)
+	}
+}
+
+func TestDecisionsDeclineWaitingRequestsWhenTheStreamEnds(t *testing.T) {
+	policy := AcceptPolicy{Decisions: ReadDecisions(strings.NewReader(""), newTestLogger())}
+	if accepted, err := policy.Decide(context.Background(), "GUEST1", "SHA256:unknown"); err != nil || accepted {
+		t.Fatalf("expected the request to be declined, got %v (%v)", accepted, err)
+	}
+}
+
+func TestParseFingerprints(t *testing.T) {
+	fingerprints, err := ParseFingerprints(" SHA256:abc, ,SHA256:def")
+	if err != nil || strings.Join(fingerprints, ",") != "SHA256:abc,SHA256:def" {
+		t.Fatalf("unexpected fingerprints %q (%v)", fingerprints, err)
+	}
+	if _, err := ParseFingerprints("abc"); err == nil {
+		t.Fatalf("expected a fingerprint without the SHA256: prefix to be rejected")
+	}
+}
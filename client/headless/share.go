@@ -0,0 +1,93 @@
+package headless
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/control"
+	"adb-remote.maci.team/client/controller"
+	"adb-remote.maci.team/client/identity"
+	"adb-remote.maci.team/client/relay"
+	"adb-remote.maci.team/client/transportLayer"
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// RunShare shares devices until ctx is cancelled, sessionTimeout elapses
+// (if positive) or the transporter connection is lost, printing what
+// happens to output and deciding join requests with policy. options is
+// passed through to controller.JoinAsRoomOwner as-is. session, if non-nil,
+// is told about the room, extends and revokes leases with options.Leases,
+// removes the guest with options.Kicker (a new one if it's nil), and
+// decides the join requests policy doesn't accept, unless policy.Decisions
+// answers first (see client/control). It returns nil when the session was
+// stopped on purpose; see ExitCode for the rest.
+func RunShare(ctx context.Context, client *transportLayer.Client, smartSocket adb.IAdbSmartSocket, ownerIdentity *identity.Identity, devices []string, policy AcceptPolicy, sessionTimeout time.Duration, options controller.OwnerOptions, session *control.OwnerSession, output io.Writer) error {
+	if len(devices) == 0 {
+		return errors.New("there's no device picker in headless mode: name the devices to share with -targetDevice")
+	}
+	printer := NewPrinter(output)
+	session.SetLeases(options.Leases)
+	if options.Kicker == nil {
+		options.Kicker = controller.NewKicker()
+	}
+	session.SetKicker(options.Kicker)
+
+	clientId, err := controller.Handshake(client)
+	if err != nil {
+		return transportError(printer, err)
+	}
+	printer.Print(Event{Event: EventConnected, ClientId: clientId, Fingerprint: ownerIdentity.Fingerprint()})
+
+	ownerCtx, cancelOwner := context.WithCancel(ctx)
+	defer cancelOwner()
+	var timedOut atomic.Bool
+	if sessionTimeout > 0 {
+		timer := time.AfterFunc(sessionTimeout, func() {
+			timedOut.Store(true)
+			printer.Print(Event{Event: EventSessionTimeout})
+			cancelOwner()
+		})
+		defer timer.Stop()
+	}
+
+	promptAccept := func(guestClientId string, guestPublicKey []byte) (bool, error) {
+		fingerprint := identity.Fingerprint(guestPublicKey)
+		if session == nil || policy.allows(fingerprint) {
+			return policy.Decide(ownerCtx, guestClientId, fingerprint)
+		}
+		var ask func(ctx context.Context) (bool, error)
+		if policy.Decisions != nil {
+			ask = func(ctx context.Context) (bool, error) {
+				return policy.Decisions.wait(ctx, guestClientId)
+			}
+		}
+		return session.Decide(ownerCtx, guestClientId, guestPublicKey, ask)
+	}
+	onEvent := func(e controller.OwnerEvent) {
+		session.OwnerEvent(e)
+		event, ok := ownerEvent(e)
+		if ok {
+			if event.Event == EventRoomCreated {
+				event.Devices = devices
+			}
+			printer.Print(event)
+		}
+	}
+
+	err = controller.JoinAsRoomOwner(ownerCtx, client, smartSocket, devices, ownerIdentity, promptAccept, onEvent, options)
+	if ctx.Err() != nil || timedOut.Load() {
+		return nil
+	}
+	return transportError(printer, err)
+}
+
+// transportError prints EventTransportLost if err is the transporter
+// connection closing, and returns err.
+func transportError(printer *Printer, err error) error {
+	if errors.Is(err, relay.ErrTransportClosed) {
+		printer.Print(Event{Event: EventTransportLost})
+	}
+	return err
+}
@@ -0,0 +1,39 @@
+// Package unixsocket listens on unix sockets only the current user may
+// connect to, the way only they can reach something listening on loopback.
+package unixsocket
+
+import (
+	"net"
+	"os"
+)
+
+// Listen listens on the unix socket at path, first removing a socket a
+// listener that didn't shut down cleanly left behind there, and restricts
+// it to the current user. Closing the listener removes the socket.
+func Listen(path string) (net.Listener, error) {
+	removeStale(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// removeStale removes the unix socket at path if nothing listens on it
+// anymore. A socket something still listens on is left alone, for Listen
+// to fail on.
+func removeStale(path string) {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode().Type() != os.ModeSocket {
+		return
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return
+	}
+	_ = os.Remove(path)
+}
@@ -0,0 +1,32 @@
+package unixsocket
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenReplacesStaleSocketsOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sock")
+	// A socket left behind by a listener that didn't remove it.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("failed to create a socket: %s", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	listener, err := Listen(path)
+	if err != nil {
+		t.Fatalf("expected the stale socket to be replaced, got %s", err)
+	}
+	defer listener.Close()
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected the socket to be owner-only, got %v (%v)", info.Mode(), err)
+	}
+	if _, err := Listen(path); err == nil {
+		t.Fatalf("did not expect to take over a socket that is still listened on")
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"adb-remote.maci.team/client/command"
 	"adb-remote.maci.team/client/di"
+	"errors"
 	"fmt"
 	"os"
 )
@@ -16,6 +17,10 @@ func main() {
 	}
 	if err := command.ParseCommand(commands); err != nil {
 		fmt.Fprintln(os.Stderr, err)
+		var exitErr *command.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,85 @@
+// Package policy decides which ADB services a guest may open on a shared
+// device. The owner's OwnerMultiplexer consults it (as a
+// relay.ServiceFilter) for every OPEN before anything reaches the local
+// adb-server, so a denied service never touches the device at all.
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrServiceDenied is wrapped by every error CheckOpen returns, so callers
+// can tell a policy decision apart from any other failure.
+var ErrServiceDenied = errors.New("service denied by policy")
+
+// ServicePolicy is a set of allow/deny rules on service string prefixes
+// (e.g. "shell,v2", "reboot:", "root:"), as loaded from a JSON file:
+//
+//	{ "allow": ["shell,v2", "sync:"], "deny": ["reboot:", "root:"] }
+//
+// Deny rules win over allow rules. An empty allow list allows everything
+// that isn't denied; a non-empty one allows only what matches it.
+type ServicePolicy struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// Load reads and validates a ServicePolicy from the JSON file at path.
+func Load(path string) (*ServicePolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	policy := ServicePolicy{}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("invalid service policy %s: %w", path, err)
+	}
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid service policy %s: %w", path, err)
+	}
+	return &policy, nil
+}
+
+// validate rejects empty prefixes: an empty string matches every service,
+// which is almost certainly a mistake in the file rather than the intent.
+func (p *ServicePolicy) validate() error {
+	for _, prefix := range p.Allow {
+		if prefix == "" {
+			return errors.New("empty prefix in the allow list")
+		}
+	}
+	for _, prefix := range p.Deny {
+		if prefix == "" {
+			return errors.New("empty prefix in the deny list")
+		}
+	}
+	return nil
+}
+
+// CheckOpen returns an error wrapping ErrServiceDenied if service must not
+// be opened, naming the rule responsible.
+func (p *ServicePolicy) CheckOpen(service string) error {
+	if prefix, ok := matchPrefix(p.Deny, service); ok {
+		return fmt.Errorf("%w: matches deny rule %q", ErrServiceDenied, prefix)
+	}
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	if _, ok := matchPrefix(p.Allow, service); ok {
+		return nil
+	}
+	return fmt.Errorf("%w: not in the allow list", ErrServiceDenied)
+}
+
+func matchPrefix(prefixes []string, service string) (string, bool) {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(service, prefix) {
+			return prefix, true
+		}
+	}
+	return "", false
+}
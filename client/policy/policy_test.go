@@ -0,0 +1,91 @@
+package policy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writePolicyFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write the test policy file: %s", err)
+	}
+	return path
+}
+
+func TestCheckOpenDenyWinsOverAllow(t *testing.T) {
+	p := &ServicePolicy{Allow: []string{"shell,v2", "reboot:"}, Deny: []string{"reboot:", "root:"}}
+
+	if err := p.CheckOpen("shell,v2,raw:ls"); err != nil {
+		t.Fatalf("expected shell,v2 to be allowed, got %s", err)
+	}
+	for _, service := range []string{"reboot:", "reboot:bootloader", "root:"} {
+		if err := p.CheckOpen(service); !errors.Is(err, ErrServiceDenied) {
+			t.Fatalf("expected %q to be denied, got %v", service, err)
+		}
+	}
+}
+
+func TestCheckOpenNonEmptyAllowListIsExclusive(t *testing.T) {
+	p := &ServicePolicy{Allow: []string{"shell,v2"}}
+	if err := p.CheckOpen("sync:"); !errors.Is(err, ErrServiceDenied) {
+		t.Fatalf("expected sync: to be denied by the allow list, got %v", err)
+	}
+}
+
+func TestCheckOpenEmptyAllowListAllowsEverythingNotDenied(t *testing.T) {
+	p := &ServicePolicy{Deny: []string{"remount:"}}
+	if err := p.CheckOpen("sync:"); err != nil {
+		t.Fatalf("expected sync: to be allowed, got %s", err)
+	}
+	if err := p.CheckOpen("remount:"); !errors.Is(err, ErrServiceDenied) {
+		t.Fatalf("expected remount: to be denied, got %v", err)
+	}
+}
+
+func TestLoadParsesRules(t *testing.T) {
+	path := writePolicyFile(t, `{"allow": ["shell,v2"], "deny": ["reboot:"]}`)
+	p, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %s", err)
+	}
+	if len(p.Allow) != 1 || p.Allow[0] != "shell,v2" || len(p.Deny) != 1 || p.Deny[0] != "reboot:" {
+		t.Fatalf("unexpected policy: %+v", p)
+	}
+}
+
+// TestExamplePolicyDoesWhatTheReadmeSays checks the example policy file
+// against what the README promises it allows and denies.
+func TestExamplePolicyDoesWhatTheReadmeSays(t *testing.T) {
+	p, err := Load(filepath.Join("..", "servicePolicy.example.json"))
+	if err != nil {
+		t.Fatalf("Load failed: %s", err)
+	}
+	for _, service := range []string{"sync:", "framebuffer:", "localabstract:scrcpy"} {
+		if err := p.CheckOpen(service); err != nil {
+			t.Fatalf("expected %q to be allowed, got %s", service, err)
+		}
+	}
+	for _, service := range []string{"localabstract:chrome_devtools_remote", "localabstract:webview_devtools_remote_1234", "tcp:5555", "tcp:localhost:5555", "shell:reboot", "reboot:"} {
+		if err := p.CheckOpen(service); !errors.Is(err, ErrServiceDenied) {
+			t.Fatalf("expected %q to be denied, got %v", service, err)
+		}
+	}
+}
+
+func TestLoadRejectsEmptyPrefix(t *testing.T) {
+	path := writePolicyFile(t, `{"deny": [""]}`)
+	if _, err := Load(path); err == nil {
+		t.Fatalf("expected an error for an empty prefix")
+	}
+}
+
+func TestLoadInvalidJson(t *testing.T) {
+	path := writePolicyFile(t, `not json`)
+	if _, err := Load(path); err == nil {
+		t.Fatalf("expected an error for invalid JSON")
+	}
+}
@@ -0,0 +1,225 @@
+package policy
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/relay"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// readOnlyCommands are the shell commands a read-only guest may run. Each
+// only reads device state, as long as the options in readOnlyDeniedOptions
+// are left out and dumpsys is given a service name at most (see
+// checkReadOnlyArguments).
+var readOnlyCommands = map[string]bool{
+	"logcat":    true,
+	"screencap": true,
+	"dumpsys":   true,
+	"getprop":   true,
+}
+
+// readOnlyDeniedOptions are options of readOnlyCommands that write to the
+// device: clearing or resizing log buffers, writing log files, changing the
+// logd prune list.
+var readOnlyDeniedOptions = map[string][]string{
+	"logcat": {"-c", "--clear", "-f", "--file", "-G", "--buffer-size", "-P", "--prune"},
+}
+
+// shellMetacharacters would let a single allowed command chain, substitute
+// or redirect into something that isn't, and quotes would let an argument
+// the filter checks differ from the one the device's shell passes on.
+const shellMetacharacters = "|&<>`$()\n\\'\""
+
+// readOnlyExports are the only environment exports a read-only command may
+// come with: the ones "adb logcat" prefixes it with, for no log tags. They
+// are matched verbatim, before quotes are refused.
+var readOnlyExports = map[string]bool{
+	`export ANDROID_LOG_TAGS="''"`: true,
+	`export ANDROID_LOG_TAGS=""`:   true,
+}
+
+// ReadOnly is a relay.InspectingServiceFilter that lets a guest observe a
+// device but not change it: logcat, screencap, dumpsys (of everything or of
+// a single service) and getprop run through shell:/exec: (so "adb logcat",
+// "adb exec-out screencap -p" work), sync: streams may stat, list and pull
+// but never push, and the legacy framebuffer: service is allowed.
+// Everything else, interactive shells, install, reboot, root and so on, is
+// denied.
+type ReadOnly struct{}
+
+// CheckOpen implements relay.ServiceFilter.
+func (ReadOnly) CheckOpen(service string) error {
+	switch {
+	case service == "sync:", service == "framebuffer:":
+		return nil
+	case strings.HasPrefix(service, "shell:"), strings.HasPrefix(service, "shell,"), strings.HasPrefix(service, "exec:"):
+		_, command, _ := strings.Cut(service, ":")
+		if strings.TrimSpace(command) == "" {
+			return fmt.Errorf("%w: interactive shells aren't allowed in read-only mode", ErrServiceDenied)
+		}
+		return checkReadOnlyCommand(command)
+	default:
+		return fmt.Errorf("%w: not allowed in read-only mode", ErrServiceDenied)
+	}
+}
+
+// NewStreamInspector implements relay.InspectingServiceFilter: sync:
+// streams are watched for push requests.
+func (ReadOnly) NewStreamInspector(service string) relay.StreamInspector {
+	if service != "sync:" {
+		return nil
+	}
+	return &readOnlySyncInspector{}
+}
+
+// checkReadOnlyCommand accepts command if every ";"-separated part of it is
+// either one of readOnlyExports (real adb prefixes "adb logcat" with one)
+// or one of readOnlyCommands, by its bare name or under /system/bin,
+// optionally run through exec. Since quotes are refused, "adb logcat" with
+// options, which adb quotes, is too; "adb shell logcat -d" isn't.
+func checkReadOnlyCommand(command string) error {
+	ranCommand := false
+	for _, part := range strings.Split(command, ";") {
+		if readOnlyExports[strings.TrimSpace(part)] {
+			continue
+		}
+		if strings.ContainsAny(part, shellMetacharacters) {
+			return fmt.Errorf("%w: shell metacharacters and quotes aren't allowed in read-only mode", ErrServiceDenied)
+		}
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "exec" {
+			fields = fields[1:]
+			if len(fields) == 0 {
+				return fmt.Errorf("%w: bare exec isn't allowed in read-only mode", ErrServiceDenied)
+			}
+		}
+		name := strings.TrimPrefix(fields[0], "/system/bin/")
+		if !readOnlyCommands[name] {
+			return fmt.Errorf("%w: %q isn't allowed in read-only mode", ErrServiceDenied, fields[0])
+		}
+		if err := checkReadOnlyArguments(name, fields[1:]); err != nil {
+			return err
+		}
+		ranCommand = true
+	}
+	if !ranCommand {
+		return fmt.Errorf("%w: interactive shells aren't allowed in read-only mode", ErrServiceDenied)
+	}
+	return nil
+}
+
+func checkReadOnlyArguments(name string, arguments []string) error {
+	// dumpsys hands whatever follows the service name on to the service,
+	// and services take commands that change the device ("dumpsys battery
+	// set level 5", "dumpsys deviceidle force-idle"), so it's only
+	// read-only with a service name at most, and no options.
+	if name == "dumpsys" && (len(arguments) > 1 || len(arguments) == 1 && strings.HasPrefix(arguments[0], "-")) {
+		return fmt.Errorf("%w: dumpsys only takes a service name in read-only mode", ErrServiceDenied)
+	}
+	for _, argument := range arguments {
+		for _, denied := range readOnlyDeniedOptions[name] {
+			if matchesOption(argument, denied) {
+				return fmt.Errorf("%w: %s %s isn't allowed in read-only mode", ErrServiceDenied, name, denied)
+			}
+		}
+		// screencap writes to a file on the device when given a path;
+		// only the stdout form ("screencap -p") is read-only.
+		if name == "screencap" && !strings.HasPrefix(argument, "-") {
+			return fmt.Errorf("%w: screencap to a device file isn't allowed in read-only mode", ErrServiceDenied)
+		}
+	}
+	return nil
+}
+
+// matchesOption reports whether argument could be option the way getopt
+// parses it: a short option anywhere in a group of them ("-dc") or with
+// its value attached ("-G16M"), a long one with its value after an "=", or
+// abbreviated ("--cl"). A short option's value that happens to contain the
+// letter ("-vcolor") matches too; erring that way is safe.
+func matchesOption(argument string, option string) bool {
+	if long, ok := strings.CutPrefix(argument, "--"); ok {
+		long, _, _ = strings.Cut(long, "=")
+		return long != "" && strings.HasPrefix(option, "--"+long)
+	}
+	if len(option) != 2 || !strings.HasPrefix(argument, "-") {
+		return false
+	}
+	return strings.ContainsRune(argument[1:], rune(option[1]))
+}
+
+// readOnlySyncInspector parses a guest's sync requests and rejects any that
+// would write to the device.
+type readOnlySyncInspector struct {
+	parser adb.SyncRequestParser
+}
+
+func (i *readOnlySyncInspector) InspectGuestData(data []byte) error {
+	requests, err := i.parser.Feed(data)
+	if err != nil {
+		return fmt.Errorf("%w: malformed sync request: %s", ErrServiceDenied, err)
+	}
+	for _, request := range requests {
+		switch request.Id {
+		case adb.SyncSend, adb.SyncSendV2, adb.SyncData, adb.SyncDone:
+			return fmt.Errorf("%w: pushing files isn't allowed in read-only mode", ErrServiceDenied)
+		}
+	}
+	return nil
+}
+
+// Chain combines filters into one that denies a service if any of them
+// does, and inspects every stream with each filter that wants to. Nil
+// filters are skipped.
+func Chain(filters ...relay.ServiceFilter) relay.InspectingServiceFilter {
+	chain := filterChain{}
+	for _, filter := range filters {
+		if filter != nil {
+			chain = append(chain, filter)
+		}
+	}
+	return chain
+}
+
+type filterChain []relay.ServiceFilter
+
+func (c filterChain) CheckOpen(service string) error {
+	for _, filter := range c {
+		if err := filter.CheckOpen(service); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c filterChain) NewStreamInspector(service string) relay.StreamInspector {
+	var inspectors inspectorChain
+	for _, filter := range c {
+		inspecting, ok := filter.(relay.InspectingServiceFilter)
+		if !ok {
+			continue
+		}
+		if inspector := inspecting.NewStreamInspector(service); inspector != nil {
+			inspectors = append(inspectors, inspector)
+		}
+	}
+	if len(inspectors) == 0 {
+		return nil
+	}
+	return inspectors
+}
+
+type inspectorChain []relay.StreamInspector
+
+func (c inspectorChain) InspectGuestData(data []byte) error {
+	var errs []error
+	for _, inspector := range c {
+		if err := inspector.InspectGuestData(data); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
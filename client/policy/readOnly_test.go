@@ -0,0 +1,135 @@
+package policy
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestReadOnlyAllowsObservingServices(t *testing.T) {
+	for _, service := range []string{
+		"sync:",
+		"framebuffer:",
+		`shell:export ANDROID_LOG_TAGS="''" ; exec logcat`,
+		"shell,v2,raw:logcat -d -v time",
+		"exec:screencap -p",
+		"shell:dumpsys battery",
+		"shell,v2,raw:dumpsys",
+		"exec:dumpsys activity",
+		"shell,v2,TERM=xterm:getprop ro.product.model",
+		"shell:/system/bin/getprop",
+	} {
+		if err := (ReadOnly{}).CheckOpen(service); err != nil {
+			t.Fatalf("expected %q to be allowed, got %s", service, err)
+		}
+	}
+}
+
+func TestReadOnlyDeniesChangingServices(t *testing.T) {
+	for _, service := range []string{
+		"shell:",
+		"shell,v2,pty:",
+		"shell:rm -rf /sdcard",
+		"shell:logcat -c",
+		"shell:logcat -G16M",
+		"shell:logcat --file=/sdcard/log",
+		"shell:screencap /sdcard/shot.png",
+		"shell:getprop; reboot",
+		"shell:getprop && reboot",
+		"shell:dumpsys $(reboot)",
+		"shell:dumpsys battery set level 5",
+		"shell:dumpsys battery unplug",
+		"shell:dumpsys battery reset",
+		"shell:dumpsys deviceidle force-idle",
+		"shell,v2,raw:dumpsys activity start-activity",
+		"exec:dumpsys -t 5 activity",
+		"shell:dumpsys --skip meminfo",
+		"shell:export A=1",
+		"exec:cmd package install -S 100",
+		"abb_exec:package\x00install",
+		"reboot:",
+		"root:",
+		"remount:",
+		"tcp:8080",
+	} {
+		if err := (ReadOnly{}).CheckOpen(service); !errors.Is(err, ErrServiceDenied) {
+			t.Fatalf("expected %q to be denied, got %v", service, err)
+		}
+	}
+}
+
+func TestReadOnlyDeniesFilterBypasses(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		service string
+	}{
+		{"quoted option", `shell:logcat '-c'`},
+		{"double-quoted option", `shell,v2,raw:logcat "-f" /sdcard/x`},
+		{"combined short options", "shell:logcat -dc"},
+		{"abbreviated long option", "shell:logcat --cl"},
+		{"binary named like an allowed one", "shell:/data/local/tmp/logcat"},
+		{"relative path", "shell:./logcat"},
+		{"PATH export", "shell:export PATH=/data/local/tmp; logcat"},
+		{"assignment prefix", "shell:PATH=/data/local/tmp logcat"},
+		{"other log tags export", `shell:export ANDROID_LOG_TAGS="*:S"; exec logcat`},
+	} {
+		if err := (ReadOnly{}).CheckOpen(c.service); !errors.Is(err, ErrServiceDenied) {
+			t.Fatalf("%s: expected %q to be denied, got %v", c.name, c.service, err)
+		}
+	}
+}
+
+func TestReadOnlySyncInspectorAllowsPulls(t *testing.T) {
+	inspector := ReadOnly{}.NewStreamInspector("sync:")
+	var session bytes.Buffer
+	_ = adb.WriteSyncRequest(&session, adb.SyncStat, []byte("/sdcard/a"))
+	_ = adb.WriteSyncRequest(&session, adb.SyncList, []byte("/sdcard"))
+	_ = adb.WriteSyncRequest(&session, adb.SyncRecv, []byte("/sdcard/a"))
+	_ = adb.WriteSyncRequest(&session, adb.SyncQuit, nil)
+	if err := inspector.InspectGuestData(session.Bytes()); err != nil {
+		t.Fatalf("expected pulls to be allowed, got %s", err)
+	}
+}
+
+func TestReadOnlySyncInspectorRejectsPushesSplitAcrossWrites(t *testing.T) {
+	inspector := ReadOnly{}.NewStreamInspector("sync:")
+	var session bytes.Buffer
+	_ = adb.WriteSyncRequest(&session, adb.SyncSendV2, []byte("/sdcard/a"))
+	data := session.Bytes()
+
+	if err := inspector.InspectGuestData(data[:5]); err != nil {
+		t.Fatalf("expected an incomplete request to pass, got %s", err)
+	}
+	if err := inspector.InspectGuestData(data[5:]); err != nil {
+		t.Fatalf("expected SND2 to wait for its setup message, got %s", err)
+	}
+	setup := make([]byte, 12)
+	copy(setup, adb.SyncSendV2)
+	if err := inspector.InspectGuestData(setup); !errors.Is(err, ErrServiceDenied) {
+		t.Fatalf("expected the push to be denied, got %v", err)
+	}
+}
+
+func TestReadOnlyOnlyInspectsSync(t *testing.T) {
+	if inspector := (ReadOnly{}).NewStreamInspector("shell:logcat"); inspector != nil {
+		t.Fatalf("expected no inspector for a shell stream")
+	}
+}
+
+func TestChainDeniesWhenAnyFilterDenies(t *testing.T) {
+	chain := Chain(ReadOnly{}, nil, &ServicePolicy{Deny: []string{"shell:dumpsys"}})
+
+	if err := chain.CheckOpen("shell:getprop"); err != nil {
+		t.Fatalf("expected getprop to be allowed, got %s", err)
+	}
+	if err := chain.CheckOpen("shell:dumpsys battery"); !errors.Is(err, ErrServiceDenied) {
+		t.Fatalf("expected dumpsys to be denied by the policy, got %v", err)
+	}
+	if err := chain.CheckOpen("reboot:"); !errors.Is(err, ErrServiceDenied) {
+		t.Fatalf("expected reboot: to be denied by read-only mode, got %v", err)
+	}
+	if chain.NewStreamInspector("sync:") == nil {
+		t.Fatalf("expected the read-only sync inspector to be kept by the chain")
+	}
+}
@@ -0,0 +1,134 @@
+// Package recording captures interactive shells run on a shared device as
+// asciicast v2 recordings (https://docs.asciinema.org/manual/asciicast/v2/),
+// one file per shell stream, and plays them back.
+//
+// A Recorder is a session observer: the owner controller feeds it every
+// stream guests open, and it decodes the shell_v2 packets of
+// "shell,v2,..." streams into timed input, output and resize events.
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Event types of asciicast v2.
+const (
+	EventOutput = "o"
+	EventInput  = "i"
+	EventResize = "r"
+	EventMarker = "m"
+)
+
+// Header is the first line of an asciicast v2 file.
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Event is one line after the header: Time seconds after the recording
+// started, an event type and its data. It is encoded as a JSON array,
+// [time, type, data].
+type Event struct {
+	Time float64
+	Type string
+	Data string
+}
+
+func (e Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{e.Time, e.Type, e.Data})
+}
+
+func (e *Event) UnmarshalJSON(data []byte) error {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if len(fields) != 3 {
+		return fmt.Errorf("expected [time, type, data], got %d fields", len(fields))
+	}
+	if err := json.Unmarshal(fields[0], &e.Time); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(fields[1], &e.Type); err != nil {
+		return err
+	}
+	return json.Unmarshal(fields[2], &e.Data)
+}
+
+// Writer writes an asciicast v2 file.
+type Writer struct {
+	encoder *json.Encoder
+}
+
+// NewWriter writes header to writer and returns a Writer for the events
+// that follow it.
+func NewWriter(writer io.Writer, header Header) (*Writer, error) {
+	header.Version = 2
+	encoder := json.NewEncoder(writer)
+	if err := encoder.Encode(header); err != nil {
+		return nil, err
+	}
+	return &Writer{encoder: encoder}, nil
+}
+
+func (w *Writer) WriteEvent(event Event) error {
+	return w.encoder.Encode(event)
+}
+
+// Reader reads an asciicast v2 file.
+type Reader struct {
+	scanner *bufio.Scanner
+	header  Header
+	line    int
+}
+
+// NewReader reads and validates the header from reader.
+func NewReader(reader io.Reader) (*Reader, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("empty recording")
+	}
+	r := &Reader{scanner: scanner, line: 1}
+	if err := json.Unmarshal(scanner.Bytes(), &r.header); err != nil {
+		return nil, fmt.Errorf("invalid recording header: %w", err)
+	}
+	if r.header.Version != 2 {
+		return nil, fmt.Errorf("unsupported asciicast version %d", r.header.Version)
+	}
+	return r, nil
+}
+
+func (r *Reader) Header() Header {
+	return r.header
+}
+
+// Next returns the next event, or io.EOF after the last one.
+func (r *Reader) Next() (Event, error) {
+	for r.scanner.Scan() {
+		r.line++
+		if len(r.scanner.Bytes()) == 0 {
+			continue
+		}
+		event := Event{}
+		if err := json.Unmarshal(r.scanner.Bytes(), &event); err != nil {
+			return event, fmt.Errorf("invalid event on line %d: %w", r.line, err)
+		}
+		return event, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return Event{}, err
+	}
+	return Event{}, io.EOF
+}
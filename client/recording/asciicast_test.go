@@ -0,0 +1,52 @@
+package recording
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestWriterReaderRoundTrip(t *testing.T) {
+	var buffer bytes.Buffer
+	writer, err := NewWriter(&buffer, Header{Width: 100, Height: 30, Title: "adb shell"})
+	if err != nil {
+		t.Fatalf("NewWriter failed: %s", err)
+	}
+	events := []Event{{Time: 0.5, Type: EventOutput, Data: "$ "}, {Time: 1.25, Type: EventInput, Data: "ls\r"}}
+	for _, event := range events {
+		if err := writer.WriteEvent(event); err != nil {
+			t.Fatalf("WriteEvent failed: %s", err)
+		}
+	}
+	if !strings.Contains(buffer.String(), `[0.5,"o","$ "]`) {
+		t.Fatalf("expected events encoded as arrays, got %s", buffer.String())
+	}
+
+	reader, err := NewReader(&buffer)
+	if err != nil {
+		t.Fatalf("NewReader failed: %s", err)
+	}
+	if header := reader.Header(); header.Version != 2 || header.Width != 100 || header.Height != 30 || header.Title != "adb shell" {
+		t.Fatalf("unexpected header: %+v", header)
+	}
+	for _, expected := range events {
+		event, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Next failed: %s", err)
+		}
+		if event != expected {
+			t.Fatalf("expected %+v, got %+v", expected, event)
+		}
+	}
+	if _, err := reader.Next(); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected io.EOF after the last event, got %v", err)
+	}
+}
+
+func TestNewReaderRejectsOtherVersions(t *testing.T) {
+	if _, err := NewReader(strings.NewReader(`{"version": 1, "width": 80, "height": 24}`)); err == nil {
+		t.Fatalf("expected an error for an asciicast v1 file")
+	}
+}
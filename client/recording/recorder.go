@@ -0,0 +1,309 @@
+package recording
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/relay"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Terminal size assumed for a recording whose shell never reported one
+// (e.g. a non-pty "adb shell <command>").
+const (
+	defaultWidth  = 80
+	defaultHeight = 24
+)
+
+// Recorder writes one asciicast file per shell_v2 stream into a directory.
+// It is safe for concurrent use.
+type Recorder struct {
+	dir    string
+	logger *slog.Logger
+	now    func() time.Time
+
+	mu            sync.Mutex
+	roomId        string
+	guestClientId string
+	streams       map[uint32]*shellRecording
+}
+
+// shellRecording is the state of one stream being recorded.
+type shellRecording struct {
+	file      *os.File
+	writer    *Writer // nil until the header is written
+	startedAt time.Time
+	header    Header
+
+	guestPackets  adb.ShellV2PacketParser
+	devicePackets adb.ShellV2PacketParser
+	// outputCarry holds the incomplete UTF-8 sequence a stdout/stderr
+	// packet ended with, to be completed by the next one: asciicast data
+	// must be valid UTF-8.
+	outputCarry []byte
+	failed      bool
+}
+
+// NewRecorder returns a Recorder writing into dir, which is created if
+// needed.
+func NewRecorder(dir string, logger *slog.Logger) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create the recording directory %s: %w", dir, err)
+	}
+	return &Recorder{
+		dir:     dir,
+		logger:  logger,
+		now:     time.Now,
+		streams: make(map[uint32]*shellRecording),
+	}, nil
+}
+
+// RoomCreated names subsequent recordings after roomId.
+func (r *Recorder) RoomCreated(roomId string, devices []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.roomId = roomId
+}
+
+func (r *Recorder) GuestJoined(clientId string, fingerprint string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.guestClientId = clientId
+}
+
+func (r *Recorder) GuestLeft() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.guestClientId = ""
+}
+
+// StreamOpened starts a recording if service is a shell_v2 shell.
+func (r *Recorder) StreamOpened(id uint32, device string, service string) {
+	options, command, ok := parseShellV2Service(service)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	startedAt := r.now()
+	name := fmt.Sprintf("%s-%s-%d.cast", r.roomId, startedAt.Format("20060102-150405"), id)
+	path := filepath.Join(r.dir, strings.TrimPrefix(name, "-"))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		r.logger.Error(fmt.Sprintf("Failed to create the shell recording %s: %s", path, err))
+		return
+	}
+	r.logger.Info(fmt.Sprintf("Recording shell stream %d to %s", id, path))
+
+	title := "adb shell"
+	if command != "" {
+		title += " " + command
+	}
+	if device != "" {
+		title += " on " + device
+	}
+	if r.guestClientId != "" {
+		title += " by " + r.guestClientId
+	}
+	header := Header{Width: defaultWidth, Height: defaultHeight, Timestamp: startedAt.Unix(), Title: title}
+	if term, ok := options["TERM"]; ok {
+		header.Env = map[string]string{"TERM": term}
+	}
+	r.streams[id] = &shellRecording{file: file, startedAt: startedAt, header: header}
+}
+
+func (r *Recorder) StreamRejected(device string, service string, reason error) {}
+
+// GuestData records stdin and window size changes.
+func (r *Recorder) GuestData(id uint32, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	recording := r.streams[id]
+	if recording == nil || recording.failed {
+		return
+	}
+	packets, err := recording.guestPackets.Feed(data)
+	for _, packet := range packets {
+		switch packet.Id {
+		case adb.ShellV2Stdin:
+			r.record(recording, EventInput, string(packet.Data))
+		case adb.ShellV2WindowSize:
+			if width, height, ok := parseWindowSize(packet.Data); ok {
+				r.resize(recording, width, height)
+			}
+		}
+	}
+	if err != nil {
+		r.fail(id, recording, err)
+	}
+}
+
+// DeviceData records stdout, stderr and the exit status.
+func (r *Recorder) DeviceData(id uint32, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	recording := r.streams[id]
+	if recording == nil || recording.failed {
+		return
+	}
+	packets, err := recording.devicePackets.Feed(data)
+	for _, packet := range packets {
+		switch packet.Id {
+		case adb.ShellV2Stdout, adb.ShellV2Stderr:
+			output := append(recording.outputCarry, packet.Data...)
+			complete := len(output) - incompleteUTF8Suffix(output)
+			recording.outputCarry = append([]byte(nil), output[complete:]...)
+			if complete > 0 {
+				r.record(recording, EventOutput, string(output[:complete]))
+			}
+		case adb.ShellV2Exit:
+			if len(packet.Data) == 1 {
+				r.record(recording, EventMarker, fmt.Sprintf("exit status %d", packet.Data[0]))
+			}
+		}
+	}
+	if err != nil {
+		r.fail(id, recording, err)
+	}
+}
+
+// StreamClosed finishes the stream's recording.
+func (r *Recorder) StreamClosed(id uint32, summary relay.StreamSummary) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	recording := r.streams[id]
+	if recording == nil {
+		return
+	}
+	delete(r.streams, id)
+	if !recording.failed {
+		// Make sure even a stream that never produced any event leaves a
+		// valid (header-only) recording behind.
+		r.ensureHeader(recording)
+	}
+	if err := recording.file.Close(); err != nil {
+		r.logger.Error(fmt.Sprintf("Failed to close the shell recording of stream %d: %s", id, err))
+	}
+}
+
+// Close finishes every recording still in progress.
+func (r *Recorder) Close() {
+	r.mu.Lock()
+	ids := make([]uint32, 0, len(r.streams))
+	for id := range r.streams {
+		ids = append(ids, id)
+	}
+	r.mu.Unlock()
+	for _, id := range ids {
+		r.StreamClosed(id, relay.StreamSummary{Reason: relay.CloseReasonEnded})
+	}
+}
+
+// resize applies a window size change: before the first event it becomes
+// the header's size (adb sends the initial size right after opening a pty
+// shell), afterwards it is recorded as a resize event.
+func (r *Recorder) resize(recording *shellRecording, width int, height int) {
+	if recording.writer == nil {
+		recording.header.Width, recording.header.Height = width, height
+		return
+	}
+	r.record(recording, EventResize, fmt.Sprintf("%dx%d", width, height))
+}
+
+// record appends an event timed relative to the stream's start. r.mu must
+// be held.
+func (r *Recorder) record(recording *shellRecording, eventType string, data string) {
+	if !r.ensureHeader(recording) {
+		return
+	}
+	elapsed := r.now().Sub(recording.startedAt).Seconds()
+	if err := recording.writer.WriteEvent(Event{Time: elapsed, Type: eventType, Data: data}); err != nil {
+		recording.failed = true
+		r.logger.Error(fmt.Sprintf("Failed to write to the shell recording %s: %s", recording.file.Name(), err))
+	}
+}
+
+func (r *Recorder) ensureHeader(recording *shellRecording) bool {
+	if recording.writer != nil {
+		return true
+	}
+	writer, err := NewWriter(recording.file, recording.header)
+	if err != nil {
+		recording.failed = true
+		r.logger.Error(fmt.Sprintf("Failed to write to the shell recording %s: %s", recording.file.Name(), err))
+		return false
+	}
+	recording.writer = writer
+	return true
+}
+
+// fail stops recording a stream whose packets can no longer be framed; the
+// events recorded so far are kept.
+func (r *Recorder) fail(id uint32, recording *shellRecording, err error) {
+	r.logger.Error(fmt.Sprintf("Stopped recording shell stream %d: %s", id, err))
+	r.ensureHeader(recording)
+	recording.failed = true
+}
+
+// parseShellV2Service splits a "shell,v2,<options>:<command>" service into
+// its key=value options (bare options such as "pty" map to "") and
+// command; ok is false for any other service.
+func parseShellV2Service(service string) (map[string]string, string, bool) {
+	name, command, found := strings.Cut(service, ":")
+	if !found {
+		return nil, "", false
+	}
+	parts := strings.Split(name, ",")
+	if len(parts) < 2 || parts[0] != "shell" || parts[1] != "v2" {
+		return nil, "", false
+	}
+	options := make(map[string]string)
+	for _, option := range parts[2:] {
+		key, value, _ := strings.Cut(option, "=")
+		options[key] = value
+	}
+	return options, command, true
+}
+
+// parseWindowSize decodes a shell_v2 window size packet,
+// "<rows>x<cols>,<xpixels>x<ypixels>", into columns and rows.
+func parseWindowSize(data []byte) (int, int, bool) {
+	characters, _, _ := strings.Cut(string(data), ",")
+	rowsText, colsText, found := strings.Cut(characters, "x")
+	if !found {
+		return 0, 0, false
+	}
+	rows, err := strconv.Atoi(rowsText)
+	if err != nil || rows <= 0 {
+		return 0, 0, false
+	}
+	cols, err := strconv.Atoi(colsText)
+	if err != nil || cols <= 0 {
+		return 0, 0, false
+	}
+	return cols, rows, true
+}
+
+// incompleteUTF8Suffix returns how many trailing bytes of data are the
+// start of a multi-byte UTF-8 sequence that hasn't been completed yet.
+// Invalid bytes aren't held back: they're recorded (as U+FFFD) right away.
+func incompleteUTF8Suffix(data []byte) int {
+	for n := 1; n < utf8.UTFMax && n <= len(data); n++ {
+		start := data[len(data)-n]
+		if !utf8.RuneStart(start) {
+			continue
+		}
+		if !utf8.FullRune(data[len(data)-n:]) {
+			return n
+		}
+		return 0
+	}
+	return 0
+}
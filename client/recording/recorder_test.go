@@ -0,0 +1,134 @@
+package recording
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/relay"
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestRecorder(t *testing.T) (*Recorder, string) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "recordings")
+	recorder, err := NewRecorder(dir, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("NewRecorder failed: %s", err)
+	}
+	current := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	recorder.now = func() time.Time {
+		current = current.Add(500 * time.Millisecond)
+		return current
+	}
+	return recorder, dir
+}
+
+func shellPackets(packets ...adb.ShellV2Packet) []byte {
+	var buffer bytes.Buffer
+	for _, packet := range packets {
+		_ = adb.WriteShellV2Packet(&buffer, packet.Id, packet.Data)
+	}
+	return buffer.Bytes()
+}
+
+func readRecording(t *testing.T, dir string) (Header, []Event) {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*.cast"))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("expected exactly one recording in %s, got %v (%v)", dir, paths, err)
+	}
+	file, err := os.Open(paths[0])
+	if err != nil {
+		t.Fatalf("failed to open the recording: %s", err)
+	}
+	defer file.Close()
+	reader, err := NewReader(file)
+	if err != nil {
+		t.Fatalf("NewReader failed: %s", err)
+	}
+	var events []Event
+	for {
+		event, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return reader.Header(), events
+		}
+		if err != nil {
+			t.Fatalf("Next failed: %s", err)
+		}
+		events = append(events, event)
+	}
+}
+
+func TestRecorderRecordsAnInteractiveShell(t *testing.T) {
+	recorder, dir := newTestRecorder(t)
+	recorder.RoomCreated("ROOM01", []string{"emulator-5554"})
+	recorder.GuestJoined("GUEST1", "SHA256:abc")
+
+	recorder.StreamOpened(3, "emulator-5554", "shell,v2,TERM=xterm-256color,pty:")
+	recorder.GuestData(3, shellPackets(adb.ShellV2Packet{Id: adb.ShellV2WindowSize, Data: []byte("40x120,0x0")}))
+	// "é" split across two stdout packets must be recorded whole.
+	recorder.DeviceData(3, shellPackets(adb.ShellV2Packet{Id: adb.ShellV2Stdout, Data: []byte("caf\xc3")}))
+	recorder.DeviceData(3, shellPackets(adb.ShellV2Packet{Id: adb.ShellV2Stdout, Data: []byte("\xa9 $ ")}))
+	input := shellPackets(adb.ShellV2Packet{Id: adb.ShellV2Stdin, Data: []byte("exit\r")})
+	recorder.GuestData(3, input[:3])
+	recorder.GuestData(3, input[3:])
+	recorder.GuestData(3, shellPackets(adb.ShellV2Packet{Id: adb.ShellV2WindowSize, Data: []byte("50x132,0x0")}))
+	recorder.DeviceData(3, shellPackets(adb.ShellV2Packet{Id: adb.ShellV2Exit, Data: []byte{0}}))
+	recorder.StreamClosed(3, relay.StreamSummary{Reason: relay.CloseReasonDevice})
+
+	header, events := readRecording(t, dir)
+	if header.Width != 120 || header.Height != 40 {
+		t.Fatalf("expected the initial window size 120x40 in the header, got %dx%d", header.Width, header.Height)
+	}
+	if header.Env["TERM"] != "xterm-256color" || header.Title != "adb shell on emulator-5554 by GUEST1" {
+		t.Fatalf("unexpected header: %+v", header)
+	}
+	expected := []Event{
+		{Type: EventOutput, Data: "caf"},
+		{Type: EventOutput, Data: "é $ "},
+		{Type: EventInput, Data: "exit\r"},
+		{Type: EventResize, Data: "132x50"},
+		{Type: EventMarker, Data: "exit status 0"},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %+v", len(expected), events)
+	}
+	previous := 0.0
+	for i := range expected {
+		if events[i].Type != expected[i].Type || events[i].Data != expected[i].Data {
+			t.Fatalf("event %d: expected %+v, got %+v", i, expected[i], events[i])
+		}
+		if events[i].Time <= previous {
+			t.Fatalf("event %d: expected increasing times, got %f after %f", i, events[i].Time, previous)
+		}
+		previous = events[i].Time
+	}
+}
+
+func TestRecorderIgnoresOtherServices(t *testing.T) {
+	recorder, dir := newTestRecorder(t)
+	for _, service := range []string{"sync:", "shell:ls", "tcp:8080"} {
+		recorder.StreamOpened(1, "emulator-5554", service)
+		recorder.DeviceData(1, []byte("data"))
+		recorder.StreamClosed(1, relay.StreamSummary{})
+	}
+	if paths, _ := filepath.Glob(filepath.Join(dir, "*")); len(paths) != 0 {
+		t.Fatalf("expected no recordings, got %v", paths)
+	}
+}
+
+func TestRecorderCloseFinishesOpenRecordings(t *testing.T) {
+	recorder, dir := newTestRecorder(t)
+	recorder.StreamOpened(1, "", "shell,v2,raw:getprop")
+	recorder.Close()
+
+	header, events := readRecording(t, dir)
+	if len(events) != 0 || header.Width != defaultWidth || header.Title != "adb shell getprop" {
+		t.Fatalf("expected a header-only recording with the default size, got %+v, %+v", header, events)
+	}
+}
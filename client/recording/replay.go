@@ -0,0 +1,76 @@
+package recording
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ReplayOptions tunes Replay's timing.
+type ReplayOptions struct {
+	// Speed multiplies playback speed; values <= 0 mean 1.
+	Speed float64
+	// MaxIdle caps any pause between two events (after Speed is applied),
+	// so a shell left idle for minutes doesn't replay as minutes of
+	// nothing; 0 keeps the original pauses.
+	MaxIdle time.Duration
+	// sleep waits for d or until ctx is done; tests replace it.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// Replay writes the output events of the recording in reader to writer,
+// reproducing their timing. Input, resize and marker events are skipped:
+// the output already contains the echo of whatever was typed.
+func Replay(ctx context.Context, reader io.Reader, writer io.Writer, options ReplayOptions) error {
+	cast, err := NewReader(reader)
+	if err != nil {
+		return err
+	}
+	speed := options.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+	sleep := options.sleep
+	if sleep == nil {
+		sleep = sleepContext
+	}
+
+	previous := 0.0
+	for {
+		event, err := cast.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if event.Type != EventOutput {
+			continue
+		}
+		delay := time.Duration((event.Time - previous) / speed * float64(time.Second))
+		previous = event.Time
+		if options.MaxIdle > 0 && delay > options.MaxIdle {
+			delay = options.MaxIdle
+		}
+		if delay > 0 {
+			if err := sleep(ctx, delay); err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(writer, event.Data); err != nil {
+			return err
+		}
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
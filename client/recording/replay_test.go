@@ -0,0 +1,48 @@
+package recording
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testCast = `{"version": 2, "width": 80, "height": 24}
+[1.0, "o", "$ "]
+[1.5, "i", "ls\r"]
+[2.0, "o", "ls\r\n"]
+[62.0, "o", "a.txt\r\n"]
+`
+
+func TestReplayWritesOutputWithTiming(t *testing.T) {
+	var delays []time.Duration
+	var output bytes.Buffer
+	options := ReplayOptions{Speed: 2, MaxIdle: 5 * time.Second, sleep: func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}}
+	if err := Replay(context.Background(), strings.NewReader(testCast), &output, options); err != nil {
+		t.Fatalf("Replay failed: %s", err)
+	}
+	if output.String() != "$ ls\r\na.txt\r\n" {
+		t.Fatalf("unexpected output %q", output.String())
+	}
+	expected := []time.Duration{500 * time.Millisecond, 500 * time.Millisecond, 5 * time.Second}
+	if len(delays) != len(expected) {
+		t.Fatalf("expected delays %v, got %v", expected, delays)
+	}
+	for i := range expected {
+		if delays[i] != expected[i] {
+			t.Fatalf("expected delays %v, got %v", expected, delays)
+		}
+	}
+}
+
+func TestReplayStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Replay(ctx, strings.NewReader(testCast), &bytes.Buffer{}, ReplayOptions{}); err == nil {
+		t.Fatalf("expected Replay to stop on a cancelled context")
+	}
+}
@@ -0,0 +1,281 @@
+package relay
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/transportLayer"
+	"adb-remote.maci.team/shared/protocol"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// GuestMultiplexer implements the guest side of one shared device: it
+// relays any number of local ADB connections (e.g. the local adb server,
+// plus a second adb server or an IDE speaking the wire protocol directly)
+// over the single room link at once.
+//
+// Every local connection numbers its streams on its own, so two of them
+// commonly both open a stream 1. The multiplexer gives each stream a room
+// id, unique across all of them, which is what the owner sees as the
+// guest's id for it, and translates back when the owner answers. Ids
+// follow the ADB wire convention: a message's arg1 is the sender's own id
+// for the stream, arg2 the receiver's.
+type GuestMultiplexer struct {
+	client TransportClient
+	device int
+	logger *slog.Logger
+
+	mutex  sync.Mutex
+	nextId uint32
+	// streams are keyed by room id.
+	streams     map[uint32]*guestStream
+	connections map[*guestConnection]struct{}
+}
+
+// guestConnection is one local ADB connection being served.
+type guestConnection struct {
+	conn net.Conn
+	// streams are keyed by the connection's own id for them, and guarded
+	// by the multiplexer's mutex, as is closed.
+	streams map[uint32]*guestStream
+	closed  bool
+}
+
+// guestStream is one stream a local connection opened.
+type guestStream struct {
+	connection *guestConnection
+	localId    uint32
+	roomId     uint32
+	// ownerId is the owner's id for the stream, 0 until it accepted the
+	// OPEN.
+	ownerId uint32
+}
+
+func NewGuestMultiplexer(client TransportClient, device int, logger *slog.Logger) *GuestMultiplexer {
+	return &GuestMultiplexer{
+		client:      client,
+		device:      device,
+		logger:      logger,
+		streams:     make(map[uint32]*guestStream),
+		connections: make(map[*guestConnection]struct{}),
+	}
+}
+
+// Serve relays the ADB messages conn sends to the owner, with their stream
+// ids remapped, until conn closes or errors or ctx is cancelled, then
+// closes conn, tells the owner to close whatever streams it left open, and
+// returns the reason it stopped. It may be called concurrently, once per
+// local connection; the owner's answers only reach conn while Run runs.
+func (m *GuestMultiplexer) Serve(ctx context.Context, conn net.Conn) error {
+	connection := &guestConnection{conn: conn, streams: make(map[uint32]*guestStream)}
+	m.mutex.Lock()
+	m.connections[connection] = struct{}{}
+	m.mutex.Unlock()
+
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	err := m.pumpLocal(ctx, connection)
+	_ = conn.Close()
+	if err := m.release(connection); err != nil {
+		m.logger.Error(fmt.Sprintf("Failed to close streams on the owner's side: %s", err))
+	}
+	return err
+}
+
+// pumpLocal forwards connection's messages to the owner.
+func (m *GuestMultiplexer) pumpLocal(ctx context.Context, connection *guestConnection) error {
+	message := adb.CreateMessage()
+	for {
+		if err := message.Read(connection.conn); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		roomId, ok := m.mapLocal(connection, message)
+		if !ok {
+			continue
+		}
+		if err := message.Set(message.Command(), roomId, message.Arg2(), message.Data()); err != nil {
+			return err
+		}
+		if err := m.client.SendAdbMessage(m.device, message); err != nil {
+			return err
+		}
+	}
+}
+
+// mapLocal returns the room id for the stream a local message is about,
+// registering a new stream for an OPEN, or false if the message must not
+// be forwarded.
+func (m *GuestMultiplexer) mapLocal(connection *guestConnection, message *adb.AdbMessage) (uint32, bool) {
+	command, localId := message.Command(), message.Arg1()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	switch command {
+	case adb.CommandOpen:
+		m.nextId++
+		stream := &guestStream{connection: connection, localId: localId, roomId: m.nextId}
+		connection.streams[localId] = stream
+		m.streams[stream.roomId] = stream
+		return stream.roomId, true
+	case adb.CommandWrite, adb.CommandOkay, adb.CommandClose:
+		stream := connection.streams[localId]
+		if stream == nil {
+			m.logger.Info(fmt.Sprintf("Dropping a local %s for an unknown stream: %d", message.CommandString(), localId))
+			return 0, false
+		}
+		if command == adb.CommandClose {
+			m.forgetLocked(stream)
+		}
+		return stream.roomId, true
+	default:
+		m.logger.Info(fmt.Sprintf("Ignoring unexpected local ADB command during relay: %x", command))
+		return 0, false
+	}
+}
+
+// release forgets a closed local connection, closing its streams on the
+// owner's side. A stream still waiting for the owner to accept its OPEN
+// is kept, without a connection to deliver to, until the owner answers
+// (see deliver). It tries to close every stream, returning why any of them
+// couldn't be.
+func (m *GuestMultiplexer) release(connection *guestConnection) error {
+	m.mutex.Lock()
+	connection.closed = true
+	delete(m.connections, connection)
+	var orphaned []*guestStream
+	for _, stream := range connection.streams {
+		if stream.ownerId != 0 {
+			m.forgetLocked(stream)
+			orphaned = append(orphaned, stream)
+		}
+	}
+	m.mutex.Unlock()
+	var errs []error
+	for _, stream := range orphaned {
+		if err := m.sendClose(stream.roomId, stream.ownerId); err != nil {
+			errs = append(errs, fmt.Errorf("stream %d: %w", stream.roomId, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *GuestMultiplexer) forgetLocked(stream *guestStream) {
+	delete(m.streams, stream.roomId)
+	if stream.connection.streams[stream.localId] == stream {
+		delete(stream.connection.streams, stream.localId)
+	}
+}
+
+func (m *GuestMultiplexer) sendClose(roomId uint32, ownerId uint32) error {
+	container := adbMessagePool.Obtain()
+	defer container.Dispose()
+	message, err := container.Data()
+	if err != nil {
+		return err
+	}
+	if err := message.Set(adb.CommandClose, roomId, ownerId, nil); err != nil {
+		return err
+	}
+	return m.client.SendAdbMessage(m.device, message)
+}
+
+// Run reads the owner's messages for the device until ctx is cancelled or
+// the transport is lost, handing each to the local connection whose
+// stream it is about, then closes every local connection and returns the
+// reason it stopped.
+func (m *GuestMultiplexer) Run(ctx context.Context) error {
+	defer m.CloseConnections()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case container, ok := <-m.client.Messages():
+			if !ok {
+				return ErrTransportClosed
+			}
+			m.dispatch(container)
+		}
+	}
+}
+
+// CloseConnections closes every local connection being served, e.g. so
+// their adb servers reconnect and find the device offline. Serve returns
+// for each.
+func (m *GuestMultiplexer) CloseConnections() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for connection := range m.connections {
+		_ = connection.conn.Close()
+	}
+}
+
+// dispatch delivers one of the owner's messages, always disposing of
+// container before returning.
+func (m *GuestMultiplexer) dispatch(container *transportLayer.MessageContainer) {
+	defer func() { _ = container.Dispose() }()
+	message, err := container.Data()
+	if err != nil {
+		m.logger.Error(fmt.Sprintf("Unusable pooled message container: %s", err))
+		return
+	}
+	if message.Command() != protocol.CommandAdbTransport {
+		m.logger.Info(fmt.Sprintf("Ignoring unexpected message during relay, command: %x", message.Command()))
+		return
+	}
+	payload, err := message.GetPayloadAdbTransport()
+	if err != nil {
+		m.logger.Error(fmt.Sprintf("Invalid ADB transport payload received from the peer: %s", err))
+		return
+	}
+	adbMessage, err := adb.DecodeMessage(payload.Message)
+	if err != nil {
+		m.logger.Error(fmt.Sprintf("Invalid ADB message received from the peer: %s", err))
+		return
+	}
+	m.deliver(adbMessage)
+}
+
+// deliver writes one of the owner's messages to the local connection whose
+// stream it is about, with arg2 translated back to that connection's id.
+func (m *GuestMultiplexer) deliver(message *adb.AdbMessage) {
+	command := message.Command()
+	m.mutex.Lock()
+	stream := m.streams[message.Arg2()]
+	if stream == nil {
+		m.mutex.Unlock()
+		return
+	}
+	if command == adb.CommandOkay && stream.ownerId == 0 {
+		stream.ownerId = message.Arg1()
+	}
+	connection := stream.connection
+	if connection.closed || command == adb.CommandClose {
+		m.forgetLocked(stream)
+	}
+	closed := connection.closed
+	m.mutex.Unlock()
+
+	if closed {
+		// The OPEN was accepted after whoever asked for it left.
+		if command == adb.CommandOkay {
+			if err := m.sendClose(stream.roomId, stream.ownerId); err != nil {
+				m.logger.Error(fmt.Sprintf("Failed to close stream %d on the owner's side: %s", stream.roomId, err))
+			}
+		}
+		return
+	}
+	if err := message.Set(command, message.Arg1(), stream.localId, message.Data()); err != nil {
+		m.logger.Error(fmt.Sprintf("Failed to translate a message for stream %d: %s", stream.roomId, err))
+		return
+	}
+	if err := message.Write(connection.conn); err != nil {
+		m.logger.Error(fmt.Sprintf("Failed to write to a local ADB connection: %s", err))
+		// Serve notices and cleans up.
+		_ = connection.conn.Close()
+	}
+}
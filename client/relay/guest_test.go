@@ -0,0 +1,205 @@
+package relay
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// startGuestMultiplexer runs a GuestMultiplexer over a fake transport until
+// the test ends.
+func startGuestMultiplexer(t *testing.T) (*GuestMultiplexer, *fakeTransportClient, context.Context) {
+	t.Helper()
+	client := newFakeTransportClient()
+	multiplexer := NewGuestMultiplexer(client, 0, newTestLogger())
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = multiplexer.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return multiplexer, client, ctx
+}
+
+// serveLocal has multiplexer serve a new local connection, returning the
+// local ADB server's end of it.
+func serveLocal(t *testing.T, ctx context.Context, multiplexer *GuestMultiplexer) (net.Conn, <-chan error) {
+	t.Helper()
+	proxySide, localSide := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- multiplexer.Serve(ctx, proxySide) }()
+	t.Cleanup(func() { _ = localSide.Close() })
+	return localSide, done
+}
+
+func writeLocal(t *testing.T, conn net.Conn, command uint32, arg1 uint32, arg2 uint32, data string) {
+	t.Helper()
+	message := adb.CreateMessage()
+	if err := message.Set(command, arg1, arg2, []byte(data)); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	if err := message.Write(conn); err != nil {
+		t.Fatalf("failed to write from the local side: %s", err)
+	}
+}
+
+func readLocal(t *testing.T, conn net.Conn) *adb.AdbMessage {
+	t.Helper()
+	message := adb.CreateMessage()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := message.Read(conn); err != nil {
+		t.Fatalf("failed to read on the local side: %s", err)
+	}
+	return message
+}
+
+func expectSent(t *testing.T, client *fakeTransportClient) *adb.AdbMessage {
+	t.Helper()
+	select {
+	case bytes := <-client.sent:
+		message, err := adb.DecodeMessage(bytes)
+		if err != nil {
+			t.Fatalf("DecodeMessage failed: %s", err)
+		}
+		return message
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for a message to the owner")
+		return nil
+	}
+}
+
+func deliverFromOwner(t *testing.T, client *fakeTransportClient, command uint32, arg1 uint32, arg2 uint32, data string) {
+	t.Helper()
+	message := adb.CreateMessage()
+	if err := message.Set(command, arg1, arg2, []byte(data)); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	client.deliverAdbTransport(t, message)
+}
+
+func TestGuestMultiplexerKeepsLocalStreamIdsApart(t *testing.T) {
+	multiplexer, client, ctx := startGuestMultiplexer(t)
+	first, _ := serveLocal(t, ctx, multiplexer)
+	second, _ := serveLocal(t, ctx, multiplexer)
+
+	// Both local connections number their first stream 1.
+	writeLocal(t, first, adb.CommandOpen, 1, 0, "shell:first")
+	firstOpen := expectSent(t, client)
+	firstId := firstOpen.Arg1()
+	writeLocal(t, second, adb.CommandOpen, 1, 0, "shell:second")
+	secondOpen := expectSent(t, client)
+	secondId := secondOpen.Arg1()
+	if firstOpen.DataString() != "shell:first" || secondOpen.DataString() != "shell:second" {
+		t.Fatalf("unexpected forwarded OPENs: %q, %q", firstOpen.DataString(), secondOpen.DataString())
+	}
+	if firstId == secondId {
+		t.Fatalf("expected the two streams to reach the owner with distinct ids, both got %d", firstId)
+	}
+
+	// The owner's answers reach the connection that opened each stream,
+	// under that connection's own id.
+	deliverFromOwner(t, client, adb.CommandOkay, 20, secondId, "")
+	if message := readLocal(t, second); message.Command() != adb.CommandOkay || message.Arg1() != 20 || message.Arg2() != 1 {
+		t.Fatalf("expected OKAY(20, 1) on the second connection, got %s(%d, %d)", message.CommandString(), message.Arg1(), message.Arg2())
+	}
+	deliverFromOwner(t, client, adb.CommandOkay, 10, firstId, "")
+	deliverFromOwner(t, client, adb.CommandWrite, 10, firstId, "hello")
+	if message := readLocal(t, first); message.Command() != adb.CommandOkay || message.Arg1() != 10 || message.Arg2() != 1 {
+		t.Fatalf("expected OKAY(10, 1) on the first connection, got %s(%d, %d)", message.CommandString(), message.Arg1(), message.Arg2())
+	}
+	if message := readLocal(t, first); message.Command() != adb.CommandWrite || message.DataString() != "hello" || message.Arg2() != 1 {
+		t.Fatalf("expected the first stream's WRTE, got %s %q", message.CommandString(), message.DataString())
+	}
+
+	// Replies from the local side are forwarded under the room id.
+	writeLocal(t, first, adb.CommandOkay, 1, 10, "")
+	if message := expectSent(t, client); message.Command() != adb.CommandOkay || message.Arg1() != firstId || message.Arg2() != 10 {
+		t.Fatalf("expected OKAY(%d, 10) to the owner, got %s(%d, %d)", firstId, message.CommandString(), message.Arg1(), message.Arg2())
+	}
+	writeLocal(t, second, adb.CommandClose, 1, 20, "")
+	if message := expectSent(t, client); message.Command() != adb.CommandClose || message.Arg1() != secondId || message.Arg2() != 20 {
+		t.Fatalf("expected CLSE(%d, 20) to the owner, got %s(%d, %d)", secondId, message.CommandString(), message.Arg1(), message.Arg2())
+	}
+}
+
+func TestGuestMultiplexerClosesStreamsOfDepartedConnection(t *testing.T) {
+	multiplexer, client, ctx := startGuestMultiplexer(t)
+	local, done := serveLocal(t, ctx, multiplexer)
+
+	writeLocal(t, local, adb.CommandOpen, 1, 0, "shell:")
+	accepted := expectSent(t, client).Arg1()
+	deliverFromOwner(t, client, adb.CommandOkay, 10, accepted, "")
+	readLocal(t, local)
+	writeLocal(t, local, adb.CommandOpen, 2, 0, "sync:")
+	pending := expectSent(t, client).Arg1()
+
+	_ = local.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Serve did not return after the local connection closed")
+	}
+	if message := expectSent(t, client); message.Command() != adb.CommandClose || message.Arg1() != accepted || message.Arg2() != 10 {
+		t.Fatalf("expected the open stream to be closed on the owner's side, got %s(%d, %d)", message.CommandString(), message.Arg1(), message.Arg2())
+	}
+	// The OPEN still in flight is closed as soon as the owner accepts it.
+	deliverFromOwner(t, client, adb.CommandOkay, 11, pending, "")
+	if message := expectSent(t, client); message.Command() != adb.CommandClose || message.Arg1() != pending || message.Arg2() != 11 {
+		t.Fatalf("expected the late-accepted stream to be closed, got %s(%d, %d)", message.CommandString(), message.Arg1(), message.Arg2())
+	}
+}
+
+// TestGuestMultiplexerTriesToCloseEveryStreamOfDepartedConnection checks
+// that failing to close one of a departed connection's streams on the
+// owner's side doesn't keep the others open.
+func TestGuestMultiplexerTriesToCloseEveryStreamOfDepartedConnection(t *testing.T) {
+	multiplexer, client, ctx := startGuestMultiplexer(t)
+	local, done := serveLocal(t, ctx, multiplexer)
+
+	for localId, ownerId := range map[uint32]uint32{1: 10, 2: 11} {
+		writeLocal(t, local, adb.CommandOpen, localId, 0, "shell:")
+		deliverFromOwner(t, client, adb.CommandOkay, ownerId, expectSent(t, client).Arg1(), "")
+		readLocal(t, local)
+	}
+
+	client.mu.Lock()
+	client.sendErr = errors.New("transport down")
+	client.mu.Unlock()
+	_ = local.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Serve did not return after the local connection closed")
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.failedSends != 2 {
+		t.Fatalf("expected a CLSE to be attempted for both streams, got %d", client.failedSends)
+	}
+}
+
+func TestGuestMultiplexerRunClosesConnectionsWhenTransportCloses(t *testing.T) {
+	client := newFakeTransportClient()
+	multiplexer := NewGuestMultiplexer(client, 0, newTestLogger())
+	local, served := serveLocal(t, context.Background(), multiplexer)
+	// Serve must have registered the connection before the transport goes.
+	writeLocal(t, local, adb.CommandOpen, 1, 0, "shell:")
+	expectSent(t, client)
+
+	close(client.messages)
+	if err := multiplexer.Run(context.Background()); !errors.Is(err, ErrTransportClosed) {
+		t.Fatalf("expected ErrTransportClosed, got %v", err)
+	}
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Serve did not return after the transport closed")
+	}
+}
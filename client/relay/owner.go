@@ -36,8 +36,13 @@ var adbMessagePool = utils.NewObjectPool(adb.CreateMessage)
 type ownerStream struct {
 	guestId uint32 // the id the guest assigned this stream (arg1 in its OPEN)
 	ownId   uint32 // the id we assigned this stream
+	device  int    // the index of the shared device the stream is open on
+	service string
 
 	conn net.Conn
+	// inspector, if non-nil, vets every WRTE payload the guest sends on
+	// this stream before it reaches the device.
+	inspector StreamInspector
 	// sendPermit is a buffered(1) token: present means we may send the
 	// next WRTE to the guest. ADB requires a sender to wait for an OKAY
 	// after each WRTE before sending another for the same stream; a
@@ -46,13 +51,87 @@ type ownerStream struct {
 	sendPermit chan struct{}
 	done       chan struct{}
 	closeOnce  sync.Once
+
+	bytesFromGuest atomic.Uint64
+	bytesToGuest   atomic.Uint64
+}
+
+// ServiceFilter decides which services a guest may open on the shared
+// device (see client/policy). CheckOpen returns a non-nil error, the reason
+// for the denial, if service must be rejected.
+type ServiceFilter interface {
+	CheckOpen(service string) error
+}
+
+// ServiceDeniedFunc is told about every OPEN a ServiceFilter rejected, and
+// every stream a StreamInspector cut short.
+type ServiceDeniedFunc func(service string, reason error)
+
+// StreamInspector examines, in order, the bytes a guest writes on one
+// stream. A non-nil error stops that data from reaching the device and
+// closes the stream. It is what lets a filter see inside protocols that
+// multiplex several operations over a single service, e.g. a sync: stream
+// carrying both pulls and pushes.
+type StreamInspector interface {
+	InspectGuestData(data []byte) error
+}
+
+// InspectingServiceFilter is a ServiceFilter that also wants to inspect
+// what guests send on the streams it allowed. NewStreamInspector is called
+// once per allowed OPEN and may return nil for services it doesn't need to
+// look into.
+type InspectingServiceFilter interface {
+	ServiceFilter
+	NewStreamInspector(service string) StreamInspector
+}
+
+// Reasons a stream closed, as reported in StreamSummary.Reason.
+const (
+	CloseReasonGuest      = "closed by guest"
+	CloseReasonDevice     = "closed by device"
+	CloseReasonRelayError = "relay error"
+	CloseReasonEnded      = "session ended"
+	// CloseReasonDenied prefixes the inspector's error when a
+	// StreamInspector cut the stream short.
+	CloseReasonDenied = "denied"
+)
+
+// StreamSummary describes a stream once it has closed.
+type StreamSummary struct {
+	Device         string
+	Service        string
+	BytesFromGuest uint64
+	BytesToGuest   uint64
+	Reason         string
+}
+
+// StreamObserver is told about the lifecycle of every stream a guest opens
+// (see client/audit). id is the owner-side stream id, unique for the
+// multiplexer's lifetime, and device the serial of the device the stream
+// was opened on. Methods are called from both the dispatch goroutine and
+// per-stream relay goroutines, so implementations must be safe for
+// concurrent use, and should not block. The data passed to GuestData and
+// DeviceData is only valid for the duration of the call.
+type StreamObserver interface {
+	StreamOpened(id uint32, device string, service string)
+	// StreamRejected reports an OPEN that never became a stream: denied by
+	// the ServiceFilter or refused by the local adb-server.
+	StreamRejected(device string, service string, reason error)
+	// GuestData reports data the guest wrote on a stream, after it passed
+	// any StreamInspector and before it reaches the device.
+	GuestData(id uint32, data []byte)
+	// DeviceData reports data the device sent on a stream, once it has
+	// been relayed to the guest.
+	DeviceData(id uint32, data []byte)
+	StreamClosed(id uint32, summary StreamSummary)
 }
 
 // OwnerMultiplexer implements the owner side of a shared-device room: for
 // every OPEN the guest sends, it opens a fresh connection to the local
-// adb-server for the requested service and relays that one stream's bytes,
-// since real adb-server does not expose a raw device transport pass-through
-// (see relay.go's package doc and the README for why).
+// adb-server for the requested service, on whichever of the room's devices
+// the OPEN is for, and relays that one stream's bytes, since real
+// adb-server does not expose a raw device transport pass-through (see
+// relay.go's package doc and the README for why).
 //
 // A single OwnerMultiplexer is meant to live for the whole room, across
 // however many guest sessions come and go: Dispatch only consumes
@@ -61,9 +140,19 @@ type ownerStream struct {
 // on the same Client — see client/controller/ownerController.go.
 type OwnerMultiplexer struct {
 	smartSocket adb.IAdbSmartSocket
-	deviceId    string
-	client      TransportClient
-	logger      *slog.Logger
+	// devices are the serials of the room's devices, indexed the way
+	// CommandAdbTransport messages refer to them.
+	devices []string
+	client  TransportClient
+	logger  *slog.Logger
+
+	// filter and onDenied are set once by SetServiceFilter, before
+	// Dispatch is first called.
+	filter   ServiceFilter
+	onDenied ServiceDeniedFunc
+	// observer is set once by SetStreamObserver, before Dispatch is first
+	// called.
+	observer StreamObserver
 
 	nextId uint32 // atomic; monotonically increasing, never reused
 
@@ -71,10 +160,10 @@ type OwnerMultiplexer struct {
 	streams map[uint32]*ownerStream
 }
 
-func NewOwnerMultiplexer(smartSocket adb.IAdbSmartSocket, deviceId string, client TransportClient, logger *slog.Logger) *OwnerMultiplexer {
+func NewOwnerMultiplexer(smartSocket adb.IAdbSmartSocket, devices []string, client TransportClient, logger *slog.Logger) *OwnerMultiplexer {
 	return &OwnerMultiplexer{
 		smartSocket: smartSocket,
-		deviceId:    deviceId,
+		devices:     devices,
 		client:      client,
 		logger:      logger,
 		streams:     make(map[uint32]*ownerStream),
@@ -87,8 +176,8 @@ func NewOwnerMultiplexer(smartSocket adb.IAdbSmartSocket, deviceId string, clien
 // message and logging/ignoring anything else. It blocks until ctx is
 // cancelled or the transporter connection is lost, and closes every
 // still-open stream before returning.
-func RunOwner(ctx context.Context, smartSocket adb.IAdbSmartSocket, deviceId string, client TransportClient, logger *slog.Logger) error {
-	m := NewOwnerMultiplexer(smartSocket, deviceId, client, logger)
+func RunOwner(ctx context.Context, smartSocket adb.IAdbSmartSocket, devices []string, client TransportClient, logger *slog.Logger) error {
+	m := NewOwnerMultiplexer(smartSocket, devices, client, logger)
 	defer m.Close()
 
 	for {
@@ -126,89 +215,162 @@ func (m *OwnerMultiplexer) Dispatch(container *transportLayer.MessageContainer)
 		m.logger.Error(fmt.Sprintf("Unusable pooled message container: %s", err))
 		return
 	}
-	adbMessage, err := adb.DecodeMessage(message.Payload())
+	payload, err := message.GetPayloadAdbTransport()
+	if err != nil {
+		m.logger.Error(fmt.Sprintf("Invalid ADB transport payload received from the guest: %s", err))
+		return
+	}
+	adbMessage, err := adb.DecodeMessage(payload.Message)
 	if err != nil {
 		m.logger.Error(fmt.Sprintf("Invalid ADB message received from the guest: %s", err))
 		return
 	}
 
+	device := payload.Device
 	switch adbMessage.Command() {
 	case adb.CommandOpen:
-		m.handleOpen(adbMessage.Arg1(), adbMessage.DataString())
+		m.handleOpen(device, adbMessage.Arg1(), adbMessage.DataString())
 	case adb.CommandWrite:
-		m.handleWrite(adbMessage.Arg1(), adbMessage.Arg2(), adbMessage.Data())
+		m.handleWrite(device, adbMessage.Arg1(), adbMessage.Arg2(), adbMessage.Data())
 	case adb.CommandOkay:
-		m.handleOkay(adbMessage.Arg2())
+		m.handleOkay(device, adbMessage.Arg2())
 	case adb.CommandClose:
-		m.handleClose(adbMessage.Arg2())
+		m.handleClose(device, adbMessage.Arg2())
 	default:
 		m.logger.Info(fmt.Sprintf("Ignoring unexpected ADB command during relay: %x", adbMessage.Command()))
 	}
 }
 
+// SetServiceFilter makes every subsequent OPEN subject to filter: a
+// rejected service is answered with a CLSE without ever reaching the local
+// adb-server, and reported to onDenied (if non-nil). If filter is also an
+// InspectingServiceFilter, the streams it allows are inspected as well, and
+// a stream whose data it rejects is closed and reported the same way. It
+// must be called before the first Dispatch.
+func (m *OwnerMultiplexer) SetServiceFilter(filter ServiceFilter, onDenied ServiceDeniedFunc) {
+	m.filter = filter
+	m.onDenied = onDenied
+}
+
+// SetStreamObserver reports every subsequent stream's lifecycle to
+// observer. It must be called before the first Dispatch.
+func (m *OwnerMultiplexer) SetStreamObserver(observer StreamObserver) {
+	m.observer = observer
+}
+
 // Close closes every currently open stream.
 func (m *OwnerMultiplexer) Close() {
 	m.closeAllStreams()
 }
 
-// handleOpen services a new stream request: guestId is the id the guest
-// picked for it, and rawService is the OPEN payload, a NUL-terminated
-// smartsocket service string (e.g. "shell,v2,raw:echo hi\x00").
-func (m *OwnerMultiplexer) handleOpen(guestId uint32, rawService string) {
+// handleOpen services a new stream request: device is the index of the
+// device it is for, guestId is the id the guest picked for it, and
+// rawService is the OPEN payload, a NUL-terminated smartsocket service
+// string (e.g. "shell,v2,raw:echo hi\x00").
+func (m *OwnerMultiplexer) handleOpen(device int, guestId uint32, rawService string) {
 	service := strings.TrimRight(rawService, "\x00")
 	logger := m.logger
-	logger.Info(fmt.Sprintf("Guest opened a stream (id=%d): %s", guestId, service))
+	if device < 0 || device >= len(m.devices) {
+		logger.Info(fmt.Sprintf("Rejected a stream (id=%d) for unknown device #%d: %s", guestId, device, service))
+		if err := m.sendClose(device, 0, guestId); err != nil {
+			logger.Error(fmt.Sprintf("Failed to notify the guest of the rejection: %s", err))
+		}
+		return
+	}
+	deviceId := m.devices[device]
+	logger.Info(fmt.Sprintf("Guest opened a stream (id=%d) on %s: %s", guestId, deviceId, service))
+
+	if m.filter != nil {
+		if err := m.filter.CheckOpen(service); err != nil {
+			logger.Info(fmt.Sprintf("Rejected service %q: %s", service, err))
+			if sendErr := m.sendClose(device, 0, guestId); sendErr != nil {
+				logger.Error(fmt.Sprintf("Failed to notify the guest of the rejection: %s", sendErr))
+			}
+			if m.onDenied != nil {
+				m.onDenied(service, err)
+			}
+			if m.observer != nil {
+				m.observer.StreamRejected(deviceId, service, err)
+			}
+			return
+		}
+	}
 
-	conn, err := m.smartSocket.OpenStream(m.deviceId, service)
+	conn, err := m.smartSocket.OpenStream(deviceId, service)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to open service %q on the local device: %s", service, err))
-		if sendErr := m.sendClose(0, guestId); sendErr != nil {
+		logger.Error(fmt.Sprintf("Failed to open service %q on %s: %s", service, deviceId, err))
+		if sendErr := m.sendClose(device, 0, guestId); sendErr != nil {
 			logger.Error(fmt.Sprintf("Failed to notify the guest of the open failure: %s", sendErr))
 		}
+		if m.observer != nil {
+			m.observer.StreamRejected(deviceId, service, err)
+		}
 		return
 	}
 
 	stream := &ownerStream{
 		guestId:    guestId,
 		ownId:      atomic.AddUint32(&m.nextId, 1),
+		device:     device,
+		service:    service,
 		conn:       conn,
 		sendPermit: make(chan struct{}, 1),
 		done:       make(chan struct{}),
 	}
 	stream.sendPermit <- struct{}{}
+	if inspecting, ok := m.filter.(InspectingServiceFilter); ok {
+		stream.inspector = inspecting.NewStreamInspector(service)
+	}
 
 	m.mu.Lock()
 	m.streams[stream.ownId] = stream
 	m.mu.Unlock()
+	if m.observer != nil {
+		m.observer.StreamOpened(stream.ownId, deviceId, service)
+	}
 
-	if err := m.sendOkay(stream.ownId, guestId); err != nil {
+	if err := m.sendOkay(device, stream.ownId, guestId); err != nil {
 		logger.Error(fmt.Sprintf("Failed to acknowledge opening stream %d: %s", stream.ownId, err))
-		m.closeStream(stream, false)
+		m.closeStream(stream, false, CloseReasonRelayError)
 		return
 	}
 
 	go m.pumpDeviceToGuest(stream)
 }
 
-func (m *OwnerMultiplexer) handleWrite(guestId uint32, ownId uint32, data []byte) {
-	stream := m.lookup(ownId)
+func (m *OwnerMultiplexer) handleWrite(device int, guestId uint32, ownId uint32, data []byte) {
+	stream := m.lookup(device, ownId)
 	if stream == nil {
 		m.logger.Info(fmt.Sprintf("Received WRTE for an unknown or already-closed stream: %d", ownId))
 		return
 	}
+	if stream.inspector != nil {
+		if err := stream.inspector.InspectGuestData(data); err != nil {
+			m.logger.Info(fmt.Sprintf("Closing stream %d (%s): %s", ownId, stream.service, err))
+			m.closeStream(stream, true, fmt.Sprintf("%s: %s", CloseReasonDenied, err))
+			if m.onDenied != nil {
+				m.onDenied(stream.service, err)
+			}
+			return
+		}
+	}
+	stream.bytesFromGuest.Add(uint64(len(data)))
+	if m.observer != nil {
+		m.observer.GuestData(ownId, data)
+	}
 	if _, err := stream.conn.Write(data); err != nil {
 		m.logger.Error(fmt.Sprintf("Failed to write to the local device stream %d: %s", ownId, err))
-		m.closeStream(stream, true)
+		m.closeStream(stream, true, CloseReasonDevice)
 		return
 	}
-	if err := m.sendOkay(ownId, guestId); err != nil {
+	if err := m.sendOkay(device, ownId, guestId); err != nil {
 		m.logger.Error(fmt.Sprintf("Failed to acknowledge a WRTE for stream %d: %s", ownId, err))
-		m.closeStream(stream, false)
+		m.closeStream(stream, false, CloseReasonRelayError)
 	}
 }
 
-func (m *OwnerMultiplexer) handleOkay(ownId uint32) {
-	stream := m.lookup(ownId)
+func (m *OwnerMultiplexer) handleOkay(device int, ownId uint32) {
+	stream := m.lookup(device, ownId)
 	if stream == nil {
 		return
 	}
@@ -220,18 +382,23 @@ func (m *OwnerMultiplexer) handleOkay(ownId uint32) {
 	}
 }
 
-func (m *OwnerMultiplexer) handleClose(ownId uint32) {
-	stream := m.lookup(ownId)
+func (m *OwnerMultiplexer) handleClose(device int, ownId uint32) {
+	stream := m.lookup(device, ownId)
 	if stream == nil {
 		return
 	}
-	m.closeStream(stream, false)
+	m.closeStream(stream, false, CloseReasonGuest)
 }
 
-func (m *OwnerMultiplexer) lookup(ownId uint32) *ownerStream {
+// lookup returns the stream ownId names, provided it is open on device.
+func (m *OwnerMultiplexer) lookup(device int, ownId uint32) *ownerStream {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	return m.streams[ownId]
+	stream := m.streams[ownId]
+	if stream == nil || stream.device != device {
+		return nil
+	}
+	return stream
 }
 
 // pumpDeviceToGuest relays bytes read from the local device stream to the
@@ -246,24 +413,29 @@ func (m *OwnerMultiplexer) pumpDeviceToGuest(stream *ownerStream) {
 			case <-stream.done:
 				return
 			}
-			if err := m.sendWrite(stream.ownId, stream.guestId, buffer[:n]); err != nil {
+			if err := m.sendWrite(stream.device, stream.ownId, stream.guestId, buffer[:n]); err != nil {
 				m.logger.Error(fmt.Sprintf("Failed to relay device output for stream %d: %s", stream.ownId, err))
-				m.closeStream(stream, false)
+				m.closeStream(stream, false, CloseReasonRelayError)
 				return
 			}
+			stream.bytesToGuest.Add(uint64(n))
+			if m.observer != nil {
+				m.observer.DeviceData(stream.ownId, buffer[:n])
+			}
 		}
 		if readErr != nil {
-			m.closeStream(stream, true)
+			m.closeStream(stream, true, CloseReasonDevice)
 			return
 		}
 	}
 }
 
 // closeStream idempotently tears a stream down: closes its device
-// connection, unregisters it, and (if notifyGuest) tells the guest it
-// closed. It is safe to call from multiple goroutines for the same stream
-// (e.g. a guest CLSE racing a local read error).
-func (m *OwnerMultiplexer) closeStream(stream *ownerStream, notifyGuest bool) {
+// connection, unregisters it, (if notifyGuest) tells the guest it closed,
+// and reports reason to the observer. It is safe to call from multiple
+// goroutines for the same stream (e.g. a guest CLSE racing a local read
+// error).
+func (m *OwnerMultiplexer) closeStream(stream *ownerStream, notifyGuest bool, reason string) {
 	stream.closeOnce.Do(func() {
 		close(stream.done)
 		_ = stream.conn.Close()
@@ -273,10 +445,19 @@ func (m *OwnerMultiplexer) closeStream(stream *ownerStream, notifyGuest bool) {
 		m.mu.Unlock()
 
 		if notifyGuest {
-			if err := m.sendClose(stream.ownId, stream.guestId); err != nil {
+			if err := m.sendClose(stream.device, stream.ownId, stream.guestId); err != nil {
 				m.logger.Error(fmt.Sprintf("Failed to notify the guest that stream %d closed: %s", stream.ownId, err))
 			}
 		}
+		if m.observer != nil {
+			m.observer.StreamClosed(stream.ownId, StreamSummary{
+				Device:         m.devices[stream.device],
+				Service:        stream.service,
+				BytesFromGuest: stream.bytesFromGuest.Load(),
+				BytesToGuest:   stream.bytesToGuest.Load(),
+				Reason:         reason,
+			})
+		}
 	})
 }
 
@@ -289,11 +470,11 @@ func (m *OwnerMultiplexer) closeAllStreams() {
 	m.mu.Unlock()
 
 	for _, stream := range streams {
-		m.closeStream(stream, false)
+		m.closeStream(stream, false, CloseReasonEnded)
 	}
 }
 
-func (m *OwnerMultiplexer) sendOkay(ownId uint32, guestId uint32) error {
+func (m *OwnerMultiplexer) sendOkay(device int, ownId uint32, guestId uint32) error {
 	container := adbMessagePool.Obtain()
 	defer container.Dispose()
 	message, err := container.Data()
@@ -303,10 +484,10 @@ func (m *OwnerMultiplexer) sendOkay(ownId uint32, guestId uint32) error {
 	if err := message.Set(adb.CommandOkay, ownId, guestId, nil); err != nil {
 		return err
 	}
-	return m.client.SendAdbMessage(message)
+	return m.client.SendAdbMessage(device, message)
 }
 
-func (m *OwnerMultiplexer) sendWrite(ownId uint32, guestId uint32, data []byte) error {
+func (m *OwnerMultiplexer) sendWrite(device int, ownId uint32, guestId uint32, data []byte) error {
 	container := adbMessagePool.Obtain()
 	defer container.Dispose()
 	message, err := container.Data()
@@ -316,10 +497,10 @@ func (m *OwnerMultiplexer) sendWrite(ownId uint32, guestId uint32, data []byte)
 	if err := message.Set(adb.CommandWrite, ownId, guestId, data); err != nil {
 		return err
 	}
-	return m.client.SendAdbMessage(message)
+	return m.client.SendAdbMessage(device, message)
 }
 
-func (m *OwnerMultiplexer) sendClose(ownId uint32, guestId uint32) error {
+func (m *OwnerMultiplexer) sendClose(device int, ownId uint32, guestId uint32) error {
 	container := adbMessagePool.Obtain()
 	defer container.Dispose()
 	message, err := container.Data()
@@ -329,5 +510,5 @@ func (m *OwnerMultiplexer) sendClose(ownId uint32, guestId uint32) error {
 	if err := message.Set(adb.CommandClose, ownId, guestId, nil); err != nil {
 		return err
 	}
-	return m.client.SendAdbMessage(message)
+	return m.client.SendAdbMessage(device, message)
 }
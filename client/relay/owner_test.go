@@ -4,6 +4,7 @@ import (
 	"adb-remote.maci.team/client/adb"
 	"errors"
 	"net"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -17,6 +18,7 @@ type fakeOwnerSmartSocket struct {
 	mu        sync.Mutex
 	byService map[string]net.Conn
 	err       error
+	serials   []string
 }
 
 func newFakeOwnerSmartSocket() *fakeOwnerSmartSocket {
@@ -33,6 +35,7 @@ func (f *fakeOwnerSmartSocket) withStream(service string, conn net.Conn) *fakeOw
 func (f *fakeOwnerSmartSocket) OpenStream(targetSerial string, service string) (net.Conn, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	f.serials = append(f.serials, targetSerial)
 	if f.err != nil {
 		return nil, f.err
 	}
@@ -51,7 +54,7 @@ func TestOwnerMultiplexerOpenFailureSendsClose(t *testing.T) {
 	smartSocket := newFakeOwnerSmartSocket()
 	smartSocket.err = errors.New("device offline")
 
-	m := NewOwnerMultiplexer(smartSocket, "emulator-5554", client, newTestLogger())
+	m := NewOwnerMultiplexer(smartSocket, []string{"emulator-5554"}, client, newTestLogger())
 
 	openMessage := adb.CreateMessage()
 	if err := openMessage.Set(adb.CommandOpen, 5, 0, []byte("shell:whoami\x00")); err != nil {
@@ -85,7 +88,7 @@ func TestOwnerMultiplexerGuestCloseTearsDownStream(t *testing.T) {
 	defer deviceConn.Close()
 	smartSocket := newFakeOwnerSmartSocket().withStream("shell:whoami", ownerSideConn)
 
-	m := NewOwnerMultiplexer(smartSocket, "emulator-5554", client, newTestLogger())
+	m := NewOwnerMultiplexer(smartSocket, []string{"emulator-5554"}, client, newTestLogger())
 
 	openMessage := adb.CreateMessage()
 	if err := openMessage.Set(adb.CommandOpen, 5, 0, []byte("shell:whoami\x00")); err != nil {
@@ -125,7 +128,7 @@ func TestOwnerMultiplexerCloseClosesAllStreams(t *testing.T) {
 	defer deviceConn.Close()
 	smartSocket := newFakeOwnerSmartSocket().withStream("shell:whoami", ownerSideConn)
 
-	m := NewOwnerMultiplexer(smartSocket, "emulator-5554", client, newTestLogger())
+	m := NewOwnerMultiplexer(smartSocket, []string{"emulator-5554"}, client, newTestLogger())
 
 	openMessage := adb.CreateMessage()
 	if err := openMessage.Set(adb.CommandOpen, 5, 0, []byte("shell:whoami\x00")); err != nil {
@@ -143,3 +146,285 @@ func TestOwnerMultiplexerCloseClosesAllStreams(t *testing.T) {
 		t.Fatalf("expected the device connection to be closed after Close")
 	}
 }
+
+// denyPrefixFilter rejects any service starting with prefix.
+type denyPrefixFilter struct{ prefix string }
+
+func (f denyPrefixFilter) CheckOpen(service string) error {
+	if strings.HasPrefix(service, f.prefix) {
+		return errors.New("denied: " + f.prefix)
+	}
+	return nil
+}
+
+// TestOwnerMultiplexerServiceFilterRejectsBeforeOpening verifies that a
+// service rejected by the filter is answered with a CLSE and reported,
+// without ever reaching the local adb-server.
+func TestOwnerMultiplexerServiceFilterRejectsBeforeOpening(t *testing.T) {
+	client := newFakeTransportClient()
+	smartSocket := newFakeOwnerSmartSocket()
+	smartSocket.err = errors.New("OpenStream must not be called for a denied service")
+
+	m := NewOwnerMultiplexer(smartSocket, []string{"emulator-5554"}, client, newTestLogger())
+	var deniedService string
+	m.SetServiceFilter(denyPrefixFilter{prefix: "reboot:"}, func(service string, reason error) {
+		deniedService = service
+	})
+
+	openMessage := adb.CreateMessage()
+	if err := openMessage.Set(adb.CommandOpen, 9, 0, []byte("reboot:\x00")); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	client.deliverAdbTransport(t, openMessage)
+	m.Dispatch(<-client.messages)
+
+	decoded, err := adb.DecodeMessage(<-client.sent)
+	if err != nil {
+		t.Fatalf("DecodeMessage failed: %s", err)
+	}
+	if decoded.Command() != adb.CommandClose || decoded.Arg2() != 9 {
+		t.Fatalf("expected a CLSE for guest id 9, got %s for %d", decoded.CommandString(), decoded.Arg2())
+	}
+	if deniedService != "reboot:" {
+		t.Fatalf("expected the denial to be reported for reboot:, got %q", deniedService)
+	}
+}
+
+// rejectWritesFilter allows every service but rejects any data a guest
+// writes containing "forbidden".
+type rejectWritesFilter struct{}
+
+func (rejectWritesFilter) CheckOpen(service string) error { return nil }
+
+func (rejectWritesFilter) NewStreamInspector(service string) StreamInspector {
+	return rejectWritesInspector{}
+}
+
+type rejectWritesInspector struct{}
+
+func (rejectWritesInspector) InspectGuestData(data []byte) error {
+	if strings.Contains(string(data), "forbidden") {
+		return errors.New("forbidden data")
+	}
+	return nil
+}
+
+// TestOwnerMultiplexerStreamInspectorClosesStream verifies that data an
+// inspector rejects never reaches the device, and that the stream is closed
+// and the denial reported.
+func TestOwnerMultiplexerStreamInspectorClosesStream(t *testing.T) {
+	client := newFakeTransportClient()
+	deviceConn, ownerSideConn := net.Pipe()
+	defer deviceConn.Close()
+	smartSocket := newFakeOwnerSmartSocket().withStream("sync:", ownerSideConn)
+
+	m := NewOwnerMultiplexer(smartSocket, []string{"emulator-5554"}, client, newTestLogger())
+	denied := make(chan string, 1)
+	m.SetServiceFilter(rejectWritesFilter{}, func(service string, reason error) {
+		denied <- service
+	})
+
+	openMessage := adb.CreateMessage()
+	if err := openMessage.Set(adb.CommandOpen, 5, 0, []byte("sync:\x00")); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	client.deliverAdbTransport(t, openMessage)
+	m.Dispatch(<-client.messages)
+	okay, err := adb.DecodeMessage(<-client.sent)
+	if err != nil {
+		t.Fatalf("DecodeMessage failed: %s", err)
+	}
+
+	writeMessage := adb.CreateMessage()
+	if err := writeMessage.Set(adb.CommandWrite, 5, okay.Arg1(), []byte("forbidden")); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	client.deliverAdbTransport(t, writeMessage)
+	m.Dispatch(<-client.messages)
+
+	decoded, err := adb.DecodeMessage(<-client.sent)
+	if err != nil {
+		t.Fatalf("DecodeMessage failed: %s", err)
+	}
+	if decoded.Command() != adb.CommandClose || decoded.Arg2() != 5 {
+		t.Fatalf("expected a CLSE for guest id 5, got %s for %d", decoded.CommandString(), decoded.Arg2())
+	}
+	if service := <-denied; service != "sync:" {
+		t.Fatalf("expected the denial to be reported for sync:, got %q", service)
+	}
+
+	// Nothing must have been written to the device: the connection is
+	// closed without any data.
+	buffer := make([]byte, 16)
+	_ = deviceConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := deviceConn.Read(buffer); err == nil {
+		t.Fatalf("expected the device connection to be closed, read %q", buffer[:n])
+	}
+}
+
+// recordingObserver collects the StreamObserver calls it receives.
+type recordingObserver struct {
+	mu       sync.Mutex
+	opened   []string
+	guest    []byte
+	rejected []string
+	closed   chan StreamSummary
+}
+
+func newRecordingObserver() *recordingObserver {
+	return &recordingObserver{closed: make(chan StreamSummary, 4)}
+}
+
+func (o *recordingObserver) StreamOpened(id uint32, device string, service string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.opened = append(o.opened, service)
+}
+
+func (o *recordingObserver) StreamRejected(device string, service string, reason error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.rejected = append(o.rejected, service)
+}
+
+func (o *recordingObserver) GuestData(id uint32, data []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.guest = append(o.guest, data...)
+}
+
+func (o *recordingObserver) DeviceData(id uint32, data []byte) {}
+
+func (o *recordingObserver) StreamClosed(id uint32, summary StreamSummary) {
+	o.closed <- summary
+}
+
+// TestOwnerMultiplexerReportsStreamLifecycle verifies the observer sees the
+// open, the guest's data, and a close summary with byte counts and reason.
+func TestOwnerMultiplexerReportsStreamLifecycle(t *testing.T) {
+	client := newFakeTransportClient()
+	deviceConn, ownerSideConn := net.Pipe()
+	smartSocket := newFakeOwnerSmartSocket().withStream("shell:cat", ownerSideConn)
+
+	m := NewOwnerMultiplexer(smartSocket, []string{"emulator-5554"}, client, newTestLogger())
+	observer := newRecordingObserver()
+	m.SetStreamObserver(observer)
+
+	openMessage := adb.CreateMessage()
+	if err := openMessage.Set(adb.CommandOpen, 5, 0, []byte("shell:cat\x00")); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	client.deliverAdbTransport(t, openMessage)
+	m.Dispatch(<-client.messages)
+	okay, err := adb.DecodeMessage(<-client.sent)
+	if err != nil {
+		t.Fatalf("DecodeMessage failed: %s", err)
+	}
+
+	// The device echoes the guest's 5 bytes, plus 3 of its own, then
+	// closes the stream.
+	go func() {
+		buffer := make([]byte, 5)
+		_, _ = deviceConn.Read(buffer)
+		_, _ = deviceConn.Write(append(buffer, "!!!"...))
+		_ = deviceConn.Close()
+	}()
+
+	writeMessage := adb.CreateMessage()
+	if err := writeMessage.Set(adb.CommandWrite, 5, okay.Arg1(), []byte("hello")); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	client.deliverAdbTransport(t, writeMessage)
+	m.Dispatch(<-client.messages)
+
+	var summary StreamSummary
+	select {
+	case summary = <-observer.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for the stream to close")
+	}
+	if summary.Device != "emulator-5554" || summary.Service != "shell:cat" || summary.BytesFromGuest != 5 || summary.BytesToGuest != 8 || summary.Reason != CloseReasonDevice {
+		t.Fatalf("unexpected close summary: %+v", summary)
+	}
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	if len(observer.opened) != 1 || observer.opened[0] != "shell:cat" || string(observer.guest) != "hello" {
+		t.Fatalf("unexpected observations: opened %v, guest data %q", observer.opened, observer.guest)
+	}
+}
+
+// TestOwnerMultiplexerOpensStreamOnRequestedDevice verifies an OPEN is
+// serviced by the device its message names, and that everything sent back
+// for that stream is tagged with the same device.
+func TestOwnerMultiplexerOpensStreamOnRequestedDevice(t *testing.T) {
+	client := newFakeTransportClient()
+	deviceConn, ownerSideConn := net.Pipe()
+	defer deviceConn.Close()
+	smartSocket := newFakeOwnerSmartSocket().withStream("shell:whoami", ownerSideConn)
+
+	m := NewOwnerMultiplexer(smartSocket, []string{"emulator-5554", "R58M123"}, client, newTestLogger())
+	defer m.Close()
+
+	openMessage := adb.CreateMessage()
+	if err := openMessage.Set(adb.CommandOpen, 5, 0, []byte("shell:whoami\x00")); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	client.deliverAdbTransportFor(t, 1, openMessage)
+	m.Dispatch(<-client.messages)
+
+	okay, err := adb.DecodeMessage(<-client.sent)
+	if err != nil {
+		t.Fatalf("DecodeMessage failed: %s", err)
+	}
+	if okay.Command() != adb.CommandOkay {
+		t.Fatalf("expected OKAY, got %x", okay.Command())
+	}
+	if devices := client.devices(); len(devices) != 1 || devices[0] != 1 {
+		t.Fatalf("expected the OKAY to be sent for device 1, got %v", devices)
+	}
+	smartSocket.mu.Lock()
+	serials := append([]string{}, smartSocket.serials...)
+	smartSocket.mu.Unlock()
+	if len(serials) != 1 || serials[0] != "R58M123" {
+		t.Fatalf("expected the stream to be opened on R58M123, got %v", serials)
+	}
+
+	// The same stream id on another device names nothing.
+	closeMessage := adb.CreateMessage()
+	if err := closeMessage.Set(adb.CommandClose, 5, okay.Arg1(), nil); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	client.deliverAdbTransportFor(t, 0, closeMessage)
+	m.Dispatch(<-client.messages)
+	if m.lookup(1, okay.Arg1()) == nil {
+		t.Fatalf("a CLSE for another device closed the stream")
+	}
+}
+
+// TestOwnerMultiplexerRejectsUnknownDevice verifies an OPEN for a device
+// index outside the room's list is refused without touching the local
+// adb-server.
+func TestOwnerMultiplexerRejectsUnknownDevice(t *testing.T) {
+	client := newFakeTransportClient()
+	smartSocket := newFakeOwnerSmartSocket()
+
+	m := NewOwnerMultiplexer(smartSocket, []string{"emulator-5554"}, client, newTestLogger())
+
+	openMessage := adb.CreateMessage()
+	if err := openMessage.Set(adb.CommandOpen, 5, 0, []byte("shell:whoami\x00")); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	client.deliverAdbTransportFor(t, 3, openMessage)
+	m.Dispatch(<-client.messages)
+
+	closeMessage, err := adb.DecodeMessage(<-client.sent)
+	if err != nil {
+		t.Fatalf("DecodeMessage failed: %s", err)
+	}
+	if closeMessage.Command() != adb.CommandClose || closeMessage.Arg2() != 5 {
+		t.Fatalf("expected a CLSE for guest id 5, got %x (arg2 %d)", closeMessage.Command(), closeMessage.Arg2())
+	}
+	if len(smartSocket.serials) != 0 {
+		t.Fatalf("expected no stream to be opened, got %v", smartSocket.serials)
+	}
+}
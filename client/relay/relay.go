@@ -17,9 +17,10 @@ import (
 )
 
 // TransportClient is the subset of transportLayer.Client the relay depends
-// on, allowing tests to substitute a fake implementation.
+// on, allowing tests to substitute a fake implementation. device is the
+// index, in the room's device list, of the shared device a message is for.
 type TransportClient interface {
-	SendAdbMessage(message *adb.AdbMessage) error
+	SendAdbMessage(device int, message *adb.AdbMessage) error
 	Messages() <-chan *transportLayer.MessageContainer
 }
 
@@ -27,13 +28,17 @@ var ErrTransportClosed = errors.New("the transporter message channel was closed"
 
 // Run pumps ADB messages between conn and client until either side closes
 // or errors, or ctx is cancelled, then closes conn and returns the reason
-// the relay stopped.
-func Run(ctx context.Context, conn net.Conn, client TransportClient, logger *slog.Logger) error {
+// the relay stopped. Messages from conn are sent for the room's device'th
+// device; every message client yields is assumed to be for it too (see
+// DeviceRouter for rooms sharing several devices). Stream ids pass through
+// verbatim, so conn must be the device's only local connection; see
+// GuestMultiplexer for relaying several.
+func Run(ctx context.Context, conn net.Conn, client TransportClient, device int, logger *slog.Logger) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	errChannel := make(chan error, 2)
-	go func() { errChannel <- pumpLocalToRemote(ctx, conn, client) }()
+	go func() { errChannel <- pumpLocalToRemote(ctx, conn, client, device) }()
 	go func() { errChannel <- pumpRemoteToLocal(ctx, conn, client, logger) }()
 
 	err := <-errChannel
@@ -46,7 +51,7 @@ func Run(ctx context.Context, conn net.Conn, client TransportClient, logger *slo
 
 // pumpLocalToRemote reads ADB messages arriving on the local connection and
 // forwards them to the peer through the transporter client.
-func pumpLocalToRemote(ctx context.Context, conn net.Conn, client TransportClient) error {
+func pumpLocalToRemote(ctx context.Context, conn net.Conn, client TransportClient, device int) error {
 	message := adb.CreateMessage()
 	for {
 		if ctx.Err() != nil {
@@ -55,7 +60,7 @@ func pumpLocalToRemote(ctx context.Context, conn net.Conn, client TransportClien
 		if err := message.Read(conn); err != nil {
 			return err
 		}
-		if err := client.SendAdbMessage(message); err != nil {
+		if err := client.SendAdbMessage(device, message); err != nil {
 			return err
 		}
 	}
@@ -88,7 +93,12 @@ func handleIncoming(conn net.Conn, container *transportLayer.MessageContainer, l
 		logger.Info(fmt.Sprintf("Ignoring unexpected message during relay, command: %x", message.Command()))
 		return container.Dispose()
 	}
-	adbMessage, err := adb.DecodeMessage(message.Payload())
+	payload, err := message.GetPayloadAdbTransport()
+	if err != nil {
+		logger.Error(fmt.Sprintf("Invalid ADB transport payload received from the peer: %s", err))
+		return container.Dispose()
+	}
+	adbMessage, err := adb.DecodeMessage(payload.Message)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Invalid ADB message received from the peer: %s", err))
 		return container.Dispose()
@@ -10,6 +10,7 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"sync"
 	"testing"
 	"time"
 )
@@ -20,12 +21,20 @@ func newTestLogger() *slog.Logger {
 
 // fakeTransportClient is a minimal, in-memory TransportClient double: every
 // SendAdbMessage call publishes a byte-copy snapshot (since the caller
-// reuses its AdbMessage buffer) on the sent channel, and test code can push
-// synthetic incoming TransporterMessages via deliver.
+// reuses its AdbMessage buffer) on the sent channel, and records which
+// device it was for in sentDevices; test code can push synthetic incoming
+// TransporterMessages via deliver.
 type fakeTransportClient struct {
 	sent     chan []byte
 	messages chan *transportLayer.MessageContainer
 	pool     *utils.ObjectPool[protocol.TransporterMessage]
+
+	mu          sync.Mutex
+	sentDevices []int
+	// sendErr, if set, fails every send, which is then only counted in
+	// failedSends.
+	sendErr     error
+	failedSends int
 }
 
 func newFakeTransportClient() *fakeTransportClient {
@@ -37,19 +46,39 @@ func newFakeTransportClient() *fakeTransportClient {
 	}
 }
 
-func (f *fakeTransportClient) SendAdbMessage(message *adb.AdbMessage) error {
+func (f *fakeTransportClient) SendAdbMessage(device int, message *adb.AdbMessage) error {
 	snapshot := append([]byte{}, message.Bytes()...)
+	f.mu.Lock()
+	if f.sendErr != nil {
+		f.failedSends++
+		f.mu.Unlock()
+		return f.sendErr
+	}
+	f.sentDevices = append(f.sentDevices, device)
+	f.mu.Unlock()
 	f.sent <- snapshot
 	return nil
 }
 
+func (f *fakeTransportClient) devices() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int{}, f.sentDevices...)
+}
+
 func (f *fakeTransportClient) Messages() <-chan *transportLayer.MessageContainer {
 	return f.messages
 }
 
-// deliverAdbTransport wraps an ADB message as an incoming CommandAdbTransport
-// TransporterMessage, as if it had arrived from the peer.
+// deliverAdbTransport wraps an ADB message for the room's first device as
+// an incoming CommandAdbTransport TransporterMessage, as if it had arrived
+// from the peer.
 func (f *fakeTransportClient) deliverAdbTransport(t *testing.T, adbMessage *adb.AdbMessage) {
+	t.Helper()
+	f.deliverAdbTransportFor(t, 0, adbMessage)
+}
+
+func (f *fakeTransportClient) deliverAdbTransportFor(t *testing.T, device int, adbMessage *adb.AdbMessage) {
 	t.Helper()
 	container := f.pool.Obtain()
 	message, err := container.Data()
@@ -57,8 +86,8 @@ func (f *fakeTransportClient) deliverAdbTransport(t *testing.T, adbMessage *adb.
 		t.Fatalf("Data() failed: %s", err)
 	}
 	message.SetDirectCommand(protocol.CommandAdbTransport)
-	if err := message.SetRawPayload(adbMessage.Bytes()); err != nil {
-		t.Fatalf("SetRawPayload failed: %s", err)
+	if err := message.SetPayloadAdbTransport(&protocol.TransporterMessagePayloadAdbTransport{Device: device, Message: adbMessage.Bytes()}); err != nil {
+		t.Fatalf("SetPayloadAdbTransport failed: %s", err)
 	}
 	f.messages <- container
 }
@@ -80,7 +109,7 @@ func TestRelayForwardsLocalMessagesToRemote(t *testing.T) {
 	logger := newTestLogger()
 
 	done := make(chan error, 1)
-	go func() { done <- Run(context.Background(), proxySide, client, logger) }()
+	go func() { done <- Run(context.Background(), proxySide, client, 0, logger) }()
 
 	outgoing := adb.CreateMessage()
 	if err := outgoing.Set(adb.CommandOpen, 1, 0, []byte("shell:")); err != nil {
@@ -117,7 +146,7 @@ func TestRelayForwardsRemoteMessagesToLocal(t *testing.T) {
 	logger := newTestLogger()
 
 	done := make(chan error, 1)
-	go func() { done <- Run(context.Background(), proxySide, client, logger) }()
+	go func() { done <- Run(context.Background(), proxySide, client, 0, logger) }()
 
 	incoming := adb.CreateMessage()
 	if err := incoming.Set(adb.CommandOkay, 2, 0, nil); err != nil {
@@ -151,7 +180,7 @@ func TestRelayIgnoresNonTransportMessagesAndKeepsRunning(t *testing.T) {
 	logger := newTestLogger()
 
 	done := make(chan error, 1)
-	go func() { done <- Run(context.Background(), proxySide, client, logger) }()
+	go func() { done <- Run(context.Background(), proxySide, client, 0, logger) }()
 
 	// An unrelated control message should be ignored, not tear the relay down.
 	client.deliverOther(t, protocol.CommandJoinRoom)
@@ -190,7 +219,7 @@ func TestRelayStopsOnContextCancellation(t *testing.T) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	done := make(chan error, 1)
-	go func() { done <- Run(ctx, proxySide, client, logger) }()
+	go func() { done <- Run(ctx, proxySide, client, 0, logger) }()
 
 	cancel()
 
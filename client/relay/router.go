@@ -0,0 +1,239 @@
+package relay
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/transportLayer"
+	"adb-remote.maci.team/shared/protocol"
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// DeviceRouter splits a guest's single transporter connection into one
+// TransportClient per device of a room sharing several devices, so each
+// device's local relay (see Run) only ever sees its own device's messages.
+// Sending is shared: every device's TransportClient sends straight through
+// the underlying client.
+type DeviceRouter struct {
+	client        TransportClient
+	devices       []chan *transportLayer.MessageContainer
+	onDeviceState func(device int, state string)
+	onDeviceInfo  func(device int, info adb.DeviceInfo)
+	onLease       func(state int, remaining time.Duration)
+	onKick        func(reason string)
+	onChat        func(message *protocol.TransporterMessagePayloadChatMessage)
+	logger        *slog.Logger
+}
+
+// deviceTransport is one device's view of a DeviceRouter.
+type deviceTransport struct {
+	TransportClient
+	messages chan *transportLayer.MessageContainer
+}
+
+func (d *deviceTransport) Messages() <-chan *transportLayer.MessageContainer {
+	return d.messages
+}
+
+func NewDeviceRouter(client TransportClient, deviceCount int, logger *slog.Logger) *DeviceRouter {
+	devices := make([]chan *transportLayer.MessageContainer, deviceCount)
+	for i := range devices {
+		devices[i] = make(chan *transportLayer.MessageContainer)
+	}
+	return &DeviceRouter{client: client, devices: devices, logger: logger}
+}
+
+// Device returns the TransportClient for the room's device'th device. Its
+// Messages() only yields CommandAdbTransport messages for that device, and
+// is closed once Run returns. Someone must keep reading it for as long as
+// Run runs: a device nobody reads stalls the others.
+func (r *DeviceRouter) Device(device int) TransportClient {
+	return &deviceTransport{TransportClient: r.client, messages: r.devices[device]}
+}
+
+// SetDeviceStateHandler has Run call handler, on Run's goroutine, for every
+// CommandDeviceState message the owner sends about one of the room's
+// devices. It must be called before Run, and handler must not block.
+func (r *DeviceRouter) SetDeviceStateHandler(handler func(device int, state string)) {
+	r.onDeviceState = handler
+}
+
+// SetDeviceInfoHandler has Run call handler, on Run's goroutine, for every
+// CommandDeviceInfo message the owner sends about one of the room's
+// devices. It must be called before Run, and handler must not block.
+func (r *DeviceRouter) SetDeviceInfoHandler(handler func(device int, info adb.DeviceInfo)) {
+	r.onDeviceInfo = handler
+}
+
+// SetSessionLeaseHandler has Run call handler, on Run's goroutine, for every
+// CommandSessionLease message the owner sends: state is one of the
+// protocol's lease states, and remaining what an active lease has left. It
+// must be called before Run, and handler must not block.
+func (r *DeviceRouter) SetSessionLeaseHandler(handler func(state int, remaining time.Duration)) {
+	r.onLease = handler
+}
+
+// SetKickHandler has Run call handler, on Run's goroutine, when the owner
+// removes the guest from the room (CommandKickGuest), with the reason it
+// gave. It must be called before Run, and handler must not block.
+func (r *DeviceRouter) SetKickHandler(handler func(reason string)) {
+	r.onKick = handler
+}
+
+// SetChatHandler has Run call handler, on Run's goroutine, for every
+// CommandChatMessage the owner sends, as it arrived: verifying it is up to
+// handler. It must be called before Run, and handler must not block.
+func (r *DeviceRouter) SetChatHandler(handler func(message *protocol.TransporterMessagePayloadChatMessage)) {
+	r.onChat = handler
+}
+
+// Run reads the underlying client's messages until ctx is cancelled or the
+// transport is lost, handing every CommandAdbTransport message to its
+// device's TransportClient and discarding anything else, then closes every
+// device's channel.
+func (r *DeviceRouter) Run(ctx context.Context) error {
+	defer func() {
+		for _, channel := range r.devices {
+			close(channel)
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case container, ok := <-r.client.Messages():
+			if !ok {
+				return ErrTransportClosed
+			}
+			device, ok := r.route(container)
+			if !ok {
+				_ = container.Dispose()
+				continue
+			}
+			select {
+			case r.devices[device] <- container:
+			case <-ctx.Done():
+				_ = container.Dispose()
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// route returns the index of the device container is for, or false if it
+// isn't an ADB message for one of the room's devices. Device state changes
+// and details, session leases, kicks and chat messages are handed to the
+// SetDeviceStateHandler, SetDeviceInfoHandler, SetSessionLeaseHandler,
+// SetKickHandler and SetChatHandler handlers instead.
+func (r *DeviceRouter) route(container *transportLayer.MessageContainer) (int, bool) {
+	message, err := container.Data()
+	if err != nil {
+		r.logger.Error(fmt.Sprintf("Unusable pooled message container: %s", err))
+		return 0, false
+	}
+	switch message.Command() {
+	case protocol.CommandDeviceState:
+		r.handleDeviceState(message)
+		return 0, false
+	case protocol.CommandDeviceInfo:
+		r.handleDeviceInfo(message)
+		return 0, false
+	case protocol.CommandSessionLease:
+		r.handleSessionLease(message)
+		return 0, false
+	case protocol.CommandKickGuest:
+		r.handleKick(message)
+		return 0, false
+	case protocol.CommandChatMessage:
+		r.handleChat(message)
+		return 0, false
+	}
+	if message.Command() != protocol.CommandAdbTransport {
+		r.logger.Info(fmt.Sprintf("Ignoring unexpected message during relay, command: %x", message.Command()))
+		return 0, false
+	}
+	payload, err := message.GetPayloadAdbTransport()
+	if err != nil {
+		r.logger.Error(fmt.Sprintf("Invalid ADB transport payload received from the peer: %s", err))
+		return 0, false
+	}
+	if payload.Device < 0 || payload.Device >= len(r.devices) {
+		r.logger.Info(fmt.Sprintf("Ignoring an ADB message for unknown device #%d", payload.Device))
+		return 0, false
+	}
+	return payload.Device, true
+}
+
+func (r *DeviceRouter) handleDeviceState(message *protocol.TransporterMessage) {
+	payload, err := message.GetPayloadDeviceState()
+	if err != nil {
+		r.logger.Error(fmt.Sprintf("Invalid device state payload received from the peer: %s", err))
+		return
+	}
+	if payload.Device < 0 || payload.Device >= len(r.devices) {
+		r.logger.Info(fmt.Sprintf("Ignoring a state change for unknown device #%d", payload.Device))
+		return
+	}
+	r.logger.Info(fmt.Sprintf("Device #%d is now %s", payload.Device, payload.State))
+	if r.onDeviceState != nil {
+		r.onDeviceState(payload.Device, payload.State)
+	}
+}
+
+func (r *DeviceRouter) handleDeviceInfo(message *protocol.TransporterMessage) {
+	payload, err := message.GetPayloadDeviceInfo()
+	if err != nil {
+		r.logger.Error(fmt.Sprintf("Invalid device info payload received from the peer: %s", err))
+		return
+	}
+	if payload.Device < 0 || payload.Device >= len(r.devices) {
+		r.logger.Info(fmt.Sprintf("Ignoring details for unknown device #%d", payload.Device))
+		return
+	}
+	if r.onDeviceInfo != nil {
+		r.onDeviceInfo(payload.Device, adb.DeviceInfo{
+			Product:        payload.Product,
+			Model:          payload.Model,
+			Device:         payload.DeviceName,
+			Manufacturer:   payload.Manufacturer,
+			AndroidVersion: payload.AndroidVersion,
+			Abi:            payload.Abi,
+		})
+	}
+}
+
+func (r *DeviceRouter) handleSessionLease(message *protocol.TransporterMessage) {
+	payload, err := message.GetPayloadSessionLease()
+	if err != nil {
+		r.logger.Error(fmt.Sprintf("Invalid session lease payload received from the peer: %s", err))
+		return
+	}
+	r.logger.Info(fmt.Sprintf("Session lease is now in state %d with %ds left", payload.State, payload.RemainingSeconds))
+	if r.onLease != nil {
+		r.onLease(payload.State, time.Duration(payload.RemainingSeconds)*time.Second)
+	}
+}
+
+func (r *DeviceRouter) handleKick(message *protocol.TransporterMessage) {
+	payload, err := message.GetPayloadKickGuest()
+	if err != nil {
+		r.logger.Error(fmt.Sprintf("Invalid kick payload received from the peer: %s", err))
+		return
+	}
+	r.logger.Info(fmt.Sprintf("The room owner removed the guest from the room: %q", payload.Reason))
+	if r.onKick != nil {
+		r.onKick(payload.Reason)
+	}
+}
+
+func (r *DeviceRouter) handleChat(message *protocol.TransporterMessage) {
+	payload, err := message.GetPayloadChatMessage()
+	if err != nil {
+		r.logger.Error(fmt.Sprintf("Invalid chat payload received from the peer: %s", err))
+		return
+	}
+	if r.onChat != nil {
+		r.onChat(payload)
+	}
+}
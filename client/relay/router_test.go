@@ -0,0 +1,253 @@
+package relay
+
+import (
+	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/shared/protocol"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeviceRouterRoutesMessagesByDevice(t *testing.T) {
+	client := newFakeTransportClient()
+	router := NewDeviceRouter(client, 2, newTestLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- router.Run(ctx) }()
+
+	for _, device := range []int{1, 5, 0} {
+		message := adb.CreateMessage()
+		if err := message.Set(adb.CommandOkay, uint32(device+1), 7, nil); err != nil {
+			t.Fatalf("Set failed: %s", err)
+		}
+		client.deliverAdbTransportFor(t, device, message)
+	}
+	client.deliverOther(t, protocol.CommandGuestLeft)
+
+	for _, device := range []int{1, 0} {
+		select {
+		case container := <-router.Device(device).Messages():
+			message, err := container.Data()
+			if err != nil {
+				t.Fatalf("Data() failed: %s", err)
+			}
+			payload, err := message.GetPayloadAdbTransport()
+			if err != nil {
+				t.Fatalf("GetPayloadAdbTransport failed: %s", err)
+			}
+			if payload.Device != device {
+				t.Fatalf("device %d received a message for device %d", device, payload.Device)
+			}
+			_ = container.Dispose()
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for device %d's message", device)
+		}
+	}
+
+	// Sending goes straight through, whichever device's view is used.
+	message := adb.CreateMessage()
+	if err := message.Set(adb.CommandOkay, 1, 2, nil); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	if err := router.Device(1).SendAdbMessage(1, message); err != nil {
+		t.Fatalf("SendAdbMessage failed: %s", err)
+	}
+	<-client.sent
+	if devices := client.devices(); len(devices) != 1 || devices[0] != 1 {
+		t.Fatalf("expected one message sent for device 1, got %v", devices)
+	}
+
+	close(client.messages)
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrTransportClosed) {
+			t.Fatalf("expected ErrTransportClosed, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Run did not return after the transport closed")
+	}
+	for device := 0; device < 2; device++ {
+		if _, ok := <-router.Device(device).Messages(); ok {
+			t.Fatalf("expected device %d's channel to be closed", device)
+		}
+	}
+}
+
+func TestDeviceRouterHandsDeviceStatesToHandler(t *testing.T) {
+	client := newFakeTransportClient()
+	router := NewDeviceRouter(client, 2, newTestLogger())
+	type stateChange struct {
+		device int
+		state  string
+	}
+	changes := make(chan stateChange, 4)
+	router.SetDeviceStateHandler(func(device int, state string) {
+		changes <- stateChange{device, state}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = router.Run(ctx) }()
+
+	for _, change := range []stateChange{{1, "offline"}, {7, "offline"}, {1, "device"}} {
+		container := client.pool.Obtain()
+		message, err := container.Data()
+		if err != nil {
+			t.Fatalf("Data() failed: %s", err)
+		}
+		message.SetDirectCommand(protocol.CommandDeviceState)
+		if err := message.SetPayloadDeviceState(&protocol.TransporterMessagePayloadDeviceState{Device: change.device, State: change.state}); err != nil {
+			t.Fatalf("SetPayloadDeviceState failed: %s", err)
+		}
+		client.messages <- container
+	}
+
+	// The change for unknown device #7 is dropped.
+	for _, want := range []stateChange{{1, "offline"}, {1, "device"}} {
+		select {
+		case got := <-changes:
+			if got != want {
+				t.Fatalf("expected %+v, got %+v", want, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %+v", want)
+		}
+	}
+}
+
+func TestDeviceRouterHandsDeviceInfoToHandler(t *testing.T) {
+	client := newFakeTransportClient()
+	router := NewDeviceRouter(client, 1, newTestLogger())
+	infos := make(chan adb.DeviceInfo, 1)
+	router.SetDeviceInfoHandler(func(device int, info adb.DeviceInfo) {
+		infos <- info
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = router.Run(ctx) }()
+
+	container := client.pool.Obtain()
+	message, err := container.Data()
+	if err != nil {
+		t.Fatalf("Data() failed: %s", err)
+	}
+	message.SetDirectCommand(protocol.CommandDeviceInfo)
+	if err := message.SetPayloadDeviceInfo(&protocol.TransporterMessagePayloadDeviceInfo{Device: 0, Model: "Pixel_7", DeviceName: "panther"}); err != nil {
+		t.Fatalf("SetPayloadDeviceInfo failed: %s", err)
+	}
+	client.messages <- container
+
+	select {
+	case info := <-infos:
+		if info.Model != "Pixel_7" || info.Device != "panther" {
+			t.Fatalf("unexpected device info: %+v", info)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for the device info")
+	}
+}
+
+func TestDeviceRouterHandsSessionLeasesToHandler(t *testing.T) {
+	client := newFakeTransportClient()
+	router := NewDeviceRouter(client, 1, newTestLogger())
+	leases := make(chan time.Duration, 1)
+	router.SetSessionLeaseHandler(func(state int, remaining time.Duration) {
+		if state == protocol.LeaseActive {
+			leases <- remaining
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = router.Run(ctx) }()
+
+	container := client.pool.Obtain()
+	message, err := container.Data()
+	if err != nil {
+		t.Fatalf("Data() failed: %s", err)
+	}
+	message.SetDirectCommand(protocol.CommandSessionLease)
+	if err := message.SetPayloadSessionLease(&protocol.TransporterMessagePayloadSessionLease{State: protocol.LeaseActive, RemainingSeconds: 90}); err != nil {
+		t.Fatalf("SetPayloadSessionLease failed: %s", err)
+	}
+	client.messages <- container
+
+	select {
+	case remaining := <-leases:
+		if remaining != 90*time.Second {
+			t.Fatalf("unexpected remaining lease: %s", remaining)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for the session lease")
+	}
+}
+
+func TestDeviceRouterHandsKicksToHandler(t *testing.T) {
+	client := newFakeTransportClient()
+	router := NewDeviceRouter(client, 1, newTestLogger())
+	reasons := make(chan string, 1)
+	router.SetKickHandler(func(reason string) {
+		reasons <- reason
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = router.Run(ctx) }()
+
+	container := client.pool.Obtain()
+	message, err := container.Data()
+	if err != nil {
+		t.Fatalf("Data() failed: %s", err)
+	}
+	message.SetDirectCommand(protocol.CommandKickGuest)
+	if err := message.SetPayloadKickGuest(&protocol.TransporterMessagePayloadKickGuest{Reason: "Session over"}); err != nil {
+		t.Fatalf("SetPayloadKickGuest failed: %s", err)
+	}
+	client.messages <- container
+
+	select {
+	case reason := <-reasons:
+		if reason != "Session over" {
+			t.Fatalf("unexpected kick reason %q", reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for the kick")
+	}
+}
+
+func TestDeviceRouterHandsChatMessagesToHandler(t *testing.T) {
+	client := newFakeTransportClient()
+	router := NewDeviceRouter(client, 1, newTestLogger())
+	texts := make(chan string, 1)
+	router.SetChatHandler(func(message *protocol.TransporterMessagePayloadChatMessage) {
+		texts <- message.Text
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = router.Run(ctx) }()
+
+	container := client.pool.Obtain()
+	message, err := container.Data()
+	if err != nil {
+		t.Fatalf("Data() failed: %s", err)
+	}
+	message.SetDirectCommand(protocol.CommandChatMessage)
+	if err := message.SetPayloadChatMessage(&protocol.TransporterMessagePayloadChatMessage{Text: "Rebooting the Pixel", SentAt: 1700000000, Sequence: 1}); err != nil {
+		t.Fatalf("SetPayloadChatMessage failed: %s", err)
+	}
+	client.messages <- container
+
+	select {
+	case text := <-texts:
+		if text != "Rebooting the Pixel" {
+			t.Fatalf("unexpected chat text %q", text)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for the chat message")
+	}
+}
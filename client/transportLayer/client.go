@@ -25,8 +25,12 @@ const messageChannelBufferSize = 0
 type MessageContainer = utils.DisposableObjectContainer[protocol.TransporterMessage]
 
 type Client struct {
+	// mutex guards connection, cancelFunc, messageChannel and clientId,
+	// which Reconnect replaces.
+	mutex      sync.Mutex
 	connection net.Conn
 	cancelFunc context.CancelFunc
+	clientId   string
 
 	// writeMutex serializes writes to connection. Owner-side stream
 	// multiplexing calls SendAdbMessage concurrently from one goroutine
@@ -72,8 +76,12 @@ func CreateClient(logger *slog.Logger, config *config.ClientConfiguration) (*Cli
 }
 
 // Messages yields every TransporterMessage read off the wire. The receiver
-// owns the returned container and must Dispose it once done.
+// owns the returned container and must Dispose it once done. After a
+// Reconnect it returns the new connection's channel; the previous one is
+// closed like on any disconnect.
 func (c *Client) Messages() <-chan *MessageContainer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	return c.messageChannel
 }
 
@@ -122,6 +130,43 @@ func (c *Client) recordCapture(direction pcapwriter.Direction, data []byte) {
 // relay in between) is what client/identity's public-key fingerprints are
 // for, checked at the application layer during room join.
 func (c *Client) Start() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.dial(c.messageChannel)
+}
+
+// Reconnect drops the current connection, if any, and dials the transporter
+// again like Start, e.g. once Messages() was closed because the connection
+// was lost. The new connection is a new client to the transporter: it has
+// to be handshaked again (see controller.Handshake) and isn't in any room.
+// Debug capture and the byte counters carry on across it.
+func (c *Client) Reconnect() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.disconnect()
+	c.clientId = ""
+	return c.dial(make(chan *MessageContainer, messageChannelBufferSize))
+}
+
+// ClientId returns the id the transporter assigned to the current
+// connection during the handshake (see SetClientId), empty before it.
+func (c *Client) ClientId() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.clientId
+}
+
+// SetClientId records the id the transporter assigned to the current
+// connection; controller.Handshake calls it.
+func (c *Client) SetClientId(clientId string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.clientId = clientId
+}
+
+// dial connects to the transporter and starts reading into messages, which
+// becomes Messages(). It is called with mutex held.
+func (c *Client) dial(messages chan *MessageContainer) error {
 	address := c.Config.TransporterAddress
 	connection, err := tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true})
 	if err != nil {
@@ -129,19 +174,33 @@ func (c *Client) Start() error {
 	}
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	c.cancelFunc = cancelFunc
+	c.writeMutex.Lock()
 	c.connection = connection
-	go c.startReader(ctx)
+	c.writeMutex.Unlock()
+	c.messageChannel = messages
+	go c.startReader(ctx, connection, messages)
 	return nil
 }
 
-// startReader is the sole sender on messageChannel, so it alone is
-// responsible for closing it once reading stops for any reason (read error,
-// a broken pool, or ctx cancellation) — this is how Messages() consumers
-// learn the connection is gone, rather than blocking forever.
-func (c *Client) startReader(ctx context.Context) {
+// disconnect stops the background reader and closes the connection, if
+// there is one. It is called with mutex held.
+func (c *Client) disconnect() {
+	if c.cancelFunc != nil {
+		c.cancelFunc()
+	}
+	if c.connection != nil {
+		_ = c.connection.Close()
+	}
+}
+
+// startReader is the sole sender on messages, so it alone is responsible
+// for closing it once reading stops for any reason (read error, a broken
+// pool, or ctx cancellation) — this is how Messages() consumers learn the
+// connection is gone, rather than blocking forever.
+func (c *Client) startReader(ctx context.Context, connection net.Conn, messages chan<- *MessageContainer) {
 	log := c.Logger
 	pool := c.transporterMessagePool
-	defer close(c.messageChannel)
+	defer close(messages)
 	for {
 		if ctx.Err() != nil {
 			log.Info("Connection reader cancelled")
@@ -156,7 +215,7 @@ func (c *Client) startReader(ctx context.Context) {
 			_ = container.Dispose()
 			return
 		}
-		if err := message.Read(c.connection); err != nil {
+		if err := message.Read(connection); err != nil {
 			log.Error(fmt.Sprintf("Error happened during reading: %s", err))
 			_ = container.Dispose()
 			return
@@ -164,7 +223,7 @@ func (c *Client) startReader(ctx context.Context) {
 		c.bytesReceived.Add(uint64(message.WireSize()))
 		c.recordCapture(pcapwriter.Incoming, message.Bytes())
 		select {
-		case c.messageChannel <- container:
+		case messages <- container:
 		case <-ctx.Done():
 			_ = container.Dispose()
 			return
@@ -174,12 +233,9 @@ func (c *Client) startReader(ctx context.Context) {
 
 // Close terminates the connection and stops the background reader.
 func (c *Client) Close() {
-	if c.cancelFunc != nil {
-		c.cancelFunc()
-	}
-	if c.connection != nil {
-		_ = c.connection.Close()
-	}
+	c.mutex.Lock()
+	c.disconnect()
+	c.mutex.Unlock()
 	if capture := c.capture.Load(); capture != nil {
 		_ = capture.file.Close()
 	}
@@ -248,24 +304,69 @@ func (c *Client) SendConnect() error {
 	})
 }
 
-func (c *Client) SendCreateRoom() error {
-	c.Logger.Info("SendCreateRoom called")
+// SendCreateRoom asks for a room: a random one with an empty roomId,
+// otherwise roomId, reserved for the identity publicKey, with signature
+// proving it (see protocol.TransporterMessagePayloadCreateRoom).
+func (c *Client) SendCreateRoom(roomId string, publicKey []byte, signature []byte) error {
+	c.Logger.Info(fmt.Sprintf("SendCreateRoom(%s) called", roomId))
 	return c.withMessage(func(m *protocol.TransporterMessage) error {
 		m.SetDirectCommand(protocol.CommandCreateRoom)
+		if err := m.SetPayloadCreateRoom(&protocol.TransporterMessagePayloadCreateRoom{
+			RoomId:    roomId,
+			PublicKey: publicKey,
+			Signature: signature,
+		}); err != nil {
+			return err
+		}
+		return c.writeMessage(m)
+	})
+}
+
+// SendPublishRoom lists this client's room in team's room directory,
+// presenting teamToken, with what published describes (see
+// protocol.TransporterMessagePayloadPublishRoom); the team fields of
+// published are ignored.
+func (c *Client) SendPublishRoom(team string, teamToken string, published protocol.TransporterMessagePayloadPublishRoom) error {
+	c.Logger.Info(fmt.Sprintf("SendPublishRoom(%s) called", team))
+	return c.withMessage(func(m *protocol.TransporterMessage) error {
+		m.SetDirectCommand(protocol.CommandPublishRoom)
+		published.Team = team
+		published.TeamToken = teamToken
+		if err := m.SetPayloadPublishRoom(&published); err != nil {
+			return err
+		}
+		return c.writeMessage(m)
+	})
+}
+
+// SendListRooms asks for the rooms listed in team's room directory,
+// presenting teamToken.
+func (c *Client) SendListRooms(team string, teamToken string) error {
+	c.Logger.Info(fmt.Sprintf("SendListRooms(%s) called", team))
+	return c.withMessage(func(m *protocol.TransporterMessage) error {
+		m.SetDirectCommand(protocol.CommandListRooms)
+		if err := m.SetPayloadListRooms(&protocol.TransporterMessagePayloadListRooms{
+			Team:      team,
+			TeamToken: teamToken,
+		}); err != nil {
+			return err
+		}
 		return c.writeMessage(m)
 	})
 }
 
 // SendJoinRoom requests to join roomId, presenting publicKey as this
 // client's identity (see client/identity) so the room owner can verify a
-// fingerprint of it out of band before accepting.
-func (c *Client) SendJoinRoom(roomId string, publicKey []byte) error {
+// fingerprint of it out of band before accepting, with signature proving
+// it (see protocol.TransporterMessagePayloadConnectRoom).
+func (c *Client) SendJoinRoom(roomId string, publicKey []byte, signature []byte) error {
 	c.Logger.Info(fmt.Sprintf("SendJoinRoom(%s) called", roomId))
 	return c.withMessage(func(m *protocol.TransporterMessage) error {
 		m.SetDirectCommand(protocol.CommandJoinRoom)
 		if err := m.SetPayloadConnectRoom(&protocol.TransporterMessagePayloadConnectRoom{
 			RoomId:    roomId,
 			PublicKey: publicKey,
+			Signature: signature,
 		}); err != nil {
 			return err
 		}
@@ -276,15 +377,19 @@ func (c *Client) SendJoinRoom(roomId string, publicKey []byte) error {
 // SendJoinRoomResponse sends the room owner's accept/decline decision,
 // presenting ownerPublicKey as this client's identity (see client/identity)
 // so the guest can display a fingerprint of it, symmetric with the owner
-// verifying the guest's. The transporter fills in the owner's client id
-// before forwarding to the guest.
-func (c *Client) SendJoinRoomResponse(isAccepted int, ownerPublicKey []byte) error {
+// verifying the guest's. devices lists the serials of the devices the room
+// shares, and features each one's comma-separated adb features (empty when
+// unknown). The transporter fills in the owner's client id before
+// forwarding to the guest.
+func (c *Client) SendJoinRoomResponse(isAccepted int, ownerPublicKey []byte, devices []string, features []string) error {
 	c.Logger.Info(fmt.Sprintf("SendJoinRoomResponse(%d) called", isAccepted))
 	return c.withMessage(func(m *protocol.TransporterMessage) error {
 		m.SetResponseCommand(protocol.CommandJoinRoom)
 		if err := m.SetPayloadConnectRoomResult(&protocol.TransporterMessagePayloadConnectRoomResult{
 			Accepted:  isAccepted,
 			PublicKey: ownerPublicKey,
+			Devices:   devices,
+			Features:  features,
 		}); err != nil {
 			return err
 		}
@@ -292,13 +397,96 @@ func (c *Client) SendJoinRoomResponse(isAccepted int, ownerPublicKey []byte) err
 	})
 }
 
-// SendAdbMessage forwards a raw ADB protocol message to the peer on the
-// other side of the room, opaque to everything in between.
-func (c *Client) SendAdbMessage(message *adb.AdbMessage) error {
+// SendAdbMessage forwards a raw ADB protocol message for the room's
+// device'th device to the peer on the other side of the room, opaque to
+// everything in between.
+func (c *Client) SendAdbMessage(device int, message *adb.AdbMessage) error {
 	c.Logger.Info("Sending ADB message to transport")
 	return c.withMessage(func(m *protocol.TransporterMessage) error {
 		m.SetDirectCommand(protocol.CommandAdbTransport)
-		if err := m.SetRawPayload(message.Bytes()); err != nil {
+		if err := m.SetPayloadAdbTransport(&protocol.TransporterMessagePayloadAdbTransport{
+			Device:  device,
+			Message: message.Bytes(),
+		}); err != nil {
+			return err
+		}
+		return c.writeMessage(m)
+	})
+}
+
+// SendDeviceState tells the room's guest that the room's device'th device
+// is now in the adb state state (e.g. "offline", or "device" once it's back).
+func (c *Client) SendDeviceState(device int, state string) error {
+	c.Logger.Info(fmt.Sprintf("SendDeviceState(%d, %s) called", device, state))
+	return c.withMessage(func(m *protocol.TransporterMessage) error {
+		m.SetDirectCommand(protocol.CommandDeviceState)
+		if err := m.SetPayloadDeviceState(&protocol.TransporterMessagePayloadDeviceState{
+			Device: device,
+			State:  state,
+		}); err != nil {
+			return err
+		}
+		return c.writeMessage(m)
+	})
+}
+
+// SendSessionLease tells the room's guest about its session lease: state is
+// one of the protocol's lease states, and remaining what an active lease
+// has left, rounded up to the second.
+func (c *Client) SendSessionLease(state int, remaining time.Duration) error {
+	c.Logger.Info(fmt.Sprintf("SendSessionLease(%d, %s) called", state, remaining))
+	return c.withMessage(func(m *protocol.TransporterMessage) error {
+		m.SetDirectCommand(protocol.CommandSessionLease)
+		if err := m.SetPayloadSessionLease(&protocol.TransporterMessagePayloadSessionLease{
+			State:            state,
+			RemainingSeconds: int((remaining + time.Second - 1) / time.Second),
+		}); err != nil {
+			return err
+		}
+		return c.writeMessage(m)
+	})
+}
+
+// SendKickGuest removes the room's guest, telling it reason.
+func (c *Client) SendKickGuest(reason string) error {
+	c.Logger.Info("SendKickGuest called")
+	return c.withMessage(func(m *protocol.TransporterMessage) error {
+		m.SetDirectCommand(protocol.CommandKickGuest)
+		if err := m.SetPayloadKickGuest(&protocol.TransporterMessagePayloadKickGuest{Reason: reason}); err != nil {
+			return err
+		}
+		return c.writeMessage(m)
+	})
+}
+
+// SendChatMessage sends a signed chat message to the other participant in
+// the room.
+func (c *Client) SendChatMessage(message *protocol.TransporterMessagePayloadChatMessage) error {
+	c.Logger.Info("SendChatMessage called")
+	return c.withMessage(func(m *protocol.TransporterMessage) error {
+		m.SetDirectCommand(protocol.CommandChatMessage)
+		if err := m.SetPayloadChatMessage(message); err != nil {
+			return err
+		}
+		return c.writeMessage(m)
+	})
+}
+
+// SendDeviceInfo tells the room's guest what the room's device'th device
+// is, for its proxy to present it as such.
+func (c *Client) SendDeviceInfo(device int, info adb.DeviceInfo) error {
+	c.Logger.Info(fmt.Sprintf("SendDeviceInfo(%d) called", device))
+	return c.withMessage(func(m *protocol.TransporterMessage) error {
+		m.SetDirectCommand(protocol.CommandDeviceInfo)
+		if err := m.SetPayloadDeviceInfo(&protocol.TransporterMessagePayloadDeviceInfo{
+			Device:         device,
+			Product:        info.Product,
+			Model:          info.Model,
+			DeviceName:     info.Device,
+			Manufacturer:   info.Manufacturer,
+			AndroidVersion: info.AndroidVersion,
+			Abi:            info.Abi,
+		}); err != nil {
 			return err
 		}
 		return c.writeMessage(m)
@@ -87,7 +87,7 @@ func TestSendJoinRoomWritesExpectedMessage(t *testing.T) {
 	client, server := newConnectedTestClient(t)
 
 	publicKey := []byte{0x01, 0x02, 0x03}
-	if err := client.SendJoinRoom("ROOM7", publicKey); err != nil {
+	if err := client.SendJoinRoom("ROOM7", publicKey, []byte{0x04}); err != nil {
 		t.Fatalf("SendJoinRoom failed: %s", err)
 	}
 
@@ -105,8 +105,8 @@ func TestSendJoinRoomWritesExpectedMessage(t *testing.T) {
 	if payload.RoomId != "ROOM7" {
 		t.Fatalf("expected room id %q, got %q", "ROOM7", payload.RoomId)
 	}
-	if !bytes.Equal(payload.PublicKey, publicKey) {
-		t.Fatalf("expected public key %x, got %x", publicKey, payload.PublicKey)
+	if !bytes.Equal(payload.PublicKey, publicKey) || !bytes.Equal(payload.Signature, []byte{0x04}) {
+		t.Fatalf("expected public key %x and signature 04, got %+v", publicKey, payload)
 	}
 }
 
@@ -117,7 +117,7 @@ func TestSendAdbMessageEmbedsRawAdbBytes(t *testing.T) {
 	if err := adbMessage.Set(adb.CommandOpen, 1, 0, []byte("shell:")); err != nil {
 		t.Fatalf("adb Set failed: %s", err)
 	}
-	if err := client.SendAdbMessage(adbMessage); err != nil {
+	if err := client.SendAdbMessage(0, adbMessage); err != nil {
 		t.Fatalf("SendAdbMessage failed: %s", err)
 	}
 
@@ -128,7 +128,14 @@ func TestSendAdbMessageEmbedsRawAdbBytes(t *testing.T) {
 	if received.Command() != protocol.CommandAdbTransport {
 		t.Fatalf("expected command %x, got %x", protocol.CommandAdbTransport, received.Command())
 	}
-	decoded, err := adb.DecodeMessage(received.Payload())
+	payload, err := received.GetPayloadAdbTransport()
+	if err != nil {
+		t.Fatalf("GetPayloadAdbTransport failed: %s", err)
+	}
+	if payload.Device != 0 {
+		t.Fatalf("expected device 0, got %d", payload.Device)
+	}
+	decoded, err := adb.DecodeMessage(payload.Message)
 	if err != nil {
 		t.Fatalf("DecodeMessage failed: %s", err)
 	}
@@ -140,6 +147,76 @@ func TestSendAdbMessageEmbedsRawAdbBytes(t *testing.T) {
 	}
 }
 
+func TestSendDeviceStateWritesExpectedMessage(t *testing.T) {
+	client, server := newConnectedTestClient(t)
+
+	if err := client.SendDeviceState(1, "offline"); err != nil {
+		t.Fatalf("SendDeviceState failed: %s", err)
+	}
+
+	received := protocol.CreateTransporterMessage()
+	if err := received.Read(server); err != nil {
+		t.Fatalf("failed to read the message on the server side: %s", err)
+	}
+	if received.Command() != protocol.CommandDeviceState {
+		t.Fatalf("expected command %x, got %x", protocol.CommandDeviceState, received.Command())
+	}
+	payload, err := received.GetPayloadDeviceState()
+	if err != nil {
+		t.Fatalf("GetPayloadDeviceState failed: %s", err)
+	}
+	if payload.Device != 1 || payload.State != "offline" {
+		t.Fatalf("unexpected payload: %+v", payload)
+	}
+}
+
+func TestSendSessionLeaseRoundsUpToTheSecond(t *testing.T) {
+	client, server := newConnectedTestClient(t)
+
+	if err := client.SendSessionLease(protocol.LeaseActive, 1500*time.Millisecond); err != nil {
+		t.Fatalf("SendSessionLease failed: %s", err)
+	}
+
+	received := protocol.CreateTransporterMessage()
+	if err := received.Read(server); err != nil {
+		t.Fatalf("failed to read the message on the server side: %s", err)
+	}
+	if received.Command() != protocol.CommandSessionLease {
+		t.Fatalf("expected command %x, got %x", protocol.CommandSessionLease, received.Command())
+	}
+	payload, err := received.GetPayloadSessionLease()
+	if err != nil {
+		t.Fatalf("GetPayloadSessionLease failed: %s", err)
+	}
+	if payload.State != protocol.LeaseActive || payload.RemainingSeconds != 2 {
+		t.Fatalf("unexpected payload: %+v", payload)
+	}
+}
+
+func TestSendDeviceInfoWritesExpectedMessage(t *testing.T) {
+	client, server := newConnectedTestClient(t)
+
+	info := adb.DeviceInfo{Product: "panther", Model: "Pixel_7", Device: "panther", Manufacturer: "Google", AndroidVersion: "14", Abi: "arm64-v8a"}
+	if err := client.SendDeviceInfo(2, info); err != nil {
+		t.Fatalf("SendDeviceInfo failed: %s", err)
+	}
+
+	received := protocol.CreateTransporterMessage()
+	if err := received.Read(server); err != nil {
+		t.Fatalf("failed to read the message on the server side: %s", err)
+	}
+	if received.Command() != protocol.CommandDeviceInfo {
+		t.Fatalf("expected command %x, got %x", protocol.CommandDeviceInfo, received.Command())
+	}
+	payload, err := received.GetPayloadDeviceInfo()
+	if err != nil {
+		t.Fatalf("GetPayloadDeviceInfo failed: %s", err)
+	}
+	if payload.Device != 2 || payload.DeviceName != "panther" || payload.Manufacturer != "Google" || payload.Abi != "arm64-v8a" {
+		t.Fatalf("unexpected payload: %+v", payload)
+	}
+}
+
 func TestMessagesChannelDeliversIncomingMessages(t *testing.T) {
 	client, server := newConnectedTestClient(t)
 
@@ -187,7 +264,7 @@ func TestBytesSentAndReceivedTrackWireTraffic(t *testing.T) {
 		t.Fatalf("expected zero counters on a fresh client, got sent=%d received=%d", client.BytesSent(), client.BytesReceived())
 	}
 
-	if err := client.SendJoinRoom("ROOM7", []byte{1, 2, 3}); err != nil {
+	if err := client.SendJoinRoom("ROOM7", []byte{1, 2, 3}, nil); err != nil {
 		t.Fatalf("SendJoinRoom failed: %s", err)
 	}
 	sent := readMessage(t, server)
@@ -297,6 +374,88 @@ func TestMessagesChannelClosesOnClientClose(t *testing.T) {
 	}
 }
 
+// TestReconnectDeliversTheNewConnectionsMessages verifies that after the
+// connection is lost and Reconnect dials again, Messages() yields what the
+// new connection receives and sends go out on it.
+func TestReconnectDeliversTheNewConnectionsMessages(t *testing.T) {
+	listener := testtls.Listen(t)
+	connections := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := testtls.Accept(listener)
+			if err != nil {
+				return
+			}
+			connections <- conn
+		}
+	}()
+	client, err := CreateClient(newTestLogger(), &config.ClientConfiguration{TransporterAddress: listener.Addr().String()})
+	if err != nil {
+		t.Fatalf("CreateClient failed: %s", err)
+	}
+	if err := client.Start(); err != nil {
+		t.Fatalf("Start failed: %s", err)
+	}
+	t.Cleanup(client.Close)
+	accept := func() net.Conn {
+		select {
+		case conn := <-connections:
+			t.Cleanup(func() { _ = conn.Close() })
+			return conn
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for the client to connect")
+			return nil
+		}
+	}
+
+	first := accept()
+	lost := client.Messages()
+	_ = first.Close()
+	select {
+	case _, ok := <-lost:
+		if ok {
+			t.Fatalf("expected the lost connection's channel to be closed, got a value instead")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for the channel to close after the server disconnected")
+	}
+
+	if err := client.Reconnect(); err != nil {
+		t.Fatalf("Reconnect failed: %s", err)
+	}
+	second := accept()
+
+	if err := client.SendConnect(); err != nil {
+		t.Fatalf("SendConnect failed: %s", err)
+	}
+	_ = second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	request := protocol.CreateTransporterMessage()
+	if err := request.Read(second); err != nil {
+		t.Fatalf("failed to read from the new connection: %s", err)
+	}
+	if request.Command() != protocol.CommandConnect {
+		t.Fatalf("expected command %x, got %x", protocol.CommandConnect, request.Command())
+	}
+
+	response := protocol.CreateTransporterMessage()
+	response.SetResponseCommand(protocol.CommandCreateRoom)
+	if err := response.SetPayloadCreateRoomResponse(&protocol.TransporterMessagePayloadCreateRoomResponse{RoomId: "ROOM9"}); err != nil {
+		t.Fatalf("SetPayloadCreateRoomResponse failed: %s", err)
+	}
+	if err := response.Write(second); err != nil {
+		t.Fatalf("failed to write from the server: %s", err)
+	}
+	select {
+	case container, ok := <-client.Messages():
+		if !ok {
+			t.Fatalf("expected a message on the new connection's channel, got it closed")
+		}
+		_ = container.Dispose()
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for the new connection's message")
+	}
+}
+
 // TestConcurrentSendAdbMessageDoesNotInterleaveWrites exercises the
 // scenario the owner-side stream multiplexer relies on: many goroutines
 // (one per open ADB stream) calling SendAdbMessage concurrently must not
@@ -316,7 +475,7 @@ func TestConcurrentSendAdbMessageDoesNotInterleaveWrites(t *testing.T) {
 				t.Errorf("Set failed: %s", err)
 				return
 			}
-			if err := client.SendAdbMessage(adbMessage); err != nil {
+			if err := client.SendAdbMessage(0, adbMessage); err != nil {
 				t.Errorf("SendAdbMessage failed: %s", err)
 			}
 		}(i)
@@ -329,7 +488,11 @@ func TestConcurrentSendAdbMessageDoesNotInterleaveWrites(t *testing.T) {
 		if received.Command() != protocol.CommandAdbTransport {
 			t.Fatalf("expected command %x, got %x", protocol.CommandAdbTransport, received.Command())
 		}
-		decoded, err := adb.DecodeMessage(received.Payload())
+		payload, err := received.GetPayloadAdbTransport()
+		if err != nil {
+			t.Fatalf("message #%d: GetPayloadAdbTransport failed: %s", i, err)
+		}
+		decoded, err := adb.DecodeMessage(payload.Message)
 		if err != nil {
 			t.Fatalf("message #%d: DecodeMessage failed (interleaved/corrupted write?): %s", i, err)
 		}
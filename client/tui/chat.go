@@ -0,0 +1,150 @@
+package tui
+
+import (
+	"adb-remote.maci.team/client/controller"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// chatPaneHeight is how many chat lines a TUI shows at once, and
+// chatHistoryLimit how many it keeps to scroll back through.
+const (
+	chatPaneHeight   = 6
+	chatHistoryLimit = 200
+)
+
+// chatInputLimit bounds the runes typed into a chat message, so that it
+// fits protocol.MaxChatMessageLength bytes whatever they are.
+const chatInputLimit = 256
+
+// chatSentMsg reports that the operator's chat message went out.
+type chatSentMsg struct {
+	text   string
+	sentAt time.Time
+}
+
+// chatErrorMsg reports that a chat message couldn't be sent.
+type chatErrorMsg struct{ err error }
+
+// chatPane is a TUI's chat with the other participant in the room: the
+// messages exchanged so far, scrolled back by scroll lines, and the line
+// the operator types the next one into while typing is set.
+type chatPane struct {
+	chat   *controller.Chat
+	lines  []string
+	scroll int
+	typing bool
+	input  lineInput
+}
+
+func newChatPane() chatPane {
+	return chatPane{chat: controller.NewChat(), input: lineInput{limit: chatInputLimit}}
+}
+
+// add appends a message from from (or a note, if from is empty) to the
+// pane. Control characters the other participant may have sent, such as
+// terminal escape sequences, are blanked out.
+func (p *chatPane) add(from string, text string, at time.Time) {
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, text)
+	line := fmt.Sprintf("%s %s", at.Format("15:04"), text)
+	if from != "" {
+		line = fmt.Sprintf("%s %s: %s", at.Format("15:04"), from, text)
+	}
+	p.lines = append(p.lines, line)
+	if len(p.lines) > chatHistoryLimit {
+		p.lines = p.lines[len(p.lines)-chatHistoryLimit:]
+	}
+	if p.scroll > 0 {
+		// Keep showing what the operator scrolled back to.
+		p.scroll = min(p.scroll+1, p.maxScroll())
+	}
+}
+
+func (p *chatPane) maxScroll() int {
+	return max(len(p.lines)-chatPaneHeight, 0)
+}
+
+// handleKey handles key if it's the pane's to handle, which every key but
+// ctrl+c is while typing: enter sends the line, esc stops typing. Page
+// up/down scroll the pane either way.
+func (p *chatPane) handleKey(key tea.KeyMsg) (tea.Cmd, bool) {
+	switch key.Type {
+	case tea.KeyPgUp:
+		p.scroll = min(p.scroll+chatPaneHeight, p.maxScroll())
+		return nil, true
+	case tea.KeyPgDown:
+		p.scroll = max(p.scroll-chatPaneHeight, 0)
+		return nil, true
+	}
+	if !p.typing || key.Type == tea.KeyCtrlC {
+		return nil, false
+	}
+	switch key.Type {
+	case tea.KeyEnter:
+		text := p.input.String()
+		p.input.reset()
+		p.scroll = 0
+		if strings.TrimSpace(text) == "" {
+			return nil, true
+		}
+		return sendChat(p.chat, text), true
+	case tea.KeyEsc:
+		p.typing = false
+		p.input.reset()
+	default:
+		p.input.update(key)
+	}
+	return nil, true
+}
+
+// stop stops typing, once there's nobody left to chat with.
+func (p *chatPane) stop() {
+	p.typing = false
+	p.input.reset()
+}
+
+// view renders the pane, or nothing before the first message unless the
+// operator is typing one.
+func (p *chatPane) view() string {
+	if len(p.lines) == 0 && !p.typing {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(labelStyle.Render("Chat:") + "\n")
+	end := len(p.lines) - p.scroll
+	start := max(end-chatPaneHeight, 0)
+	if start > 0 {
+		b.WriteString(dimStyle.Render(fmt.Sprintf("  (%d earlier, pgup to scroll back)", start)) + "\n")
+	}
+	for _, line := range p.lines[start:end] {
+		b.WriteString("  " + line + "\n")
+	}
+	if p.scroll > 0 {
+		b.WriteString(dimStyle.Render(fmt.Sprintf("  (%d later, pgdown to scroll on)", p.scroll)) + "\n")
+	}
+	if p.typing {
+		b.WriteString(promptStyle.Render("> ") + p.input.view() + "\n")
+		b.WriteString(dimStyle.Render("  enter to send, esc to stop typing") + "\n")
+	}
+	return b.String()
+}
+
+// sendChat sends text off the UI goroutine, which mustn't wait on the
+// transporter connection.
+func sendChat(chat *controller.Chat, text string) tea.Cmd {
+	return func() tea.Msg {
+		if err := chat.Send(text); err != nil {
+			return chatErrorMsg{err}
+		}
+		return chatSentMsg{text: text, sentAt: time.Now()}
+	}
+}
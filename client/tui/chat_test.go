@@ -0,0 +1,67 @@
+package tui
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func TestChatPaneScrollsBack(t *testing.T) {
+	p := newChatPane()
+	at := time.Date(2026, 10, 19, 9, 30, 0, 0, time.Local)
+	for i := 1; i <= 10; i++ {
+		p.add("GUEST1", fmt.Sprintf("message %d", i), at)
+	}
+	view := p.view()
+	if strings.Contains(view, "message 4\n") || !strings.Contains(view, "09:30 GUEST1: message 10") || !strings.Contains(view, "4 earlier") {
+		t.Fatalf("expected the last %d messages, got:\n%s", chatPaneHeight, view)
+	}
+
+	if _, handled := p.handleKey(tea.KeyMsg{Type: tea.KeyPgUp}); !handled {
+		t.Fatalf("expected page up to scroll the pane")
+	}
+	p.add("GUEST1", "message 11", at)
+	view = p.view()
+	if !strings.Contains(view, "message 1\n") || strings.Contains(view, "message 7") || !strings.Contains(view, "5 later") {
+		t.Fatalf("expected the pane to stay scrolled back, got:\n%s", view)
+	}
+	p.handleKey(tea.KeyMsg{Type: tea.KeyPgDown})
+	p.handleKey(tea.KeyMsg{Type: tea.KeyPgDown})
+	if view := p.view(); !strings.Contains(view, "message 11") {
+		t.Fatalf("expected page down to get back to the latest messages, got:\n%s", view)
+	}
+}
+
+func TestChatPaneBlanksControlCharacters(t *testing.T) {
+	p := newChatPane()
+	p.add("GUEST1", "hi\x1b[2Jthere\nyou", time.Now())
+	if line := p.lines[0]; strings.ContainsAny(line, "\x1b\n") || !strings.Contains(line, "hi [2Jthere you") {
+		t.Fatalf("expected control characters to be blanked out, got %q", line)
+	}
+}
+
+func TestChatPaneSendsTypedLines(t *testing.T) {
+	p := newChatPane()
+	if _, handled := p.handleKey(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("q")}); handled {
+		t.Fatalf("expected keys to be left to the TUI while not typing")
+	}
+	p.typing = true
+	if cmd, _ := p.handleKey(tea.KeyMsg{Type: tea.KeyEnter}); cmd != nil {
+		t.Fatalf("expected an empty line not to be sent")
+	}
+	p.handleKey(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("q")})
+	cmd, handled := p.handleKey(tea.KeyMsg{Type: tea.KeyEnter})
+	if !handled || cmd == nil || !p.typing || p.input.String() != "" {
+		t.Fatalf("expected enter to send the line and keep typing")
+	}
+	if _, handled := p.handleKey(tea.KeyMsg{Type: tea.KeyCtrlC}); handled {
+		t.Fatalf("expected ctrl+c to be left to the TUI while typing")
+	}
+	p.handleKey(tea.KeyMsg{Type: tea.KeyEsc})
+	if p.typing {
+		t.Fatalf("expected esc to stop typing")
+	}
+}
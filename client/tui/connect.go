@@ -2,6 +2,7 @@ package tui
 
 import (
 	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/control"
 	"adb-remote.maci.team/client/controller"
 	"adb-remote.maci.team/client/identity"
 	"adb-remote.maci.team/client/relay"
@@ -24,53 +25,110 @@ const (
 	connectStageProxyStarting
 	connectStageReady
 	connectStageRelaying
+	connectStageReconnecting
 	connectStageDisconnected
+	connectStageLeaseEnded
+	connectStageKicked
 	connectStageError
 )
 
 // connectModel drives the `connect` command's TUI: report the assigned
 // client id and the connection state as the guest joins the room, starts
-// the local proxy, and relays traffic.
+// a local proxy per shared device, and relays traffic.
 type connectModel struct {
 	roomId      string
-	localPort   string
 	fingerprint string
 
 	stage    connectStage
 	clientId string
 	err      error
+	// queuePosition is where the join request is in the room's join queue
+	// while another guest is in the room, 0 otherwise.
+	queuePosition int
 
 	// ownerClientId/ownerFingerprint identify the room owner once the join
 	// request is accepted, since a room holds exactly one owner.
 	ownerClientId    string
 	ownerFingerprint string
 
-	adbConnected  bool
-	adbConnectErr error
+	// proxies lists the room's devices in the order their proxies
+	// started.
+	proxies []*proxyStatus
 
 	relayCount   int
+	activeRelays int
 	lastRelayErr error
 
+	// reconnectAttempt and reconnectErr follow the attempts at getting
+	// back into the room after the transporter connection was lost
+	// (reconnectErr being why the previous one failed), and reconnects
+	// counts the times it did. lostErr is why it was given up on.
+	reconnectAttempt int
+	reconnectErr     error
+	reconnects       int
+	lostErr          error
+
+	// leaseExpiresAt is when the session lease the owner granted runs out
+	// (zero without a time limit), and leaseEnded why it ended, once it
+	// has.
+	leaseExpiresAt time.Time
+	leaseEnded     error
+	// kickReason is the reason the owner gave for removing the guest from
+	// the room, once it did.
+	kickReason string
+	// chat is the chat with the room owner.
+	chat chatPane
+
+	// keyRequests are local adb servers waiting for the operator to allow
+	// their key, oldest first.
+	keyRequests []adbKeyRequestMsg
+
 	statsSource   transferStatsSource
 	stats         transferStats
 	width, height int
 }
 
+// proxyStatus is what the connect TUI shows about one shared device's
+// local proxy.
+type proxyStatus struct {
+	device string
+	port   string
+	// address is where the proxy listens: host:port, or "unix:<path>".
+	address string
+	// description is what the owner says the device is, if anything.
+	description   string
+	adbConnected  bool
+	adbConnectErr error
+	// offlineState is the device's adb state on the owner's side while it
+	// is unusable, empty while online.
+	offlineState string
+}
+
 // RunConnect runs the interactive connect TUI to completion. It does not
 // return until the background guest flow (including its "adb disconnect"
 // cleanup) has fully stopped, so callers can rely on cleanup having
-// happened by the time this returns.
-func RunConnect(ctx context.Context, client *transportLayer.Client, smartSocket adb.IAdbSmartSocket, guestIdentity *identity.Identity, roomId string, localPort string) error {
+// happened by the time this returns. options is passed through to
+// controller.JoinAsGuest, with local adb servers whose key isn't in
+// options.AdbKeys prompting the operator to allow it, and with the TUI's
+// Chat for the operator to chat with the room owner. session, if non-nil,
+// is told about the room (see client/control). Cancelling ctx leaves the
+// room and closes the TUI.
+func RunConnect(ctx context.Context, client *transportLayer.Client, smartSocket adb.IAdbSmartSocket, guestIdentity *identity.Identity, roomId string, localPort string, options controller.GuestOptions, session *control.GuestSession) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	m := &connectModel{roomId: roomId, localPort: localPort, fingerprint: guestIdentity.Fingerprint(), stage: connectStageConnecting, statsSource: client}
+	m := &connectModel{roomId: roomId, fingerprint: guestIdentity.Fingerprint(), stage: connectStageConnecting, chat: newChatPane(), statsSource: client}
 	program := tea.NewProgram(m, tea.WithAltScreen())
+	options.Chat = m.chat.chat
 
 	guestFlowDone := make(chan struct{})
 	go func() {
 		defer close(guestFlowDone)
-		runGuestFlow(ctx, program, client, smartSocket, guestIdentity, roomId, localPort)
+		runGuestFlow(ctx, program, client, smartSocket, guestIdentity, roomId, localPort, options, session)
+	}()
+	go func() {
+		<-ctx.Done()
+		program.Quit()
 	}()
 
 	_, err := program.Run()
@@ -83,7 +141,7 @@ func RunConnect(ctx context.Context, client *transportLayer.Client, smartSocket
 	return m.err
 }
 
-func runGuestFlow(ctx context.Context, program *tea.Program, client *transportLayer.Client, smartSocket adb.IAdbSmartSocket, guestIdentity *identity.Identity, roomId string, localPort string) {
+func runGuestFlow(ctx context.Context, program *tea.Program, client *transportLayer.Client, smartSocket adb.IAdbSmartSocket, guestIdentity *identity.Identity, roomId string, localPort string, options controller.GuestOptions, session *control.GuestSession) {
 	clientId, err := controller.Handshake(client)
 	if err != nil {
 		program.Send(connectErrorMsg{err})
@@ -93,10 +151,22 @@ func runGuestFlow(ctx context.Context, program *tea.Program, client *transportLa
 	program.Send(joiningRoomMsg{})
 
 	onEvent := func(e controller.GuestEvent) {
+		session.GuestEvent(e)
 		program.Send(guestEventMsg(e))
 	}
 
-	err = controller.JoinAsGuest(ctx, client, smartSocket, guestIdentity, roomId, localPort, onEvent)
+	options.ApproveAdbKey = func(ctx context.Context, key *adb.PublicKey) (bool, bool) {
+		respond := make(chan adbKeyDecision, 1)
+		program.Send(adbKeyRequestMsg{fingerprint: key.Fingerprint(), comment: key.Comment, respond: respond})
+		select {
+		case decision := <-respond:
+			return decision.approved, decision.remember
+		case <-ctx.Done():
+			return false, false
+		}
+	}
+
+	err = controller.JoinAsGuest(ctx, client, smartSocket, guestIdentity, roomId, localPort, onEvent, options)
 	if err == nil || ctx.Err() != nil {
 		return
 	}
@@ -109,6 +179,16 @@ func runGuestFlow(ctx context.Context, program *tea.Program, client *transportLa
 		// Already reflected via a GuestTransportLost event.
 		return
 	}
+	var leaseEnded *controller.ErrLeaseEnded
+	if errors.As(err, &leaseEnded) {
+		// Already reflected via a GuestLeaseEnded event.
+		return
+	}
+	var kicked *controller.ErrKicked
+	if errors.As(err, &kicked) {
+		// Already reflected via a GuestKicked event.
+		return
+	}
 	program.Send(connectErrorMsg{err})
 }
 
@@ -118,6 +198,19 @@ type joiningRoomMsg struct{}
 type guestEventMsg controller.GuestEvent
 type connectErrorMsg struct{ err error }
 
+// adbKeyRequestMsg asks the operator whether a local adb server with an
+// unknown key may connect.
+type adbKeyRequestMsg struct {
+	fingerprint string
+	comment     string
+	respond     chan<- adbKeyDecision
+}
+
+type adbKeyDecision struct {
+	approved bool
+	remember bool
+}
+
 // --- bubbletea.Model ---
 
 func (m *connectModel) Init() tea.Cmd {
@@ -129,9 +222,23 @@ func (m *connectModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case tea.WindowSizeMsg:
 		m.width, m.height = msg.Width, msg.Height
 	case tea.KeyMsg:
+		if cmd, handled := m.chat.handleKey(msg); handled {
+			return m, cmd
+		}
 		if msg.String() == "ctrl+c" || msg.String() == "q" {
 			return m, tea.Quit
 		}
+		if len(m.keyRequests) > 0 {
+			m.answerKeyRequest(msg.String())
+		} else if msg.String() == "c" {
+			m.chat.typing = m.chatting()
+		}
+	case chatSentMsg:
+		m.chat.add("you", msg.text, msg.sentAt)
+	case chatErrorMsg:
+		m.chat.add("", fmt.Sprintf("(not sent: %s)", msg.err), time.Now())
+	case adbKeyRequestMsg:
+		m.keyRequests = append(m.keyRequests, msg)
 	case clientIdMsg:
 		m.clientId = string(msg)
 	case joiningRoomMsg:
@@ -141,15 +248,46 @@ func (m *connectModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case connectErrorMsg:
 		m.err = msg.err
 		m.stage = connectStageError
+		m.chat.stop()
 	case transferTickMsg:
 		return m, m.stats.sample(m.statsSource, time.Time(msg))
 	}
 	return m, nil
 }
 
+// chatting reports whether the room owner is there to chat with.
+func (m *connectModel) chatting() bool {
+	switch m.stage {
+	case connectStageProxyStarting, connectStageReady, connectStageRelaying, connectStageReconnecting:
+		return true
+	default:
+		return false
+	}
+}
+
+// answerKeyRequest answers the oldest pending key request, if key is one
+// of its choices.
+func (m *connectModel) answerKeyRequest(key string) {
+	var decision adbKeyDecision
+	switch key {
+	case "y":
+		decision = adbKeyDecision{approved: true}
+	case "a":
+		decision = adbKeyDecision{approved: true, remember: true}
+	case "n":
+	default:
+		return
+	}
+	m.keyRequests[0].respond <- decision
+	m.keyRequests = m.keyRequests[1:]
+}
+
 func (m *connectModel) handleGuestEvent(e controller.GuestEvent) {
 	switch e.Kind {
+	case controller.GuestQueued:
+		m.queuePosition = e.QueuePosition
 	case controller.GuestJoinDecided:
+		m.queuePosition = 0
 		if e.Accepted {
 			m.stage = connectStageProxyStarting
 			m.ownerClientId = e.OwnerClientId
@@ -159,24 +297,80 @@ func (m *connectModel) handleGuestEvent(e controller.GuestEvent) {
 		}
 	case controller.GuestProxyReady:
 		m.stage = connectStageReady
-		m.localPort = e.LocalPort
+		proxy := m.proxy(e.Device)
+		proxy.port = e.LocalPort
+		proxy.address = e.LocalAddress
+		if proxy.address == "" {
+			proxy.address = "127.0.0.1:" + e.LocalPort
+		}
 	case controller.GuestAdbConnected:
-		m.adbConnected = true
-		m.adbConnectErr = nil
+		proxy := m.proxy(e.Device)
+		proxy.adbConnected = true
+		proxy.adbConnectErr = nil
 	case controller.GuestAdbConnectFailed:
-		m.adbConnected = false
-		m.adbConnectErr = e.Err
+		proxy := m.proxy(e.Device)
+		proxy.adbConnected = false
+		proxy.adbConnectErr = e.Err
 	case controller.GuestLocalAdbConnected:
 		m.stage = connectStageRelaying
 		m.relayCount++
+		m.activeRelays++
 	case controller.GuestRelayStopped:
 		m.lastRelayErr = e.Err
+		if m.activeRelays > 0 {
+			m.activeRelays--
+		}
+		if m.activeRelays == 0 {
+			m.stage = connectStageReady
+		}
+	case controller.GuestDeviceInfo:
+		m.proxy(e.Device).description = e.DeviceInfo.Describe()
+	case controller.GuestDeviceOffline:
+		m.proxy(e.Device).offlineState = e.DeviceState
+	case controller.GuestDeviceOnline:
+		m.proxy(e.Device).offlineState = ""
+	case controller.GuestReconnecting:
+		m.stage = connectStageReconnecting
+		m.reconnectAttempt = e.Attempt
+		m.reconnectErr = e.Err
+	case controller.GuestReconnected:
 		m.stage = connectStageReady
+		m.clientId = e.ClientId
+		m.reconnects++
+		m.reconnectErr = nil
 	case controller.GuestTransportLost:
 		m.stage = connectStageDisconnected
+		m.lostErr = e.Err
+	case controller.GuestLeaseChanged, controller.GuestLeaseExpiring:
+		m.leaseExpiresAt = e.LeaseExpiresAt
+	case controller.GuestLeaseEnded:
+		m.stage = connectStageLeaseEnded
+		m.leaseExpiresAt = time.Time{}
+		m.leaseEnded = e.Err
+	case controller.GuestKicked:
+		m.stage = connectStageKicked
+		m.leaseExpiresAt = time.Time{}
+		m.kickReason = e.Reason
+	case controller.GuestChatMessage:
+		m.chat.add(e.OwnerClientId, e.Text, e.SentAt)
+	}
+	if !m.chatting() {
+		m.chat.stop()
 	}
 }
 
+// proxy returns device's proxy status, adding it if it is new.
+func (m *connectModel) proxy(device string) *proxyStatus {
+	for _, proxy := range m.proxies {
+		if proxy.device == device {
+			return proxy
+		}
+	}
+	proxy := &proxyStatus{device: device}
+	m.proxies = append(m.proxies, proxy)
+	return proxy
+}
+
 func (m *connectModel) View() string {
 	var b strings.Builder
 	b.WriteString(titleStyle.Render("adb-remote — connect") + "\n")
@@ -191,42 +385,106 @@ func (m *connectModel) View() string {
 		b.WriteString(labelStyle.Render("Room owner: ") + successStyle.Render(m.ownerClientId) + "\n")
 		b.WriteString(labelStyle.Render("  Owner fingerprint: ") + m.ownerFingerprint + "\n\n")
 	}
-	b.WriteString(labelStyle.Render("Connection state: ") + m.stateLine() + "\n\n")
+	b.WriteString(labelStyle.Render("Connection state: ") + m.stateLine() + "\n")
+	if !m.leaseExpiresAt.IsZero() {
+		b.WriteString(m.leaseLine(time.Until(m.leaseExpiresAt)) + "\n")
+	}
+	b.WriteString("\n")
+
+	if len(m.keyRequests) > 0 {
+		request := m.keyRequests[0]
+		b.WriteString(promptStyle.Render("A local adb server wants to use the shared devices — allow? [y]es / [a]lways / [n]o") + "\n")
+		b.WriteString(labelStyle.Render("  Its adb key fingerprint: ") + request.fingerprint + "\n")
+		if request.comment != "" {
+			b.WriteString(labelStyle.Render("  Key comment: ") + request.comment + "\n")
+		}
+		b.WriteString("\n")
+	}
 
 	switch m.stage {
-	case connectStageReady, connectStageRelaying:
-		b.WriteString(fmt.Sprintf("Local proxy: 127.0.0.1:%s\n", m.localPort))
-		if m.adbConnected {
-			b.WriteString(successStyle.Render("adb connect issued automatically") + "\n\n")
-		} else if m.adbConnectErr != nil {
-			b.WriteString(errorStyle.Render(fmt.Sprintf("Automatic \"adb connect\" failed: %s", m.adbConnectErr)) + "\n")
-			b.WriteString(dimStyle.Render(fmt.Sprintf("Run it yourself: adb connect 127.0.0.1:%s", m.localPort)) + "\n\n")
-		} else {
+	case connectStageReady, connectStageRelaying, connectStageReconnecting:
+		if m.stage == connectStageReconnecting {
+			b.WriteString(errorStyle.Render("The transporter connection was lost; getting back into the room. adb lists the devices as offline meanwhile.") + "\n")
+			if m.reconnectErr != nil {
+				b.WriteString(dimStyle.Render(fmt.Sprintf("  Last attempt failed: %s", m.reconnectErr)) + "\n")
+			}
 			b.WriteString("\n")
 		}
+		for _, proxy := range m.proxies {
+			b.WriteString(fmt.Sprintf("Local proxy for %s: %s\n", proxy.device, proxy.address))
+			if proxy.description != "" {
+				b.WriteString(dimStyle.Render("  "+proxy.description) + "\n")
+			}
+			if proxy.offlineState != "" {
+				b.WriteString(errorStyle.Render(fmt.Sprintf("  Device is %s on the owner's side; adb lists it as offline until it's back", proxy.offlineState)) + "\n")
+			}
+			if proxy.adbConnected {
+				b.WriteString(successStyle.Render("  adb connect issued automatically") + "\n")
+			} else if proxy.adbConnectErr != nil {
+				b.WriteString(errorStyle.Render(fmt.Sprintf("  Automatic \"adb connect\" failed: %s", proxy.adbConnectErr)) + "\n")
+				b.WriteString(dimStyle.Render(fmt.Sprintf("  Run it yourself: adb connect %s", proxy.address)) + "\n")
+			}
+		}
+		b.WriteString("\n")
 		if m.relayCount > 0 {
 			b.WriteString(dimStyle.Render(fmt.Sprintf("(%d local adb connection(s) relayed so far)", m.relayCount)) + "\n\n")
 		}
+		if m.reconnects > 0 {
+			b.WriteString(dimStyle.Render(fmt.Sprintf("(reconnected to the room %d time(s))", m.reconnects)) + "\n\n")
+		}
 		if m.lastRelayErr != nil {
 			b.WriteString(dimStyle.Render(fmt.Sprintf("Last relay ended: %s", m.lastRelayErr)) + "\n\n")
 		}
 	case connectStageDenied:
 		b.WriteString(errorStyle.Render("The room owner declined the join request.") + "\n\n")
 	case connectStageDisconnected:
-		b.WriteString(errorStyle.Render("Disconnected: the room owner left, or the transporter connection was lost.") + "\n\n")
+		b.WriteString(errorStyle.Render("Disconnected: the room owner left, or the transporter connection was lost.") + "\n")
+		if m.lostErr != nil {
+			b.WriteString(dimStyle.Render(fmt.Sprintf("  %s", m.lostErr)) + "\n")
+		}
+		b.WriteString("\n")
+	case connectStageLeaseEnded:
+		b.WriteString(errorStyle.Render(fmt.Sprintf("Session over: %s.", m.leaseEnded)) + "\n")
+		b.WriteString(dimStyle.Render("  Ask the room owner for more time, then connect again.") + "\n\n")
+	case connectStageKicked:
+		b.WriteString(errorStyle.Render("The room owner removed you from the room.") + "\n")
+		if m.kickReason != "" {
+			b.WriteString(labelStyle.Render("  Reason: ") + m.kickReason + "\n")
+		}
+		b.WriteString("\n")
 	case connectStageError:
 		b.WriteString(errorStyle.Render(fmt.Sprintf("Error: %s", m.err)) + "\n\n")
 	}
 
-	b.WriteString(helpStyle.Render("q quit"))
+	if chat := m.chat.view(); chat != "" {
+		b.WriteString(chat + "\n")
+	}
+	if m.chatting() && !m.chat.typing {
+		b.WriteString(helpStyle.Render("c chat · q quit"))
+	} else if !m.chat.typing {
+		b.WriteString(helpStyle.Render("q quit"))
+	}
 	return layoutWithFooter(b.String(), m.stats.render(), m.height)
 }
 
+// leaseLine describes a session lease with remaining left, as a warning
+// once it's within controller.LeaseWarning of running out.
+func (m *connectModel) leaseLine(remaining time.Duration) string {
+	remaining = max(remaining, 0).Round(time.Second)
+	if remaining <= controller.LeaseWarning {
+		return errorStyle.Render(fmt.Sprintf("Session lease: %s left — the owner ends the session then unless they extend it", remaining))
+	}
+	return labelStyle.Render("Session lease: ") + fmt.Sprintf("%s left", remaining)
+}
+
 func (m *connectModel) stateLine() string {
 	switch m.stage {
 	case connectStageConnecting:
 		return "connecting to the transporter..."
 	case connectStageJoiningRoom:
+		if m.queuePosition > 0 {
+			return fmt.Sprintf("another guest is in room %s; number %d in line to join...", m.roomId, m.queuePosition)
+		}
 		return "joining room " + m.roomId + "..."
 	case connectStageDenied:
 		return errorStyle.Render("join request declined")
@@ -236,8 +494,14 @@ func (m *connectModel) stateLine() string {
 		return successStyle.Render("ready — waiting for a local adb connection")
 	case connectStageRelaying:
 		return successStyle.Render("relaying ADB traffic")
+	case connectStageReconnecting:
+		return errorStyle.Render(fmt.Sprintf("reconnecting (attempt %d)...", m.reconnectAttempt))
 	case connectStageDisconnected:
 		return errorStyle.Render("disconnected")
+	case connectStageLeaseEnded:
+		return errorStyle.Render("session lease ended")
+	case connectStageKicked:
+		return errorStyle.Render("removed from the room")
 	case connectStageError:
 		return errorStyle.Render("error")
 	default:
@@ -1,15 +1,18 @@
 package tui
 
 import (
+	"adb-remote.maci.team/client/adb"
 	"adb-remote.maci.team/client/controller"
 	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 )
 
 func newTestConnectModel() *connectModel {
-	return &connectModel{roomId: "ROOM42", localPort: "5038", stage: connectStageConnecting}
+	return &connectModel{roomId: "ROOM42", stage: connectStageConnecting, chat: newChatPane()}
 }
 
 func TestConnectModelClientId(t *testing.T) {
@@ -30,6 +33,21 @@ func TestConnectModelJoiningRoom(t *testing.T) {
 	}
 }
 
+func TestConnectModelWaitsInTheJoinQueue(t *testing.T) {
+	m := newTestConnectModel()
+	updated, _ := m.Update(joiningRoomMsg{})
+	updated, _ = updated.Update(guestEventMsg{Kind: controller.GuestQueued, QueuePosition: 2})
+	cm := updated.(*connectModel)
+	if view := cm.View(); !strings.Contains(view, "number 2 in line") {
+		t.Fatalf("expected the place in line to be shown, got:\n%s", view)
+	}
+	updated, _ = cm.Update(guestEventMsg{Kind: controller.GuestJoinDecided, Accepted: true})
+	cm = updated.(*connectModel)
+	if cm.queuePosition != 0 || strings.Contains(cm.View(), "in line") {
+		t.Fatalf("expected the place in line to be cleared once the owner decided")
+	}
+}
+
 func TestConnectModelJoinAccepted(t *testing.T) {
 	m := newTestConnectModel()
 	updated, _ := m.Update(guestEventMsg{Kind: controller.GuestJoinDecided, Accepted: true})
@@ -50,13 +68,28 @@ func TestConnectModelJoinDenied(t *testing.T) {
 
 func TestConnectModelProxyReady(t *testing.T) {
 	m := newTestConnectModel()
-	updated, _ := m.Update(guestEventMsg{Kind: controller.GuestProxyReady, LocalPort: "6000"})
+	updated, _ := m.Update(guestEventMsg{Kind: controller.GuestProxyReady, Device: "emulator-5554", LocalPort: "6000"})
 	cm := updated.(*connectModel)
 	if cm.stage != connectStageReady {
 		t.Fatalf("expected stage %v, got %v", connectStageReady, cm.stage)
 	}
-	if cm.localPort != "6000" {
-		t.Fatalf("expected local port %q, got %q", "6000", cm.localPort)
+	if len(cm.proxies) != 1 || cm.proxies[0].port != "6000" {
+		t.Fatalf("expected one proxy on port %q, got %+v", "6000", cm.proxies)
+	}
+	updated, _ = cm.Update(guestEventMsg{Kind: controller.GuestProxyReady, Device: "R58M", LocalPort: "6001"})
+	cm = updated.(*connectModel)
+	if len(cm.proxies) != 2 || cm.proxies[1].device != "R58M" || cm.proxies[1].port != "6001" {
+		t.Fatalf("expected a second proxy for R58M on port %q, got %+v", "6001", cm.proxies)
+	}
+}
+
+func TestConnectModelShowsWhereProxiesListen(t *testing.T) {
+	m := newTestConnectModel()
+	updated, _ := m.Update(guestEventMsg{Kind: controller.GuestProxyReady, Device: "emulator-5554", LocalPort: "6000"})
+	updated, _ = updated.Update(guestEventMsg{Kind: controller.GuestProxyReady, Device: "R58M", LocalAddress: "unix:/tmp/proxy.sock"})
+	view := updated.View()
+	if !strings.Contains(view, "Local proxy for emulator-5554: 127.0.0.1:6000") || !strings.Contains(view, "Local proxy for R58M: unix:/tmp/proxy.sock") {
+		t.Fatalf("expected the view to show where each proxy listens, got:\n%s", view)
 	}
 }
 
@@ -80,6 +113,7 @@ func TestConnectModelLocalAdbConnectedIncrementsRelayCount(t *testing.T) {
 func TestConnectModelRelayStoppedGoesBackToReady(t *testing.T) {
 	m := newTestConnectModel()
 	m.stage = connectStageRelaying
+	m.activeRelays = 1
 	relayErr := errors.New("EOF")
 	updated, _ := m.Update(guestEventMsg{Kind: controller.GuestRelayStopped, Err: relayErr})
 	cm := updated.(*connectModel)
@@ -93,27 +127,65 @@ func TestConnectModelRelayStoppedGoesBackToReady(t *testing.T) {
 
 func TestConnectModelAutomaticAdbConnected(t *testing.T) {
 	m := newTestConnectModel()
-	updated, _ := m.Update(guestEventMsg{Kind: controller.GuestAdbConnected})
+	updated, _ := m.Update(guestEventMsg{Kind: controller.GuestAdbConnected, Device: "emulator-5554"})
 	cm := updated.(*connectModel)
-	if !cm.adbConnected {
+	proxy := cm.proxy("emulator-5554")
+	if !proxy.adbConnected {
 		t.Fatalf("expected adbConnected to be true")
 	}
-	if cm.adbConnectErr != nil {
-		t.Fatalf("expected no adbConnectErr, got %v", cm.adbConnectErr)
+	if proxy.adbConnectErr != nil {
+		t.Fatalf("expected no adbConnectErr, got %v", proxy.adbConnectErr)
 	}
 }
 
 func TestConnectModelAutomaticAdbConnectFailed(t *testing.T) {
 	m := newTestConnectModel()
-	m.adbConnected = true // simulate a stale prior success before a later failure
+	m.proxy("emulator-5554").adbConnected = true // simulate a stale prior success before a later failure
 	wantErr := errors.New("adb-server unreachable")
-	updated, _ := m.Update(guestEventMsg{Kind: controller.GuestAdbConnectFailed, Err: wantErr})
+	updated, _ := m.Update(guestEventMsg{Kind: controller.GuestAdbConnectFailed, Device: "emulator-5554", Err: wantErr})
 	cm := updated.(*connectModel)
-	if cm.adbConnected {
+	proxy := cm.proxy("emulator-5554")
+	if proxy.adbConnected {
 		t.Fatalf("expected adbConnected to be reset to false on failure")
 	}
-	if cm.adbConnectErr != wantErr {
-		t.Fatalf("expected adbConnectErr %v, got %v", wantErr, cm.adbConnectErr)
+	if proxy.adbConnectErr != wantErr {
+		t.Fatalf("expected adbConnectErr %v, got %v", wantErr, proxy.adbConnectErr)
+	}
+}
+
+// TestConnectModelStaysRelayingWhileAnotherDeviceRelays verifies one
+// device's relay stopping doesn't report the guest as idle while another
+// device's relay is still running.
+func TestConnectModelStaysRelayingWhileAnotherDeviceRelays(t *testing.T) {
+	m := newTestConnectModel()
+	updated, _ := m.Update(guestEventMsg{Kind: controller.GuestLocalAdbConnected, Device: "emulator-5554"})
+	updated, _ = updated.Update(guestEventMsg{Kind: controller.GuestLocalAdbConnected, Device: "R58M"})
+	updated, _ = updated.Update(guestEventMsg{Kind: controller.GuestRelayStopped, Device: "R58M"})
+	cm := updated.(*connectModel)
+	if cm.stage != connectStageRelaying {
+		t.Fatalf("expected stage %v, got %v", connectStageRelaying, cm.stage)
+	}
+}
+
+func TestConnectModelShowsOfflineDevice(t *testing.T) {
+	m := newTestConnectModel()
+	updated, _ := m.Update(guestEventMsg{Kind: controller.GuestProxyReady, Device: "emulator-5554", LocalPort: "5038"})
+	updated, _ = updated.Update(guestEventMsg{Kind: controller.GuestDeviceOffline, Device: "emulator-5554", DeviceState: "offline"})
+	if view := updated.View(); !strings.Contains(view, "Device is offline on the owner's side") {
+		t.Fatalf("expected the view to report the device offline, got:\n%s", view)
+	}
+	updated, _ = updated.Update(guestEventMsg{Kind: controller.GuestDeviceOnline, Device: "emulator-5554", DeviceState: "device"})
+	if view := updated.View(); strings.Contains(view, "on the owner's side") {
+		t.Fatalf("expected the offline notice to go away, got:\n%s", view)
+	}
+}
+
+func TestConnectModelShowsDeviceInfo(t *testing.T) {
+	m := newTestConnectModel()
+	updated, _ := m.Update(guestEventMsg{Kind: controller.GuestDeviceInfo, Device: "emulator-5554", DeviceInfo: adb.DeviceInfo{Manufacturer: "Google", Model: "Pixel_7", AndroidVersion: "14"}})
+	updated, _ = updated.Update(guestEventMsg{Kind: controller.GuestProxyReady, Device: "emulator-5554", LocalPort: "5038"})
+	if view := updated.View(); !strings.Contains(view, "Google Pixel_7 (Android 14)") {
+		t.Fatalf("expected the view to describe the device, got:\n%s", view)
 	}
 }
 
@@ -127,6 +199,92 @@ func TestConnectModelTransportLost(t *testing.T) {
 	}
 }
 
+func TestConnectModelReportsReconnections(t *testing.T) {
+	m := newTestConnectModel()
+	m.stage = connectStageRelaying
+	updated, _ := m.Update(guestEventMsg{Kind: controller.GuestProxyReady, Device: "emulator-5554", LocalPort: "5038"})
+	updated, _ = updated.Update(guestEventMsg{Kind: controller.GuestReconnecting, Attempt: 2, Err: errors.New("connection refused")})
+	cm := updated.(*connectModel)
+	if cm.stage != connectStageReconnecting {
+		t.Fatalf("expected stage %v, got %v", connectStageReconnecting, cm.stage)
+	}
+	view := cm.View()
+	if !strings.Contains(view, "attempt 2") || !strings.Contains(view, "connection refused") || !strings.Contains(view, "127.0.0.1:5038") {
+		t.Fatalf("expected the view to show the attempt, why the last one failed and the proxy still up, got:\n%s", view)
+	}
+
+	updated, _ = cm.Update(guestEventMsg{Kind: controller.GuestReconnected, ClientId: "CLIENT2"})
+	cm = updated.(*connectModel)
+	if cm.stage != connectStageReady || cm.clientId != "CLIENT2" || cm.reconnects != 1 {
+		t.Fatalf("expected to be ready again as CLIENT2, got stage=%v clientId=%q reconnects=%d", cm.stage, cm.clientId, cm.reconnects)
+	}
+}
+
+func TestConnectModelShowsWhyReconnectingWasGivenUp(t *testing.T) {
+	m := newTestConnectModel()
+	m.stage = connectStageReconnecting
+	updated, _ := m.Update(guestEventMsg{Kind: controller.GuestTransportLost, Err: errors.New("room not found")})
+	if view := updated.View(); !strings.Contains(view, "room not found") {
+		t.Fatalf("expected the view to say why reconnecting was given up on, got:\n%s", view)
+	}
+}
+
+func TestConnectModelWarnsBeforeTheLeaseRunsOut(t *testing.T) {
+	m := newTestConnectModel()
+	updated, _ := m.Update(guestEventMsg{Kind: controller.GuestLeaseChanged, Lease: time.Hour, LeaseExpiresAt: time.Now().Add(time.Hour)})
+	cm := updated.(*connectModel)
+	if view := cm.View(); !strings.Contains(view, "Session lease:") || strings.Contains(view, "unless they extend it") {
+		t.Fatalf("expected the lease without a warning, got:\n%s", view)
+	}
+	updated, _ = cm.Update(guestEventMsg{Kind: controller.GuestLeaseExpiring, LeaseExpiresAt: time.Now().Add(30 * time.Second)})
+	cm = updated.(*connectModel)
+	if view := cm.View(); !strings.Contains(view, "unless they extend it") {
+		t.Fatalf("expected a warning about the lease running out, got:\n%s", view)
+	}
+}
+
+func TestConnectModelLeaseEnded(t *testing.T) {
+	m := newTestConnectModel()
+	updated, _ := m.Update(guestEventMsg{Kind: controller.GuestLeaseEnded, Err: &controller.ErrLeaseEnded{Revoked: true}})
+	cm := updated.(*connectModel)
+	if cm.stage != connectStageLeaseEnded || !strings.Contains(cm.View(), "revoked") {
+		t.Fatalf("expected the revoked session to be shown, got stage %v:\n%s", cm.stage, cm.View())
+	}
+}
+
+func TestConnectModelKicked(t *testing.T) {
+	m := newTestConnectModel()
+	updated, _ := m.Update(guestEventMsg{Kind: controller.GuestKicked, Reason: "Session over"})
+	cm := updated.(*connectModel)
+	if cm.stage != connectStageKicked || !strings.Contains(cm.View(), "Session over") {
+		t.Fatalf("expected the kick and its reason to be shown, got stage %v:\n%s", cm.stage, cm.View())
+	}
+}
+
+func TestConnectModelChatsWithTheOwner(t *testing.T) {
+	m := newTestConnectModel()
+	updated, _ := m.Update(guestEventMsg{Kind: controller.GuestJoinDecided, Accepted: true, OwnerClientId: "OWNER1"})
+	cm := updated.(*connectModel)
+	updated, _ = cm.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("c")})
+	cm = updated.(*connectModel)
+	updated, cmd := cm.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("q")})
+	cm = updated.(*connectModel)
+	if cmd != nil || !cm.chat.typing {
+		t.Fatalf("expected q to be typed into the chat rather than quit")
+	}
+	updated, _ = cm.Update(guestEventMsg{Kind: controller.GuestChatMessage, OwnerClientId: "OWNER1", Text: "Hi there", SentAt: time.Now()})
+	cm = updated.(*connectModel)
+	if view := cm.View(); !strings.Contains(view, "OWNER1: Hi there") || !strings.Contains(view, "> q") {
+		t.Fatalf("expected the chat pane and the line being typed, got:\n%s", view)
+	}
+
+	updated, _ = cm.Update(guestEventMsg{Kind: controller.GuestKicked})
+	cm = updated.(*connectModel)
+	if cm.chat.typing {
+		t.Fatalf("expected typing to stop once removed from the room")
+	}
+}
+
 func TestConnectModelErrorStage(t *testing.T) {
 	m := newTestConnectModel()
 	wantErr := errors.New("transporter connection lost")
@@ -158,3 +316,33 @@ func TestConnectModelCtrlCQuits(t *testing.T) {
 		t.Fatalf("expected the command to produce tea.QuitMsg")
 	}
 }
+
+func TestConnectModelAnswersAdbKeyRequestsInOrder(t *testing.T) {
+	m := newTestConnectModel()
+	first := make(chan adbKeyDecision, 1)
+	second := make(chan adbKeyDecision, 1)
+	updated, _ := m.Update(adbKeyRequestMsg{fingerprint: "AA:BB", comment: "me@laptop", respond: first})
+	updated, _ = updated.Update(adbKeyRequestMsg{fingerprint: "CC:DD", respond: second})
+	cm := updated.(*connectModel)
+	if view := cm.View(); !strings.Contains(view, "AA:BB") || !strings.Contains(view, "me@laptop") || strings.Contains(view, "CC:DD") {
+		t.Fatalf("expected the oldest key request to be shown, got:\n%s", view)
+	}
+
+	// Keys that aren't an answer leave the request pending.
+	updated, _ = cm.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("x")})
+	updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("a")})
+	cm = updated.(*connectModel)
+	if decision := <-first; !decision.approved || !decision.remember {
+		t.Fatalf("expected 'a' to always allow the key, got %+v", decision)
+	}
+	if len(cm.keyRequests) != 1 || !strings.Contains(cm.View(), "CC:DD") {
+		t.Fatalf("expected the second request to be shown next")
+	}
+	updated, _ = cm.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("n")})
+	if decision := <-second; decision.approved {
+		t.Fatalf("expected 'n' to reject the key, got %+v", decision)
+	}
+	if len(updated.(*connectModel).keyRequests) != 0 {
+		t.Fatalf("expected no key request left")
+	}
+}
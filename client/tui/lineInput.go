@@ -0,0 +1,45 @@
+package tui
+
+import tea "github.com/charmbracelet/bubbletea"
+
+// lineInput is a single line of text the operator types into a TUI, up to
+// limit runes (no limit if it's 0).
+type lineInput struct {
+	value []rune
+	limit int
+}
+
+// update applies key to the line, reporting whether it edits text at all:
+// printable runes are appended and backspace deletes the last one. Other
+// keys (enter, esc, ...) are left to the caller.
+func (l *lineInput) update(key tea.KeyMsg) bool {
+	switch key.Type {
+	case tea.KeyRunes:
+		l.value = append(l.value, key.Runes...)
+	case tea.KeySpace:
+		l.value = append(l.value, ' ')
+	case tea.KeyBackspace:
+		if len(l.value) > 0 {
+			l.value = l.value[:len(l.value)-1]
+		}
+	default:
+		return false
+	}
+	if l.limit > 0 && len(l.value) > l.limit {
+		l.value = l.value[:l.limit]
+	}
+	return true
+}
+
+func (l *lineInput) String() string {
+	return string(l.value)
+}
+
+func (l *lineInput) reset() {
+	l.value = nil
+}
+
+// view renders the line with a cursor at its end.
+func (l *lineInput) view() string {
+	return string(l.value) + "█"
+}
@@ -0,0 +1,32 @@
+package tui
+
+import (
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func TestLineInputEditsUpToItsLimit(t *testing.T) {
+	line := lineInput{limit: 8}
+	for _, key := range []tea.KeyMsg{
+		{Type: tea.KeyRunes, Runes: []rune("bye")},
+		{Type: tea.KeySpace},
+		{Type: tea.KeyRunes, Runes: []rune("now!")},
+		{Type: tea.KeyBackspace},
+		{Type: tea.KeyRunes, Runes: []rune("?!")},
+	} {
+		if !line.update(key) {
+			t.Fatalf("expected %v to edit the line", key)
+		}
+	}
+	if line.String() != "bye now?" {
+		t.Fatalf("expected %q, got %q", "bye now?", line.String())
+	}
+	if line.update(tea.KeyMsg{Type: tea.KeyEnter}) {
+		t.Fatalf("expected enter to be left to the caller")
+	}
+	line.reset()
+	if line.String() != "" {
+		t.Fatalf("expected the line to be empty once reset, got %q", line.String())
+	}
+}
@@ -0,0 +1,155 @@
+package tui
+
+import (
+	"adb-remote.maci.team/client/controller"
+	"adb-remote.maci.team/client/identity"
+	"adb-remote.maci.team/client/transportLayer"
+	"context"
+	"fmt"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// listModel drives the `list` command's TUI: show the rooms listed in a
+// team's room directory and let the operator pick one to connect to.
+type listModel struct {
+	team string
+	// loadRooms fetches the team's listed rooms; it's only ever called
+	// once at a time.
+	loadRooms func() ([]controller.RoomListing, error)
+
+	loading bool
+	rooms   []controller.RoomListing
+	cursor  int
+	err     error
+	// notice explains why the last pick was refused.
+	notice string
+	// picked is the room picked, nil if the operator quit instead.
+	picked *controller.RoomListing
+}
+
+func newListModel(team string, loadRooms func() ([]controller.RoomListing, error)) *listModel {
+	return &listModel{team: team, loadRooms: loadRooms, loading: true}
+}
+
+// RunList runs the interactive room picker for team's room directory,
+// presenting teamToken, and returns the room picked, or nil if the
+// operator quit without picking one. The transporter handshake is done on
+// client, for the caller to reconnect it before joining the room.
+func RunList(ctx context.Context, client *transportLayer.Client, team string, teamToken string) (*controller.RoomListing, error) {
+	handshaken := false
+	m := newListModel(team, func() ([]controller.RoomListing, error) {
+		if !handshaken {
+			if _, err := controller.Handshake(client); err != nil {
+				return nil, err
+			}
+			handshaken = true
+		}
+		return controller.ListRooms(client, team, teamToken)
+	})
+	program := tea.NewProgram(m, tea.WithAltScreen(), tea.WithContext(ctx))
+	if _, err := program.Run(); err != nil {
+		return nil, err
+	}
+	return m.picked, nil
+}
+
+// roomsLoadedMsg carries a team's listed rooms.
+type roomsLoadedMsg struct {
+	rooms []controller.RoomListing
+	err   error
+}
+
+func (m *listModel) fetchRooms() tea.Cmd {
+	m.loading = true
+	return func() tea.Msg {
+		rooms, err := m.loadRooms()
+		return roomsLoadedMsg{rooms: rooms, err: err}
+	}
+}
+
+func (m *listModel) Init() tea.Cmd {
+	return m.fetchRooms()
+}
+
+func (m *listModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case roomsLoadedMsg:
+		m.loading = false
+		m.rooms, m.err = msg.rooms, msg.err
+		if m.cursor >= len(m.rooms) {
+			m.cursor = max(len(m.rooms)-1, 0)
+		}
+		return m, nil
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "q", "ctrl+c":
+			return m, tea.Quit
+		case "up", "k":
+			if m.cursor > 0 {
+				m.cursor--
+			}
+		case "down", "j":
+			if m.cursor < len(m.rooms)-1 {
+				m.cursor++
+			}
+		case "r":
+			if !m.loading {
+				m.notice = ""
+				return m, m.fetchRooms()
+			}
+		case "enter":
+			if m.loading || len(m.rooms) == 0 {
+				return m, nil
+			}
+			room := m.rooms[m.cursor]
+			if room.Occupied {
+				m.notice = fmt.Sprintf("Room %s already has a guest.", room.RoomId)
+				return m, nil
+			}
+			m.picked = &room
+			return m, tea.Quit
+		}
+	}
+	return m, nil
+}
+
+func (m *listModel) View() string {
+	var b strings.Builder
+	b.WriteString(titleStyle.Render(fmt.Sprintf("adb-remote — rooms of team %s", m.team)) + "\n")
+
+	switch {
+	case m.loading:
+		b.WriteString("Loading rooms...\n")
+	case m.err != nil:
+		b.WriteString(errorStyle.Render(fmt.Sprintf("Error: %s", m.err)) + "\n\n")
+	case len(m.rooms) == 0:
+		b.WriteString("No rooms listed.\n\n")
+	}
+	if !m.loading {
+		for i, room := range m.rooms {
+			line := fmt.Sprintf("%-24s %-24s %s", room.RoomId, room.Label, strings.Join(room.Models, ", "))
+			if len(room.Tags) > 0 {
+				line += dimStyle.Render(" [" + strings.Join(room.Tags, ", ") + "]")
+			}
+			if room.Occupied {
+				line += errorStyle.Render(" (in use)")
+			}
+			if i == m.cursor {
+				b.WriteString(selectedStyle.Render("> "+line) + "\n")
+				if len(room.OwnerPublicKey) > 0 {
+					b.WriteString(labelStyle.Render("    Owner fingerprint: ") + identity.Fingerprint(room.OwnerPublicKey) + "\n")
+				}
+			} else {
+				b.WriteString("  " + line + "\n")
+			}
+		}
+		b.WriteString("\n")
+	}
+	if m.notice != "" {
+		b.WriteString(promptStyle.Render(m.notice) + "\n\n")
+	}
+	b.WriteString(helpStyle.Render("↑/↓ move · enter connect · r refresh · q quit"))
+	return b.String()
+}
@@ -0,0 +1,47 @@
+package tui
+
+import (
+	"adb-remote.maci.team/client/controller"
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func TestListModelPicksTheSelectedRoom(t *testing.T) {
+	m := newListModel("mobile", nil)
+	m.Update(roomsLoadedMsg{rooms: []controller.RoomListing{{RoomId: "lab-pixel"}, {RoomId: "ROOM42"}}})
+	m.Update(tea.KeyMsg{Type: tea.KeyDown})
+	_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if m.picked == nil || m.picked.RoomId != "ROOM42" || cmd == nil {
+		t.Fatalf("expected ROOM42 to be picked and the TUI to quit, got %+v", m.picked)
+	}
+}
+
+func TestListModelRefusesAnOccupiedRoom(t *testing.T) {
+	m := newListModel("mobile", nil)
+	m.Update(roomsLoadedMsg{rooms: []controller.RoomListing{{RoomId: "lab-pixel", Occupied: true}}})
+	if _, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter}); cmd != nil || m.picked != nil {
+		t.Fatalf("expected an occupied room not to be picked")
+	}
+	if !strings.Contains(m.View(), "already has a guest") {
+		t.Fatalf("expected the view to say why, got %q", m.View())
+	}
+}
+
+func TestListModelRefreshes(t *testing.T) {
+	loads := 0
+	m := newListModel("mobile", func() ([]controller.RoomListing, error) {
+		loads++
+		return []controller.RoomListing{{RoomId: "lab-pixel"}}, nil
+	})
+	m.Update(m.Init()())
+	_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("r")})
+	if cmd == nil || !m.loading {
+		t.Fatalf("expected r to reload the rooms")
+	}
+	m.Update(cmd())
+	if loads != 2 || m.loading || len(m.rooms) != 1 {
+		t.Fatalf("expected two loads and the rooms shown, got %d loads and %+v", loads, m.rooms)
+	}
+}
@@ -2,12 +2,15 @@ package tui
 
 import (
 	"adb-remote.maci.team/client/adb"
+	"adb-remote.maci.team/client/control"
 	"adb-remote.maci.team/client/controller"
 	"adb-remote.maci.team/client/identity"
 	"adb-remote.maci.team/client/transportLayer"
 	"context"
 	"fmt"
+	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -27,29 +30,72 @@ const (
 
 const activityLogLimit = 10
 
-// shareModel drives the `share` command's TUI: pick a local device (with
-// refresh), then show the room id and handle join requests as they arrive.
+// leaseChoices are the session leases the join prompt offers, 0 being no
+// time limit; the -lease default is offered too.
+var leaseChoices = []time.Duration{0, 15 * time.Minute, 30 * time.Minute, time.Hour, 2 * time.Hour, 4 * time.Hour, 8 * time.Hour}
+
+// leaseExtension is how much the extend key adds to the guest's lease.
+const leaseExtension = 15 * time.Minute
+
+// kickReasonLimit bounds the reason typed for removing the guest.
+const kickReasonLimit = 120
+
+// shareModel drives the `share` command's TUI: pick one or more local
+// devices (kept up to date as they're plugged in and out), then show the room id and handle join requests as
+// they arrive.
 type shareModel struct {
 	ctx         context.Context
 	smartSocket adb.IAdbSmartSocket
 	autoAccept  bool
 	fingerprint string
+	// trackingCtx bounds the picker's device tracking; stopTracking ends it
+	// once devices are chosen.
+	trackingCtx  context.Context
+	stopTracking context.CancelFunc
 
-	// selectedDevice carries the chosen device id from Update (once) to
+	// selectedDevices carries the chosen device ids from Update (once) to
 	// the background owner-flow goroutine.
-	selectedDevice chan string
+	selectedDevices chan []string
 
 	stage   shareStage
 	devices []adb.Device
 	cursor  int
+	// marked holds the ids of the devices toggled on in the picker.
+	marked map[string]bool
+	// shared lists the device ids the room shares, once chosen, and
+	// offline the adb state of those currently unusable.
+	shared  []string
+	offline map[string]string
 	err     error
 
 	clientId string
 	roomId   string
+	// publishedTeam is the team whose room directory lists the room.
+	publishedTeam string
 
 	pendingGuestId     string
 	pendingFingerprint string
 	pendingRespond     chan<- bool
+	// leaseChoices are the leases the prompt offers, and pendingLease the
+	// index of the one picked for the pending guest.
+	leaseChoices []time.Duration
+	defaultLease time.Duration
+	pendingLease int
+	// leases extends and revokes the connected guest's lease; chosenLeases
+	// carries the lease picked for a guest from Update to grantLease, on
+	// the owner flow's goroutine.
+	leases         *controller.Leases
+	leaseMutex     sync.Mutex
+	chosenLeases   map[string]time.Duration
+	leaseExpiresAt time.Time
+	leaseEnded     bool
+	// kicker removes the connected guest from the room; kicking is set
+	// while the operator types the reason for it into kickReason.
+	kicker     *controller.Kicker
+	kicking    bool
+	kickReason lineInput
+	// chat is the chat with the connected guest.
+	chat chatPane
 
 	// connectedGuestId/connectedGuestFingerprint identify the room's
 	// current guest, since a room holds exactly one guest at a time; they
@@ -57,6 +103,9 @@ type shareModel struct {
 	// as that guest is connected.
 	connectedGuestId          string
 	connectedGuestFingerprint string
+	// joinQueue holds the client ids of the guests waiting, in order, to
+	// join while another one is in the room.
+	joinQueue []string
 
 	activity []string
 
@@ -65,37 +114,70 @@ type shareModel struct {
 	width, height int
 }
 
-func newShareModel(ctx context.Context, smartSocket adb.IAdbSmartSocket, presetDevice string, autoAccept bool, fingerprint string, statsSource transferStatsSource) *shareModel {
+func newShareModel(ctx context.Context, smartSocket adb.IAdbSmartSocket, presetDevices []string, autoAccept bool, defaultLease time.Duration, fingerprint string, statsSource transferStatsSource) *shareModel {
+	trackingCtx, stopTracking := context.WithCancel(ctx)
+	choices := slices.Clone(leaseChoices)
+	if !slices.Contains(choices, defaultLease) {
+		choices = append(choices, defaultLease)
+		slices.Sort(choices)
+	}
 	m := &shareModel{
-		ctx:            ctx,
-		smartSocket:    smartSocket,
-		autoAccept:     autoAccept,
-		fingerprint:    fingerprint,
-		selectedDevice: make(chan string, 1),
-		stage:          shareStageLoadingDevices,
-		statsSource:    statsSource,
+		ctx:             ctx,
+		trackingCtx:     trackingCtx,
+		stopTracking:    stopTracking,
+		smartSocket:     smartSocket,
+		autoAccept:      autoAccept,
+		fingerprint:     fingerprint,
+		selectedDevices: make(chan []string, 1),
+		stage:           shareStageLoadingDevices,
+		marked:          make(map[string]bool),
+		offline:         make(map[string]string),
+		leaseChoices:    choices,
+		defaultLease:    defaultLease,
+		chosenLeases:    make(map[string]time.Duration),
+		kicker:          controller.NewKicker(),
+		kickReason:      lineInput{limit: kickReasonLimit},
+		chat:            newChatPane(),
+		statsSource:     statsSource,
 	}
-	if presetDevice != "" {
-		m.stage = shareStageConnecting
-		m.selectedDevice <- presetDevice
+	m.leases = controller.NewLeases(m.grantLease)
+	if len(presetDevices) > 0 {
+		m.selectDevices(presetDevices)
 	}
 	return m
 }
 
-// RunShare runs the interactive share TUI to completion. If presetDevice is
-// non-empty, the device picker is skipped. If autoAccept is true, join
+// RunShare runs the interactive share TUI to completion. If presetDevices
+// is non-empty, the device picker is skipped and the room shares those
+// devices. If autoAccept is true, join
 // requests are accepted automatically instead of prompting. sessionTimeout
 // closes the room (and this process) once it elapses after the room is
 // created; a zero or negative value (including the documented -1 CLI
-// sentinel) disables the timeout.
-func RunShare(ctx context.Context, client *transportLayer.Client, smartSocket adb.IAdbSmartSocket, ownerIdentity *identity.Identity, presetDevice string, autoAccept bool, sessionTimeout time.Duration) error {
+// sentinel) disables the timeout. Accepted guests get a session lease of
+// the one picked at the join prompt, defaultLease unless the operator
+// picks another (0 being no time limit), and the operator can extend or
+// revoke it while the guest is connected, chat with it, or remove it from
+// the room. options is passed through to controller.JoinAsRoomOwner, with
+// the TUI's Leases, Kicker and Chat. session, if non-nil,
+// is told about the room and may decide join requests before the operator
+// does (see client/control). Cancelling ctx closes the room and the TUI.
+func RunShare(ctx context.Context, client *transportLayer.Client, smartSocket adb.IAdbSmartSocket, ownerIdentity *identity.Identity, presetDevices []string, autoAccept bool, sessionTimeout time.Duration, defaultLease time.Duration, options controller.OwnerOptions, session *control.OwnerSession) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	m := newShareModel(ctx, smartSocket, presetDevice, autoAccept, ownerIdentity.Fingerprint(), client)
+	m := newShareModel(ctx, smartSocket, presetDevices, autoAccept, defaultLease, ownerIdentity.Fingerprint(), client)
 	program := tea.NewProgram(m, tea.WithAltScreen())
-
-	go runOwnerFlow(ctx, program, m, client, smartSocket, ownerIdentity, autoAccept, sessionTimeout)
+	options.Leases = m.leases
+	options.Kicker = m.kicker
+	options.Chat = m.chat.chat
+	session.SetLeases(m.leases)
+	session.SetKicker(m.kicker)
+
+	go runOwnerFlow(ctx, program, m, client, smartSocket, ownerIdentity, autoAccept, sessionTimeout, options, session)
+	go func() {
+		<-ctx.Done()
+		program.Quit()
+	}()
 
 	_, err := program.Run()
 	cancel()
@@ -105,13 +187,13 @@ func RunShare(ctx context.Context, client *transportLayer.Client, smartSocket ad
 	return m.err
 }
 
-// runOwnerFlow waits for a device to be selected, then performs the
+// runOwnerFlow waits for devices to be selected, then performs the
 // handshake and services the room, forwarding every state change into the
 // TUI as a message.
-func runOwnerFlow(ctx context.Context, program *tea.Program, m *shareModel, client *transportLayer.Client, smartSocket adb.IAdbSmartSocket, ownerIdentity *identity.Identity, autoAccept bool, sessionTimeout time.Duration) {
-	var deviceId string
+func runOwnerFlow(ctx context.Context, program *tea.Program, m *shareModel, client *transportLayer.Client, smartSocket adb.IAdbSmartSocket, ownerIdentity *identity.Identity, autoAccept bool, sessionTimeout time.Duration, options controller.OwnerOptions, session *control.OwnerSession) {
+	var devices []string
 	select {
-	case deviceId = <-m.selectedDevice:
+	case devices = <-m.selectedDevices:
 	case <-ctx.Done():
 		return
 	}
@@ -127,14 +209,16 @@ func runOwnerFlow(ctx context.Context, program *tea.Program, m *shareModel, clie
 		if autoAccept {
 			return true, nil
 		}
-		respond := make(chan bool, 1)
-		program.Send(joinRequestMsg{clientId: guestClientId, fingerprint: identity.Fingerprint(guestPublicKey), respond: respond})
-		select {
-		case accepted := <-respond:
-			return accepted, nil
-		case <-ctx.Done():
-			return false, ctx.Err()
-		}
+		return session.Decide(ctx, guestClientId, guestPublicKey, func(ctx context.Context) (bool, error) {
+			respond := make(chan bool, 1)
+			program.Send(joinRequestMsg{clientId: guestClientId, fingerprint: identity.Fingerprint(guestPublicKey), respond: respond})
+			select {
+			case accepted := <-respond:
+				return accepted, nil
+			case <-ctx.Done():
+				return false, ctx.Err()
+			}
+		})
 	}
 
 	// ownerCtx derives from ctx so the timeout can stop JoinAsRoomOwner (and
@@ -155,19 +239,23 @@ func runOwnerFlow(ctx context.Context, program *tea.Program, m *shareModel, clie
 	}
 
 	onEvent := func(e controller.OwnerEvent) {
+		session.OwnerEvent(e)
 		program.Send(ownerEventMsg(e))
 	}
 
-	if err := controller.JoinAsRoomOwner(ownerCtx, client, smartSocket, deviceId, ownerIdentity, promptAccept, onEvent); err != nil && ctx.Err() == nil && !timedOut.Load() {
+	if err := controller.JoinAsRoomOwner(ownerCtx, client, smartSocket, devices, ownerIdentity, promptAccept, onEvent, options); err != nil && ctx.Err() == nil && !timedOut.Load() {
 		program.Send(shareErrorMsg{err})
 	}
 }
 
 // --- messages ---
 
+// devicesLoadedMsg carries a device list; updates is set when it came from
+// live tracking, for the next one to be waited for.
 type devicesLoadedMsg struct {
 	devices []adb.Device
 	err     error
+	updates <-chan []adb.Device
 }
 
 type clientIdMsg string
@@ -182,6 +270,13 @@ type joinRequestMsg struct {
 
 type shareErrorMsg struct{ err error }
 
+// leaseErrorMsg reports that extending or revoking the guest's lease
+// failed.
+type leaseErrorMsg struct{ err error }
+
+// kickErrorMsg reports that removing the guest from the room failed.
+type kickErrorMsg struct{ err error }
+
 type sessionTimeoutMsg struct{}
 
 func fetchDevices(smartSocket adb.IAdbSmartSocket) tea.Cmd {
@@ -191,13 +286,35 @@ func fetchDevices(smartSocket adb.IAdbSmartSocket) tea.Cmd {
 	}
 }
 
+// trackDevices follows the adb server's device list for as long as ctx
+// lasts, falling back to a one-off fetch if the adb server can't track.
+func trackDevices(ctx context.Context, smartSocket adb.IAdbSmartSocket) tea.Cmd {
+	return func() tea.Msg {
+		updates, err := smartSocket.TrackDevices(ctx)
+		if err != nil {
+			return fetchDevices(smartSocket)()
+		}
+		return waitForDevices(updates)()
+	}
+}
+
+func waitForDevices(updates <-chan []adb.Device) tea.Cmd {
+	return func() tea.Msg {
+		devices, ok := <-updates
+		if !ok {
+			return nil
+		}
+		return devicesLoadedMsg{devices: devices, updates: updates}
+	}
+}
+
 // --- bubbletea.Model ---
 
 func (m *shareModel) Init() tea.Cmd {
 	if m.stage == shareStageConnecting {
 		return tickTransferStats()
 	}
-	return tea.Batch(fetchDevices(m.smartSocket), tickTransferStats())
+	return tea.Batch(trackDevices(m.trackingCtx, m.smartSocket), tickTransferStats())
 }
 
 func (m *shareModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
@@ -210,13 +327,31 @@ func (m *shareModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case tea.KeyMsg:
 		return m.handleKey(msg)
 	case devicesLoadedMsg:
+		if m.stage != shareStageLoadingDevices && m.stage != shareStageSelectDevice {
+			// A tracking update racing the devices being chosen.
+			return m, nil
+		}
+		var next tea.Cmd
+		if msg.updates != nil {
+			next = waitForDevices(msg.updates)
+		}
 		m.stage = shareStageSelectDevice
 		m.devices = msg.devices
 		m.err = msg.err
 		if m.cursor >= len(m.devices) {
 			m.cursor = 0
 		}
-		return m, nil
+		// Forget marks on devices that went away with the update.
+		present := make(map[string]bool, len(m.devices))
+		for _, device := range m.devices {
+			present[device.Id] = true
+		}
+		for id := range m.marked {
+			if !present[id] {
+				delete(m.marked, id)
+			}
+		}
+		return m, next
 	case clientIdMsg:
 		m.clientId = string(msg)
 		return m, nil
@@ -227,11 +362,24 @@ func (m *shareModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.pendingGuestId = msg.clientId
 		m.pendingFingerprint = msg.fingerprint
 		m.pendingRespond = msg.respond
+		m.pendingLease = slices.Index(m.leaseChoices, m.defaultLease)
 		return m, nil
 	case shareErrorMsg:
 		m.err = msg.err
 		m.stage = shareStageError
 		return m, nil
+	case leaseErrorMsg:
+		m.appendActivity(fmt.Sprintf("Can't change the guest's lease: %s", msg.err))
+		return m, nil
+	case kickErrorMsg:
+		m.appendActivity(fmt.Sprintf("Can't remove the guest: %s", msg.err))
+		return m, nil
+	case chatSentMsg:
+		m.chat.add("you", msg.text, msg.sentAt)
+		return m, nil
+	case chatErrorMsg:
+		m.chat.add("", fmt.Sprintf("(not sent: %s)", msg.err), time.Now())
+		return m, nil
 	case sessionTimeoutMsg:
 		m.stage = shareStageSessionTimeout
 		return m, tea.Quit
@@ -244,9 +392,40 @@ func (m *shareModel) handleKey(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		return m, tea.Quit
 	}
 
+	if m.kicking {
+		switch msg.Type {
+		case tea.KeyEnter:
+			reason := m.kickReason.String()
+			m.kicking = false
+			m.kickReason.reset()
+			return m, kickGuest(m.kicker, reason)
+		case tea.KeyEsc:
+			m.kicking = false
+			m.kickReason.reset()
+		default:
+			m.kickReason.update(msg)
+		}
+		return m, nil
+	}
+
+	if cmd, handled := m.chat.handleKey(msg); handled {
+		return m, cmd
+	}
+
 	if m.pendingRespond != nil {
 		switch msg.String() {
+		case "left", "h":
+			if m.pendingLease > 0 {
+				m.pendingLease--
+			}
+		case "right", "l":
+			if m.pendingLease < len(m.leaseChoices)-1 {
+				m.pendingLease++
+			}
 		case "y":
+			m.leaseMutex.Lock()
+			m.chosenLeases[m.pendingGuestId] = m.leaseChoices[m.pendingLease]
+			m.leaseMutex.Unlock()
 			m.pendingRespond <- true
 			m.pendingRespond = nil
 			m.pendingGuestId = ""
@@ -271,18 +450,50 @@ func (m *shareModel) handleKey(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 			if m.cursor < len(m.devices)-1 {
 				m.cursor++
 			}
+		case " ", "x":
+			if len(m.devices) > 0 {
+				id := m.devices[m.cursor].Id
+				if m.marked[id] {
+					delete(m.marked, id)
+				} else {
+					m.marked[id] = true
+				}
+			}
 		case "r":
 			m.stage = shareStageLoadingDevices
 			return m, fetchDevices(m.smartSocket)
 		case "enter":
-			if len(m.devices) > 0 {
-				m.stage = shareStageConnecting
-				m.selectedDevice <- m.devices[m.cursor].Id
+			// Share the marked devices, in list order, or just the
+			// highlighted one if none is marked.
+			var devices []string
+			for _, device := range m.devices {
+				if m.marked[device.Id] {
+					devices = append(devices, device.Id)
+				}
+			}
+			if len(devices) == 0 && len(m.devices) > 0 {
+				devices = []string{m.devices[m.cursor].Id}
+			}
+			if len(devices) > 0 {
+				m.selectDevices(devices)
 			}
 		case "q":
 			return m, tea.Quit
 		}
-	case shareStageRoomActive, shareStageError, shareStageLoadingDevices, shareStageConnecting:
+	case shareStageRoomActive:
+		switch msg.String() {
+		case "e":
+			return m, changeLease(func() error { return m.leases.Extend(leaseExtension) })
+		case "r":
+			return m, changeLease(m.leases.Revoke)
+		case "k":
+			m.kicking = m.connectedGuestId != ""
+		case "c":
+			m.chat.typing = m.connectedGuestId != ""
+		case "q":
+			return m, tea.Quit
+		}
+	case shareStageError, shareStageLoadingDevices, shareStageConnecting:
 		if msg.String() == "q" {
 			return m, tea.Quit
 		}
@@ -290,6 +501,49 @@ func (m *shareModel) handleKey(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+// changeLease runs change, which extends or revokes the guest's lease, off
+// the UI goroutine: Leases reports the result as an OwnerEvent, which the
+// UI goroutine must be free to take.
+func changeLease(change func() error) tea.Cmd {
+	return func() tea.Msg {
+		if err := change(); err != nil {
+			return leaseErrorMsg{err}
+		}
+		return nil
+	}
+}
+
+// kickGuest removes the guest from the room with reason, off the UI
+// goroutine, for the same reason as changeLease.
+func kickGuest(kicker *controller.Kicker, reason string) tea.Cmd {
+	return func() tea.Msg {
+		if err := kicker.Kick(reason); err != nil {
+			return kickErrorMsg{err}
+		}
+		return nil
+	}
+}
+
+// grantLease is the TUI's controller.LeaseFunc: the lease picked at the
+// join prompt, or the default for guests the prompt didn't decide about.
+func (m *shareModel) grantLease(guestClientId string, _ []byte) time.Duration {
+	m.leaseMutex.Lock()
+	defer m.leaseMutex.Unlock()
+	lease, ok := m.chosenLeases[guestClientId]
+	if !ok {
+		return m.defaultLease
+	}
+	delete(m.chosenLeases, guestClientId)
+	return lease
+}
+
+func (m *shareModel) selectDevices(devices []string) {
+	m.stopTracking()
+	m.stage = shareStageConnecting
+	m.shared = devices
+	m.selectedDevices <- devices
+}
+
 func (m *shareModel) handleOwnerEvent(e controller.OwnerEvent) {
 	switch e.Kind {
 	case controller.OwnerRoomCreated:
@@ -298,15 +552,60 @@ func (m *shareModel) handleOwnerEvent(e controller.OwnerEvent) {
 	case controller.OwnerJoinRequested:
 		m.appendActivity(fmt.Sprintf("Join request from clientId: %s (fingerprint %s)", e.GuestClientId, identity.Fingerprint(e.GuestPublicKey)))
 	case controller.OwnerJoinDecided:
+		if m.pendingGuestId == e.GuestClientId {
+			// Decided over the control socket while the prompt was up.
+			m.pendingGuestId = ""
+			m.pendingFingerprint = ""
+			m.pendingRespond = nil
+		}
 		verb := "declined"
-		if e.Accepted {
+		if e.Rejoined {
+			verb = "re-joined after losing its connection, without asking"
+		} else if e.Accepted {
 			verb = "accepted"
+		}
+		if e.Accepted {
 			m.connectedGuestId = e.GuestClientId
 			m.connectedGuestFingerprint = identity.Fingerprint(e.GuestPublicKey)
+			m.leaseExpiresAt = time.Time{}
+			m.leaseEnded = false
 		}
 		m.appendActivity(fmt.Sprintf("clientId %s: %s", e.GuestClientId, verb))
 	case controller.OwnerJoinFailed:
 		m.appendActivity(fmt.Sprintf("clientId %s: error handling join request: %s", e.GuestClientId, e.Err))
+	case controller.OwnerServiceDenied:
+		m.appendActivity(fmt.Sprintf("Denied service %q: %s", e.Service, e.Err))
+	case controller.OwnerDeviceOffline:
+		m.offline[e.Device] = e.DeviceState
+		m.appendActivity(fmt.Sprintf("Device %s went offline (%s)", e.Device, e.DeviceState))
+	case controller.OwnerDeviceOnline:
+		delete(m.offline, e.Device)
+		m.appendActivity(fmt.Sprintf("Device %s is back online", e.Device))
+	case controller.OwnerRoomPublished:
+		m.publishedTeam = e.Team
+	case controller.OwnerPublishFailed:
+		m.appendActivity(fmt.Sprintf("Can't list the room in team %s's directory: %s", e.Team, e.Err))
+	case controller.OwnerJoinQueueChanged:
+		m.joinQueue = e.Queue
+	case controller.OwnerLeaseChanged:
+		m.leaseExpiresAt = time.Now().Add(e.Lease)
+		m.appendActivity(fmt.Sprintf("clientId %s: lease runs out in %s", e.GuestClientId, formatLease(e.Lease)))
+	case controller.OwnerLeaseEnded:
+		m.leaseExpiresAt = time.Time{}
+		m.leaseEnded = true
+		verb := "expired"
+		if e.Revoked {
+			verb = "revoked"
+		}
+		m.appendActivity(fmt.Sprintf("clientId %s: lease %s", e.GuestClientId, verb))
+	case controller.OwnerGuestKicked:
+		if e.Reason != "" {
+			m.appendActivity(fmt.Sprintf("clientId %s: removed from the room (%s)", e.GuestClientId, e.Reason))
+		} else {
+			m.appendActivity(fmt.Sprintf("clientId %s: removed from the room", e.GuestClientId))
+		}
+	case controller.OwnerChatMessage:
+		m.chat.add(e.GuestClientId, e.Text, e.SentAt)
 	case controller.OwnerGuestLeft:
 		// Only one guest is ever active at a time, so whichever one we were
 		// tracking (connected, or still-pending a decision) is the one that
@@ -318,6 +617,11 @@ func (m *shareModel) handleOwnerEvent(e controller.OwnerEvent) {
 		m.appendActivity(fmt.Sprintf("clientId %s: disconnected", leftId))
 		m.connectedGuestId = ""
 		m.connectedGuestFingerprint = ""
+		m.leaseExpiresAt = time.Time{}
+		m.leaseEnded = false
+		m.kicking = false
+		m.kickReason.reset()
+		m.chat.stop()
 		if m.pendingRespond != nil {
 			// Unblock the goroutine waiting on this decision instead of
 			// leaking it for the rest of the session; the decision is moot
@@ -353,14 +657,18 @@ func (m *shareModel) View() string {
 			b.WriteString("No devices found.\n\n")
 		}
 		for i, d := range m.devices {
-			line := fmt.Sprintf("%-24s %s", d.Id, d.Type)
+			mark := "[ ]"
+			if m.marked[d.Id] {
+				mark = "[x]"
+			}
+			line := fmt.Sprintf("%s %-24s %-12s %s", mark, d.Id, d.Type, d.Model)
 			if i == m.cursor {
 				b.WriteString(selectedStyle.Render("> "+line) + "\n")
 			} else {
 				b.WriteString("  " + line + "\n")
 			}
 		}
-		b.WriteString("\n" + helpStyle.Render("↑/↓ move · enter select · r refresh · q quit"))
+		b.WriteString("\n" + helpStyle.Render("↑/↓ move · space mark · enter share · r refresh · q quit"))
 	case shareStageConnecting:
 		b.WriteString("Connecting to the transporter...\n")
 	case shareStageRoomActive:
@@ -368,17 +676,42 @@ func (m *shareModel) View() string {
 			b.WriteString(labelStyle.Render("Your client id: ") + m.clientId + "\n")
 		}
 		b.WriteString(labelStyle.Render("Your fingerprint: ") + m.fingerprint + "\n")
-		b.WriteString(labelStyle.Render("Room id:        ") + successStyle.Render(m.roomId) + "\n\n")
+		b.WriteString(labelStyle.Render("Room id:        ") + successStyle.Render(m.roomId) + "\n")
+		if m.publishedTeam != "" {
+			b.WriteString(labelStyle.Render("Listed for:     ") + "team " + m.publishedTeam + "\n")
+		}
+		shared := make([]string, len(m.shared))
+		for i, device := range m.shared {
+			shared[i] = device
+			if state, ok := m.offline[device]; ok {
+				shared[i] += errorStyle.Render(fmt.Sprintf(" (%s)", state))
+			}
+		}
+		b.WriteString(labelStyle.Render("Sharing:        ") + strings.Join(shared, ", ") + "\n\n")
 		if m.pendingRespond != nil {
 			b.WriteString(promptStyle.Render(fmt.Sprintf("Join request from clientId: %s — accept? [y/n]", m.pendingGuestId)) + "\n")
 			b.WriteString(labelStyle.Render("  Guest fingerprint: ") + m.pendingFingerprint + "\n")
+			b.WriteString(labelStyle.Render("  Lease: ") + selectedStyle.Render(formatLease(m.leaseChoices[m.pendingLease])) + dimStyle.Render(" (←/→ to change)") + "\n")
 			b.WriteString(dimStyle.Render("  Verify this matches the guest's own displayed fingerprint out of band before accepting.") + "\n\n")
 		} else if m.connectedGuestId != "" {
 			b.WriteString(labelStyle.Render("Connected guest: ") + successStyle.Render(m.connectedGuestId) + "\n")
-			b.WriteString(labelStyle.Render("  Guest fingerprint: ") + m.connectedGuestFingerprint + "\n\n")
+			b.WriteString(labelStyle.Render("  Guest fingerprint: ") + m.connectedGuestFingerprint + "\n")
+			if m.leaseEnded {
+				b.WriteString(labelStyle.Render("  Lease: ") + errorStyle.Render("ended") + "\n")
+			} else if !m.leaseExpiresAt.IsZero() {
+				b.WriteString(labelStyle.Render("  Lease: ") + formatLease(time.Until(m.leaseExpiresAt)) + " left\n")
+			}
+			if m.kicking {
+				b.WriteString(promptStyle.Render(fmt.Sprintf("Remove %s from the room — reason (optional): ", m.connectedGuestId)) + m.kickReason.view() + "\n")
+				b.WriteString(dimStyle.Render("  enter to remove the guest, esc to keep it") + "\n")
+			}
+			b.WriteString("\n")
 		} else {
 			b.WriteString(dimStyle.Render("Waiting for guests to join...") + "\n\n")
 		}
+		if len(m.joinQueue) > 0 {
+			b.WriteString(labelStyle.Render(fmt.Sprintf("Waiting to join (%d): ", len(m.joinQueue))) + strings.Join(m.joinQueue, ", ") + "\n\n")
+		}
 		if len(m.activity) > 0 {
 			b.WriteString(labelStyle.Render("Activity:") + "\n")
 			for _, line := range m.activity {
@@ -386,7 +719,18 @@ func (m *shareModel) View() string {
 			}
 			b.WriteString("\n")
 		}
-		b.WriteString(helpStyle.Render("q quit"))
+		if chat := m.chat.view(); chat != "" {
+			b.WriteString(chat + "\n")
+		}
+		var help []string
+		if !m.leaseExpiresAt.IsZero() {
+			help = append(help, fmt.Sprintf("e extend lease by %s", formatLease(leaseExtension)), "r revoke lease")
+		}
+		if m.connectedGuestId != "" && !m.kicking && !m.chat.typing {
+			help = append(help, "c chat", "k remove guest")
+		}
+		help = append(help, "q quit")
+		b.WriteString(helpStyle.Render(strings.Join(help, " · ")))
 	case shareStageSessionTimeout:
 		b.WriteString(errorStyle.Render("Session timeout reached — closing the room.") + "\n\n")
 	case shareStageError:
@@ -396,3 +740,11 @@ func (m *shareModel) View() string {
 
 	return layoutWithFooter(b.String(), m.stats.render(), m.height)
 }
+
+// formatLease describes a lease, to the second; 0 is no time limit.
+func formatLease(lease time.Duration) string {
+	if lease <= 0 {
+		return "no time limit"
+	}
+	return lease.Round(time.Second).String()
+}
@@ -5,13 +5,15 @@ import (
 	"adb-remote.maci.team/client/controller"
 	"context"
 	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 )
 
 func TestShareModelInitFetchesDevicesWhenNoPreset(t *testing.T) {
-	m := newShareModel(context.Background(), nil, "", false, "FP-TEST", nil)
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
 	if m.stage != shareStageLoadingDevices {
 		t.Fatalf("expected stage %v, got %v", shareStageLoadingDevices, m.stage)
 	}
@@ -21,7 +23,7 @@ func TestShareModelInitFetchesDevicesWhenNoPreset(t *testing.T) {
 }
 
 func TestShareModelInitSkipsPickerWithPresetDevice(t *testing.T) {
-	m := newShareModel(context.Background(), nil, "emulator-5554", false, "FP-TEST", nil)
+	m := newShareModel(context.Background(), nil, []string{"emulator-5554"}, false, 0, "FP-TEST", nil)
 	if m.stage != shareStageConnecting {
 		t.Fatalf("expected stage %v, got %v", shareStageConnecting, m.stage)
 	}
@@ -31,9 +33,9 @@ func TestShareModelInitSkipsPickerWithPresetDevice(t *testing.T) {
 		t.Fatalf("expected the transfer-stats ticker command even with a preset device")
 	}
 	select {
-	case device := <-m.selectedDevice:
-		if device != "emulator-5554" {
-			t.Fatalf("expected the preset device id, got %q", device)
+	case devices := <-m.selectedDevices:
+		if len(devices) != 1 || devices[0] != "emulator-5554" {
+			t.Fatalf("expected the preset device id, got %v", devices)
 		}
 	default:
 		t.Fatalf("expected the preset device id to already be queued")
@@ -41,7 +43,7 @@ func TestShareModelInitSkipsPickerWithPresetDevice(t *testing.T) {
 }
 
 func TestShareModelDevicesLoadedPopulatesList(t *testing.T) {
-	m := newShareModel(context.Background(), nil, "", false, "FP-TEST", nil)
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
 	devices := []adb.Device{{Id: "emulator-5554", Type: adb.TypeDevice}, {Id: "R58M", Type: adb.TypeDevice}}
 	updated, _ := m.Update(devicesLoadedMsg{devices: devices})
 	sm := updated.(*shareModel)
@@ -53,8 +55,44 @@ func TestShareModelDevicesLoadedPopulatesList(t *testing.T) {
 	}
 }
 
+func TestShareModelKeepsWaitingForTrackedDevices(t *testing.T) {
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
+	updates := make(chan []adb.Device, 1)
+	_, cmd := m.Update(devicesLoadedMsg{devices: []adb.Device{{Id: "emulator-5554", Type: adb.TypeDevice}}, updates: updates})
+	if cmd == nil {
+		t.Fatalf("expected a command waiting for the next tracked update")
+	}
+	updates <- []adb.Device{{Id: "emulator-5554", Type: adb.TypeDevice}, {Id: "R58M", Type: adb.TypeDevice}}
+	msg, ok := cmd().(devicesLoadedMsg)
+	if !ok || len(msg.devices) != 2 {
+		t.Fatalf("expected the next update as a devicesLoadedMsg, got %+v", msg)
+	}
+
+	m.selectDevices([]string{"emulator-5554"})
+	if m.trackingCtx.Err() == nil {
+		t.Fatalf("expected picking devices to stop tracking")
+	}
+	updated, cmd := m.Update(msg)
+	if sm := updated.(*shareModel); sm.stage != shareStageConnecting || cmd != nil {
+		t.Fatalf("expected a late update to be ignored once devices are picked, got stage %v", sm.stage)
+	}
+}
+
+func TestShareModelShowsOfflineSharedDevice(t *testing.T) {
+	m := newShareModel(context.Background(), nil, []string{"emulator-5554", "R58M"}, false, 0, "FP-TEST", nil)
+	m.handleOwnerEvent(controller.OwnerEvent{Kind: controller.OwnerRoomCreated, RoomId: "ROOM1"})
+	m.handleOwnerEvent(controller.OwnerEvent{Kind: controller.OwnerDeviceOffline, Device: "R58M", DeviceState: "offline"})
+	if view := m.View(); !strings.Contains(view, "R58M (offline)") || !strings.Contains(view, "Device R58M went offline") {
+		t.Fatalf("expected the view to show R58M offline, got:\n%s", view)
+	}
+	m.handleOwnerEvent(controller.OwnerEvent{Kind: controller.OwnerDeviceOnline, Device: "R58M", DeviceState: "device"})
+	if view := m.View(); strings.Contains(view, "R58M (offline)") || !strings.Contains(view, "Device R58M is back online") {
+		t.Fatalf("expected the view to show R58M back online, got:\n%s", view)
+	}
+}
+
 func TestShareModelDevicesLoadedError(t *testing.T) {
-	m := newShareModel(context.Background(), nil, "", false, "FP-TEST", nil)
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
 	wantErr := errors.New("adb not running")
 	updated, _ := m.Update(devicesLoadedMsg{err: wantErr})
 	sm := updated.(*shareModel)
@@ -64,7 +102,7 @@ func TestShareModelDevicesLoadedError(t *testing.T) {
 }
 
 func TestShareModelCursorNavigation(t *testing.T) {
-	m := newShareModel(context.Background(), nil, "", false, "FP-TEST", nil)
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
 	m.stage = shareStageSelectDevice
 	m.devices = []adb.Device{{Id: "a"}, {Id: "b"}, {Id: "c"}}
 
@@ -88,7 +126,7 @@ func TestShareModelCursorNavigation(t *testing.T) {
 }
 
 func TestShareModelEnterSelectsDevice(t *testing.T) {
-	m := newShareModel(context.Background(), nil, "", false, "FP-TEST", nil)
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
 	m.stage = shareStageSelectDevice
 	m.devices = []adb.Device{{Id: "emulator-5554"}, {Id: "R58M"}}
 	m.cursor = 1
@@ -99,17 +137,46 @@ func TestShareModelEnterSelectsDevice(t *testing.T) {
 		t.Fatalf("expected stage %v, got %v", shareStageConnecting, m.stage)
 	}
 	select {
-	case device := <-m.selectedDevice:
-		if device != "R58M" {
-			t.Fatalf("expected the highlighted device id, got %q", device)
+	case devices := <-m.selectedDevices:
+		if len(devices) != 1 || devices[0] != "R58M" {
+			t.Fatalf("expected the highlighted device id, got %v", devices)
 		}
 	default:
 		t.Fatalf("expected the selected device id to be queued")
 	}
 }
 
+func TestShareModelSpaceMarksSeveralDevices(t *testing.T) {
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
+	m.stage = shareStageSelectDevice
+	m.devices = []adb.Device{{Id: "emulator-5554"}, {Id: "R58M"}, {Id: "emulator-5556"}}
+
+	// Mark the last device, then the first; unmark and re-mark the last.
+	keys := []tea.KeyMsg{
+		{Type: tea.KeyDown}, {Type: tea.KeyDown}, {Type: tea.KeySpace, Runes: []rune(" ")},
+		{Type: tea.KeyUp}, {Type: tea.KeyUp}, {Type: tea.KeySpace, Runes: []rune(" ")},
+		{Type: tea.KeyDown}, {Type: tea.KeyDown}, {Type: tea.KeySpace, Runes: []rune(" ")}, {Type: tea.KeySpace, Runes: []rune(" ")},
+		{Type: tea.KeyEnter},
+	}
+	for _, key := range keys {
+		updated, _ := m.Update(key)
+		m = updated.(*shareModel)
+	}
+	select {
+	case devices := <-m.selectedDevices:
+		if strings.Join(devices, ",") != "emulator-5554,emulator-5556" {
+			t.Fatalf("expected the marked devices in list order, got %v", devices)
+		}
+	default:
+		t.Fatalf("expected the marked device ids to be queued")
+	}
+	if m.stage != shareStageConnecting || len(m.shared) != 2 {
+		t.Fatalf("expected to be connecting with 2 shared devices, got stage %v, %v", m.stage, m.shared)
+	}
+}
+
 func TestShareModelRefreshReturnsFetchCommand(t *testing.T) {
-	m := newShareModel(context.Background(), nil, "", false, "FP-TEST", nil)
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
 	m.stage = shareStageSelectDevice
 	updated, cmd := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("r")})
 	m = updated.(*shareModel)
@@ -122,7 +189,7 @@ func TestShareModelRefreshReturnsFetchCommand(t *testing.T) {
 }
 
 func TestShareModelHandlesOwnerRoomCreated(t *testing.T) {
-	m := newShareModel(context.Background(), nil, "", false, "FP-TEST", nil)
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
 	updated, _ := m.Update(ownerEventMsg{Kind: controller.OwnerRoomCreated, RoomId: "ROOM42"})
 	m = updated.(*shareModel)
 	if m.stage != shareStageRoomActive {
@@ -134,7 +201,7 @@ func TestShareModelHandlesOwnerRoomCreated(t *testing.T) {
 }
 
 func TestShareModelLogsJoinActivity(t *testing.T) {
-	m := newShareModel(context.Background(), nil, "", false, "FP-TEST", nil)
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
 	updated, _ := m.Update(ownerEventMsg{Kind: controller.OwnerJoinRequested, GuestClientId: "GUEST1"})
 	m = updated.(*shareModel)
 	updated, _ = m.Update(ownerEventMsg{Kind: controller.OwnerJoinDecided, GuestClientId: "GUEST1", Accepted: true})
@@ -144,8 +211,44 @@ func TestShareModelLogsJoinActivity(t *testing.T) {
 	}
 }
 
+func TestShareModelLogsTrustedRejoins(t *testing.T) {
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
+	updated, _ := m.Update(ownerEventMsg{Kind: controller.OwnerJoinDecided, GuestClientId: "GUEST2", Accepted: true, Rejoined: true})
+	m = updated.(*shareModel)
+	if m.connectedGuestId != "GUEST2" {
+		t.Fatalf("expected the re-joined guest to be tracked as connected, got %q", m.connectedGuestId)
+	}
+	if len(m.activity) != 1 || !strings.Contains(m.activity[0], "re-joined") {
+		t.Fatalf("expected the re-join to be logged, got %v", m.activity)
+	}
+}
+
+func TestShareModelLogsDeniedServices(t *testing.T) {
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
+	updated, _ := m.Update(ownerEventMsg{Kind: controller.OwnerServiceDenied, Service: "reboot:", Err: errors.New("matches deny rule")})
+	m = updated.(*shareModel)
+	if len(m.activity) != 1 || !strings.Contains(m.activity[0], "reboot:") {
+		t.Fatalf("expected the denied service in the activity feed, got %v", m.activity)
+	}
+}
+
+func TestShareModelShowsTheJoinQueue(t *testing.T) {
+	m := newShareModel(context.Background(), nil, []string{"emulator-5554"}, false, 0, "FP-TEST", nil)
+	updated, _ := m.Update(ownerEventMsg{Kind: controller.OwnerRoomCreated, RoomId: "ROOM1"})
+	updated, _ = updated.Update(ownerEventMsg{Kind: controller.OwnerJoinQueueChanged, Queue: []string{"GUEST2", "GUEST3"}})
+	m = updated.(*shareModel)
+	if view := m.View(); !strings.Contains(view, "Waiting to join (2)") || !strings.Contains(view, "GUEST2, GUEST3") {
+		t.Fatalf("expected the waiting guests in the view, got:\n%s", view)
+	}
+	updated, _ = m.Update(ownerEventMsg{Kind: controller.OwnerJoinQueueChanged})
+	m = updated.(*shareModel)
+	if strings.Contains(m.View(), "Waiting to join") {
+		t.Fatalf("expected the empty join queue to be hidden")
+	}
+}
+
 func TestShareModelTracksConnectedGuestOnAccept(t *testing.T) {
-	m := newShareModel(context.Background(), nil, "", false, "FP-TEST", nil)
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
 	guestPublicKey := []byte{0x01, 0x02, 0x03}
 	updated, _ := m.Update(ownerEventMsg{Kind: controller.OwnerJoinDecided, GuestClientId: "GUEST1", GuestPublicKey: guestPublicKey, Accepted: true})
 	m = updated.(*shareModel)
@@ -158,7 +261,7 @@ func TestShareModelTracksConnectedGuestOnAccept(t *testing.T) {
 }
 
 func TestShareModelDoesNotTrackConnectedGuestOnDecline(t *testing.T) {
-	m := newShareModel(context.Background(), nil, "", false, "FP-TEST", nil)
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
 	updated, _ := m.Update(ownerEventMsg{Kind: controller.OwnerJoinDecided, GuestClientId: "GUEST1", Accepted: false})
 	m = updated.(*shareModel)
 	if m.connectedGuestId != "" {
@@ -167,7 +270,7 @@ func TestShareModelDoesNotTrackConnectedGuestOnDecline(t *testing.T) {
 }
 
 func TestShareModelClearsConnectedGuestOnGuestLeft(t *testing.T) {
-	m := newShareModel(context.Background(), nil, "", false, "FP-TEST", nil)
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
 	updated, _ := m.Update(ownerEventMsg{Kind: controller.OwnerJoinDecided, GuestClientId: "GUEST1", GuestPublicKey: []byte{1, 2, 3}, Accepted: true})
 	m = updated.(*shareModel)
 	if m.connectedGuestId != "GUEST1" {
@@ -185,7 +288,7 @@ func TestShareModelClearsConnectedGuestOnGuestLeft(t *testing.T) {
 }
 
 func TestShareModelGuestLeftClearsPendingPrompt(t *testing.T) {
-	m := newShareModel(context.Background(), nil, "", false, "FP-TEST", nil)
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
 	m.stage = shareStageRoomActive
 	respond := make(chan bool, 1)
 	updated, _ := m.Update(joinRequestMsg{clientId: "GUEST1", fingerprint: "FP-GUEST", respond: respond})
@@ -206,8 +309,145 @@ func TestShareModelGuestLeftClearsPendingPrompt(t *testing.T) {
 	}
 }
 
+func TestShareModelJoinDecidedElsewhereClearsPendingPrompt(t *testing.T) {
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
+	m.stage = shareStageRoomActive
+	updated, _ := m.Update(joinRequestMsg{clientId: "GUEST1", respond: make(chan bool, 1)})
+	m = updated.(*shareModel)
+
+	updated, _ = m.Update(ownerEventMsg{Kind: controller.OwnerJoinDecided, GuestClientId: "GUEST1", Accepted: true})
+	m = updated.(*shareModel)
+	if m.pendingGuestId != "" || m.pendingRespond != nil {
+		t.Fatalf("expected the prompt to go away once the request was decided over the control socket, got %+v", m)
+	}
+	if m.connectedGuestId != "GUEST1" {
+		t.Fatalf("expected GUEST1 to be tracked as connected, got %q", m.connectedGuestId)
+	}
+}
+
+func TestShareModelGrantsTheLeasePickedAtThePrompt(t *testing.T) {
+	m := newShareModel(context.Background(), nil, nil, false, 30*time.Minute, "FP-TEST", nil)
+	m.stage = shareStageRoomActive
+	updated, _ := m.Update(joinRequestMsg{clientId: "GUEST1", respond: make(chan bool, 1)})
+	m = updated.(*shareModel)
+	if lease := m.leaseChoices[m.pendingLease]; lease != 30*time.Minute {
+		t.Fatalf("expected the prompt to offer the default lease first, got %s", lease)
+	}
+
+	for _, key := range []tea.KeyMsg{{Type: tea.KeyRight}, {Type: tea.KeyRunes, Runes: []rune("y")}} {
+		updated, _ = m.Update(key)
+		m = updated.(*shareModel)
+	}
+	if lease := m.grantLease("GUEST1", nil); lease != time.Hour {
+		t.Fatalf("expected the picked lease of an hour, got %s", lease)
+	}
+	if lease := m.grantLease("GUEST2", nil); lease != 30*time.Minute {
+		t.Fatalf("expected a guest the prompt didn't decide about to get the default lease, got %s", lease)
+	}
+}
+
+func TestShareModelFollowsTheGuestsLease(t *testing.T) {
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
+	m.stage = shareStageRoomActive
+	m.roomId = "ROOM1"
+	for _, e := range []controller.OwnerEvent{
+		{Kind: controller.OwnerJoinDecided, GuestClientId: "GUEST1", Accepted: true},
+		{Kind: controller.OwnerLeaseChanged, GuestClientId: "GUEST1", Lease: time.Hour},
+	} {
+		updated, _ := m.Update(ownerEventMsg(e))
+		m = updated.(*shareModel)
+	}
+	if view := m.View(); !strings.Contains(view, "left") || !strings.Contains(view, "e extend lease") {
+		t.Fatalf("expected the lease and how to extend it to be shown, got:\n%s", view)
+	}
+
+	updated, _ := m.Update(ownerEventMsg{Kind: controller.OwnerLeaseEnded, GuestClientId: "GUEST1", Revoked: true})
+	m = updated.(*shareModel)
+	if !m.leaseEnded || !strings.Contains(m.activity[len(m.activity)-1], "revoked") {
+		t.Fatalf("expected the revoked lease to be shown, got %v", m.activity)
+	}
+}
+
+func TestShareModelKicksTheGuestWithAReason(t *testing.T) {
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
+	m.stage = shareStageRoomActive
+	updated, _ := m.Update(ownerEventMsg{Kind: controller.OwnerJoinDecided, GuestClientId: "GUEST1", Accepted: true})
+	m = updated.(*shareModel)
+	if view := m.View(); !strings.Contains(view, "k remove guest") {
+		t.Fatalf("expected the kick key to be offered, got:\n%s", view)
+	}
+
+	for _, key := range []tea.KeyMsg{{Type: tea.KeyRunes, Runes: []rune("k")}, {Type: tea.KeyRunes, Runes: []rune("q")}, {Type: tea.KeyEsc}} {
+		updated, cmd := m.Update(key)
+		m = updated.(*shareModel)
+		if cmd != nil {
+			t.Fatalf("expected %v not to quit or kick while typing the reason", key)
+		}
+	}
+	if m.kicking {
+		t.Fatalf("expected esc to keep the guest")
+	}
+
+	var cmd tea.Cmd
+	for _, key := range []tea.KeyMsg{{Type: tea.KeyRunes, Runes: []rune("k")}, {Type: tea.KeyRunes, Runes: []rune("bye")}} {
+		updated, _ = m.Update(key)
+		m = updated.(*shareModel)
+	}
+	if view := m.View(); !strings.Contains(view, "Remove GUEST1 from the room") || !strings.Contains(view, "bye") {
+		t.Fatalf("expected the reason prompt, got:\n%s", view)
+	}
+	updated, cmd = m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	m = updated.(*shareModel)
+	if cmd == nil || m.kicking {
+		t.Fatalf("expected enter to kick the guest")
+	}
+	// The Kicker isn't serving a room here, so it knows of no guest.
+	if msg, ok := cmd().(kickErrorMsg); !ok || !errors.Is(msg.err, controller.ErrNoGuest) {
+		t.Fatalf("expected the kick to reach the Kicker, got %#v", msg)
+	}
+
+	updated, _ = m.Update(ownerEventMsg{Kind: controller.OwnerGuestKicked, GuestClientId: "GUEST1", Reason: "bye"})
+	m = updated.(*shareModel)
+	if line := m.activity[len(m.activity)-1]; !strings.Contains(line, "removed from the room (bye)") {
+		t.Fatalf("expected the kick to be logged, got %q", line)
+	}
+}
+
+func TestShareModelChatsWithTheGuest(t *testing.T) {
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
+	m.stage = shareStageRoomActive
+	updated, _ := m.Update(ownerEventMsg{Kind: controller.OwnerJoinDecided, GuestClientId: "GUEST1", Accepted: true})
+	m = updated.(*shareModel)
+	if view := m.View(); !strings.Contains(view, "c chat") {
+		t.Fatalf("expected the chat key to be offered, got:\n%s", view)
+	}
+
+	var cmd tea.Cmd
+	for _, key := range []tea.KeyMsg{{Type: tea.KeyRunes, Runes: []rune("c")}, {Type: tea.KeyRunes, Runes: []rune("q")}, {Type: tea.KeyEnter}} {
+		updated, cmd = m.Update(key)
+		m = updated.(*shareModel)
+	}
+	if cmd == nil {
+		t.Fatalf("expected enter to send what was typed")
+	}
+	// The Chat isn't serving a room here, so there's nobody to send it to.
+	updated, _ = m.Update(cmd())
+	m = updated.(*shareModel)
+	updated, _ = m.Update(ownerEventMsg{Kind: controller.OwnerChatMessage, GuestClientId: "GUEST1", Text: "Hello!", SentAt: time.Now()})
+	m = updated.(*shareModel)
+	if view := m.View(); !strings.Contains(view, "not sent: "+controller.ErrNoChatPeer.Error()) || !strings.Contains(view, "GUEST1: Hello!") {
+		t.Fatalf("expected the chat pane to show the messages, got:\n%s", view)
+	}
+
+	updated, _ = m.Update(ownerEventMsg{Kind: controller.OwnerGuestLeft})
+	m = updated.(*shareModel)
+	if m.chat.typing {
+		t.Fatalf("expected typing to stop once the guest left")
+	}
+}
+
 func TestShareModelJoinRequestPromptAcceptDecline(t *testing.T) {
-	m := newShareModel(context.Background(), nil, "", false, "FP-TEST", nil)
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
 	m.stage = shareStageRoomActive
 	respond := make(chan bool, 1)
 
@@ -233,7 +473,7 @@ func TestShareModelJoinRequestPromptAcceptDecline(t *testing.T) {
 }
 
 func TestShareModelJoinRequestDecline(t *testing.T) {
-	m := newShareModel(context.Background(), nil, "", false, "FP-TEST", nil)
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
 	m.stage = shareStageRoomActive
 	respond := make(chan bool, 1)
 	updated, _ := m.Update(joinRequestMsg{clientId: "GUEST1", respond: respond})
@@ -252,7 +492,7 @@ func TestShareModelJoinRequestDecline(t *testing.T) {
 }
 
 func TestShareModelSessionTimeoutQuits(t *testing.T) {
-	m := newShareModel(context.Background(), nil, "", false, "FP-TEST", nil)
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
 	m.stage = shareStageRoomActive
 	updated, cmd := m.Update(sessionTimeoutMsg{})
 	sm := updated.(*shareModel)
@@ -268,7 +508,7 @@ func TestShareModelSessionTimeoutQuits(t *testing.T) {
 }
 
 func TestShareModelErrorStage(t *testing.T) {
-	m := newShareModel(context.Background(), nil, "", false, "FP-TEST", nil)
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
 	wantErr := errors.New("transporter connection lost")
 	updated, _ := m.Update(shareErrorMsg{wantErr})
 	m = updated.(*shareModel)
@@ -278,7 +518,7 @@ func TestShareModelErrorStage(t *testing.T) {
 }
 
 func TestShareModelQuit(t *testing.T) {
-	m := newShareModel(context.Background(), nil, "", false, "FP-TEST", nil)
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
 	m.stage = shareStageSelectDevice
 	_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("q")})
 	if cmd == nil {
@@ -294,7 +534,7 @@ func TestShareModelPendingRespondSwallowsQuit(t *testing.T) {
 	// must not be treated as global quit either (only y/n/ctrl+c apply),
 	// so the operator can't accidentally exit the TUI mid-decision without
 	// noticing.
-	m := newShareModel(context.Background(), nil, "", false, "FP-TEST", nil)
+	m := newShareModel(context.Background(), nil, nil, false, 0, "FP-TEST", nil)
 	m.stage = shareStageRoomActive
 	respond := make(chan bool, 1)
 	m.pendingGuestId = "GUEST1"
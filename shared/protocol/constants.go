@@ -1,9 +1,43 @@
 package protocol
 
-const ProtocolVersion uint32 = 0x0001
+// ProtocolVersion 2 added multi-device rooms: the join room result lists
+// the room's devices, and every CommandAdbTransport payload names the
+// device its ADB message is for (see TransporterMessagePayloadAdbTransport).
+// Version 3 added each device's adb features to the join room result.
+// Version 4 added reserved room ids to the create room request (see
+// TransporterMessagePayloadCreateRoom). Version 5 added the team room
+// directory (CommandPublishRoom, CommandListRooms). Version 6 added
+// session leases (CommandSessionLease). Version 7 added the join queue of
+// busy rooms (CommandQueuePosition, CommandJoinQueue). Version 8 added
+// removing the guest from a room (CommandKickGuest). Version 9 added
+// in-session chat (CommandChatMessage). Version 10 added the owner's
+// signature to room listings (see TransporterMessagePayloadPublishRoom).
+// Version 11 added the guest's signature to join requests (see
+// TransporterMessagePayloadConnectRoom).
+const ProtocolVersion uint32 = 0x000B
 const MaxPayloadSize uint32 = 0xF000
 const HeaderSize uint32 = 0x000C //3 int size field
 
+// MaxRoomDevices bounds how many devices a single room can share.
+const MaxRoomDevices = 32
+
+// MaxChatMessageLength bounds the bytes of a chat message's text.
+const MaxChatMessageLength = 1024
+
+// MaxListedRooms bounds how many rooms a room list carries, and
+// MaxListingModels, MaxListingTags and MaxListingTextLength what a single
+// room's listing does, so that a whole list fits in one message.
+const (
+	MaxListedRooms       = 32
+	MaxListingModels     = 8
+	MaxListingTags       = 8
+	MaxListingTextLength = 64
+)
+
+// MaxJoinQueue bounds how many guests can wait to join a room while
+// another one is in it.
+const MaxJoinQueue = 8
+
 const (
 	CommandConnect      uint32 = 0x0001
 	CommandReconnect    uint32 = 0x0002
@@ -15,6 +49,61 @@ const (
 	// active room. The owner's own transporter connection is unaffected by
 	// this, so it has no other way to learn the guest is gone.
 	CommandGuestLeft uint32 = 0x0007
+	// CommandDeviceState is sent by the room owner, and forwarded by the
+	// transporter to the guest (no response expected), whenever one of the
+	// room's devices changes state, e.g. is unplugged or comes back (see
+	// TransporterMessagePayloadDeviceState).
+	CommandDeviceState uint32 = 0x0008
+	// CommandDeviceInfo is sent by the room owner, and forwarded by the
+	// transporter to the guest (no response expected), once per shared
+	// device right after accepting the guest, and again whenever a device
+	// comes back online (see TransporterMessagePayloadDeviceInfo).
+	CommandDeviceInfo uint32 = 0x0009
+	// CommandPublishRoom is sent by a room owner to list its room in a
+	// team's room directory, for as long as the room exists (see
+	// TransporterMessagePayloadPublishRoom). The response has no payload.
+	CommandPublishRoom uint32 = 0x000A
+	// CommandListRooms asks for the rooms listed in a team's room
+	// directory (see TransporterMessagePayloadListRooms); the response
+	// carries a TransporterMessagePayloadRoomList.
+	CommandListRooms uint32 = 0x000B
+	// CommandSessionLease is sent by the room owner, and forwarded by the
+	// transporter to the guest (no response expected), whenever the guest's
+	// session lease is granted, extended, revoked or runs out (see
+	// TransporterMessagePayloadSessionLease).
+	CommandSessionLease uint32 = 0x000C
+	// CommandQueuePosition is sent by the transporter (no response
+	// expected) to a guest whose join request waits in the room's join
+	// queue because another guest is in the room, and again whenever its
+	// place in the queue changes (see TransporterMessagePayloadQueuePosition).
+	// Its join request goes to the owner once it's first in line and the
+	// room is free; the join room response comes as usual then.
+	CommandQueuePosition uint32 = 0x000D
+	// CommandJoinQueue is sent by the transporter to the room owner (no
+	// response expected) whenever the room's join queue changes (see
+	// TransporterMessagePayloadJoinQueue).
+	CommandJoinQueue uint32 = 0x000E
+	// CommandKickGuest is sent by the room owner (no response expected) to
+	// remove its guest from the room, with the reason it gives (see
+	// TransporterMessagePayloadKickGuest). The transporter forwards it to
+	// the guest, takes the guest out of the room without closing its
+	// connection, and tells the owner with CommandGuestLeft.
+	CommandKickGuest uint32 = 0x000F
+	// CommandChatMessage is sent by the room owner or its guest, and
+	// forwarded by the transporter to the other one (no response
+	// expected), to chat within the session (see
+	// TransporterMessagePayloadChatMessage).
+	CommandChatMessage uint32 = 0x0010
+)
+
+// Session lease states, as TransporterMessagePayloadSessionLease.State.
+const (
+	// LeaseActive is a lease with RemainingSeconds left.
+	LeaseActive = 0
+	// LeaseExpired is a lease that ran out.
+	LeaseExpired = 1
+	// LeaseRevoked is a lease the owner ended early.
+	LeaseRevoked = 2
 )
 
 const CommandResponseMask uint32 = 0x1000
@@ -28,4 +117,14 @@ const (
 	ErrorFull                 int = 0x0004
 	ErrorNoParticipant        int = 0x0005
 	ErrorInvalidPayload       int = 0x0006
+	// ErrorRoomReserved answers a create room request for a room id that
+	// is reserved for another identity, or is in use by a room that isn't
+	// reserved.
+	ErrorRoomReserved int = 0x0007
+	// ErrorInvalidSignature answers a create room request for a reserved
+	// room id whose signature doesn't verify (see RoomReservationMessage).
+	ErrorInvalidSignature int = 0x0008
+	// ErrorTeamAccessDenied answers a room directory request for a team
+	// the transporter doesn't know, or with the wrong team token.
+	ErrorTeamAccessDenied int = 0x0009
 )
@@ -93,6 +93,68 @@ func (m *TransporterMessage) SetPayloadConnectResponse(data *TransporterMessageP
 
 //endregion
 
+// region Create room payload
+
+// TransporterMessagePayloadCreateRoom asks for a room. With an empty RoomId
+// the transporter picks a random one; otherwise the owner asks for RoomId
+// itself, reserved for its identity: PublicKey is the owner's identity
+// public key (see client/identity) and Signature its Ed25519 signature of
+// RoomReservationMessage(RoomId, the owner's client id). The first identity
+// to ask for a room id gets it reserved; only that identity can create the
+// room under that id from then on.
+type TransporterMessagePayloadCreateRoom struct {
+	RoomId    string
+	PublicKey []byte
+	Signature []byte
+}
+
+func (m *TransporterMessage) GetPayloadCreateRoom() (*TransporterMessagePayloadCreateRoom, error) {
+	offset, roomId, err := m.readString(0)
+	if err != nil {
+		return nil, err
+	}
+	offset, publicKey, err := m.readString(offset)
+	if err != nil {
+		return nil, err
+	}
+	_, signature, err := m.readString(offset)
+	if err != nil {
+		return nil, err
+	}
+	return &TransporterMessagePayloadCreateRoom{
+		RoomId:    roomId,
+		PublicKey: []byte(publicKey),
+		Signature: []byte(signature),
+	}, nil
+}
+
+func (m *TransporterMessage) SetPayloadCreateRoom(data *TransporterMessagePayloadCreateRoom) error {
+	offset, err := m.writeString(0, data.RoomId)
+	if err != nil {
+		return err
+	}
+	offset, err = m.writeString(offset, string(data.PublicKey))
+	if err != nil {
+		return err
+	}
+	payloadLength, err := m.writeString(offset, string(data.Signature))
+	if err != nil {
+		return err
+	}
+	m.updatePayloadMetadata(payloadLength)
+	return nil
+}
+
+// RoomReservationMessage is what an owner signs to create its reserved
+// room roomId. Binding the signature to clientId, which the transporter
+// assigned to this very connection, keeps it from being replayed on
+// another one.
+func RoomReservationMessage(roomId string, clientId string) []byte {
+	return []byte("adb-remote room reservation\x00" + roomId + "\x00" + clientId)
+}
+
+//endregion
+
 // region Create room response
 type TransporterMessagePayloadCreateRoomResponse struct {
 	RoomId string
@@ -122,15 +184,20 @@ func (m *TransporterMessage) SetPayloadCreateRoomResponse(data *TransporterMessa
 // region Connect to room payload
 
 // TransporterMessagePayloadConnectRoom carries a join request in both
-// directions: the guest sends {RoomId, PublicKey} to the transporter, which
-// forwards {RoomId, ClientId, PublicKey} to the room owner once it knows
-// which guest sent it. PublicKey is the guest's identity public key (see
-// client/identity); the owner displays its fingerprint so the operator can
-// verify the guest's identity out of band before accepting.
+// directions: the guest sends {RoomId, PublicKey, Signature} to the
+// transporter, which forwards {RoomId, ClientId, PublicKey, Signature} to
+// the room owner once it knows which guest sent it. PublicKey is the
+// guest's identity public key (see client/identity); the owner displays
+// its fingerprint so the operator can verify the guest's identity out of
+// band before accepting. Signature is the guest's Ed25519 signature of
+// RoomJoinMessage(RoomId, ClientId), proving it holds the identity's
+// private key: a public key alone is no secret, so the owner disregards a
+// request whose signature doesn't verify.
 type TransporterMessagePayloadConnectRoom struct {
 	RoomId    string
 	ClientId  string
 	PublicKey []byte
+	Signature []byte
 }
 
 func (m *TransporterMessage) GetPayloadConnectRoom() (*TransporterMessagePayloadConnectRoom, error) {
@@ -142,7 +209,11 @@ func (m *TransporterMessage) GetPayloadConnectRoom() (*TransporterMessagePayload
 	if err != nil {
 		return nil, err
 	}
-	_, publicKey, err := m.readString(offset)
+	offset, publicKey, err := m.readString(offset)
+	if err != nil {
+		return nil, err
+	}
+	_, signature, err := m.readString(offset)
 	if err != nil {
 		return nil, err
 	}
@@ -150,6 +221,7 @@ func (m *TransporterMessage) GetPayloadConnectRoom() (*TransporterMessagePayload
 		RoomId:    roomId,
 		ClientId:  clientId,
 		PublicKey: []byte(publicKey),
+		Signature: []byte(signature),
 	}, nil
 }
 
@@ -162,7 +234,11 @@ func (m *TransporterMessage) SetPayloadConnectRoom(data *TransporterMessagePaylo
 	if err != nil {
 		return err
 	}
-	payloadLength, err := m.writeString(offset, string(data.PublicKey))
+	offset, err = m.writeString(offset, string(data.PublicKey))
+	if err != nil {
+		return err
+	}
+	payloadLength, err := m.writeString(offset, string(data.Signature))
 	if err != nil {
 		return err
 	}
@@ -170,6 +246,13 @@ func (m *TransporterMessage) SetPayloadConnectRoom(data *TransporterMessagePaylo
 	return nil
 }
 
+// RoomJoinMessage is what a guest signs to join roomId. Binding the
+// signature to clientId, which the transporter assigned to the guest's
+// very connection, keeps it from being replayed on another one.
+func RoomJoinMessage(roomId string, clientId string) []byte {
+	return []byte("adb-remote room join\x00" + roomId + "\x00" + clientId)
+}
+
 //endregion
 
 // region Connect to room response
@@ -183,11 +266,17 @@ func (m *TransporterMessage) SetPayloadConnectRoom(data *TransporterMessagePaylo
 // TransporterMessagePayloadConnectRoom's ClientId is filled in for the
 // guest->owner direction. The guest displays the owner's fingerprint so the
 // operator can verify it out of band, symmetric with the owner verifying
-// the guest's.
+// the guest's. Devices lists the serials of the devices the room shares, in
+// the order TransporterMessagePayloadAdbTransport.Device indexes them, and
+// Features the adb features each of them supports, comma-separated as adb
+// itself reports them (empty when the owner couldn't find out); both are
+// only meaningful when Accepted.
 type TransporterMessagePayloadConnectRoomResult struct {
 	Accepted  int //0 = false, anything else true
 	ClientId  string
 	PublicKey []byte
+	Devices   []string
+	Features  []string
 }
 
 func (m *TransporterMessage) GetPayloadConnectRoomResponse() (*TransporterMessagePayloadConnectRoomResult, error) {
@@ -199,7 +288,15 @@ func (m *TransporterMessage) GetPayloadConnectRoomResponse() (*TransporterMessag
 	if err != nil {
 		return nil, err
 	}
-	_, publicKey, err := m.readString(offset)
+	offset, publicKey, err := m.readString(offset)
+	if err != nil {
+		return nil, err
+	}
+	offset, devices, err := m.readDeviceList(offset)
+	if err != nil {
+		return nil, err
+	}
+	_, features, err := m.readDeviceList(offset)
 	if err != nil {
 		return nil, err
 	}
@@ -207,6 +304,8 @@ func (m *TransporterMessage) GetPayloadConnectRoomResponse() (*TransporterMessag
 		Accepted:  accepted,
 		ClientId:  clientId,
 		PublicKey: []byte(publicKey),
+		Devices:   devices,
+		Features:  features,
 	}, nil
 }
 
@@ -219,7 +318,173 @@ func (m *TransporterMessage) SetPayloadConnectRoomResult(data *TransporterMessag
 	if err != nil {
 		return err
 	}
-	payloadLength, err := m.writeString(offset, string(data.PublicKey))
+	offset, err = m.writeString(offset, string(data.PublicKey))
+	if err != nil {
+		return err
+	}
+	offset, err = m.writeDeviceList(offset, data.Devices)
+	if err != nil {
+		return err
+	}
+	offset, err = m.writeDeviceList(offset, data.Features)
+	if err != nil {
+		return err
+	}
+	m.updatePayloadMetadata(offset)
+	return nil
+}
+
+// writeDeviceList writes one string per room device, preceded by their
+// count.
+func (m *TransporterMessage) writeDeviceList(offset uint32, values []string) (uint32, error) {
+	if len(values) > MaxRoomDevices {
+		return 0, fmt.Errorf("device count %d exceeds the maximum allowed (%d)", len(values), MaxRoomDevices)
+	}
+	offset, err := m.writeInt(offset, len(values))
+	if err != nil {
+		return 0, err
+	}
+	for _, value := range values {
+		offset, err = m.writeString(offset, value)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+func (m *TransporterMessage) readDeviceList(offset uint32) (uint32, []string, error) {
+	offset, count, err := m.readInt(offset)
+	if err != nil {
+		return 0, nil, err
+	}
+	if count > MaxRoomDevices {
+		return 0, nil, fmt.Errorf("device count %d exceeds the maximum allowed (%d)", count, MaxRoomDevices)
+	}
+	values := make([]string, 0, count)
+	for range count {
+		var value string
+		offset, value, err = m.readString(offset)
+		if err != nil {
+			return 0, nil, err
+		}
+		values = append(values, value)
+	}
+	return offset, values, nil
+}
+
+//endregion
+
+// region Room directory payloads
+
+// TransporterMessagePayloadPublishRoom lists the sender's room in Team's
+// room directory, TeamToken proving it's a member. Label is a free-form
+// description of the room, Models the models of (up to MaxListingModels
+// of) the devices it shares, and Tags free-form keywords; PublicKey is the
+// owner's identity public key (see client/identity), for guests to see
+// its fingerprint before asking to join, and Signature its Ed25519
+// signature of RoomListingMessage(the room id, the owner's client id). A
+// room reserved for an identity is only listed under that identity.
+type TransporterMessagePayloadPublishRoom struct {
+	Team      string
+	TeamToken string
+	Label     string
+	PublicKey []byte
+	Models    []string
+	Tags      []string
+	Signature []byte
+}
+
+func (m *TransporterMessage) GetPayloadPublishRoom() (*TransporterMessagePayloadPublishRoom, error) {
+	data := &TransporterMessagePayloadPublishRoom{}
+	offset := uint32(0)
+	var publicKey string
+	var err error
+	for _, field := range []*string{&data.Team, &data.TeamToken, &data.Label, &publicKey} {
+		offset, *field, err = m.readString(offset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	data.PublicKey = []byte(publicKey)
+	offset, data.Models, err = m.readStringList(offset, MaxListingModels)
+	if err != nil {
+		return nil, err
+	}
+	offset, data.Tags, err = m.readStringList(offset, MaxListingTags)
+	if err != nil {
+		return nil, err
+	}
+	_, signature, err := m.readString(offset)
+	if err != nil {
+		return nil, err
+	}
+	data.Signature = []byte(signature)
+	return data, nil
+}
+
+func (m *TransporterMessage) SetPayloadPublishRoom(data *TransporterMessagePayloadPublishRoom) error {
+	offset := uint32(0)
+	var err error
+	for _, field := range []string{data.Team, data.TeamToken, data.Label, string(data.PublicKey)} {
+		offset, err = m.writeString(offset, field)
+		if err != nil {
+			return err
+		}
+	}
+	offset, err = m.writeStringList(offset, data.Models, MaxListingModels)
+	if err != nil {
+		return err
+	}
+	offset, err = m.writeStringList(offset, data.Tags, MaxListingTags)
+	if err != nil {
+		return err
+	}
+	offset, err = m.writeString(offset, string(data.Signature))
+	if err != nil {
+		return err
+	}
+	m.updatePayloadMetadata(offset)
+	return nil
+}
+
+// RoomListingMessage is what an owner signs to list its room roomId under
+// its identity. Binding the signature to clientId, which the transporter
+// assigned to this very connection, keeps it from being replayed by
+// another one, and so from listing another room under the owner's
+// identity.
+func RoomListingMessage(roomId string, clientId string) []byte {
+	return []byte("adb-remote room listing\x00" + roomId + "\x00" + clientId)
+}
+
+// TransporterMessagePayloadListRooms asks for the rooms listed in Team's
+// room directory, TeamToken proving the sender is a member.
+type TransporterMessagePayloadListRooms struct {
+	Team      string
+	TeamToken string
+}
+
+func (m *TransporterMessage) GetPayloadListRooms() (*TransporterMessagePayloadListRooms, error) {
+	offset, team, err := m.readString(0)
+	if err != nil {
+		return nil, err
+	}
+	_, teamToken, err := m.readString(offset)
+	if err != nil {
+		return nil, err
+	}
+	return &TransporterMessagePayloadListRooms{
+		Team:      team,
+		TeamToken: teamToken,
+	}, nil
+}
+
+func (m *TransporterMessage) SetPayloadListRooms(data *TransporterMessagePayloadListRooms) error {
+	offset, err := m.writeString(0, data.Team)
+	if err != nil {
+		return err
+	}
+	payloadLength, err := m.writeString(offset, data.TeamToken)
 	if err != nil {
 		return err
 	}
@@ -227,6 +492,457 @@ func (m *TransporterMessage) SetPayloadConnectRoomResult(data *TransporterMessag
 	return nil
 }
 
+// TransporterRoomListing is one room of a team's room directory: what its
+// owner published (see TransporterMessagePayloadPublishRoom), and whether
+// a guest is in it already (Occupied, 0 = false, anything else true).
+type TransporterRoomListing struct {
+	RoomId    string
+	Label     string
+	PublicKey []byte
+	Models    []string
+	Tags      []string
+	Occupied  int
+}
+
+// TransporterMessagePayloadRoomList answers CommandListRooms with (up to
+// MaxListedRooms of) the rooms listed in the team's room directory.
+type TransporterMessagePayloadRoomList struct {
+	Rooms []TransporterRoomListing
+}
+
+func (m *TransporterMessage) GetPayloadRoomList() (*TransporterMessagePayloadRoomList, error) {
+	offset, count, err := m.readInt(0)
+	if err != nil {
+		return nil, err
+	}
+	if count > MaxListedRooms {
+		return nil, fmt.Errorf("room count %d exceeds the maximum allowed (%d)", count, MaxListedRooms)
+	}
+	rooms := make([]TransporterRoomListing, count)
+	for i := range rooms {
+		room := &rooms[i]
+		var publicKey string
+		for _, field := range []*string{&room.RoomId, &room.Label, &publicKey} {
+			offset, *field, err = m.readString(offset)
+			if err != nil {
+				return nil, err
+			}
+		}
+		room.PublicKey = []byte(publicKey)
+		offset, room.Models, err = m.readStringList(offset, MaxListingModels)
+		if err != nil {
+			return nil, err
+		}
+		offset, room.Tags, err = m.readStringList(offset, MaxListingTags)
+		if err != nil {
+			return nil, err
+		}
+		offset, room.Occupied, err = m.readInt(offset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &TransporterMessagePayloadRoomList{Rooms: rooms}, nil
+}
+
+func (m *TransporterMessage) SetPayloadRoomList(data *TransporterMessagePayloadRoomList) error {
+	if len(data.Rooms) > MaxListedRooms {
+		return fmt.Errorf("room count %d exceeds the maximum allowed (%d)", len(data.Rooms), MaxListedRooms)
+	}
+	offset, err := m.writeInt(0, len(data.Rooms))
+	if err != nil {
+		return err
+	}
+	for _, room := range data.Rooms {
+		for _, field := range []string{room.RoomId, room.Label, string(room.PublicKey)} {
+			offset, err = m.writeString(offset, field)
+			if err != nil {
+				return err
+			}
+		}
+		offset, err = m.writeStringList(offset, room.Models, MaxListingModels)
+		if err != nil {
+			return err
+		}
+		offset, err = m.writeStringList(offset, room.Tags, MaxListingTags)
+		if err != nil {
+			return err
+		}
+		offset, err = m.writeInt(offset, room.Occupied)
+		if err != nil {
+			return err
+		}
+	}
+	m.updatePayloadMetadata(offset)
+	return nil
+}
+
+// writeStringList writes up to limit strings, preceded by their count.
+func (m *TransporterMessage) writeStringList(offset uint32, values []string, limit int) (uint32, error) {
+	if len(values) > limit {
+		return 0, fmt.Errorf("list length %d exceeds the maximum allowed (%d)", len(values), limit)
+	}
+	offset, err := m.writeInt(offset, len(values))
+	if err != nil {
+		return 0, err
+	}
+	for _, value := range values {
+		offset, err = m.writeString(offset, value)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+func (m *TransporterMessage) readStringList(offset uint32, limit int) (uint32, []string, error) {
+	offset, count, err := m.readInt(offset)
+	if err != nil {
+		return 0, nil, err
+	}
+	if count > limit {
+		return 0, nil, fmt.Errorf("list length %d exceeds the maximum allowed (%d)", count, limit)
+	}
+	values := make([]string, 0, count)
+	for range count {
+		var value string
+		offset, value, err = m.readString(offset)
+		if err != nil {
+			return 0, nil, err
+		}
+		values = append(values, value)
+	}
+	return offset, values, nil
+}
+
+//endregion
+
+// region ADB transport payload
+
+// TransporterMessagePayloadAdbTransport carries one ADB protocol message
+// between the room's participants. Device indexes the room's device list
+// (see TransporterMessagePayloadConnectRoomResult.Devices), telling the
+// owner which device to open a stream against and the guest which of its
+// proxies the message belongs to. Message is opaque to the transporter.
+type TransporterMessagePayloadAdbTransport struct {
+	Device  int
+	Message []byte
+}
+
+// GetPayloadAdbTransport decodes the payload. The returned Message aliases
+// the message's payload buffer: it is only valid until the message is
+// reused.
+func (m *TransporterMessage) GetPayloadAdbTransport() (*TransporterMessagePayloadAdbTransport, error) {
+	offset, device, err := m.readInt(0)
+	if err != nil {
+		return nil, err
+	}
+	return &TransporterMessagePayloadAdbTransport{
+		Device:  device,
+		Message: m.payloadBuffer[offset:m.PayloadLength()],
+	}, nil
+}
+
+func (m *TransporterMessage) SetPayloadAdbTransport(data *TransporterMessagePayloadAdbTransport) error {
+	offset, err := m.writeInt(0, data.Device)
+	if err != nil {
+		return err
+	}
+	payloadLength := offset + uint32(len(data.Message))
+	if uint32(len(m.payloadBuffer)) < payloadLength {
+		return fmt.Errorf("not enough space in the payload buffer, size: %d, data length: %d", len(m.payloadBuffer), payloadLength)
+	}
+	copy(m.payloadBuffer[offset:payloadLength], data.Message)
+	m.updatePayloadMetadata(payloadLength)
+	return nil
+}
+
+//endregion
+
+// region Device state payload
+
+// TransporterMessagePayloadDeviceState reports the adb state of one of the
+// room's devices: Device indexes the room's device list, and State is the
+// state column of "adb devices" ("device" when usable, "offline",
+// "unauthorized", ...).
+type TransporterMessagePayloadDeviceState struct {
+	Device int
+	State  string
+}
+
+func (m *TransporterMessage) GetPayloadDeviceState() (*TransporterMessagePayloadDeviceState, error) {
+	offset, device, err := m.readInt(0)
+	if err != nil {
+		return nil, err
+	}
+	_, state, err := m.readString(offset)
+	if err != nil {
+		return nil, err
+	}
+	return &TransporterMessagePayloadDeviceState{
+		Device: device,
+		State:  state,
+	}, nil
+}
+
+func (m *TransporterMessage) SetPayloadDeviceState(data *TransporterMessagePayloadDeviceState) error {
+	offset, err := m.writeInt(0, data.Device)
+	if err != nil {
+		return err
+	}
+	payloadLength, err := m.writeString(offset, data.State)
+	if err != nil {
+		return err
+	}
+	m.updatePayloadMetadata(payloadLength)
+	return nil
+}
+
+//endregion
+
+// region Device info payload
+
+// TransporterMessagePayloadDeviceInfo describes one of the room's devices:
+// Device indexes the room's device list; Product, Model and DeviceName are
+// what "adb devices -l" reports as product:, model: and device:, and the
+// rest come from the device's ro.product.manufacturer,
+// ro.build.version.release and ro.product.cpu.abi properties. Any of them
+// may be empty when the owner couldn't find out.
+type TransporterMessagePayloadDeviceInfo struct {
+	Device         int
+	Product        string
+	Model          string
+	DeviceName     string
+	Manufacturer   string
+	AndroidVersion string
+	Abi            string
+}
+
+func (m *TransporterMessage) GetPayloadDeviceInfo() (*TransporterMessagePayloadDeviceInfo, error) {
+	offset, device, err := m.readInt(0)
+	if err != nil {
+		return nil, err
+	}
+	info := &TransporterMessagePayloadDeviceInfo{Device: device}
+	for _, field := range []*string{&info.Product, &info.Model, &info.DeviceName, &info.Manufacturer, &info.AndroidVersion, &info.Abi} {
+		offset, *field, err = m.readString(offset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+func (m *TransporterMessage) SetPayloadDeviceInfo(data *TransporterMessagePayloadDeviceInfo) error {
+	offset, err := m.writeInt(0, data.Device)
+	if err != nil {
+		return err
+	}
+	for _, field := range []string{data.Product, data.Model, data.DeviceName, data.Manufacturer, data.AndroidVersion, data.Abi} {
+		offset, err = m.writeString(offset, field)
+		if err != nil {
+			return err
+		}
+	}
+	m.updatePayloadMetadata(offset)
+	return nil
+}
+
+//endregion
+
+// region Session lease payload
+
+// TransporterMessagePayloadSessionLease tells the guest how long its session
+// has left: State is one of the lease states, and RemainingSeconds how many
+// seconds an active lease has left. Once the lease isn't active any more,
+// the owner closes the guest's streams and refuses new ones.
+type TransporterMessagePayloadSessionLease struct {
+	State            int
+	RemainingSeconds int
+}
+
+func (m *TransporterMessage) GetPayloadSessionLease() (*TransporterMessagePayloadSessionLease, error) {
+	offset, state, err := m.readInt(0)
+	if err != nil {
+		return nil, err
+	}
+	_, remaining, err := m.readInt(offset)
+	if err != nil {
+		return nil, err
+	}
+	return &TransporterMessagePayloadSessionLease{
+		State:            state,
+		RemainingSeconds: remaining,
+	}, nil
+}
+
+func (m *TransporterMessage) SetPayloadSessionLease(data *TransporterMessagePayloadSessionLease) error {
+	offset, err := m.writeInt(0, data.State)
+	if err != nil {
+		return err
+	}
+	payloadLength, err := m.writeInt(offset, data.RemainingSeconds)
+	if err != nil {
+		return err
+	}
+	m.updatePayloadMetadata(payloadLength)
+	return nil
+}
+
+//endregion
+
+// region Join queue payloads
+
+// TransporterMessagePayloadQueuePosition tells a waiting guest its
+// Position in the room's join queue, 1 being next in line.
+type TransporterMessagePayloadQueuePosition struct {
+	Position int
+}
+
+func (m *TransporterMessage) GetPayloadQueuePosition() (*TransporterMessagePayloadQueuePosition, error) {
+	_, position, err := m.readInt(0)
+	if err != nil {
+		return nil, err
+	}
+	return &TransporterMessagePayloadQueuePosition{Position: position}, nil
+}
+
+func (m *TransporterMessage) SetPayloadQueuePosition(data *TransporterMessagePayloadQueuePosition) error {
+	payloadLength, err := m.writeInt(0, data.Position)
+	if err != nil {
+		return err
+	}
+	m.updatePayloadMetadata(payloadLength)
+	return nil
+}
+
+// TransporterMessagePayloadJoinQueue tells the room owner the client ids
+// of the guests waiting to join, in order, up to MaxJoinQueue of them.
+type TransporterMessagePayloadJoinQueue struct {
+	GuestClientIds []string
+}
+
+func (m *TransporterMessage) GetPayloadJoinQueue() (*TransporterMessagePayloadJoinQueue, error) {
+	_, guestClientIds, err := m.readStringList(0, MaxJoinQueue)
+	if err != nil {
+		return nil, err
+	}
+	return &TransporterMessagePayloadJoinQueue{GuestClientIds: guestClientIds}, nil
+}
+
+func (m *TransporterMessage) SetPayloadJoinQueue(data *TransporterMessagePayloadJoinQueue) error {
+	payloadLength, err := m.writeStringList(0, data.GuestClientIds, MaxJoinQueue)
+	if err != nil {
+		return err
+	}
+	m.updatePayloadMetadata(payloadLength)
+	return nil
+}
+
+//endregion
+
+// region Kick guest payload
+
+// TransporterMessagePayloadKickGuest carries the Reason the room owner
+// gives for removing its guest, which may be empty.
+type TransporterMessagePayloadKickGuest struct {
+	Reason string
+}
+
+func (m *TransporterMessage) GetPayloadKickGuest() (*TransporterMessagePayloadKickGuest, error) {
+	_, reason, err := m.readString(0)
+	if err != nil {
+		return nil, err
+	}
+	return &TransporterMessagePayloadKickGuest{Reason: reason}, nil
+}
+
+func (m *TransporterMessage) SetPayloadKickGuest(data *TransporterMessagePayloadKickGuest) error {
+	payloadLength, err := m.writeString(0, data.Reason)
+	if err != nil {
+		return err
+	}
+	m.updatePayloadMetadata(payloadLength)
+	return nil
+}
+
+//endregion
+
+// region Chat message payload
+
+// TransporterMessagePayloadChatMessage is a chat message's Text, at most
+// MaxChatMessageLength bytes, with SentAt, the unix time in seconds its
+// sender sent it at, and Sequence, which its sender counts up with every
+// message. Signature is the sender's Ed25519 identity signature of
+// ChatMessage, which the transporter relaying it can't forge.
+type TransporterMessagePayloadChatMessage struct {
+	Text      string
+	SentAt    int
+	Sequence  int
+	Signature []byte
+}
+
+func (m *TransporterMessage) GetPayloadChatMessage() (*TransporterMessagePayloadChatMessage, error) {
+	offset, text, err := m.readString(0)
+	if err != nil {
+		return nil, err
+	}
+	if len(text) > MaxChatMessageLength {
+		return nil, fmt.Errorf("chat message of %d bytes is longer than %d", len(text), MaxChatMessageLength)
+	}
+	offset, sentAt, err := m.readInt(offset)
+	if err != nil {
+		return nil, err
+	}
+	offset, sequence, err := m.readInt(offset)
+	if err != nil {
+		return nil, err
+	}
+	_, signature, err := m.readString(offset)
+	if err != nil {
+		return nil, err
+	}
+	return &TransporterMessagePayloadChatMessage{
+		Text:      text,
+		SentAt:    sentAt,
+		Sequence:  sequence,
+		Signature: []byte(signature),
+	}, nil
+}
+
+func (m *TransporterMessage) SetPayloadChatMessage(data *TransporterMessagePayloadChatMessage) error {
+	if len(data.Text) > MaxChatMessageLength {
+		return fmt.Errorf("chat message of %d bytes is longer than %d", len(data.Text), MaxChatMessageLength)
+	}
+	offset, err := m.writeString(0, data.Text)
+	if err != nil {
+		return err
+	}
+	offset, err = m.writeInt(offset, data.SentAt)
+	if err != nil {
+		return err
+	}
+	offset, err = m.writeInt(offset, data.Sequence)
+	if err != nil {
+		return err
+	}
+	payloadLength, err := m.writeString(offset, string(data.Signature))
+	if err != nil {
+		return err
+	}
+	m.updatePayloadMetadata(payloadLength)
+	return nil
+}
+
+// ChatMessage is what a room's owner or guest signs to send text to the
+// other one, whose identity public key is recipientPublicKey. Binding the
+// signature to the room and the recipient keeps the transporter from
+// reflecting a message back to its sender or passing it on to another
+// room; sentAt and sequence let the recipient drop replayed ones.
+func ChatMessage(roomId string, recipientPublicKey []byte, sentAt int, sequence int, text string) []byte {
+	return []byte(fmt.Sprintf("adb-remote chat\x00%s\x00%s\x00%d\x00%d\x00%s", roomId, recipientPublicKey, sentAt, sequence, text))
+}
+
 //endregion
 
 // region Raw payload
@@ -2,6 +2,9 @@ package protocol
 
 import (
 	"bytes"
+	"fmt"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -53,6 +56,40 @@ func TestConnectResponsePayloadRoundTrip(t *testing.T) {
 	}
 }
 
+func TestCreateRoomPayloadRoundTrip(t *testing.T) {
+	m := CreateTransporterMessage()
+	if err := m.SetPayloadCreateRoom(&TransporterMessagePayloadCreateRoom{RoomId: "lab-pixel", PublicKey: []byte{1, 2, 3}, Signature: []byte{4, 5}}); err != nil {
+		t.Fatalf("SetPayloadCreateRoom failed: %s", err)
+	}
+	payload, err := m.GetPayloadCreateRoom()
+	if err != nil {
+		t.Fatalf("GetPayloadCreateRoom failed: %s", err)
+	}
+	if payload.RoomId != "lab-pixel" || string(payload.PublicKey) != "\x01\x02\x03" || string(payload.Signature) != "\x04\x05" {
+		t.Fatalf("unexpected payload: %+v", payload)
+	}
+}
+
+func TestCreateRoomPayloadWithoutRoomId(t *testing.T) {
+	m := CreateTransporterMessage()
+	if err := m.SetPayloadCreateRoom(&TransporterMessagePayloadCreateRoom{}); err != nil {
+		t.Fatalf("SetPayloadCreateRoom failed: %s", err)
+	}
+	payload, err := m.GetPayloadCreateRoom()
+	if err != nil {
+		t.Fatalf("GetPayloadCreateRoom failed: %s", err)
+	}
+	if payload.RoomId != "" || len(payload.PublicKey) != 0 || len(payload.Signature) != 0 {
+		t.Fatalf("expected an empty payload, got %+v", payload)
+	}
+}
+
+func TestRoomReservationMessageBindsRoomAndClient(t *testing.T) {
+	if string(RoomReservationMessage("AB", "C")) == string(RoomReservationMessage("A", "BC")) {
+		t.Fatalf("expected different room/client splits to sign differently")
+	}
+}
+
 func TestCreateRoomResponsePayloadRoundTrip(t *testing.T) {
 	m := CreateTransporterMessage()
 	if err := m.SetPayloadCreateRoomResponse(&TransporterMessagePayloadCreateRoomResponse{RoomId: "ROOM1"}); err != nil {
@@ -78,6 +115,7 @@ func TestConnectRoomPayloadRoundTrip(t *testing.T) {
 		RoomId:    "ROOM-A-LONGER-ID",
 		ClientId:  "CLIENT-B",
 		PublicKey: publicKey,
+		Signature: []byte{0x0a, 0x0b},
 	}); err != nil {
 		t.Fatalf("SetPayloadConnectRoom failed: %s", err)
 	}
@@ -94,6 +132,9 @@ func TestConnectRoomPayloadRoundTrip(t *testing.T) {
 	if !bytes.Equal(payload.PublicKey, publicKey) {
 		t.Fatalf("expected public key %x, got %x", publicKey, payload.PublicKey)
 	}
+	if !bytes.Equal(payload.Signature, []byte{0x0a, 0x0b}) {
+		t.Fatalf("expected signature 0a0b, got %x", payload.Signature)
+	}
 }
 
 func TestConnectRoomPayloadWithoutPublicKey(t *testing.T) {
@@ -149,6 +190,245 @@ func TestConnectRoomResultPayloadWithOwnerIdentityRoundTrip(t *testing.T) {
 	}
 }
 
+func TestConnectRoomResultPayloadCarriesDevices(t *testing.T) {
+	m := CreateTransporterMessage()
+	devices := []string{"emulator-5554", "R58M123ABC"}
+	if err := m.SetPayloadConnectRoomResult(&TransporterMessagePayloadConnectRoomResult{Accepted: 1, Devices: devices}); err != nil {
+		t.Fatalf("SetPayloadConnectRoomResult failed: %s", err)
+	}
+	payload, err := m.GetPayloadConnectRoomResponse()
+	if err != nil {
+		t.Fatalf("GetPayloadConnectRoomResponse failed: %s", err)
+	}
+	if len(payload.Devices) != 2 || payload.Devices[0] != devices[0] || payload.Devices[1] != devices[1] {
+		t.Fatalf("expected devices %v, got %v", devices, payload.Devices)
+	}
+}
+
+func TestConnectRoomResultPayloadCarriesFeatures(t *testing.T) {
+	m := CreateTransporterMessage()
+	features := []string{"shell_v2,cmd,stat_v2", ""}
+	if err := m.SetPayloadConnectRoomResult(&TransporterMessagePayloadConnectRoomResult{Accepted: 1, Devices: []string{"a", "b"}, Features: features}); err != nil {
+		t.Fatalf("SetPayloadConnectRoomResult failed: %s", err)
+	}
+	payload, err := m.GetPayloadConnectRoomResponse()
+	if err != nil {
+		t.Fatalf("GetPayloadConnectRoomResponse failed: %s", err)
+	}
+	if len(payload.Features) != 2 || payload.Features[0] != features[0] || payload.Features[1] != "" {
+		t.Fatalf("expected features %q, got %q", features, payload.Features)
+	}
+}
+
+func TestConnectRoomResultPayloadRejectsTooManyDevices(t *testing.T) {
+	m := CreateTransporterMessage()
+	devices := make([]string, MaxRoomDevices+1)
+	if err := m.SetPayloadConnectRoomResult(&TransporterMessagePayloadConnectRoomResult{Accepted: 1, Devices: devices}); err == nil {
+		t.Fatalf("expected an error for %d devices", len(devices))
+	}
+}
+
+func TestPublishRoomPayloadRoundTrip(t *testing.T) {
+	m := CreateTransporterMessage()
+	published := &TransporterMessagePayloadPublishRoom{
+		Team:      "mobile",
+		TeamToken: "secret",
+		Label:     "Pixel lab, 3rd floor",
+		PublicKey: []byte{1, 2, 3},
+		Models:    []string{"Pixel_7", "SM-G991B"},
+		Tags:      []string{"android14", "arm64"},
+		Signature: []byte{4, 5},
+	}
+	if err := m.SetPayloadPublishRoom(published); err != nil {
+		t.Fatalf("SetPayloadPublishRoom failed: %s", err)
+	}
+	payload, err := m.GetPayloadPublishRoom()
+	if err != nil {
+		t.Fatalf("GetPayloadPublishRoom failed: %s", err)
+	}
+	if fmt.Sprint(payload) != fmt.Sprint(published) {
+		t.Fatalf("expected %+v, got %+v", published, payload)
+	}
+}
+
+func TestPublishRoomPayloadRejectsTooManyTags(t *testing.T) {
+	m := CreateTransporterMessage()
+	if err := m.SetPayloadPublishRoom(&TransporterMessagePayloadPublishRoom{Tags: make([]string, MaxListingTags+1)}); err == nil {
+		t.Fatalf("expected an error for more than %d tags", MaxListingTags)
+	}
+}
+
+func TestListRoomsPayloadRoundTrip(t *testing.T) {
+	m := CreateTransporterMessage()
+	if err := m.SetPayloadListRooms(&TransporterMessagePayloadListRooms{Team: "mobile", TeamToken: "secret"}); err != nil {
+		t.Fatalf("SetPayloadListRooms failed: %s", err)
+	}
+	payload, err := m.GetPayloadListRooms()
+	if err != nil {
+		t.Fatalf("GetPayloadListRooms failed: %s", err)
+	}
+	if payload.Team != "mobile" || payload.TeamToken != "secret" {
+		t.Fatalf("unexpected payload: %+v", payload)
+	}
+}
+
+func TestRoomListPayloadRoundTrip(t *testing.T) {
+	m := CreateTransporterMessage()
+	list := &TransporterMessagePayloadRoomList{Rooms: []TransporterRoomListing{
+		{RoomId: "lab-pixel", Label: "Pixel lab", PublicKey: []byte{1}, Models: []string{"Pixel_7"}, Tags: []string{"android14"}, Occupied: 1},
+		{RoomId: "QNZQ5630", Models: []string{}, Tags: []string{}},
+	}}
+	if err := m.SetPayloadRoomList(list); err != nil {
+		t.Fatalf("SetPayloadRoomList failed: %s", err)
+	}
+	payload, err := m.GetPayloadRoomList()
+	if err != nil {
+		t.Fatalf("GetPayloadRoomList failed: %s", err)
+	}
+	if fmt.Sprint(payload) != fmt.Sprint(list) {
+		t.Fatalf("expected %+v, got %+v", list, payload)
+	}
+}
+
+// TestFullRoomListFitsInOneMessage checks that the listing limits keep a
+// list of MaxListedRooms rooms, each as large as allowed, within a single
+// message's payload.
+func TestFullRoomListFitsInOneMessage(t *testing.T) {
+	text := strings.Repeat("x", MaxListingTextLength)
+	room := TransporterRoomListing{RoomId: text, Label: text, PublicKey: make([]byte, 32)}
+	for range MaxListingModels {
+		room.Models = append(room.Models, text)
+	}
+	for range MaxListingTags {
+		room.Tags = append(room.Tags, text)
+	}
+	list := &TransporterMessagePayloadRoomList{}
+	for range MaxListedRooms {
+		list.Rooms = append(list.Rooms, room)
+	}
+	if err := CreateTransporterMessage().SetPayloadRoomList(list); err != nil {
+		t.Fatalf("expected a full room list to fit, got %s", err)
+	}
+}
+
+func TestAdbTransportPayloadRoundTrip(t *testing.T) {
+	m := CreateTransporterMessage()
+	adbMessage := []byte("OPEN....shell:ls")
+	if err := m.SetPayloadAdbTransport(&TransporterMessagePayloadAdbTransport{Device: 3, Message: adbMessage}); err != nil {
+		t.Fatalf("SetPayloadAdbTransport failed: %s", err)
+	}
+	payload, err := m.GetPayloadAdbTransport()
+	if err != nil {
+		t.Fatalf("GetPayloadAdbTransport failed: %s", err)
+	}
+	if payload.Device != 3 || !bytes.Equal(payload.Message, adbMessage) {
+		t.Fatalf("unexpected payload: device %d, message %q", payload.Device, payload.Message)
+	}
+}
+
+func TestAdbTransportPayloadRejectsOversizedMessage(t *testing.T) {
+	m := CreateTransporterMessage()
+	if err := m.SetPayloadAdbTransport(&TransporterMessagePayloadAdbTransport{Message: make([]byte, MaxPayloadSize)}); err == nil {
+		t.Fatalf("expected an error for a message filling the whole payload buffer")
+	}
+}
+
+func TestDeviceStatePayloadRoundTrip(t *testing.T) {
+	m := CreateTransporterMessage()
+	if err := m.SetPayloadDeviceState(&TransporterMessagePayloadDeviceState{Device: 2, State: "offline"}); err != nil {
+		t.Fatalf("SetPayloadDeviceState failed: %s", err)
+	}
+	payload, err := m.GetPayloadDeviceState()
+	if err != nil {
+		t.Fatalf("GetPayloadDeviceState failed: %s", err)
+	}
+	if payload.Device != 2 || payload.State != "offline" {
+		t.Fatalf("unexpected payload: %+v", payload)
+	}
+}
+
+func TestSessionLeasePayloadRoundTrip(t *testing.T) {
+	m := CreateTransporterMessage()
+	if err := m.SetPayloadSessionLease(&TransporterMessagePayloadSessionLease{State: LeaseActive, RemainingSeconds: 1800}); err != nil {
+		t.Fatalf("SetPayloadSessionLease failed: %s", err)
+	}
+	payload, err := m.GetPayloadSessionLease()
+	if err != nil {
+		t.Fatalf("GetPayloadSessionLease failed: %s", err)
+	}
+	if payload.State != LeaseActive || payload.RemainingSeconds != 1800 {
+		t.Fatalf("unexpected payload: %+v", payload)
+	}
+}
+
+func TestJoinQueuePayloadsRoundTrip(t *testing.T) {
+	m := CreateTransporterMessage()
+	if err := m.SetPayloadQueuePosition(&TransporterMessagePayloadQueuePosition{Position: 2}); err != nil {
+		t.Fatalf("SetPayloadQueuePosition failed: %s", err)
+	}
+	position, err := m.GetPayloadQueuePosition()
+	if err != nil {
+		t.Fatalf("GetPayloadQueuePosition failed: %s", err)
+	}
+	if position.Position != 2 {
+		t.Fatalf("unexpected payload: %+v", position)
+	}
+
+	m = CreateTransporterMessage()
+	if err := m.SetPayloadJoinQueue(&TransporterMessagePayloadJoinQueue{GuestClientIds: []string{"GUEST2", "GUEST3"}}); err != nil {
+		t.Fatalf("SetPayloadJoinQueue failed: %s", err)
+	}
+	queue, err := m.GetPayloadJoinQueue()
+	if err != nil {
+		t.Fatalf("GetPayloadJoinQueue failed: %s", err)
+	}
+	if !slices.Equal(queue.GuestClientIds, []string{"GUEST2", "GUEST3"}) {
+		t.Fatalf("unexpected payload: %+v", queue)
+	}
+	if err := m.SetPayloadJoinQueue(&TransporterMessagePayloadJoinQueue{GuestClientIds: make([]string, MaxJoinQueue+1)}); err == nil {
+		t.Fatalf("expected a queue longer than MaxJoinQueue to be refused")
+	}
+}
+
+func TestKickGuestPayloadRoundTrip(t *testing.T) {
+	for _, reason := range []string{"Session over, thanks!", ""} {
+		m := CreateTransporterMessage()
+		if err := m.SetPayloadKickGuest(&TransporterMessagePayloadKickGuest{Reason: reason}); err != nil {
+			t.Fatalf("SetPayloadKickGuest failed: %s", err)
+		}
+		payload, err := m.GetPayloadKickGuest()
+		if err != nil {
+			t.Fatalf("GetPayloadKickGuest failed: %s", err)
+		}
+		if payload.Reason != reason {
+			t.Fatalf("expected reason %q, got %q", reason, payload.Reason)
+		}
+	}
+}
+
+func TestDeviceInfoPayloadRoundTrip(t *testing.T) {
+	m := CreateTransporterMessage()
+	info := &TransporterMessagePayloadDeviceInfo{
+		Device:         1,
+		Product:        "panther",
+		Model:          "Pixel_7",
+		DeviceName:     "panther",
+		Manufacturer:   "Google",
+		AndroidVersion: "14",
+		Abi:            "arm64-v8a",
+	}
+	if err := m.SetPayloadDeviceInfo(info); err != nil {
+		t.Fatalf("SetPayloadDeviceInfo failed: %s", err)
+	}
+	payload, err := m.GetPayloadDeviceInfo()
+	if err != nil {
+		t.Fatalf("GetPayloadDeviceInfo failed: %s", err)
+	}
+	if *payload != *info {
+		t.Fatalf("expected %+v, got %+v", info, payload)
+	}
+}
+
 func TestReadIntRejectsTruncatedBuffer(t *testing.T) {
 	m := CreateTransporterMessage()
 	if err := m.SetRawPayload([]byte{1, 2}); err != nil {
@@ -189,3 +469,21 @@ func TestReadStringRejectsOverflowingLength(t *testing.T) {
 		t.Fatalf("expected an error rejecting the overflowing length, not a silently wrapped offset")
 	}
 }
+
+func TestChatMessagePayloadRoundTrip(t *testing.T) {
+	m := CreateTransporterMessage()
+	if err := m.SetPayloadChatMessage(&TransporterMessagePayloadChatMessage{Text: "Can you unplug the Pixel?", SentAt: 1700000000, Sequence: 3, Signature: []byte{1, 2}}); err != nil {
+		t.Fatalf("SetPayloadChatMessage failed: %s", err)
+	}
+	payload, err := m.GetPayloadChatMessage()
+	if err != nil {
+		t.Fatalf("GetPayloadChatMessage failed: %s", err)
+	}
+	if payload.Text != "Can you unplug the Pixel?" || payload.SentAt != 1700000000 || payload.Sequence != 3 || string(payload.Signature) != "\x01\x02" {
+		t.Fatalf("unexpected payload %+v", payload)
+	}
+
+	if err := m.SetPayloadChatMessage(&TransporterMessagePayloadChatMessage{Text: strings.Repeat("a", MaxChatMessageLength+1)}); err == nil {
+		t.Fatal("expected an overlong chat message to be rejected")
+	}
+}
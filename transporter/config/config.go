@@ -14,10 +14,30 @@ const (
 	DefaultTLSKeyFile  = "transporter-key.pem"
 )
 
+// DefaultRoomReservationsFile is used when
+// TransporterConfiguration.RoomReservationsFile is left empty. It's where
+// the transporter persists reserved room ids (see transporter/reservation).
+const DefaultRoomReservationsFile = "room-reservations.json"
+
 type TransporterConfiguration struct {
 	Address     string `json:"transporterAddress"`
 	TLSCertFile string `json:"tlsCertFile,omitempty"`
 	TLSKeyFile  string `json:"tlsKeyFile,omitempty"`
+	// RoomReservationsFile is where reserved room ids are persisted.
+	RoomReservationsFile string `json:"roomReservationsFile,omitempty"`
+	// Teams are the teams whose members can publish rooms to, and list
+	// rooms from, their team's room directory; without any, the directory
+	// is disabled.
+	Teams []TeamConfiguration `json:"teams,omitempty"`
+}
+
+// TeamConfiguration is one team of the room directory: its name, and the
+// hex SHA-256 hash of the token its members present (e.g. the output of
+// `printf %s "$TOKEN" | sha256sum`), so the configuration file doesn't
+// hold the token itself.
+type TeamConfiguration struct {
+	Name        string `json:"name"`
+	TokenSha256 string `json:"tokenSha256"`
 }
 
 // CertPath returns the configured TLS certificate path, or
@@ -38,6 +58,15 @@ func (c *TransporterConfiguration) KeyPath() string {
 	return DefaultTLSKeyFile
 }
 
+// RoomReservationsPath returns the configured room reservations path, or
+// DefaultRoomReservationsFile if unset.
+func (c *TransporterConfiguration) RoomReservationsPath() string {
+	if c.RoomReservationsFile != "" {
+		return c.RoomReservationsFile
+	}
+	return DefaultRoomReservationsFile
+}
+
 func CreateConfig(path string) (*TransporterConfiguration, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -73,3 +73,29 @@ func TestCreateConfigParsesTLSPaths(t *testing.T) {
 		t.Fatalf("expected TLS paths a.pem/b.pem, got %q/%q", config.CertPath(), config.KeyPath())
 	}
 }
+
+func TestRoomReservationsPath(t *testing.T) {
+	config := &TransporterConfiguration{}
+	if config.RoomReservationsPath() != DefaultRoomReservationsFile {
+		t.Fatalf("expected the default reservations path %q, got %q", DefaultRoomReservationsFile, config.RoomReservationsPath())
+	}
+	path := writeConfigFile(t, `{"transporterAddress": "0.0.0.0:9000", "roomReservationsFile": "/var/lib/transporter/rooms.json"}`)
+	config, err := CreateConfig(path)
+	if err != nil {
+		t.Fatalf("CreateConfig failed: %s", err)
+	}
+	if config.RoomReservationsPath() != "/var/lib/transporter/rooms.json" {
+		t.Fatalf("expected the configured reservations path, got %q", config.RoomReservationsPath())
+	}
+}
+
+func TestCreateConfigParsesTeams(t *testing.T) {
+	path := writeConfigFile(t, `{"transporterAddress": "0.0.0.0:9000", "teams": [{"name": "mobile", "tokenSha256": "abcd"}]}`)
+	config, err := CreateConfig(path)
+	if err != nil {
+		t.Fatalf("CreateConfig failed: %s", err)
+	}
+	if len(config.Teams) != 1 || config.Teams[0].Name != "mobile" || config.Teams[0].TokenSha256 != "abcd" {
+		t.Fatalf("unexpected teams: %+v", config.Teams)
+	}
+}
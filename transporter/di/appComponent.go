@@ -3,8 +3,10 @@ package di
 import (
 	"adb-remote.maci.team/shared/prettyLogHandler"
 	"adb-remote.maci.team/transporter/config"
+	"adb-remote.maci.team/transporter/directory"
 	"adb-remote.maci.team/transporter/manager/connectionManager"
 	"adb-remote.maci.team/transporter/manager/roomManager"
+	"adb-remote.maci.team/transporter/reservation"
 	"github.com/golobby/container/v3"
 	"log/slog"
 	"os"
@@ -18,6 +20,8 @@ func CreateContainer() container.Container {
 	registerLogger(&cont)
 	registerConfiguration(&cont)
 	registerConnectionManager(&cont)
+	registerReservationStore(&cont)
+	registerTeams(&cont)
 	registerRoomManager(&cont)
 	return cont
 }
@@ -59,10 +63,36 @@ func registerConnectionManager(container *container.Container) {
 	}
 }
 
+func registerReservationStore(container *container.Container) {
+	err := container.Singleton(func(config *config.TransporterConfiguration, logger *slog.Logger) *reservation.Store {
+		store, err := reservation.Load(config.RoomReservationsPath(), logger)
+		if err != nil {
+			panic(err)
+		}
+		return store
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func registerTeams(container *container.Container) {
+	err := container.Singleton(func(config *config.TransporterConfiguration) *directory.Teams {
+		teams, err := directory.NewTeams(config.Teams)
+		if err != nil {
+			panic(err)
+		}
+		return teams
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
 func registerRoomManager(container *container.Container) {
 	err := container.Singleton(
-		func(logger *slog.Logger, connectionManager *connectionManager.ConnectionManager) *roomManager.RoomManager {
-			return roomManager.CreateRoomManager(connectionManager, logger)
+		func(logger *slog.Logger, connectionManager *connectionManager.ConnectionManager, reservations *reservation.Store, teams *directory.Teams) *roomManager.RoomManager {
+			return roomManager.CreateRoomManager(connectionManager, reservations, teams, logger)
 		},
 	)
 	if err != nil {
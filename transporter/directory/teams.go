@@ -0,0 +1,72 @@
+// Package directory holds what the transporter's room directory needs
+// besides the rooms themselves: which teams exist and how their members
+// prove they are, and what a room's listing may contain. Rooms are only
+// ever listed to the members of the team their owner published them to,
+// and joining one still takes the owner's accept decision.
+package directory
+
+import (
+	"adb-remote.maci.team/shared/protocol"
+	"adb-remote.maci.team/transporter/config"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+)
+
+// Teams authorizes room directory requests against the configured teams.
+type Teams struct {
+	// tokenHashes maps each team name to the SHA-256 hash of its token.
+	tokenHashes map[string][]byte
+}
+
+// NewTeams returns the Teams of teams, failing on an invalid token hash or
+// a team configured twice.
+func NewTeams(teams []config.TeamConfiguration) (*Teams, error) {
+	tokenHashes := make(map[string][]byte, len(teams))
+	for _, team := range teams {
+		if team.Name == "" {
+			return nil, fmt.Errorf("a team has no name")
+		}
+		if _, ok := tokenHashes[team.Name]; ok {
+			return nil, fmt.Errorf("team %s is configured twice", team.Name)
+		}
+		tokenHash, err := hex.DecodeString(team.TokenSha256)
+		if err != nil || len(tokenHash) != sha256.Size {
+			return nil, fmt.Errorf("team %s: tokenSha256 must be a hex SHA-256 hash", team.Name)
+		}
+		tokenHashes[team.Name] = tokenHash
+	}
+	return &Teams{tokenHashes: tokenHashes}, nil
+}
+
+// Authorize reports whether token is team's token. An unknown team is
+// never authorized, so with no teams configured the directory is off.
+func (t *Teams) Authorize(team string, token string) bool {
+	tokenHash, ok := t.tokenHashes[team]
+	if !ok {
+		return false
+	}
+	sum := sha256.Sum256([]byte(token))
+	return subtle.ConstantTimeCompare(sum[:], tokenHash) == 1
+}
+
+// ValidateListing reports why a room can't be listed as published says,
+// if it can't: every text must be at most protocol.MaxListingTextLength
+// bytes long, and tags non-empty.
+func ValidateListing(published *protocol.TransporterMessagePayloadPublishRoom) error {
+	if len(published.Label) > protocol.MaxListingTextLength {
+		return fmt.Errorf("the label is longer than %d bytes", protocol.MaxListingTextLength)
+	}
+	for _, model := range published.Models {
+		if len(model) > protocol.MaxListingTextLength {
+			return fmt.Errorf("the model %q is longer than %d bytes", model, protocol.MaxListingTextLength)
+		}
+	}
+	for _, tag := range published.Tags {
+		if tag == "" || len(tag) > protocol.MaxListingTextLength {
+			return fmt.Errorf("tags must be 1 to %d bytes long", protocol.MaxListingTextLength)
+		}
+	}
+	return nil
+}
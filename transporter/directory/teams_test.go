@@ -0,0 +1,71 @@
+package directory
+
+import (
+	"adb-remote.maci.team/shared/protocol"
+	"adb-remote.maci.team/transporter/config"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAuthorizeChecksTheTeamsToken(t *testing.T) {
+	teams, err := NewTeams([]config.TeamConfiguration{{Name: "mobile", TokenSha256: tokenHash("secret")}})
+	if err != nil {
+		t.Fatalf("NewTeams failed: %s", err)
+	}
+	if !teams.Authorize("mobile", "secret") {
+		t.Fatalf("expected the team's token to be authorized")
+	}
+	if teams.Authorize("mobile", "guess") {
+		t.Fatalf("expected a wrong token to be refused")
+	}
+	if teams.Authorize("web", "secret") {
+		t.Fatalf("expected an unknown team to be refused")
+	}
+}
+
+func TestNoTeamsAuthorizesNothing(t *testing.T) {
+	teams, err := NewTeams(nil)
+	if err != nil {
+		t.Fatalf("NewTeams failed: %s", err)
+	}
+	if teams.Authorize("", "") {
+		t.Fatalf("expected nothing to be authorized without teams")
+	}
+}
+
+func TestNewTeamsRejectsInvalidConfiguration(t *testing.T) {
+	for _, teams := range [][]config.TeamConfiguration{
+		{{Name: "mobile", TokenSha256: "not hex"}},
+		{{Name: "mobile", TokenSha256: "abcd"}},
+		{{Name: "", TokenSha256: tokenHash("secret")}},
+		{{Name: "mobile", TokenSha256: tokenHash("a")}, {Name: "mobile", TokenSha256: tokenHash("b")}},
+	} {
+		if _, err := NewTeams(teams); err == nil {
+			t.Fatalf("expected %+v to be rejected", teams)
+		}
+	}
+}
+
+func TestValidateListing(t *testing.T) {
+	if err := ValidateListing(&protocol.TransporterMessagePayloadPublishRoom{Label: "Pixel lab", Models: []string{"Pixel_7"}, Tags: []string{"arm64"}}); err != nil {
+		t.Fatalf("expected a valid listing, got %s", err)
+	}
+	tooLong := strings.Repeat("x", protocol.MaxListingTextLength+1)
+	for _, published := range []*protocol.TransporterMessagePayloadPublishRoom{
+		{Label: tooLong},
+		{Models: []string{tooLong}},
+		{Tags: []string{tooLong}},
+		{Tags: []string{""}},
+	} {
+		if err := ValidateListing(published); err == nil {
+			t.Fatalf("expected %+v to be rejected", published)
+		}
+	}
+}
@@ -218,7 +218,10 @@ func (cc *ClientConnection) SendRoomCreateResponse(roomId string) error {
 	return message.Write(cc.connection)
 }
 
-func (cc *ClientConnection) SendJoinRoomRequest(roomId string, clientId string, guestPublicKey []byte) error {
+// SendJoinRoomRequest hands this (owner) connection the join request of
+// the guest clientId, with the identity public key it presented and its
+// signature of protocol.RoomJoinMessage for the owner to check.
+func (cc *ClientConnection) SendJoinRoomRequest(roomId string, clientId string, guestPublicKey []byte, signature []byte) error {
 	pool := cc.owner.transporterMessagePool
 	container := pool.Obtain()
 	defer container.Dispose()
@@ -231,6 +234,7 @@ func (cc *ClientConnection) SendJoinRoomRequest(roomId string, clientId string,
 		RoomId:    roomId,
 		ClientId:  clientId,
 		PublicKey: guestPublicKey,
+		Signature: signature,
 	}); err != nil {
 		return err
 	}
@@ -240,9 +244,10 @@ func (cc *ClientConnection) SendJoinRoomRequest(roomId string, clientId string,
 // SendJoinRoomResponse forwards the room owner's accept/decline decision to
 // this (guest) connection. ownerClientId and ownerPublicKey identify the
 // owner (see client/identity) so the guest can display the owner's
-// fingerprint for out-of-band verification; they are meaningful only when
+// fingerprint for out-of-band verification; they, and the serials and adb
+// features of the devices the room shares, are meaningful only when
 // isAccepted is non-zero.
-func (cc *ClientConnection) SendJoinRoomResponse(isAccepted int, ownerClientId string, ownerPublicKey []byte) error {
+func (cc *ClientConnection) SendJoinRoomResponse(isAccepted int, ownerClientId string, ownerPublicKey []byte, devices []string, features []string) error {
 	pool := cc.owner.transporterMessagePool
 	container := pool.Obtain()
 	defer container.Dispose()
@@ -255,6 +260,8 @@ func (cc *ClientConnection) SendJoinRoomResponse(isAccepted int, ownerClientId s
 		Accepted:  isAccepted,
 		ClientId:  ownerClientId,
 		PublicKey: ownerPublicKey,
+		Devices:   devices,
+		Features:  features,
 	}); err != nil {
 		return err
 	}
@@ -276,6 +283,73 @@ func (cc *ClientConnection) SendGuestLeft() error {
 	return message.Write(cc.connection)
 }
 
+// SendQueuePosition tells this (guest) connection its place in the join
+// queue of the room it asked to join.
+func (cc *ClientConnection) SendQueuePosition(position int) error {
+	pool := cc.owner.transporterMessagePool
+	container := pool.Obtain()
+	defer container.Dispose()
+	message, err := container.Data()
+	if err != nil {
+		return err
+	}
+	message.SetDirectCommand(protocol.CommandQueuePosition)
+	if err := message.SetPayloadQueuePosition(&protocol.TransporterMessagePayloadQueuePosition{Position: position}); err != nil {
+		return err
+	}
+	return message.Write(cc.connection)
+}
+
+// SendJoinQueue tells this (owner) connection who waits to join its room.
+func (cc *ClientConnection) SendJoinQueue(guestClientIds []string) error {
+	pool := cc.owner.transporterMessagePool
+	container := pool.Obtain()
+	defer container.Dispose()
+	message, err := container.Data()
+	if err != nil {
+		return err
+	}
+	message.SetDirectCommand(protocol.CommandJoinQueue)
+	if err := message.SetPayloadJoinQueue(&protocol.TransporterMessagePayloadJoinQueue{GuestClientIds: guestClientIds}); err != nil {
+		return err
+	}
+	return message.Write(cc.connection)
+}
+
+// SendPublishRoomResponse tells this (owner) connection its room is listed
+// in the team's room directory.
+func (cc *ClientConnection) SendPublishRoomResponse() error {
+	pool := cc.owner.transporterMessagePool
+	container := pool.Obtain()
+	defer container.Dispose()
+	message, err := container.Data()
+	if err != nil {
+		return err
+	}
+	message.SetResponseCommand(protocol.CommandPublishRoom)
+	if err := message.SetRawPayload(nil); err != nil {
+		return err
+	}
+	return message.Write(cc.connection)
+}
+
+// SendRoomList answers this connection's room directory request with the
+// rooms listed for its team.
+func (cc *ClientConnection) SendRoomList(rooms []protocol.TransporterRoomListing) error {
+	pool := cc.owner.transporterMessagePool
+	container := pool.Obtain()
+	defer container.Dispose()
+	message, err := container.Data()
+	if err != nil {
+		return err
+	}
+	message.SetResponseCommand(protocol.CommandListRooms)
+	if err := message.SetPayloadRoomList(&protocol.TransporterMessagePayloadRoomList{Rooms: rooms}); err != nil {
+		return err
+	}
+	return message.Write(cc.connection)
+}
+
 func (cc *ClientConnection) SendInvalidPayloadError(command uint32) error {
 	pool := cc.owner.transporterMessagePool
 	container := pool.Obtain()
@@ -2,22 +2,47 @@ package roomManager
 
 import (
 	"adb-remote.maci.team/shared/protocol"
+	"adb-remote.maci.team/transporter/directory"
 	"adb-remote.maci.team/transporter/manager/connectionManager"
+	"adb-remote.maci.team/transporter/reservation"
 	"adb-remote.maci.team/transporter/utils"
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"log/slog"
+	"sort"
 )
 
 type roomData struct {
 	roomId string
 	owner  *connectionManager.ClientConnection
 	guest  *connectionManager.ClientConnection
+	// ownerPublicKey is the identity the room id is reserved for, nil for
+	// a room with a random id.
+	ownerPublicKey []byte
+	// team and listing are the team whose room directory lists the room,
+	// and what it lists, once its owner published it.
+	team    string
+	listing *protocol.TransporterMessagePayloadPublishRoom
+	// queue holds, in order, the guests waiting to join while another one
+	// is in the room (see protocol.CommandQueuePosition).
+	queue []*queuedGuest
+}
+
+// queuedGuest is a guest waiting in a room's join queue, with the join
+// request it sent.
+type queuedGuest struct {
+	connection *connectionManager.ClientConnection
+	request    *protocol.TransporterMessagePayloadConnectRoom
 }
 
 type RoomManager struct {
 	//Dependencies
 	connectionManager *connectionManager.ConnectionManager
+	reservations      *reservation.Store
+	teams             *directory.Teams
 	logger            *slog.Logger
 
 	//Internal state
@@ -25,11 +50,13 @@ type RoomManager struct {
 	cancelFunc context.CancelFunc
 }
 
-func CreateRoomManager(cm *connectionManager.ConnectionManager, logger *slog.Logger) *RoomManager {
+func CreateRoomManager(cm *connectionManager.ConnectionManager, reservations *reservation.Store, teams *directory.Teams, logger *slog.Logger) *RoomManager {
 	logger.Info("Create room manager")
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	roomManager := &RoomManager{
 		connectionManager: cm,
+		reservations:      reservations,
+		teams:             teams,
 		logger:            logger,
 		rooms:             make([]*roomData, 0, 10),
 		cancelFunc:        cancelFunc,
@@ -92,7 +119,14 @@ func (rm *RoomManager) dispatchMessage(messageContainer *connectionManager.Clien
 	logger.Info(fmt.Sprintf("RoomManager: %x message received from client: %p", message.Command(), sender))
 	switch message.Command() {
 	case protocol.CommandCreateRoom:
-		rm.handleCreateRoom(sender)
+		payload, err := message.GetPayloadCreateRoom()
+		if err != nil {
+			if err := sender.SendInvalidPayloadError(message.Command()); err != nil {
+				_ = sender.Close()
+			}
+			return
+		}
+		rm.handleCreateRoom(sender, payload)
 	case protocol.CommandJoinRoom:
 		payload, err := message.GetPayloadConnectRoom()
 		if err != nil {
@@ -101,7 +135,7 @@ func (rm *RoomManager) dispatchMessage(messageContainer *connectionManager.Clien
 			}
 			return
 		}
-		rm.handleJoinRoom(sender, payload.RoomId, payload.PublicKey)
+		rm.handleJoinRoom(sender, payload)
 	case protocol.CommandJoinRoom | protocol.CommandResponseMask:
 		payload, err := message.GetPayloadConnectRoomResponse()
 		if err != nil {
@@ -111,43 +145,151 @@ func (rm *RoomManager) dispatchMessage(messageContainer *connectionManager.Clien
 			}
 			return
 		}
-		rm.handleJoinRoomResponse(sender, payload.Accepted, payload.PublicKey)
+		rm.handleJoinRoomResponse(sender, payload.Accepted, payload.PublicKey, payload.Devices, payload.Features)
 	case protocol.CommandAdbTransport:
-		rm.handleAdbTransport(sender, message)
+		rm.relayToPeer(sender, message)
+	case protocol.CommandChatMessage:
+		if _, err := message.GetPayloadChatMessage(); err != nil {
+			if err := sender.SendInvalidPayloadError(message.Command()); err != nil {
+				_ = sender.Close()
+			}
+			return
+		}
+		rm.relayToPeer(sender, message)
+	case protocol.CommandPublishRoom:
+		payload, err := message.GetPayloadPublishRoom()
+		if err != nil {
+			if err := sender.SendInvalidPayloadError(message.Command()); err != nil {
+				_ = sender.Close()
+			}
+			return
+		}
+		rm.handlePublishRoom(sender, payload)
+	case protocol.CommandListRooms:
+		payload, err := message.GetPayloadListRooms()
+		if err != nil {
+			if err := sender.SendInvalidPayloadError(message.Command()); err != nil {
+				_ = sender.Close()
+			}
+			return
+		}
+		rm.handleListRooms(sender, payload.Team, payload.TeamToken)
+	case protocol.CommandKickGuest:
+		if _, err := message.GetPayloadKickGuest(); err != nil {
+			if err := sender.SendInvalidPayloadError(message.Command()); err != nil {
+				_ = sender.Close()
+			}
+			return
+		}
+		rm.handleKickGuest(sender, message)
+	case protocol.CommandDeviceState, protocol.CommandDeviceInfo, protocol.CommandSessionLease:
+		rm.forwardToGuest(sender, message)
 	default:
 		logger.Warn(fmt.Sprintf("RoomManager: Unhandled command from client %p: %x", sender, message.Command()))
 	}
 }
 
-func (rm *RoomManager) handleCreateRoom(sender *connectionManager.ClientConnection) {
+func (rm *RoomManager) handleCreateRoom(sender *connectionManager.ClientConnection, payload *protocol.TransporterMessagePayloadCreateRoom) {
 	logger := rm.logger
 	logger.Info(fmt.Sprintf("%p (%s): Create room request", sender, sender.GetClientId()))
 	if rm.isClientInARoom(sender) {
 		logger.Error(fmt.Sprintf("%p (%s): Client already present in a room, a client can't occupy more than 1 room", sender, sender.GetClientId()))
-		if err := sender.SendErrorResponse(protocol.CommandCreateRoom, protocol.ErrorAlreadyInRoom, "You already occupy a room"); err != nil {
-			logger.Error(fmt.Sprintf("%p (%s): Error during the error response sending, close the client connection", sender, sender.GetClientId()))
-			_ = sender.Close()
-		}
+		rm.sendErrorResponse(sender, protocol.CommandCreateRoom, protocol.ErrorAlreadyInRoom, "You already occupy a room")
 		return
 	}
-	roomId := utils.GenerateClientId()
-	logger.Info(fmt.Sprintf("%p (%s): Room ID generated: %s", sender, sender.GetClientId(), roomId))
 	rd := &roomData{
-		owner:  sender,
-		guest:  nil,
-		roomId: roomId,
+		owner: sender,
+		guest: nil,
+	}
+	if payload.RoomId == "" {
+		rd.roomId = rm.generateRoomId()
+		logger.Info(fmt.Sprintf("%p (%s): Room ID generated: %s", sender, sender.GetClientId(), rd.roomId))
+	} else if !rm.reserveRoom(sender, payload) {
+		return
+	} else {
+		rd.roomId = payload.RoomId
+		rd.ownerPublicKey = payload.PublicKey
 	}
 	rm.rooms = append(rm.rooms, rd)
-	if err := sender.SendRoomCreateResponse(roomId); err != nil {
+	if err := sender.SendRoomCreateResponse(rd.roomId); err != nil {
 		logger.Error(fmt.Sprintf("%p (%s): Error during the room creation response sending: %s", sender, sender.GetClientId(), err))
 		_ = sender.Close()
 		return
 	}
-	logger.Info(fmt.Sprintf("%p (%s): Room created: %s", sender, sender.GetClientId(), roomId))
+	logger.Info(fmt.Sprintf("%p (%s): Room created: %s", sender, sender.GetClientId(), rd.roomId))
 }
 
-func (rm *RoomManager) handleJoinRoom(sender *connectionManager.ClientConnection, roomId string, guestPublicKey []byte) {
+// generateRoomId returns a random room id that's neither in use nor
+// reserved.
+func (rm *RoomManager) generateRoomId() string {
+	for {
+		roomId := utils.GenerateClientId()
+		if rm.findRoomById(roomId) == nil && !rm.reservations.IsReserved(roomId) {
+			return roomId
+		}
+	}
+}
+
+// reserveRoom checks that the sender may create the room payload.RoomId:
+// the payload is signed by the identity it presents, and the room id is
+// free or reserved for that identity, reserving it if it isn't yet. A room
+// still open under that id was left behind by the same owner (e.g. its
+// previous process, whose connection the transporter hasn't noticed is
+// dead yet), so it's closed for the new one to take over. Otherwise it
+// answers with an error and returns false.
+func (rm *RoomManager) reserveRoom(sender *connectionManager.ClientConnection, payload *protocol.TransporterMessagePayloadCreateRoom) bool {
+	logger := rm.logger
+	roomId := payload.RoomId
+	if err := reservation.ValidateRoomId(roomId); err != nil {
+		logger.Error(fmt.Sprintf("%p (%s): Can't reserve the room: %s", sender, sender.GetClientId(), err))
+		rm.sendErrorResponse(sender, protocol.CommandCreateRoom, protocol.ErrorInvalidPayload, err.Error())
+		return false
+	}
+	if len(payload.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(payload.PublicKey, protocol.RoomReservationMessage(roomId, sender.GetClientId()), payload.Signature) {
+		logger.Error(fmt.Sprintf("%p (%s): Invalid signature for the room %s", sender, sender.GetClientId(), roomId))
+		rm.sendErrorResponse(sender, protocol.CommandCreateRoom, protocol.ErrorInvalidSignature, fmt.Sprintf("The request for room %s isn't signed by the identity it presents", roomId))
+		return false
+	}
+	existing := rm.findRoomById(roomId)
+	if existing != nil && !bytes.Equal(existing.ownerPublicKey, payload.PublicKey) {
+		logger.Error(fmt.Sprintf("%p (%s): The room %s is in use by another identity", sender, sender.GetClientId(), roomId))
+		rm.sendErrorResponse(sender, protocol.CommandCreateRoom, protocol.ErrorRoomReserved, fmt.Sprintf("The room id %s is in use", roomId))
+		return false
+	}
+	if err := rm.reservations.Reserve(roomId, payload.PublicKey); err != nil {
+		logger.Error(fmt.Sprintf("%p (%s): Can't reserve the room %s: %s", sender, sender.GetClientId(), roomId, err))
+		switch {
+		case errors.Is(err, reservation.ErrReservedForOther):
+			rm.sendErrorResponse(sender, protocol.CommandCreateRoom, protocol.ErrorRoomReserved, fmt.Sprintf("The room id %s is reserved for another identity", roomId))
+		case errors.Is(err, reservation.ErrTooManyReservations), errors.Is(err, reservation.ErrStoreFull):
+			rm.sendErrorResponse(sender, protocol.CommandCreateRoom, protocol.ErrorRoomReserved, err.Error())
+		default:
+			rm.sendErrorResponse(sender, protocol.CommandCreateRoom, protocol.ErrorUnknown, "Couldn't save the room reservation")
+		}
+		return false
+	}
+	if existing != nil {
+		logger.Info(fmt.Sprintf("%p (%s): The owner of the room %s created it again, closing the previous one", sender, sender.GetClientId(), roomId))
+		rm.closeRoom(existing)
+	}
+	return true
+}
+
+// sendErrorResponse answers a command with an error, closing the
+// connection if even that fails.
+func (rm *RoomManager) sendErrorResponse(sender *connectionManager.ClientConnection, command uint32, errorCode int, errorMessage string) {
+	if err := sender.SendErrorResponse(command, errorCode, errorMessage); err != nil {
+		rm.logger.Error(fmt.Sprintf("%p (%s): Error during the error response sending, close the client connection", sender, sender.GetClientId()))
+		_ = sender.Close()
+	}
+}
+
+// handleJoinRoom hands the sender's join request to the room's owner, or
+// has it wait in the room's join queue. The guest's signature is the
+// owner's to check: it's the owner that trusts guest identities.
+func (rm *RoomManager) handleJoinRoom(sender *connectionManager.ClientConnection, request *protocol.TransporterMessagePayloadConnectRoom) {
 	logger := rm.logger
+	roomId := request.RoomId
 	logger.Info(fmt.Sprintf("%p (%s): Join room request: %s", sender, sender.GetClientId(), roomId))
 
 	targetRoom := rm.findRoomById(roomId)
@@ -164,27 +306,83 @@ func (rm *RoomManager) handleJoinRoom(sender *connectionManager.ClientConnection
 		return
 	}
 
+	if rm.isClientInARoom(sender) {
+		logger.Error(fmt.Sprintf("%p (%s): Client can't join room %s: it's already in a room, or waiting to join one", sender, sender.GetClientId(), roomId))
+		rm.sendErrorResponse(sender, protocol.CommandJoinRoom, protocol.ErrorAlreadyInRoom, "You already are in a room, or waiting to join one")
+		return
+	}
+
 	if targetRoom.guest != nil {
-		logger.Error(fmt.Sprintf("%p (%s): Client can't join room %s: it already has a guest", sender, sender.GetClientId(), roomId))
-		if err := sender.SendErrorResponse(protocol.CommandJoinRoom, protocol.ErrorFull, "This room already has a guest; only one guest is allowed per room"); err != nil {
-			logger.Error(fmt.Sprintf("%p (%s): Error during the error response sending: %s", sender, sender.GetClientId(), err))
-			_ = sender.Close()
-		}
+		rm.enqueueGuest(targetRoom, sender, request)
 		return
 	}
+	rm.requestJoin(targetRoom, sender, request)
+}
 
-	targetRoom.guest = sender
-	owner := targetRoom.owner
-	if err := owner.SendJoinRoomRequest(roomId, sender.GetClientId(), guestPublicKey); err != nil {
+// requestJoin makes guest the room's guest and hands its join request to
+// the owner, closing the room if that fails.
+func (rm *RoomManager) requestJoin(room *roomData, guest *connectionManager.ClientConnection, request *protocol.TransporterMessagePayloadConnectRoom) {
+	logger := rm.logger
+	room.guest = guest
+	owner := room.owner
+	if err := owner.SendJoinRoomRequest(room.roomId, guest.GetClientId(), request.PublicKey, request.Signature); err != nil {
 		logger.Error(fmt.Sprintf("%p (%s): Error during the join room request sending to the room owner: %s", owner, owner.GetClientId(), err))
-		if err := sender.SendErrorResponse(protocol.CommandJoinRoom, protocol.ErrorUnknown, "Couldn't send the join request to the room owner, closing down the room"); err != nil {
-			logger.Error(fmt.Sprintf("%p (%s): Error sending the failure notice to the guest: %s", sender, sender.GetClientId(), err))
+		if err := guest.SendErrorResponse(protocol.CommandJoinRoom, protocol.ErrorUnknown, "Couldn't send the join request to the room owner, closing down the room"); err != nil {
+			logger.Error(fmt.Sprintf("%p (%s): Error sending the failure notice to the guest: %s", guest, guest.GetClientId(), err))
 		}
-		rm.closeRoom(targetRoom)
+		rm.closeRoom(room)
+	}
+}
+
+// enqueueGuest has sender wait in the room's join queue until the guests
+// ahead of it had their turn, unless the queue is full.
+func (rm *RoomManager) enqueueGuest(room *roomData, sender *connectionManager.ClientConnection, request *protocol.TransporterMessagePayloadConnectRoom) {
+	logger := rm.logger
+	if len(room.queue) >= protocol.MaxJoinQueue {
+		logger.Error(fmt.Sprintf("%p (%s): Client can't join room %s: it already has a guest, and its join queue is full", sender, sender.GetClientId(), room.roomId))
+		rm.sendErrorResponse(sender, protocol.CommandJoinRoom, protocol.ErrorFull, fmt.Sprintf("This room already has a guest, and %d more waiting to join", len(room.queue)))
+		return
+	}
+	room.queue = append(room.queue, &queuedGuest{connection: sender, request: request})
+	logger.Info(fmt.Sprintf("%p (%s): Waiting to join room %s, number %d in line", sender, sender.GetClientId(), room.roomId, len(room.queue)))
+	rm.announceQueue(room, len(room.queue)-1)
+}
+
+// admitNext hands the join request of the first guest in the room's join
+// queue to the owner, now that the room has no guest.
+func (rm *RoomManager) admitNext(room *roomData) {
+	if len(room.queue) == 0 {
+		return
 	}
+	next := room.queue[0]
+	room.queue = room.queue[1:]
+	rm.logger.Info(fmt.Sprintf("%p (%s): Next in line to join room %s", next.connection, next.connection.GetClientId(), room.roomId))
+	rm.announceQueue(room, 0)
+	rm.requestJoin(room, next.connection, next.request)
 }
 
-func (rm *RoomManager) handleJoinRoomResponse(sender *connectionManager.ClientConnection, isAccepted int, ownerPublicKey []byte) {
+// announceQueue tells the guests in the room's join queue, from the one at
+// index from on, where they are in line, and the owner who's waiting. A
+// guest that can't be told is disconnected, which takes it off the queue.
+func (rm *RoomManager) announceQueue(room *roomData, from int) {
+	logger := rm.logger
+	guestClientIds := make([]string, 0, len(room.queue))
+	for i, waiting := range room.queue {
+		guestClientIds = append(guestClientIds, waiting.connection.GetClientId())
+		if i < from {
+			continue
+		}
+		if err := waiting.connection.SendQueuePosition(i + 1); err != nil {
+			logger.Error(fmt.Sprintf("%p (%s): Failed to send the join queue position, closing the connection: %s", waiting.connection, waiting.connection.GetClientId(), err))
+			_ = waiting.connection.Close()
+		}
+	}
+	if err := room.owner.SendJoinQueue(guestClientIds); err != nil {
+		logger.Error(fmt.Sprintf("%p (%s): Failed to send the join queue to the room owner: %s", room.owner, room.owner.GetClientId(), err))
+	}
+}
+
+func (rm *RoomManager) handleJoinRoomResponse(sender *connectionManager.ClientConnection, isAccepted int, ownerPublicKey []byte, devices []string, features []string) {
 	logger := rm.logger
 	logger.Info(fmt.Sprintf("%p (%s): Handle join room response", sender, sender.GetClientId()))
 
@@ -207,34 +405,38 @@ func (rm *RoomManager) handleJoinRoomResponse(sender *connectionManager.ClientCo
 		return
 	}
 
-	if err := targetRoom.guest.SendJoinRoomResponse(isAccepted, sender.GetClientId(), ownerPublicKey); err != nil {
+	if err := targetRoom.guest.SendJoinRoomResponse(isAccepted, sender.GetClientId(), ownerPublicKey, devices, features); err != nil {
 		logger.Error(fmt.Sprintf("%p (%s): Error during the response sending to the guest", sender, sender.GetClientId()))
 		_ = targetRoom.guest.Close()
 		targetRoom.guest = nil
 
 		if err := sender.SendErrorResponse(protocol.CommandJoinRoom, protocol.ErrorNoParticipant, "participant disconnected during the response sending, the room is waiting for another participant"); err != nil {
 			rm.closeRoom(targetRoom)
+			return
 		}
+		rm.admitNext(targetRoom)
 		return
 	}
 
 	if isAccepted == 0 {
 		logger.Info(fmt.Sprintf("%p (%s): Join room request declined, evicting the guest", sender, sender.GetClientId()))
 		targetRoom.guest = nil
+		rm.admitNext(targetRoom)
 		return
 	}
 
 	logger.Info(fmt.Sprintf("%p (%s): The room %s is ready to relay ADB messages", sender, sender.GetClientId(), targetRoom.roomId))
 }
 
-// handleAdbTransport forwards an opaque ADB transport message from the
-// sender to the other participant in the sender's room. The transporter
-// never inspects the embedded ADB payload; it only routes it.
-func (rm *RoomManager) handleAdbTransport(sender *connectionManager.ClientConnection, message *protocol.TransporterMessage) {
+// relayToPeer forwards a message from the sender to the other participant
+// in the sender's room: an opaque ADB transport message, or a chat message
+// signed end to end. The transporter never inspects the embedded ADB
+// payload or chat text; it only routes them.
+func (rm *RoomManager) relayToPeer(sender *connectionManager.ClientConnection, message *protocol.TransporterMessage) {
 	logger := rm.logger
 	targetRoom := rm.findRoomByParticipant(sender)
 	if targetRoom == nil {
-		logger.Warn(fmt.Sprintf("%p (%s): Received an ADB transport message outside of any room", sender, sender.GetClientId()))
+		logger.Warn(fmt.Sprintf("%p (%s): Received a message to relay (%x) outside of any room", sender, sender.GetClientId(), message.Command()))
 		return
 	}
 
@@ -245,12 +447,148 @@ func (rm *RoomManager) handleAdbTransport(sender *connectionManager.ClientConnec
 		target = targetRoom.owner
 	}
 	if target == nil {
-		logger.Warn(fmt.Sprintf("%p (%s): Received an ADB transport message but the room has no other participant", sender, sender.GetClientId()))
+		logger.Warn(fmt.Sprintf("%p (%s): Received a message to relay (%x) but the room has no other participant", sender, sender.GetClientId(), message.Command()))
 		return
 	}
 
 	if err := target.Send(message); err != nil {
-		logger.Error(fmt.Sprintf("%p (%s): Failed to forward the ADB transport message: %s", sender, sender.GetClientId(), err))
+		logger.Error(fmt.Sprintf("%p (%s): Failed to relay message %x: %s", sender, sender.GetClientId(), message.Command(), err))
+	}
+}
+
+// forwardToGuest forwards an owner's notice about its devices (their state
+// or details) or the guest's session lease to its room's guest. Only the
+// owner knows about either, so a guest sending one is ignored, as is one in
+// a room nobody joined yet: the owner repeats what matters to a guest once
+// it accepts it.
+func (rm *RoomManager) forwardToGuest(sender *connectionManager.ClientConnection, message *protocol.TransporterMessage) {
+	logger := rm.logger
+	targetRoom := rm.findRoomByOwner(sender)
+	if targetRoom == nil {
+		logger.Warn(fmt.Sprintf("%p (%s): Received an owner-only message (%x) from a client that doesn't own a room", sender, sender.GetClientId(), message.Command()))
+		return
+	}
+	if targetRoom.guest == nil {
+		return
+	}
+	if err := targetRoom.guest.Send(message); err != nil {
+		logger.Error(fmt.Sprintf("%p (%s): Failed to forward message %x to the guest: %s", sender, sender.GetClientId(), message.Command(), err))
+	}
+}
+
+// handleKickGuest takes the guest out of the sender's room at its request,
+// forwarding it the owner's message, and so its reason, first. The guest's
+// connection stays open, outside of any room, for it to leave on its own;
+// the owner is told the guest left, as if it had disconnected, and the next
+// guest in line gets its turn.
+func (rm *RoomManager) handleKickGuest(sender *connectionManager.ClientConnection, message *protocol.TransporterMessage) {
+	logger := rm.logger
+	targetRoom := rm.findRoomByOwner(sender)
+	if targetRoom == nil {
+		logger.Warn(fmt.Sprintf("%p (%s): Received a kick from a client that doesn't own a room", sender, sender.GetClientId()))
+		return
+	}
+	guest := targetRoom.guest
+	if guest == nil {
+		// The guest left while the kick was on its way.
+		logger.Info(fmt.Sprintf("%p (%s): No guest to remove from room %s", sender, sender.GetClientId(), targetRoom.roomId))
+		return
+	}
+	logger.Info(fmt.Sprintf("%p (%s): Removing the guest %p (%s) from room %s", sender, sender.GetClientId(), guest, guest.GetClientId(), targetRoom.roomId))
+	targetRoom.guest = nil
+	if err := guest.Send(message); err != nil {
+		logger.Error(fmt.Sprintf("%p (%s): Failed to tell the guest it was removed, closing its connection: %s", guest, guest.GetClientId(), err))
+		_ = guest.Close()
+	}
+	if err := sender.SendGuestLeft(); err != nil {
+		logger.Error(fmt.Sprintf("%p (%s): Failed to notify the owner that the guest left: %s", sender, sender.GetClientId(), err))
+	}
+	rm.admitNext(targetRoom)
+}
+
+// handlePublishRoom lists the sender's room in the room directory of the
+// team it names, until the room closes. Publishing again replaces the
+// listing. The identity the room is listed under must have signed the
+// listing for this connection and, for a reserved room, be the one it's
+// reserved for, so nobody lists a room under somebody else's fingerprint.
+func (rm *RoomManager) handlePublishRoom(sender *connectionManager.ClientConnection, payload *protocol.TransporterMessagePayloadPublishRoom) {
+	logger := rm.logger
+	logger.Info(fmt.Sprintf("%p (%s): Publish room request for team %s", sender, sender.GetClientId(), payload.Team))
+	targetRoom := rm.findRoomByOwner(sender)
+	if targetRoom == nil {
+		logger.Error(fmt.Sprintf("%p (%s): Can't publish a room: the client doesn't own one", sender, sender.GetClientId()))
+		rm.sendErrorResponse(sender, protocol.CommandPublishRoom, protocol.ErrorRoomNotFound, "You don't own a room to publish")
+		return
+	}
+	if !rm.teams.Authorize(payload.Team, payload.TeamToken) {
+		logger.Error(fmt.Sprintf("%p (%s): Can't publish the room %s: access to team %s denied", sender, sender.GetClientId(), targetRoom.roomId, payload.Team))
+		rm.sendErrorResponse(sender, protocol.CommandPublishRoom, protocol.ErrorTeamAccessDenied, fmt.Sprintf("Unknown team %s, or wrong team token", payload.Team))
+		return
+	}
+	if len(payload.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(payload.PublicKey, protocol.RoomListingMessage(targetRoom.roomId, sender.GetClientId()), payload.Signature) {
+		logger.Error(fmt.Sprintf("%p (%s): Can't publish the room %s: invalid listing signature", sender, sender.GetClientId(), targetRoom.roomId))
+		rm.sendErrorResponse(sender, protocol.CommandPublishRoom, protocol.ErrorInvalidSignature, "The listing isn't signed by the identity it presents")
+		return
+	}
+	if targetRoom.ownerPublicKey != nil && !bytes.Equal(payload.PublicKey, targetRoom.ownerPublicKey) {
+		logger.Error(fmt.Sprintf("%p (%s): Can't publish the room %s under another identity than the one it's reserved for", sender, sender.GetClientId(), targetRoom.roomId))
+		rm.sendErrorResponse(sender, protocol.CommandPublishRoom, protocol.ErrorInvalidSignature, fmt.Sprintf("The room %s is reserved for another identity", targetRoom.roomId))
+		return
+	}
+	if err := directory.ValidateListing(payload); err != nil {
+		logger.Error(fmt.Sprintf("%p (%s): Can't publish the room %s: %s", sender, sender.GetClientId(), targetRoom.roomId, err))
+		rm.sendErrorResponse(sender, protocol.CommandPublishRoom, protocol.ErrorInvalidPayload, err.Error())
+		return
+	}
+	// The token and signature aren't needed anymore; don't keep them
+	// around.
+	payload.TeamToken = ""
+	payload.Signature = nil
+	targetRoom.team = payload.Team
+	targetRoom.listing = payload
+	if err := sender.SendPublishRoomResponse(); err != nil {
+		logger.Error(fmt.Sprintf("%p (%s): Error during the publish room response sending: %s", sender, sender.GetClientId(), err))
+		_ = sender.Close()
+		return
+	}
+	logger.Info(fmt.Sprintf("%p (%s): Room %s published to team %s", sender, sender.GetClientId(), targetRoom.roomId, payload.Team))
+}
+
+// handleListRooms answers with the rooms published to team, sorted by room
+// id, up to protocol.MaxListedRooms of them.
+func (rm *RoomManager) handleListRooms(sender *connectionManager.ClientConnection, team string, teamToken string) {
+	logger := rm.logger
+	logger.Info(fmt.Sprintf("%p (%s): List rooms request for team %s", sender, sender.GetClientId(), team))
+	if !rm.teams.Authorize(team, teamToken) {
+		logger.Error(fmt.Sprintf("%p (%s): Can't list the rooms: access to team %s denied", sender, sender.GetClientId(), team))
+		rm.sendErrorResponse(sender, protocol.CommandListRooms, protocol.ErrorTeamAccessDenied, fmt.Sprintf("Unknown team %s, or wrong team token", team))
+		return
+	}
+	rooms := make([]protocol.TransporterRoomListing, 0)
+	for _, room := range rm.rooms {
+		if room.listing == nil || room.team != team {
+			continue
+		}
+		occupied := 0
+		if room.guest != nil {
+			occupied = 1
+		}
+		rooms = append(rooms, protocol.TransporterRoomListing{
+			RoomId:    room.roomId,
+			Label:     room.listing.Label,
+			PublicKey: room.listing.PublicKey,
+			Models:    room.listing.Models,
+			Tags:      room.listing.Tags,
+			Occupied:  occupied,
+		})
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].RoomId < rooms[j].RoomId })
+	if len(rooms) > protocol.MaxListedRooms {
+		rooms = rooms[:protocol.MaxListedRooms]
+	}
+	if err := sender.SendRoomList(rooms); err != nil {
+		logger.Error(fmt.Sprintf("%p (%s): Error during the room list sending: %s", sender, sender.GetClientId(), err))
+		_ = sender.Close()
 	}
 }
 
@@ -265,6 +603,10 @@ func (rm *RoomManager) closeRoom(room *roomData) {
 		logger.Info(fmt.Sprintf("%p (%s): Disconnecting client due to room close", room.guest, room.guest.GetClientId()))
 		_ = room.guest.Close()
 	}
+	for _, waiting := range room.queue {
+		logger.Info(fmt.Sprintf("%p (%s): Disconnecting client waiting to join due to room close", waiting.connection, waiting.connection.GetClientId()))
+		_ = waiting.connection.Close()
+	}
 
 	targetIndex := -1
 	for index, candidate := range rm.rooms {
@@ -282,7 +624,11 @@ func (rm *RoomManager) closeRoom(room *roomData) {
 }
 
 func (rm *RoomManager) isClientInARoom(connection *connectionManager.ClientConnection) bool {
-	return rm.findRoomByParticipant(connection) != nil
+	if rm.findRoomByParticipant(connection) != nil {
+		return true
+	}
+	room, _ := rm.findRoomByQueuedGuest(connection)
+	return room != nil
 }
 
 func (rm *RoomManager) findRoomById(roomId string) *roomData {
@@ -312,10 +658,29 @@ func (rm *RoomManager) findRoomByParticipant(connection *connectionManager.Clien
 	return nil
 }
 
+// findRoomByQueuedGuest returns the room whose join queue connection waits
+// in, and its index in it.
+func (rm *RoomManager) findRoomByQueuedGuest(connection *connectionManager.ClientConnection) (*roomData, int) {
+	for _, room := range rm.rooms {
+		for index, waiting := range room.queue {
+			if waiting.connection == connection {
+				return room, index
+			}
+		}
+	}
+	return nil, -1
+}
+
 func (rm *RoomManager) handleClientDisconnected(client *connectionManager.ClientConnection) {
 	logger := rm.logger
 	logger.Info(fmt.Sprintf("Client disconnected: %p", client))
 
+	if queuedRoom, index := rm.findRoomByQueuedGuest(client); queuedRoom != nil {
+		logger.Info(fmt.Sprintf("The disconnected client was waiting to join the room (%s), taking it off the queue: %p", queuedRoom.roomId, client))
+		queuedRoom.queue = append(queuedRoom.queue[:index], queuedRoom.queue[index+1:]...)
+		rm.announceQueue(queuedRoom, index)
+		return
+	}
 	targetRoom := rm.findRoomByParticipant(client)
 	if targetRoom == nil {
 		logger.Info(fmt.Sprintf("The disconnected client did not join a room: %p", client))
@@ -331,5 +696,6 @@ func (rm *RoomManager) handleClientDisconnected(client *connectionManager.Client
 		if err := targetRoom.owner.SendGuestLeft(); err != nil {
 			logger.Error(fmt.Sprintf("%p (%s): Failed to notify the owner that the guest left: %s", targetRoom.owner, targetRoom.owner.GetClientId(), err))
 		}
+		rm.admitNext(targetRoom)
 	}
 }
@@ -3,12 +3,19 @@ package roomManager
 import (
 	"adb-remote.maci.team/shared/protocol"
 	"adb-remote.maci.team/transporter/config"
+	"adb-remote.maci.team/transporter/directory"
 	"adb-remote.maci.team/transporter/manager/connectionManager"
+	"adb-remote.maci.team/transporter/reservation"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"io"
 	"log/slog"
 	"net"
 	"path/filepath"
+	"slices"
 	"testing"
 	"time"
 )
@@ -31,6 +38,25 @@ func freeLocalAddress(t *testing.T) string {
 // startTestSystem wires a ConnectionManager and RoomManager together exactly
 // like the real transporter binary does, on an ephemeral local port.
 func startTestSystem(t *testing.T) string {
+	t.Helper()
+	return startTestSystemWithReservations(t, loadTestReservations(t, filepath.Join(t.TempDir(), "reservations.json")))
+}
+
+func loadTestReservations(t *testing.T, path string) *reservation.Store {
+	t.Helper()
+	reservations, err := reservation.Load(path, newTestLogger())
+	if err != nil {
+		t.Fatalf("failed to load the room reservations: %s", err)
+	}
+	// Don't let the test's temporary directory go while it's written to.
+	t.Cleanup(reservations.Flush)
+	return reservations
+}
+
+// startTestSystemWithReservations is startTestSystem keeping room
+// reservations in reservations, for a test to restart the transporter with
+// the same ones.
+func startTestSystemWithReservations(t *testing.T, reservations *reservation.Store) string {
 	t.Helper()
 	address := freeLocalAddress(t)
 	dir := t.TempDir()
@@ -39,7 +65,13 @@ func startTestSystem(t *testing.T) string {
 		TLSCertFile: filepath.Join(dir, "cert.pem"),
 		TLSKeyFile:  filepath.Join(dir, "key.pem"),
 	}, newTestLogger())
-	rm := CreateRoomManager(cm, newTestLogger())
+	// The test team's token is "secret".
+	secretHash := sha256.Sum256([]byte("secret"))
+	teams, err := directory.NewTeams([]config.TeamConfiguration{{Name: "mobile", TokenSha256: hex.EncodeToString(secretHash[:])}})
+	if err != nil {
+		t.Fatalf("NewTeams failed: %s", err)
+	}
+	rm := CreateRoomManager(cm, reservations, teams, newTestLogger())
 
 	started := make(chan struct{})
 	go func() {
@@ -113,12 +145,7 @@ func (tc *testClient) readMessage() *protocol.TransporterMessage {
 
 func (tc *testClient) createRoom() string {
 	tc.t.Helper()
-	request := protocol.CreateTransporterMessage()
-	request.SetDirectCommand(protocol.CommandCreateRoom)
-	if err := request.Write(tc.conn); err != nil {
-		tc.t.Fatalf("failed to write the create-room request: %s", err)
-	}
-	response := tc.readMessage()
+	response := tc.requestRoom(&protocol.TransporterMessagePayloadCreateRoom{})
 	if response.IsError() {
 		payload, _ := response.GetErrorPayload()
 		tc.t.Fatalf("create room failed: %+v", payload)
@@ -130,16 +157,127 @@ func (tc *testClient) createRoom() string {
 	return payload.RoomId
 }
 
+// createReservedRoom asks for roomId, signed by privateKey, and returns
+// the error code it was refused with, or 0 if it was created.
+func (tc *testClient) createReservedRoom(roomId string, privateKey ed25519.PrivateKey) int {
+	tc.t.Helper()
+	response := tc.requestRoom(&protocol.TransporterMessagePayloadCreateRoom{
+		RoomId:    roomId,
+		PublicKey: privateKey.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(privateKey, protocol.RoomReservationMessage(roomId, tc.clientId)),
+	})
+	if response.IsError() {
+		payload, err := response.GetErrorPayload()
+		if err != nil {
+			tc.t.Fatalf("GetErrorPayload failed: %s", err)
+		}
+		return payload.ErrorCode
+	}
+	payload, err := response.GetPayloadCreateRoomResponse()
+	if err != nil {
+		tc.t.Fatalf("GetPayloadCreateRoomResponse failed: %s", err)
+	}
+	if payload.RoomId != roomId {
+		tc.t.Fatalf("expected the room %q, got %q", roomId, payload.RoomId)
+	}
+	return 0
+}
+
+func (tc *testClient) requestRoom(request *protocol.TransporterMessagePayloadCreateRoom) *protocol.TransporterMessage {
+	tc.t.Helper()
+	message := protocol.CreateTransporterMessage()
+	message.SetDirectCommand(protocol.CommandCreateRoom)
+	if err := message.SetPayloadCreateRoom(request); err != nil {
+		tc.t.Fatalf("SetPayloadCreateRoom failed: %s", err)
+	}
+	if err := message.Write(tc.conn); err != nil {
+		tc.t.Fatalf("failed to write the create-room request: %s", err)
+	}
+	return tc.readMessage()
+}
+
+// publishRoom publishes the client's room roomId under key's identity,
+// returning the error code it was refused with, or 0.
+func (tc *testClient) publishRoom(roomId string, key ed25519.PrivateKey, published *protocol.TransporterMessagePayloadPublishRoom) int {
+	tc.t.Helper()
+	published.PublicKey = key.Public().(ed25519.PublicKey)
+	published.Signature = ed25519.Sign(key, protocol.RoomListingMessage(roomId, tc.clientId))
+	message := protocol.CreateTransporterMessage()
+	message.SetDirectCommand(protocol.CommandPublishRoom)
+	if err := message.SetPayloadPublishRoom(published); err != nil {
+		tc.t.Fatalf("SetPayloadPublishRoom failed: %s", err)
+	}
+	if err := message.Write(tc.conn); err != nil {
+		tc.t.Fatalf("failed to write the publish room request: %s", err)
+	}
+	return tc.expectResponse(protocol.CommandPublishRoom).errorCode
+}
+
+// listRooms lists team's rooms, returning them, or the error code it was
+// refused with.
+func (tc *testClient) listRooms(team string, teamToken string) ([]protocol.TransporterRoomListing, int) {
+	tc.t.Helper()
+	message := protocol.CreateTransporterMessage()
+	message.SetDirectCommand(protocol.CommandListRooms)
+	if err := message.SetPayloadListRooms(&protocol.TransporterMessagePayloadListRooms{Team: team, TeamToken: teamToken}); err != nil {
+		tc.t.Fatalf("SetPayloadListRooms failed: %s", err)
+	}
+	if err := message.Write(tc.conn); err != nil {
+		tc.t.Fatalf("failed to write the list rooms request: %s", err)
+	}
+	response := tc.expectResponse(protocol.CommandListRooms)
+	if response.errorCode != 0 {
+		return nil, response.errorCode
+	}
+	payload, err := response.message.GetPayloadRoomList()
+	if err != nil {
+		tc.t.Fatalf("GetPayloadRoomList failed: %s", err)
+	}
+	return payload.Rooms, 0
+}
+
+type testResponse struct {
+	message   *protocol.TransporterMessage
+	errorCode int
+}
+
+// expectResponse reads the response to command, or the error it failed
+// with.
+func (tc *testClient) expectResponse(command uint32) testResponse {
+	tc.t.Helper()
+	message := tc.readMessage()
+	if message.IsError() {
+		payload, err := message.GetErrorPayload()
+		if err != nil {
+			tc.t.Fatalf("GetErrorPayload failed: %s", err)
+		}
+		return testResponse{message: message, errorCode: payload.ErrorCode}
+	}
+	if message.Command() != command|protocol.CommandResponseMask {
+		tc.t.Fatalf("expected a response to %x, got %x", command, message.Command())
+	}
+	return testResponse{message: message}
+}
+
+func newTestKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate a key: %s", err)
+	}
+	return privateKey
+}
+
 func (tc *testClient) joinRoom(roomId string) {
 	tc.t.Helper()
-	tc.joinRoomWithKey(roomId, nil)
+	tc.joinRoomWithKey(roomId, nil, nil)
 }
 
-func (tc *testClient) joinRoomWithKey(roomId string, publicKey []byte) {
+func (tc *testClient) joinRoomWithKey(roomId string, publicKey []byte, signature []byte) {
 	tc.t.Helper()
 	request := protocol.CreateTransporterMessage()
 	request.SetDirectCommand(protocol.CommandJoinRoom)
-	if err := request.SetPayloadConnectRoom(&protocol.TransporterMessagePayloadConnectRoom{RoomId: roomId, PublicKey: publicKey}); err != nil {
+	if err := request.SetPayloadConnectRoom(&protocol.TransporterMessagePayloadConnectRoom{RoomId: roomId, PublicKey: publicKey, Signature: signature}); err != nil {
 		tc.t.Fatalf("SetPayloadConnectRoom failed: %s", err)
 	}
 	if err := request.Write(tc.conn); err != nil {
@@ -149,11 +287,11 @@ func (tc *testClient) joinRoomWithKey(roomId string, publicKey []byte) {
 
 func (tc *testClient) expectJoinRoomRequest() (roomId string, guestClientId string) {
 	tc.t.Helper()
-	roomId, guestClientId, _ = tc.expectJoinRoomRequestWithKey()
-	return roomId, guestClientId
+	request := tc.expectJoinRoomRequestWithKey()
+	return request.RoomId, request.ClientId
 }
 
-func (tc *testClient) expectJoinRoomRequestWithKey() (roomId string, guestClientId string, guestPublicKey []byte) {
+func (tc *testClient) expectJoinRoomRequestWithKey() *protocol.TransporterMessagePayloadConnectRoom {
 	tc.t.Helper()
 	message := tc.readMessage()
 	if message.Command() != protocol.CommandJoinRoom {
@@ -163,7 +301,7 @@ func (tc *testClient) expectJoinRoomRequestWithKey() (roomId string, guestClient
 	if err != nil {
 		tc.t.Fatalf("GetPayloadConnectRoom failed: %s", err)
 	}
-	return payload.RoomId, payload.ClientId, payload.PublicKey
+	return payload
 }
 
 func (tc *testClient) respondToJoinRoom(accepted int) {
@@ -202,6 +340,32 @@ func (tc *testClient) expectJoinRoomResponseWithKey() (accepted int, ownerClient
 	return payload.Accepted, payload.ClientId, payload.PublicKey
 }
 
+func (tc *testClient) expectQueuePosition() int {
+	tc.t.Helper()
+	message := tc.readMessage()
+	if message.Command() != protocol.CommandQueuePosition {
+		tc.t.Fatalf("expected a join queue position, got %x", message.Command())
+	}
+	payload, err := message.GetPayloadQueuePosition()
+	if err != nil {
+		tc.t.Fatalf("GetPayloadQueuePosition failed: %s", err)
+	}
+	return payload.Position
+}
+
+func (tc *testClient) expectJoinQueue() []string {
+	tc.t.Helper()
+	message := tc.readMessage()
+	if message.Command() != protocol.CommandJoinQueue {
+		tc.t.Fatalf("expected the join queue, got %x", message.Command())
+	}
+	payload, err := message.GetPayloadJoinQueue()
+	if err != nil {
+		tc.t.Fatalf("GetPayloadJoinQueue failed: %s", err)
+	}
+	return payload.GuestClientIds
+}
+
 func (tc *testClient) sendAdbTransport(raw []byte) {
 	tc.t.Helper()
 	message := protocol.CreateTransporterMessage()
@@ -214,6 +378,18 @@ func (tc *testClient) sendAdbTransport(raw []byte) {
 	}
 }
 
+func (tc *testClient) sendDeviceState(device int, state string) {
+	tc.t.Helper()
+	message := protocol.CreateTransporterMessage()
+	message.SetDirectCommand(protocol.CommandDeviceState)
+	if err := message.SetPayloadDeviceState(&protocol.TransporterMessagePayloadDeviceState{Device: device, State: state}); err != nil {
+		tc.t.Fatalf("SetPayloadDeviceState failed: %s", err)
+	}
+	if err := message.Write(tc.conn); err != nil {
+		tc.t.Fatalf("failed to write the device state message: %s", err)
+	}
+}
+
 func (tc *testClient) expectAdbTransport() []byte {
 	tc.t.Helper()
 	message := tc.readMessage()
@@ -248,7 +424,7 @@ func TestCreateAndJoinRoomAccepted(t *testing.T) {
 // TestJoinRoomForwardsIdentitiesBothWays confirms the transporter carries
 // each side's public key to the other: the guest's key arrives with the
 // join request (already covered by joinRoomAndAccept's guestClientId
-// check), and the owner's key arrives with the join response, tagged with
+// check) along with its signature, and the owner's key arrives with the join response, tagged with
 // the owner's client id (which the owner itself never sends — the
 // transporter fills it in from the connection it already knows).
 func TestJoinRoomForwardsIdentitiesBothWays(t *testing.T) {
@@ -259,13 +435,14 @@ func TestJoinRoomForwardsIdentitiesBothWays(t *testing.T) {
 	roomId := owner.createRoom()
 
 	guestPublicKey := []byte{0x01, 0x02, 0x03}
-	guest.joinRoomWithKey(roomId, guestPublicKey)
-	_, guestClientId, receivedGuestKey := owner.expectJoinRoomRequestWithKey()
-	if guestClientId != guest.clientId {
-		t.Fatalf("expected the guest's client id %q in the join request, got %q", guest.clientId, guestClientId)
+	guestSignature := []byte{0x04, 0x05}
+	guest.joinRoomWithKey(roomId, guestPublicKey, guestSignature)
+	request := owner.expectJoinRoomRequestWithKey()
+	if request.ClientId != guest.clientId {
+		t.Fatalf("expected the guest's client id %q in the join request, got %q", guest.clientId, request.ClientId)
 	}
-	if string(receivedGuestKey) != string(guestPublicKey) {
-		t.Fatalf("expected the owner to receive the guest's public key %x, got %x", guestPublicKey, receivedGuestKey)
+	if string(request.PublicKey) != string(guestPublicKey) || string(request.Signature) != string(guestSignature) {
+		t.Fatalf("expected the owner to receive the guest's public key %x and signature %x, got %+v", guestPublicKey, guestSignature, request)
 	}
 
 	ownerPublicKey := []byte{0xaa, 0xbb, 0xcc}
@@ -282,11 +459,46 @@ func TestJoinRoomForwardsIdentitiesBothWays(t *testing.T) {
 	}
 }
 
-// TestSecondGuestIsRejected is a regression test for the invariant that a
-// room has exactly one owner and one guest: a second guest trying to join
-// an already-occupied room must be rejected, not silently replace the
-// first guest.
-func TestSecondGuestIsRejected(t *testing.T) {
+// TestJoinRoomForwardsSharedDevices confirms the owner's device list, and
+// each device's adb features, reach the guest with the join response.
+func TestJoinRoomForwardsSharedDevices(t *testing.T) {
+	address := startTestSystem(t)
+	owner := dialTestClient(t, address)
+	guest := dialTestClient(t, address)
+
+	roomId := owner.createRoom()
+	guest.joinRoom(roomId)
+	owner.expectJoinRoomRequest()
+
+	response := protocol.CreateTransporterMessage()
+	response.SetResponseCommand(protocol.CommandJoinRoom)
+	devices := []string{"emulator-5554", "emulator-5556"}
+	features := []string{"shell_v2,cmd", ""}
+	if err := response.SetPayloadConnectRoomResult(&protocol.TransporterMessagePayloadConnectRoomResult{Accepted: 1, Devices: devices, Features: features}); err != nil {
+		t.Fatalf("SetPayloadConnectRoomResult failed: %s", err)
+	}
+	if err := response.Write(owner.conn); err != nil {
+		t.Fatalf("failed to write the join-room response: %s", err)
+	}
+
+	message := guest.readMessage()
+	payload, err := message.GetPayloadConnectRoomResponse()
+	if err != nil {
+		t.Fatalf("GetPayloadConnectRoomResponse failed: %s", err)
+	}
+	if len(payload.Devices) != 2 || payload.Devices[0] != devices[0] || payload.Devices[1] != devices[1] {
+		t.Fatalf("expected the guest to receive devices %v, got %v", devices, payload.Devices)
+	}
+	if len(payload.Features) != 2 || payload.Features[0] != features[0] || payload.Features[1] != features[1] {
+		t.Fatalf("expected the guest to receive features %q, got %q", features, payload.Features)
+	}
+}
+
+// TestSecondGuestWaitsInTheJoinQueue checks that a guest joining a room
+// that already has one waits in its join queue, without replacing the
+// first guest, and that its join request reaches the owner once the first
+// guest left.
+func TestSecondGuestWaitsInTheJoinQueue(t *testing.T) {
 	address := startTestSystem(t)
 	owner := dialTestClient(t, address)
 	guest1 := dialTestClient(t, address)
@@ -296,9 +508,104 @@ func TestSecondGuestIsRejected(t *testing.T) {
 	joinRoomAndAccept(t, owner, guest1, roomId)
 
 	guest2.joinRoom(roomId)
-	response := guest2.readMessage()
+	if position := guest2.expectQueuePosition(); position != 1 {
+		t.Fatalf("expected the second guest to be first in line, got %d", position)
+	}
+	if queue := owner.expectJoinQueue(); !slices.Equal(queue, []string{guest2.clientId}) {
+		t.Fatalf("expected the owner to see the second guest waiting, got %v", queue)
+	}
+
+	// The first guest's room membership must be unaffected.
+	guestToOwner := []byte("still connected")
+	guest1.sendAdbTransport(guestToOwner)
+	if received := owner.expectAdbTransport(); string(received) != string(guestToOwner) {
+		t.Fatalf("expected the first guest to remain in the room, got %q", received)
+	}
+
+	_ = guest1.conn.Close()
+	if message := owner.readMessage(); message.Command() != protocol.CommandGuestLeft {
+		t.Fatalf("expected a CommandGuestLeft notification, got %x", message.Command())
+	}
+	if queue := owner.expectJoinQueue(); len(queue) != 0 {
+		t.Fatalf("expected the join queue to be empty, got %v", queue)
+	}
+	if _, guestClientId := owner.expectJoinRoomRequest(); guestClientId != guest2.clientId {
+		t.Fatalf("expected the second guest's join request, got %q's", guestClientId)
+	}
+	owner.respondToJoinRoom(1)
+	if accepted := guest2.expectJoinRoomResponse(); accepted != 1 {
+		t.Fatalf("expected the second guest to be accepted")
+	}
+}
+
+// TestJoinQueueMovesUp checks that the guests behind one that gave up
+// waiting, or that the owner declined, move up the queue.
+func TestJoinQueueMovesUp(t *testing.T) {
+	address := startTestSystem(t)
+	owner := dialTestClient(t, address)
+	guest1 := dialTestClient(t, address)
+	guest2 := dialTestClient(t, address)
+	guest3 := dialTestClient(t, address)
+	guest4 := dialTestClient(t, address)
+
+	roomId := owner.createRoom()
+	guest1.joinRoom(roomId)
+	owner.expectJoinRoomRequest()
+	for i, guest := range []*testClient{guest2, guest3, guest4} {
+		guest.joinRoom(roomId)
+		if position := guest.expectQueuePosition(); position != i+1 {
+			t.Fatalf("expected to be number %d in line, got %d", i+1, position)
+		}
+		owner.expectJoinQueue()
+	}
+
+	_ = guest2.conn.Close()
+	if position := guest3.expectQueuePosition(); position != 1 {
+		t.Fatalf("expected the third guest to move up to first in line, got %d", position)
+	}
+	if position := guest4.expectQueuePosition(); position != 2 {
+		t.Fatalf("expected the fourth guest to move up to second in line, got %d", position)
+	}
+	if queue := owner.expectJoinQueue(); !slices.Equal(queue, []string{guest3.clientId, guest4.clientId}) {
+		t.Fatalf("unexpected join queue %v", queue)
+	}
+
+	owner.respondToJoinRoom(0)
+	if accepted := guest1.expectJoinRoomResponse(); accepted != 0 {
+		t.Fatalf("expected the first guest to be declined")
+	}
+	if position := guest4.expectQueuePosition(); position != 1 {
+		t.Fatalf("expected the fourth guest to move up to first in line, got %d", position)
+	}
+	if queue := owner.expectJoinQueue(); !slices.Equal(queue, []string{guest4.clientId}) {
+		t.Fatalf("unexpected join queue %v", queue)
+	}
+	if _, guestClientId := owner.expectJoinRoomRequest(); guestClientId != guest3.clientId {
+		t.Fatalf("expected the third guest's join request, got %q's", guestClientId)
+	}
+}
+
+// TestFullJoinQueueIsRejected checks that a room's join queue doesn't grow
+// past protocol.MaxJoinQueue.
+func TestFullJoinQueueIsRejected(t *testing.T) {
+	address := startTestSystem(t)
+	owner := dialTestClient(t, address)
+	roomId := owner.createRoom()
+	joinRoomAndAccept(t, owner, dialTestClient(t, address), roomId)
+	waiting := make([]*testClient, 0, protocol.MaxJoinQueue)
+	for range protocol.MaxJoinQueue {
+		guest := dialTestClient(t, address)
+		guest.joinRoom(roomId)
+		guest.expectQueuePosition()
+		owner.expectJoinQueue()
+		waiting = append(waiting, guest)
+	}
+
+	guest := dialTestClient(t, address)
+	guest.joinRoom(roomId)
+	response := guest.readMessage()
 	if !response.IsError() {
-		t.Fatalf("expected an error response for a second guest joining an occupied room")
+		t.Fatalf("expected an error response for a guest joining a room whose join queue is full")
 	}
 	payload, err := response.GetErrorPayload()
 	if err != nil {
@@ -308,11 +615,13 @@ func TestSecondGuestIsRejected(t *testing.T) {
 		t.Fatalf("expected error code %d, got %d", protocol.ErrorFull, payload.ErrorCode)
 	}
 
-	// The first guest's room membership must be unaffected.
-	guestToOwner := []byte("still connected")
-	guest1.sendAdbTransport(guestToOwner)
-	if received := owner.expectAdbTransport(); string(received) != string(guestToOwner) {
-		t.Fatalf("expected the first guest to remain in the room, got %q", received)
+	// Empty the queue again, for the transporter's connection count to
+	// stay within what it can shut down.
+	for i, guest := range waiting {
+		_ = guest.conn.Close()
+		if queue := owner.expectJoinQueue(); len(queue) != len(waiting)-i-1 {
+			t.Fatalf("expected %d guests left waiting, got %v", len(waiting)-i-1, queue)
+		}
 	}
 }
 
@@ -416,6 +725,186 @@ func TestAdbTransportIsRelayedBetweenRoomParticipants(t *testing.T) {
 	}
 }
 
+func TestChatMessageIsRelayedBetweenRoomParticipants(t *testing.T) {
+	address := startTestSystem(t)
+	owner := dialTestClient(t, address)
+	guest := dialTestClient(t, address)
+
+	roomId := owner.createRoom()
+	joinRoomAndAccept(t, owner, guest, roomId)
+
+	for _, c := range []struct {
+		from, to *testClient
+		text     string
+	}{{guest, owner, "Is the Pixel plugged in?"}, {owner, guest, "It is now."}} {
+		message := protocol.CreateTransporterMessage()
+		message.SetDirectCommand(protocol.CommandChatMessage)
+		if err := message.SetPayloadChatMessage(&protocol.TransporterMessagePayloadChatMessage{Text: c.text, SentAt: 1700000000, Sequence: 1, Signature: []byte{1}}); err != nil {
+			t.Fatalf("SetPayloadChatMessage failed: %s", err)
+		}
+		if err := message.Write(c.from.conn); err != nil {
+			t.Fatalf("failed to send the chat message: %s", err)
+		}
+		received := c.to.readMessage()
+		if received.Command() != protocol.CommandChatMessage {
+			t.Fatalf("expected a chat message, got %x", received.Command())
+		}
+		payload, err := received.GetPayloadChatMessage()
+		if err != nil {
+			t.Fatalf("GetPayloadChatMessage failed: %s", err)
+		}
+		if payload.Text != c.text || string(payload.Signature) != "\x01" {
+			t.Fatalf("unexpected chat message: %+v", payload)
+		}
+	}
+}
+
+func TestDeviceStateIsForwardedFromOwnerToGuestOnly(t *testing.T) {
+	address := startTestSystem(t)
+	owner := dialTestClient(t, address)
+	guest := dialTestClient(t, address)
+
+	roomId := owner.createRoom()
+	joinRoomAndAccept(t, owner, guest, roomId)
+
+	owner.sendDeviceState(1, "offline")
+	message := guest.readMessage()
+	if message.Command() != protocol.CommandDeviceState {
+		t.Fatalf("expected a device state message, got %x", message.Command())
+	}
+	payload, err := message.GetPayloadDeviceState()
+	if err != nil {
+		t.Fatalf("GetPayloadDeviceState failed: %s", err)
+	}
+	if payload.Device != 1 || payload.State != "offline" {
+		t.Fatalf("unexpected device state: %+v", payload)
+	}
+
+	guest.sendDeviceState(0, "device")
+	_ = owner.conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if err := protocol.CreateTransporterMessage().Read(owner.conn); err == nil {
+		t.Fatalf("did not expect a guest's device state to reach the owner")
+	}
+}
+
+func TestDeviceInfoIsForwardedToGuest(t *testing.T) {
+	address := startTestSystem(t)
+	owner := dialTestClient(t, address)
+	guest := dialTestClient(t, address)
+
+	roomId := owner.createRoom()
+	joinRoomAndAccept(t, owner, guest, roomId)
+
+	message := protocol.CreateTransporterMessage()
+	message.SetDirectCommand(protocol.CommandDeviceInfo)
+	if err := message.SetPayloadDeviceInfo(&protocol.TransporterMessagePayloadDeviceInfo{Device: 0, Model: "Pixel_7"}); err != nil {
+		t.Fatalf("SetPayloadDeviceInfo failed: %s", err)
+	}
+	if err := message.Write(owner.conn); err != nil {
+		t.Fatalf("failed to write the device info message: %s", err)
+	}
+
+	received := guest.readMessage()
+	if received.Command() != protocol.CommandDeviceInfo {
+		t.Fatalf("expected a device info message, got %x", received.Command())
+	}
+	payload, err := received.GetPayloadDeviceInfo()
+	if err != nil {
+		t.Fatalf("GetPayloadDeviceInfo failed: %s", err)
+	}
+	if payload.Model != "Pixel_7" {
+		t.Fatalf("unexpected device info: %+v", payload)
+	}
+}
+
+func TestSessionLeaseIsForwardedToGuest(t *testing.T) {
+	address := startTestSystem(t)
+	owner := dialTestClient(t, address)
+	guest := dialTestClient(t, address)
+
+	roomId := owner.createRoom()
+	joinRoomAndAccept(t, owner, guest, roomId)
+
+	message := protocol.CreateTransporterMessage()
+	message.SetDirectCommand(protocol.CommandSessionLease)
+	if err := message.SetPayloadSessionLease(&protocol.TransporterMessagePayloadSessionLease{State: protocol.LeaseRevoked}); err != nil {
+		t.Fatalf("SetPayloadSessionLease failed: %s", err)
+	}
+	if err := message.Write(owner.conn); err != nil {
+		t.Fatalf("failed to write the session lease message: %s", err)
+	}
+
+	received := guest.readMessage()
+	if received.Command() != protocol.CommandSessionLease {
+		t.Fatalf("expected a session lease message, got %x", received.Command())
+	}
+	payload, err := received.GetPayloadSessionLease()
+	if err != nil {
+		t.Fatalf("GetPayloadSessionLease failed: %s", err)
+	}
+	if payload.State != protocol.LeaseRevoked {
+		t.Fatalf("unexpected session lease: %+v", payload)
+	}
+}
+
+// TestKickedGuestLeavesTheRoom checks that a guest the owner kicks gets its
+// reason and is out of the room, that the owner is told it left, and that
+// the next guest in line gets its turn.
+func TestKickedGuestLeavesTheRoom(t *testing.T) {
+	address := startTestSystem(t)
+	owner := dialTestClient(t, address)
+	guest1 := dialTestClient(t, address)
+	guest2 := dialTestClient(t, address)
+
+	roomId := owner.createRoom()
+	joinRoomAndAccept(t, owner, guest1, roomId)
+	guest2.joinRoom(roomId)
+	guest2.expectQueuePosition()
+	owner.expectJoinQueue()
+
+	message := protocol.CreateTransporterMessage()
+	message.SetDirectCommand(protocol.CommandKickGuest)
+	if err := message.SetPayloadKickGuest(&protocol.TransporterMessagePayloadKickGuest{Reason: "Session over"}); err != nil {
+		t.Fatalf("SetPayloadKickGuest failed: %s", err)
+	}
+	if err := message.Write(owner.conn); err != nil {
+		t.Fatalf("failed to write the kick message: %s", err)
+	}
+
+	received := guest1.readMessage()
+	if received.Command() != protocol.CommandKickGuest {
+		t.Fatalf("expected a kick message, got %x", received.Command())
+	}
+	payload, err := received.GetPayloadKickGuest()
+	if err != nil {
+		t.Fatalf("GetPayloadKickGuest failed: %s", err)
+	}
+	if payload.Reason != "Session over" {
+		t.Fatalf("unexpected kick reason %q", payload.Reason)
+	}
+	if message := owner.readMessage(); message.Command() != protocol.CommandGuestLeft {
+		t.Fatalf("expected a CommandGuestLeft notification, got %x", message.Command())
+	}
+	if queue := owner.expectJoinQueue(); len(queue) != 0 {
+		t.Fatalf("expected the join queue to be empty, got %v", queue)
+	}
+	if _, guestClientId := owner.expectJoinRoomRequest(); guestClientId != guest2.clientId {
+		t.Fatalf("expected the second guest's join request, got %q's", guestClientId)
+	}
+	owner.respondToJoinRoom(1)
+	if accepted := guest2.expectJoinRoomResponse(); accepted != 1 {
+		t.Fatalf("expected the second guest to be accepted")
+	}
+
+	// The kicked guest's connection outlives the kick, but it's no longer
+	// in the room: only the second guest's traffic reaches the owner.
+	guest1.sendAdbTransport([]byte("kicked"))
+	guest2.sendAdbTransport([]byte("admitted"))
+	if received := owner.expectAdbTransport(); string(received) != "admitted" {
+		t.Fatalf("expected only the admitted guest's traffic, got %q", received)
+	}
+}
+
 func TestAdbTransportOutsideRoomIsDropped(t *testing.T) {
 	address := startTestSystem(t)
 	lonely := dialTestClient(t, address)
@@ -472,3 +961,194 @@ func TestGuestDisconnectNotifiesOwner(t *testing.T) {
 	guest2 := dialTestClient(t, address)
 	joinRoomAndAccept(t, owner, guest2, roomId)
 }
+
+func TestReservedRoomIsJoinableByName(t *testing.T) {
+	address := startTestSystem(t)
+	owner := dialTestClient(t, address)
+	guest := dialTestClient(t, address)
+
+	if code := owner.createReservedRoom("lab-pixel", newTestKey(t)); code != 0 {
+		t.Fatalf("expected the room to be created, got error %d", code)
+	}
+	joinRoomAndAccept(t, owner, guest, "lab-pixel")
+}
+
+func TestReservedRoomRejectsAnotherIdentity(t *testing.T) {
+	address := startTestSystem(t)
+	owner := dialTestClient(t, address)
+	if code := owner.createReservedRoom("lab-pixel", newTestKey(t)); code != 0 {
+		t.Fatalf("expected the room to be created, got error %d", code)
+	}
+	_ = owner.conn.Close()
+
+	squatter := dialTestClient(t, address)
+	if code := squatter.createReservedRoom("lab-pixel", newTestKey(t)); code != protocol.ErrorRoomReserved {
+		t.Fatalf("expected error %d, got %d", protocol.ErrorRoomReserved, code)
+	}
+}
+
+func TestReservedRoomRejectsBadSignature(t *testing.T) {
+	address := startTestSystem(t)
+	owner := dialTestClient(t, address)
+	key := newTestKey(t)
+
+	// A signature made for another connection doesn't carry over.
+	response := owner.requestRoom(&protocol.TransporterMessagePayloadCreateRoom{
+		RoomId:    "lab-pixel",
+		PublicKey: key.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(key, protocol.RoomReservationMessage("lab-pixel", "ABCD1234")),
+	})
+	if !response.IsError() {
+		t.Fatalf("expected an error response for a bad signature")
+	}
+	payload, err := response.GetErrorPayload()
+	if err != nil {
+		t.Fatalf("GetErrorPayload failed: %s", err)
+	}
+	if payload.ErrorCode != protocol.ErrorInvalidSignature {
+		t.Fatalf("expected error code %d, got %d", protocol.ErrorInvalidSignature, payload.ErrorCode)
+	}
+}
+
+func TestReservedRoomIsTakenOverByItsOwner(t *testing.T) {
+	address := startTestSystem(t)
+	key := newTestKey(t)
+	stale := dialTestClient(t, address)
+	if code := stale.createReservedRoom("lab-pixel", key); code != 0 {
+		t.Fatalf("expected the room to be created, got error %d", code)
+	}
+
+	owner := dialTestClient(t, address)
+	if code := owner.createReservedRoom("lab-pixel", key); code != 0 {
+		t.Fatalf("expected the owner to take its room over, got error %d", code)
+	}
+	_ = stale.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if err := protocol.CreateTransporterMessage().Read(stale.conn); err == nil {
+		t.Fatalf("expected the previous owner's connection to be closed")
+	}
+	guest := dialTestClient(t, address)
+	joinRoomAndAccept(t, owner, guest, "lab-pixel")
+}
+
+func TestReservedRoomSurvivesTransporterRestart(t *testing.T) {
+	reservationsPath := filepath.Join(t.TempDir(), "reservations.json")
+	reservations := loadTestReservations(t, reservationsPath)
+	owner := dialTestClient(t, startTestSystemWithReservations(t, reservations))
+	if code := owner.createReservedRoom("lab-pixel", newTestKey(t)); code != 0 {
+		t.Fatalf("expected the room to be created, got error %d", code)
+	}
+	reservations.Flush()
+
+	squatter := dialTestClient(t, startTestSystemWithReservations(t, loadTestReservations(t, reservationsPath)))
+	if code := squatter.createReservedRoom("lab-pixel", newTestKey(t)); code != protocol.ErrorRoomReserved {
+		t.Fatalf("expected error %d after a restart, got %d", protocol.ErrorRoomReserved, code)
+	}
+}
+
+func TestPublishedRoomIsListedToItsTeam(t *testing.T) {
+	address := startTestSystem(t)
+	owner := dialTestClient(t, address)
+	roomId := owner.createRoom()
+	if code := owner.publishRoom(roomId, newTestKey(t), &protocol.TransporterMessagePayloadPublishRoom{Team: "mobile", TeamToken: "secret", Label: "Pixel lab", Models: []string{"Pixel_7"}, Tags: []string{"arm64"}}); code != 0 {
+		t.Fatalf("expected the room to be published, got error %d", code)
+	}
+	// An unpublished room isn't listed.
+	dialTestClient(t, address).createRoom()
+
+	guest := dialTestClient(t, address)
+	rooms, code := guest.listRooms("mobile", "secret")
+	if code != 0 {
+		t.Fatalf("expected the rooms to be listed, got error %d", code)
+	}
+	if len(rooms) != 1 || rooms[0].RoomId != roomId || rooms[0].Label != "Pixel lab" || rooms[0].Occupied != 0 {
+		t.Fatalf("expected only the published room, got %+v", rooms)
+	}
+
+	joinRoomAndAccept(t, owner, guest, roomId)
+	rooms, _ = dialTestClient(t, address).listRooms("mobile", "secret")
+	if len(rooms) != 1 || rooms[0].Occupied == 0 {
+		t.Fatalf("expected the room to be listed as occupied, got %+v", rooms)
+	}
+}
+
+func TestListingIsSignedByTheRoomsIdentity(t *testing.T) {
+	address := startTestSystem(t)
+	owner := dialTestClient(t, address)
+	roomId := owner.createRoom()
+
+	// Somebody else's key can't sign for this connection.
+	someoneElse := newTestKey(t)
+	published := &protocol.TransporterMessagePayloadPublishRoom{Team: "mobile", TeamToken: "secret"}
+	owner.publishRoom(roomId, newTestKey(t), published)
+	published.PublicKey = someoneElse.Public().(ed25519.PublicKey)
+	message := protocol.CreateTransporterMessage()
+	message.SetDirectCommand(protocol.CommandPublishRoom)
+	if err := message.SetPayloadPublishRoom(published); err != nil {
+		t.Fatalf("SetPayloadPublishRoom failed: %s", err)
+	}
+	if err := message.Write(owner.conn); err != nil {
+		t.Fatalf("failed to write the publish room request: %s", err)
+	}
+	if code := owner.expectResponse(protocol.CommandPublishRoom).errorCode; code != protocol.ErrorInvalidSignature {
+		t.Fatalf("expected error %d for a listing signed by another key, got %d", protocol.ErrorInvalidSignature, code)
+	}
+
+	// A reserved room is only listed under the identity it's reserved for,
+	// even with a valid signature from another one.
+	reserved := dialTestClient(t, address)
+	if code := reserved.createReservedRoom("lab-pixel", newTestKey(t)); code != 0 {
+		t.Fatalf("expected the room to be created, got error %d", code)
+	}
+	if code := reserved.publishRoom("lab-pixel", newTestKey(t), &protocol.TransporterMessagePayloadPublishRoom{Team: "mobile", TeamToken: "secret"}); code != protocol.ErrorInvalidSignature {
+		t.Fatalf("expected error %d listing a reserved room under another identity, got %d", protocol.ErrorInvalidSignature, code)
+	}
+	if rooms, _ := dialTestClient(t, address).listRooms("mobile", "secret"); len(rooms) != 1 || rooms[0].RoomId != roomId {
+		t.Fatalf("expected only the first listing to stand, got %+v", rooms)
+	}
+}
+
+func TestDirectoryNeedsTheTeamToken(t *testing.T) {
+	address := startTestSystem(t)
+	owner := dialTestClient(t, address)
+	roomId := owner.createRoom()
+	if code := owner.publishRoom(roomId, newTestKey(t), &protocol.TransporterMessagePayloadPublishRoom{Team: "mobile", TeamToken: "guess"}); code != protocol.ErrorTeamAccessDenied {
+		t.Fatalf("expected error %d publishing with a wrong token, got %d", protocol.ErrorTeamAccessDenied, code)
+	}
+	if _, code := dialTestClient(t, address).listRooms("mobile", "guess"); code != protocol.ErrorTeamAccessDenied {
+		t.Fatalf("expected error %d listing with a wrong token, got %d", protocol.ErrorTeamAccessDenied, code)
+	}
+	if _, code := dialTestClient(t, address).listRooms("web", "secret"); code != protocol.ErrorTeamAccessDenied {
+		t.Fatalf("expected error %d listing an unknown team, got %d", protocol.ErrorTeamAccessDenied, code)
+	}
+}
+
+func TestPublishingNeedsARoom(t *testing.T) {
+	address := startTestSystem(t)
+	client := dialTestClient(t, address)
+	if code := client.publishRoom("", newTestKey(t), &protocol.TransporterMessagePayloadPublishRoom{Team: "mobile", TeamToken: "secret"}); code != protocol.ErrorRoomNotFound {
+		t.Fatalf("expected error %d, got %d", protocol.ErrorRoomNotFound, code)
+	}
+}
+
+func TestClosedRoomIsUnlisted(t *testing.T) {
+	address := startTestSystem(t)
+	owner := dialTestClient(t, address)
+	roomId := owner.createRoom()
+	if code := owner.publishRoom(roomId, newTestKey(t), &protocol.TransporterMessagePayloadPublishRoom{Team: "mobile", TeamToken: "secret"}); code != 0 {
+		t.Fatalf("expected the room to be published, got error %d", code)
+	}
+	_ = owner.conn.Close()
+
+	lister := dialTestClient(t, address)
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		rooms, _ := lister.listRooms("mobile", "secret")
+		if len(rooms) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the closed room to be unlisted, got %+v", rooms)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
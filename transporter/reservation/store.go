@@ -0,0 +1,244 @@
+// Package reservation keeps the transporter's reserved room ids: room ids
+// an owner asked for by name, bound to the identity public key (see
+// client/identity) that asked first, so the owner can share at the same
+// room id across its own and the transporter's restarts. A reservation
+// lapses once its owner hasn't created its room for Lifetime, and there
+// are at most MaxReservations at a time. Reservations are persisted to a
+// JSON file, rewritten in the background after every change.
+package reservation
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// MaxReservations bounds how many room ids are reserved at a time, across
+// all identities: since an identity is only a key pair anyone can
+// generate, bounding each identity's alone wouldn't bound the store.
+const MaxReservations = 4096
+
+// MaxPerIdentity bounds how many room ids a single identity can reserve,
+// so one owner can't take all MaxReservations by mistake.
+const MaxPerIdentity = 16
+
+// Lifetime is how long a reservation lasts after its owner last created
+// its room; once it lapses, the room id is anybody's to reserve again.
+const Lifetime = 90 * 24 * time.Hour
+
+// roomIdPattern is what a reserved room id must look like: short enough to
+// read out, and safe to print and put on a command line.
+var roomIdPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{2,63}$`)
+
+// ErrReservedForOther is returned by Reserve for a room id another
+// identity reserved.
+var ErrReservedForOther = errors.New("the room id is reserved for another identity")
+
+// ErrTooManyReservations is returned by Reserve once the identity has
+// MaxPerIdentity room ids reserved already.
+var ErrTooManyReservations = fmt.Errorf("an identity can't reserve more than %d room ids", MaxPerIdentity)
+
+// ErrStoreFull is returned by Reserve while MaxReservations room ids are
+// reserved, until one lapses.
+var ErrStoreFull = errors.New("the transporter can't reserve any more room ids")
+
+// ValidateRoomId reports why roomId can't be reserved, if it can't.
+func ValidateRoomId(roomId string) error {
+	if !roomIdPattern.MatchString(roomId) {
+		return fmt.Errorf("invalid room id %q: it must be 3 to 64 letters, digits, '.', '_' or '-', starting with a letter or digit", roomId)
+	}
+	return nil
+}
+
+// Store is the set of reserved room ids. It's safe for concurrent use.
+type Store struct {
+	path   string
+	logger *slog.Logger
+	// capacity is MaxReservations but in tests, and now the clock.
+	capacity int
+	now      func() time.Time
+
+	mutex sync.Mutex
+	// owners maps each reserved room id to its owner's public key, and
+	// used to when the owner last created the room.
+	owners map[string][]byte
+	used   map[string]time.Time
+	// dirty is set by a change the file doesn't have yet, and writing
+	// while a goroutine writes them; idle is signalled when it stops.
+	dirty   bool
+	writing bool
+	idle    sync.Cond
+}
+
+// storeFile is the JSON layout of the store's file.
+type storeFile struct {
+	// Rooms maps each reserved room id to its owner's public key (base64,
+	// as encoding/json encodes a []byte).
+	Rooms map[string][]byte `json:"rooms"`
+	// Used maps each reserved room id to when its owner last created the
+	// room; a room id missing from it counts as used when loaded.
+	Used map[string]time.Time `json:"used,omitempty"`
+}
+
+// Load reads the store persisted at path; a missing file is an empty
+// store, created on the first reservation. Failures to write it later are
+// logged to logger.
+func Load(path string, logger *slog.Logger) (*Store, error) {
+	store := &Store{
+		path:     path,
+		logger:   logger,
+		capacity: MaxReservations,
+		now:      time.Now,
+		owners:   make(map[string][]byte),
+		used:     make(map[string]time.Time),
+	}
+	store.idle.L = &store.mutex
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file storeFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid room reservations file %s: %w", path, err)
+	}
+	loadedAt := store.now()
+	for roomId, publicKey := range file.Rooms {
+		store.owners[roomId] = publicKey
+		store.used[roomId] = loadedAt
+		if used, ok := file.Used[roomId]; ok {
+			store.used[roomId] = used
+		}
+	}
+	return store, nil
+}
+
+// IsReserved reports whether roomId is reserved for any identity.
+func (s *Store) IsReserved(roomId string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.owners[roomId]
+	return ok && !s.lapsed(roomId)
+}
+
+// Reserve reserves roomId for publicKey, unless it already is, and starts
+// its Lifetime over. It fails with ErrReservedForOther if another identity
+// reserved it, with ErrTooManyReservations if publicKey has too many
+// already, and with ErrStoreFull if the store does. It doesn't wait for
+// the change to be persisted, so it's cheap enough to call while handling
+// a request; see Flush. The caller is expected to have checked publicKey's
+// signature.
+func (s *Store) Reserve(roomId string, publicKey []byte) error {
+	if err := ValidateRoomId(roomId); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.removeLapsed()
+	if owner, ok := s.owners[roomId]; ok {
+		if !bytes.Equal(owner, publicKey) {
+			return ErrReservedForOther
+		}
+		s.used[roomId] = s.now()
+		s.changed()
+		return nil
+	}
+	if len(s.owners) >= s.capacity {
+		return ErrStoreFull
+	}
+	count := 0
+	for _, owner := range s.owners {
+		if bytes.Equal(owner, publicKey) {
+			count++
+		}
+	}
+	if count >= MaxPerIdentity {
+		return ErrTooManyReservations
+	}
+	s.owners[roomId] = bytes.Clone(publicKey)
+	s.used[roomId] = s.now()
+	s.changed()
+	return nil
+}
+
+// Flush waits until every change made so far is persisted, or failed to
+// be.
+func (s *Store) Flush() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for s.writing {
+		s.idle.Wait()
+	}
+}
+
+// lapsed reports whether roomId's reservation has lapsed. It is called
+// with mutex held.
+func (s *Store) lapsed(roomId string) bool {
+	return s.now().Sub(s.used[roomId]) > Lifetime
+}
+
+// removeLapsed removes the reservations that have lapsed. It is called
+// with mutex held.
+func (s *Store) removeLapsed() {
+	for roomId := range s.owners {
+		if s.lapsed(roomId) {
+			delete(s.owners, roomId)
+			delete(s.used, roomId)
+			s.changed()
+		}
+	}
+}
+
+// changed has the store's file rewritten, by a goroutine of its own so
+// that the caller doesn't wait on the disk. It is called with mutex held.
+func (s *Store) changed() {
+	s.dirty = true
+	if !s.writing {
+		s.writing = true
+		go s.writeBack()
+	}
+}
+
+// writeBack persists the store until no change is left to.
+func (s *Store) writeBack() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for s.dirty {
+		s.dirty = false
+		data, err := json.MarshalIndent(storeFile{Rooms: s.owners, Used: s.used}, "", "  ")
+		if err == nil {
+			s.mutex.Unlock()
+			err = s.persist(data)
+			s.mutex.Lock()
+		}
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to save the room reservations to %s: %s", s.path, err))
+		}
+	}
+	s.writing = false
+	s.idle.Broadcast()
+}
+
+// persist rewrites the store's file with data, through a temporary file
+// renamed over it so a crash never leaves it half written.
+func (s *Store) persist(data []byte) error {
+	if dir := filepath.Dir(s.path); dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+	temporary := s.path + ".tmp"
+	if err := os.WriteFile(temporary, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, s.path)
+}
@@ -0,0 +1,134 @@
+package reservation
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// loadTestStore loads the store at path, flushing it when the test ends
+// so that its temporary directory can go.
+func loadTestStore(t *testing.T, path string) *Store {
+	t.Helper()
+	store, err := Load(path, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("Load failed: %s", err)
+	}
+	t.Cleanup(store.Flush)
+	return store
+}
+
+func TestReserveIsPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reservations.json")
+	store := loadTestStore(t, path)
+	if err := store.Reserve("lab-pixel", []byte("owner")); err != nil {
+		t.Fatalf("Reserve failed: %s", err)
+	}
+	store.Flush()
+
+	reloaded := loadTestStore(t, path)
+	if !reloaded.IsReserved("lab-pixel") {
+		t.Fatalf("expected the reservation to survive a reload")
+	}
+	if err := reloaded.Reserve("lab-pixel", []byte("owner")); err != nil {
+		t.Fatalf("expected the owner to get its room id again, got %s", err)
+	}
+}
+
+func TestReserveRejectsAnotherIdentity(t *testing.T) {
+	store := loadTestStore(t, filepath.Join(t.TempDir(), "reservations.json"))
+	if err := store.Reserve("lab-pixel", []byte("owner")); err != nil {
+		t.Fatalf("Reserve failed: %s", err)
+	}
+	if err := store.Reserve("lab-pixel", []byte("someone else")); !errors.Is(err, ErrReservedForOther) {
+		t.Fatalf("expected ErrReservedForOther, got %v", err)
+	}
+}
+
+func TestReserveRejectsInvalidRoomIds(t *testing.T) {
+	store := loadTestStore(t, filepath.Join(t.TempDir(), "reservations.json"))
+	for _, roomId := range []string{"", "ab", "-lab", "lab pixel", "lab/pixel"} {
+		if err := store.Reserve(roomId, []byte("owner")); err == nil {
+			t.Fatalf("expected %q to be rejected", roomId)
+		}
+	}
+}
+
+func TestReserveIsBoundedPerIdentity(t *testing.T) {
+	store := loadTestStore(t, filepath.Join(t.TempDir(), "reservations.json"))
+	for i := range MaxPerIdentity {
+		if err := store.Reserve(fmt.Sprintf("room-%d", i), []byte("owner")); err != nil {
+			t.Fatalf("Reserve failed: %s", err)
+		}
+	}
+	if err := store.Reserve("one-more", []byte("owner")); !errors.Is(err, ErrTooManyReservations) {
+		t.Fatalf("expected ErrTooManyReservations, got %v", err)
+	}
+	if err := store.Reserve("one-more", []byte("another owner")); err != nil {
+		t.Fatalf("expected another identity to be unaffected, got %s", err)
+	}
+}
+
+func TestReserveIsBoundedOverall(t *testing.T) {
+	store := loadTestStore(t, filepath.Join(t.TempDir(), "reservations.json"))
+	store.capacity = 3
+	// Every reservation from an identity of its own, as anyone can make up
+	// identities.
+	for i := range store.capacity {
+		if err := store.Reserve(fmt.Sprintf("room-%d", i), []byte(fmt.Sprintf("owner %d", i))); err != nil {
+			t.Fatalf("Reserve failed: %s", err)
+		}
+	}
+	if err := store.Reserve("one-more", []byte("yet another owner")); !errors.Is(err, ErrStoreFull) {
+		t.Fatalf("expected ErrStoreFull, got %v", err)
+	}
+	if err := store.Reserve("room-0", []byte("owner 0")); err != nil {
+		t.Fatalf("expected an owner to get its room id again, got %s", err)
+	}
+}
+
+func TestReservationLapsesUnlessUsed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reservations.json")
+	store := loadTestStore(t, path)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	for _, roomId := range []string{"lab-pixel", "lab-galaxy"} {
+		if err := store.Reserve(roomId, []byte("owner")); err != nil {
+			t.Fatalf("Reserve failed: %s", err)
+		}
+	}
+	now = now.Add(Lifetime / 2)
+	if err := store.Reserve("lab-pixel", []byte("owner")); err != nil {
+		t.Fatalf("Reserve failed: %s", err)
+	}
+	now = now.Add(Lifetime/2 + time.Hour)
+	if !store.IsReserved("lab-pixel") || store.IsReserved("lab-galaxy") {
+		t.Fatalf("expected only the room id left unused to lapse")
+	}
+	if err := store.Reserve("lab-galaxy", []byte("someone else")); err != nil {
+		t.Fatalf("expected the lapsed room id to be free, got %s", err)
+	}
+	store.Flush()
+
+	// The time each room id was last used survives a reload.
+	reloaded := loadTestStore(t, path)
+	reloaded.now = func() time.Time { return now.Add(Lifetime/2 + time.Hour) }
+	if reloaded.IsReserved("lab-pixel") || !reloaded.IsReserved("lab-galaxy") {
+		t.Fatalf("expected the reload to keep when the room ids were last used")
+	}
+}
+
+func TestLoadRejectsInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reservations.json")
+	if err := os.WriteFile(path, []byte("not json"), 0o600); err != nil {
+		t.Fatalf("failed to write the test file: %s", err)
+	}
+	if _, err := Load(path, slog.New(slog.NewTextHandler(io.Discard, nil))); err == nil {
+		t.Fatalf("expected an error for an invalid file")
+	}
+}